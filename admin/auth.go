@@ -0,0 +1,289 @@
+package admin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/audit"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// Role is what a token may do; each role includes the ones below it
+type Role int
+
+// Roles, from least to most privileged
+const (
+	RoleNone Role = iota
+	// RoleViewer reads stats and status
+	RoleViewer
+	// RoleOperator also pauses, requeues, cancels and reconfigures
+	RoleOperator
+	// RoleAdmin also purges, bulk-deletes and migrates
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{RoleViewer: "viewer", RoleOperator: "operator", RoleAdmin: "admin"}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "none"
+}
+
+// ParseRole parses viewer, operator or admin
+func ParseRole(s string) (Role, error) {
+	for r, name := range roleNames {
+		if name == s {
+			return r, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q, want viewer, operator or admin", s)
+}
+
+// Policy names the operation a request performs and the role it requires
+type Policy func(r *http.Request) (op string, role Role)
+
+// Allow requires role for every request
+func Allow(op string, role Role) Policy {
+	return func(*http.Request) (string, Role) { return op, role }
+}
+
+// ReadWrite requires the viewer role for GET and HEAD, and write for the
+// other methods; the operation is op with ".read" or ".write" appended
+func ReadWrite(op string, write Role) Policy {
+	return func(r *http.Request) (string, Role) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return op + ".read", RoleViewer
+		}
+		return op + ".write", write
+	}
+}
+
+// DefaultTokenRate is how many requests per second a token may make unless
+// ADMIN_TOKEN_RATE or its own rate says otherwise
+const DefaultTokenRate = 10.0
+
+// TokenConfig defines one token. The secret is given inline, or read from
+// an environment variable or file so a secrets manager can inject it.
+type TokenConfig struct {
+	Name      string  `yaml:"name"`
+	Role      string  `yaml:"role"`
+	Token     string  `yaml:"token"`
+	TokenEnv  string  `yaml:"token_env"`
+	TokenFile string  `yaml:"token_file"`
+	Rate      float64 `yaml:"rate"`
+}
+
+// secret resolves the token of c
+func (c TokenConfig) secret() (string, error) {
+	switch {
+	case c.Token != "":
+		return c.Token, nil
+	case c.TokenEnv != "":
+		if v := os.Getenv(c.TokenEnv); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("%s is not set", c.TokenEnv)
+	case c.TokenFile != "":
+		data, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token file: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", fmt.Errorf("no token, token_env or token_file")
+}
+
+// token is a resolved token; only the digest of the secret is kept
+type token struct {
+	name    string
+	role    Role
+	digest  [sha256.Size]byte
+	limiter *rate.Limiter
+}
+
+// AccessLog records admin API accesses, e.g. the audit store
+type AccessLog interface {
+	RecordAccess(ctx context.Context, a audit.Access) error
+}
+
+// Authorizer checks admin API requests against tokens with roles
+type Authorizer struct {
+	tokens []*token
+	log    AccessLog
+}
+
+// NewAuthorizer resolves the tokens; defaultRate applies to tokens without
+// a rate. accessLog may be nil to only log denied requests.
+func NewAuthorizer(configs []TokenConfig, defaultRate float64, accessLog AccessLog) (*Authorizer, error) {
+	a := &Authorizer{log: accessLog}
+	names := make(map[string]bool, len(configs))
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("admin token without a name")
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("admin token %s is defined twice", c.Name)
+		}
+		names[c.Name] = true
+		role, err := ParseRole(c.Role)
+		if err != nil {
+			return nil, fmt.Errorf("admin token %s: %v", c.Name, err)
+		}
+		secret, err := c.secret()
+		if err != nil {
+			return nil, fmt.Errorf("admin token %s: %v", c.Name, err)
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("admin token %s is empty", c.Name)
+		}
+		limit := c.Rate
+		if limit <= 0 {
+			limit = defaultRate
+		}
+		a.tokens = append(a.tokens, &token{
+			name:    c.Name,
+			role:    role,
+			digest:  sha256.Sum256([]byte(secret)),
+			limiter: rate.NewLimiter(rate.Limit(limit), int(2*limit)+1),
+		})
+	}
+	return a, nil
+}
+
+// AuthorizerFromEnv reads the tokens of ADMIN_TOKENS_FILE, a YAML file with
+// a "tokens" list of TokenConfig. A legacy ADMIN_TOKEN is added as a token
+// named "admin" with the admin role. ADMIN_TOKEN_RATE overrides
+// DefaultTokenRate.
+func AuthorizerFromEnv(accessLog AccessLog) (*Authorizer, error) {
+	var file struct {
+		Tokens []TokenConfig `yaml:"tokens"`
+	}
+	if path := os.Getenv("ADMIN_TOKENS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ADMIN_TOKENS_FILE: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse ADMIN_TOKENS_FILE %s: %v", path, err)
+		}
+	}
+	if token := TokenFromEnv(); token != "" {
+		file.Tokens = append(file.Tokens, TokenConfig{Name: "admin", Role: RoleAdmin.String(), Token: token})
+	}
+	limit := DefaultTokenRate
+	if v := os.Getenv("ADMIN_TOKEN_RATE"); v != "" {
+		var err error
+		if limit, err = strconv.ParseFloat(v, 64); err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid ADMIN_TOKEN_RATE %q", v)
+		}
+	}
+	return NewAuthorizer(file.Tokens, limit, accessLog)
+}
+
+// Tokens returns how many tokens are configured
+func (a *Authorizer) Tokens() int {
+	return len(a.tokens)
+}
+
+// hasToken reports whether a token is named name
+func (a *Authorizer) hasToken(name string) bool {
+	for _, t := range a.tokens {
+		if t.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the token of "Authorization: Bearer <token>", nil
+// when none matches. Every token is compared, in constant time, so timing
+// tells nothing about which tokens exist.
+func (a *Authorizer) authenticate(r *http.Request) *token {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || got == "" {
+		return nil
+	}
+	digest := sha256.Sum256([]byte(got))
+	var match *token
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(digest[:], t.digest[:]) == 1 {
+			match = t
+		}
+	}
+	return match
+}
+
+// Authenticate returns the name and role of the request's token, RoleNone
+// when it has none or an unknown one. It is for handlers that are public
+// but offer some options to privileged tokens only.
+func (a *Authorizer) Authenticate(r *http.Request) (string, Role) {
+	if a == nil {
+		return "", RoleNone
+	}
+	t := a.authenticate(r)
+	if t == nil {
+		return "", RoleNone
+	}
+	return t.name, t.role
+}
+
+// statusRecorder keeps the status an authorized handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Require lets through requests whose token has the role policy asks for,
+// within the token's rate, and logs every request to the access log
+func (a *Authorizer) Require(policy Policy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, role := policy(r)
+		access := audit.Access{At: time.Now(), Operation: op, Method: r.Method, Path: r.URL.Path}
+		t := a.authenticate(r)
+		if t != nil {
+			access.Token, access.Role = t.name, t.role.String()
+		}
+		switch {
+		case t == nil:
+			access.Outcome, access.Status = audit.OutcomeUnauthenticated, http.StatusUnauthorized
+			WriteError(w, access.Status, "invalid admin token")
+		case t.role < role:
+			access.Outcome, access.Status = audit.OutcomeForbidden, http.StatusForbidden
+			WriteError(w, access.Status, fmt.Sprintf("%s requires the %s role", op, role))
+		case !t.limiter.Allow():
+			access.Outcome, access.Status = audit.OutcomeRateLimited, http.StatusTooManyRequests
+			WriteError(w, access.Status, "rate limit exceeded")
+		default:
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(rec, r)
+			access.Outcome, access.Status = audit.OutcomeAllowed, rec.status
+		}
+		if access.Outcome != audit.OutcomeAllowed {
+			log.Printf("⚠️  Admin API %s %s (%s) %s for token %q", r.Method, r.URL.Path, op, access.Outcome, access.Token)
+		}
+		if a.log == nil {
+			return
+		}
+		// The request context may be done once the response is written
+		if err := a.log.RecordAccess(context.Background(), access); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package admin_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"asynqdemo/admin"
+	"asynqdemo/audit"
+	"asynqdemo/queues"
+)
+
+// accessRecorder is an in-memory admin.AccessLog
+type accessRecorder struct {
+	mu       sync.Mutex
+	accesses []audit.Access
+}
+
+func (r *accessRecorder) RecordAccess(ctx context.Context, a audit.Access) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.accesses = append(r.accesses, a)
+	return nil
+}
+
+// TestAdminRoles sends a viewer, an operator and an admin operation of
+// the admin API with a token of each role, an unknown token and no token,
+// and fails unless each is allowed exactly when the role suffices and
+// every request is in the access log. It also checks that a token beyond
+// its rate is limited.
+func TestAdminRoles(t *testing.T) {
+	log := &accessRecorder{}
+	authz, err := admin.NewAuthorizer([]admin.TokenConfig{
+		{Name: "grafana", Role: "viewer", Token: "viewer-token-0123456789"},
+		{Name: "oncall", Role: "operator", Token: "operator-token-0123456789"},
+		{Name: "sre", Role: "admin", Token: "admin-token-0123456789"},
+		{Name: "script", Role: "viewer", Token: "script-token-0123456789", Rate: 1},
+	}, 1000, log)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin.WriteJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/queues", authz.Require(admin.ReadWrite("queues", admin.RoleOperator), ok))
+	mux.Handle("/admin/queues/", authz.Require(queues.ActionPolicy, ok))
+
+	ops := []struct {
+		method, path string
+		role         admin.Role
+	}{
+		{http.MethodGet, "/admin/queues", admin.RoleViewer},
+		{http.MethodPost, "/admin/queues/default/pause", admin.RoleOperator},
+		{http.MethodPost, "/admin/queues/default/migrate?to=low", admin.RoleAdmin},
+	}
+	tokens := []struct {
+		token string
+		role  admin.Role
+	}{
+		{"", admin.RoleNone},
+		{"unknown-token-0123456789", admin.RoleNone},
+		{"viewer-token-0123456789", admin.RoleViewer},
+		{"operator-token-0123456789", admin.RoleOperator},
+		{"admin-token-0123456789", admin.RoleAdmin},
+	}
+	send := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	sent := 0
+	for _, tok := range tokens {
+		for _, op := range ops {
+			want := http.StatusOK
+			switch {
+			case tok.role == admin.RoleNone:
+				want = http.StatusUnauthorized
+			case tok.role < op.role:
+				want = http.StatusForbidden
+			}
+			if got := send(op.method, op.path, tok.token); got != want {
+				t.Errorf("%s %s as %s: status %d, want %d", op.method, op.path, tok.role, got, want)
+			}
+			sent++
+		}
+	}
+
+	limited := false
+	for i := 0; i < 10 && !limited; i++ {
+		limited = send(http.MethodGet, "/admin/queues", "script-token-0123456789") == http.StatusTooManyRequests
+		sent++
+	}
+	if !limited {
+		t.Errorf("token with a rate of 1/s was not limited")
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if len(log.accesses) != sent {
+		t.Fatalf("access log has %d entries for %d requests", len(log.accesses), sent)
+	}
+	for _, a := range log.accesses {
+		if a.Operation == "" || a.Outcome == "" || a.Status == 0 {
+			t.Errorf("incomplete access log entry %+v", a)
+		}
+		if a.Outcome == audit.OutcomeAllowed && a.Token == "" {
+			t.Errorf("allowed access without a token name: %+v", a)
+		}
+	}
+}
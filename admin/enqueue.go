@@ -0,0 +1,270 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// AnyToken names the enqueue policy of tokens without one of their own and
+// of requests without a token
+const AnyToken = "*"
+
+// Constraints an enqueue may violate
+const (
+	ConstraintType     = "type"
+	ConstraintQueue    = "queue"
+	ConstraintMaxDelay = "max_delay"
+	ConstraintMaxBatch = "max_batch"
+)
+
+// EnqueuePolicy limits what a token may enqueue through the API. Types and
+// queues are allowlists of path.Match patterns such as "email:*"; an empty
+// list allows any, as does a zero maximum.
+type EnqueuePolicy struct {
+	Types    []string      `yaml:"types"`
+	Queues   []string      `yaml:"queues"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+	MaxBatch int           `yaml:"max_batch"`
+}
+
+// EnqueueAttempt is what a request asks to enqueue; Batch is the number of
+// tasks it enqueues at once
+type EnqueueAttempt struct {
+	Type  string
+	Queue string
+	Delay time.Duration
+	Batch int
+}
+
+// PolicyViolation is the constraint of its policy an enqueue broke
+type PolicyViolation struct {
+	Token      string `json:"token,omitempty"`
+	Constraint string `json:"constraint"`
+	Detail     string `json:"detail"`
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("enqueue policy violated (%s): %s", v.Constraint, v.Detail)
+}
+
+// WritePolicyViolation answers 403 naming the violated constraint
+func WritePolicyViolation(w http.ResponseWriter, v *PolicyViolation) {
+	WriteJSON(w, http.StatusForbidden, map[string]string{"error": v.Error(), "constraint": v.Constraint})
+}
+
+// Check returns the first constraint a violates, nil when p allows it
+func (p EnqueuePolicy) Check(a EnqueueAttempt) *PolicyViolation {
+	queue := a.Queue
+	if queue == "" {
+		queue = "default"
+	}
+	switch {
+	case !matchAny(p.Types, a.Type):
+		return &PolicyViolation{Constraint: ConstraintType, Detail: fmt.Sprintf("task type %s is not in %v", a.Type, p.Types)}
+	case !matchAny(p.Queues, queue):
+		return &PolicyViolation{Constraint: ConstraintQueue, Detail: fmt.Sprintf("queue %s is not in %v", queue, p.Queues)}
+	case p.MaxDelay > 0 && a.Delay > p.MaxDelay:
+		return &PolicyViolation{Constraint: ConstraintMaxDelay, Detail: fmt.Sprintf("delay %v is over %v", a.Delay, p.MaxDelay)}
+	case p.MaxBatch > 0 && a.Batch > p.MaxBatch:
+		return &PolicyViolation{Constraint: ConstraintMaxBatch, Detail: fmt.Sprintf("batch of %d is over %d", a.Batch, p.MaxBatch)}
+	}
+	return nil
+}
+
+// matchAny reports whether name matches one of patterns, or patterns is empty
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check validates the patterns of p
+func (p EnqueuePolicy) check() error {
+	for _, list := range [][]string{p.Types, p.Queues} {
+		for _, pattern := range list {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q", pattern)
+			}
+		}
+	}
+	if p.MaxDelay < 0 || p.MaxBatch < 0 {
+		return fmt.Errorf("max_delay and max_batch must not be negative")
+	}
+	return nil
+}
+
+// abuse counts the violations of a token in the current window
+type abuse struct {
+	since   time.Time
+	count   int
+	alerted bool
+}
+
+// EnqueuePolicies enforces the enqueue policies of a YAML file with a
+// "policies" map from token name to EnqueuePolicy. The file is reread
+// every Interval, so edits apply without a restart.
+type EnqueuePolicies struct {
+	file  string
+	authz *Authorizer
+	// Alert reports a token violating its policy Threshold times within
+	// Window; nil only logs
+	Alert     func(ctx context.Context, text string) error
+	Threshold int
+	Window    time.Duration
+	// Interval is how often Run rereads the file
+	Interval time.Duration
+
+	violations *prometheus.CounterVec
+
+	mu       sync.Mutex
+	policies map[string]EnqueuePolicy
+	abuse    map[string]*abuse
+}
+
+// NewEnqueuePolicies loads the policies of file for the tokens of authz
+func NewEnqueuePolicies(file string, authz *Authorizer, reg prometheus.Registerer) (*EnqueuePolicies, error) {
+	p := &EnqueuePolicies{
+		file:      file,
+		authz:     authz,
+		Threshold: 10,
+		Window:    10 * time.Minute,
+		Interval:  10 * time.Second,
+		violations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "asynq_enqueue_policy_violations_total",
+			Help: "Enqueue API requests refused by the token's enqueue policy, by violated constraint.",
+		}, []string{"token", "constraint"}),
+		abuse: make(map[string]*abuse),
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(p.violations); err != nil {
+		return nil, fmt.Errorf("failed to register enqueue policy metrics: %v", err)
+	}
+	return p, nil
+}
+
+// Reload rereads the file; an invalid file keeps the previous policies
+func (p *EnqueuePolicies) Reload() error {
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return fmt.Errorf("failed to read enqueue policies: %v", err)
+	}
+	var file struct {
+		Policies map[string]EnqueuePolicy `yaml:"policies"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return fmt.Errorf("failed to parse enqueue policies %s: %v", p.file, err)
+	}
+	for name, policy := range file.Policies {
+		if name != AnyToken && !p.authz.hasToken(name) {
+			return fmt.Errorf("enqueue policy of %s in %s: no such token", name, p.file)
+		}
+		if err := policy.check(); err != nil {
+			return fmt.Errorf("enqueue policy of %s in %s: %v", name, p.file, err)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.policies != nil && !reflect.DeepEqual(p.policies, file.Policies) {
+		fmt.Printf("✅ Enqueue policies reloaded from %s: %d tokens\n", p.file, len(file.Policies))
+	}
+	p.policies = file.Policies
+	return nil
+}
+
+// Run rereads the file every Interval until ctx is done
+func (p *EnqueuePolicies) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := p.Reload(); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+	}
+}
+
+// Authorize checks a against the policy of the request's token, or the
+// AnyToken policy when the token has none. A violation is counted and
+// returned; nil policies allow everything.
+func (p *EnqueuePolicies) Authorize(r *http.Request, a EnqueueAttempt) *PolicyViolation {
+	if p == nil {
+		return nil
+	}
+	name, _ := p.authz.Authenticate(r)
+	p.mu.Lock()
+	policy, ok := p.policies[name]
+	if !ok || name == "" {
+		policy, ok = p.policies[AnyToken]
+	}
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	v := policy.Check(a)
+	if v == nil {
+		return nil
+	}
+	v.Token = name
+	p.record(r.Context(), v, time.Now())
+	return v
+}
+
+// record counts a violation and alerts once per window when the token
+// reaches the threshold
+func (p *EnqueuePolicies) record(ctx context.Context, v *PolicyViolation, now time.Time) {
+	label := v.Token
+	if label == "" {
+		label = "anonymous"
+	}
+	p.violations.WithLabelValues(label, v.Constraint).Inc()
+	log.Printf("⚠️  Enqueue by token %q refused: %v", v.Token, v)
+
+	p.mu.Lock()
+	a := p.abuse[label]
+	if a == nil || now.Sub(a.since) >= p.Window {
+		a = &abuse{since: now}
+		p.abuse[label] = a
+	}
+	a.count++
+	alert := a.count >= p.Threshold && !a.alerted
+	if alert {
+		a.alerted = true
+	}
+	count := a.count
+	p.mu.Unlock()
+	if !alert {
+		return
+	}
+	text := fmt.Sprintf("Token %q violated its enqueue policy %d times within %v, last: %s", label, count, p.Window, v.Detail)
+	log.Printf("❌ %s", text)
+	if p.Alert != nil {
+		if err := p.Alert(context.WithoutCancel(ctx), text); err != nil {
+			log.Printf("❌ Failed to alert about enqueue policy abuse: %v", err)
+		}
+	}
+}
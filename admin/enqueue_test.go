@@ -0,0 +1,172 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"asynqdemo/admin"
+	"asynqdemo/api"
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// enqueuePolicies restricts the reporting token and every other request
+const enqueuePolicies = `policies:
+  reporting:
+    types: ["server:*"]
+    queues: ["low", "default"]
+    max_delay: 1h
+  "*":
+    types: ["email:*", "welcome:message"]
+    queues: ["*"]
+    max_batch: 2
+`
+
+// TestEnqueuePolicies sends enqueue and batch requests under the
+// policies of a file and fails unless each constraint (task type, queue,
+// delay, batch size) refuses with 403 naming it, wildcards match, tokens
+// without a policy and requests without a token get the "*" policy,
+// violations are counted and alert once a token repeats them, and an
+// edited file applies after Reload.
+func TestEnqueuePolicies(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	authz, err := admin.NewAuthorizer([]admin.TokenConfig{
+		{Name: "reporting", Role: "viewer", Token: "reporting-token-0123456789"},
+		{Name: "billing", Role: "viewer", Token: "billing-token-0123456789"},
+	}, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	if err := os.WriteFile(path, []byte(enqueuePolicies), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	policies, err := admin.NewEnqueuePolicies(path, authz, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alerts []string
+	policies.Threshold = 3
+	policies.Alert = func(ctx context.Context, text string) error {
+		alerts = append(alerts, text)
+		return nil
+	}
+
+	enqueue := api.EnqueueHandler(client, nil, nil, authz, policies, nil, inspector, nil)
+	batch := api.NewBatchHandler(client, inspector, nil, nil, nil)
+	batch.Policies = policies
+	send := func(h http.Handler, token string, body interface{}) (int, string) {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(data)))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var resp struct {
+			Constraint string `json:"constraint"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp.Constraint
+	}
+	serverInfo := json.RawMessage(`{"timestamp":1,"source":"policy"}`)
+	welcome := json.RawMessage(`{"user_id":1,"username":"ada"}`)
+	email := json.RawMessage(`{"user_id":1,"email":"ada@example.com","subject":"Hi","message":"Hello"}`)
+
+	cases := []struct {
+		name       string
+		h          http.Handler
+		token      string
+		body       interface{}
+		constraint string
+	}{
+		{"server:* matches server:info", enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeServerInfo, Payload: serverInfo, Queue: "low"}, ""},
+		{"no queue is the default queue", enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeServerInfo, Payload: serverInfo}, ""},
+		{"type outside the allowlist", enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeWelcomeMessage, Payload: welcome}, admin.ConstraintType},
+		{"queue outside the allowlist", enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeServerInfo, Payload: serverInfo, Queue: "critical"}, admin.ConstraintQueue},
+		{"delay within max_delay", enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeServerInfo, Payload: serverInfo, ProcessInSeconds: 3600}, ""},
+		{"delay over max_delay", enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeServerInfo, Payload: serverInfo, ProcessInSeconds: 3601}, admin.ConstraintMaxDelay},
+		{"token without a policy gets *", enqueue, "billing-token-0123456789", api.EnqueueRequest{Type: common.TypeServerInfo, Payload: serverInfo}, admin.ConstraintType},
+		{"request without a token gets *", enqueue, "", api.EnqueueRequest{Type: common.TypeWelcomeMessage, Payload: welcome, Queue: "critical"}, ""},
+		{"batch within max_batch", batch, "", api.BatchRequest{Queue: "low", Items: []json.RawMessage{email, email}}, ""},
+		{"batch over max_batch", batch, "", api.BatchRequest{Items: []json.RawMessage{email, email, email}}, admin.ConstraintMaxBatch},
+		{"batch of a type outside the allowlist", batch, "reporting-token-0123456789", api.BatchRequest{Items: []json.RawMessage{email}}, admin.ConstraintType},
+	}
+	for _, c := range cases {
+		code, constraint := send(c.h, c.token, c.body)
+		switch {
+		case c.constraint == "" && code == http.StatusForbidden:
+			t.Errorf("%s: refused, want allowed", c.name)
+		case c.constraint != "" && (code != http.StatusForbidden || constraint != c.constraint):
+			t.Errorf("%s: status %d naming %q, want 403 naming %q", c.name, code, constraint, c.constraint)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			counted[labels["token"]+"/"+labels["constraint"]] = m.GetCounter().GetValue()
+		}
+	}
+	want := map[string]float64{"reporting/type": 2, "reporting/queue": 1, "reporting/max_delay": 1, "billing/type": 1, "anonymous/max_batch": 1}
+	for key, n := range want {
+		if counted[key] != n {
+			t.Errorf("violations %s counted %v times, want %v", key, counted[key], n)
+		}
+	}
+	if len(alerts) != 1 || !strings.Contains(alerts[0], `"reporting"`) {
+		t.Errorf("alerts %q, want one about reporting", alerts)
+	}
+	send(enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeWelcomeMessage, Payload: welcome})
+	if len(alerts) != 1 {
+		t.Errorf("alerted again within the window: %q", alerts)
+	}
+
+	// Widening the policy applies once the file is reread
+	widened := strings.Replace(enqueuePolicies, `types: ["server:*"]`, `types: ["server:*", "welcome:message"]`, 1)
+	if err := os.WriteFile(path, []byte(widened), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := policies.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := send(enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeWelcomeMessage, Payload: welcome}); code != http.StatusCreated {
+		t.Errorf("after reload: status %d, want 201", code)
+	}
+	if err := os.WriteFile(path, []byte("policies:\n  nobody: {max_batch: 1}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := policies.Reload(); err == nil {
+		t.Error("policy of an unknown token was accepted")
+	}
+	if code, _ := send(enqueue, "reporting-token-0123456789", api.EnqueueRequest{Type: common.TypeWelcomeMessage, Payload: welcome}); code != http.StatusCreated {
+		t.Errorf("an invalid file replaced the policies: status %d", code)
+	}
+}
@@ -0,0 +1,93 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Server serves the admin HTTP API next to the worker
+type Server struct {
+	mux *http.ServeMux
+	srv *http.Server
+}
+
+// AddrFromEnv returns ADMIN_ADDR, empty when the admin API is disabled
+func AddrFromEnv() string {
+	return os.Getenv("ADMIN_ADDR")
+}
+
+// TokenFromEnv returns ADMIN_TOKEN, a token with the admin role
+func TokenFromEnv() string {
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+// NewServer creates an admin server listening on addr
+func NewServer(addr string) *Server {
+	mux := http.NewServeMux()
+	return &Server{
+		mux: mux,
+		srv: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 5 * time.Second,
+		},
+	}
+}
+
+// Handle registers a handler for the given pattern
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// HandleFunc registers a handler function for the given pattern
+func (s *Server) HandleFunc(pattern string, f func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, f)
+}
+
+// Run serves requests until ctx is done, then waits up to five seconds for
+// in-flight requests
+func (s *Server) Run(ctx context.Context) error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.srv.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		return fmt.Errorf("Admin API error: %v", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down admin API: %v", err)
+	}
+	return nil
+}
+
+// WriteJSON writes v as a JSON response with the given status
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("❌ Failed to write admin response: %v", err)
+	}
+}
+
+// WriteError writes a JSON error response
+func WriteError(w http.ResponseWriter, status int, msg string) {
+	WriteJSON(w, status, map[string]string{"error": msg})
+}
+
+// PathSegments splits the request path below prefix, e.g. "/handlers/x/rate"
+// with prefix "/handlers/" gives ["x", "rate"]
+func PathSegments(r *http.Request, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
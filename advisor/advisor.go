@@ -0,0 +1,283 @@
+// Package advisor recommends how many tasks a worker should process at once
+// from the recorded workload.
+//
+// Each task type keeps λ·W workers busy on average (Little's law), λ being
+// its arrivals per second and W its duration, taken at p90 so that slow
+// tails get room. The sum times a headroom factor is the target
+// concurrency, raised further while tasks wait longer than the target
+// latency. Successive targets are smoothed, changes smaller than a deadband
+// are ignored, undoing the last change needs twice that, and each step is
+// capped, so that a noisy workload does not make the worker oscillate.
+package advisor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"asynqdemo/concurrency"
+)
+
+// Profile is the recent workload of one task type
+type Profile struct {
+	TaskType string  `json:"task_type"`
+	PerMin   float64 `json:"per_min"`
+	P50Ms    float64 `json:"p50_ms"`
+	P90Ms    float64 `json:"p90_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+}
+
+// Input is what a recommendation is computed from
+type Input struct {
+	Profiles []Profile
+	// QueueLatency is the age of the oldest pending task of any queue
+	QueueLatency time.Duration
+	// Current is the concurrency in effect, 0 when unknown
+	Current int
+}
+
+// Config tunes the advisor
+type Config struct {
+	// Min and Max bound the recommendation; Max 0 means no upper bound
+	Min, Max int
+	// Headroom multiplies the busy workers, so that bursts do not queue
+	Headroom float64
+	// TargetLatency is how long tasks may wait before concurrency is raised
+	// for the backlog
+	TargetLatency time.Duration
+	// Smoothing is the weight of a new target against the previous ones
+	Smoothing float64
+	// Deadband is the change, as a fraction of the current concurrency,
+	// below which the concurrency is kept
+	Deadband float64
+	// MaxStep caps a change to this fraction of the current concurrency
+	MaxStep float64
+	// Apply sets the recommended concurrency on the worker
+	Apply bool
+	// Interval is how often Run advises
+	Interval time.Duration
+}
+
+// DefaultConfig advises every minute without applying anything
+func DefaultConfig() Config {
+	return Config{
+		Min:           1,
+		Headroom:      1.25,
+		TargetLatency: 30 * time.Second,
+		Smoothing:     0.3,
+		Deadband:      0.1,
+		MaxStep:       0.25,
+		Interval:      time.Minute,
+	}
+}
+
+// maxBoost caps how much a backlog raises the target
+const maxBoost = 2
+
+// Recommendation is the advised concurrency with the reasoning behind it
+type Recommendation struct {
+	At time.Time `json:"at"`
+	// Concurrency is the damped recommendation, Target the raw one
+	Concurrency int     `json:"concurrency"`
+	Target      float64 `json:"target"`
+	Current     int     `json:"current"`
+	// PerType is the most tasks of each type worth running at once
+	PerType      map[string]int `json:"per_type"`
+	QueueLatency string         `json:"queue_latency"`
+	Applied      bool           `json:"applied"`
+	Explanation  []string       `json:"explanation"`
+}
+
+// Collector reads the current workload
+type Collector func(ctx context.Context) (Input, error)
+
+// Advisor turns workloads into damped recommendations. Recommendations
+// depend on the previous ones, so keep one Advisor per worker.
+type Advisor struct {
+	cfg Config
+
+	mu       sync.Mutex
+	smoothed float64
+	// direction is the sign of the last change
+	direction int
+	last      *Recommendation
+}
+
+// NewAdvisor creates an advisor; zero fields of cfg take their defaults
+func NewAdvisor(cfg Config) *Advisor {
+	def := DefaultConfig()
+	if cfg.Min < 1 {
+		cfg.Min = def.Min
+	}
+	if cfg.Headroom <= 0 {
+		cfg.Headroom = def.Headroom
+	}
+	if cfg.TargetLatency <= 0 {
+		cfg.TargetLatency = def.TargetLatency
+	}
+	if cfg.Smoothing <= 0 || cfg.Smoothing > 1 {
+		cfg.Smoothing = def.Smoothing
+	}
+	if cfg.Deadband < 0 {
+		cfg.Deadband = def.Deadband
+	}
+	if cfg.MaxStep <= 0 {
+		cfg.MaxStep = def.MaxStep
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = def.Interval
+	}
+	return &Advisor{cfg: cfg}
+}
+
+// Advise recommends a concurrency for in, damped by the previous
+// recommendations
+func (a *Advisor) Advise(in Input) Recommendation {
+	return a.advise(in, true)
+}
+
+// Preview is Advise without remembering the recommendation, so that it does
+// not weigh on the next ones
+func (a *Advisor) Preview(in Input) Recommendation {
+	return a.advise(in, false)
+}
+
+// Last returns the latest recommendation of Advise, nil before the first
+func (a *Advisor) Last() *Recommendation {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last == nil {
+		return nil
+	}
+	rec := *a.last
+	return &rec
+}
+
+func (a *Advisor) advise(in Input, commit bool) Recommendation {
+	cfg := a.cfg
+	rec := Recommendation{At: time.Now(), Current: in.Current, PerType: map[string]int{}, QueueLatency: in.QueueLatency.String(), Applied: cfg.Apply}
+	explain := func(format string, args ...interface{}) {
+		rec.Explanation = append(rec.Explanation, fmt.Sprintf(format, args...))
+	}
+
+	// Little's law per task type
+	profiles := append([]Profile(nil), in.Profiles...)
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].TaskType < profiles[j].TaskType })
+	busy := make(map[string]float64, len(profiles))
+	var total float64
+	for _, p := range profiles {
+		b := p.PerMin / 60 * p.P90Ms / 1000
+		busy[p.TaskType] = b
+		total += b
+		explain("%s: %.2f/s × p90 %.3fs = %.2f busy workers", p.TaskType, p.PerMin/60, p.P90Ms/1000, b)
+	}
+	target := total * cfg.Headroom
+	explain("busy workers %.2f × headroom %.2f = %.2f", total, cfg.Headroom, target)
+
+	// Tasks waiting past the target latency mean too few workers
+	boost := 1.0
+	if in.QueueLatency > cfg.TargetLatency {
+		boost = math.Min(maxBoost, float64(in.QueueLatency)/float64(cfg.TargetLatency))
+		target *= boost
+		explain("oldest pending task waited %v, over the %v target: × %.2f = %.2f", in.QueueLatency.Round(time.Second), cfg.TargetLatency, boost, target)
+	}
+	rec.Target = target
+
+	// Damping: smooth the targets, ignore small changes, cap the steps
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev := a.smoothed
+	if prev == 0 {
+		prev = float64(in.Current)
+		if prev <= 0 {
+			prev = target
+		}
+	}
+	smoothed := cfg.Smoothing*target + (1-cfg.Smoothing)*prev
+	explain("smoothed %.2f × %.2f + %.2f × %.2f = %.2f", cfg.Smoothing, target, 1-cfg.Smoothing, prev, smoothed)
+	base := in.Current
+	if base <= 0 {
+		base = int(math.Round(smoothed))
+	}
+	next := int(math.Round(smoothed))
+	band := math.Max(1, cfg.Deadband*float64(base))
+	if (smoothed-float64(base))*float64(a.direction) < 0 {
+		// Hysteresis: undoing the last change takes twice the evidence
+		band *= 2
+	}
+	if math.Abs(smoothed-float64(base)) < band {
+		next = base
+		explain("within %.2f of the current %d: keep %d", band, base, base)
+	}
+	step := int(math.Max(1, math.Ceil(cfg.MaxStep*float64(base))))
+	if next > base+step {
+		next = base + step
+		explain("step capped at +%d: %d", step, next)
+	} else if next < base-step {
+		next = base - step
+		explain("step capped at -%d: %d", step, next)
+	}
+	if next < cfg.Min {
+		next = cfg.Min
+		explain("raised to the minimum %d", next)
+	}
+	if cfg.Max > 0 && next > cfg.Max {
+		next = cfg.Max
+		explain("lowered to the maximum %d", next)
+	}
+	rec.Concurrency = next
+
+	// Per-type limits: each type's own share, at least one slot
+	for _, p := range profiles {
+		n := int(math.Ceil(busy[p.TaskType] * cfg.Headroom * boost))
+		if n < 1 {
+			n = 1
+		}
+		if n > next {
+			n = next
+		}
+		rec.PerType[p.TaskType] = n
+	}
+
+	if commit {
+		a.smoothed = smoothed
+		if next != base {
+			a.direction = 1
+			if next < base {
+				a.direction = -1
+			}
+		}
+		a.last = &rec
+	}
+	return rec
+}
+
+// Run advises every interval until ctx is done, from the workload collect
+// reads and the concurrency of s, which it sets to the recommendation when
+// the config applies them
+func (a *Advisor) Run(ctx context.Context, collect Collector, s concurrency.Setter) error {
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		in, err := collect(ctx)
+		if err != nil {
+			log.Printf("⚠️  Concurrency advisor: %v", err)
+			continue
+		}
+		in.Current = s.Concurrency()
+		rec := a.Advise(in)
+		if a.cfg.Apply && rec.Concurrency != in.Current {
+			s.SetConcurrency(rec.Concurrency)
+			fmt.Printf("🧮 Concurrency set to %d by the advisor (was %d, target %.1f)\n", rec.Concurrency, in.Current, rec.Target)
+		}
+	}
+}
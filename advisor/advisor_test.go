@@ -0,0 +1,126 @@
+package advisor_test
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"asynqdemo/advisor"
+)
+
+// TestAdvisor feeds synthetic workloads to an Advisor and fails unless
+// the recommendations follow Little's law with headroom, grow with the
+// queue latency up to a cap, stay within bounds, hold steady under noise
+// and alternating load, and converge on a new load in capped steps.
+func TestAdvisor(t *testing.T) {
+	// 10 emails a second of p90 500ms keep 5 workers busy, a report a
+	// second of p90 2s keeps 2 busy
+	workload := func(emailsPerMin float64) []advisor.Profile {
+		return []advisor.Profile{
+			{TaskType: "email:send", PerMin: emailsPerMin, P50Ms: 200, P90Ms: 500, P99Ms: 900},
+			{TaskType: "report:render", PerMin: 60, P50Ms: 1200, P90Ms: 2000, P99Ms: 4000},
+		}
+	}
+	fresh := func(in advisor.Input) advisor.Recommendation {
+		return advisor.NewAdvisor(advisor.Config{}).Advise(in)
+	}
+
+	rec := fresh(advisor.Input{Profiles: workload(600)})
+	if rec.Concurrency != 9 || math.Abs(rec.Target-8.75) > 1e-9 || !reflect.DeepEqual(rec.PerType, map[string]int{"email:send": 7, "report:render": 3}) {
+		t.Errorf("7 busy workers gave %d (target %.2f) and limits %v, want 9 and 7/3", rec.Concurrency, rec.Target, rec.PerType)
+	}
+	if len(rec.Explanation) == 0 {
+		t.Error("recommendation without an explanation")
+	}
+
+	// A backlog raises the target, at most twofold
+	if rec := fresh(advisor.Input{Profiles: workload(600), QueueLatency: 45 * time.Second}); math.Abs(rec.Target-8.75*1.5) > 1e-9 {
+		t.Errorf("45s queue latency gave target %.2f, want %.2f", rec.Target, 8.75*1.5)
+	}
+	if rec := fresh(advisor.Input{Profiles: workload(600), QueueLatency: time.Hour}); math.Abs(rec.Target-8.75*2) > 1e-9 {
+		t.Errorf("1h queue latency gave target %.2f, want the capped %.2f", rec.Target, 8.75*2)
+	}
+
+	// Bounds hold, idle workloads keep the minimum
+	bounded := advisor.NewAdvisor(advisor.Config{Min: 2, Max: 5})
+	if rec := bounded.Advise(advisor.Input{Profiles: workload(6000)}); rec.Concurrency != 5 || rec.PerType["email:send"] != 5 {
+		t.Errorf("heavy load within [2, 5] gave %d and limits %v", rec.Concurrency, rec.PerType)
+	}
+	if rec := fresh(advisor.Input{Profiles: []advisor.Profile{{TaskType: "email:send", P90Ms: 500}}}); rec.Concurrency != 1 || rec.PerType["email:send"] != 1 {
+		t.Errorf("idle workload gave %d and limits %v, want 1", rec.Concurrency, rec.PerType)
+	}
+
+	// run applies each recommendation as the next current concurrency and
+	// counts the changes and reversals
+	run := func(a *advisor.Advisor, current int, loads []float64) (final, changes, reversals int, lo, hi int) {
+		lo, hi = current, current
+		direction := 0
+		for _, load := range loads {
+			rec := a.Advise(advisor.Input{Profiles: workload(load), Current: current})
+			if d := rec.Concurrency - current; d != 0 {
+				changes++
+				if d*direction < 0 {
+					reversals++
+				}
+				direction = d
+			}
+			current = rec.Concurrency
+			if current < lo {
+				lo = current
+			}
+			if current > hi {
+				hi = current
+			}
+		}
+		return current, changes, reversals, lo, hi
+	}
+
+	// ±15% noise around a steady load barely moves the recommendation
+	var noisy []float64
+	for i := 0; i < 50; i++ {
+		noisy = append(noisy, 600*(1+0.15*math.Sin(float64(i)*2.3)))
+	}
+	if _, changes, _, lo, hi := run(advisor.NewAdvisor(advisor.Config{}), 9, noisy); changes > 2 || lo < 8 || hi > 10 {
+		t.Errorf("noisy load made %d changes within [%d, %d], want at most 2 within [8, 10]", changes, lo, hi)
+	}
+
+	// A load alternating between low and high every cycle settles instead
+	// of following it
+	var alternating []float64
+	for i := 0; i < 40; i++ {
+		alternating = append(alternating, []float64{300, 1200}[i%2])
+	}
+	if _, changes, reversals, _, _ := run(advisor.NewAdvisor(advisor.Config{}), 9, alternating); reversals > 1 || changes > 4 {
+		t.Errorf("alternating load made %d changes and %d reversals", changes, reversals)
+	}
+
+	// Doubling the emails (12 busy, target 15) is reached in capped steps,
+	// without overshooting
+	var doubled []float64
+	for i := 0; i < 20; i++ {
+		doubled = append(doubled, 1200)
+	}
+	a := advisor.NewAdvisor(advisor.Config{})
+	current := 9
+	for i, load := range doubled {
+		rec := a.Advise(advisor.Input{Profiles: workload(load), Current: current})
+		if step := rec.Concurrency - current; step < 0 || float64(step) > math.Ceil(0.25*float64(current)) {
+			t.Errorf("cycle %d stepped from %d to %d", i, current, rec.Concurrency)
+		}
+		current = rec.Concurrency
+	}
+	if current < 14 || current > 15 {
+		t.Errorf("doubled load settled at %d, want about 15", current)
+	}
+
+	// Preview does not weigh on the next recommendation
+	a = advisor.NewAdvisor(advisor.Config{})
+	a.Preview(advisor.Input{Profiles: workload(6000), Current: 9})
+	if a.Last() != nil {
+		t.Error("Preview recorded a recommendation")
+	}
+	if rec := a.Advise(advisor.Input{Profiles: workload(600), Current: 9}); rec.Concurrency != 9 {
+		t.Errorf("steady load after a preview gave %d, want 9", rec.Concurrency)
+	}
+}
@@ -0,0 +1,127 @@
+package advisor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/concurrency"
+	"asynqdemo/metrics"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCollector reads the workload recorded by the latency recorder: the
+// percentiles of the last 24h, and as arrival rate the tasks processed per
+// minute over the last window complete minutes, which a backlog shows
+// through the queue latency instead
+func RedisCollector(rdb redis.UniversalClient, inspector *asynq.Inspector, window int) Collector {
+	return func(ctx context.Context) (Input, error) {
+		var in Input
+		summaries, err := metrics.Summaries(ctx, rdb)
+		if err != nil {
+			return in, err
+		}
+		now := time.Now()
+		for _, s := range summaries {
+			points, err := metrics.Throughput(ctx, rdb, s.TaskType, window+1, now)
+			if err != nil {
+				return in, err
+			}
+			// The current minute is incomplete
+			var processed float64
+			for _, p := range points[:len(points)-1] {
+				processed += p.V
+			}
+			in.Profiles = append(in.Profiles, Profile{TaskType: s.TaskType, PerMin: processed / float64(window), P50Ms: s.P50Ms, P90Ms: s.P90Ms, P99Ms: s.P99Ms})
+		}
+		queues, err := inspector.Queues()
+		if err != nil {
+			return in, fmt.Errorf("failed to list queues: %v", err)
+		}
+		for _, q := range queues {
+			info, err := inspector.GetQueueInfo(q)
+			if err != nil {
+				return in, fmt.Errorf("failed to read queue %s: %v", q, err)
+			}
+			if !info.Paused && info.Latency > in.QueueLatency {
+				in.QueueLatency = info.Latency
+			}
+		}
+		return in, nil
+	}
+}
+
+// ConfigFromEnv reads ADVISOR_APPLY, ADVISOR_MIN, ADVISOR_MAX,
+// ADVISOR_TARGET_LATENCY and ADVISOR_INTERVAL; max bounds ADVISOR_MAX and is
+// its default
+func ConfigFromEnv(max int) (Config, error) {
+	cfg := DefaultConfig()
+	cfg.Max = max
+	if v := os.Getenv("ADVISOR_APPLY"); v != "" {
+		apply, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid ADVISOR_APPLY %q", v)
+		}
+		cfg.Apply = apply
+	}
+	if v := os.Getenv("ADVISOR_MIN"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid ADVISOR_MIN %q", v)
+		}
+		cfg.Min = n
+	}
+	if v := os.Getenv("ADVISOR_MAX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > max {
+			return cfg, fmt.Errorf("invalid ADVISOR_MAX %q, want 1 to %d", v, max)
+		}
+		cfg.Max = n
+	}
+	if cfg.Min > cfg.Max {
+		return cfg, fmt.Errorf("ADVISOR_MIN %d is above ADVISOR_MAX %d", cfg.Min, cfg.Max)
+	}
+	if v := os.Getenv("ADVISOR_TARGET_LATENCY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid ADVISOR_TARGET_LATENCY %q", v)
+		}
+		cfg.TargetLatency = d
+	}
+	if v := os.Getenv("ADVISOR_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid ADVISOR_INTERVAL %q", v)
+		}
+		cfg.Interval = d
+	}
+	return cfg, nil
+}
+
+// Handler serves GET /admin/advisor: the latest recommendation, or one
+// previewed from the current workload before Run made any
+func Handler(a *Advisor, collect Collector, s concurrency.Setter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if rec := a.Last(); rec != nil {
+			admin.WriteJSON(w, http.StatusOK, rec)
+			return
+		}
+		in, err := collect(r.Context())
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		in.Current = s.Concurrency()
+		admin.WriteJSON(w, http.StatusOK, a.Preview(in))
+	})
+}
@@ -0,0 +1,164 @@
+// Package affinity routes all tasks of a user to the same worker, so the
+// worker's per-process caches stay warm. Task types are sharded over N queues
+// by consistent hashing of the user, and each worker consumes the shards it
+// claims.
+package affinity
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+
+	"asynqdemo/metadata"
+	"asynqdemo/quota"
+
+	"github.com/hibiken/asynq"
+)
+
+// KeyOrderingKey is the task metadata attribute that overrides the user ID as
+// the routing key
+const KeyOrderingKey = "ordering_key"
+
+// Config is the fleet-wide shard layout plus the name of this worker
+type Config struct {
+	TaskTypes []string `json:"task_types"`
+	Shards    int      `json:"shards"`
+	// Assignments maps each worker name to the shards it consumes
+	Assignments map[string][]int `json:"assignments"`
+	Worker      string           `json:"worker"`
+}
+
+// LoadConfig reads a JSON config file
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read affinity config: %v", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("failed to parse affinity config: %v", err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that every shard is claimed by exactly one worker
+func (c Config) Validate() error {
+	if c.Shards < 1 {
+		return fmt.Errorf("shards must be positive, got %d", c.Shards)
+	}
+	owner := make(map[int]string, c.Shards)
+	workers := make([]string, 0, len(c.Assignments))
+	for w := range c.Assignments {
+		workers = append(workers, w)
+	}
+	sort.Strings(workers)
+	for _, w := range workers {
+		for _, s := range c.Assignments[w] {
+			if s < 0 || s >= c.Shards {
+				return fmt.Errorf("worker %s claims shard %d outside 0..%d", w, s, c.Shards-1)
+			}
+			if prev, ok := owner[s]; ok {
+				return fmt.Errorf("shard %d claimed by both %s and %s", s, prev, w)
+			}
+			owner[s] = w
+		}
+	}
+	for s := 0; s < c.Shards; s++ {
+		if _, ok := owner[s]; !ok {
+			return fmt.Errorf("shard %d is not claimed by any worker", s)
+		}
+	}
+	if _, ok := c.Assignments[c.Worker]; c.Worker != "" && !ok {
+		return fmt.Errorf("worker %s has no assignment", c.Worker)
+	}
+	return nil
+}
+
+// QueueName is the queue of a shard
+func QueueName(shard int) string {
+	return fmt.Sprintf("affinity-%d", shard)
+}
+
+// Router picks shard queues for tasks
+type Router struct {
+	cfg   Config
+	types map[string]bool
+}
+
+// NewRouter validates cfg and creates a router
+func NewRouter(cfg Config) (*Router, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	types := make(map[string]bool, len(cfg.TaskTypes))
+	for _, t := range cfg.TaskTypes {
+		types[t] = true
+	}
+	return &Router{cfg: cfg, types: types}, nil
+}
+
+// ClaimedQueues returns the shard queues this worker consumes
+func (r *Router) ClaimedQueues() []string {
+	var queues []string
+	for _, s := range r.cfg.Assignments[r.cfg.Worker] {
+		queues = append(queues, QueueName(s))
+	}
+	return queues
+}
+
+// Shard maps a routing key to a shard with jump consistent hashing, so
+// changing the shard count moves as few keys as possible
+func (r *Router) Shard(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return jumpHash(h.Sum64(), r.cfg.Shards)
+}
+
+// QueueOption returns the queue option routing t, or nothing when t's type is
+// not sharded or has no routing key. A nil Router routes nothing.
+func (r *Router) QueueOption(t *asynq.Task) []asynq.Option {
+	if r == nil || !r.types[t.Type()] {
+		return nil
+	}
+	key, ok := routingKey(t)
+	if !ok {
+		return nil
+	}
+	return []asynq.Option{asynq.Queue(QueueName(r.Shard(key)))}
+}
+
+// routingKey is the ordering_key metadata, else the user_id metadata, else
+// the payload's user_id
+func routingKey(t *asynq.Task) (string, bool) {
+	payload, md := metadata.Unwrap(t.Payload())
+	if k := md[KeyOrderingKey]; k != "" {
+		return k, true
+	}
+	if id := md[quota.KeyUserID]; id != "" {
+		return "user:" + id, true
+	}
+	var p struct {
+		UserID json.Number `json:"user_id"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil || p.UserID == "" {
+		return "", false
+	}
+	if _, err := strconv.ParseInt(string(p.UserID), 10, 64); err != nil {
+		return "", false
+	}
+	return "user:" + string(p.UserID), true
+}
+
+// jumpHash is Lamping and Veach's jump consistent hash
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
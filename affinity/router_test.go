@@ -0,0 +1,207 @@
+package affinity_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/affinity"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metadata"
+	"asynqdemo/quota"
+
+	"github.com/hibiken/asynq"
+)
+
+func layout(worker string) affinity.Config {
+	return affinity.Config{
+		TaskTypes:   []string{"onboarding:step"},
+		Shards:      4,
+		Assignments: map[string][]int{"a": {0, 1}, "b": {2, 3}},
+		Worker:      worker,
+	}
+}
+
+// TestLocality runs two workers claiming two shards each and fails unless
+// the three onboarding tasks of every user are processed by one worker and
+// both workers get users
+func TestLocality(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var mu sync.Mutex
+	workersOf := map[string]map[string]bool{}
+	processed := 0
+	for _, name := range []string{"a", "b"} {
+		name := name
+		router, err := affinity.NewRouter(layout(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		queues := map[string]int{}
+		for _, q := range router.ClaimedQueues() {
+			queues[q] = 1
+		}
+		worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 2, Queues: queues, LogLevel: asynq.FatalLevel})
+		if err := worker.Start(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			payload, _ := metadata.Unwrap(task.Payload())
+			user, _, _ := strings.Cut(string(payload), "/")
+			mu.Lock()
+			defer mu.Unlock()
+			if workersOf[user] == nil {
+				workersOf[user] = map[string]bool{}
+			}
+			workersOf[user][name] = true
+			processed++
+			return nil
+		})); err != nil {
+			t.Fatal(err)
+		}
+		defer worker.Shutdown()
+	}
+
+	router, err := affinity.NewRouter(layout(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	for step := 0; step < 3; step++ {
+		for user := 0; user < 20; user++ {
+			// The payload names the user for the handler; the metadata routes
+			task, err := metadata.NewTask("onboarding:step", []byte(fmt.Sprintf(`"%d/%d"`, user, step)), metadata.Metadata{quota.KeyUserID: fmt.Sprint(user)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := router.QueueOption(task)
+			if len(opts) != 1 {
+				t.Fatalf("task of user %d not routed", user)
+			}
+			if _, err := client.Enqueue(task, opts...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		n := processed
+		mu.Unlock()
+		if n == 60 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 60 tasks processed", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	perWorker := map[string]int{}
+	for user, workers := range workersOf {
+		if len(workers) != 1 {
+			t.Errorf("tasks of user %s ran on workers %v", user, workers)
+		}
+		for w := range workers {
+			perWorker[w]++
+		}
+	}
+	if len(workersOf) != 20 || perWorker["a"] == 0 || perWorker["b"] == 0 {
+		t.Errorf("users per worker %v, want 20 users on both", perWorker)
+	}
+}
+
+// TestRouting fails unless the ordering key wins over the user, types not
+// sharded or tasks without a user are not routed, and growing from 4 to 5
+// shards moves few users
+func TestRouting(t *testing.T) {
+	router, err := affinity.NewRouter(layout("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueOf := func(task *asynq.Task) string {
+		opts := router.QueueOption(task)
+		if len(opts) == 0 {
+			return ""
+		}
+		return opts[0].Value().(string)
+	}
+
+	byPayload := asynq.NewTask("onboarding:step", []byte(`{"user_id":7}`))
+	byMetadata, _ := metadata.NewTask("onboarding:step", []byte(`{}`), metadata.Metadata{quota.KeyUserID: "7"})
+	if queueOf(byPayload) == "" || queueOf(byPayload) != queueOf(byMetadata) {
+		t.Errorf("user 7 routed to %q by payload and %q by metadata", queueOf(byPayload), queueOf(byMetadata))
+	}
+	want := affinity.QueueName(router.Shard("order-1"))
+	for user := 0; user < 10; user++ {
+		task, _ := metadata.NewTask("onboarding:step", []byte(fmt.Sprintf(`{"user_id":%d}`, user)), metadata.Metadata{affinity.KeyOrderingKey: "order-1"})
+		if got := queueOf(task); got != want {
+			t.Errorf("ordering key of user %d routed to %s, want %s", user, got, want)
+		}
+	}
+	for _, task := range []*asynq.Task{
+		asynq.NewTask("email:send", []byte(`{"user_id":7}`)),
+		asynq.NewTask("onboarding:step", []byte(`{"user_id":"seven"}`)),
+		asynq.NewTask("onboarding:step", []byte(`{}`)),
+	} {
+		if got := queueOf(task); got != "" {
+			t.Errorf("%s %s routed to %s", task.Type(), task.Payload(), got)
+		}
+	}
+	var nilRouter *affinity.Router
+	if opts := nilRouter.QueueOption(byPayload); opts != nil {
+		t.Error("nil router routed a task")
+	}
+	if got := router.ClaimedQueues(); len(got) != 2 || got[0] != "affinity-0" || got[1] != "affinity-1" {
+		t.Errorf("worker a claims %v", got)
+	}
+
+	grown := layout("")
+	grown.Shards = 5
+	grown.Assignments["b"] = append(grown.Assignments["b"], 4)
+	bigger, err := affinity.NewRouter(grown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for user := 0; user < 1000; user++ {
+		key := fmt.Sprintf("user:%d", user)
+		if router.Shard(key) != bigger.Shard(key) {
+			moved++
+		}
+	}
+	if moved > 260 {
+		t.Errorf("%d of 1000 users moved to a new shard, want about 200", moved)
+	}
+}
+
+// TestValidate fails unless layouts leaving a shard unclaimed, claiming one
+// twice or out of range, or naming an unknown worker are refused
+func TestValidate(t *testing.T) {
+	if err := layout("a").Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(*affinity.Config){
+		"no shards":      func(c *affinity.Config) { c.Shards = 0 },
+		"unclaimed":      func(c *affinity.Config) { c.Assignments["b"] = []int{2} },
+		"claimed twice":  func(c *affinity.Config) { c.Assignments["b"] = []int{1, 2, 3} },
+		"out of range":   func(c *affinity.Config) { c.Assignments["b"] = []int{2, 3, 4} },
+		"unknown worker": func(c *affinity.Config) { c.Worker = "c" },
+	} {
+		cfg := layout("a")
+		change(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+		if _, err := affinity.NewRouter(cfg); err == nil {
+			t.Errorf("router created with %s", name)
+		}
+	}
+}
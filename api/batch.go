@@ -0,0 +1,245 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/audit"
+	"asynqdemo/common"
+	"asynqdemo/dedup"
+	"asynqdemo/quiethours"
+	"asynqdemo/throttle"
+	"asynqdemo/validation"
+
+	"github.com/hibiken/asynq"
+)
+
+// MaxBatchItems is the most emails one batch request may carry
+const MaxBatchItems = 1000
+
+// DefaultBatchDedupWindow is how long an email equal to one enqueued
+// before, e.g. by a retried batch, is dropped as a duplicate
+const DefaultBatchDedupWindow = 10 * time.Minute
+
+// Headers carrying the outcome counts of a batch
+const (
+	HeaderBatchEnqueued     = "X-Batch-Enqueued"
+	HeaderBatchDeduplicated = "X-Batch-Deduplicated"
+	HeaderBatchFailed       = "X-Batch-Failed"
+)
+
+// BatchRequest is the body of POST /tasks/email/batch
+type BatchRequest struct {
+	// Atomic rejects the whole batch when any item is invalid, and removes
+	// the items already enqueued when Redis fails midway
+	Atomic bool              `json:"atomic"`
+	Queue  string            `json:"queue,omitempty"`
+	Items  []json.RawMessage `json:"items"`
+}
+
+// BatchItemResult is the outcome of one item, in request order. One of
+// TaskID, Error and Deduplicated is set, except that a task a rollback
+// failed to delete keeps its TaskID next to the Error.
+type BatchItemResult struct {
+	Index        int    `json:"index"`
+	TaskID       string `json:"task_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+}
+
+// BatchResponse lists the outcome of every item
+type BatchResponse struct {
+	Atomic     bool              `json:"atomic"`
+	RolledBack bool              `json:"rolled_back,omitempty"`
+	Items      []BatchItemResult `json:"items"`
+}
+
+// BatchHandler serves POST /tasks/email/batch.
+//
+// By default each item is validated and enqueued on its own, and the
+// response is 207 with the outcome of every item. With "atomic": true every
+// item is validated before anything is enqueued, and one invalid item
+// rejects the batch with 422. Items over their frequency cap count as
+// invalid, there is no override for batches. Redis cannot enqueue a batch atomically, so
+// when an enqueue fails midway the items already enqueued are deleted again
+// on a best-effort basis and the batch fails with 503; items whose deletion
+// failed keep their task ID in the response.
+type BatchHandler struct {
+	// Enqueue enqueues one email, reporting true for a duplicate
+	Enqueue func(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, bool, error)
+	// Delete removes an enqueued email when an atomic batch is rolled back
+	Delete func(queue, id string) error
+
+	Validators  *validation.ValidatorRegistry
+	Quiet       *quiethours.Config
+	Throttle    *throttle.Ledger
+	Audit       *audit.Store
+	DedupWindow time.Duration
+	// Policies refuses batches the enqueue policy of the request's token
+	// forbids with 403; nil allows every batch
+	Policies *admin.EnqueuePolicies
+}
+
+// NewBatchHandler creates a batch handler enqueuing with content
+// deduplication; quiet, ledger and auditStore may be nil
+func NewBatchHandler(client *asynq.Client, inspector *asynq.Inspector, quiet *quiethours.Config, ledger *throttle.Ledger, auditStore *audit.Store) *BatchHandler {
+	h := &BatchHandler{
+		Delete:      inspector.DeleteTask,
+		Validators:  validation.DefaultRegistry(),
+		Quiet:       quiet,
+		Throttle:    ledger,
+		Audit:       auditStore,
+		DedupWindow: DefaultBatchDedupWindow,
+	}
+	h.Enqueue = func(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, bool, error) {
+		return dedup.EnqueueWithContentDedup(client, task, h.DedupWindow, opts...)
+	}
+	return h
+}
+
+// itemOptions validates one email and returns its enqueue options, which
+// are never nil for a valid item
+func (h *BatchHandler) itemOptions(ctx context.Context, payload json.RawMessage, queue string, now time.Time) ([]asynq.Option, error) {
+	if err := common.ValidatePayload(common.TypeEmailTask, payload); err != nil {
+		return nil, err
+	}
+	if err := h.Validators.Validate(common.TypeEmailTask, payload); err != nil {
+		return nil, err
+	}
+	var p common.EmailPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, fmt.Errorf("invalid %s payload: %v", common.TypeEmailTask, err)
+	}
+	opts := append([]asynq.Option{}, common.EnqueueOptions(common.TypeEmailTask)...)
+	if queue != "" {
+		opts = append(opts, asynq.Queue(queue))
+	}
+	opts, err := h.Throttle.Options(ctx, &p, now, false, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return h.Quiet.Options(&p, now, opts...), nil
+}
+
+func (h *BatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 8<<20))
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req BatchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > MaxBatchItems {
+		admin.WriteError(w, http.StatusBadRequest, fmt.Sprintf("expected 1 to %d items, got %d", MaxBatchItems, len(req.Items)))
+		return
+	}
+
+	if v := h.Policies.Authorize(r, admin.EnqueueAttempt{Type: common.TypeEmailTask, Queue: req.Queue, Batch: len(req.Items)}); v != nil {
+		admin.WritePolicyViolation(w, v)
+		return
+	}
+
+	resp := BatchResponse{Atomic: req.Atomic, Items: make([]BatchItemResult, len(req.Items))}
+	// opts holds the enqueue options of each valid item, nil for the others
+	opts := make([][]asynq.Option, len(req.Items))
+	now := time.Now()
+	invalid := 0
+	for i, item := range req.Items {
+		resp.Items[i].Index = i
+		if opts[i], err = h.itemOptions(r.Context(), item, req.Queue, now); err != nil {
+			resp.Items[i].Error = err.Error()
+			invalid++
+		}
+	}
+	if req.Atomic && invalid > 0 {
+		for i := range resp.Items {
+			if resp.Items[i].Error == "" {
+				resp.Items[i].Error = "not enqueued: batch has invalid items"
+			}
+		}
+		writeBatch(w, http.StatusUnprocessableEntity, resp)
+		return
+	}
+
+	var enqueued []*asynq.TaskInfo
+	for i, item := range req.Items {
+		if opts[i] == nil {
+			continue
+		}
+		info, duplicate, err := h.Enqueue(r.Context(), asynq.NewTask(common.TypeEmailTask, item), opts[i]...)
+		switch {
+		case err != nil && req.Atomic:
+			resp.Items[i].Error = err.Error()
+			h.rollback(&resp, enqueued, i)
+			writeBatch(w, http.StatusServiceUnavailable, resp)
+			return
+		case err != nil:
+			resp.Items[i].Error = err.Error()
+		case duplicate:
+			resp.Items[i].Deduplicated = true
+		default:
+			resp.Items[i].TaskID = info.ID
+			enqueued = append(enqueued, info)
+			h.Audit.RecordEnqueued(r.Context(), info)
+		}
+	}
+	writeBatch(w, http.StatusMultiStatus, resp)
+}
+
+// rollback deletes the tasks enqueued before item failed and marks every
+// other item as not enqueued
+func (h *BatchHandler) rollback(resp *BatchResponse, enqueued []*asynq.TaskInfo, failed int) {
+	resp.RolledBack = true
+	deleted := make(map[string]bool, len(enqueued))
+	for _, info := range enqueued {
+		if err := h.Delete(info.Queue, info.ID); err != nil {
+			log.Printf("⚠️  Failed to roll back batch task %s: %v", info.ID, err)
+			continue
+		}
+		deleted[info.ID] = true
+	}
+	for i := range resp.Items {
+		item := &resp.Items[i]
+		switch {
+		case i == failed:
+		case item.TaskID != "" && !deleted[item.TaskID]:
+			item.Error = "rollback failed, task remains enqueued"
+		default:
+			item.TaskID, item.Deduplicated = "", false
+			item.Error = "not enqueued: batch rolled back"
+		}
+	}
+}
+
+// writeBatch writes resp with the outcome counts in headers
+func writeBatch(w http.ResponseWriter, status int, resp BatchResponse) {
+	var enqueued, deduplicated, failed int
+	for _, item := range resp.Items {
+		switch {
+		case item.TaskID != "":
+			enqueued++
+		case item.Deduplicated:
+			deduplicated++
+		default:
+			failed++
+		}
+	}
+	w.Header().Set(HeaderBatchEnqueued, strconv.Itoa(enqueued))
+	w.Header().Set(HeaderBatchDeduplicated, strconv.Itoa(deduplicated))
+	w.Header().Set(HeaderBatchFailed, strconv.Itoa(failed))
+	admin.WriteJSON(w, status, resp)
+}
@@ -0,0 +1,142 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"asynqdemo/api"
+
+	"github.com/hibiken/asynq"
+)
+
+// fakeQueue stands in for Redis behind an api.BatchHandler: it enqueues
+// into a map, reports payloads seen before as duplicates and fails the
+// enqueue of a subject containing "redis-down"
+type fakeQueue struct {
+	tasks map[string]string
+	seen  map[string]bool
+	next  int
+}
+
+func (q *fakeQueue) enqueue(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, bool, error) {
+	payload := string(task.Payload())
+	if strings.Contains(payload, "redis-down") {
+		return nil, false, errors.New("connection refused")
+	}
+	if q.seen[payload] {
+		return nil, true, nil
+	}
+	q.seen[payload] = true
+	q.next++
+	id := fmt.Sprintf("task-%d", q.next)
+	q.tasks[id] = payload
+	return &asynq.TaskInfo{ID: id, Queue: "default", Type: task.Type()}, false, nil
+}
+
+func (q *fakeQueue) delete(queue, id string) error {
+	if _, ok := q.tasks[id]; !ok {
+		return asynq.ErrTaskNotFound
+	}
+	delete(q.tasks, id)
+	return nil
+}
+
+// TestBatchEnqueue posts batches mixing valid, invalid and duplicate
+// emails in both modes, and one whose enqueue fails midway, and fails
+// unless non-atomic batches enqueue every valid item, atomic ones enqueue
+// nothing when an item is invalid, a failed atomic batch is rolled back,
+// and the count headers match the per-item results.
+func TestBatchEnqueue(t *testing.T) {
+	email := func(user int, subject string) string {
+		return fmt.Sprintf(`{"user_id":%d,"email":"user%d@example.com","subject":%q}`, user, user, subject)
+	}
+	valid1, valid2 := email(1, "Hello"), email(2, "Hello")
+	invalid := `{"user_id":3,"email":"not-an-address","subject":"Hello"}`
+	down := email(4, "redis-down")
+
+	post := func(q *fakeQueue, atomic bool, items ...string) (int, http.Header, api.BatchResponse) {
+		h := api.NewBatchHandler(nil, nil, nil, nil, nil)
+		h.Enqueue, h.Delete = q.enqueue, q.delete
+		body := fmt.Sprintf(`{"atomic":%t,"items":[%s]}`, atomic, strings.Join(items, ","))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tasks/email/batch", strings.NewReader(body)))
+		var resp api.BatchResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+		}
+		if len(resp.Items) != len(items) {
+			t.Fatalf("%d results for %d items", len(resp.Items), len(items))
+		}
+		return rec.Code, rec.Header(), resp
+	}
+	newQueue := func() *fakeQueue {
+		return &fakeQueue{tasks: make(map[string]string), seen: make(map[string]bool)}
+	}
+	// expect checks the status, the count headers and which items were
+	// enqueued ("e"), deduplicated ("d") or failed ("f")
+	expect := func(name string, code int, header http.Header, resp api.BatchResponse, wantCode int, want string) {
+		if code != wantCode {
+			t.Errorf("%s: status %d, want %d", name, code, wantCode)
+		}
+		got := ""
+		for i, item := range resp.Items {
+			if item.Index != i {
+				t.Errorf("%s: item %d has index %d", name, i, item.Index)
+			}
+			switch {
+			case item.TaskID != "":
+				got += "e"
+			case item.Deduplicated:
+				got += "d"
+			default:
+				got += "f"
+			}
+		}
+		if got != want {
+			t.Errorf("%s: items %q, want %q: %+v", name, got, want, resp.Items)
+		}
+		for h, c := range map[string]byte{api.HeaderBatchEnqueued: 'e', api.HeaderBatchDeduplicated: 'd', api.HeaderBatchFailed: 'f'} {
+			if n := fmt.Sprint(strings.Count(want, string(c))); header.Get(h) != n {
+				t.Errorf("%s: %s is %q, want %s", name, h, header.Get(h), n)
+			}
+		}
+	}
+
+	q := newQueue()
+	code, header, resp := post(q, false, valid1, invalid, valid2, valid1)
+	expect("non-atomic mixed", code, header, resp, http.StatusMultiStatus, "efed")
+	if len(q.tasks) != 2 {
+		t.Errorf("non-atomic mixed: %d tasks enqueued, want 2", len(q.tasks))
+	}
+
+	q = newQueue()
+	code, header, resp = post(q, true, valid1, invalid, valid2)
+	expect("atomic mixed", code, header, resp, http.StatusUnprocessableEntity, "fff")
+	if len(q.tasks) != 0 {
+		t.Errorf("atomic mixed: %d tasks enqueued, want none", len(q.tasks))
+	}
+	if !strings.Contains(resp.Items[1].Error, "email") {
+		t.Errorf("atomic mixed: invalid item error %q does not name the field", resp.Items[1].Error)
+	}
+
+	q = newQueue()
+	code, header, resp = post(q, true, valid1, valid2, valid1)
+	expect("atomic valid", code, header, resp, http.StatusMultiStatus, "eed")
+
+	q = newQueue()
+	code, header, resp = post(q, false, valid1, down, valid2)
+	expect("non-atomic redis failure", code, header, resp, http.StatusMultiStatus, "efe")
+
+	q = newQueue()
+	code, header, resp = post(q, true, valid1, valid2, down, email(5, "Hello"))
+	expect("atomic rollback", code, header, resp, http.StatusServiceUnavailable, "ffff")
+	if !resp.RolledBack || len(q.tasks) != 0 {
+		t.Errorf("atomic rollback: rolled back %t, %d tasks left", resp.RolledBack, len(q.tasks))
+	}
+}
@@ -0,0 +1,139 @@
+// Package api is the HTTP API producers use to enqueue tasks.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/audit"
+	"asynqdemo/common"
+	"asynqdemo/metadata"
+	"asynqdemo/pkg/taskclient"
+	"asynqdemo/predict"
+	"asynqdemo/quiethours"
+	"asynqdemo/throttle"
+
+	"github.com/hibiken/asynq"
+)
+
+// EnqueueRequest is the body of POST /api/tasks
+type EnqueueRequest = taskclient.EnqueueRequest
+
+// EnqueueResponse describes the enqueued task
+type EnqueueResponse = taskclient.EnqueueResponse
+
+// ThrottledResponse is the body of a 429 for an email over its frequency cap
+type ThrottledResponse = taskclient.ThrottledResponse
+
+// writeThrottled answers 429 with the time the cap allows the email again
+func writeThrottled(w http.ResponseWriter, e throttle.ErrThrottled) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(e.NextAllowed).Seconds()))))
+	admin.WriteJSON(w, http.StatusTooManyRequests, ThrottledResponse{Error: e.Error(), NextAllowed: e.NextAllowed})
+}
+
+// EnqueueHandler serves POST /api/tasks for task types known to the registry.
+// Marketing and digest email is held for the recipient's quiet hours when
+// quiet is not nil, and email over its category's frequency cap is deferred
+// or refused with 429 when ledger is not nil; admin tokens of authz may
+// override the cap when auditStore is not nil. Enqueued tasks are recorded
+// in auditStore when it is not nil, and pending tasks get an estimated
+// completion time when predictor is not nil. Tasks the enqueue policy of the
+// request's token forbids are refused with 403 when policies is not nil.
+func EnqueueHandler(client *asynq.Client, quiet *quiethours.Config, ledger *throttle.Ledger, authz *admin.Authorizer, policies *admin.EnqueuePolicies, auditStore *audit.Store, inspector *asynq.Inspector, predictor *predict.DurationPredictor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var req EnqueueRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		if err := common.ValidatePayload(req.Type, req.Payload); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		delay := time.Duration(req.ProcessInSeconds) * time.Second
+		if v := policies.Authorize(r, admin.EnqueueAttempt{Type: req.Type, Queue: req.Queue, Delay: delay, Batch: 1}); v != nil {
+			admin.WritePolicyViolation(w, v)
+			return
+		}
+		task, err := metadata.NewTask(req.Type, req.Payload, req.Metadata)
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		opts := common.EnqueueOptions(req.Type)
+		if req.Queue != "" {
+			opts = append(opts, asynq.Queue(req.Queue))
+		}
+		if delay > 0 {
+			opts = append(opts, asynq.ProcessIn(delay))
+		}
+		var overriddenBy string
+		if req.OverrideFrequencyCap {
+			name, role := authz.Authenticate(r)
+			switch {
+			case role < admin.RoleAdmin:
+				admin.WriteError(w, http.StatusForbidden, "override_frequency_cap requires an admin token")
+				return
+			case auditStore == nil:
+				admin.WriteError(w, http.StatusForbidden, "override_frequency_cap requires the audit log (AUDIT_ENABLED)")
+				return
+			}
+			overriddenBy = name
+		}
+		if req.Type == common.TypeEmailTask {
+			var p common.EmailPayload
+			if err := json.Unmarshal(req.Payload, &p); err == nil {
+				now := time.Now()
+				opts, err = ledger.Options(r.Context(), &p, now, req.OverrideFrequencyCap, opts...)
+				var throttled throttle.ErrThrottled
+				switch {
+				case errors.As(err, &throttled):
+					writeThrottled(w, throttled)
+					return
+				case err != nil:
+					admin.WriteError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				opts = quiet.Options(&p, now, opts...)
+			}
+		}
+		info, err := client.EnqueueContext(r.Context(), task, opts...)
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		auditStore.RecordEnqueued(r.Context(), info)
+		if req.OverrideFrequencyCap {
+			log.Printf("⚠️  Frequency cap overridden for task %s by admin token %q", info.ID, overriddenBy)
+			auditStore.RecordOverride(r.Context(), info, fmt.Sprintf("frequency cap overridden by admin token %q", overriddenBy))
+		}
+		resp := EnqueueResponse{ID: info.ID, Queue: info.Queue, NextProcessAt: info.NextProcessAt}
+		if predictor != nil && info.State == asynq.TaskStatePending {
+			eta, err := predictor.EstimatedCompletion(r.Context(), inspector, task, info.Queue)
+			switch {
+			case err == nil:
+				resp.EstimatedCompletion = &eta
+			case !errors.Is(err, predict.ErrNoHistory):
+				log.Printf("⚠️  Failed to estimate completion of task %s: %v", info.ID, err)
+			}
+		}
+		admin.WriteJSON(w, http.StatusCreated, resp)
+	})
+}
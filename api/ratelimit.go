@@ -0,0 +1,33 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"asynqdemo/admin"
+
+	"golang.org/x/time/rate"
+)
+
+// HTTPRateLimitMiddleware answers 429 Too Many Requests with a Retry-After
+// header once limiter runs out of tokens
+func HTTPRateLimitMiddleware(limiter *rate.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res := limiter.Reserve()
+			if res.OK() && res.Delay() == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			retryAfter := 1
+			if res.OK() {
+				retryAfter = int(math.Ceil(res.Delay().Seconds()))
+				// The request is refused, so give the token back
+				res.Cancel()
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			admin.WriteError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		})
+	}
+}
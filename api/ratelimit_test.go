@@ -0,0 +1,55 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"asynqdemo/api"
+
+	"golang.org/x/time/rate"
+)
+
+// TestHTTPRateLimit makes 20 requests through a 10/s limiter and fails
+// unless the first 10 reach the handler, the rest are refused with 429 and
+// a Retry-After of a second without reaching it, and refused requests do
+// not use up tokens.
+func TestHTTPRateLimit(t *testing.T) {
+	reached := 0
+	h := api.HTTPRateLimitMiddleware(rate.NewLimiter(10, 10))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/tasks", nil))
+		return rec
+	}
+
+	for i := 1; i <= 20; i++ {
+		rec := do()
+		want := http.StatusOK
+		if i > 10 {
+			want = http.StatusTooManyRequests
+		}
+		if rec.Code != want {
+			t.Fatalf("request %d got %d, want %d", i, rec.Code, want)
+		}
+		if want == http.StatusTooManyRequests {
+			if s, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || s != 1 {
+				t.Errorf("request %d has Retry-After %q, want 1", i, rec.Header().Get("Retry-After"))
+			}
+		}
+	}
+	if reached != 10 {
+		t.Errorf("%d requests reached the handler, want 10", reached)
+	}
+
+	// One token refills in 100ms, and the ten refusals did not reserve it
+	time.Sleep(120 * time.Millisecond)
+	if rec := do(); rec.Code != http.StatusOK {
+		t.Errorf("request after the refill got %d", rec.Code)
+	}
+}
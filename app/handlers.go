@@ -0,0 +1,76 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/quarantine"
+
+	"github.com/hibiken/asynq"
+)
+
+// Mux is where RegisterHandlers registers, such as asynq.ServeMux or
+// common.ControlMux
+type Mux interface {
+	Handle(pattern string, h asynq.Handler)
+}
+
+// Deadlines of the handlers, each fitting its work: printing a greeting is
+// quick, collecting the runtime stats and firing webhooks is not
+const (
+	welcomeTimeout     = 5 * time.Second
+	emailTimeout       = 30 * time.Second
+	preferencesTimeout = 10 * time.Second
+	serverInfoTimeout  = time.Minute
+)
+
+// RegisterHandlers registers the handlers of the demo's task types, each
+// with its own timeout. serverInfo handles server info tasks,
+// HandleServerInfoTask wrapped as the worker needs; nil registers
+// HandleServerInfoTask itself.
+func RegisterHandlers(mux Mux, serverInfo asynq.Handler) {
+	if serverInfo == nil {
+		serverInfo = asynq.HandlerFunc(HandleServerInfoTask)
+	}
+	mux.Handle(common.TypeWelcomeMessage, common.WithTimeout(welcomeTimeout)(HandleWelcomeTask))
+	mux.Handle(common.TypeEmailTask, common.WithTimeout(emailTimeout)(HandleEmailTask))
+	mux.Handle(common.TypePreferencesUpdate, common.WithTimeout(preferencesTimeout)(HandlePreferencesUpdateTask))
+	mux.Handle(common.TypeServerInfo, common.WithTimeout(serverInfoTimeout)(serverInfo.ProcessTask))
+}
+
+// HandleWelcomeTask wraps the common handler for Asynq
+func HandleWelcomeTask(ctx context.Context, t *asynq.Task) error {
+	var p common.WelcomePayload
+	if err := quarantine.DecodeJSON(t, &p); err != nil {
+		return err
+	}
+	return common.HandleWelcomeTask(ctx, &p)
+}
+
+// HandleEmailTask wraps the common handler for Asynq
+func HandleEmailTask(ctx context.Context, t *asynq.Task) error {
+	var p common.EmailPayload
+	if err := quarantine.DecodeJSON(t, &p); err != nil {
+		return err
+	}
+	return common.HandleEmailTask(ctx, &p)
+}
+
+// HandleServerInfoTask wraps the common handler for Asynq
+func HandleServerInfoTask(ctx context.Context, t *asynq.Task) error {
+	var p common.ServerInfoPayload
+	if err := quarantine.DecodeJSON(t, &p); err != nil {
+		return err
+	}
+	return common.HandleServerInfoTask(ctx, &p)
+}
+
+// HandlePreferencesUpdateTask wraps the common handler for Asynq
+func HandlePreferencesUpdateTask(ctx context.Context, t *asynq.Task) error {
+	var p common.PreferencesUpdatePayload
+	if err := quarantine.DecodeJSON(t, &p); err != nil {
+		return err
+	}
+	return common.HandlePreferencesUpdateTask(ctx, &p)
+}
@@ -0,0 +1,37 @@
+// Package app holds the setup shared by the run modes of the demo binary:
+// the Redis connection, the task handlers of the worker's mux, the
+// periodic entries of the scheduler and the sample tasks of the producer.
+package app
+
+import "fmt"
+
+// Mode is the role a process runs
+type Mode string
+
+// Run modes; ModeAll runs the worker, the scheduler and the demo producer
+// in one process
+const (
+	ModeAll      Mode = "all"
+	ModeWorker   Mode = "worker"
+	ModeProduce  Mode = "produce"
+	ModeSchedule Mode = "schedule"
+)
+
+// ParseMode parses the -mode flag
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeAll, ModeWorker, ModeProduce, ModeSchedule:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown mode %q, want all, worker, produce or schedule", s)
+}
+
+// Worker reports whether the mode processes tasks
+func (m Mode) Worker() bool {
+	return m == ModeAll || m == ModeWorker
+}
+
+// Schedules reports whether the mode runs the periodic entries
+func (m Mode) Schedules() bool {
+	return m == ModeAll || m == ModeSchedule
+}
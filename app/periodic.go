@@ -0,0 +1,54 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"asynqdemo/canary"
+	"asynqdemo/common"
+	"asynqdemo/maintenance"
+	"asynqdemo/scheduler"
+	"asynqdemo/trash"
+)
+
+// RegisterPeriodic registers the periodic entries of the scheduler: server
+// info and the round-trip canary every 30 seconds, key compaction daily,
+// the preflight hourly and the purge of trashed tasks older than trashTTL
+// hourly. An entry that fails to register is logged and left out.
+func RegisterPeriodic(periodic *scheduler.ObservabilityWrapper, trashTTL time.Duration) {
+	serverInfo, err := common.NewServerInfoTask(common.ServerInfoPayload{
+		Timestamp: time.Now().Unix(),
+		Source:    "periodic-monitor",
+	})
+	if err != nil {
+		log.Printf("❌ Failed to create server info task: %v", err)
+	} else if _, err := periodic.Register("@every 30s", common.TypeServerInfo, serverInfo); err != nil {
+		log.Printf("❌ Failed to register server info scheduler: %v", err)
+	} else {
+		fmt.Println("⏰ Server info scheduler registered - runs every 30 seconds")
+	}
+
+	if _, err := periodic.Register("@every 30s", canary.TypeRoundtrip, canary.NewRoundtripTask()); err != nil {
+		log.Printf("❌ Failed to register roundtrip canary: %v", err)
+	}
+
+	// Compact per-task keys off-peak
+	if compactTask, err := maintenance.NewCompactTask(5 * time.Minute); err != nil {
+		log.Printf("❌ Failed to create compact task: %v", err)
+	} else if _, err := periodic.Register("0 3 * * *", maintenance.TypeCompact, compactTask); err != nil {
+		log.Printf("❌ Failed to register compact scheduler: %v", err)
+	} else {
+		fmt.Println("🧹 Key compaction scheduled daily at 03:00")
+	}
+
+	if _, err := periodic.Register("@every 1h", maintenance.TypePreflight, maintenance.NewPreflightTask()); err != nil {
+		log.Printf("❌ Failed to register preflight scheduler: %v", err)
+	}
+
+	if purgeTask, err := trash.NewPurgeTask(trashTTL); err != nil {
+		log.Printf("❌ Failed to create trash purge task: %v", err)
+	} else if _, err := periodic.Register("@every 1h", trash.TypePurge, purgeTask); err != nil {
+		log.Printf("❌ Failed to register trash purge scheduler: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package app
+
+import (
+	"context"
+	"fmt"
+
+	"asynqdemo/demo"
+)
+
+// Produce enqueues the tasks of the demo scenario at path once through
+// enqueue, failing when any of them could not be enqueued
+func Produce(ctx context.Context, path string, enqueue demo.Enqueuer) error {
+	scenario, err := demo.Load(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("📤 [Demo] Running scenario %s\n", scenario.Name)
+	sum := scenario.Run(ctx, enqueue)
+	fmt.Printf("🎉 [Demo] %s: %s\n", scenario.Name, sum)
+	if sum.Failed > 0 {
+		return fmt.Errorf("%d of the tasks of %s could not be enqueued", sum.Failed, scenario.Name)
+	}
+	return nil
+}
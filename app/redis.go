@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"asynqdemo/config"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/redisconn"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is the connection every mode starts from
+type Redis struct {
+	ConnOpt asynq.RedisConnOpt
+	// Client is shared for our own bookkeeping keys
+	Client redis.UniversalClient
+	// Embedded is the in-process instance, nil when connected to a server
+	Embedded *embeddedredis.Server
+}
+
+// ConnectRedis connects per cfg and REDIS_URL or REDIS_MODE/REDIS_ADDR,
+// with ACL credentials, failing early when the user lacks commands asynq
+// needs. With embedded it starts an in-process instance on addr instead,
+// which has no ACLs. Redis Cluster is refused until all our multi-key
+// commands share a hash tag.
+func ConnectRedis(cfg *config.Config, embedded bool, addr string) (*Redis, error) {
+	r := &Redis{}
+	if embedded {
+		if err := embeddedredis.CheckEnv(); err != nil {
+			return nil, err
+		}
+		srv, err := embeddedredis.Start(addr)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println(srv.Banner())
+		r.Embedded, r.ConnOpt = srv, srv.ConnOpt()
+	} else {
+		opt, err := cfg.ConnOpt()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis config: %v", err)
+		}
+		if _, ok := opt.(asynq.RedisClusterClientOpt); ok {
+			return nil, errors.New("Redis Cluster is not supported: several of our scripts and transactions use keys in different slots, which the cluster refuses with CROSSSLOT")
+		}
+		for _, name := range redisconn.Shadowed(os.Getenv) {
+			log.Printf("⚠️  %s is ignored, REDIS_URL takes precedence", name)
+		}
+		r.ConnOpt = opt
+	}
+	r.Client = r.ConnOpt.MakeRedisClient().(redis.UniversalClient)
+	if r.Embedded == nil {
+		if err := redisconn.CheckPermissions(context.Background(), r.Client); err != nil {
+			r.Client.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Close closes the client and stops the embedded instance, if any
+func (r *Redis) Close() {
+	r.Client.Close()
+	if r.Embedded != nil {
+		r.Embedded.Close()
+	}
+}
@@ -0,0 +1,260 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/sigv4"
+)
+
+// ErrNotFound is returned for artifacts and blobs that do not exist
+var ErrNotFound = errors.New("artifact not found")
+
+// BlobStore keeps artifact contents under slash-separated keys
+type BlobStore interface {
+	// Put stores size bytes read from r
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob; missing blobs are not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// Presigner is implemented by stores that issue their own download URLs
+type Presigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// FileStore keeps blobs as files below a directory
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a store writing below dir
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create artifact dir %s: %v", dir, err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path maps key below the directory, refusing keys that would leave it
+func (s *FileStore) path(key string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid artifact key %q", key)
+	}
+	return p, nil
+}
+
+// Put writes the blob to a temporary file and renames it into place, so
+// readers never see a partial artifact
+func (s *FileStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return fmt.Errorf("failed to create artifact dir: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create artifact file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write artifact %s: %v", key, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write artifact %s: %v", key, err)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("failed to store artifact %s: %v", key, err)
+	}
+	return nil
+}
+
+// Get opens the blob
+func (s *FileStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open artifact %s: %v", key, err)
+	}
+	return f, nil
+}
+
+// Delete removes the blob and its directory once empty
+func (s *FileStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete artifact %s: %v", key, err)
+	}
+	// Fails while other artifacts of the task remain, which is fine
+	os.Remove(filepath.Dir(p))
+	return nil
+}
+
+// S3Store keeps blobs in a bucket of S3 or an S3-compatible service, using
+// path-style URLs
+type S3Store struct {
+	endpoint string
+	bucket   string
+	region   string
+	creds    sigv4.Credentials
+	http     *http.Client
+}
+
+// NewS3Store creates a store for bucket at endpoint, such as
+// https://s3.eu-west-1.amazonaws.com or a MinIO URL
+func NewS3Store(endpoint, bucket, region string, creds sigv4.Credentials) *S3Store {
+	return &S3Store{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		bucket:   bucket,
+		region:   region,
+		creds:    creds,
+		http:     &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (s *S3Store) objectURL(key string) (*url.URL, error) {
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return url.Parse(s.endpoint + "/" + url.PathEscape(s.bucket) + "/" + strings.Join(segs, "/"))
+}
+
+func (s *S3Store) do(ctx context.Context, method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact key %q: %v", key, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %v", method, err)
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	req.Header.Set("X-Amz-Content-Sha256", sigv4.UnsignedPayload)
+	sigv4.Sign(req, sigv4.UnsignedPayload, s.region, "s3", s.creds, time.Now())
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s artifact %s: %v", method, key, err)
+	}
+	return resp, nil
+}
+
+// Put uploads the blob; S3 needs its size up front
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if size < 0 {
+		return fmt.Errorf("S3 uploads need the artifact size")
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Error(resp, key)
+}
+
+// Get downloads the blob
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Error(resp, key); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the blob
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := s3Error(resp, key); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// PresignGet returns a URL downloading the blob without credentials for ttl
+func (s *S3Store) PresignGet(key string, ttl time.Duration) (string, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid artifact key %q: %v", key, err)
+	}
+	return sigv4.Presign(http.MethodGet, u, s.region, "s3", s.creds, time.Now(), ttl), nil
+}
+
+func s3Error(resp *http.Response, key string) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("artifact %s: %s: %s", key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// BlobStoreFromEnv returns the store ARTIFACT_STORE names, nil when unset:
+// fs keeps files below ARTIFACT_DIR, s3 uses ARTIFACT_S3_BUCKET at
+// ARTIFACT_S3_ENDPOINT (AWS in AWS_REGION by default) with the AWS_*
+// credentials
+func BlobStoreFromEnv() (BlobStore, error) {
+	switch kind := os.Getenv("ARTIFACT_STORE"); kind {
+	case "":
+		return nil, nil
+	case "fs":
+		dir := os.Getenv("ARTIFACT_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("ARTIFACT_STORE=fs requires ARTIFACT_DIR")
+		}
+		return NewFileStore(dir)
+	case "s3":
+		bucket := os.Getenv("ARTIFACT_S3_BUCKET")
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("ARTIFACT_S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+		}
+		creds := sigv4.CredentialsFromEnv()
+		if bucket == "" || !creds.Valid() {
+			return nil, fmt.Errorf("ARTIFACT_STORE=s3 requires ARTIFACT_S3_BUCKET, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return NewS3Store(endpoint, bucket, region, creds), nil
+	default:
+		return nil, fmt.Errorf("unknown ARTIFACT_STORE %q, want fs or s3", kind)
+	}
+}
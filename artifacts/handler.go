@@ -0,0 +1,143 @@
+package artifacts
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"asynqdemo/admin"
+
+	"github.com/hibiken/asynq"
+)
+
+// URLTTLFromEnv returns ARTIFACT_URL_TTL, how long download URLs stay valid,
+// 15 minutes by default
+func URLTTLFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ARTIFACT_URL_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+// Handler serves the artifacts of a task below /tasks/ to viewers:
+//
+//	GET /tasks/{queue}/{id}/artifacts/{name}      streams the artifact
+//	GET /tasks/{queue}/{id}/artifacts/{name}/url  returns an expiring URL
+//
+// URLs are presigned by the blob store when it can, otherwise signed by
+// signer, which may be nil to disable them. Other paths go to next.
+func Handler(store *Store, inspector *asynq.Inspector, signer *URLSigner, authz *admin.Authorizer, ttl time.Duration, next http.Handler) http.Handler {
+	artifacts := authz.Require(admin.Allow("artifacts.read", admin.RoleViewer), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seg := admin.PathSegments(r, "/tasks/")
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		queue, id, name := seg[0], seg[1], seg[3]
+		// Artifacts live only as long as their task is retained
+		if _, err := inspector.GetTaskInfo(queue, id); err != nil {
+			if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+				admin.WriteError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		ref, err := store.Lookup(r.Context(), id, name)
+		if errors.Is(err, ErrNotFound) {
+			admin.WriteError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if len(seg) == 4 {
+			serve(w, r, store, ref.Key, ref.Name, ref.ContentType)
+			return
+		}
+		now := time.Now()
+		var u string
+		switch p, ok := store.Blobs().(Presigner); {
+		case ok:
+			if u, err = p.PresignGet(ref.Key, ttl); err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		case signer != nil:
+			u = signer.URL(ref.Key, now, ttl)
+		default:
+			admin.WriteError(w, http.StatusNotImplemented, "ARTIFACT_URL_SECRET is not set")
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+			"url":        u,
+			"expires_at": now.Add(ttl),
+		})
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seg := admin.PathSegments(r, "/tasks/")
+		if (len(seg) == 4 || (len(seg) == 5 && seg[4] == "url")) && seg[2] == "artifacts" {
+			artifacts.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DownloadHandler serves DownloadPath for URLs issued by signer. The
+// signature is the credential, so it needs no admin token.
+func DownloadHandler(store *Store, signer *URLSigner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		key, err := signer.Verify(r.URL.Query(), time.Now())
+		if err != nil {
+			admin.WriteError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		name, err := url.PathUnescape(path.Base(key))
+		if err != nil {
+			name = path.Base(key)
+		}
+		serve(w, r, store, key, name, "")
+	})
+}
+
+// serve streams a blob as an attachment
+func serve(w http.ResponseWriter, r *http.Request, store *Store, key, name, contentType string) {
+	body, err := store.Blobs().Get(r.Context(), key)
+	if errors.Is(err, ErrNotFound) {
+		admin.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		admin.WriteError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer body.Close()
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if f, ok := body.(*os.File); ok {
+		if st, err := f.Stat(); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(st.Size(), 10))
+		}
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("⚠️  Failed to stream artifact %s: %v", key, err)
+	}
+}
@@ -0,0 +1,162 @@
+// Package artifacts stores files produced by task handlers, such as reports,
+// next to the task and serves them for download.
+package artifacts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// IndexPrefix prefixes the hash listing the artifacts of a task by name
+const IndexPrefix = "task:artifacts:"
+
+// Ref references a stored artifact
+type Ref struct {
+	Name        string    `json:"name"`
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TaskResult is the result of tasks that produce artifacts
+type TaskResult struct {
+	Artifacts []Ref `json:"artifacts"`
+}
+
+// Store keeps artifact contents in a BlobStore and indexes them per task in
+// Redis
+type Store struct {
+	blobs BlobStore
+	rdb   redis.UniversalClient
+}
+
+// New creates a store
+func New(blobs BlobStore, rdb redis.UniversalClient) *Store {
+	return &Store{blobs: blobs, rdb: rdb}
+}
+
+// Blobs returns the underlying blob store
+func (s *Store) Blobs() BlobStore {
+	return s.blobs
+}
+
+func indexKey(taskID string) string {
+	return IndexPrefix + taskID
+}
+
+// blobKey names the blob of an artifact. Both parts are escaped so neither
+// can add path segments.
+func blobKey(taskID, name string) (string, error) {
+	for _, part := range []string{taskID, name} {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid artifact name %q of task %q", name, taskID)
+		}
+	}
+	return url.PathEscape(taskID) + "/" + url.PathEscape(name), nil
+}
+
+// Upload stores an artifact of a task, replacing one of the same name. size
+// may be -1 when unknown, which S3 stores reject.
+func (s *Store) Upload(ctx context.Context, taskID, name, contentType string, r io.Reader, size int64) (Ref, error) {
+	key, err := blobKey(taskID, name)
+	if err != nil {
+		return Ref{}, err
+	}
+	counter := &countingReader{r: r}
+	if err := s.blobs.Put(ctx, key, counter, size, contentType); err != nil {
+		return Ref{}, err
+	}
+	ref := Ref{Name: name, Key: key, Size: counter.n, ContentType: contentType, CreatedAt: time.Now()}
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return Ref{}, fmt.Errorf("failed to marshal artifact ref: %v", err)
+	}
+	if err := s.rdb.HSet(ctx, indexKey(taskID), name, data).Err(); err != nil {
+		return Ref{}, fmt.Errorf("failed to index artifact %s of task %s: %v", name, taskID, err)
+	}
+	return ref, nil
+}
+
+// UploadForTask uploads an artifact of the task ctx is processing
+func (s *Store) UploadForTask(ctx context.Context, name, contentType string, r io.Reader, size int64) (Ref, error) {
+	taskID, ok := asynq.GetTaskID(ctx)
+	if !ok {
+		return Ref{}, fmt.Errorf("no task in context for artifact %s", name)
+	}
+	return s.Upload(ctx, taskID, name, contentType, r, size)
+}
+
+// Lookup returns the ref of an artifact, ErrNotFound when there is none
+func (s *Store) Lookup(ctx context.Context, taskID, name string) (Ref, error) {
+	data, err := s.rdb.HGet(ctx, indexKey(taskID), name).Bytes()
+	if err == redis.Nil {
+		return Ref{}, ErrNotFound
+	}
+	if err != nil {
+		return Ref{}, fmt.Errorf("failed to look up artifact %s of task %s: %v", name, taskID, err)
+	}
+	var ref Ref
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return Ref{}, fmt.Errorf("failed to decode artifact %s of task %s: %v", name, taskID, err)
+	}
+	return ref, nil
+}
+
+// List returns the refs of all artifacts of a task
+func (s *Store) List(ctx context.Context, taskID string) ([]Ref, error) {
+	all, err := s.rdb.HGetAll(ctx, indexKey(taskID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list artifacts of task %s: %v", taskID, err)
+	}
+	refs := make([]Ref, 0, len(all))
+	for name, data := range all {
+		var ref Ref
+		if err := json.Unmarshal([]byte(data), &ref); err != nil {
+			return nil, fmt.Errorf("failed to decode artifact %s of task %s: %v", name, taskID, err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// Open returns the contents of an artifact
+func (s *Store) Open(ctx context.Context, ref Ref) (io.ReadCloser, error) {
+	return s.blobs.Get(ctx, ref.Key)
+}
+
+// DeleteAll removes the blobs and the index of a task's artifacts. The index
+// goes last so a failed run is retried by the next compaction.
+func (s *Store) DeleteAll(ctx context.Context, taskID string) (int, error) {
+	refs, err := s.List(ctx, taskID)
+	if err != nil {
+		return 0, err
+	}
+	for _, ref := range refs {
+		if err := s.blobs.Delete(ctx, ref.Key); err != nil {
+			return 0, err
+		}
+	}
+	if err := s.rdb.Del(ctx, indexKey(taskID)).Err(); err != nil {
+		return 0, fmt.Errorf("failed to delete artifact index of task %s: %v", taskID, err)
+	}
+	return len(refs), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,64 @@
+package artifacts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidURL is returned for download URLs that were not issued by this
+// signer or have expired
+var ErrInvalidURL = errors.New("invalid or expired download URL")
+
+// DownloadPath is where the admin server serves signed downloads
+const DownloadPath = "/artifacts/download"
+
+// URLSigner issues expiring download URLs for stores that cannot presign
+type URLSigner struct {
+	key     []byte
+	baseURL string
+}
+
+// NewURLSigner creates a signer with the HMAC key, issuing URLs below baseURL
+func NewURLSigner(key []byte, baseURL string) (*URLSigner, error) {
+	if len(key) < 16 {
+		return nil, fmt.Errorf("artifact URL key must be at least 16 bytes")
+	}
+	return &URLSigner{key: key, baseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+// URL returns a link downloading the blob key until now+ttl
+func (s *URLSigner) URL(key string, now time.Time, ttl time.Duration) string {
+	expires := strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	q := url.Values{}
+	q.Set("key", key)
+	q.Set("expires", expires)
+	q.Set("sig", base64.RawURLEncoding.EncodeToString(s.sign(key, expires)))
+	return s.baseURL + DownloadPath + "?" + q.Encode()
+}
+
+// Verify returns the blob key of a download URL's query valid at now
+func (s *URLSigner) Verify(q url.Values, now time.Time) (string, error) {
+	key, expires := q.Get("key"), q.Get("expires")
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get("sig"))
+	if err != nil || key == "" || !hmac.Equal(sig, s.sign(key, expires)) {
+		return "", ErrInvalidURL
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > exp {
+		return "", ErrInvalidURL
+	}
+	return key, nil
+}
+
+func (s *URLSigner) sign(key, expires string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(key + "\n" + expires))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrorCount is an error message and how many archived tasks had it
+type ErrorCount struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+// DiffRow is the change of one queue and task type. Type is empty for rows
+// computed from snapshots, which do not break queues down by type.
+type DiffRow struct {
+	Queue      string       `json:"queue"`
+	Type       string       `json:"type,omitempty"`
+	Enqueued   int          `json:"enqueued"`
+	Completed  int          `json:"completed"`
+	Archived   int          `json:"archived"`
+	NetBacklog int          `json:"net_backlog"`
+	TopErrors  []ErrorCount `json:"top_errors,omitempty"`
+}
+
+// DiffReport describes what changed between From and To
+type DiffReport struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// CountsOnly is set when the report was estimated from snapshots
+	CountsOnly bool      `json:"counts_only"`
+	Rows       []DiffRow `json:"rows"`
+}
+
+// Diff reports the changes between from and to, from the audit store when it
+// is enabled and from queue snapshots otherwise
+func Diff(ctx context.Context, rdb redis.UniversalClient, inspector *asynq.Inspector, from, to time.Time) (*DiffReport, error) {
+	enabled, err := Enabled(ctx, rdb)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		events, err := NewStore(rdb).Range(ctx, from, to)
+		if err != nil {
+			return nil, err
+		}
+		return &DiffReport{From: from, To: to, Rows: DiffEvents(events)}, nil
+	}
+	return diffSnapshots(ctx, rdb, inspector, from, to)
+}
+
+// DiffEvents aggregates audit events per queue and type
+func DiffEvents(events []Event) []DiffRow {
+	type key struct{ queue, typ string }
+	rows := make(map[key]*DiffRow)
+	errs := make(map[key]map[string]int)
+	for _, e := range events {
+		k := key{e.Queue, e.Type}
+		row, ok := rows[k]
+		if !ok {
+			row = &DiffRow{Queue: e.Queue, Type: e.Type}
+			rows[k] = row
+			errs[k] = make(map[string]int)
+		}
+		switch e.Kind {
+		case KindEnqueued:
+			row.Enqueued++
+		case KindCompleted:
+			row.Completed++
+		case KindArchived:
+			row.Archived++
+			errs[k][e.Error]++
+		}
+	}
+	out := make([]DiffRow, 0, len(rows))
+	for k, row := range rows {
+		row.NetBacklog = row.Enqueued - row.Completed - row.Archived
+		row.TopErrors = topErrors(errs[k], 3)
+		out = append(out, *row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Queue != out[j].Queue {
+			return out[i].Queue < out[j].Queue
+		}
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
+
+func topErrors(counts map[string]int, n int) []ErrorCount {
+	out := make([]ErrorCount, 0, len(counts))
+	for msg, c := range counts {
+		out = append(out, ErrorCount{Error: msg, Count: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Error < out[j].Error
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// diffSnapshots estimates the changes of each queue from the snapshots
+// bracketing the interval
+func diffSnapshots(ctx context.Context, rdb redis.UniversalClient, inspector *asynq.Inspector, from, to time.Time) (*DiffReport, error) {
+	queues, err := inspector.Queues()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(queues)
+	report := &DiffReport{From: from, To: to, CountsOnly: true}
+	for _, q := range queues {
+		a, err := snapshotAt(ctx, rdb, q, from)
+		if err != nil {
+			return nil, err
+		}
+		b, err := snapshotAt(ctx, rdb, q, to)
+		if err != nil {
+			return nil, err
+		}
+		if a == nil || b == nil {
+			continue
+		}
+		completed := (b.ProcessedTotal - b.FailedTotal) - (a.ProcessedTotal - a.FailedTotal)
+		archived := b.Archived - a.Archived
+		backlog := b.Backlog - a.Backlog
+		report.Rows = append(report.Rows, DiffRow{
+			Queue:      q,
+			Enqueued:   backlog + completed + archived,
+			Completed:  completed,
+			Archived:   archived,
+			NetBacklog: backlog,
+		})
+	}
+	return report, nil
+}
@@ -0,0 +1,121 @@
+package audit_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"asynqdemo/audit"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestDiffAudit seeds the audit store with a timeline around 14:00-14:30
+// and fails unless the diff counts exactly the events within it per queue
+// and type, with the most frequent errors of the archived tasks
+func TestDiffAudit(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+	store := audit.NewStore(rdb)
+	if err := store.Enable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	to := from.Add(30 * time.Minute)
+	at := func(min int) time.Time { return from.Add(time.Duration(min) * time.Minute) }
+	for _, e := range []audit.Event{
+		{At: at(-10), Queue: "default", Type: "email:send", Kind: audit.KindEnqueued},
+		{At: at(-5), Queue: "default", Type: "email:send", Kind: audit.KindArchived, Error: "before"},
+		{At: at(0), Queue: "default", Type: "email:send", Kind: audit.KindEnqueued},
+		{At: at(1), Queue: "default", Type: "email:send", Kind: audit.KindEnqueued},
+		{At: at(2), Queue: "default", Type: "email:send", Kind: audit.KindEnqueued},
+		{At: at(3), Queue: "default", Type: "email:send", Kind: audit.KindCompleted},
+		{At: at(4), Queue: "default", Type: "email:send", Kind: audit.KindArchived, Error: "smtp down"},
+		{At: at(5), Queue: "default", Type: "email:send", Kind: audit.KindArchived, Error: "smtp down"},
+		{At: at(6), Queue: "default", Type: "email:send", Kind: audit.KindArchived, Error: "bad address"},
+		{At: at(7), Queue: "default", Type: "email:send", Kind: audit.KindArchived, Error: "quota"},
+		{At: at(8), Queue: "default", Type: "email:send", Kind: audit.KindArchived, Error: "timeout"},
+		{At: at(10), Queue: "low", Type: "report:generate", Kind: audit.KindEnqueued},
+		{At: at(12), Queue: "critical", Type: "email:send", Kind: audit.KindCompleted},
+		{At: at(15), Queue: "critical", Type: "email:send", Kind: audit.KindCapOverridden},
+		{At: at(30), Queue: "low", Type: "report:generate", Kind: audit.KindCompleted},
+	} {
+		if err := store.Record(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := audit.Diff(ctx, rdb, nil, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []audit.DiffRow{
+		{Queue: "critical", Type: "email:send", Completed: 1, NetBacklog: -1, TopErrors: []audit.ErrorCount{}},
+		{Queue: "default", Type: "email:send", Enqueued: 3, Completed: 1, Archived: 5, NetBacklog: -3,
+			TopErrors: []audit.ErrorCount{{Error: "smtp down", Count: 2}, {Error: "bad address", Count: 1}, {Error: "quota", Count: 1}}},
+		{Queue: "low", Type: "report:generate", Enqueued: 1, NetBacklog: 1, TopErrors: []audit.ErrorCount{}},
+	}
+	if report.CountsOnly || !reflect.DeepEqual(report.Rows, want) {
+		t.Errorf("got %+v (counts only %v), want %+v", report.Rows, report.CountsOnly, want)
+	}
+}
+
+// TestDiffSnapshots fails unless, without the audit store, the diff
+// estimates each queue's changes from the snapshots bracketing the interval
+// and says it only has counts
+func TestDiffSnapshots(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	ctx := context.Background()
+	snapshotter := audit.NewSnapshotter(inspector, rdb, time.Minute)
+
+	enqueue := func(id string) {
+		if _, err := client.Enqueue(asynq.NewTask("email:send", nil), asynq.TaskID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		enqueue(id)
+	}
+	if err := snapshotter.Snapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	from := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	enqueue("d")
+	enqueue("e")
+	if err := inspector.ArchiveTask("default", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshotter.Snapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := audit.Diff(ctx, rdb, inspector, from, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []audit.DiffRow{{Queue: "default", Enqueued: 2, Archived: 1, NetBacklog: 1}}
+	if !report.CountsOnly || !reflect.DeepEqual(report.Rows, want) {
+		t.Errorf("got %+v (counts only %v), want %+v", report.Rows, report.CountsOnly, want)
+	}
+}
@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+const snapshotsKey = "stats:snapshots"
+
+// QueueSnapshot holds the counters of one queue at one time
+type QueueSnapshot struct {
+	At             time.Time `json:"at"`
+	Queue          string    `json:"queue"`
+	Backlog        int       `json:"backlog"`
+	Archived       int       `json:"archived"`
+	ProcessedTotal int       `json:"processed_total"`
+	FailedTotal    int       `json:"failed_total"`
+}
+
+// Snapshotter periodically stores queue counters, which is all the diff has
+// to go on when the audit store is disabled
+type Snapshotter struct {
+	inspector *asynq.Inspector
+	rdb       redis.UniversalClient
+	interval  time.Duration
+	// OnSnapshot, when set, is called with each stored snapshot
+	OnSnapshot func(QueueSnapshot)
+}
+
+// NewSnapshotter creates a snapshotter taking a snapshot every interval
+func NewSnapshotter(inspector *asynq.Inspector, rdb redis.UniversalClient, interval time.Duration) *Snapshotter {
+	return &Snapshotter{inspector: inspector, rdb: rdb, interval: interval}
+}
+
+// Run takes snapshots until ctx is done
+func (s *Snapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Snapshot(ctx); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Snapshot stores the current counters of every queue
+func (s *Snapshotter) Snapshot(ctx context.Context) error {
+	queues, err := s.inspector.Queues()
+	if err != nil {
+		return fmt.Errorf("failed to list queues: %v", err)
+	}
+	now := time.Now()
+	for _, q := range queues {
+		info, err := s.inspector.GetQueueInfo(q)
+		if err != nil {
+			return fmt.Errorf("failed to inspect queue %s: %v", q, err)
+		}
+		snap := QueueSnapshot{
+			At:             now,
+			Queue:          q,
+			Backlog:        info.Pending + info.Active + info.Scheduled + info.Retry,
+			Archived:       info.Archived,
+			ProcessedTotal: info.ProcessedTotal,
+			FailedTotal:    info.FailedTotal,
+		}
+		data, err := json.Marshal(snap)
+		if err != nil {
+			return fmt.Errorf("failed to marshal snapshot: %v", err)
+		}
+		key := snapshotsKey + ":" + q
+		pipe := s.rdb.Pipeline()
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: data})
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(now.Add(-retention).UnixMilli(), 10))
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("failed to store snapshot of %s: %v", q, err)
+		}
+		if s.OnSnapshot != nil {
+			s.OnSnapshot(snap)
+		}
+	}
+	return nil
+}
+
+// snapshotAt returns the last snapshot of queue taken at or before t
+func snapshotAt(ctx context.Context, rdb redis.UniversalClient, queue string, t time.Time) (*QueueSnapshot, error) {
+	raw, err := rdb.ZRevRangeByScore(ctx, snapshotsKey+":"+queue, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(t.UnixMilli(), 10),
+		Count: 1,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots of %s: %v", queue, err)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var snap QueueSnapshot
+	if err := json.Unmarshal([]byte(raw[0]), &snap); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot of %s: %v", queue, err)
+	}
+	return &snap, nil
+}
+
+// Snapshots returns the snapshots of queue taken between from and to, oldest
+// first
+func Snapshots(ctx context.Context, rdb redis.UniversalClient, queue string, from, to time.Time) ([]QueueSnapshot, error) {
+	raw, err := rdb.ZRangeByScore(ctx, snapshotsKey+":"+queue, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.UnixMilli(), 10),
+		Max: strconv.FormatInt(to.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots of %s: %v", queue, err)
+	}
+	snaps := make([]QueueSnapshot, 0, len(raw))
+	for _, r := range raw {
+		var snap QueueSnapshot
+		if err := json.Unmarshal([]byte(r), &snap); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot of %s: %v", queue, err)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
@@ -0,0 +1,217 @@
+// Package audit records task lifecycle events and answers what changed in the
+// queues between two points in time.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Event kinds
+const (
+	KindEnqueued  = "enqueued"
+	KindCompleted = "completed"
+	KindArchived  = "archived"
+	// KindCapOverridden is an enqueue an admin let past a frequency cap
+	KindCapOverridden = "cap-overridden"
+)
+
+const (
+	eventsKey  = "audit:events"
+	enabledKey = "audit:enabled"
+	retention  = 7 * 24 * time.Hour
+)
+
+// Event is one recorded change of a task
+type Event struct {
+	At     time.Time `json:"at"`
+	TaskID string    `json:"task_id"`
+	Queue  string    `json:"queue"`
+	Type   string    `json:"type"`
+	Kind   string    `json:"kind"`
+	Error  string    `json:"error,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Store keeps events in a Redis sorted set scored by time, for seven days
+type Store struct {
+	rdb redis.UniversalClient
+	// IsFailure tells failures from errors that are not, such as delays,
+	// which are retried without using up a retry; nil counts every error
+	IsFailure func(error) bool
+}
+
+// NewStore creates an audit store
+func NewStore(rdb redis.UniversalClient) *Store {
+	return &Store{rdb: rdb}
+}
+
+// Enable marks the store as in use so readers prefer it over snapshots
+func (s *Store) Enable(ctx context.Context) error {
+	return s.rdb.Set(ctx, enabledKey, time.Now().Format(time.RFC3339), 0).Err()
+}
+
+// Enabled reports whether a worker has ever recorded into the store
+func Enabled(ctx context.Context, rdb redis.UniversalClient) (bool, error) {
+	n, err := rdb.Exists(ctx, enabledKey).Result()
+	return n > 0, err
+}
+
+// Record stores an event and drops events past the retention
+func (s *Store) Record(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %v", err)
+	}
+	pipe := s.rdb.Pipeline()
+	pipe.ZAdd(ctx, eventsKey, redis.Z{Score: float64(e.At.UnixMilli()), Member: data})
+	pipe.ZRemRangeByScore(ctx, eventsKey, "-inf", "("+strconv.FormatInt(e.At.Add(-retention).UnixMilli(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record audit event: %v", err)
+	}
+	return nil
+}
+
+// RecordEnqueued records a task returned by Enqueue. A nil Store records nothing.
+func (s *Store) RecordEnqueued(ctx context.Context, info *asynq.TaskInfo) {
+	if s == nil {
+		return
+	}
+	e := Event{At: time.Now(), TaskID: info.ID, Queue: info.Queue, Type: info.Type, Kind: KindEnqueued}
+	if err := s.Record(ctx, e); err != nil {
+		log.Printf("⚠️  %v", err)
+	}
+}
+
+// RecordOverride records a task enqueued past a frequency cap, with who
+// allowed it in detail. A nil Store records nothing.
+func (s *Store) RecordOverride(ctx context.Context, info *asynq.TaskInfo, detail string) {
+	if s == nil {
+		return
+	}
+	e := Event{At: time.Now(), TaskID: info.ID, Queue: info.Queue, Type: info.Type, Kind: KindCapOverridden, Detail: detail}
+	if err := s.Record(ctx, e); err != nil {
+		log.Printf("⚠️  %v", err)
+	}
+}
+
+// Range returns the events in [from, to), oldest first
+func (s *Store) Range(ctx context.Context, from, to time.Time) ([]Event, error) {
+	raw, err := s.rdb.ZRangeByScore(ctx, eventsKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.UnixMilli(), 10),
+		Max: "(" + strconv.FormatInt(to.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit events: %v", err)
+	}
+	events := make([]Event, 0, len(raw))
+	for _, r := range raw {
+		var e Event
+		if err := json.Unmarshal([]byte(r), &e); err != nil {
+			return nil, fmt.Errorf("failed to parse audit event: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// Middleware records completed tasks and tasks archived after their last
+// attempt. Deferred tasks at their last attempt are not archived and not
+// recorded.
+func (s *Store) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			err := next.ProcessTask(ctx, t)
+			id, _ := asynq.GetTaskID(ctx)
+			queue, _ := asynq.GetQueueName(ctx)
+			e := Event{At: time.Now(), TaskID: id, Queue: queue, Type: t.Type()}
+			retried, _ := asynq.GetRetryCount(ctx)
+			maxRetry, _ := asynq.GetMaxRetry(ctx)
+			switch {
+			case err == nil:
+				e.Kind = KindCompleted
+			case errors.Is(err, asynq.SkipRetry) || retried >= maxRetry && (s.IsFailure == nil || s.IsFailure(err)):
+				e.Kind, e.Error = KindArchived, err.Error()
+			default:
+				return err
+			}
+			// Use a fresh context so an expired task deadline does not lose the event
+			if rerr := s.Record(context.Background(), e); rerr != nil {
+				log.Printf("⚠️  %v", rerr)
+			}
+			return err
+		})
+	}
+}
+
+// accessKey holds admin API accesses, kept as long as task events
+const accessKey = "audit:access"
+
+// Access outcomes
+const (
+	OutcomeAllowed         = "allowed"
+	OutcomeForbidden       = "forbidden"
+	OutcomeUnauthenticated = "unauthenticated"
+	OutcomeRateLimited     = "rate_limited"
+)
+
+// Access is one request to the admin API
+type Access struct {
+	At time.Time `json:"at"`
+	// Token is the name of the token used, empty when none matched
+	Token     string `json:"token,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Operation string `json:"operation"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Outcome   string `json:"outcome"`
+	Status    int    `json:"status"`
+}
+
+// RecordAccess stores an admin API access. A nil Store records nothing.
+func (s *Store) RecordAccess(ctx context.Context, a Access) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to marshal access: %v", err)
+	}
+	pipe := s.rdb.Pipeline()
+	pipe.ZAdd(ctx, accessKey, redis.Z{Score: float64(a.At.UnixMilli()), Member: data})
+	pipe.ZRemRangeByScore(ctx, accessKey, "-inf", "("+strconv.FormatInt(a.At.Add(-retention).UnixMilli(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record access: %v", err)
+	}
+	return nil
+}
+
+// AccessRange returns the admin API accesses in [from, to), oldest first
+func (s *Store) AccessRange(ctx context.Context, from, to time.Time) ([]Access, error) {
+	raw, err := s.rdb.ZRangeByScore(ctx, accessKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.UnixMilli(), 10),
+		Max: "(" + strconv.FormatInt(to.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accesses: %v", err)
+	}
+	accesses := make([]Access, 0, len(raw))
+	for _, r := range raw {
+		var a Access
+		if err := json.Unmarshal([]byte(r), &a); err != nil {
+			return nil, fmt.Errorf("failed to parse access: %v", err)
+		}
+		accesses = append(accesses, a)
+	}
+	return accesses, nil
+}
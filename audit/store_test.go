@@ -0,0 +1,60 @@
+package audit_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"asynqdemo/audit"
+	"asynqdemo/circuit"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestMiddlewareDeferred runs last attempts through the middleware and
+// fails unless completed and failed tasks are recorded while tasks deferred
+// by an open circuit or a flag are not recorded as archived
+func TestMiddlewareDeferred(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	store := audit.NewStore(rdb)
+	store.IsFailure = flags.IsFailure
+
+	// Without retry counts in the context every attempt is the last
+	handler := store.Middleware()(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		switch task.Type() {
+		case "open":
+			return circuit.ErrOpen{Provider: "smtp", ProbeAt: time.Now().Add(time.Second), Delay: time.Second}
+		case "delayed":
+			return flags.ErrDelayed{TaskType: "delayed", Delay: time.Minute}
+		case "fail":
+			return errors.New("smtp down")
+		}
+		return nil
+	}))
+	start := time.Now().Add(-time.Second)
+	for _, typ := range []string{"done", "open", "delayed", "fail"} {
+		handler.ProcessTask(context.Background(), asynq.NewTask(typ, nil))
+	}
+	events, err := store.Range(context.Background(), start, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, e := range events {
+		got[e.Type] = e.Kind
+	}
+	want := map[string]string{"done": audit.KindCompleted, "fail": audit.KindArchived}
+	if len(got) != len(want) || got["done"] != want["done"] || got["fail"] != want["fail"] {
+		t.Errorf("recorded %v, want %v", got, want)
+	}
+}
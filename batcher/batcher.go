@@ -0,0 +1,242 @@
+// Package batcher combines the items of concurrent handler invocations into
+// one provider call, for providers that charge per call but accept many
+// items, while each invocation still gets the result of its own item.
+package batcher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMargin is how long before the earliest deadline of its items a
+// batch is flushed, leaving time for the provider call
+const DefaultMargin = time.Second
+
+// Flush reasons, the reason label of asynq_batch_flushes_total
+const (
+	ReasonSize     = "size"
+	ReasonWait     = "wait"
+	ReasonDeadline = "deadline"
+	ReasonShutdown = "shutdown"
+)
+
+// FlushFunc sends a batch and returns the error of each item in order; a
+// nil slice means every item succeeded. ctx ends at the earliest deadline
+// of the items.
+type FlushFunc[T any] func(ctx context.Context, items []T) []error
+
+// Batcher collects items until MaxSize of them are waiting, MaxWait passed
+// since the first, or the earliest deadline of their callers is Margin
+// away, and flushes them together
+type Batcher[T any] struct {
+	Name    string
+	MaxSize int
+	MaxWait time.Duration
+	Margin  time.Duration
+
+	flush   FlushFunc[T]
+	sizes   prometheus.Histogram
+	flushes *prometheus.CounterVec
+
+	mu      sync.Mutex
+	pending *batch[T]
+	closed  bool
+}
+
+// call is one item waiting for its result
+type call[T any] struct {
+	item     T
+	deadline time.Time
+	done     chan error
+}
+
+// batch is the calls flushed together
+type batch[T any] struct {
+	calls  []*call[T]
+	opened time.Time
+	due    time.Time
+	reason string
+	timer  *time.Timer
+}
+
+// New creates a batcher named name for its metrics, flushing at most
+// maxSize items at once
+func New[T any](name string, maxSize int, maxWait time.Duration, flush FlushFunc[T], reg prometheus.Registerer) (*Batcher[T], error) {
+	if maxSize < 1 {
+		return nil, fmt.Errorf("batcher %s: size must be positive", name)
+	}
+	b := &Batcher[T]{
+		Name:    name,
+		MaxSize: maxSize,
+		MaxWait: maxWait,
+		Margin:  DefaultMargin,
+		flush:   flush,
+		sizes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "asynq_batch_size",
+			Help:        "Items per flushed batch.",
+			ConstLabels: prometheus.Labels{"batcher": name},
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		flushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "asynq_batch_flushes_total",
+			Help:        "Flushed batches by what triggered the flush.",
+			ConstLabels: prometheus.Labels{"batcher": name},
+		}, []string{"reason"}),
+	}
+	for _, c := range []prometheus.Collector{b.sizes, b.flushes} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register batcher %s metrics: %v", name, err)
+		}
+	}
+	return b, nil
+}
+
+// Do adds item to the next batch and returns its result once the batch is
+// flushed. When ctx ends first the item is dropped from the batch if it
+// was not sent yet; either way Do returns ctx's error.
+func (b *Batcher[T]) Do(ctx context.Context, item T) error {
+	c := &call[T]{item: item, done: make(chan error, 1)}
+	c.deadline, _ = ctx.Deadline()
+	now := time.Now()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		b.send(ReasonShutdown, []*call[T]{c})
+		return <-c.done
+	}
+	if b.pending == nil {
+		b.pending = &batch[T]{opened: now}
+	}
+	p := b.pending
+	p.calls = append(p.calls, c)
+	if len(p.calls) >= b.MaxSize {
+		b.take(p)
+		b.mu.Unlock()
+		go b.send(ReasonSize, p.calls)
+	} else {
+		b.schedule(p, now)
+		b.mu.Unlock()
+	}
+
+	select {
+	case err := <-c.done:
+		return err
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.remove(c)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// schedule sets the timer of p to its first due time; b.mu is held
+func (b *Batcher[T]) schedule(p *batch[T], now time.Time) {
+	due, reason := p.opened.Add(b.MaxWait), ReasonWait
+	for _, c := range p.calls {
+		if d := c.deadline.Add(-b.Margin); !c.deadline.IsZero() && d.Before(due) {
+			due, reason = d, ReasonDeadline
+		}
+	}
+	if p.timer != nil {
+		if due.Equal(p.due) {
+			return
+		}
+		p.timer.Stop()
+	}
+	p.due, p.reason = due, reason
+	p.timer = time.AfterFunc(due.Sub(now), func() {
+		b.mu.Lock()
+		if b.pending != p {
+			b.mu.Unlock()
+			return
+		}
+		b.take(p)
+		b.mu.Unlock()
+		b.send(p.reason, p.calls)
+	})
+}
+
+// take detaches p so no more items join it; b.mu is held
+func (b *Batcher[T]) take(p *batch[T]) {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if b.pending == p {
+		b.pending = nil
+	}
+}
+
+// remove drops c from the pending batch; b.mu is held
+func (b *Batcher[T]) remove(c *call[T]) {
+	p := b.pending
+	if p == nil {
+		return
+	}
+	for i, pc := range p.calls {
+		if pc != c {
+			continue
+		}
+		p.calls = append(p.calls[:i:i], p.calls[i+1:]...)
+		if len(p.calls) == 0 {
+			b.take(p)
+		}
+		return
+	}
+}
+
+// send flushes calls and hands each its result
+func (b *Batcher[T]) send(reason string, calls []*call[T]) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	var earliest time.Time
+	items := make([]T, len(calls))
+	for i, c := range calls {
+		items[i] = c.item
+		if !c.deadline.IsZero() && (earliest.IsZero() || c.deadline.Before(earliest)) {
+			earliest = c.deadline
+		}
+	}
+	if !earliest.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, earliest)
+	}
+	defer cancel()
+
+	b.sizes.Observe(float64(len(items)))
+	b.flushes.WithLabelValues(reason).Inc()
+	errs := b.flush(ctx, items)
+	for i, c := range calls {
+		switch {
+		case errs == nil:
+			c.done <- nil
+		case len(errs) != len(items):
+			c.done <- fmt.Errorf("batcher %s: flush returned %d results for %d items", b.Name, len(errs), len(items))
+		default:
+			c.done <- errs[i]
+		}
+	}
+}
+
+// Close flushes the pending batch; items added later are sent one by one
+func (b *Batcher[T]) Close() {
+	b.mu.Lock()
+	b.closed = true
+	p := b.pending
+	if p != nil {
+		b.take(p)
+	}
+	b.mu.Unlock()
+	if p != nil {
+		b.send(ReasonShutdown, p.calls)
+	}
+}
+
+// Run closes the batcher once ctx is done, so shutdown flushes it
+func (b *Batcher[T]) Run(ctx context.Context) error {
+	<-ctx.Done()
+	b.Close()
+	return nil
+}
@@ -0,0 +1,279 @@
+// Package bulk enqueues many tasks in few Redis round-trips by running
+// asynq's enqueue scripts through a pipeline, one round-trip per flush.
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultMaxPipelineSize is how many tasks one pipeline flush writes
+const DefaultMaxPipelineSize = 500
+
+// asynq's defaults for tasks enqueued without the options
+const (
+	defaultMaxRetry = 25
+	defaultTimeout  = 30 * time.Minute
+)
+
+// allQueuesKey is asynq's set of queue names
+const allQueuesKey = "asynq:queues"
+
+// BatchEntry is a task to enqueue with its options. Options given to
+// asynq.NewTask cannot be read back from the task, so pass them here.
+type BatchEntry struct {
+	Task    *asynq.Task
+	Options []asynq.Option
+}
+
+// BatchResult is the outcome of one entry: Info when it was enqueued, Err
+// otherwise, e.g. asynq.ErrTaskIDConflict
+type BatchResult struct {
+	Info *asynq.TaskInfo
+	Err  error
+}
+
+// BatchClient enqueues batches of tasks through Redis pipelines
+type BatchClient struct {
+	client *asynq.Client
+	rdb    redis.UniversalClient
+	// MaxPipelineSize splits larger batches into several flushes
+	MaxPipelineSize int
+}
+
+// NewBatchClient creates a batch client writing to rdb, the Redis client
+// is connected to. Entries the pipeline cannot write, those with
+// asynq.Unique or asynq.Group, are enqueued one by one through client.
+func NewBatchClient(client *asynq.Client, rdb redis.UniversalClient) *BatchClient {
+	return &BatchClient{client: client, rdb: rdb, MaxPipelineSize: DefaultMaxPipelineSize}
+}
+
+// EnqueueBatch is EnqueueBatchContext with a background context
+func (c *BatchClient) EnqueueBatch(entries []BatchEntry) ([]BatchResult, error) {
+	return c.EnqueueBatchContext(context.Background(), entries)
+}
+
+// EnqueueBatchContext enqueues entries in flushes of MaxPipelineSize, one
+// round-trip each, and returns a result per entry, in order. A failed
+// entry or flush does not stop the others; the error is only set when ctx
+// ended before every flush ran, and the entries not written then carry it
+// too.
+func (c *BatchClient) EnqueueBatchContext(ctx context.Context, entries []BatchEntry) ([]BatchResult, error) {
+	size := c.MaxPipelineSize
+	if size < 1 {
+		size = DefaultMaxPipelineSize
+	}
+	results := make([]BatchResult, len(entries))
+	for start := 0; start < len(entries); start += size {
+		end := start + size
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if err := ctx.Err(); err != nil {
+			for i := start; i < len(entries); i++ {
+				results[i].Err = err
+			}
+			return results, err
+		}
+		c.flush(ctx, entries[start:end], results[start:end])
+	}
+	return results, nil
+}
+
+// enqueueScript and scheduleScript are asynq v0.24.1's enqueueCmd and
+// scheduleCmd, which write a task atomically unless its ID is taken. They
+// are copied so a pipeline can run them; TestBatchClient reads the tasks
+// back through asynq's Inspector to catch an asynq upgrade changing them.
+//
+// KEYS[1] task hash, KEYS[2] pending list or scheduled set
+// ARGV[1] encoded message, then the ID and the time in ns (enqueue) or
+// the process time in seconds and the ID (schedule)
+var (
+	enqueueScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1],
+           "msg", ARGV[1],
+           "state", "pending",
+           "pending_since", ARGV[3])
+redis.call("LPUSH", KEYS[2], ARGV[2])
+return 1
+`)
+	scheduleScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1],
+           "msg", ARGV[1],
+           "state", "scheduled")
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[3])
+return 1
+`)
+)
+
+// write is an entry queued on the pipeline
+type write struct {
+	i       int
+	info    *asynq.TaskInfo
+	encoded []byte
+	cmd     *redis.Cmd
+}
+
+// flush writes entries in one pipelined round-trip: the scripts are
+// loaded, the queues registered as asynq does before writing a task, and
+// each task written by its script
+func (c *BatchClient) flush(ctx context.Context, entries []BatchEntry, results []BatchResult) {
+	now := time.Now()
+	var (
+		writes []write
+		queues []interface{}
+		seen   = make(map[string]bool)
+	)
+	for i, e := range entries {
+		info, encoded, ok, err := compose(e, now)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if !ok {
+			results[i].Info, results[i].Err = c.client.EnqueueContext(ctx, e.Task, e.Options...)
+			continue
+		}
+		if !seen[info.Queue] {
+			seen[info.Queue] = true
+			queues = append(queues, info.Queue)
+		}
+		writes = append(writes, write{i: i, info: info, encoded: encoded})
+	}
+	if len(writes) == 0 {
+		return
+	}
+	pipe := c.rdb.Pipeline()
+	enqueueScript.Load(ctx, pipe)
+	scheduleScript.Load(ctx, pipe)
+	pipe.SAdd(ctx, allQueuesKey, queues...)
+	for j, w := range writes {
+		key := queueKey(w.info.Queue, "t:"+w.info.ID)
+		if w.info.State == asynq.TaskStateScheduled {
+			writes[j].cmd = scheduleScript.EvalSha(ctx, pipe, []string{key, queueKey(w.info.Queue, "scheduled")}, w.encoded, w.info.NextProcessAt.Unix(), w.info.ID)
+		} else {
+			writes[j].cmd = enqueueScript.EvalSha(ctx, pipe, []string{key, queueKey(w.info.Queue, "pending")}, w.encoded, w.info.ID, now.UnixNano())
+		}
+	}
+	// Exec returns the first failed command's error; each is checked below
+	_, _ = pipe.Exec(ctx)
+	for _, w := range writes {
+		n, err := w.cmd.Int()
+		switch {
+		case err != nil:
+			results[w.i].Err = fmt.Errorf("failed to enqueue task %s: %v", w.info.ID, err)
+		case n == 0:
+			results[w.i].Err = asynq.ErrTaskIDConflict
+		default:
+			results[w.i].Info = w.info
+		}
+	}
+}
+
+// queueKey is the key of a queue's name in asynq's layout, e.g.
+// "asynq:{default}:pending"
+func queueKey(queue, name string) string {
+	return "asynq:{" + queue + "}:" + name
+}
+
+// compose applies the options of e as asynq's client does and encodes the
+// task message. ok is false for entries the pipeline leaves to the client.
+func compose(e BatchEntry, now time.Time) (info *asynq.TaskInfo, encoded []byte, ok bool, err error) {
+	if e.Task == nil {
+		return nil, nil, false, errors.New("task cannot be nil")
+	}
+	if strings.TrimSpace(e.Task.Type()) == "" {
+		return nil, nil, false, errors.New("task typename cannot be empty")
+	}
+	info = &asynq.TaskInfo{
+		ID:            uuid.NewString(),
+		Queue:         "default",
+		Type:          e.Task.Type(),
+		Payload:       e.Task.Payload(),
+		State:         asynq.TaskStatePending,
+		MaxRetry:      defaultMaxRetry,
+		NextProcessAt: now,
+	}
+	for _, opt := range e.Options {
+		switch opt.Type() {
+		case asynq.MaxRetryOpt:
+			info.MaxRetry = opt.Value().(int)
+		case asynq.QueueOpt:
+			info.Queue = opt.Value().(string)
+			if strings.TrimSpace(info.Queue) == "" {
+				return nil, nil, false, errors.New("queue name must contain one or more characters")
+			}
+		case asynq.TaskIDOpt:
+			info.ID = opt.Value().(string)
+			if strings.TrimSpace(info.ID) == "" {
+				return nil, nil, false, errors.New("task ID cannot be empty")
+			}
+		case asynq.TimeoutOpt:
+			info.Timeout = opt.Value().(time.Duration)
+		case asynq.DeadlineOpt:
+			info.Deadline = opt.Value().(time.Time)
+		case asynq.ProcessAtOpt:
+			info.NextProcessAt = opt.Value().(time.Time)
+		case asynq.ProcessInOpt:
+			info.NextProcessAt = now.Add(opt.Value().(time.Duration))
+		case asynq.RetentionOpt:
+			info.Retention = opt.Value().(time.Duration)
+		case asynq.UniqueOpt, asynq.GroupOpt:
+			return nil, nil, false, nil
+		}
+	}
+	if info.Deadline.IsZero() && info.Timeout == 0 {
+		info.Timeout = defaultTimeout
+	}
+	if info.NextProcessAt.After(now) {
+		info.State = asynq.TaskStateScheduled
+	} else {
+		info.NextProcessAt = now
+	}
+	return info, encodeMessage(info), true, nil
+}
+
+// encodeMessage is the protobuf TaskMessage asynq stores in the "msg" field
+// of the task hash, with the fields a new task sets
+func encodeMessage(info *asynq.TaskInfo) []byte {
+	var b []byte
+	bytesField := func(num protowire.Number, v []byte) {
+		if len(v) > 0 {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, v)
+		}
+	}
+	varintField := func(num protowire.Number, v int64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		}
+	}
+	var deadline int64
+	if !info.Deadline.IsZero() {
+		deadline = info.Deadline.Unix()
+	}
+	bytesField(1, []byte(info.Type))
+	bytesField(2, info.Payload)
+	bytesField(3, []byte(info.ID))
+	bytesField(4, []byte(info.Queue))
+	varintField(5, int64(info.MaxRetry))
+	varintField(8, int64(info.Timeout.Seconds()))
+	varintField(9, deadline)
+	varintField(12, int64(info.Retention.Seconds()))
+	return b
+}
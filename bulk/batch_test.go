@@ -0,0 +1,269 @@
+package bulk_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/bulk"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestBatchClient enqueues batches split over several pipeline flushes
+// on an embedded Redis and fails unless each flush is one round-trip,
+// every task reads back through asynq's Inspector as asynq's client would
+// have written it and is processed, options apply, scheduled and unique
+// tasks are handled, and failed entries are reported without stopping the
+// others.
+func TestBatchClient(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	pipelines := &pipelineCounter{}
+	rdb.AddHook(pipelines)
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	bc := bulk.NewBatchClient(client, rdb)
+	bc.MaxPipelineSize = 3
+	deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+	entries := []bulk.BatchEntry{
+		{Task: asynq.NewTask("bulk:a", []byte(`{"n":1}`))},
+		{Task: asynq.NewTask("bulk:a", []byte(`{"n":2}`)), Options: []asynq.Option{asynq.Queue("critical"), asynq.MaxRetry(3), asynq.TaskID("fixed")}},
+		{Task: asynq.NewTask("bulk:a", []byte(`{"n":3}`)), Options: []asynq.Option{asynq.Deadline(deadline), asynq.Retention(time.Hour)}},
+		{Task: asynq.NewTask("bulk:a", []byte(`{"n":4}`)), Options: []asynq.Option{asynq.ProcessIn(time.Hour)}},
+		{Task: asynq.NewTask("bulk:a", []byte(`{"n":5}`)), Options: []asynq.Option{asynq.Queue("critical"), asynq.TaskID("fixed")}},
+		{Task: asynq.NewTask("", nil)},
+		{Task: asynq.NewTask("bulk:a", []byte(`{"n":7}`)), Options: []asynq.Option{asynq.Unique(time.Hour)}},
+		{Task: asynq.NewTask("bulk:a", []byte(`{"n":7}`)), Options: []asynq.Option{asynq.Unique(time.Hour)}},
+		{Task: asynq.NewTask("bulk:b", []byte(`{"n":9}`)), Options: []asynq.Option{asynq.Timeout(time.Minute)}},
+	}
+	results, err := bc.EnqueueBatch(entries)
+	if err != nil || len(results) != len(entries) {
+		t.Fatalf("EnqueueBatch gave %d results (%v)", len(results), err)
+	}
+	if n := pipelines.n.Load(); n != 3 {
+		t.Errorf("9 entries in flushes of 3 took %d pipelines, want 3", n)
+	}
+	for i, r := range results {
+		failed := i == 4 || i == 5 || i == 7
+		if failed != (r.Err != nil) || failed == (r.Info != nil) {
+			t.Errorf("entry %d: %+v, want failed=%v", i, r, failed)
+		}
+	}
+	if !errors.Is(results[4].Err, asynq.ErrTaskIDConflict) {
+		t.Errorf("taken task ID gave %v, want ErrTaskIDConflict", results[4].Err)
+	}
+	if !errors.Is(results[7].Err, asynq.ErrDuplicateTask) {
+		t.Errorf("second unique task gave %v, want ErrDuplicateTask", results[7].Err)
+	}
+
+	// Tasks read back as the client would have written them
+	check := func(i int, want func(info *asynq.TaskInfo) bool) {
+		t.Helper()
+		r := results[i]
+		got, err := inspector.GetTaskInfo(r.Info.Queue, r.Info.ID)
+		if err != nil || got.Type != r.Info.Type || string(got.Payload) != string(r.Info.Payload) || got.State != r.Info.State ||
+			got.MaxRetry != r.Info.MaxRetry || got.Timeout != r.Info.Timeout || !want(got) {
+			t.Errorf("entry %d stored as %+v (%v), enqueued as %+v", i, got, err, r.Info)
+		}
+	}
+	check(0, func(info *asynq.TaskInfo) bool {
+		return info.Queue == "default" && info.MaxRetry == 25 && info.Timeout == 30*time.Minute && info.State == asynq.TaskStatePending
+	})
+	check(1, func(info *asynq.TaskInfo) bool {
+		return info.ID == "fixed" && info.Queue == "critical" && info.MaxRetry == 3
+	})
+	check(2, func(info *asynq.TaskInfo) bool {
+		return info.Deadline.Equal(deadline) && info.Timeout == 0 && info.Retention == time.Hour
+	})
+	check(3, func(info *asynq.TaskInfo) bool {
+		return info.State == asynq.TaskStateScheduled && info.NextProcessAt.After(time.Now().Add(59*time.Minute))
+	})
+	check(8, func(info *asynq.TaskInfo) bool { return info.Type == "bulk:b" && info.Timeout == time.Minute })
+	if queues, err := inspector.Queues(); err != nil || len(queues) != 2 {
+		t.Errorf("queues %v (%v), want default and critical", queues, err)
+	}
+
+	// A worker processes what the batch wrote
+	var mu sync.Mutex
+	processed := map[string]bool{}
+	mux := asynq.NewServeMux()
+	mux.HandleFunc("bulk:a", func(ctx context.Context, task *asynq.Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed[string(task.Payload())] = true
+		return nil
+	})
+	mux.HandleFunc("bulk:b", func(context.Context, *asynq.Task) error { return nil })
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 2, Queues: map[string]int{"default": 1, "critical": 1}, LogLevel: asynq.WarnLevel})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	want := []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":7}`}
+	for wait := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		mu.Lock()
+		done := len(processed) == len(want)
+		mu.Unlock()
+		if done || time.Now().After(wait) {
+			break
+		}
+	}
+	mu.Lock()
+	for _, p := range want {
+		if !processed[p] {
+			t.Errorf("task %s was not processed, processed %v", p, processed)
+		}
+	}
+	mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = bc.EnqueueBatchContext(ctx, entries[:2])
+	if !errors.Is(err, context.Canceled) || !errors.Is(results[1].Err, context.Canceled) {
+		t.Errorf("batch with a cancelled context gave %v, %+v", err, results)
+	}
+}
+
+// latencyProxy forwards connections to addr, holding every request for
+// delay the way a network round-trip would
+func latencyProxy(tb testing.TB, addr string, delay time.Duration) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				defer server.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := client.Read(buf)
+					if err != nil {
+						return
+					}
+					time.Sleep(delay)
+					if _, err := server.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				defer client.Close()
+				io.Copy(client, server)
+			}()
+		}
+	}()
+	tb.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	return ln.Addr().String()
+}
+
+// BenchmarkEnqueue compares enqueueing 1000 tasks one by one and in a batch
+// over a link with a 2ms round-trip
+func BenchmarkEnqueue(b *testing.B) {
+	b.Run("sequential", func(b *testing.B) { benchmarkEnqueue(b, 1000, false) })
+	b.Run("batched", func(b *testing.B) { benchmarkEnqueue(b, 1000, true) })
+}
+
+// benchmarkEnqueue enqueues n tasks per iteration on an embedded Redis
+// behind a 2ms round-trip, in batches through a BatchClient or one by one
+// through asynq's client
+func benchmarkEnqueue(b *testing.B, n int, batch bool) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	opt := asynq.RedisClientOpt{Addr: latencyProxy(b, srv.Addr(), 2*time.Millisecond)}
+	client := asynq.NewClient(opt)
+	defer client.Close()
+	proxied := opt.MakeRedisClient().(redis.UniversalClient)
+	defer proxied.Close()
+	bc := bulk.NewBatchClient(client, proxied)
+
+	entries := make([]bulk.BatchEntry, n)
+	for i := range entries {
+		entries[i].Task = asynq.NewTask("bench", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Start each iteration empty; the embedded Redis slows down as
+		// the pending list grows
+		b.StopTimer()
+		if err := rdb.FlushDB(context.Background()).Err(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if batch {
+			results, err := bc.EnqueueBatch(entries)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Err != nil {
+					b.Fatal(r.Err)
+				}
+			}
+			continue
+		}
+		for _, e := range entries {
+			if _, err := client.Enqueue(e.Task); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "tasks/s")
+}
+
+// pipelineCounter is a go-redis hook counting the pipelines sent
+type pipelineCounter struct {
+	n atomic.Int32
+}
+
+func (c *pipelineCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (c *pipelineCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (c *pipelineCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		c.n.Add(1)
+		return next(ctx, cmds)
+	}
+}
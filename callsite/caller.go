@@ -0,0 +1,37 @@
+// Package callsite records where in the code tasks are enqueued from.
+package callsite
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// KeyEnqueuedFrom is the task metadata attribute holding the enqueuing call site
+const KeyEnqueuedFrom = "enqueued_from"
+
+// EnqueueWithCallerInfo enqueues task with the call site stored in its
+// metadata as "file:line func". skip 0 records the direct caller, 1 the
+// caller's caller and so on.
+func EnqueueWithCallerInfo(ctx context.Context, client *asynq.Client, task *asynq.Task, skip int, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	task, err := metadata.With(task, metadata.Metadata{KeyEnqueuedFrom: Caller(skip + 1)})
+	if err != nil {
+		return nil, err
+	}
+	return client.EnqueueContext(ctx, task, opts...)
+}
+
+// Caller formats the frame skip levels above the caller of Caller
+func Caller(skip int) string {
+	var pcs [1]uintptr
+	// Skip runtime.Callers and Caller itself
+	if runtime.Callers(skip+2, pcs[:]) == 0 {
+		return "unknown"
+	}
+	frame, _ := runtime.CallersFrames(pcs[:]).Next()
+	return fmt.Sprintf("%s:%d %s", frame.File, frame.Line, frame.Function)
+}
@@ -0,0 +1,74 @@
+package callsite_test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"asynqdemo/callsite"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// enqueueVia enqueues with skip 1, recording the caller of enqueueVia
+func enqueueVia(client *asynq.Client) (*asynq.TaskInfo, error) {
+	return callsite.EnqueueWithCallerInfo(context.Background(), client, asynq.NewTask("callsite:test", []byte(`{}`)), 1)
+}
+
+// TestEnqueueWithCallerInfo fails unless skip 0 stores this test's file,
+// line and function in the enqueued_from metadata, skip 1 the line calling
+// a helper, and existing metadata is kept
+func TestEnqueueWithCallerInfo(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	enqueuedFrom := func(info *asynq.TaskInfo) metadata.Metadata {
+		t.Helper()
+		stored, err := inspector.GetTaskInfo(info.Queue, info.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata.FromTask(asynq.NewTask(stored.Type, stored.Payload))
+	}
+	task, err := metadata.NewTask("callsite:test", []byte(`{}`), metadata.Metadata{"source": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, file, line, _ := runtime.Caller(0)
+	direct, err := callsite.EnqueueWithCallerInfo(context.Background(), client, task, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, viaLine, _ := runtime.Caller(0)
+	via, err := enqueueVia(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := enqueuedFrom(direct)
+	want := fmt.Sprintf("%s:%d asynqdemo/callsite_test.TestEnqueueWithCallerInfo", file, line+1)
+	if md[callsite.KeyEnqueuedFrom] != want || md["source"] != "test" {
+		t.Errorf("skip 0 stored %v, want %s", md, want)
+	}
+	if !strings.Contains(md[callsite.KeyEnqueuedFrom], "caller_test.go:") {
+		t.Errorf("call site %q does not name the test file", md[callsite.KeyEnqueuedFrom])
+	}
+	want = fmt.Sprintf("%s:%d asynqdemo/callsite_test.TestEnqueueWithCallerInfo", file, viaLine+1)
+	if got := enqueuedFrom(via)[callsite.KeyEnqueuedFrom]; got != want {
+		t.Errorf("skip 1 stored %q, want %s", got, want)
+	}
+	if got := callsite.Caller(1 << 20); got != "unknown" {
+		t.Errorf("frame past the stack gave %q", got)
+	}
+}
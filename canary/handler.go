@@ -0,0 +1,172 @@
+package canary
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"asynqdemo/admin"
+
+	"github.com/hibiken/asynq"
+)
+
+// CanaryStats counts calls and errors of one handler variant
+type CanaryStats struct {
+	Calls  int64 `json:"calls"`
+	Errors int64 `json:"errors"`
+}
+
+// CanaryHandler routes a fraction of tasks to a new handler implementation
+// while the rest keeps going to the stable one
+type CanaryHandler struct {
+	stable, canary asynq.Handler
+
+	mu   sync.Mutex
+	rate float64
+	rng  *rand.Rand
+
+	stableCalls, stableErrors atomic.Int64
+	canaryCalls, canaryErrors atomic.Int64
+}
+
+// NewCanaryHandler creates a handler sending the given fraction of tasks to canary
+func NewCanaryHandler(stable, canary asynq.Handler, rate float64) (*CanaryHandler, error) {
+	if err := validateRate(rate); err != nil {
+		return nil, err
+	}
+	return &CanaryHandler{
+		stable: stable,
+		canary: canary,
+		rate:   rate,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// ProcessTask invokes the canary with probability rate and stable otherwise
+func (h *CanaryHandler) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	h.mu.Lock()
+	useCanary := h.rng.Float64() < h.rate
+	h.mu.Unlock()
+
+	if useCanary {
+		h.canaryCalls.Add(1)
+		err := h.canary.ProcessTask(ctx, t)
+		if err != nil {
+			h.canaryErrors.Add(1)
+		}
+		return err
+	}
+	h.stableCalls.Add(1)
+	err := h.stable.ProcessTask(ctx, t)
+	if err != nil {
+		h.stableErrors.Add(1)
+	}
+	return err
+}
+
+// SetRate changes the fraction of tasks sent to the canary
+func (h *CanaryHandler) SetRate(rate float64) error {
+	if err := validateRate(rate); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.rate = rate
+	h.mu.Unlock()
+	return nil
+}
+
+// Rate returns the fraction of tasks sent to the canary
+func (h *CanaryHandler) Rate() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rate
+}
+
+// GetStats returns the call and error counts of both variants
+func (h *CanaryHandler) GetStats() (stable, canary CanaryStats) {
+	stable = CanaryStats{Calls: h.stableCalls.Load(), Errors: h.stableErrors.Load()}
+	canary = CanaryStats{Calls: h.canaryCalls.Load(), Errors: h.canaryErrors.Load()}
+	return stable, canary
+}
+
+func validateRate(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("canary rate must be between 0 and 1, got %v", rate)
+	}
+	return nil
+}
+
+// Registry keeps the canary handlers by task type for the admin API
+type Registry struct {
+	mu       sync.RWMutex
+	handlers map[string]*CanaryHandler
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]*CanaryHandler)}
+}
+
+// Register makes the canary of a task type adjustable through the admin API
+func (r *Registry) Register(taskType string, h *CanaryHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[taskType] = h
+}
+
+// Get returns the canary handler of a task type
+func (r *Registry) Get(taskType string) (*CanaryHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[taskType]
+	return h, ok
+}
+
+type rateResponse struct {
+	Type   string      `json:"type"`
+	Rate   float64     `json:"rate"`
+	Stable CanaryStats `json:"stable"`
+	Canary CanaryStats `json:"canary"`
+}
+
+// ServeHTTP handles GET and PUT /handlers/{type}/canary-rate. PUT expects a
+// body like {"rate": 0.1}.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	seg := admin.PathSegments(req, "/handlers/")
+	if len(seg) != 2 || seg[1] != "canary-rate" {
+		admin.WriteError(w, http.StatusNotFound, "not found")
+		return
+	}
+	h, ok := r.Get(seg[0])
+	if !ok {
+		admin.WriteError(w, http.StatusNotFound, fmt.Sprintf("no canary registered for %q", seg[0]))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Rate *float64 `json:"rate"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Rate == nil {
+			admin.WriteError(w, http.StatusBadRequest, `expected body {"rate": <0..1>}`)
+			return
+		}
+		if err := h.SetRate(*body.Rate); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	stable, canary := h.GetStats()
+	admin.WriteJSON(w, http.StatusOK, rateResponse{Type: seg[0], Rate: h.Rate(), Stable: stable, Canary: canary})
+}
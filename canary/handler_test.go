@@ -0,0 +1,102 @@
+package canary_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"asynqdemo/canary"
+	"asynqdemo/leak/leaktest"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestCanaryHandler runs 10000 tasks with a canary rate of 0.1 and fails
+// unless the canary takes 10% ±1.5% of them and errors are counted per
+// variant
+func TestCanaryHandler(t *testing.T) {
+	leaktest.Check(t)
+	stable := asynq.HandlerFunc(func(context.Context, *asynq.Task) error { return nil })
+	broken := asynq.HandlerFunc(func(context.Context, *asynq.Task) error { return errors.New("boom") })
+	h, err := canary.NewCanaryHandler(stable, broken, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10000
+	failed := 0
+	for i := 0; i < n; i++ {
+		if h.ProcessTask(context.Background(), asynq.NewTask("canary:test", nil)) != nil {
+			failed++
+		}
+	}
+	s, c := h.GetStats()
+	if s.Calls+c.Calls != n {
+		t.Fatalf("%d stable and %d canary calls, want %d in total", s.Calls, c.Calls, n)
+	}
+	if frac := float64(c.Calls) / n; math.Abs(frac-0.1) > 0.015 {
+		t.Errorf("canary took %.2f%% of the tasks, want 10%% ±1.5%%", frac*100)
+	}
+	if s.Errors != 0 || c.Errors != c.Calls || int64(failed) != c.Errors {
+		t.Errorf("stable %+v, canary %+v, %d failed", s, c, failed)
+	}
+
+	if _, err := canary.NewCanaryHandler(stable, broken, 1.5); err == nil {
+		t.Error("rate above 1 accepted")
+	}
+	if err := h.SetRate(-0.1); err == nil || h.Rate() != 0.1 {
+		t.Errorf("negative rate gave %v, rate now %v", err, h.Rate())
+	}
+}
+
+// TestRegistry fails unless PUT /handlers/{type}/canary-rate changes the
+// rate of the registered handler and bad requests are refused
+func TestRegistry(t *testing.T) {
+	noop := asynq.HandlerFunc(func(context.Context, *asynq.Task) error { return nil })
+	h, err := canary.NewCanaryHandler(noop, noop, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := canary.NewRegistry()
+	reg.Register("email:send", h)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	w := do(http.MethodPut, "/handlers/email:send/canary-rate", `{"rate": 0.25}`)
+	var resp struct {
+		Type string  `json:"type"`
+		Rate float64 `json:"rate"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || resp.Rate != 0.25 || resp.Type != "email:send" {
+		t.Fatalf("PUT gave %d %s", w.Code, w.Body)
+	}
+	if h.Rate() != 0.25 {
+		t.Errorf("rate %v after PUT, want 0.25", h.Rate())
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodGet, "/handlers/email:send/canary-rate", "", http.StatusOK},
+		{http.MethodPut, "/handlers/email:send/canary-rate", `{"rate": 2}`, http.StatusBadRequest},
+		{http.MethodPut, "/handlers/email:send/canary-rate", `{}`, http.StatusBadRequest},
+		{http.MethodPut, "/handlers/sms:send/canary-rate", `{"rate": 0.5}`, http.StatusNotFound},
+		{http.MethodPut, "/handlers/email:send/rate", `{"rate": 0.5}`, http.StatusNotFound},
+		{http.MethodDelete, "/handlers/email:send/canary-rate", "", http.StatusMethodNotAllowed},
+	} {
+		if w := do(tc.method, tc.path, tc.body); w.Code != tc.code {
+			t.Errorf("%s %s %s: %d, want %d", tc.method, tc.path, tc.body, w.Code, tc.code)
+		}
+	}
+	if h.Rate() != 0.25 {
+		t.Errorf("rate %v after refused requests, want 0.25", h.Rate())
+	}
+}
@@ -0,0 +1,254 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// TypeRoundtrip is the synthetic task checking scheduler, Redis, queueing
+// and processing end to end
+const TypeRoundtrip = "canary:roundtrip"
+
+// RoundtripQueue is consumed at top priority so a backlog elsewhere does
+// not delay the canary
+const RoundtripQueue = "canary"
+
+const (
+	// sentKey and landedKey map canary nonces to when they were enqueued
+	// and processed, in Unix nanoseconds
+	sentKey     = "canary:roundtrip:sent"
+	landedKey   = "canary:roundtrip:landed"
+	lastSentKey = "canary:roundtrip:last-sent"
+	stateKey    = "canary:roundtrip:state"
+)
+
+// roundtripOptions archive a failed canary right away; a retry would only
+// hide the failure
+var roundtripOptions = []asynq.Option{asynq.Queue(RoundtripQueue), asynq.MaxRetry(0), asynq.Timeout(10 * time.Second)}
+
+// The canary is a control task: it has no payload, the nonce of a canary is
+// its task ID, which the scheduler generates for every enqueue
+func init() {
+	common.RegisterTaskSpec(common.TaskSpec{Type: TypeRoundtrip, Control: true, DefaultOptions: roundtripOptions})
+}
+
+// NewRoundtripTask creates the canary task registered with the scheduler
+func NewRoundtripTask() *asynq.Task {
+	return asynq.NewTask(TypeRoundtrip, nil, roundtripOptions...)
+}
+
+// RoundtripStatus is the canary's state shown on /healthz
+type RoundtripStatus struct {
+	Healthy        bool      `json:"healthy"`
+	LatencySeconds float64   `json:"latency_seconds"`
+	LastLandedAt   time.Time `json:"last_landed_at,omitempty"`
+	LastFailure    string    `json:"last_failure,omitempty"`
+	LastFailureAt  time.Time `json:"last_failure_at,omitempty"`
+}
+
+// Roundtrip records when canaries are enqueued and processed, and alerts
+// when one is late, lost, or the scheduler stopped sending them
+type Roundtrip struct {
+	rdb        redis.UniversalClient
+	every      time.Duration
+	maxLatency time.Duration
+	alert      func(ctx context.Context, text string) error
+
+	latency  prometheus.Gauge
+	failures prometheus.Counter
+
+	mu     sync.Mutex
+	status RoundtripStatus
+}
+
+// NewRoundtrip creates a canary scheduled every interval whose tasks must
+// be processed within maxLatency; alert may be nil to only log
+func NewRoundtrip(rdb redis.UniversalClient, every, maxLatency time.Duration, alert func(ctx context.Context, text string) error, reg prometheus.Registerer) (*Roundtrip, error) {
+	r := &Roundtrip{
+		rdb:        rdb,
+		every:      every,
+		maxLatency: maxLatency,
+		alert:      alert,
+		latency: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "asynq_canary_roundtrip_latency_seconds",
+			Help: "Time from enqueueing the last verified canary task to processing it.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "asynq_canary_roundtrip_failures_total",
+			Help: "Canary tasks that were late or lost, and intervals without a canary.",
+		}),
+		status: RoundtripStatus{Healthy: true},
+	}
+	for _, c := range []prometheus.Collector{r.latency, r.failures} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register canary metrics: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// PostEnqueue records canaries the scheduler enqueued; it is the
+// PostEnqueueFunc of the scheduler
+func (r *Roundtrip) PostEnqueue(info *asynq.TaskInfo, err error) {
+	if err != nil || info == nil || info.Type != TypeRoundtrip {
+		return
+	}
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	ctx := context.Background()
+	pipe := r.rdb.Pipeline()
+	pipe.HSet(ctx, sentKey, info.ID, now)
+	pipe.Set(ctx, lastSentKey, now, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("⚠️  Failed to record canary %s: %v", info.ID, err)
+	}
+}
+
+// ProcessTask writes the canary's nonce to Redis
+func (r *Roundtrip) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	id, ok := asynq.GetTaskID(ctx)
+	if !ok {
+		return fmt.Errorf("canary task without an ID")
+	}
+	if err := r.rdb.HSet(ctx, landedKey, id, time.Now().UnixNano()).Err(); err != nil {
+		return fmt.Errorf("failed to record canary %s: %v", id, err)
+	}
+	return nil
+}
+
+// Status returns the result of the last verification
+func (r *Roundtrip) Status() RoundtripStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Verify checks every recorded canary: those processed are measured, those
+// not processed within maxLatency fail. Each canary is checked by the one
+// worker whose HDEL claims it.
+func (r *Roundtrip) Verify(ctx context.Context) error {
+	sent, err := r.rdb.HGetAll(ctx, sentKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read canaries: %v", err)
+	}
+	landed, err := r.rdb.HGetAll(ctx, landedKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read canaries: %v", err)
+	}
+	now := time.Now()
+	for id, v := range sent {
+		sentAt := unixNano(v)
+		l, ok := landed[id]
+		if !ok && now.Sub(sentAt) <= r.maxLatency {
+			continue
+		}
+		if n, err := r.rdb.HDel(ctx, sentKey, id).Result(); err != nil || n == 0 {
+			continue
+		}
+		if !ok {
+			r.fail(ctx, fmt.Sprintf("Canary %s enqueued at %s was not processed within %v", id, sentAt.Format(time.RFC3339), r.maxLatency))
+			continue
+		}
+		r.rdb.HDel(ctx, landedKey, id)
+		landedAt := unixNano(l)
+		latency := landedAt.Sub(sentAt)
+		r.latency.Set(latency.Seconds())
+		r.mu.Lock()
+		r.status.LatencySeconds, r.status.LastLandedAt = latency.Seconds(), landedAt
+		r.mu.Unlock()
+		if latency > r.maxLatency {
+			r.fail(ctx, fmt.Sprintf("Canary %s took %v from enqueue to processing, more than %v", id, latency.Round(time.Millisecond), r.maxLatency))
+			continue
+		}
+		r.ok(ctx)
+	}
+	// Nonces processed without a recorded enqueue, e.g. enqueued by hand
+	for id, l := range landed {
+		if _, ok := sent[id]; !ok && now.Sub(unixNano(l)) > 10*r.maxLatency {
+			r.rdb.HDel(ctx, landedKey, id)
+		}
+	}
+
+	// The scheduler itself stopped: no canary enqueued for two intervals
+	last, err := r.rdb.Get(ctx, lastSentKey).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read last canary: %v", err)
+	}
+	if since := now.Sub(unixNano(last)); since > 2*r.every+r.maxLatency {
+		claimed, err := r.rdb.SetNX(ctx, lastSentKey+":checked", 1, r.every).Result()
+		if err == nil && claimed {
+			r.fail(ctx, fmt.Sprintf("No canary was enqueued for %v; is the scheduler running?", since.Round(time.Second)))
+		}
+	}
+	return nil
+}
+
+// fail records a failure and alerts when the canary was healthy before
+func (r *Roundtrip) fail(ctx context.Context, text string) {
+	r.failures.Inc()
+	r.mu.Lock()
+	r.status.Healthy, r.status.LastFailure, r.status.LastFailureAt = false, text, time.Now()
+	r.mu.Unlock()
+	log.Printf("⚠️  %s", text)
+	prev, err := r.rdb.GetSet(ctx, stateKey, "failing").Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("⚠️  Failed to update canary state: %v", err)
+	}
+	if prev == "failing" || r.alert == nil {
+		return
+	}
+	if err := r.alert(ctx, text); err != nil {
+		log.Printf("❌ Failed to alert about the canary: %v", err)
+	}
+}
+
+// ok records a canary processed in time
+func (r *Roundtrip) ok(ctx context.Context) {
+	r.mu.Lock()
+	r.status.Healthy = true
+	r.mu.Unlock()
+	if prev, err := r.rdb.GetSet(ctx, stateKey, "ok").Result(); err == nil && prev == "failing" {
+		log.Printf("✅ Canary round trips recovered")
+	}
+}
+
+// Reset forgets every recorded canary and the failing state
+func (r *Roundtrip) Reset(ctx context.Context) error {
+	if err := r.rdb.Del(ctx, sentKey, landedKey, lastSentKey, lastSentKey+":checked", stateKey).Err(); err != nil {
+		return fmt.Errorf("failed to reset canaries: %v", err)
+	}
+	return nil
+}
+
+// Run verifies the canaries every interval until ctx is done
+func (r *Roundtrip) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := r.Verify(ctx); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+	}
+}
+
+func unixNano(v string) time.Time {
+	n, _ := strconv.ParseInt(v, 10, 64)
+	return time.Unix(0, n)
+}
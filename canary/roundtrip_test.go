@@ -0,0 +1,112 @@
+package canary_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/canary"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestRoundtripCanary runs canaries through a real server, first with
+// the canary handler and then with a broken one, and fails unless the
+// first round trip is measured without an alert and the second raises
+// exactly one.
+func TestRoundtripCanary(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	const maxLatency = 5 * time.Second
+	ctx := context.Background()
+	rdb, ok := r.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		t.Fatalf("unsupported redis connection %T", r)
+	}
+	defer rdb.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	client := asynq.NewClient(r)
+	defer client.Close()
+
+	var (
+		mu     sync.Mutex
+		alerts []string
+	)
+	alert := func(ctx context.Context, text string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		alerts = append(alerts, text)
+		return nil
+	}
+	rt, err := canary.NewRoundtrip(rdb, time.Minute, maxLatency, alert, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := func() {
+		inspector.DeleteQueue(canary.RoundtripQueue, true)
+		rt.Reset(ctx)
+	}
+	reset()
+	defer reset()
+
+	// run processes one canary with h and verifies it once it landed or
+	// maxLatency passed
+	run := func(h asynq.Handler) {
+		srv := asynq.NewServer(r, asynq.Config{Concurrency: 1, Queues: map[string]int{canary.RoundtripQueue: 1}, LogLevel: asynq.FatalLevel})
+		mux := asynq.NewServeMux()
+		mux.Handle(canary.TypeRoundtrip, h)
+		if err := srv.Start(mux); err != nil {
+			t.Fatalf("failed to start server: %v", err)
+		}
+		defer srv.Shutdown()
+		info, err := client.Enqueue(canary.NewRoundtripTask())
+		rt.PostEnqueue(info, err)
+		if err != nil {
+			t.Fatalf("failed to enqueue canary: %v", err)
+		}
+		deadline := time.Now().Add(maxLatency + time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(200 * time.Millisecond)
+			if before := rt.Status().LastLandedAt; rt.Verify(ctx) == nil && rt.Status().LastLandedAt != before {
+				return
+			}
+		}
+		if err := rt.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(rt)
+	status := rt.Status()
+	if !status.Healthy || status.LatencySeconds <= 0 || status.LatencySeconds > maxLatency.Seconds() {
+		t.Errorf("working canary: status %+v", status)
+	}
+	mu.Lock()
+	if len(alerts) != 0 {
+		t.Errorf("working canary alerted: %v", alerts)
+	}
+	mu.Unlock()
+
+	run(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		return fmt.Errorf("broken canary handler")
+	}))
+	if status := rt.Status(); status.Healthy {
+		t.Errorf("broken canary: status %+v", status)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "not processed") {
+		t.Errorf("broken canary: alerts %v, want one about a canary not processed", alerts)
+	}
+}
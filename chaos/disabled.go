@@ -0,0 +1,59 @@
+//go:build !chaos
+
+package chaos
+
+import (
+	"context"
+	"fmt"
+
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+)
+
+// Enabled reports whether chaos mode was compiled in
+const Enabled = false
+
+// ChaosScheduler is only available in builds with the chaos tag
+type ChaosScheduler struct{}
+
+// NewChaosScheduler fails in builds without the chaos tag
+func NewChaosScheduler(r asynq.RedisConnOpt, opts *asynq.SchedulerOpts, failRate float64, seed int64) (*ChaosScheduler, error) {
+	return nil, fmt.Errorf("chaos mode requires building with -tags chaos")
+}
+
+// Register always fails
+func (cs *ChaosScheduler) Register(cronspec string, task *asynq.Task, opts ...asynq.Option) (string, error) {
+	return "", fmt.Errorf("chaos mode requires building with -tags chaos")
+}
+
+// Unregister does nothing
+func (cs *ChaosScheduler) Unregister(entryID string) error {
+	return nil
+}
+
+// Start always fails
+func (cs *ChaosScheduler) Start() error {
+	return fmt.Errorf("chaos mode requires building with -tags chaos")
+}
+
+// Shutdown does nothing
+func (cs *ChaosScheduler) Shutdown() {}
+
+// FailingMailer is only available in builds with the chaos tag
+type FailingMailer struct{}
+
+// NewFailingMailer fails in builds without the chaos tag
+func NewFailingMailer(inner common.Mailer, failRate float64, seed int64) (*FailingMailer, error) {
+	return nil, fmt.Errorf("chaos mode requires building with -tags chaos")
+}
+
+// SetFailRate always fails
+func (m *FailingMailer) SetFailRate(failRate float64) error {
+	return fmt.Errorf("chaos mode requires building with -tags chaos")
+}
+
+// Send always fails
+func (m *FailingMailer) Send(ctx context.Context, msg common.EmailMessage) error {
+	return fmt.Errorf("chaos mode requires building with -tags chaos")
+}
@@ -0,0 +1,58 @@
+//go:build chaos
+
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+
+	"asynqdemo/common"
+)
+
+// FailingMailer wraps a mailer and fails a fraction of sends, as an email
+// provider having an outage would
+type FailingMailer struct {
+	inner    common.Mailer
+	failRate float64
+	rng      *rand.Rand
+	mu       sync.Mutex
+}
+
+// NewFailingMailer creates a mailer failing with probability failRate;
+// inner may be nil to only print the email that would have been sent
+func NewFailingMailer(inner common.Mailer, failRate float64, seed int64) (*FailingMailer, error) {
+	m := &FailingMailer{inner: inner, rng: rand.New(rand.NewSource(seed))}
+	if err := m.SetFailRate(failRate); err != nil {
+		return nil, err
+	}
+	log.Printf("🐒 Chaos mailer failing %.0f%% of sends", failRate*100)
+	return m, nil
+}
+
+// SetFailRate changes the fraction of failed sends, e.g. to end an outage
+func (m *FailingMailer) SetFailRate(failRate float64) error {
+	if failRate < 0 || failRate > 1 {
+		return fmt.Errorf("chaos fail rate must be within [0, 1], got %v", failRate)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failRate = failRate
+	return nil
+}
+
+// Send fails or hands msg to the inner mailer
+func (m *FailingMailer) Send(ctx context.Context, msg common.EmailMessage) error {
+	m.mu.Lock()
+	fail := m.rng.Float64() < m.failRate
+	m.mu.Unlock()
+	if fail {
+		return fmt.Errorf("failed to send email to %s: %w", msg.To, ErrInjected)
+	}
+	if m.inner == nil {
+		return nil
+	}
+	return m.inner.Send(ctx, msg)
+}
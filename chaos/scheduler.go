@@ -0,0 +1,96 @@
+//go:build chaos
+
+// Package chaos injects failures into the scheduler to check that periodic
+// tasks survive flaky Redis calls.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+
+	"github.com/hibiken/asynq"
+)
+
+// Enabled reports whether chaos mode was compiled in
+const Enabled = true
+
+// ErrInjected is the synthetic error returned by failed calls
+var ErrInjected = errors.New("chaos: injected failure")
+
+// ChaosScheduler wraps an asynq scheduler and fails a fraction of calls.
+// Register fails outright, and enqueues made after Start are dropped by
+// deleting the task right after it was enqueued, as if the write was lost.
+type ChaosScheduler struct {
+	inner     *asynq.Scheduler
+	inspector *asynq.Inspector
+	failRate  float64
+	rng       *rand.Rand
+	mu        sync.Mutex
+}
+
+// NewChaosScheduler creates a scheduler that fails with probability failRate.
+// A fixed seed makes a chaos run reproducible.
+func NewChaosScheduler(r asynq.RedisConnOpt, opts *asynq.SchedulerOpts, failRate float64, seed int64) (*ChaosScheduler, error) {
+	if failRate < 0 || failRate > 1 {
+		return nil, fmt.Errorf("chaos fail rate must be within [0, 1], got %v", failRate)
+	}
+	cs := &ChaosScheduler{
+		inspector: asynq.NewInspector(r),
+		failRate:  failRate,
+		rng:       rand.New(rand.NewSource(seed)),
+	}
+	var o asynq.SchedulerOpts
+	if opts != nil {
+		o = *opts
+	}
+	post := o.PostEnqueueFunc
+	o.PostEnqueueFunc = func(info *asynq.TaskInfo, err error) {
+		if err == nil && cs.fail() {
+			if derr := cs.inspector.DeleteTask(info.Queue, info.ID); derr != nil {
+				log.Printf("⚠️  Chaos failed to drop task %s: %v", info.ID, derr)
+			} else {
+				log.Printf("🐒 Chaos dropped scheduled %s task %s", info.Type, info.ID)
+				err = ErrInjected
+			}
+		}
+		if post != nil {
+			post(info, err)
+		}
+	}
+	cs.inner = asynq.NewScheduler(r, &o)
+	return cs, nil
+}
+
+func (cs *ChaosScheduler) fail() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.rng.Float64() < cs.failRate
+}
+
+// Register registers an entry unless a failure is injected
+func (cs *ChaosScheduler) Register(cronspec string, task *asynq.Task, opts ...asynq.Option) (string, error) {
+	if cs.fail() {
+		return "", fmt.Errorf("failed to register %s: %w", task.Type(), ErrInjected)
+	}
+	return cs.inner.Register(cronspec, task, opts...)
+}
+
+// Unregister removes an entry
+func (cs *ChaosScheduler) Unregister(entryID string) error {
+	return cs.inner.Unregister(entryID)
+}
+
+// Start starts the inner scheduler
+func (cs *ChaosScheduler) Start() error {
+	log.Printf("🐒 Chaos scheduler failing %.0f%% of calls", cs.failRate*100)
+	return cs.inner.Start()
+}
+
+// Shutdown stops the inner scheduler
+func (cs *ChaosScheduler) Shutdown() {
+	cs.inner.Shutdown()
+	cs.inspector.Close()
+}
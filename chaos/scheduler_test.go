@@ -0,0 +1,124 @@
+//go:build chaos
+
+package chaos_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/chaos"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestChaosRegister registers entries at a fail rate of 0.3 and fails unless
+// about 7 in 10 succeed, failures are ErrInjected, and concurrent
+// registrations are safe
+func TestChaosRegister(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cs, err := chaos.NewChaosScheduler(srv.ConnOpt(), nil, 0.3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Shutdown()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	registered := 0
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := cs.Register("@every 1h", asynq.NewTask("chaos:test", []byte(fmt.Sprint(i))))
+			if err != nil && !errors.Is(err, chaos.ErrInjected) {
+				t.Errorf("registration failed with %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				registered++
+			}
+		}(i)
+	}
+	wg.Wait()
+	if registered < 650 || registered > 750 {
+		t.Errorf("%d of 1000 entries registered, want about 700", registered)
+	}
+
+	if _, err := chaos.NewChaosScheduler(srv.ConnOpt(), nil, 1.5, 1); err == nil {
+		t.Error("fail rate above 1 accepted")
+	}
+}
+
+// TestChaosEnqueue runs a scheduler dropping enqueues and fails unless the
+// dropped ones are reported as ErrInjected and are not in the queue, while
+// the others are
+func TestChaosEnqueue(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	var mu sync.Mutex
+	enqueued, dropped := map[string]bool{}, 0
+	cs, err := chaos.NewChaosScheduler(srv.ConnOpt(), &asynq.SchedulerOpts{
+		LogLevel: asynq.FatalLevel,
+		PostEnqueueFunc: func(info *asynq.TaskInfo, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, chaos.ErrInjected):
+				dropped++
+			case err == nil:
+				enqueued[info.ID] = true
+			default:
+				t.Errorf("enqueue failed with %v", err)
+			}
+		},
+	}, 0.5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := 0
+	for i := 0; i < 10; i++ {
+		if _, err := cs.Register("@every 1s", asynq.NewTask("chaos:test", []byte(fmt.Sprint(i)))); err == nil {
+			registered++
+		}
+	}
+	if registered == 0 {
+		t.Fatal("no entry registered")
+	}
+	if err := cs.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2500 * time.Millisecond)
+	cs.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if dropped == 0 || len(enqueued) == 0 {
+		t.Fatalf("%d enqueued and %d dropped, want both", len(enqueued), dropped)
+	}
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	pending, err := inspector.ListPendingTasks("default", asynq.PageSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(enqueued) {
+		t.Errorf("%d tasks pending, want the %d not dropped", len(pending), len(enqueued))
+	}
+	for _, p := range pending {
+		if !enqueued[p.ID] {
+			t.Errorf("dropped task %s is pending", p.ID)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Package circuit stops calling a downstream provider that keeps failing.
+// Tasks that need a provider whose circuit is open are deferred until
+// shortly after its next probe, without using up their retries, so a long
+// outage does not archive them.
+package circuit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults of a Registry
+const (
+	DefaultThreshold = 5
+	DefaultCooldown  = 30 * time.Second
+	// DefaultSlack is how long after the probe time deferred tasks retry;
+	// asynq schedules retries to the second
+	DefaultSlack = time.Second
+)
+
+// Breaker states
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+// ErrOpen is returned instead of calling a provider whose circuit is open,
+// and for a failed probe. It unwraps to a flags.ErrDelayed, so the server
+// config deferring flagged tasks retries it after Delay without using up a
+// retry, and to the error of the failed probe.
+type ErrOpen struct {
+	Provider string
+	// ProbeAt is when the circuit lets the next call through
+	ProbeAt time.Time
+	Delay   time.Duration
+	Err     error
+}
+
+func (e ErrOpen) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("circuit of %s reopened after a failed probe (%v), retrying in %v", e.Provider, e.Err, e.Delay)
+	}
+	return fmt.Sprintf("circuit of %s is open until %s, retrying in %v", e.Provider, e.ProbeAt.Format(time.RFC3339), e.Delay)
+}
+
+func (e ErrOpen) Unwrap() []error {
+	errs := []error{flags.ErrDelayed{TaskType: e.Provider, Delay: e.Delay}}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// ErrRetryAfter is a provider failure whose answer asked to wait After,
+// e.g. an HTTP 429 or 503 with Retry-After. It counts as a failure;
+// RetryDelay waits at least After, and a circuit it opens stays open at
+// least as long.
+type ErrRetryAfter struct {
+	Err   error
+	After time.Duration
+}
+
+func (e ErrRetryAfter) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.Err, e.After)
+}
+
+func (e ErrRetryAfter) Unwrap() error {
+	return e.Err
+}
+
+// RetryDelay returns a Config.RetryDelayFunc waiting fallback's delay, or
+// the Retry-After of an ErrRetryAfter when it is longer
+func RetryDelay(fallback asynq.RetryDelayFunc) asynq.RetryDelayFunc {
+	return func(n int, err error, t *asynq.Task) time.Duration {
+		d := fallback(n, err, t)
+		var ra ErrRetryAfter
+		if errors.As(err, &ra) && ra.After > d {
+			return ra.After
+		}
+		return d
+	}
+}
+
+// Registry holds a breaker per provider
+type Registry struct {
+	// Threshold consecutive failures open a circuit for Cooldown
+	Threshold int
+	Cooldown  time.Duration
+	Slack     time.Duration
+
+	open     *prometheus.GaugeVec
+	deferred *prometheus.CounterVec
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewRegistry creates a registry with the default settings
+func NewRegistry(reg prometheus.Registerer) (*Registry, error) {
+	r := &Registry{
+		Threshold: DefaultThreshold,
+		Cooldown:  DefaultCooldown,
+		Slack:     DefaultSlack,
+		open: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "asynq_circuit_open",
+			Help: "Whether the circuit of a downstream provider is open (1) or half-open (0.5).",
+		}, []string{"provider"}),
+		deferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "asynq_circuit_deferred_total",
+			Help: "Calls refused and deferred because the provider's circuit was open.",
+		}, []string{"provider"}),
+		breakers: make(map[string]*Breaker),
+	}
+	for _, c := range []prometheus.Collector{r.open, r.deferred} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register circuit metrics: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// RegistryFromEnv creates a registry opening a circuit after
+// CIRCUIT_THRESHOLD (default 5) consecutive failures for CIRCUIT_COOLDOWN
+// (default 30s)
+func RegistryFromEnv(reg prometheus.Registerer) (*Registry, error) {
+	r, err := NewRegistry(reg)
+	if err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("CIRCUIT_THRESHOLD"); v != "" {
+		if r.Threshold, err = strconv.Atoi(v); err != nil || r.Threshold < 1 {
+			return nil, fmt.Errorf("invalid CIRCUIT_THRESHOLD %q", v)
+		}
+	}
+	if v := os.Getenv("CIRCUIT_COOLDOWN"); v != "" {
+		if r.Cooldown, err = time.ParseDuration(v); err != nil || r.Cooldown <= 0 {
+			return nil, fmt.Errorf("invalid CIRCUIT_COOLDOWN %q", v)
+		}
+	}
+	return r, nil
+}
+
+// Breaker returns the breaker of provider, created on first use
+func (r *Registry) Breaker(provider string) *Breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[provider]
+	if !ok {
+		b = &Breaker{Provider: provider, registry: r, state: StateClosed}
+		r.breakers[provider] = b
+		r.open.WithLabelValues(provider).Set(0)
+	}
+	return b
+}
+
+// States returns the state of every breaker by provider
+func (r *Registry) States() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	states := make(map[string]string, len(r.breakers))
+	for name, b := range r.breakers {
+		states[name] = b.State()
+	}
+	return states
+}
+
+// Breaker is the circuit of one provider. It opens after the registry's
+// Threshold consecutive failures, lets one probe through once Cooldown
+// passed, and closes when the probe succeeds.
+type Breaker struct {
+	Provider string
+	registry *Registry
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	probeAt  time.Time
+}
+
+// State returns the breaker's state
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Do calls fn unless the circuit is open and records its outcome. A call
+// the circuit refuses, or a failed probe, returns ErrOpen.
+func (b *Breaker) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	probe, err := b.allow(time.Now())
+	if err != nil {
+		return err
+	}
+	err = fn(ctx)
+	if reopened := b.record(err, probe, time.Now()); reopened != nil {
+		return reopened
+	}
+	return err
+}
+
+// allow reports whether a call may go through and whether it is the probe
+func (b *Breaker) allow(now time.Time) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == StateClosed:
+		return false, nil
+	case b.state == StateOpen && !now.Before(b.probeAt):
+		b.setState(StateHalfOpen)
+		return true, nil
+	case b.state == StateHalfOpen:
+		// The probe is under way; should it fail the next is a cooldown away
+		return false, b.refuse(now, now.Add(b.registry.Cooldown), nil)
+	}
+	return false, b.refuse(now, b.probeAt, nil)
+}
+
+// record updates the state after a call, returning ErrOpen for a failed
+// probe. A failure marked permanent means the provider answered; a
+// cancelled call tells nothing.
+func (b *Breaker) record(err error, probe bool, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case errors.Is(err, context.Canceled):
+		if probe {
+			// The next call probes instead
+			b.probeAt = now
+			b.setState(StateOpen)
+		}
+		return nil
+	case err == nil || errors.Is(err, asynq.SkipRetry):
+		b.failures = 0
+		b.setState(StateClosed)
+		return nil
+	}
+	b.failures++
+	if !probe && b.failures < b.registry.Threshold {
+		return nil
+	}
+	probeAt := now.Add(b.registry.Cooldown)
+	var ra ErrRetryAfter
+	if errors.As(err, &ra) && now.Add(ra.After).After(probeAt) {
+		probeAt = now.Add(ra.After)
+	}
+	if b.state != StateOpen || probeAt.After(b.probeAt) {
+		b.probeAt = probeAt
+	}
+	b.setState(StateOpen)
+	if probe {
+		return b.refuse(now, b.probeAt, err)
+	}
+	return nil
+}
+
+// refuse returns the ErrOpen of a call deferred until probeAt; b.mu is held
+func (b *Breaker) refuse(now, probeAt time.Time, err error) error {
+	b.registry.deferred.WithLabelValues(b.Provider).Inc()
+	return ErrOpen{Provider: b.Provider, ProbeAt: probeAt, Delay: probeAt.Sub(now) + b.registry.Slack, Err: err}
+}
+
+// setState changes the state and its gauge; b.mu is held
+func (b *Breaker) setState(state string) {
+	b.state = state
+	v := map[string]float64{StateClosed: 0, StateHalfOpen: 0.5, StateOpen: 1}[state]
+	b.registry.open.WithLabelValues(b.Provider).Set(v)
+}
+
+// ParseRetryAfter parses a Retry-After header, in seconds or an HTTP date
+func ParseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
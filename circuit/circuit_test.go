@@ -0,0 +1,129 @@
+package circuit_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestCircuitOutage runs a worker with the retry config of main against
+// an embedded Redis and a provider down for longer than the task's retries
+// would last. It fails unless the task is never archived, uses up only
+// the retry of the failure that opened the circuit, calls the provider only
+// to probe it while the circuit is open, and completes once the provider is
+// back; and unless a Retry-After stretches both the retry delay and the
+// time a circuit stays open.
+func TestCircuitOutage(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	breakers, err := circuit.NewRegistry(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	breakers.Threshold, breakers.Cooldown = 1, time.Second
+	breaker := breakers.Breaker("provider")
+	var down atomic.Bool
+	var calls atomic.Int32
+	down.Store(true)
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{
+		Concurrency:              1,
+		Queues:                   map[string]int{"default": 1},
+		DelayedTaskCheckInterval: 100 * time.Millisecond,
+		IsFailure:                flags.IsFailure,
+		RetryDelayFunc: flags.RetryDelay(circuit.RetryDelay(func(int, error, *asynq.Task) time.Duration {
+			return time.Second
+		})),
+	})
+	if err := worker.Start(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		return breaker.Do(ctx, func(ctx context.Context) error {
+			calls.Add(1)
+			if down.Load() {
+				return fmt.Errorf("provider unavailable")
+			}
+			return nil
+		})
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	info, err := client.Enqueue(asynq.NewTask("provider:call", nil), asynq.MaxRetry(1), asynq.Retention(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outage := time.Now().Add(6 * time.Second)
+	for time.Now().Before(outage) {
+		task, err := inspector.GetTaskInfo("default", info.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.State == asynq.TaskStateArchived || task.Retried > 1 {
+			t.Fatalf("task is %s after %d retries during the outage, want it deferred", task.State, task.Retried)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if breaker.State() == circuit.StateClosed {
+		t.Errorf("circuit is closed during the outage")
+	}
+	// The failure opening the circuit and a probe per cooldown plus slack
+	if n := calls.Load(); n < 2 || n > 5 {
+		t.Errorf("provider was called %d times in a 6s outage, want the first call and a probe every 2s", n)
+	}
+
+	down.Store(false)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		task, err := inspector.GetTaskInfo("default", info.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.State == asynq.TaskStateCompleted {
+			if task.Retried != 1 {
+				t.Errorf("task completed after %d retries, want the one of the failure opening the circuit", task.Retried)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task is %s after the provider came back, want completed", task.State)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if breaker.State() != circuit.StateClosed {
+		t.Errorf("circuit is %s after a successful probe, want closed", breaker.State())
+	}
+
+	// Retry-After outlasts the fallback delay and the cooldown
+	limited := circuit.ErrRetryAfter{Err: fmt.Errorf("429 Too Many Requests"), After: time.Hour}
+	delay := circuit.RetryDelay(func(int, error, *asynq.Task) time.Duration { return time.Second })
+	if d := delay(0, limited, nil); d != time.Hour {
+		t.Errorf("retry delay after Retry-After 1h is %v", d)
+	}
+	api := breakers.Breaker("api")
+	api.Do(context.Background(), func(context.Context) error { return limited })
+	var open circuit.ErrOpen
+	err = api.Do(context.Background(), func(context.Context) error { return nil })
+	if !errors.As(err, &open) || time.Until(open.ProbeAt) < 59*time.Minute || !flags.IsDelayed(err) {
+		t.Errorf("call after Retry-After 1h got %v, want ErrOpen until the Retry-After", err)
+	}
+	if d, ok := circuit.ParseRetryAfter("120", time.Now()); !ok || d != 2*time.Minute {
+		t.Errorf("Retry-After 120 parsed as %v, %v", d, ok)
+	}
+}
@@ -0,0 +1,1411 @@
+// Command admin is the operator CLI for inspecting and managing the demo's
+// state in Redis.
+//
+//	go run ./cmd/admin <command> [subcommand] [flags]
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"asynqdemo/advisor"
+	"asynqdemo/audit"
+	"asynqdemo/common"
+	"asynqdemo/config"
+	"asynqdemo/contracts"
+	"asynqdemo/eventlog"
+	"asynqdemo/fleet"
+	"asynqdemo/i18n"
+	"asynqdemo/importer"
+	"asynqdemo/mailer"
+	"asynqdemo/maintenance"
+	"asynqdemo/metadata"
+	"asynqdemo/metrics"
+	"asynqdemo/orphans"
+	"asynqdemo/quarantine"
+	"asynqdemo/queues"
+	"asynqdemo/redisconn"
+	"asynqdemo/redrive"
+	"asynqdemo/retrysim"
+	"asynqdemo/scheduler"
+	"asynqdemo/stats"
+	"asynqdemo/support"
+	"asynqdemo/trash"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"copy-task":        {summary: "--from PROFILE|--from-url URL --queue Q ID [--to PROFILE|--to-url URL] [--scrub MAPPING] - copy a task of another environment here, scrubbing its payload", run: runCopyTask},
+	"delete":           {summary: "--queue Q --state S [--type T] [--hard] - move matching tasks to the trash, or delete them", run: runDelete},
+	"events":           {summary: "[--dir D] [--from T] [--to T] [--kind K] [--type T] [--outcome O] [--json] - search the event log of EVENT_LOG_DIR, rotated files included", run: runEvents},
+	"diff":             {summary: "--from T --to T [--json] - tasks enqueued, completed and archived in a time range", run: runDiff},
+	"fleet":            {summary: "list live workers with their build and supported task types", run: runFleet},
+	"migrate-queues":   {summary: "old=new[,old=new] - move pending/scheduled/retry tasks to new queues", run: runMigrateQueues},
+	"schedule":         {summary: "list | export [FILE] | import-crontab --rules R [--write FILE] CRONTAB | suspend|resume --entry ID|--group G [--reason R] [--catch-up] - show the schedule, print the entries of PERIODIC_ENTRIES_FILE, translate a crontab into entries, or suspend and resume entries", run: runSchedule},
+	"quarantine":       {summary: "list [--format json|hex] [--limit N] - payloads that failed to decode, with their raw bytes", run: runQuarantine},
+	"trash":            {summary: "list | restore ID... | restore --all - inspect and restore soft-deleted tasks", run: runTrash},
+	"orphans":          {summary: "list | recover [--dry-run] - active tasks past their timeout plus ORPHAN_MARGIN; recover requeues those whose server is gone", run: runOrphans},
+	"preflight":        {summary: "render templates with fixtures and check locales and SMTP (SMTP_ADDR or SMTP_HOST) before a deploy", run: runPreflight},
+	"advise":           {summary: "[--current N] [--window M] [--json] - recommended concurrency and per-type limits from the recorded workload, with the math", run: runAdvise},
+	"latency":          {summary: "show p50/p90/p99/max processing latency per task type over 24h", run: runLatency},
+	"import-csv":       {summary: "--type T [--queue Q] [--batch N] [--journal J [--resume] [--key COL]] FILE - enqueue a task per CSV row, header names payload fields", run: runImportCSV},
+	"import-jsonl":     {summary: "[--queue Q] [--journal J [--resume] [--key FIELD]] FILE - enqueue a task per JSON line with type and payload fields", run: runImportJSONL},
+	"contracts":        {summary: "check [--dir D] | export [--dir D] OUT - verify payload structs against the contract fixtures, or export them with JSON Schemas", run: runContracts},
+	"i18n":             {summary: "i18n missing - list translations that fell back to the default locale", run: runI18n},
+	"support-bundle":   {summary: "[--out F] [--minutes N] [--failures N] [--events-dir D] [--config C] | verify [--signer KEY] FILE | decrypt --identity FILE [--signer KEY] [--out F] FILE | keygen [--sign] - encrypted, signed bundle of failures, config, queues, schedule, fleet and events for support", run: runSupportBundle},
+	"simulate-retries": {summary: "--policy FILE [--dir D] [--from T] [--to T] [--type T] [--json] - replay the failures of the event log under a candidate retry policy and compare with the current one", run: runSimulateRetries},
+	"stats":            {summary: "[--json] - print the runtime stats of this process; exits 3 (goroutines), 4 (heap), 5 (GC pause) or 6 (several) over the STATS_MAX_* thresholds", run: runStats},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		// Commands used by scripts, such as stats, exit with their own codes
+		var coded interface{ ExitCode() int }
+		if errors.As(err, &coded) {
+			os.Exit(coded.ExitCode())
+		}
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin <command> [args]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].summary)
+	}
+}
+
+// redisConnOpt reads the same REDIS_* variables as the worker
+func redisConnOpt() asynq.RedisConnOpt {
+	opt, err := redisconn.FromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Invalid Redis config: %v\n", err)
+		os.Exit(1)
+	}
+	return opt
+}
+
+func redisClient() redis.UniversalClient {
+	return redisConnOpt().MakeRedisClient().(redis.UniversalClient)
+}
+
+func runI18n(args []string) error {
+	if len(args) != 1 || args[0] != "missing" {
+		return fmt.Errorf("usage: admin i18n missing")
+	}
+	rdb := redisClient()
+	defer rdb.Close()
+
+	missing, err := i18n.ListMissing(context.Background(), rdb)
+	if err != nil {
+		return fmt.Errorf("failed to read missing translations: %v", err)
+	}
+	if len(missing) == 0 {
+		fmt.Println("✅ No missing translations recorded")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LOCALE\tKEY\tTASK TYPE\tCOUNT")
+	for _, m := range missing {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", m.Locale, m.Key, m.TaskType, m.Count)
+	}
+	return w.Flush()
+}
+
+func runContracts(args []string) error {
+	const usage = "usage: admin contracts check [--dir D] | export [--dir D] OUT"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	fs := flag.NewFlagSet("contracts", flag.ContinueOnError)
+	dir := fs.String("dir", contracts.DefaultDir, "directory holding the contract fixtures")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "check" && fs.NArg() == 0:
+		if err := contracts.CheckAll(*dir); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Payload structs match the contract fixtures in %s\n", *dir)
+		return nil
+	case args[0] == "export" && fs.NArg() == 1:
+		written, err := contracts.Export(*dir, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		for _, path := range written {
+			fmt.Println(path)
+		}
+		return nil
+	}
+	return fmt.Errorf(usage)
+}
+
+func runOrphans(args []string) error {
+	const usage = "usage: admin orphans list | recover [--dry-run]"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	fs := flag.NewFlagSet("orphans", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only show what would be recovered")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || (args[0] != "list" && args[0] != "recover") {
+		return fmt.Errorf(usage)
+	}
+	margin, err := orphans.MarginFromEnv()
+	if err != nil {
+		return err
+	}
+	rdb := redisClient()
+	defer rdb.Close()
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+	detector := orphans.NewDetector(inspector, rdb)
+	detector.Margin = margin
+
+	ctx := context.Background()
+	found, err := detector.Find(ctx)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		fmt.Println("✅ No orphaned active tasks")
+		return nil
+	}
+	if args[0] == "list" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tQUEUE\tTYPE\tELAPSED\tTIMEOUT\tSERVER\tALIVE")
+		for _, o := range found {
+			elapsed, server := "-", "-"
+			if o.Started != nil {
+				elapsed = o.Elapsed.Round(time.Second).String()
+				server = fmt.Sprintf("%s:%d", o.Host, o.PID)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\t%v\n", o.ID, o.Queue, o.Type, elapsed, o.Timeout, server, o.ServerAlive)
+		}
+		return w.Flush()
+	}
+
+	var failed int
+	for _, o := range found {
+		if o.ServerAlive {
+			fmt.Printf("⏭️  %s: its server still heartbeats, leaving it\n", o.ID)
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("🔍 %s (%s) would be requeued to %s\n", o.ID, o.Type, o.Queue)
+			continue
+		}
+		if err := detector.Recover(ctx, o); err != nil {
+			fmt.Printf("❌ %s: %v\n", o.ID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("♻️  %s (%s) requeued to %s\n", o.ID, o.Type, o.Queue)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d tasks could not be recovered", failed)
+	}
+	return nil
+}
+
+func runFleet(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: admin fleet")
+	}
+	rdb := redisClient()
+	defer rdb.Close()
+
+	workers, err := fleet.List(context.Background(), rdb)
+	if err != nil {
+		return err
+	}
+	if len(workers) == 0 {
+		fmt.Println("⚠️  No live workers")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKER\tGIT SHA\tBUILT\tTASK TYPES\tFEATURES")
+	for _, wk := range workers {
+		types := make([]string, 0, len(wk.TaskTypes))
+		for t, versions := range wk.TaskTypes {
+			types = append(types, fmt.Sprintf("%s%v", t, versions))
+		}
+		sort.Strings(types)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", wk.ID, shortSHA(wk.GitSHA), wk.BuildTime, strings.Join(types, " "), strings.Join(wk.Features, ","))
+	}
+	return w.Flush()
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
+}
+
+func runLatency(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: admin latency")
+	}
+	rdb := redisClient()
+	defer rdb.Close()
+
+	summaries, err := metrics.Summaries(context.Background(), rdb)
+	if err != nil {
+		return err
+	}
+	if len(summaries) == 0 {
+		fmt.Println("⚠️  No latencies recorded in the last 24h")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK TYPE\tCOUNT\tP50\tP90\tP99\tMAX")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%s\t%d\t%.1fms\t%.1fms\t%.1fms\t%.1fms\n", s.TaskType, s.Count, s.P50Ms, s.P90Ms, s.P99Ms, s.MaxMs)
+	}
+	return w.Flush()
+}
+
+func runAdvise(args []string) error {
+	fs := flag.NewFlagSet("advise", flag.ContinueOnError)
+	current := fs.Int("current", 0, "concurrency in effect, which the recommendation steps from")
+	window := fs.Int("window", 15, "minutes of throughput the arrival rates are averaged over")
+	asJSON := fs.Bool("json", false, "print JSON instead of text")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *window < 1 {
+		return fmt.Errorf("usage: admin advise [--current N] [--window M] [--json]")
+	}
+	cfg, err := advisor.ConfigFromEnv(math.MaxInt32)
+	if err != nil {
+		return err
+	}
+	rdb := redisClient()
+	defer rdb.Close()
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+
+	in, err := advisor.RedisCollector(rdb, inspector, *window)(context.Background())
+	if err != nil {
+		return err
+	}
+	in.Current = *current
+	rec := advisor.NewAdvisor(cfg).Advise(in)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rec)
+	}
+	fmt.Printf("Recommended concurrency: %d (target %.2f)\n", rec.Concurrency, rec.Target)
+	if len(rec.PerType) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TASK TYPE\tLIMIT")
+		for _, p := range in.Profiles {
+			fmt.Fprintf(w, "%s\t%d\n", p.TaskType, rec.PerType[p.TaskType])
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	fmt.Println("\nHow:")
+	for _, line := range rec.Explanation {
+		fmt.Println("  " + line)
+	}
+	return nil
+}
+
+func runSupportBundle(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return createSupportBundle(args)
+	}
+	switch args[0] {
+	case "verify":
+		fs := flag.NewFlagSet("support-bundle verify", flag.ContinueOnError)
+		signerFlag := fs.String("signer", os.Getenv("SUPPORT_SIGNER"), "public key the bundle must be signed with")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: admin support-bundle verify [--signer KEY] FILE")
+		}
+		bundle, trusted, err := readBundle(fs.Arg(0), *signerFlag)
+		if err != nil {
+			return err
+		}
+		signer, err := support.Verify(bundle, trusted)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✅ Signature valid, signed by %s\n", base64.StdEncoding.EncodeToString(signer))
+		if trusted == nil {
+			fmt.Println("⚠️  No --signer given: the bundle is intact, but who signed it was not checked")
+		}
+		fmt.Printf("   sha256: %s\n", support.Hash(bundle))
+		return nil
+	case "decrypt":
+		fs := flag.NewFlagSet("support-bundle decrypt", flag.ContinueOnError)
+		identityFile := fs.String("identity", "", "file holding the identity the bundle is encrypted to")
+		signerFlag := fs.String("signer", os.Getenv("SUPPORT_SIGNER"), "public key the bundle must be signed with")
+		out := fs.String("out", "", "tar.gz to write, FILE with .tar.gz by default")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 || *identityFile == "" {
+			return fmt.Errorf("usage: admin support-bundle decrypt --identity FILE [--signer KEY] [--out F] FILE")
+		}
+		bundle, trusted, err := readBundle(fs.Arg(0), *signerFlag)
+		if err != nil {
+			return err
+		}
+		raw, err := os.ReadFile(*identityFile)
+		if err != nil {
+			return fmt.Errorf("failed to read identity: %v", err)
+		}
+		identity, err := support.ParseIdentity(string(raw))
+		if err != nil {
+			return err
+		}
+		archive, err := support.Open(bundle, identity, trusted)
+		if err != nil {
+			return err
+		}
+		files, err := support.ReadArchive(archive)
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			*out = strings.TrimSuffix(fs.Arg(0), filepath.Ext(fs.Arg(0))) + ".tar.gz"
+		}
+		if err := os.WriteFile(*out, archive, 0o600); err != nil {
+			return fmt.Errorf("failed to write %s: %v", *out, err)
+		}
+		fmt.Printf("✅ Decrypted to %s\n", *out)
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("   %s (%d bytes)\n", name, len(files[name]))
+		}
+		return nil
+	case "keygen":
+		fs := flag.NewFlagSet("support-bundle keygen", flag.ContinueOnError)
+		sign := fs.Bool("sign", false, "generate a worker signing key instead of a support identity")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *sign {
+			private, public, err := support.GenerateSigningKey()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("# Signing key, for SUPPORT_SIGNING_KEY_FILE on the workers\n%s\n# Signer, for support-bundle verify --signer\n%s\n", private, public)
+			return nil
+		}
+		identity, recipient, err := support.GenerateIdentity()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# Identity, kept by support for support-bundle decrypt --identity\n%s\n# Recipient, for SUPPORT_RECIPIENTS on the workers\n%s\n", identity, recipient)
+		return nil
+	}
+	return fmt.Errorf("usage: admin support-bundle [flags] | verify | decrypt | keygen")
+}
+
+// readBundle reads a sealed bundle and the optional trusted signer key
+func readBundle(path, signer string) ([]byte, ed25519.PublicKey, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read bundle: %v", err)
+	}
+	if signer == "" {
+		return bundle, nil, nil
+	}
+	trusted, err := support.ParseSigner(signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bundle, trusted, nil
+}
+
+func createSupportBundle(args []string) error {
+	fs := flag.NewFlagSet("support-bundle", flag.ContinueOnError)
+	now := time.Now()
+	out := fs.String("out", "support-"+now.UTC().Format("20060102T150405Z")+".bundle", "bundle file to write")
+	minutes := fs.Int("minutes", 30, "minutes of the event log to include")
+	failures := fs.Int("failures", 50, "archived and retried tasks to include per queue")
+	eventDir := fs.String("events-dir", os.Getenv("EVENT_LOG_DIR"), "event log directory")
+	configFile := fs.String("config", config.DefaultFile, "worker config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *minutes < 1 || *failures < 1 {
+		return fmt.Errorf("usage: admin support-bundle [--out F] [--minutes N] [--failures N] [--events-dir D] [--config C]")
+	}
+	var recipients []*ecdh.PublicKey
+	for _, r := range strings.Split(os.Getenv("SUPPORT_RECIPIENTS"), ",") {
+		if strings.TrimSpace(r) == "" {
+			continue
+		}
+		key, err := support.ParseRecipient(r)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, key)
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("SUPPORT_RECIPIENTS is not set: list the support public keys, comma-separated")
+	}
+	keyFile := os.Getenv("SUPPORT_SIGNING_KEY_FILE")
+	if keyFile == "" {
+		return fmt.Errorf("SUPPORT_SIGNING_KEY_FILE is not set: generate a key with admin support-bundle keygen --sign")
+	}
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read signing key: %v", err)
+	}
+	signer, err := support.ParseSigningKey(string(raw))
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return err
+	}
+
+	rdb := redisClient()
+	defer rdb.Close()
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+	archive, err := support.Build(context.Background(), support.Sources{
+		Inspector: inspector,
+		RDB:       rdb,
+		Config:    cfg,
+		EventDir:  *eventDir,
+		Window:    time.Duration(*minutes) * time.Minute,
+		Failures:  *failures,
+	}, now)
+	if err != nil {
+		return err
+	}
+	bundle, err := support.Seal(archive, recipients, signer)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, bundle, 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", *out, err)
+	}
+	fmt.Printf("📦 Support bundle written to %s for %d recipient(s)\n", *out, len(recipients))
+	fmt.Printf("   sha256: %s\n", support.Hash(bundle))
+	return nil
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of text")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: admin stats [--json]")
+	}
+	thresholds, err := stats.ThresholdsFromEnv()
+	if err != nil {
+		return err
+	}
+	snap := stats.Collect(stats.Runtime{}, time.Now())
+	breaches := thresholds.Check(snap)
+	if *asJSON {
+		out := struct {
+			stats.Snapshot
+			Breaches []stats.Breach `json:"breaches"`
+		}{snap, append([]stats.Breach{}, breaches...)}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+	} else {
+		snap.WriteText(os.Stdout)
+	}
+	if len(breaches) > 0 {
+		return stats.BreachError{Breaches: breaches}
+	}
+	return nil
+}
+
+func runMigrateQueues(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: admin migrate-queues old=new[,old=new]")
+	}
+	var pairs [][2]string
+	for _, m := range strings.Split(args[0], ",") {
+		from, to, ok := strings.Cut(m, "=")
+		if !ok || from == "" || to == "" || from == to {
+			return fmt.Errorf("invalid mapping %q, want old=new", m)
+		}
+		pairs = append(pairs, [2]string{from, to})
+	}
+
+	rdb := redisClient()
+	defer rdb.Close()
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+	client := asynq.NewClient(redisConnOpt())
+	defer client.Close()
+
+	for _, p := range pairs {
+		fmt.Printf("🚚 Migrating %s -> %s\n", p[0], p[1])
+		res, err := queues.Migrate(context.Background(), inspector, client, rdb, p[0], p[1])
+		if err != nil {
+			return fmt.Errorf("migration of %s stopped, run the command again to resume: %v", p[0], err)
+		}
+		fmt.Printf("✅ Moved %d pending, %d scheduled, %d retry tasks\n", res.Moved["pending"], res.Moved["scheduled"], res.Moved["retry"])
+	}
+	return nil
+}
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fromFlag := fs.String("from", "", "start time, RFC 3339 or HH:MM today")
+	toFlag := fs.String("to", "", "end time, RFC 3339 or HH:MM today (default now)")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	from, err := parseTime(*fromFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %v", err)
+	}
+	to := time.Now()
+	if *toFlag != "" {
+		if to, err = parseTime(*toFlag); err != nil {
+			return fmt.Errorf("invalid --to: %v", err)
+		}
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("--from must be before --to")
+	}
+
+	rdb := redisClient()
+	defer rdb.Close()
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+
+	report, err := audit.Diff(context.Background(), rdb, inspector, from, to)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Printf("Changes from %s to %s\n", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if report.CountsOnly {
+		fmt.Println("⚠️  Audit store disabled: counts only, estimated from queue snapshots")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tTYPE\tENQUEUED\tCOMPLETED\tARCHIVED\tNET BACKLOG")
+	for _, r := range report.Rows {
+		typ := r.Type
+		if typ == "" {
+			typ = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%+d\n", r.Queue, typ, r.Enqueued, r.Completed, r.Archived, r.NetBacklog)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, r := range report.Rows {
+		for _, e := range r.TopErrors {
+			fmt.Printf("   %s/%s archived %dx: %s\n", r.Queue, r.Type, e.Count, e.Error)
+		}
+	}
+	return nil
+}
+
+func runEvents(args []string) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	dir := fs.String("dir", os.Getenv("EVENT_LOG_DIR"), "event log directory")
+	fromFlag := fs.String("from", "", "start time, RFC 3339 or HH:MM today")
+	toFlag := fs.String("to", "", "end time, RFC 3339 or HH:MM today")
+	var filter eventlog.Filter
+	fs.StringVar(&filter.Kind, "kind", "", "task, alert or queue")
+	fs.StringVar(&filter.Type, "type", "", "task type")
+	fs.StringVar(&filter.Outcome, "outcome", "", "succeeded, failed, skipped or archived")
+	asJSON := fs.Bool("json", false, "print JSON lines instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *dir == "" {
+		return fmt.Errorf("usage: admin events [--dir D] [--from T] [--to T] [--kind K] [--type T] [--outcome O] [--json], --dir defaults to EVENT_LOG_DIR")
+	}
+	var err error
+	if *fromFlag != "" {
+		if filter.From, err = parseTime(*fromFlag); err != nil {
+			return fmt.Errorf("invalid --from: %v", err)
+		}
+	}
+	if *toFlag != "" {
+		if filter.To, err = parseTime(*toFlag); err != nil {
+			return fmt.Errorf("invalid --to: %v", err)
+		}
+	}
+
+	matches, err := eventlog.Query(*dir, filter)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range matches {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(matches) == 0 {
+		fmt.Println("⚠️  No matching events")
+		return nil
+	}
+	return eventlog.Print(os.Stdout, matches)
+}
+
+func runSimulateRetries(args []string) error {
+	fs := flag.NewFlagSet("simulate-retries", flag.ContinueOnError)
+	policy := fs.String("policy", "", "YAML file of the candidate retry policies and maintenance windows")
+	dir := fs.String("dir", os.Getenv("EVENT_LOG_DIR"), "event log directory")
+	fromFlag := fs.String("from", "", "start time, RFC 3339 or HH:MM today (default 24h ago)")
+	toFlag := fs.String("to", "", "end time, RFC 3339 or HH:MM today")
+	taskType := fs.String("type", "", "task type")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *policy == "" || *dir == "" {
+		return fmt.Errorf("usage: admin simulate-retries --policy FILE [--dir D] [--from T] [--to T] [--type T] [--json], --dir defaults to EVENT_LOG_DIR")
+	}
+	filter := eventlog.Filter{Kind: eventlog.KindTask, Type: *taskType, From: time.Now().Add(-24 * time.Hour)}
+	var err error
+	if *fromFlag != "" {
+		if filter.From, err = parseTime(*fromFlag); err != nil {
+			return fmt.Errorf("invalid --from: %v", err)
+		}
+	}
+	if *toFlag != "" {
+		if filter.To, err = parseTime(*toFlag); err != nil {
+			return fmt.Errorf("invalid --to: %v", err)
+		}
+	}
+	current := retrysim.CurrentConfig()
+	candidate, err := retrysim.LoadConfig(*policy, current)
+	if err != nil {
+		return err
+	}
+
+	events, err := eventlog.Query(*dir, filter)
+	if err != nil {
+		return err
+	}
+	rows := retrysim.Simulate(retrysim.Timelines(events), current, candidate)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+	if len(rows) == 0 {
+		fmt.Println("⚠️  No failed tasks in the event log")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK TYPE\tTASKS\tSUCCEEDED\tARCHIVED\tRETRIES\tADDED LATENCY")
+	cell := func(cur, cand int) string {
+		if cur == cand {
+			return strconv.Itoa(cur)
+		}
+		return fmt.Sprintf("%d -> %d", cur, cand)
+	}
+	for _, r := range rows {
+		cur, cand := r.Current, r.Candidate
+		latency := cur.Latency.Round(time.Second).String()
+		if c := cand.Latency.Round(time.Second).String(); c != latency {
+			latency += " -> " + c
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", r.Type, cur.Tasks, cell(cur.Succeeded, cand.Succeeded), cell(cur.Archived, cand.Archived), cell(cur.Retries, cand.Retries), latency)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println("\nCurrent -> candidate; jittered policies differ from run to run.")
+	return nil
+}
+
+// parseTime accepts RFC 3339 or a local HH:MM of today
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	hm, err := time.ParseInLocation("15:04", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC 3339 nor HH:MM", s)
+	}
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), hm.Hour(), hm.Minute(), 0, 0, time.Local), nil
+}
+
+func runImportCSV(args []string) error {
+	fs := flag.NewFlagSet("import-csv", flag.ContinueOnError)
+	taskType := fs.String("type", "", "task type of the rows")
+	queue := fs.String("queue", "default", "queue to enqueue into")
+	batch := fs.Int("batch", 100, "rows enqueued per batch")
+	jf := journalFlags(fs, "column")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *taskType == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: admin import-csv --type T [--queue Q] [--batch N] [--journal J [--resume] [--key COL]] FILE")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", fs.Arg(0), err)
+	}
+	defer f.Close()
+
+	client := asynq.NewClient(redisConnOpt())
+	defer client.Close()
+
+	imp := importer.NewCSVImporter(client, importer.ColumnsAsPayload(*taskType), asynq.Queue(*queue))
+	journal, err := jf.open(fs.Arg(0) + ":" + *taskType)
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		imp.WithJournal(journal, *jf.key)
+	}
+	imported, skipped, errs := imp.ImportFromCSV(f, *batch)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "⚠️  %v\n", err)
+	}
+	fmt.Printf("✅ Imported %d tasks, skipped %d rows\n", imported, skipped)
+	if err := jf.close(journal); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d rows failed", len(errs))
+	}
+	return nil
+}
+
+// importJournal holds the journal flags of the import commands
+type importJournal struct {
+	path, job, key *string
+	resume         *bool
+}
+
+func journalFlags(fs *flag.FlagSet, keyKind string) importJournal {
+	return importJournal{
+		path:   fs.String("journal", "", "file recording the enqueued rows, for --resume"),
+		resume: fs.Bool("resume", false, "skip the rows the journal recorded as enqueued"),
+		key:    fs.String("key", "", "row key "+keyKind+" for the journal and task IDs, the line number when empty"),
+		job:    fs.String("job", "", "name of the import the task IDs derive from, the file name by default"),
+	}
+}
+
+// open opens the journal, nil without --journal. The job defaults to the
+// base name of defaultJob, so rerunning the same command derives the same
+// task IDs.
+func (jf importJournal) open(defaultJob string) (*importer.Journal, error) {
+	if *jf.path == "" {
+		if *jf.resume {
+			return nil, fmt.Errorf("--resume needs --journal")
+		}
+		return nil, nil
+	}
+	job := *jf.job
+	if job == "" {
+		job = filepath.Base(defaultJob)
+	}
+	return importer.OpenJournal(*jf.path, job, *jf.resume)
+}
+
+// close reports what the journal skipped and closes it
+func (jf importJournal) close(j *importer.Journal) error {
+	if j == nil {
+		return nil
+	}
+	if j.Resumed > 0 || j.Duplicates > 0 {
+		fmt.Printf("⏭️  Skipped %d rows the journal had and %d already enqueued\n", j.Resumed, j.Duplicates)
+	}
+	return j.Close()
+}
+
+func runCopyTask(args []string) error {
+	const usage = "usage: admin copy-task --from PROFILE|--from-url URL [--from-env E] --queue Q [--to PROFILE|--to-url URL --to-env E] [--to-queue Q] [--scrub MAPPING] ID"
+	fs := flag.NewFlagSet("copy-task", flag.ContinueOnError)
+	from := fs.String("from", "", "env file of the source environment with APP_ENV and REDIS_* variables")
+	fromURL := fs.String("from-url", "", "Redis URL of the source environment, instead of --from")
+	fromEnv := fs.String("from-env", "", "APP_ENV of --from-url")
+	to := fs.String("to", "", "env file of the destination environment; default this environment")
+	toURL := fs.String("to-url", "", "Redis URL of the destination environment, instead of --to")
+	toEnv := fs.String("to-env", "", "APP_ENV of --to-url")
+	queue := fs.String("queue", "", "queue of the task in the source environment")
+	toQueue := fs.String("to-queue", "", "queue of the copy; default the same queue")
+	scrub := fs.String("scrub", "", "YAML mapping of payload fields to remove or replace with fixtures")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *queue == "" || (*from == "") == (*fromURL == "") || (*to != "" && *toURL != "") {
+		return fmt.Errorf(usage)
+	}
+	copier := &redrive.Copier{Queue: *toQueue}
+	var err error
+	if copier.From, err = copyProfile(*from, *fromURL, *fromEnv); err != nil {
+		return err
+	}
+	if copier.To, err = copyProfile(*to, *toURL, *toEnv); err != nil {
+		return err
+	}
+	if *scrub != "" {
+		if copier.Mapping, err = redrive.LoadMapping(*scrub); err != nil {
+			return err
+		}
+	}
+	info, err := copier.Copy(context.Background(), *queue, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Copied %s task %s into queue %s as %s (%s)\n", info.Type, fs.Arg(0), info.Queue, info.ID, info.State)
+	return nil
+}
+
+// copyProfile returns the environment of an env file, of a Redis URL, or
+// this one when both are empty
+func copyProfile(path, url, env string) (*redisconn.Profile, error) {
+	switch {
+	case path != "":
+		return redisconn.LoadProfile(path)
+	case url != "":
+		opt, err := redisconn.FromLookup(func(name string) string {
+			if name == "REDIS_URL" {
+				return url
+			}
+			return ""
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &redisconn.Profile{Env: env, ConnOpt: opt}, nil
+	}
+	return redisconn.CurrentProfile()
+}
+
+func runDelete(args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	queue := fs.String("queue", "", "queue to delete from")
+	state := fs.String("state", "pending", "pending, scheduled, retry or archived")
+	taskType := fs.String("type", "", "only delete tasks of this type")
+	hard := fs.Bool("hard", false, "delete for good instead of moving to the trash")
+	confirm := fs.Bool("confirm-production", false, "allow --hard when APP_ENV=production")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *queue == "" {
+		return fmt.Errorf("usage: admin delete --queue Q --state S [--type T] [--hard]")
+	}
+	if *queue == trash.Queue && !*hard {
+		return fmt.Errorf("tasks in the trash can only be deleted with --hard")
+	}
+	if *hard && os.Getenv("APP_ENV") == "production" && !*confirm {
+		return fmt.Errorf("refusing hard delete in production without --confirm-production")
+	}
+
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+	list := map[string]func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error){
+		"pending":   inspector.ListPendingTasks,
+		"scheduled": inspector.ListScheduledTasks,
+		"retry":     inspector.ListRetryTasks,
+		"archived":  inspector.ListArchivedTasks,
+	}[*state]
+	if list == nil {
+		return fmt.Errorf("unknown state %q", *state)
+	}
+
+	// Collect first: deleting while paging would skip tasks
+	var matched []*asynq.TaskInfo
+	for page := 1; ; page++ {
+		tasks, err := list(*queue, asynq.PageSize(100), asynq.Page(page))
+		if err != nil {
+			return fmt.Errorf("failed to list %s tasks of %s: %v", *state, *queue, err)
+		}
+		for _, t := range tasks {
+			if *taskType == "" || t.Type == *taskType {
+				matched = append(matched, t)
+			}
+		}
+		if len(tasks) < 100 {
+			break
+		}
+	}
+
+	var deleted int
+	if *hard {
+		for _, t := range matched {
+			if err := inspector.DeleteTask(t.Queue, t.ID); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+				return fmt.Errorf("failed after deleting %d tasks: %v", deleted, err)
+			}
+			deleted++
+		}
+		fmt.Printf("🗑️  Deleted %d tasks for good\n", deleted)
+		return nil
+	}
+
+	rdb := redisClient()
+	defer rdb.Close()
+	client := asynq.NewClient(redisConnOpt())
+	defer client.Close()
+	for _, t := range matched {
+		if err := trash.SoftDelete(context.Background(), inspector, client, rdb, t); err != nil {
+			return fmt.Errorf("failed after trashing %d tasks: %v", deleted, err)
+		}
+		deleted++
+	}
+	fmt.Printf("🗑️  Moved %d tasks to the trash; undo with: admin trash restore --all\n", deleted)
+	return nil
+}
+
+func runQuarantine(args []string) error {
+	if len(args) == 0 || args[0] != "list" {
+		return fmt.Errorf("usage: admin quarantine list [--format json|hex] [--limit N]")
+	}
+	fs := flag.NewFlagSet("quarantine list", flag.ContinueOnError)
+	format := fs.String("format", "json", "raw payload format: json, falling back to hex for non-JSON bytes, or hex")
+	limit := fs.Int("limit", 100, "most entries to list")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "hex" {
+		return fmt.Errorf("unknown format %q, want json or hex", *format)
+	}
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+
+	entries, err := quarantine.List(inspector, *limit)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("✅ The quarantine is empty")
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Printf("%s %s (queue %s) at %s\n", e.TaskType, e.TaskID, e.Queue, e.QuarantinedAt.Format(time.RFC3339))
+		fmt.Printf("  %s\n", e.Error)
+		fmt.Println(formatRaw(e.Raw, *format))
+	}
+	return nil
+}
+
+func runSchedule(args []string) error {
+	const usage = "usage: admin schedule list | export [FILE] | import-crontab --rules R [--write FILE] CRONTAB | suspend|resume --entry ID|--group G [--reason R] [--catch-up]"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return fmt.Errorf(usage)
+		}
+		return listSchedule()
+	case "export":
+		path, err := entriesPath(args[1:])
+		if err != nil {
+			return err
+		}
+		return scheduler.EntriesFile(path).Export(os.Stdout)
+	case "import-crontab":
+		return importCrontab(args[1:])
+	case "suspend", "resume":
+		return suspendSchedule(args[0], args[1:])
+	default:
+		return fmt.Errorf("unknown schedule subcommand %q", args[0])
+	}
+}
+
+// entriesPath returns the schedule file named in args, or else
+// PERIODIC_ENTRIES_FILE
+func entriesPath(args []string) (string, error) {
+	switch {
+	case len(args) == 1:
+		return args[0], nil
+	case len(args) > 1:
+		return "", fmt.Errorf("usage: admin schedule export [FILE]")
+	}
+	path := os.Getenv("PERIODIC_ENTRIES_FILE")
+	if path == "" {
+		return "", fmt.Errorf("no schedule file given and PERIODIC_ENTRIES_FILE is not set")
+	}
+	return path, nil
+}
+
+// importCrontab translates a crontab into schedule entries, printing them
+// or merging them into a schedule file, and reports the lines left out
+func importCrontab(args []string) error {
+	fs := flag.NewFlagSet("import-crontab", flag.ContinueOnError)
+	rules := fs.String("rules", "", "YAML translation table from commands to task types and payloads")
+	write := fs.String("write", "", "schedule file to merge the entries into instead of printing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *rules == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: admin schedule import-crontab --rules R [--write FILE] CRONTAB")
+	}
+	translation, err := scheduler.LoadTranslation(*rules)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open crontab: %v", err)
+	}
+	defer f.Close()
+	entries, unmapped, err := scheduler.ImportCrontab(f, translation)
+	if err != nil {
+		return err
+	}
+	for _, u := range unmapped {
+		fmt.Fprintf(os.Stderr, "⚠️  %s:%d: %s\n   %s\n", fs.Arg(0), u.Line, u.Reason, u.Text)
+	}
+	if *write == "" {
+		if err := scheduler.WriteEntries(os.Stdout, entries); err != nil {
+			return err
+		}
+	} else {
+		added, err := scheduler.MergeEntries(*write, entries)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✅ Added %d of %d entries to %s\n", added, len(entries), *write)
+	}
+	if len(unmapped) > 0 {
+		return fmt.Errorf("%d crontab lines could not be imported", len(unmapped))
+	}
+	return nil
+}
+
+// suspendSchedule suspends or resumes an entry or a group of
+// PERIODIC_ENTRIES_FILE, which the schedulers pick up at their next sync
+func suspendSchedule(action string, args []string) error {
+	fs := flag.NewFlagSet(action, flag.ContinueOnError)
+	entry := fs.String("entry", "", "entry ID")
+	group := fs.String("group", "", "entry group, e.g. a tenant")
+	reason := fs.String("reason", "", "why the entries are suspended")
+	catchUp := fs.Bool("catch-up", false, "on resume, enqueue each entry that skipped ticks once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*entry == "") == (*group == "") || fs.NArg() != 0 {
+		return fmt.Errorf("usage: admin schedule %s --entry ID|--group G [--reason R] [--catch-up]", action)
+	}
+	cfg, err := scheduler.ShardConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return fmt.Errorf("PERIODIC_ENTRIES_FILE is not set")
+	}
+	target := scheduler.EntryTarget(*entry)
+	if *group != "" {
+		target = scheduler.GroupTarget(*group)
+	}
+	rdb := redisClient()
+	defer rdb.Close()
+	suspensions := scheduler.NewSuspensions(rdb, scheduler.EntriesFile(cfg.File))
+	if action == "suspend" {
+		if err := suspensions.Suspend(context.Background(), target, *reason, time.Now()); err != nil {
+			return err
+		}
+		fmt.Printf("⏸️  Suspended %s, from the next scheduler sync\n", target)
+		return nil
+	}
+	client := asynq.NewClient(redisConnOpt())
+	defer client.Close()
+	resumed, err := suspensions.Resume(context.Background(), client, target, *catchUp, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(resumed) == 0 {
+		fmt.Printf("%s was not suspended\n", target)
+	}
+	for _, r := range resumed {
+		switch {
+		case len(r.StillSuspendedBy) > 0:
+			fmt.Printf("⏸️  %s still suspended by %s\n", r.ID, strings.Join(r.StillSuspendedBy, ", "))
+		case r.CatchUpTaskID != "":
+			fmt.Printf("▶️  %s resumed after %d skipped ticks, catch-up task %s\n", r.ID, r.Skipped, r.CatchUpTaskID)
+		default:
+			fmt.Printf("▶️  %s resumed after %d skipped ticks\n", r.ID, r.Skipped)
+		}
+	}
+	return nil
+}
+
+func listSchedule() error {
+	cfg, err := scheduler.ShardConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+
+	entries, err := inspector.SchedulerEntries()
+	if err != nil {
+		return fmt.Errorf("failed to list scheduler entries: %v", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Next.Before(entries[j].Next) })
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SPEC\tTYPE\tNEXT\tPREV")
+	for _, e := range entries {
+		prev := "-"
+		if !e.Prev.IsZero() {
+			prev = e.Prev.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Spec, e.Task.Type(), e.Next.Format(time.RFC3339), prev)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if cfg == nil {
+		return nil
+	}
+
+	rdb := redisClient()
+	defer rdb.Close()
+	states, err := scheduler.NewSuspensions(rdb, scheduler.EntriesFile(cfg.File)).States(context.Background(), time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nEntries of %s:\n", cfg.File)
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tGROUP\tCRON\tTYPE\tSTATE\tSINCE\tUNTIL\tSKIPPED")
+	for _, st := range states {
+		state, since, until := "active", "-", "-"
+		if st.Suspended {
+			state = "suspended (" + strings.Join(st.By, ", ") + ")"
+			since = st.Since.Format(time.RFC3339)
+		}
+		if !st.Until.IsZero() {
+			until = st.Until.Format(time.RFC3339)
+		}
+		group := st.Group
+		if group == "" {
+			group = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", st.ID, group, st.Cronspec, st.Type, state, since, until, st.Skipped)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	shots, err := scheduler.EntriesFile(cfg.File).OneShots()
+	if err != nil {
+		return err
+	}
+	statuses, err := scheduler.OneShotStatuses(context.Background(), inspector, rdb, shots, cfg.OneShotGrace, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nOne-shot entries of %s:\n", cfg.File)
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tAT\tTYPE\tQUEUE\tSTATUS\tTASK")
+	for _, s := range statuses {
+		task := "-"
+		if s.TaskState != "" {
+			task = s.TaskID + " (" + s.TaskState + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, s.At.Format(time.RFC3339), s.Type, s.Queue, s.Status, task)
+	}
+	return w.Flush()
+}
+
+// formatRaw renders a raw payload as indented JSON or as a hex dump, also
+// for JSON format when the bytes are not valid JSON
+func formatRaw(raw []byte, format string) string {
+	var out bytes.Buffer
+	if format == "json" && json.Indent(&out, raw, "  ", "  ") == nil {
+		return "  " + out.String() + "\n"
+	}
+	for _, line := range strings.SplitAfter(hex.Dump(raw), "\n") {
+		if line != "" {
+			out.WriteString("  " + line)
+		}
+	}
+	return out.String()
+}
+
+func runTrash(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: admin trash list | restore ID... | restore --all")
+	}
+	inspector := asynq.NewInspector(redisConnOpt())
+	defer inspector.Close()
+
+	switch args[0] {
+	case "list":
+		tasks, err := trash.List(inspector)
+		if err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			fmt.Println("✅ The trash is empty")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTYPE\tFROM\tSTATE\tTRASHED AT")
+		for _, t := range tasks {
+			_, md := metadata.Unwrap(t.Payload)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Type, md[trash.KeyFrom], md[trash.KeyState], md[trash.KeyAt])
+		}
+		return w.Flush()
+	case "restore":
+		ids := args[1:]
+		if len(ids) == 1 && ids[0] == "--all" {
+			tasks, err := trash.List(inspector)
+			if err != nil {
+				return err
+			}
+			ids = ids[:0]
+			for _, t := range tasks {
+				ids = append(ids, t.ID)
+			}
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("usage: admin trash restore ID... | restore --all")
+		}
+		client := asynq.NewClient(redisConnOpt())
+		defer client.Close()
+		for _, id := range ids {
+			info, err := trash.Restore(context.Background(), inspector, client, id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("♻️  Restored %s to %s (%s)\n", id, info.Queue, info.State)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown trash subcommand %q", args[0])
+	}
+}
+
+func runImportJSONL(args []string) error {
+	fs := flag.NewFlagSet("import-jsonl", flag.ContinueOnError)
+	queue := fs.String("queue", "default", "queue to enqueue into")
+	typeField := fs.String("type-field", "type", "field holding the task type")
+	payloadField := fs.String("payload-field", "payload", "field holding the payload")
+	jf := journalFlags(fs, "field")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: admin import-jsonl [--queue Q] [--journal J [--resume] [--key FIELD]] FILE")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", fs.Arg(0), err)
+	}
+	defer f.Close()
+
+	client := asynq.NewClient(redisConnOpt())
+	defer client.Close()
+
+	imp := importer.NewJSONLinesImporter(client, *typeField, *payloadField)
+	journal, err := jf.open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		imp.WithJournal(journal, *jf.key)
+	}
+	imported, errs := imp.ImportFromJSONLines(f, *queue)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "⚠️  %v\n", err)
+	}
+	fmt.Printf("✅ Imported %d tasks\n", imported)
+	if err := jf.close(journal); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d lines failed", len(errs))
+	}
+	return nil
+}
+
+func runPreflight(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: admin preflight")
+	}
+	smtpAddr, err := mailer.AddrFromEnv()
+	if err != nil {
+		return err
+	}
+	res := maintenance.RunPreflight(context.Background(), common.DefaultDeps(), smtpAddr)
+	for _, c := range res.Checks {
+		if c.OK {
+			fmt.Printf("✅ %s\n", c.Name)
+		} else {
+			fmt.Printf("❌ %s: %s\n", c.Name, c.Error)
+		}
+	}
+	if !res.OK {
+		return fmt.Errorf("preflight failed")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Command external-handler is a sample out-of-process task handler. It
+// counts the words of {"text": "..."} payloads and stores the count as the
+// task result.
+//
+// For trying out the failure paths, "sleep_ms" makes it sleep first and
+// "crash" makes it panic. Payloads without text are rejected with
+// external.ExitSkipRetry.
+//
+//	handlers:
+//	  - type: text:count
+//	    path: ./bin/external-handler
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"asynqdemo/external"
+)
+
+type payload struct {
+	Text    string `json:"text"`
+	SleepMs int    `json:"sleep_ms"`
+	Crash   bool   `json:"crash"`
+}
+
+type result struct {
+	Words int `json:"words"`
+}
+
+func main() {
+	var req external.Request
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fail(1, fmt.Sprintf("failed to decode request: %v", err))
+	}
+	var p payload
+	if err := json.Unmarshal(req.Payload, &p); err != nil || p.Text == "" {
+		fail(external.ExitSkipRetry, fmt.Sprintf("task %s: payload needs a text", req.ID))
+	}
+	time.Sleep(time.Duration(p.SleepMs) * time.Millisecond)
+	if p.Crash {
+		panic("crash requested by task " + req.ID)
+	}
+	out, _ := json.Marshal(result{Words: len(strings.Fields(p.Text))})
+	json.NewEncoder(os.Stdout).Encode(external.Response{Result: out})
+}
+
+// fail reports err in the response and exits with code
+func fail(code int, err string) {
+	json.NewEncoder(os.Stdout).Encode(external.Response{Error: err})
+	os.Exit(code)
+}
@@ -0,0 +1,224 @@
+package clock
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for our own code, so that tests can control it
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer mirrors the parts of *time.Timer we use
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Sleep waits for d on the given clock, returning early if ctx is done
+func Sleep(ctx context.Context, c Clock, d time.Duration) error {
+	t := c.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C():
+		return nil
+	}
+}
+
+// WithTimeout is context.WithTimeout on the given clock: the context is
+// done with context.DeadlineExceeded once c advanced by d, or with the
+// error of parent or context.Canceled when they come first
+func WithTimeout(parent context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx := &timeoutCtx{Context: parent, clock: c, deadline: c.Now().Add(d), done: make(chan struct{})}
+	timer := c.NewTimer(d)
+	stop := context.AfterFunc(parent, func() { ctx.cancel(parent.Err()) })
+	go func() {
+		select {
+		case <-timer.C():
+			ctx.cancel(context.DeadlineExceeded)
+		case <-ctx.done:
+		}
+	}()
+	return ctx, func() {
+		stop()
+		timer.Stop()
+		ctx.cancel(context.Canceled)
+	}
+}
+
+// timeoutCtx is the context of WithTimeout. It keeps its own done channel
+// so contexts derived from it see its error rather than the parent's.
+type timeoutCtx struct {
+	context.Context
+	clock    Clock
+	deadline time.Time
+
+	mu   sync.Mutex
+	done chan struct{}
+	err  error
+}
+
+func (c *timeoutCtx) Deadline() (time.Time, bool) {
+	if d, ok := c.Context.Deadline(); ok && d.Before(c.deadline) {
+		return d, true
+	}
+	return c.deadline, true
+}
+
+func (c *timeoutCtx) Done() <-chan struct{} { return c.done }
+
+// Err also checks the deadline, so a caller that advanced a fake clock
+// past it sees the timeout before the timer goroutine ran
+func (c *timeoutCtx) Err() error {
+	if !c.clock.Now().Before(c.deadline) {
+		c.cancel(context.DeadlineExceeded)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *timeoutCtx) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+// Real returns the clock backed by the time package
+func Real() Clock { return realClock{} }
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (r realTimer) C() <-chan time.Time        { return r.t.C }
+func (r realTimer) Stop() bool                 { return r.t.Stop() }
+func (r realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+
+// Fake is a manually advanced clock. Timers fire when Advance or Set moves the
+// current time past their deadline.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake creates a fake clock starting at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake current time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel receiving the time once the clock advanced by d
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// NewTimer creates a timer firing once the clock advanced by d
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{clock: f, ch: make(chan time.Time, 1)}
+	f.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d and fires every timer that became due
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock to t and fires every timer that became due
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+	sort.Slice(f.timers, func(i, j int) bool { return f.timers[i].deadline.Before(f.timers[j].deadline) })
+	remaining := f.timers[:0]
+	for _, ft := range f.timers {
+		if ft.deadline.After(f.now) {
+			remaining = append(remaining, ft)
+			continue
+		}
+		select {
+		case ft.ch <- f.now:
+		default:
+		}
+	}
+	f.timers = remaining
+}
+
+// Pending returns the number of timers waiting to fire, useful to know a
+// goroutine is blocked on the clock before advancing it
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// schedule must be called with f.mu held
+func (f *Fake) schedule(t *fakeTimer, d time.Duration) {
+	t.deadline = f.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.ch <- f.now:
+		default:
+		}
+		return
+	}
+	f.timers = append(f.timers, t)
+}
+
+// unschedule must be called with f.mu held
+func (f *Fake) unschedule(t *fakeTimer) bool {
+	for i, ft := range f.timers {
+		if ft == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	ch       chan time.Time
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.unschedule(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+	return wasActive
+}
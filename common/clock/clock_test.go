@@ -0,0 +1,123 @@
+package clock_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"asynqdemo/common/clock"
+)
+
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := clock.NewFake(start)
+	if !f.Now().Equal(start) {
+		t.Fatalf("Now %v, want %v", f.Now(), start)
+	}
+
+	after := f.After(time.Minute)
+	timer := f.NewTimer(2 * time.Minute)
+	stopped := f.NewTimer(time.Minute)
+	if !stopped.Stop() || f.Pending() != 2 {
+		t.Fatalf("%d timers pending after a stop, want 2", f.Pending())
+	}
+	f.Advance(59 * time.Second)
+	if fired(after) || fired(timer.C()) {
+		t.Fatal("timers fired before their deadline")
+	}
+	f.Advance(time.Second)
+	if !fired(after) || fired(timer.C()) || fired(stopped.C()) {
+		t.Fatal("only the 1m timer should fire at 1m")
+	}
+	if timer.Reset(time.Hour) != true {
+		t.Error("resetting a pending timer reported it inactive")
+	}
+	f.Set(start.Add(59 * time.Minute))
+	if fired(timer.C()) {
+		t.Error("reset timer fired at its old deadline")
+	}
+	f.Set(start.Add(time.Hour + time.Minute))
+	if !fired(timer.C()) || f.Pending() != 0 {
+		t.Errorf("reset timer did not fire, %d pending", f.Pending())
+	}
+	if !fired(f.After(0)) {
+		t.Error("zero duration did not fire at once")
+	}
+}
+
+// TestSleep fails unless Sleep returns once the fake clock passes the
+// duration, and early with the context's error
+func TestSleep(t *testing.T) {
+	f := clock.NewFake(time.Unix(0, 0))
+	done := make(chan error, 1)
+	go func() { done <- clock.Sleep(context.Background(), f, time.Hour) }()
+	for f.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Sleep returned %v before the clock moved", err)
+	default:
+	}
+	f.Advance(time.Hour)
+	if err := <-done; err != nil {
+		t.Errorf("Sleep gave %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := clock.Sleep(ctx, f, time.Hour); err != context.Canceled {
+		t.Errorf("Sleep with a cancelled context gave %v", err)
+	}
+	if f.Pending() != 0 {
+		t.Errorf("%d timers left after Sleep returned", f.Pending())
+	}
+}
+
+// TestWithTimeout fails unless the context of WithTimeout is done with
+// context.DeadlineExceeded once the fake clock passes its deadline, passes
+// that error to the contexts derived from it, ends with its parent, and
+// is cancelled by its CancelFunc
+func TestWithTimeout(t *testing.T) {
+	f := clock.NewFake(time.Unix(0, 0))
+	ctx, cancel := clock.WithTimeout(context.Background(), f, time.Minute)
+	defer cancel()
+	derived, cancelDerived := context.WithCancel(ctx)
+	defer cancelDerived()
+	if d, ok := ctx.Deadline(); !ok || !d.Equal(time.Unix(60, 0)) {
+		t.Errorf("deadline %v, want 1m on the fake clock", d)
+	}
+	f.Advance(59 * time.Second)
+	if ctx.Err() != nil {
+		t.Fatalf("done with %v before the deadline", ctx.Err())
+	}
+	f.Advance(time.Second)
+	<-derived.Done()
+	if ctx.Err() != context.DeadlineExceeded || derived.Err() != context.DeadlineExceeded {
+		t.Errorf("past the deadline gave %v, derived %v", ctx.Err(), derived.Err())
+	}
+
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel = clock.WithTimeout(parent, f, time.Minute)
+	cancelParent()
+	<-ctx.Done()
+	if ctx.Err() != context.Canceled {
+		t.Errorf("cancelled parent gave %v", ctx.Err())
+	}
+	cancel()
+
+	ctx, cancel = clock.WithTimeout(context.Background(), f, time.Minute)
+	cancel()
+	if ctx.Err() != context.Canceled || f.Pending() != 0 {
+		t.Errorf("cancelled context gave %v with %d timers pending", ctx.Err(), f.Pending())
+	}
+}
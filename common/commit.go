@@ -0,0 +1,109 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// doneTTL bounds how long a processed task is remembered for redelivery
+const doneTTL = 7 * 24 * time.Hour
+
+// doneKey shares the {queue} hash tag of asynq's task keys, so the commit
+// script touches a single slot in Redis Cluster
+func doneKey(queue, taskID string) string {
+	return fmt.Sprintf("task:{%s}:done:%s", queue, taskID)
+}
+
+// commitScript writes the processed marker, the final history entry and the
+// task result in one step, so a crash leaves either all of them or none.
+// The result goes straight into asynq's task hash, which is what ResultWriter
+// writes to.
+//
+// KEYS[1] marker, KEYS[2] history list, KEYS[3] asynq task hash
+// ARGV[1] result, ARGV[2] history entry, ARGV[3] marker TTL in seconds,
+// ARGV[4] history TTL in seconds
+var commitScript = redis.NewScript(`
+redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[3])
+redis.call("RPUSH", KEYS[2], ARGV[2])
+redis.call("EXPIRE", KEYS[2], ARGV[4])
+if redis.call("EXISTS", KEYS[3]) == 1 then
+  redis.call("HSET", KEYS[3], "result", ARGV[1])
+end
+return 1
+`)
+
+type committerKey struct{}
+
+type committer struct {
+	rdb   redis.UniversalClient
+	queue string
+	id    string
+}
+
+func taskHashKey(queue, id string) string {
+	return fmt.Sprintf("asynq:{%s}:t:%s", queue, id)
+}
+
+// CommitResult records the task as processed together with its result. Handlers
+// with side effects call it as their last step so a redelivered task is
+// answered from the marker instead of repeating the side effect. Without
+// ExactlyOnce installed it only writes the result through the task's
+// ResultWriter, if any.
+func CommitResult(ctx context.Context, result []byte) error {
+	w, hasWriter := GetResultWriter(ctx)
+	c, ok := ctx.Value(committerKey{}).(committer)
+	if !ok {
+		if hasWriter {
+			_, err := w.Write(result)
+			return err
+		}
+		return nil
+	}
+	entry, err := json.Marshal(HistoryEntry{At: DepsFrom(ctx).Clock.Now(), Event: "completed"})
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %v", err)
+	}
+	keys := []string{doneKey(c.queue, c.id), historyKey(c.queue, c.id), taskHashKey(c.queue, c.id)}
+	if err := commitScript.Run(ctx, c.rdb, keys, result, entry, int(doneTTL.Seconds()), int(historyTTL.Seconds())).Err(); err != nil {
+		return fmt.Errorf("failed to commit result of task %s: %v", c.id, err)
+	}
+	if hasWriter {
+		return w.store(ctx, result)
+	}
+	return nil
+}
+
+// ExactlyOnce skips tasks that already committed a result, rewriting the
+// stored result instead of running the handler again
+func ExactlyOnce(rdb redis.UniversalClient) asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			id, ok := asynq.GetTaskID(ctx)
+			if !ok {
+				return next.ProcessTask(ctx, t)
+			}
+			queue, _ := asynq.GetQueueName(ctx)
+			result, err := rdb.Get(ctx, doneKey(queue, id)).Bytes()
+			switch {
+			case err == nil:
+				fmt.Printf("♻️  Task %s already processed, reusing its result\n", id)
+				if err := rdb.HSet(ctx, taskHashKey(queue, id), "result", result).Err(); err != nil {
+					return fmt.Errorf("failed to restore result of task %s: %v", id, err)
+				}
+				if w, ok := GetResultWriter(ctx); ok {
+					return w.store(ctx, result)
+				}
+				return nil
+			case err != redis.Nil:
+				return fmt.Errorf("failed to check processed marker of task %s: %v", id, err)
+			}
+			ctx = context.WithValue(ctx, committerKey{}, committer{rdb: rdb, queue: queue, id: id})
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package common_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/leak/leaktest"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestExactlyOnce kills a handler after it sent and committed its result
+// but before the task was acknowledged, and fails unless the redelivered
+// task completes with the committed result without a second send, the
+// completion is in the task's history, the history is kept for 30 days and
+// the marker, tagged with the queue, for 7, and a handler failing before
+// its commit is run again
+func TestExactlyOnce(t *testing.T) {
+	leaktest.Check(t)
+	srv := leaktest.Redis(t)
+	r := srv.ConnOpt()
+	rdb := r.MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+
+	var sends, attempts atomic.Int32
+	mux := asynq.NewServeMux()
+	mux.Use(common.ResultWriterMiddleware(rdb, time.Hour), common.ExactlyOnce(rdb))
+	mux.HandleFunc("payment:charge", func(ctx context.Context, task *asynq.Task) error {
+		n := attempts.Add(1)
+		if string(task.Payload()) == "fail before commit" && n == 1 {
+			panic("worker killed before the send")
+		}
+		sends.Add(1)
+		if err := common.CommitResult(ctx, []byte(`{"charged":true}`)); err != nil {
+			return err
+		}
+		if string(task.Payload()) == "fail after commit" && n == 1 {
+			panic("worker killed before the ack")
+		}
+		return nil
+	})
+	worker := asynq.NewServer(r, asynq.Config{
+		Concurrency:              1,
+		LogLevel:                 asynq.FatalLevel,
+		RetryDelayFunc:           func(int, error, *asynq.Task) time.Duration { return time.Millisecond },
+		DelayedTaskCheckInterval: 10 * time.Millisecond,
+	})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	client := asynq.NewClient(r)
+	defer client.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+
+	run := func(payload string) *asynq.TaskInfo {
+		t.Helper()
+		sends.Store(0)
+		attempts.Store(0)
+		info, err := client.Enqueue(asynq.NewTask("payment:charge", []byte(payload)), asynq.MaxRetry(3), asynq.Retention(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the task to complete", func() bool {
+			info, err = inspector.GetTaskInfo("default", info.ID)
+			return err == nil && info.State == asynq.TaskStateCompleted
+		})
+		return info
+	}
+
+	info := run("fail after commit")
+	if sends.Load() != 1 || attempts.Load() != 1 {
+		t.Errorf("%d sends in %d handler runs, want the redelivery answered from the marker", sends.Load(), attempts.Load())
+	}
+	if string(info.Result) != `{"charged":true}` || info.Retried != 1 {
+		t.Errorf("task completed after %d retries with result %s", info.Retried, info.Result)
+	}
+	store := common.NewResultStore(rdb, inspector)
+	if result, err := store.ReadResult(info.ID); err != nil || string(result) != `{"charged":true}` {
+		t.Errorf("stored result %s (%v)", result, err)
+	}
+	entries, err := common.NewHistory(rdb).Entries(context.Background(), info.Queue, info.ID)
+	if err != nil || len(entries) != 1 || entries[0].Event != "completed" {
+		t.Errorf("history %+v (%v), want one completion", entries, err)
+	}
+	// The marker shares the queue's hash tag with asynq's task hash, so the
+	// commit touches one slot in Redis Cluster
+	if rdb.Exists(context.Background(), "task:{default}:done:"+info.ID).Val() != 1 {
+		t.Errorf("processed marker of %s is not tagged with its queue", info.ID)
+	}
+	// The commit keeps the history for 30 days, the marker for 7
+	ctx := context.Background()
+	if ttl := rdb.TTL(ctx, "task:{default}:history:"+info.ID).Val(); ttl < 29*24*time.Hour || ttl > 30*24*time.Hour {
+		t.Errorf("history TTL %v after the commit, want 30 days", ttl)
+	}
+	if ttl := rdb.TTL(ctx, "task:{default}:done:"+info.ID).Val(); ttl < 6*24*time.Hour || ttl > 7*24*time.Hour {
+		t.Errorf("marker TTL %v, want 7 days", ttl)
+	}
+
+	if info := run("fail before commit"); sends.Load() != 1 || attempts.Load() != 2 || string(info.Result) != `{"charged":true}` {
+		t.Errorf("%d sends in %d handler runs, result %s; want the retry to send", sends.Load(), attempts.Load(), info.Result)
+	}
+}
@@ -0,0 +1,170 @@
+package common_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"asynqdemo/common"
+	"asynqdemo/validation"
+
+	"github.com/hibiken/asynq"
+)
+
+// compatibilityTest checks that two schema versions of a payload can be read
+// by the handlers of both versions, as happens while a rollout is in progress
+type compatibilityTest struct {
+	taskType  string
+	v1Fixture interface{}
+	v2Fixture interface{}
+	v1Handler asynq.Handler
+	v2Handler asynq.Handler
+}
+
+// newCompatibilityTest pairs the fixtures and handlers of two schema versions
+func newCompatibilityTest(taskType string, v1Fixture, v2Fixture interface{}, v1Handler, v2Handler asynq.Handler) compatibilityTest {
+	return compatibilityTest{taskType: taskType, v1Fixture: v1Fixture, v2Fixture: v2Fixture, v1Handler: v1Handler, v2Handler: v2Handler}
+}
+
+// assertBackwardCompatible fails t unless the v2 handler accepts a v1 payload
+func (c compatibilityTest) assertBackwardCompatible(t *testing.T) {
+	t.Helper()
+	if err := c.run(c.v1Fixture, c.v2Handler); err != nil {
+		t.Fatalf("%s: v2 handler rejected v1 payload: %v", c.taskType, err)
+	}
+}
+
+// assertForwardCompatible fails t unless the v1 handler accepts a v2 payload
+func (c compatibilityTest) assertForwardCompatible(t *testing.T) {
+	t.Helper()
+	if err := c.run(c.v2Fixture, c.v1Handler); err != nil {
+		t.Fatalf("%s: v1 handler rejected v2 payload: %v", c.taskType, err)
+	}
+}
+
+func (c compatibilityTest) run(fixture interface{}, h asynq.Handler) error {
+	payload, err := json.Marshal(fixture)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fixture: %v", err)
+	}
+	return h.ProcessTask(context.Background(), asynq.NewTask(c.taskType, payload))
+}
+
+// Schemas as released in v1, before the optional fields were added. The
+// server info payload has not changed since.
+type (
+	welcomePayloadV1 struct {
+		UserID   int    `json:"user_id"`
+		Username string `json:"username"`
+		Message  string `json:"message"`
+	}
+	emailPayloadV1 struct {
+		UserID  int    `json:"user_id"`
+		Email   string `json:"email"`
+		Subject string `json:"subject"`
+		Message string `json:"message"`
+	}
+	serverInfoPayloadV1 struct {
+		Timestamp int64  `json:"timestamp"`
+		Source    string `json:"source"`
+	}
+)
+
+// emailPayloadV2 is the email payload with the metadata field added in v2
+type emailPayloadV2 struct {
+	common.EmailPayload
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// decodeHandler stands in for a worker of one version: it decodes the payload
+// into that version's type the way the handlers do and checks it
+func decodeHandler(newPayload func() interface{}, check func(v interface{}) error) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		v := newPayload()
+		if err := json.Unmarshal(t.Payload(), v); err != nil {
+			return fmt.Errorf("failed to unmarshal payload: %v", err)
+		}
+		return check(v)
+	})
+}
+
+// currentHandler decodes into the registered payload type and runs the
+// registered validator, which is what the current worker does
+func currentHandler() asynq.Handler {
+	reg := validation.DefaultRegistry()
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		spec, ok := common.LookupTaskSpec(t.Type())
+		if !ok || spec.NewPayload == nil {
+			return fmt.Errorf("no payload type registered for %s", t.Type())
+		}
+		if err := json.Unmarshal(t.Payload(), spec.NewPayload()); err != nil {
+			return fmt.Errorf("failed to unmarshal payload: %v", err)
+		}
+		return reg.Validate(t.Type(), t.Payload())
+	})
+}
+
+func requireFields(fields map[string]bool) error {
+	for name, ok := range fields {
+		if !ok {
+			return fmt.Errorf("%s required", name)
+		}
+	}
+	return nil
+}
+
+// compatibilityFixtures returns the compatibility tests of the built-in
+// payload types
+func compatibilityFixtures() []compatibilityTest {
+	return []compatibilityTest{
+		newCompatibilityTest(common.TypeWelcomeMessage,
+			welcomePayloadV1{UserID: 1, Username: "Alice", Message: "Welcome!"},
+			common.WelcomePayload{UserID: 1, Username: "Alice", Message: "Welcome!", Locale: "zh", TenantID: "acme"},
+			decodeHandler(func() interface{} { return &welcomePayloadV1{} }, func(v interface{}) error {
+				p := v.(*welcomePayloadV1)
+				return requireFields(map[string]bool{"user_id": p.UserID != 0, "username": p.Username != ""})
+			}),
+			currentHandler(),
+		),
+		newCompatibilityTest(common.TypeEmailTask,
+			emailPayloadV1{UserID: 4, Email: "alice@example.com", Subject: "Welcome!", Message: "Hi"},
+			emailPayloadV2{
+				EmailPayload: common.EmailPayload{UserID: 4, Email: "alice@example.com", Subject: "Welcome!", Message: "Hi", Category: common.CategoryMarketing},
+				Metadata:     map[string]string{"campaign": "spring"},
+			},
+			decodeHandler(func() interface{} { return &emailPayloadV1{} }, func(v interface{}) error {
+				p := v.(*emailPayloadV1)
+				return requireFields(map[string]bool{"user_id": p.UserID != 0, "email": p.Email != ""})
+			}),
+			currentHandler(),
+		),
+		newCompatibilityTest(common.TypeServerInfo,
+			serverInfoPayloadV1{Timestamp: 1700000000, Source: "periodic-monitor"},
+			common.ServerInfoPayload{Timestamp: 1700000000, Source: "periodic-monitor"},
+			decodeHandler(func() interface{} { return &serverInfoPayloadV1{} }, func(v interface{}) error {
+				p := v.(*serverInfoPayloadV1)
+				return requireFields(map[string]bool{"timestamp": p.Timestamp != 0, "source": p.Source != ""})
+			}),
+			currentHandler(),
+		),
+	}
+}
+
+// TestPayloadCompatibility fails unless the handlers of either schema
+// version of every built-in payload type accept the payloads of the other
+func TestPayloadCompatibility(t *testing.T) {
+	for _, c := range compatibilityFixtures() {
+		c := c
+		t.Run(c.taskType, func(t *testing.T) {
+			c.assertBackwardCompatible(t)
+			c.assertForwardCompatible(t)
+		})
+	}
+
+	// A v1 payload missing a field the current worker requires is caught
+	broken := newCompatibilityTest(common.TypeEmailTask, emailPayloadV1{UserID: 4, Subject: "Welcome!"}, nil, nil, currentHandler())
+	if err := broken.run(broken.v1Fixture, broken.v2Handler); err == nil {
+		t.Error("v2 handler accepted a v1 email payload without an address")
+	}
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"context"
+
+	"github.com/hibiken/asynq"
+)
+
+// ControlMux routes control tasks to a lean mux that runs only the
+// middlewares installed with UseAll, such as metrics, and every other task
+// to the full mux. asynq recovers handler panics on both paths. Handlers
+// go to the mux their type belongs to, so control specs must be
+// registered before their handlers.
+type ControlMux struct {
+	full    *asynq.ServeMux
+	control *asynq.ServeMux
+}
+
+// NewControlMux creates an empty mux
+func NewControlMux() *ControlMux {
+	return &ControlMux{full: asynq.NewServeMux(), control: asynq.NewServeMux()}
+}
+
+// Use installs middlewares for all but control tasks
+func (m *ControlMux) Use(mws ...asynq.MiddlewareFunc) {
+	m.full.Use(mws...)
+}
+
+// UseAll installs middlewares for every task, control tasks included
+func (m *ControlMux) UseAll(mws ...asynq.MiddlewareFunc) {
+	m.full.Use(mws...)
+	m.control.Use(mws...)
+}
+
+// Chain composes middlewares into one that runs them in the order given,
+// the first outermost, as Use installs them
+func Chain(mws ...asynq.MiddlewareFunc) asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// Handle registers the handler of a task type
+func (m *ControlMux) Handle(pattern string, h asynq.Handler) {
+	if IsControl(pattern) {
+		m.control.Handle(pattern, h)
+		return
+	}
+	m.full.Handle(pattern, h)
+}
+
+// HandleFunc registers the handler function of a task type
+func (m *ControlMux) HandleFunc(pattern string, h func(context.Context, *asynq.Task) error) {
+	m.Handle(pattern, asynq.HandlerFunc(h))
+}
+
+// ProcessTask dispatches t on the path of its type
+func (m *ControlMux) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	if IsControl(t.Type()) {
+		return m.control.ProcessTask(ctx, t)
+	}
+	return m.full.ProcessTask(ctx, t)
+}
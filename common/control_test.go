@@ -0,0 +1,182 @@
+package common_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"asynqdemo/common"
+	"asynqdemo/leak/leaktest"
+	"asynqdemo/metadata"
+	"asynqdemo/metrics"
+	"asynqdemo/validation"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	benchControlType = "bench:control"
+	benchFullType    = "bench:full"
+)
+
+// benchPayload is the empty payload a control-like task carries on the
+// full path
+type benchPayload struct{}
+
+// controlBenchMux registers a control type and a payload type doing nothing
+// and returns a mux with the payload middlewares, plus the metrics
+// middleware for both paths
+func controlBenchMux(tb testing.TB) *common.ControlMux {
+	common.RegisterTaskSpec(common.TaskSpec{Type: benchControlType, Control: true})
+	common.RegisterTaskSpec(common.TaskSpec{Type: benchFullType, NewPayload: func() interface{} { return &benchPayload{} }})
+	latency, err := metrics.NewLatencyRecorder(nil, prometheus.NewRegistry())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	mux := common.NewControlMux()
+	mux.UseAll(latency.Middleware())
+	mux.Use(metadata.Middleware())
+	mux.Use(validation.ValidationMiddleware(validation.DefaultRegistry()))
+	mux.Use(common.TempDirMiddleware(common.TempDirConfig{Root: tb.TempDir()}))
+	nop := func(ctx context.Context, t *asynq.Task) error { return nil }
+	mux.HandleFunc(benchControlType, nop)
+	mux.HandleFunc(benchFullType, nop)
+	return mux
+}
+
+// BenchmarkControlTasks measures creating and processing a task without a
+// meaningful payload through the full middleware path and as a control
+// task
+func BenchmarkControlTasks(b *testing.B) {
+	mux := controlBenchMux(b)
+	ctx := context.Background()
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			payload, err := json.Marshal(benchPayload{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			task, err := metadata.NewTask(benchFullType, payload, metadata.Metadata{"source": "bench"})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := mux.ProcessTask(ctx, task); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("control", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := mux.ProcessTask(ctx, asynq.NewTask(benchControlType, nil)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestControlTasks fails unless a control type declaring a payload is
+// refused, control tasks skip the payload middlewares but are still timed
+// by the metrics middleware, and an enqueued control task is listed by the
+// inspector the admin tools use
+func TestControlTasks(t *testing.T) {
+	leaktest.Check(t)
+	srv := leaktest.Redis(t)
+	r := srv.ConnOpt()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("control type with a payload was registered")
+			}
+		}()
+		common.RegisterTaskSpec(common.TaskSpec{Type: "control:invalid", Control: true, NewPayload: func() interface{} { return &benchPayload{} }})
+	}()
+	if _, ok := common.LookupTaskSpec("control:invalid"); ok {
+		t.Errorf("refused control type is in the registry")
+	}
+
+	common.RegisterTaskSpec(common.TaskSpec{Type: benchControlType, Control: true})
+	common.RegisterTaskSpec(common.TaskSpec{Type: benchFullType, NewPayload: func() interface{} { return &benchPayload{} }})
+	reg := prometheus.NewRegistry()
+	latency, err := metrics.NewLatencyRecorder(nil, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloadMiddleware []string
+	mux := common.NewControlMux()
+	mux.UseAll(latency.Middleware())
+	mux.Use(func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			payloadMiddleware = append(payloadMiddleware, t.Type())
+			return next.ProcessTask(ctx, t)
+		})
+	})
+	handled := map[string]int{}
+	nop := func(ctx context.Context, t *asynq.Task) error {
+		handled[t.Type()]++
+		return nil
+	}
+	mux.HandleFunc(benchControlType, nop)
+	mux.HandleFunc(benchFullType, nop)
+	ctx := context.Background()
+	for _, task := range []*asynq.Task{asynq.NewTask(benchControlType, nil), asynq.NewTask(benchFullType, []byte("{}"))} {
+		if err := mux.ProcessTask(ctx, task); err != nil {
+			t.Errorf("%s: %v", task.Type(), err)
+		}
+	}
+	if handled[benchControlType] != 1 || handled[benchFullType] != 1 {
+		t.Errorf("handled %v, want one task of each type", handled)
+	}
+	if len(payloadMiddleware) != 1 || payloadMiddleware[0] != benchFullType {
+		t.Errorf("payload middleware ran for %v, want only %s", payloadMiddleware, benchFullType)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timed := false
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "task_type" && l.GetValue() == benchControlType && m.GetHistogram().GetSampleCount() == 1 {
+					timed = true
+				}
+			}
+		}
+	}
+	if !timed {
+		t.Errorf("control task missing from the processing time histogram")
+	}
+
+	rdb, ok := r.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		t.Fatalf("unsupported redis connection %T", r)
+	}
+	defer rdb.Close()
+	const queue = "control-test"
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	client := asynq.NewClient(r)
+	defer client.Close()
+	info, err := client.Enqueue(asynq.NewTask(benchControlType, nil), asynq.Queue(queue))
+	if err != nil {
+		t.Fatalf("failed to enqueue control task: %v", err)
+	}
+	tasks, err := inspector.ListPendingTasks(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		if task.ID == info.ID {
+			if task.Type != benchControlType || len(strings.TrimSpace(string(task.Payload))) != 0 {
+				t.Errorf("control task listed as %s with payload %q", task.Type, task.Payload)
+			}
+			return
+		}
+	}
+	t.Errorf("control task %s not listed in queue %s", info.ID, queue)
+}
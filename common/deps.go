@@ -0,0 +1,83 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"asynqdemo/artifacts"
+	"asynqdemo/common/clock"
+	"asynqdemo/emailhtml"
+	"asynqdemo/i18n"
+	"asynqdemo/stats"
+)
+
+// Deps carries the dependencies task handlers use instead of package globals
+type Deps struct {
+	Clock   clock.Clock
+	Catalog *i18n.Catalog
+	// Preferences suppresses mail recipients opted out of; nil sends everything
+	Preferences NotificationPreferences
+	// UnsubscribeURL links recipients to opt out of a category; nil omits the link
+	UnsubscribeURL func(email, category string) string
+	// Mailer delivers email; nil only prints it
+	Mailer Mailer
+	// Artifacts stores files handlers produce; nil keeps them out of storage
+	Artifacts *artifacts.Store
+	// Templates renders the subject and body of email; nil sends them as given
+	Templates EmailTemplates
+	// HTML renders the HTML body of email naming a TemplateName
+	HTML *emailhtml.Registry
+	// Stats is read by server info tasks; nil reads the Go runtime
+	Stats stats.Source
+	// StatsThresholds are the limits server info tasks alert about
+	StatsThresholds stats.Thresholds
+	// Alert sends operational alerts; nil only logs them
+	Alert func(ctx context.Context, text string) error
+}
+
+// The embedded catalog and HTML templates are loaded once and shared by all
+// default Deps
+var (
+	loadCatalog = sync.OnceValues(i18n.Default)
+	loadHTML    = sync.OnceValues(emailhtml.Default)
+)
+
+// DefaultDeps returns the dependencies used in production
+func DefaultDeps() Deps {
+	catalog, err := loadCatalog()
+	if err != nil {
+		panic(fmt.Sprintf("embedded i18n catalog is broken: %v", err))
+	}
+	html, err := loadHTML()
+	if err != nil {
+		panic(fmt.Sprintf("embedded HTML email templates are broken: %v", err))
+	}
+	return Deps{Clock: clock.Real(), Catalog: catalog, HTML: html}
+}
+
+type depsKey struct{}
+
+// WithDeps returns a context carrying d for the handlers
+func WithDeps(ctx context.Context, d Deps) context.Context {
+	return context.WithValue(ctx, depsKey{}, d)
+}
+
+// DepsFrom returns the dependencies carried by ctx, falling back to DefaultDeps
+func DepsFrom(ctx context.Context) Deps {
+	d, ok := ctx.Value(depsKey{}).(Deps)
+	if !ok {
+		return DefaultDeps()
+	}
+	def := DefaultDeps()
+	if d.Clock == nil {
+		d.Clock = def.Clock
+	}
+	if d.Catalog == nil {
+		d.Catalog = def.Catalog
+	}
+	if d.HTML == nil {
+		d.HTML = def.HTML
+	}
+	return d
+}
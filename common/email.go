@@ -0,0 +1,63 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"asynqdemo/emailhtml"
+)
+
+// EmailMessage is an email ready to hand to the mail provider
+type EmailMessage struct {
+	To      string
+	Subject string
+	Body    string
+	// HTML is the HTML alternative of Body; empty sends text only
+	HTML    string
+	Headers map[string]string
+}
+
+// Mailer delivers rendered email messages
+type Mailer interface {
+	Send(ctx context.Context, msg EmailMessage) error
+}
+
+// EmailTemplates renders the subject and body of an email payload
+type EmailTemplates interface {
+	Render(ctx context.Context, p *EmailPayload) (subject, body string, err error)
+}
+
+// BuildEmail renders the message for a payload. Marketing mail gets an
+// unsubscribe link in the body and RFC 8058 one-click unsubscribe headers
+// when unsubscribeURL is set.
+func BuildEmail(p *EmailPayload, unsubscribeURL func(email, category string) string) EmailMessage {
+	msg := EmailMessage{To: p.Email, Subject: p.Subject, Body: p.Message, Headers: map[string]string{}}
+	if p.Category != CategoryMarketing || unsubscribeURL == nil {
+		return msg
+	}
+	url := unsubscribeURL(p.Email, p.Category)
+	msg.Body += fmt.Sprintf("\n\nUnsubscribe: %s", url)
+	msg.Headers["List-Unsubscribe"] = "<" + url + ">"
+	msg.Headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	return msg
+}
+
+// BuildHTML renders the HTML body of a payload naming a TemplateName with
+// html, linking marketing mail to unsubscribeURL when set. An unknown name
+// fails with emailhtml.ErrUnknownTemplate.
+func BuildHTML(html *emailhtml.Registry, p *EmailPayload, unsubscribeURL func(email, category string) string) (string, error) {
+	v := emailhtml.View{
+		UserID:   p.UserID,
+		Email:    p.Email,
+		Subject:  p.Subject,
+		Message:  p.Message,
+		Locale:   p.Locale,
+		TenantID: p.TenantID,
+		Category: p.Category,
+		Data:     p.TemplateData,
+	}
+	if p.Category == CategoryMarketing && unsubscribeURL != nil {
+		v.UnsubscribeURL = unsubscribeURL(p.Email, p.Category)
+	}
+	return html.Render(p.TemplateName, v)
+}
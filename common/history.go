@@ -0,0 +1,70 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// historyTTL bounds how long the history of a task is kept
+const historyTTL = 30 * 24 * time.Hour
+
+// HistoryEntry is one recorded change to a task
+type HistoryEntry struct {
+	At     time.Time `json:"at"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// History stores per-task change logs in Redis lists keyed by queue and task ID
+type History struct {
+	rdb redis.UniversalClient
+}
+
+// NewHistory creates a history store
+func NewHistory(rdb redis.UniversalClient) *History {
+	return &History{rdb: rdb}
+}
+
+func historyKey(queue, taskID string) string {
+	return fmt.Sprintf("task:{%s}:history:%s", queue, taskID)
+}
+
+// Record appends an entry to the history of a task. A nil History records nothing.
+func (h *History) Record(ctx context.Context, queue, taskID string, e HistoryEntry) error {
+	if h == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %v", err)
+	}
+	key := historyKey(queue, taskID)
+	pipe := h.rdb.TxPipeline()
+	pipe.RPush(ctx, key, data)
+	pipe.Expire(ctx, key, historyTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record history of task %s: %v", taskID, err)
+	}
+	return nil
+}
+
+// Entries returns the history of a task, oldest first
+func (h *History) Entries(ctx context.Context, queue, taskID string) ([]HistoryEntry, error) {
+	raw, err := h.rdb.LRange(ctx, historyKey(queue, taskID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of task %s: %v", taskID, err)
+	}
+	entries := make([]HistoryEntry, 0, len(raw))
+	for _, r := range raw {
+		var e HistoryEntry
+		if err := json.Unmarshal([]byte(r), &e); err != nil {
+			return nil, fmt.Errorf("failed to parse history of task %s: %v", taskID, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
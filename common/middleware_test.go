@@ -0,0 +1,78 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"asynqdemo/common"
+	"asynqdemo/leak/leaktest"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestMiddlewareChain runs tasks through chained middlewares installed on
+// a ControlMux. It fails unless they run in the order given, first
+// outermost, a middleware returning early keeps the later ones and the
+// handler from running, and a panicking middleware leaves the chain
+// running in order for the next task.
+func TestMiddlewareChain(t *testing.T) {
+	leaktest.Check(t)
+	var calls []string
+	errStop := errors.New("stopped")
+	trace := func(name string) asynq.MiddlewareFunc {
+		return func(next asynq.Handler) asynq.Handler {
+			return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+				calls = append(calls, name)
+				switch {
+				case strings.HasSuffix(task.Type(), ":stop") && name == "b":
+					return errStop
+				case strings.HasSuffix(task.Type(), ":panic") && name == "b":
+					panic("middleware b")
+				}
+				err := next.ProcessTask(ctx, task)
+				calls = append(calls, name+" done")
+				return err
+			})
+		}
+	}
+
+	mux := common.NewControlMux()
+	mux.Use(common.Chain(trace("a"), trace("b")), trace("c"))
+	handler := func(ctx context.Context, task *asynq.Task) error {
+		calls = append(calls, "handler")
+		return nil
+	}
+	for _, typ := range []string{"chain:ok", "chain:stop", "chain:panic"} {
+		mux.HandleFunc(typ, handler)
+	}
+
+	run := func(typ string) (panicked bool, err error) {
+		calls = nil
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = true
+			}
+		}()
+		return false, mux.ProcessTask(context.Background(), asynq.NewTask(typ, nil))
+	}
+	ordered := []string{"a", "b", "c", "handler", "c done", "b done", "a done"}
+
+	if _, err := run("chain:ok"); err != nil || !reflect.DeepEqual(calls, ordered) {
+		t.Errorf("chain ran %v (%v), want %v", calls, err, ordered)
+	}
+	if _, err := run("chain:stop"); !errors.Is(err, errStop) || !reflect.DeepEqual(calls, []string{"a", "b", "a done"}) {
+		t.Errorf("aborted chain ran %v (%v), want c and the handler skipped", calls, err)
+	}
+	if panicked, _ := run("chain:panic"); !panicked || !reflect.DeepEqual(calls, []string{"a", "b"}) {
+		t.Errorf("panicking chain ran %v, panicked %v", calls, panicked)
+	}
+	if _, err := run("chain:ok"); err != nil || !reflect.DeepEqual(calls, ordered) {
+		t.Errorf("chain after a panic ran %v (%v), want %v", calls, err, ordered)
+	}
+	if got := common.Chain()(asynq.HandlerFunc(handler)); got == nil {
+		t.Error("empty chain returned no handler")
+	}
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"asynqdemo/pkg/taskclient"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Email categories; recipients can opt out of marketing mail only
+const (
+	CategoryMarketing     = taskclient.CategoryMarketing
+	CategoryTransactional = taskclient.CategoryTransactional
+	CategoryDigest        = taskclient.CategoryDigest
+	CategorySecurity      = taskclient.CategorySecurity
+	CategoryWelcome       = taskclient.CategoryWelcome
+)
+
+// IsEssential reports whether a task keeps flowing while its type is
+// delayed by a feature flag: transactional and security email. Tasks whose
+// payload cannot be read count as essential, so their handler reports it.
+func IsEssential(t *asynq.Task) bool {
+	if t.Type() != TypeEmailTask {
+		return false
+	}
+	var p EmailPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return true
+	}
+	switch p.Category {
+	case "", CategoryTransactional, CategorySecurity:
+		return true
+	}
+	return false
+}
+
+// PreferencesUpdatePayload changes whether a recipient gets a category of mail
+type PreferencesUpdatePayload = taskclient.PreferencesUpdatePayload
+
+// NotificationPreferences stores which email categories recipients opted out of
+type NotificationPreferences interface {
+	OptedOut(ctx context.Context, email, category string) (bool, error)
+	SetOptedOut(ctx context.Context, email, category string, optedOut bool) error
+}
+
+// RedisPreferences keeps each recipient's opted-out categories in a Redis set
+type RedisPreferences struct {
+	rdb redis.UniversalClient
+}
+
+// NewRedisPreferences creates a preferences store
+func NewRedisPreferences(rdb redis.UniversalClient) *RedisPreferences {
+	return &RedisPreferences{rdb: rdb}
+}
+
+func optOutKey(email string) string {
+	return "prefs:optout:" + email
+}
+
+// OptedOut reports whether the recipient opted out of the category
+func (p *RedisPreferences) OptedOut(ctx context.Context, email, category string) (bool, error) {
+	return p.rdb.SIsMember(ctx, optOutKey(email), category).Result()
+}
+
+// SetOptedOut records the recipient's choice for the category
+func (p *RedisPreferences) SetOptedOut(ctx context.Context, email, category string, optedOut bool) error {
+	if optedOut {
+		return p.rdb.SAdd(ctx, optOutKey(email), category).Err()
+	}
+	return p.rdb.SRem(ctx, optOutKey(email), category).Err()
+}
+
+// HandlePreferencesUpdateTask applies a preferences change
+func HandlePreferencesUpdateTask(ctx context.Context, p *PreferencesUpdatePayload) error {
+	prefs := DepsFrom(ctx).Preferences
+	if prefs == nil {
+		return fmt.Errorf("no notification preferences store configured")
+	}
+	if err := prefs.SetOptedOut(ctx, p.Email, p.Category, p.OptedOut); err != nil {
+		return fmt.Errorf("failed to update preferences of %s: %v", p.Email, err)
+	}
+	fmt.Printf("📝 [Preferences] %s opted %s of %s mail\n", p.Email, map[bool]string{true: "out", false: "in"}[p.OptedOut], p.Category)
+	return nil
+}
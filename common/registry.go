@@ -0,0 +1,133 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// TaskSpec describes a task type known to this service
+type TaskSpec struct {
+	Type string
+	// PublishEvents opts the type into terminal-state event publication
+	PublishEvents bool
+	// NewPayload returns a pointer to an empty payload, used to validate payloads
+	NewPayload func() interface{}
+	// PayloadVersions lists the payload versions handled; nil means only version 1
+	PayloadVersions []int
+	// DefaultOptions are the options tasks of the type are created with
+	DefaultOptions []asynq.Option
+	// RetryPolicy sets the retry count (EnqueueOptions) and backoff
+	// (RetryDelay) of the type; nil keeps asynq's
+	RetryPolicy *RetryPolicy
+	// DedupKey returns the natural key of a payload, equal for payloads
+	// that are the same logical task; producers skip a task whose key was
+	// enqueued recently. Nil or an empty key never deduplicates.
+	DedupKey func(payload []byte) string
+	// Control marks internal tasks without a payload, such as canaries.
+	// They are enqueued without an envelope and ControlMux runs them
+	// without the payload middlewares. A control type cannot set NewPayload.
+	Control bool
+}
+
+// Versions returns the payload versions the spec handles
+func (s TaskSpec) Versions() []int {
+	if len(s.PayloadVersions) == 0 {
+		return []int{1}
+	}
+	return s.PayloadVersions
+}
+
+var (
+	// EmailRetryPolicy retries email quickly at first, as most failures
+	// are brief provider hiccups, and gives up within the hour
+	EmailRetryPolicy = RetryPolicy{MaxRetries: 10, InitialDelay: 10 * time.Second, Multiplier: 2, MaxDelay: 10 * time.Minute, Jitter: true, MaxTotal: time.Hour}
+	// WelcomeRetryPolicy retries a welcome message a few times only; a
+	// late welcome is worth little
+	WelcomeRetryPolicy = RetryPolicy{MaxRetries: 3, InitialDelay: time.Minute, Multiplier: 2, MaxDelay: 10 * time.Minute, Jitter: true}
+)
+
+// Options of the task constructors: the retry counts of the policies, and
+// server info on the low queue without retries, as the next run replaces it
+var (
+	welcomeOptions    = []asynq.Option{MaxRetryOf(WelcomeRetryPolicy)}
+	emailOptions      = []asynq.Option{MaxRetryOf(EmailRetryPolicy), asynq.Queue("default")}
+	serverInfoOptions = []asynq.Option{asynq.MaxRetry(0), asynq.Queue("low")}
+)
+
+// EmailDedupKey is the user and subject of an email payload: one user gets
+// a given email once
+func EmailDedupKey(payload []byte) string {
+	var p EmailPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.UserID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s", p.UserID, p.Subject)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]TaskSpec{
+		TypeWelcomeMessage:    {Type: TypeWelcomeMessage, NewPayload: func() interface{} { return &WelcomePayload{} }, RetryPolicy: &WelcomeRetryPolicy, DefaultOptions: welcomeOptions},
+		TypeEmailTask:         {Type: TypeEmailTask, PublishEvents: true, NewPayload: func() interface{} { return &EmailPayload{} }, RetryPolicy: &EmailRetryPolicy, DedupKey: EmailDedupKey, DefaultOptions: emailOptions},
+		TypeServerInfo:        {Type: TypeServerInfo, NewPayload: func() interface{} { return &ServerInfoPayload{} }, DefaultOptions: serverInfoOptions},
+		TypePreferencesUpdate: {Type: TypePreferencesUpdate, NewPayload: func() interface{} { return &PreferencesUpdatePayload{} }},
+	}
+)
+
+// RegisterTaskSpec adds or replaces the spec of a task type. It panics for
+// a control type that declares a payload.
+func RegisterTaskSpec(spec TaskSpec) {
+	if spec.Control && spec.NewPayload != nil {
+		panic(fmt.Sprintf("control task type %s must not declare a payload", spec.Type))
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[spec.Type] = spec
+}
+
+// LookupTaskSpec returns the spec registered for a task type
+func LookupTaskSpec(taskType string) (TaskSpec, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	spec, ok := registry[taskType]
+	return spec, ok
+}
+
+// IsControl reports whether taskType is registered as a control task
+func IsControl(taskType string) bool {
+	spec, ok := LookupTaskSpec(taskType)
+	return ok && spec.Control
+}
+
+// TaskSpecs returns all registered specs sorted by type
+func TaskSpecs() []TaskSpec {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	specs := make([]TaskSpec, 0, len(registry))
+	for _, spec := range registry {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Type < specs[j].Type })
+	return specs
+}
+
+// ValidatePayload checks that payload decodes into the registered payload type
+// of taskType without unknown fields
+func ValidatePayload(taskType string, payload []byte) error {
+	spec, ok := LookupTaskSpec(taskType)
+	if !ok || spec.NewPayload == nil {
+		return fmt.Errorf("no payload type registered for %s", taskType)
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(spec.NewPayload()); err != nil {
+		return fmt.Errorf("invalid %s payload: %v", taskType, err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/artifacts"
+	"asynqdemo/stats"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultResultTTL is how long task results are kept unless TASK_RESULT_TTL
+// says otherwise
+const DefaultResultTTL = 24 * time.Hour
+
+var (
+	// ErrResultNotReady is returned for a task that has not completed yet
+	ErrResultNotReady = errors.New("task result not ready")
+	// ErrResultNotFound is returned for a task without a result: unknown,
+	// completed without writing one, or whose result expired
+	ErrResultNotFound = errors.New("task result not found")
+)
+
+func resultKey(taskID string) string {
+	return "task:result:" + taskID
+}
+
+// WelcomeResult is the result of welcome message tasks
+type WelcomeResult struct {
+	UserID    int       `json:"user_id"`
+	Greeting  string    `json:"greeting"`
+	GreetedAt time.Time `json:"greeted_at"`
+}
+
+// EmailResult is the result of email tasks
+type EmailResult struct {
+	Email   string    `json:"email"`
+	Subject string    `json:"subject"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// ServerInfoResult is the result of server info tasks; Artifacts lists the
+// stored report when artifacts are enabled
+type ServerInfoResult struct {
+	CollectedAt time.Time `json:"collected_at"`
+	NumCPU      int       `json:"num_cpu"`
+	Goroutines  int       `json:"goroutines"`
+	AllocBytes  uint64    `json:"alloc_bytes"`
+	HeapAlloc   uint64    `json:"heap_alloc"`
+	NumGC       uint32    `json:"num_gc"`
+	// Breaches lists the stats thresholds exceeded
+	Breaches  []stats.Breach  `json:"breaches,omitempty"`
+	Artifacts []artifacts.Ref `json:"artifacts,omitempty"`
+}
+
+// ResultWriter writes the result of the task being processed to asynq's
+// task hash and to a copy kept for the result TTL, so the result outlives
+// a task enqueued without retention
+type ResultWriter struct {
+	rdb  redis.UniversalClient
+	ttl  time.Duration
+	id   string
+	task *asynq.ResultWriter
+}
+
+// TaskID returns the ID of the task the writer writes the result of
+func (w *ResultWriter) TaskID() string {
+	return w.id
+}
+
+// Write replaces the result with p
+func (w *ResultWriter) Write(p []byte) (int, error) {
+	if w.task != nil {
+		if _, err := w.task.Write(p); err != nil {
+			return 0, fmt.Errorf("failed to write result of task %s: %v", w.id, err)
+		}
+	}
+	if err := w.store(context.Background(), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// store writes the copy of the result
+func (w *ResultWriter) store(ctx context.Context, result []byte) error {
+	if err := w.rdb.Set(ctx, resultKey(w.id), result, w.ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store result of task %s: %v", w.id, err)
+	}
+	return nil
+}
+
+type resultWriterKey struct{}
+
+// GetResultWriter returns the result writer of the task being processed
+func GetResultWriter(ctx context.Context) (*ResultWriter, bool) {
+	w, ok := ctx.Value(resultWriterKey{}).(*ResultWriter)
+	return w, ok
+}
+
+// ResultWriterMiddleware hands every task a ResultWriter keeping results
+// for ttl. Install it before the metadata middleware, whose unwrapped task
+// has no asynq ResultWriter.
+func ResultWriterMiddleware(rdb redis.UniversalClient, ttl time.Duration) asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			id, ok := asynq.GetTaskID(ctx)
+			if !ok {
+				return next.ProcessTask(ctx, t)
+			}
+			w := &ResultWriter{rdb: rdb, ttl: ttl, id: id, task: t.ResultWriter()}
+			return next.ProcessTask(context.WithValue(ctx, resultWriterKey{}, w), t)
+		})
+	}
+}
+
+// WriteResult commits v as the JSON result of the task, see CommitResult
+func WriteResult(ctx context.Context, v interface{}) error {
+	result, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task result: %v", err)
+	}
+	return CommitResult(ctx, result)
+}
+
+// ResultStore reads the results handlers wrote, for the enqueuing side
+type ResultStore struct {
+	rdb       redis.UniversalClient
+	inspector *asynq.Inspector
+}
+
+// NewResultStore creates a store reading results from rdb and task states
+// from inspector
+func NewResultStore(rdb redis.UniversalClient, inspector *asynq.Inspector) *ResultStore {
+	return &ResultStore{rdb: rdb, inspector: inspector}
+}
+
+// ReadResult returns the result of a task, ErrResultNotReady while it has
+// not completed and ErrResultNotFound when there is none
+func (s *ResultStore) ReadResult(taskID string) ([]byte, error) {
+	result, err := s.rdb.Get(context.Background(), resultKey(taskID)).Bytes()
+	if err == nil {
+		return result, nil
+	}
+	if err != redis.Nil {
+		return nil, fmt.Errorf("failed to read result of task %s: %v", taskID, err)
+	}
+	// No result stored: the task's state tells whether one is to come
+	queues, err := s.inspector.Queues()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues: %v", err)
+	}
+	for _, q := range queues {
+		info, err := s.inspector.GetTaskInfo(q, taskID)
+		if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read task %s: %v", taskID, err)
+		}
+		switch info.State {
+		case asynq.TaskStateCompleted:
+			return nil, ErrResultNotFound
+		case asynq.TaskStateArchived:
+			return nil, fmt.Errorf("%w: task %s was archived: %s", ErrResultNotFound, taskID, info.LastErr)
+		default:
+			return nil, ErrResultNotReady
+		}
+	}
+	return nil, ErrResultNotFound
+}
+
+// ReadResultInto decodes the result of a task into v, see ReadResult
+func (s *ResultStore) ReadResultInto(taskID string, v interface{}) error {
+	result, err := s.ReadResult(taskID)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(result, v); err != nil {
+		return fmt.Errorf("invalid result of task %s: %v", taskID, err)
+	}
+	return nil
+}
+
+// ResultHandler serves GET /admin/results/{id}, the result of a task
+func ResultHandler(s *ResultStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seg := admin.PathSegments(r, "/admin/results/")
+		if len(seg) != 1 {
+			admin.WriteError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		result, err := s.ReadResult(seg[0])
+		switch {
+		case errors.Is(err, ErrResultNotReady):
+			admin.WriteError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, ErrResultNotFound):
+			admin.WriteError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+		default:
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"id": seg[0], "result": json.RawMessage(result)})
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package common_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/common/clock"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestTaskResults processes welcome, email and server info tasks through
+// a worker with the result middleware on an embedded Redis. It fails
+// unless each handler's typed result reads back, also for tasks without
+// retention and those answered by ExactlyOnce, a scheduled task reports
+// ErrResultNotReady, results are gone once their TTL expires, and handlers
+// stamp their results with the clock of their Deps.
+func TestTaskResults(t *testing.T) {
+	const ttl = 2 * time.Second
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+
+	// The handlers wait on the fake clock; finished receives the ID of every
+	// task they returned from, its result written
+	fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	finished := make(chan string, 8)
+	mux := asynq.NewServeMux()
+	mux.Use(func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			err := next.ProcessTask(ctx, t)
+			id, _ := asynq.GetTaskID(ctx)
+			finished <- id
+			return err
+		})
+	}, common.ResultWriterMiddleware(rdb, ttl), common.ExactlyOnce(rdb))
+	mux.HandleFunc(common.TypeWelcomeMessage, func(ctx context.Context, t *asynq.Task) error {
+		var p common.WelcomePayload
+		if err := json.Unmarshal(t.Payload(), &p); err != nil {
+			return err
+		}
+		return common.HandleWelcomeTask(ctx, &p)
+	})
+	mux.HandleFunc(common.TypeEmailTask, func(ctx context.Context, t *asynq.Task) error {
+		var p common.EmailPayload
+		if err := json.Unmarshal(t.Payload(), &p); err != nil {
+			return err
+		}
+		return common.HandleEmailTask(ctx, &p)
+	})
+	mux.HandleFunc(common.TypeServerInfo, func(ctx context.Context, t *asynq.Task) error {
+		var p common.ServerInfoPayload
+		if err := json.Unmarshal(t.Payload(), &p); err != nil {
+			return err
+		}
+		return common.HandleServerInfoTask(ctx, &p)
+	})
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{
+		Concurrency: 4,
+		Queues:      map[string]int{"default": 1},
+		LogLevel:    asynq.WarnLevel,
+		BaseContext: func() context.Context {
+			return common.WithDeps(context.Background(), common.Deps{Clock: fake})
+		},
+	})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	store := common.NewResultStore(rdb, inspector)
+
+	if _, err := store.ReadResult("no-such-task"); !errors.Is(err, common.ErrResultNotFound) {
+		t.Errorf("unknown task gave %v, want ErrResultNotFound", err)
+	}
+	later, err := client.Enqueue(asynq.NewTask(common.TypeWelcomeMessage, []byte(`{"user_id":9,"username":"later"}`)), asynq.ProcessIn(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadResult(later.ID); !errors.Is(err, common.ErrResultNotReady) {
+		t.Errorf("scheduled task gave %v, want ErrResultNotReady", err)
+	}
+
+	// The welcome task keeps no retention: only the copy holds its result
+	enqueue := func(taskType, payload string, opts ...asynq.Option) string {
+		t.Helper()
+		info, err := client.Enqueue(asynq.NewTask(taskType, []byte(payload)), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ID
+	}
+	welcome := enqueue(common.TypeWelcomeMessage, `{"user_id":7,"username":"ada"}`)
+	email := enqueue(common.TypeEmailTask, `{"user_id":7,"email":"ada@example.com","subject":"Hi","message":"Hello"}`, asynq.Retention(time.Hour))
+	info := enqueue(common.TypeServerInfo, `{"timestamp":1,"source":"results"}`, asynq.Retention(time.Hour))
+
+	done := map[string]bool{}
+	read := func(id string, v interface{}) {
+		t.Helper()
+		for !done[id] {
+			select {
+			case got := <-finished:
+				done[got] = true
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for task %s", id)
+			}
+		}
+		if err := store.ReadResultInto(id, v); err != nil {
+			t.Fatalf("result of %s: %v", id, err)
+		}
+	}
+	// The server info handler does not wait, the welcome and email ones
+	// finish once the clock passed their delays
+	start := fake.Now()
+	var s common.ServerInfoResult
+	read(info, &s)
+	if s.NumCPU == 0 || !s.CollectedAt.Equal(start) {
+		t.Errorf("server info result %+v, want it collected at %v", s, start)
+	}
+	waitFor(t, "the welcome and email handlers", func() bool { return fake.Pending() == 2 })
+	fake.Advance(time.Second)
+	var w common.WelcomeResult
+	read(welcome, &w)
+	if w.UserID != 7 || w.Greeting == "" || !w.GreetedAt.Equal(fake.Now()) {
+		t.Errorf("welcome result %+v, want it greeted at %v", w, fake.Now())
+	}
+	var e common.EmailResult
+	read(email, &e)
+	if e.Email != "ada@example.com" || e.Subject == "" || !e.SentAt.Equal(fake.Now()) {
+		t.Errorf("email result %+v, want it sent at %v", e, fake.Now())
+	}
+	if task, err := inspector.GetTaskInfo("default", email); err != nil || !json.Valid(task.Result) {
+		t.Errorf("email result is not in asynq's task hash: %v", err)
+	}
+
+	// A redelivered email is answered from the marker with the same result
+	if err := rdb.Set(context.Background(), "task:{default}:done:"+email+"-again", `{"email":"ada@example.com"}`, time.Hour).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Enqueue(asynq.NewTask(common.TypeEmailTask, []byte(`{"user_id":7,"email":"other@example.com"}`)), asynq.TaskID(email+"-again")); err != nil {
+		t.Fatal(err)
+	}
+	var again common.EmailResult
+	read(email+"-again", &again)
+	if again.Email != "ada@example.com" {
+		t.Errorf("redelivered email result %+v, want the committed one", again)
+	}
+
+	srv.FastForward(ttl + time.Second)
+	if _, err := store.ReadResult(email); !errors.Is(err, common.ErrResultNotFound) {
+		t.Errorf("result past its TTL gave %v, want ErrResultNotFound", err)
+	}
+	if _, err := store.ReadResult(welcome); !errors.Is(err, common.ErrResultNotFound) {
+		t.Errorf("welcome result past its TTL gave %v, want ErrResultNotFound", err)
+	}
+}
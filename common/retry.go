@@ -0,0 +1,181 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// RetryPolicy retries the tasks of a type with exponential backoff: retry n
+// (from 0) waits InitialDelay*Multiplier^n, at most MaxDelay
+type RetryPolicy struct {
+	MaxRetries int `json:"max_retries"`
+	// InitialDelay is the wait before the first retry, 1s when zero
+	InitialDelay time.Duration `json:"initial_delay,omitempty"`
+	// Multiplier grows the delay per retry; below 1 keeps it constant
+	Multiplier float64 `json:"multiplier,omitempty"`
+	// MaxDelay caps a single delay; zero leaves it uncapped
+	MaxDelay time.Duration `json:"max_delay,omitempty"`
+	// Jitter waits a random delay between half and all of the computed
+	// one, so tasks failing together do not retry together
+	Jitter bool `json:"jitter,omitempty"`
+	// MaxTotal caps the sum of the delays: retries that would start after
+	// it are dropped from MaxRetries. Zero leaves it uncapped.
+	MaxTotal time.Duration `json:"max_total,omitempty"`
+}
+
+// KeyRetryPolicy is the metadata attribute holding the JSON retry policy a
+// task carries, see WithRetryPolicy
+const KeyRetryPolicy = "retry_policy"
+
+// backoff is the delay of retry n before jitter
+func (p RetryPolicy) backoff(n int) time.Duration {
+	initial := p.InitialDelay
+	if initial <= 0 {
+		initial = time.Second
+	}
+	mult := math.Max(p.Multiplier, 1)
+	d := float64(initial) * math.Pow(mult, float64(n))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// Delay returns how long retry n (from 0) waits
+func (p RetryPolicy) Delay(n int) time.Duration {
+	d := p.backoff(n)
+	if p.Jitter && d > 1 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	return d
+}
+
+// Retries returns MaxRetries, less the retries that MaxTotal leaves no
+// time for
+func (p RetryPolicy) Retries() int {
+	if p.MaxTotal <= 0 {
+		return p.MaxRetries
+	}
+	var total time.Duration
+	for n := 0; n < p.MaxRetries; n++ {
+		if total += p.backoff(n); total > p.MaxTotal {
+			return n
+		}
+	}
+	return p.MaxRetries
+}
+
+func (p RetryPolicy) String() string {
+	s := fmt.Sprintf("%d retries from %v x%g", p.Retries(), p.backoff(0), math.Max(p.Multiplier, 1))
+	if p.MaxDelay > 0 {
+		s += fmt.Sprintf(" up to %v", p.MaxDelay)
+	}
+	if p.MaxTotal > 0 {
+		s += fmt.Sprintf(" within %v", p.MaxTotal)
+	}
+	if p.Jitter {
+		s += " with jitter"
+	}
+	return s
+}
+
+// MaxRetryOf is the MaxRetry option of p. It does not set the delays,
+// which the server's RetryDelay takes from the policy registered for the
+// type; use WithRetryPolicy for a policy the type is not registered with.
+func MaxRetryOf(p RetryPolicy) asynq.Option {
+	return asynq.MaxRetry(p.Retries())
+}
+
+// WithRetryPolicy returns a copy of t carrying p in its metadata and the
+// MaxRetry option of p to enqueue it with. RetryDelay waits p's delays for
+// the task whatever policy its type is registered with. The payload of t
+// must be JSON.
+func WithRetryPolicy(t *asynq.Task, p RetryPolicy) (*asynq.Task, asynq.Option, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal retry policy: %v", err)
+	}
+	t, err = metadata.With(t, metadata.Metadata{KeyRetryPolicy: string(data)})
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, MaxRetryOf(p), nil
+}
+
+// carriedRetryPolicy returns the policy t carries, nil when it has none
+func carriedRetryPolicy(t *asynq.Task) *RetryPolicy {
+	data, ok := metadata.FromTask(t)[KeyRetryPolicy]
+	if !ok {
+		return nil
+	}
+	var p RetryPolicy
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		log.Printf("⚠️  Ignoring malformed retry policy of %s task: %v", t.Type(), err)
+		return nil
+	}
+	return &p
+}
+
+// EnqueueOptions returns the retry option of taskType's policy, if it has
+// one, followed by opts, which win over it
+func EnqueueOptions(taskType string, opts ...asynq.Option) []asynq.Option {
+	spec, ok := LookupTaskSpec(taskType)
+	if !ok || spec.RetryPolicy == nil {
+		return opts
+	}
+	return append([]asynq.Option{MaxRetryOf(*spec.RetryPolicy)}, opts...)
+}
+
+// RegisteredRetryPolicy returns the retry policy registered for taskType,
+// nil when it has none
+func RegisteredRetryPolicy(taskType string) *RetryPolicy {
+	spec, ok := LookupTaskSpec(taskType)
+	if !ok {
+		return nil
+	}
+	return spec.RetryPolicy
+}
+
+// PolicyRetryDelay returns a Config.RetryDelayFunc waiting the delay of the
+// retry policy the task carries or, without one, the policy policyOf
+// returns for the task's type, and fallback's for types without one
+func PolicyRetryDelay(policyOf func(taskType string) *RetryPolicy, fallback asynq.RetryDelayFunc) asynq.RetryDelayFunc {
+	return func(n int, err error, t *asynq.Task) time.Duration {
+		p := carriedRetryPolicy(t)
+		if p == nil {
+			p = policyOf(t.Type())
+		}
+		if p == nil {
+			return fallback(n, err, t)
+		}
+		return p.Delay(n)
+	}
+}
+
+// RetryDelay is the PolicyRetryDelay of the registered policies. Each retry
+// under a policy is logged.
+func RetryDelay(fallback asynq.RetryDelayFunc) asynq.RetryDelayFunc {
+	delay := PolicyRetryDelay(RegisteredRetryPolicy, fallback)
+	return func(n int, err error, t *asynq.Task) time.Duration {
+		d := delay(n, err, t)
+		p := carriedRetryPolicy(t)
+		if p == nil {
+			p = RegisteredRetryPolicy(t.Type())
+		}
+		if p != nil {
+			log.Printf("⚠️  Retrying %s task (attempt %d of %d) in %v: %v", t.Type(), n+1, p.Retries(), d, err)
+		}
+		return d
+	}
+}
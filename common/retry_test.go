@@ -0,0 +1,136 @@
+package common_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestRetryPolicy fails unless a retry policy backs off exponentially
+// up to its maximum delay, keeps jittered delays between half and all of
+// the computed one, drops the retries its total cap leaves no time for,
+// and is applied by EnqueueOptions and RetryDelay to the types registered
+// with it only, with the caller's options winning.
+func TestRetryPolicy(t *testing.T) {
+	p := common.RetryPolicy{MaxRetries: 8, InitialDelay: time.Second, Multiplier: 2, MaxDelay: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for n, d := range want {
+		if got := p.Delay(n); got != d {
+			t.Errorf("delay of retry %d: %v, want %v", n, got, d)
+		}
+	}
+	if p.Retries() != 8 {
+		t.Errorf("uncapped policy allows %d retries, want 8", p.Retries())
+	}
+	// 1+2+4+8 = 15s fit in 20s, the fifth retry would start after 25s
+	p.MaxTotal = 20 * time.Second
+	if p.Retries() != 4 {
+		t.Errorf("policy within %v allows %d retries, want 4", p.MaxTotal, p.Retries())
+	}
+	if opt := common.MaxRetryOf(p); opt.Type() != asynq.MaxRetryOpt || opt.Value().(int) != 4 {
+		t.Errorf("MaxRetryOf gave %v, want MaxRetry(4)", opt)
+	}
+
+	p.Jitter = true
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(3); d < 4*time.Second || d > 8*time.Second {
+			t.Fatalf("jittered delay %v outside [4s, 8s]", d)
+		}
+	}
+	constant := common.RetryPolicy{MaxRetries: 3, InitialDelay: 5 * time.Second}
+	if constant.Delay(2) != 5*time.Second {
+		t.Errorf("policy without multiplier waits %v on retry 2, want 5s", constant.Delay(2))
+	}
+
+	// The server waits the policy's delay for registered types only
+	fallback := func(n int, err error, task *asynq.Task) time.Duration { return time.Hour }
+	delay := common.RetryDelay(fallback)
+	failed := errors.New("provider down")
+	for n := 0; n < common.EmailRetryPolicy.Retries(); n++ {
+		d := delay(n, failed, asynq.NewTask(common.TypeEmailTask, nil))
+		if max := common.EmailRetryPolicy.MaxDelay; d <= 0 || d > max {
+			t.Errorf("email retry %d waits %v, want up to %v", n, d, max)
+		}
+	}
+	if d := delay(0, failed, asynq.NewTask(common.TypeServerInfo, nil)); d != time.Hour {
+		t.Errorf("type without policy waits %v, want the fallback's hour", d)
+	}
+
+	// Enqueued tasks carry the retry count of their type's policy
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	enqueue := func(taskType string, opts ...asynq.Option) int {
+		t.Helper()
+		info, err := client.Enqueue(asynq.NewTask(taskType, []byte(`{}`)), common.EnqueueOptions(taskType, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.MaxRetry
+	}
+	if got := enqueue(common.TypeEmailTask); got != common.EmailRetryPolicy.Retries() {
+		t.Errorf("email enqueued with %d retries, want %d", got, common.EmailRetryPolicy.Retries())
+	}
+	if got := enqueue(common.TypeWelcomeMessage); got != common.WelcomeRetryPolicy.Retries() {
+		t.Errorf("welcome enqueued with %d retries, want %d", got, common.WelcomeRetryPolicy.Retries())
+	}
+	if got := enqueue(common.TypeEmailTask, asynq.MaxRetry(1)); got != 1 {
+		t.Errorf("email with MaxRetry(1) enqueued with %d retries, want the caller's 1", got)
+	}
+	if got := enqueue(common.TypeServerInfo); got != 25 {
+		t.Errorf("type without policy enqueued with %d retries, want asynq's 25", got)
+	}
+}
+
+// TestCarriedRetryPolicy fails unless a task enqueued with WithRetryPolicy
+// waits its policy's delays and retry count though its type is registered
+// with none, as the server sees the task read back from Redis.
+func TestCarriedRetryPolicy(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	p := common.RetryPolicy{MaxRetries: 3, InitialDelay: 7 * time.Second, Multiplier: 3}
+	task, opt, err := common.WithRetryPolicy(asynq.NewTask("report:unregistered", []byte(`{"id":1}`)), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := client.Enqueue(task, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MaxRetry != 3 {
+		t.Errorf("enqueued with %d retries, want the policy's 3", info.MaxRetry)
+	}
+	stored, err := inspector.GetTaskInfo(info.Queue, info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fallback := func(n int, err error, task *asynq.Task) time.Duration { return time.Hour }
+	delay := common.RetryDelay(fallback)
+	failed := errors.New("provider down")
+	for n, want := range []time.Duration{7 * time.Second, 21 * time.Second, 63 * time.Second} {
+		if d := delay(n, failed, asynq.NewTask(stored.Type, stored.Payload)); d != want {
+			t.Errorf("retry %d waits %v, want the carried policy's %v", n, d, want)
+		}
+	}
+	if d := delay(0, failed, asynq.NewTask("report:unregistered", []byte(`{"id":1}`))); d != time.Hour {
+		t.Errorf("task without a carried policy waits %v, want the fallback's hour", d)
+	}
+}
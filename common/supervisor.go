@@ -0,0 +1,207 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"asynqdemo/common/clock"
+)
+
+// Component is a long-running part of the worker. Run blocks until ctx is
+// done or the component fails; returning after ctx is done is a clean stop.
+type Component interface {
+	Run(ctx context.Context) error
+}
+
+// ComponentFunc adapts a function to Component
+type ComponentFunc func(ctx context.Context) error
+
+// Run calls f
+func (f ComponentFunc) Run(ctx context.Context) error { return f(ctx) }
+
+// RestartPolicy decides whether a component that returned is run again
+type RestartPolicy int
+
+const (
+	// RestartNever runs the component once
+	RestartNever RestartPolicy = iota
+	// RestartOnError restarts the component when it fails or panics
+	RestartOnError
+	// RestartAlways restarts the component whenever it returns
+	RestartAlways
+)
+
+func (p RestartPolicy) String() string {
+	switch p {
+	case RestartNever:
+		return "never"
+	case RestartOnError:
+		return "on-error"
+	case RestartAlways:
+		return "always"
+	}
+	return fmt.Sprintf("RestartPolicy(%d)", int(p))
+}
+
+type supervised struct {
+	name      string
+	component Component
+	policy    RestartPolicy
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// Supervisor runs components in registration order, restarts them according
+// to their policy and stops them in reverse order
+type Supervisor struct {
+	// DrainTimeout bounds the whole shutdown
+	DrainTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the delay before a restart, which doubles
+	// with every consecutive failure
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// A component failing CrashLoopLimit times within CrashLoopWindow is not
+	// restarted any more
+	CrashLoopLimit  int
+	CrashLoopWindow time.Duration
+	// Clock times restarts and the drain timeout
+	Clock clock.Clock
+
+	mu         sync.Mutex
+	components []*supervised
+	started    bool
+}
+
+// NewSupervisor creates a supervisor that gives components drainTimeout to stop
+func NewSupervisor(drainTimeout time.Duration) *Supervisor {
+	return &Supervisor{
+		DrainTimeout:    drainTimeout,
+		MinBackoff:      time.Second,
+		MaxBackoff:      time.Minute,
+		CrashLoopLimit:  5,
+		CrashLoopWindow: 5 * time.Minute,
+		Clock:           clock.Real(),
+	}
+}
+
+// Add registers a component. Components must be added before Start.
+func (s *Supervisor) Add(name string, policy RestartPolicy, c Component) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		panic(fmt.Sprintf("component %s added after the supervisor started", name))
+	}
+	s.components = append(s.components, &supervised{name: name, component: c, policy: policy, done: make(chan struct{})})
+}
+
+// Start runs every component in registration order until ctx is done or
+// Shutdown is called
+func (s *Supervisor) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = true
+	for _, c := range s.components {
+		var cctx context.Context
+		cctx, c.cancel = context.WithCancel(ctx)
+		go s.supervise(cctx, c)
+	}
+}
+
+// Shutdown stops the components in reverse registration order, waiting for
+// each to return before stopping the previous one. Components still running
+// when the drain timeout expires are abandoned.
+func (s *Supervisor) Shutdown() error {
+	s.mu.Lock()
+	components := s.components
+	s.mu.Unlock()
+
+	deadline := s.Clock.NewTimer(s.DrainTimeout)
+	defer deadline.Stop()
+	for i := len(components) - 1; i >= 0; i-- {
+		c := components[i]
+		if c.cancel == nil {
+			continue
+		}
+		c.cancel()
+		select {
+		case <-c.done:
+		case <-deadline.C():
+			var abandoned []string
+			for j := i; j >= 0; j-- {
+				if components[j].cancel == nil {
+					continue
+				}
+				components[j].cancel()
+				select {
+				case <-components[j].done:
+				default:
+					abandoned = append(abandoned, components[j].name)
+				}
+			}
+			return fmt.Errorf("drain timeout of %v expired with %v still running", s.DrainTimeout, abandoned)
+		}
+	}
+	return nil
+}
+
+// supervise runs c until its policy or the crash-loop breaker says to stop
+func (s *Supervisor) supervise(ctx context.Context, c *supervised) {
+	defer close(c.done)
+	var crashes []time.Time
+	backoff := s.MinBackoff
+	for {
+		started := s.Clock.Now()
+		err := runSafely(ctx, c.component)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err == nil && c.policy != RestartAlways:
+			return
+		case err != nil && c.policy == RestartNever:
+			log.Printf("❌ Component %s failed: %v", c.name, err)
+			return
+		case err != nil:
+			log.Printf("❌ Component %s failed: %v", c.name, err)
+		}
+
+		// A run outlasting the crash window counts as recovered
+		now := s.Clock.Now()
+		if now.Sub(started) > s.CrashLoopWindow {
+			backoff = s.MinBackoff
+		}
+		if err != nil {
+			crashes = append(crashes, now)
+			for len(crashes) > 0 && now.Sub(crashes[0]) > s.CrashLoopWindow {
+				crashes = crashes[1:]
+			}
+			if len(crashes) >= s.CrashLoopLimit {
+				log.Printf("❌ Component %s failed %d times within %v, not restarting it", c.name, len(crashes), s.CrashLoopWindow)
+				return
+			}
+		}
+
+		log.Printf("⚠️  Restarting component %s in %v", c.name, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.Clock.After(backoff):
+		}
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// runSafely runs c, turning a panic into an error
+func runSafely(ctx context.Context, c Component) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.Run(ctx)
+}
@@ -0,0 +1,199 @@
+package common_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/common/clock"
+)
+
+// waitFor polls cond for up to 5s
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the log output of the supervisor's
+// goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestSupervisorRestarts fails unless a failing component is restarted
+// after a backoff doubling on the supervisor's clock, a crash loop stops
+// the restarts, and shutdown stops components in reverse order.
+func TestSupervisorRestarts(t *testing.T) {
+	var logs syncBuffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+	fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	s := common.NewSupervisor(time.Second)
+	s.Clock = fake
+	s.MinBackoff, s.MaxBackoff = time.Minute, time.Hour
+	s.CrashLoopLimit = 3
+
+	var runs atomic.Int32
+	s.Add("flaky", common.RestartOnError, common.ComponentFunc(func(ctx context.Context) error {
+		runs.Add(1)
+		return errors.New("boom")
+	}))
+	var mu sync.Mutex
+	var stopped []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		s.Add(name, common.RestartNever, common.ComponentFunc(func(ctx context.Context) error {
+			<-ctx.Done()
+			mu.Lock()
+			stopped = append(stopped, name)
+			mu.Unlock()
+			return nil
+		}))
+	}
+	s.Start(context.Background())
+
+	waitFor(t, "the first run", func() bool { return runs.Load() == 1 && fake.Pending() == 1 })
+	// The backoff timer still pending, no restart can have started
+	fake.Advance(59 * time.Second)
+	if runs.Load() != 1 || fake.Pending() != 1 {
+		t.Fatalf("restarted before the 1m backoff")
+	}
+	fake.Advance(time.Second)
+	waitFor(t, "the restart after 1m", func() bool { return runs.Load() == 2 && fake.Pending() == 1 })
+	// The backoff doubled
+	fake.Advance(time.Minute)
+	if runs.Load() != 2 || fake.Pending() != 1 {
+		t.Fatalf("restarted after 1m, want 2m")
+	}
+	fake.Advance(time.Minute)
+	// The third failure within the window ends the crash loop
+	waitFor(t, "the crash loop to end", func() bool { return strings.Contains(logs.String(), "flaky failed 3 times") })
+	if runs.Load() != 3 || fake.Pending() != 0 {
+		t.Errorf("a restart is pending after %d failures", runs.Load())
+	}
+
+	if err := s.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stopped) != 2 || stopped[0] != "second" || stopped[1] != "first" {
+		t.Errorf("stopped %v, want second before first", stopped)
+	}
+}
+
+// TestSupervisorPolicies fails unless a panic is restarted like an error,
+// RestartAlways restarts a component that returned cleanly while
+// RestartOnError does not, a failing RestartNever component stays down,
+// and the restart backoff stops doubling at MaxBackoff.
+func TestSupervisorPolicies(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	s := common.NewSupervisor(time.Second)
+	s.Clock = fake
+	s.MinBackoff, s.MaxBackoff = time.Minute, 2*time.Minute
+	s.CrashLoopLimit = 100
+
+	var panics, always, clean, never atomic.Int32
+	s.Add("panics", common.RestartOnError, common.ComponentFunc(func(ctx context.Context) error {
+		panics.Add(1)
+		panic("boom")
+	}))
+	s.Add("always", common.RestartAlways, common.ComponentFunc(func(ctx context.Context) error {
+		always.Add(1)
+		return nil
+	}))
+	s.Add("clean", common.RestartOnError, common.ComponentFunc(func(ctx context.Context) error {
+		clean.Add(1)
+		return nil
+	}))
+	s.Add("never", common.RestartNever, common.ComponentFunc(func(ctx context.Context) error {
+		never.Add(1)
+		return errors.New("boom")
+	}))
+	s.Start(context.Background())
+	defer s.Shutdown()
+
+	// panics and always wait out their first backoff of 1m
+	waitFor(t, "the first runs", func() bool { return panics.Load() == 1 && always.Load() == 1 && fake.Pending() == 2 })
+	fake.Advance(time.Minute)
+	waitFor(t, "the restarts after 1m", func() bool { return panics.Load() == 2 && always.Load() == 2 && fake.Pending() == 2 })
+	fake.Advance(2 * time.Minute)
+	waitFor(t, "the restarts after 2m", func() bool { return panics.Load() == 3 && fake.Pending() == 2 })
+	// Capped at 2m rather than doubled to 4m
+	fake.Advance(2 * time.Minute)
+	waitFor(t, "the restarts after the capped 2m", func() bool { return panics.Load() == 4 && always.Load() == 4 })
+	if clean.Load() != 1 || never.Load() != 1 {
+		t.Errorf("clean ran %d times and never %d times, want once each", clean.Load(), never.Load())
+	}
+}
+
+// TestSupervisorDrainTimeout fails unless Shutdown gives up on a component
+// ignoring its context once the drain timeout expires, naming it, and still
+// stops the components registered before it
+func TestSupervisorDrainTimeout(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	s := common.NewSupervisor(10 * time.Second)
+	s.Clock = fake
+
+	var stopped atomic.Bool
+	s.Add("polite", common.RestartNever, common.ComponentFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		stopped.Store(true)
+		return nil
+	}))
+	release := make(chan struct{})
+	defer close(release)
+	var running atomic.Bool
+	s.Add("stuck", common.RestartNever, common.ComponentFunc(func(ctx context.Context) error {
+		running.Store(true)
+		<-release
+		return nil
+	}))
+	s.Start(context.Background())
+	waitFor(t, "the stuck component", running.Load)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown() }()
+	waitFor(t, "the drain timer", func() bool { return fake.Pending() == 1 })
+	fake.Advance(9 * time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v before the drain timeout", err)
+	default:
+	}
+	if fake.Pending() != 1 {
+		t.Fatal("drain timer fired before the drain timeout")
+	}
+	fake.Advance(time.Second)
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "stuck") {
+		t.Errorf("Shutdown gave %v, want stuck abandoned", err)
+	}
+	waitFor(t, "the polite component to stop", stopped.Load)
+}
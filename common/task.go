@@ -1,33 +1,43 @@
 package common
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"runtime"
+	"log"
+	"os"
+	"sort"
 	"time"
+
+	"asynqdemo/artifacts"
+	"asynqdemo/common/clock"
+	"asynqdemo/i18n"
+	"asynqdemo/pkg/taskclient"
+	"asynqdemo/stats"
+
+	"github.com/hibiken/asynq"
 )
 
-// Task types
+// Task types; those other services enqueue are defined in taskclient
 const (
-	TypeWelcomeMessage = "welcome:message"
-	TypeEmailTask      = "email:send"
-	TypeServerInfo     = "server:info"
+	TypeWelcomeMessage    = taskclient.TypeWelcomeMessage
+	TypeEmailTask         = taskclient.TypeEmailTask
+	TypeServerInfo        = "server:info"
+	TypePreferencesUpdate = taskclient.TypePreferencesUpdate
 )
 
-// WelcomePayload represents the payload for welcome message tasks
-type WelcomePayload struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
-	Message  string `json:"message"`
+func init() {
+	// Message keys looked up by the handlers, verified by --check-i18n
+	i18n.Use(TypeWelcomeMessage, "welcome.greeting")
+	i18n.Use(TypeEmailTask, "email.sent")
 }
 
+// WelcomePayload represents the payload for welcome message tasks
+type WelcomePayload = taskclient.WelcomePayload
+
 // EmailPayload represents the payload for email tasks
-type EmailPayload struct {
-	UserID  int    `json:"user_id"`
-	Email   string `json:"email"`
-	Subject string `json:"subject"`
-	Message string `json:"message"`
-}
+type EmailPayload = taskclient.EmailPayload
 
 // ServerInfoPayload represents the payload for server info tasks
 type ServerInfoPayload struct {
@@ -35,51 +45,158 @@ type ServerInfoPayload struct {
 	Source    string `json:"source"`
 }
 
+// NewWelcomeTask creates a welcome message task retried as WelcomeRetryPolicy
+func NewWelcomeTask(p WelcomePayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal welcome payload: %v", err)
+	}
+	return asynq.NewTask(TypeWelcomeMessage, payload, welcomeOptions...), nil
+}
+
+// NewEmailTask creates an email task on the default queue, retried as
+// EmailRetryPolicy
+func NewEmailTask(p EmailPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal email payload: %v", err)
+	}
+	return asynq.NewTask(TypeEmailTask, payload, emailOptions...), nil
+}
+
+// NewServerInfoTask creates a server info task on the low queue, never retried
+func NewServerInfoTask(p ServerInfoPayload) (*asynq.Task, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal server info payload: %v", err)
+	}
+	return asynq.NewTask(TypeServerInfo, payload, serverInfoOptions...), nil
+}
+
 // HandleWelcomeTask processes welcome message tasks
 func HandleWelcomeTask(ctx context.Context, p *WelcomePayload) error {
-	fmt.Printf("👋 [Welcome] Hello %s (ID: %d)! %s\n", p.Username, p.UserID, p.Message)
+	deps := DepsFrom(ctx)
+	greeting := deps.Catalog.Translate(ctx, p.Locale, p.TenantID, TypeWelcomeMessage, "welcome.greeting")
+	greeting = fmt.Sprintf(greeting, p.Username)
+	fmt.Printf("👋 [Welcome] %s (ID: %d)! %s\n", greeting, p.UserID, p.Message)
 	// Simulate processing time
-	time.Sleep(200 * time.Millisecond)
-	return nil
+	if err := clock.Sleep(ctx, deps.Clock, 200*time.Millisecond); err != nil {
+		return err
+	}
+	return WriteResult(ctx, WelcomeResult{UserID: p.UserID, Greeting: greeting, GreetedAt: deps.Clock.Now()})
 }
 
 // HandleEmailTask processes email sending tasks
 func HandleEmailTask(ctx context.Context, p *EmailPayload) error {
-	fmt.Printf("📧 [Email] Sending email to %s (UserID: %d)\n", p.Email, p.UserID)
-	fmt.Printf("   Subject: %s\n", p.Subject)
-	fmt.Printf("   Message: %s\n", p.Message)
-	fmt.Println("   ✅ Email sent successfully!")
+	deps := DepsFrom(ctx)
+	if p.Category == CategoryMarketing && deps.Preferences != nil {
+		optedOut, err := deps.Preferences.OptedOut(ctx, p.Email, p.Category)
+		if err != nil {
+			return fmt.Errorf("failed to check preferences of %s: %v", p.Email, err)
+		}
+		if optedOut {
+			fmt.Printf("🚫 [Email] %s unsubscribed from %s mail, skipping\n", p.Email, p.Category)
+			return nil
+		}
+	}
 
-	// Simulate processing time
-	time.Sleep(300 * time.Millisecond)
-	return nil
+	if deps.Templates != nil {
+		subject, body, err := deps.Templates.Render(ctx, p)
+		if err != nil {
+			return fmt.Errorf("failed to render email to %s: %v", p.Email, err)
+		}
+		rendered := *p
+		rendered.Subject, rendered.Message = subject, body
+		p = &rendered
+	}
+	msg := BuildEmail(p, deps.UnsubscribeURL)
+	if p.TemplateName != "" {
+		html, err := BuildHTML(deps.HTML, p, deps.UnsubscribeURL)
+		if err != nil {
+			// %w keeps asynq.SkipRetry of unknown templates
+			return fmt.Errorf("failed to render email to %s: %w", p.Email, err)
+		}
+		msg.HTML = html
+	}
+	fmt.Printf("📧 [Email] Sending email to %s (UserID: %d)\n", msg.To, p.UserID)
+	fmt.Printf("   Subject: %s\n", msg.Subject)
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("   %s: %s\n", name, msg.Headers[name])
+	}
+	fmt.Printf("   Message: %s\n", msg.Body)
+	if msg.HTML != "" {
+		fmt.Printf("   HTML: %s template, %d bytes\n", p.TemplateName, len(msg.HTML))
+	}
+
+	if deps.Mailer != nil {
+		if err := deps.Mailer.Send(ctx, msg); err != nil {
+			// %w keeps asynq.SkipRetry of permanent rejections
+			return fmt.Errorf("failed to send email to %s: %w", msg.To, err)
+		}
+	} else if err := clock.Sleep(ctx, deps.Clock, 300*time.Millisecond); err != nil {
+		// No mailer configured: simulate the time a send takes
+		return err
+	}
+	fmt.Printf("   ✅ %s\n", deps.Catalog.Translate(ctx, p.Locale, p.TenantID, TypeEmailTask, "email.sent"))
+
+	// The email is out; record it so a redelivery does not send it again
+	return WriteResult(ctx, EmailResult{Email: p.Email, Subject: msg.Subject, SentAt: deps.Clock.Now()})
 }
 
 // HandleServerInfoTask processes server info tasks and prints current server information
 func HandleServerInfoTask(ctx context.Context, p *ServerInfoPayload) error {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	fmt.Printf("🖥️  [Server Info] %s - 系统状态报告\n", time.Now().Format("2006-01-02 15:04:05"))
+	deps := DepsFrom(ctx)
+	src := deps.Stats
+	if src == nil {
+		src = stats.Runtime{}
+	}
+	now := deps.Clock.Now()
+	snap := stats.Collect(src, now)
+	fmt.Printf("🖥️  [Server Info] %s - 系统状态报告\n", now.Format("2006-01-02 15:04:05"))
 	fmt.Printf("   📅 时间戳: %d\n", p.Timestamp)
-	fmt.Printf("   🔢 CPU核心数: %d\n", runtime.NumCPU())
-	fmt.Printf("   🧵 当前Goroutines: %d\n", runtime.NumGoroutine())
-	fmt.Printf("   💾 分配内存: %.2f MB\n", float64(m.Alloc)/1024/1024)
-	fmt.Printf("   🔄 系统内存: %.2f MB\n", float64(m.Sys)/1024/1024)
-	fmt.Printf("   🗑️  GC次数: %d\n", m.NumGC)
-
-	// 避免除零错误
-	if m.NumGC > 0 {
-		fmt.Printf("   ⏱️  平均GC暂停时间: %v\n", time.Duration(m.PauseTotalNs/uint64(m.NumGC)))
-	} else {
-		fmt.Printf("   ⏱️  平均GC暂停时间: N/A\n")
-	}
-
-	fmt.Printf("   📊 堆使用: %.2f MB\n", float64(m.HeapAlloc)/1024/1024)
-	fmt.Printf("   📈 堆系统: %.2f MB\n", float64(m.HeapSys)/1024/1024)
-	fmt.Printf("   🏗️  堆对象数: %d\n", m.HeapObjects)
+	snap.WriteText(os.Stdout)
 	fmt.Printf("   📋 来源: %s\n", p.Source)
 	fmt.Println("   ✅ 服务器信息收集完成")
 
-	return nil
+	result := ServerInfoResult{
+		CollectedAt: now,
+		NumCPU:      snap.NumCPU,
+		Goroutines:  snap.Goroutines,
+		AllocBytes:  snap.AllocBytes,
+		HeapAlloc:   snap.HeapAlloc,
+		NumGC:       snap.NumGC,
+	}
+	if breaches := deps.StatsThresholds.Check(snap); len(breaches) > 0 {
+		result.Breaches = breaches
+		text := fmt.Sprintf("Server info from %s: %v", p.Source, stats.BreachError{Breaches: breaches})
+		log.Printf("⚠️  %s", text)
+		if deps.Alert != nil {
+			if err := deps.Alert(ctx, text); err != nil {
+				log.Printf("⚠️  Failed to send server info alert: %v", err)
+			}
+		}
+	}
+	if deps.Artifacts == nil {
+		return WriteResult(ctx, result)
+	}
+	// Keep the report as an artifact and list it in the task result
+	report, err := json.MarshalIndent(struct {
+		stats.Snapshot
+		Timestamp int64  `json:"timestamp"`
+		Source    string `json:"source"`
+	}{snap, p.Timestamp, p.Source}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal server info report: %v", err)
+	}
+	ref, err := deps.Artifacts.UploadForTask(ctx, "report.json", "application/json", bytes.NewReader(report), int64(len(report)))
+	if err != nil {
+		return fmt.Errorf("failed to upload server info report: %v", err)
+	}
+	result.Artifacts = []artifacts.Ref{ref}
+	return WriteResult(ctx, result)
 }
@@ -0,0 +1,80 @@
+package common_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/leak/leaktest"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestTaskConstructors fails unless the task constructors of common
+// marshal their payload and, enqueued into an embedded Redis, retry email
+// 10 times on the default queue, welcome messages 3 times and server info
+// never on the low queue; unless the enqueue options win over theirs; and
+// unless the registered default options give enveloped tasks the same.
+func TestTaskConstructors(t *testing.T) {
+	srv := leaktest.Redis(t)
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+
+	welcome, err := common.NewWelcomeTask(common.WelcomePayload{UserID: 7, Username: "ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, err := common.NewEmailTask(common.EmailPayload{UserID: 7, Email: "ada@example.com", Subject: "Hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverInfo, err := common.NewServerInfoTask(common.ServerInfoPayload{Timestamp: 1, Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p common.EmailPayload
+	if err := json.Unmarshal(email.Payload(), &p); err != nil || p.Email != "ada@example.com" || p.Subject != "Hi" {
+		t.Errorf("email payload %s: %v", email.Payload(), err)
+	}
+
+	for _, c := range []struct {
+		task     *asynq.Task
+		opts     []asynq.Option
+		queue    string
+		maxRetry int
+	}{
+		{welcome, nil, "default", 3},
+		{email, nil, "default", 10},
+		{serverInfo, nil, "low", 0},
+		// The caller's options win
+		{email, []asynq.Option{asynq.Queue("critical"), asynq.MaxRetry(2)}, "critical", 2},
+		{serverInfo, []asynq.Option{asynq.ProcessIn(time.Hour)}, "low", 0},
+	} {
+		info, err := client.Enqueue(c.task, c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Type != c.task.Type() || info.Queue != c.queue || info.MaxRetry != c.maxRetry {
+			t.Errorf("%s enqueued with %v on %s with MaxRetry %d, want %s and %d", info.Type, c.opts, info.Queue, info.MaxRetry, c.queue, c.maxRetry)
+		}
+	}
+
+	// Enveloped tasks get the same options from the registry
+	for _, taskType := range []string{common.TypeWelcomeMessage, common.TypeEmailTask, common.TypeServerInfo} {
+		spec, _ := common.LookupTaskSpec(taskType)
+		task, err := metadata.NewTask(taskType, []byte(`{}`), metadata.Metadata{}, spec.DefaultOptions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := client.Enqueue(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int{common.TypeWelcomeMessage: 3, common.TypeEmailTask: 10, common.TypeServerInfo: 0}[taskType]
+		if info.MaxRetry != want || (taskType == common.TypeServerInfo) != (info.Queue == "low") {
+			t.Errorf("enveloped %s enqueued on %s with MaxRetry %d, want %d", taskType, info.Queue, info.MaxRetry, want)
+		}
+	}
+}
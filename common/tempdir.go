@@ -0,0 +1,148 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"asynqdemo/common/clock"
+
+	"github.com/hibiken/asynq"
+)
+
+// ErrTempQuotaExceeded is returned when a write would take a task's temporary
+// directory over its quota
+var ErrTempQuotaExceeded = errors.New("task temp dir quota exceeded")
+
+// TempDirConfig configures per-task temporary directories
+type TempDirConfig struct {
+	// Root holds one directory per task attempt
+	Root string
+	// QuotaBytes caps the disk usage of one attempt's directory; 0 means unlimited
+	QuotaBytes int64
+}
+
+type tempDirKey struct{}
+
+// taskTempDir is created on first use and removed when the attempt ends
+type taskTempDir struct {
+	cfg    TempDirConfig
+	prefix string
+
+	once sync.Once
+	path string
+	err  error
+}
+
+// TempDirMiddleware gives each task attempt a temporary directory, created on
+// the first TaskTempDir call and removed when the handler returns, fails or
+// panics
+func TempDirMiddleware(cfg TempDirConfig) asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			id, _ := asynq.GetTaskID(ctx)
+			retry, _ := asynq.GetRetryCount(ctx)
+			td := &taskTempDir{cfg: cfg, prefix: fmt.Sprintf("%s-%d-", id, retry)}
+			defer td.remove()
+			return next.ProcessTask(context.WithValue(ctx, tempDirKey{}, td), t)
+		})
+	}
+}
+
+func (td *taskTempDir) remove() {
+	if td.path == "" {
+		return
+	}
+	if err := os.RemoveAll(td.path); err != nil {
+		log.Printf("⚠️  Failed to remove task temp dir %s: %v", td.path, err)
+	}
+}
+
+// TaskTempDir returns the temporary directory of the current task attempt
+func TaskTempDir(ctx context.Context) (string, error) {
+	td, ok := ctx.Value(tempDirKey{}).(*taskTempDir)
+	if !ok {
+		return "", fmt.Errorf("no task temp dir: TempDirMiddleware is not installed")
+	}
+	td.once.Do(func() {
+		if err := os.MkdirAll(td.cfg.Root, 0o755); err != nil {
+			td.err = fmt.Errorf("failed to create temp root %s: %v", td.cfg.Root, err)
+			return
+		}
+		td.path, td.err = os.MkdirTemp(td.cfg.Root, td.prefix)
+	})
+	return td.path, td.err
+}
+
+// CheckTempQuota returns ErrTempQuotaExceeded if writing n more bytes would
+// take the task's temporary directory over quota. Call it before large writes.
+func CheckTempQuota(ctx context.Context, n int64) error {
+	dir, err := TaskTempDir(ctx)
+	if err != nil {
+		return err
+	}
+	quota := ctx.Value(tempDirKey{}).(*taskTempDir).cfg.QuotaBytes
+	if quota <= 0 {
+		return nil
+	}
+	used, err := dirSize(dir)
+	if err != nil {
+		return fmt.Errorf("failed to measure %s: %v", dir, err)
+	}
+	if used+n > quota {
+		return fmt.Errorf("%w: %d used + %d requested > %d", ErrTempQuotaExceeded, used, n, quota)
+	}
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// SweepTempDirs removes task directories under root older than maxAge on c,
+// left behind by processes that crashed mid-task
+func SweepTempDirs(root string, maxAge time.Duration, c clock.Clock) (int, error) {
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read temp root %s: %v", root, err)
+	}
+	removed := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || c.Now().Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, e.Name())); err != nil {
+			log.Printf("⚠️  Failed to remove stale temp dir %s: %v", e.Name(), err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
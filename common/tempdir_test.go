@@ -0,0 +1,138 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/common/clock"
+	"asynqdemo/leak/leaktest"
+
+	"github.com/hibiken/asynq"
+)
+
+// runWithTempDir runs h through TempDirMiddleware under a recovery that
+// turns panics into errors, as the server's recovery middleware does
+func runWithTempDir(cfg common.TempDirConfig, h asynq.HandlerFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("panic")
+		}
+	}()
+	return common.TempDirMiddleware(cfg)(h).ProcessTask(context.Background(), asynq.NewTask("report:generate", nil))
+}
+
+// TestTaskTempDir fails unless writes over the quota are refused and the
+// directory of an attempt is removed whether the handler succeeds, fails or
+// panics
+func TestTaskTempDir(t *testing.T) {
+	root := leaktest.TempDir(t)
+	cfg := common.TempDirConfig{Root: root, QuotaBytes: 1000}
+	var dirs []string
+	write := func(ctx context.Context) error {
+		dir, err := common.TaskTempDir(ctx)
+		if err != nil {
+			return err
+		}
+		if again, _ := common.TaskTempDir(ctx); again != dir {
+			t.Errorf("attempt got directories %s and %s", dir, again)
+		}
+		dirs = append(dirs, dir)
+		if err := common.CheckTempQuota(ctx, 600); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, "part1"), make([]byte, 600), 0o644)
+	}
+
+	err := runWithTempDir(cfg, func(ctx context.Context, _ *asynq.Task) error {
+		if err := write(ctx); err != nil {
+			return err
+		}
+		if err := common.CheckTempQuota(ctx, 500); !errors.Is(err, common.ErrTempQuotaExceeded) {
+			t.Errorf("600 + 500 bytes of 1000 allowed: %v", err)
+		}
+		return common.CheckTempQuota(ctx, 400)
+	})
+	if err != nil {
+		t.Fatalf("writes within the quota failed: %v", err)
+	}
+	if err := runWithTempDir(cfg, func(ctx context.Context, _ *asynq.Task) error {
+		if err := write(ctx); err != nil {
+			return err
+		}
+		return errors.New("render failed")
+	}); err == nil || err.Error() != "render failed" {
+		t.Fatalf("failing handler gave %v", err)
+	}
+	if err := runWithTempDir(cfg, func(ctx context.Context, _ *asynq.Task) error {
+		if err := write(ctx); err != nil {
+			return err
+		}
+		panic("out of memory")
+	}); err == nil {
+		t.Fatal("panic not recovered")
+	}
+	if len(dirs) != 3 {
+		t.Fatalf("handlers got %d directories, want 3", len(dirs))
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s left after its attempt (%v)", dir, err)
+		}
+	}
+
+	if _, err := common.TaskTempDir(context.Background()); err == nil {
+		t.Error("temp dir given without the middleware")
+	}
+	unlimited := common.TempDirConfig{Root: root}
+	if err := runWithTempDir(unlimited, func(ctx context.Context, _ *asynq.Task) error {
+		return common.CheckTempQuota(ctx, 1<<40)
+	}); err != nil {
+		t.Errorf("write refused without a quota: %v", err)
+	}
+}
+
+// TestSweepTempDirs fails unless the startup sweep removes the directories
+// of crashed attempts older than a day and keeps newer ones and files
+func TestSweepTempDirs(t *testing.T) {
+	root := leaktest.TempDir(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for name, age := range map[string]time.Duration{"stale": 25 * time.Hour, "recent": 23 * time.Hour, "note.txt": 48 * time.Hour} {
+		path := filepath.Join(root, name)
+		var err error
+		if filepath.Ext(name) == "" {
+			err = os.MkdirAll(filepath.Join(path, "nested"), 0o755)
+		} else {
+			err = os.WriteFile(path, nil, 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := common.SweepTempDirs(root, 24*time.Hour, clock.NewFake(now))
+	if err != nil || removed != 1 {
+		t.Fatalf("removed %d (%v), want the stale directory", removed, err)
+	}
+	entries, _ := os.ReadDir(root)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if len(left) != 2 || left[0] != "note.txt" || left[1] != "recent" {
+		t.Errorf("left %v, want note.txt and recent", left)
+	}
+	os.RemoveAll(filepath.Join(root, "recent"))
+	os.Remove(filepath.Join(root, "note.txt"))
+
+	if n, err := common.SweepTempDirs(filepath.Join(root, "missing"), time.Hour, clock.NewFake(now)); err != nil || n != 0 {
+		t.Errorf("sweep of a missing root gave %d, %v", n, err)
+	}
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"asynqdemo/common/clock"
+
+	"github.com/hibiken/asynq"
+)
+
+// WithTimeout returns a wrapper giving a handler its own deadline d, below
+// the server's and the other handlers', through its context. The wrapper
+// waits for the handler to return, so asynq never retries a task whose
+// first attempt is still running. If d passed by then, it returns an error
+// wrapping context.DeadlineExceeded whatever the handler returned, so a
+// handler ignoring its context still times out. The deadline runs on the
+// clock of the handler's Deps.
+func WithTimeout(d time.Duration) func(func(context.Context, *asynq.Task) error) asynq.HandlerFunc {
+	return func(next func(context.Context, *asynq.Task) error) asynq.HandlerFunc {
+		return func(ctx context.Context, t *asynq.Task) error {
+			child, cancel := clock.WithTimeout(ctx, DepsFrom(ctx).Clock, d)
+			defer cancel()
+			err := next(child, t)
+			// Only this deadline is reported as a timeout, not the server's
+			if errors.Is(child.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+				return fmt.Errorf("%s task timed out after %v: %w", t.Type(), d, context.DeadlineExceeded)
+			}
+			return err
+		}
+	}
+}
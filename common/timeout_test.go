@@ -0,0 +1,143 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/common/clock"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestHandlerTimeout fails unless WithTimeout stops handlers watching the
+// context at their deadline on the clock of their Deps with an error
+// wrapping context.DeadlineExceeded, waits for handlers ignoring it and
+// times them out too, cancels the context of handlers that returned,
+// leaves the errors of handlers within their deadline alone, and has asynq
+// record the timeout of a worker's task while another task type keeps a
+// longer deadline.
+func TestHandlerTimeout(t *testing.T) {
+	task := asynq.NewTask("slow:task", nil)
+	fake := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	base := common.WithDeps(context.Background(), common.Deps{Clock: fake})
+
+	// A handler ignoring its context is waited for, returning early would
+	// let asynq retry the task while it still runs, and times out whatever
+	// it returns
+	for _, result := range []error{nil, errors.New("upload failed")} {
+		var sawDeadline, returned bool
+		wrapped := common.WithTimeout(100 * time.Millisecond)(func(ctx context.Context, _ *asynq.Task) error {
+			fake.Advance(300 * time.Millisecond)
+			sawDeadline = errors.Is(ctx.Err(), context.DeadlineExceeded)
+			returned = true
+			return result
+		})
+		err := wrapped(base, task)
+		if !returned || !sawDeadline {
+			t.Errorf("wrapper returned before the handler, or without its deadline passing")
+		}
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "slow:task task timed out after 100ms") {
+			t.Errorf("handler returning %v late gave %v, want the timeout", result, err)
+		}
+	}
+
+	// A handler watching its context stops when the deadline passes
+	stopped := make(chan struct{})
+	wrapped := common.WithTimeout(100 * time.Millisecond)(func(ctx context.Context, _ *asynq.Task) error {
+		defer close(stopped)
+		return clock.Sleep(ctx, fake, 2*time.Second)
+	})
+	done := make(chan error, 1)
+	go func() { done <- wrapped(base, task) }()
+	waitFor(t, "the handler and its deadline", func() bool { return fake.Pending() == 2 })
+	fake.Advance(100 * time.Millisecond)
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("context-aware handler gave %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("wrapper returned before the context-aware handler")
+	}
+
+	// Within the deadline, results pass through and the context is released
+	var handlerCtx context.Context
+	failure := errors.New("smtp down")
+	for _, want := range []error{nil, failure} {
+		wrapped = common.WithTimeout(time.Second)(func(ctx context.Context, _ *asynq.Task) error {
+			handlerCtx = ctx
+			return want
+		})
+		if err := wrapped(base, task); err != want {
+			t.Errorf("fast handler gave %v, want %v", err, want)
+		}
+		if handlerCtx.Err() == nil {
+			t.Error("context of a returned handler not cancelled")
+		}
+	}
+
+	// The deadline of the server is not reported as the handler's
+	parent, cancel := clock.WithTimeout(base, fake, 50*time.Millisecond)
+	defer cancel()
+	wrapped = common.WithTimeout(time.Second)(func(ctx context.Context, _ *asynq.Task) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	go func() { done <- wrapped(parent, task) }()
+	waitFor(t, "the server's and the handler's deadlines", func() bool { return fake.Pending() == 2 })
+	fake.Advance(50 * time.Millisecond)
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("server deadline gave %v, want context.DeadlineExceeded as is", err)
+	}
+
+	// On a worker, the slow type times out while the other keeps its longer
+	// deadline
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	sleep := func(d time.Duration) func(context.Context, *asynq.Task) error {
+		return func(ctx context.Context, _ *asynq.Task) error {
+			return clock.Sleep(ctx, fake, d)
+		}
+	}
+	mux := asynq.NewServeMux()
+	mux.Handle("slow:task", common.WithTimeout(200*time.Millisecond)(sleep(5*time.Second)))
+	mux.Handle("report:render", common.WithTimeout(5*time.Second)(sleep(500*time.Millisecond)))
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{
+		Concurrency: 2,
+		LogLevel:    asynq.FatalLevel,
+		BaseContext: func() context.Context { return base },
+	})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	slow, err := client.Enqueue(task, asynq.MaxRetry(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Enqueue(asynq.NewTask("report:render", nil), asynq.MaxRetry(0), asynq.Retention(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// Each handler waits on its sleep and its deadline
+	waitFor(t, "both handlers", func() bool { return fake.Pending() == 4 })
+	fake.Advance(500 * time.Millisecond)
+	waitFor(t, "the tasks to finish", func() bool {
+		q, err := inspector.GetQueueInfo("default")
+		return err == nil && q.Archived == 1 && q.Completed == 1
+	})
+	if info, err := inspector.GetTaskInfo("default", slow.ID); err != nil || !strings.Contains(info.LastErr, "timed out after 200ms") {
+		t.Errorf("slow task on the worker: %+v (%v)", info, err)
+	}
+}
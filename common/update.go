@@ -0,0 +1,166 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"asynqdemo/admin"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// ErrTaskConflict is returned when a task stopped being scheduled before its
+// payload could be replaced, e.g. because a worker picked it up
+type ErrTaskConflict struct {
+	Queue string
+	ID    string
+	State string
+}
+
+func (e ErrTaskConflict) Error() string {
+	return fmt.Sprintf("task %s in queue %s is %s, not scheduled", e.ID, e.Queue, e.State)
+}
+
+// UpdateScheduledTask replaces the payload of a scheduled task with the result
+// of mutate. The task keeps its ID, queue, process time and options, and the
+// edit is recorded in its history. Enveloped metadata is preserved and mutate
+// only sees the inner payload.
+func UpdateScheduledTask(ctx context.Context, inspector *asynq.Inspector, client *asynq.Client, history *History, queue, id string, mutate func(raw []byte) ([]byte, error)) (*asynq.TaskInfo, error) {
+	info, err := inspector.GetTaskInfo(queue, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task %s: %w", id, err)
+	}
+	if info.State != asynq.TaskStateScheduled {
+		return nil, ErrTaskConflict{Queue: queue, ID: id, State: info.State.String()}
+	}
+
+	raw, md := metadata.Unwrap(info.Payload)
+	updated, err := mutate(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update payload of task %s: %v", id, err)
+	}
+	if err := ValidatePayload(info.Type, updated); err != nil {
+		return nil, err
+	}
+	payload := updated
+	if md != nil {
+		if payload, err = metadata.Wrap(updated, md); err != nil {
+			return nil, fmt.Errorf("failed to wrap payload of task %s: %v", id, err)
+		}
+	}
+
+	// Deleting fails once the task is active, which is the race to guard
+	// against; the ID is free again right after so it can be reused
+	if err := inspector.DeleteTask(queue, id); err != nil {
+		if errors.Is(err, asynq.ErrQueueNotFound) {
+			return nil, fmt.Errorf("failed to delete task %s: %w", id, err)
+		}
+		return nil, ErrTaskConflict{Queue: queue, ID: id, State: "no longer scheduled"}
+	}
+	opts := []asynq.Option{
+		asynq.TaskID(id),
+		asynq.Queue(queue),
+		asynq.ProcessAt(info.NextProcessAt),
+		asynq.MaxRetry(info.MaxRetry),
+	}
+	if info.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(info.Timeout))
+	}
+	if !info.Deadline.IsZero() {
+		opts = append(opts, asynq.Deadline(info.Deadline))
+	}
+	if info.Retention > 0 {
+		opts = append(opts, asynq.Retention(info.Retention))
+	}
+	newInfo, err := client.Enqueue(asynq.NewTask(info.Type, payload), opts...)
+	if err != nil {
+		// Put the original back so a failed edit does not lose the task
+		if _, rerr := client.Enqueue(asynq.NewTask(info.Type, info.Payload), opts...); rerr != nil {
+			log.Printf("❌ Failed to restore task %s after failed update: %v", id, rerr)
+		}
+		return nil, fmt.Errorf("failed to enqueue updated task %s: %v", id, err)
+	}
+
+	entry := HistoryEntry{At: DepsFrom(ctx).Clock.Now(), Event: "payload_updated", Detail: fmt.Sprintf("%s -> %s", raw, updated)}
+	if err := history.Record(ctx, queue, id, entry); err != nil {
+		log.Printf("⚠️  %v", err)
+	}
+	return newInfo, nil
+}
+
+// MergePatch applies a JSON merge patch (RFC 7396) to a JSON document
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	var target, p interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, fmt.Errorf("failed to parse document: %v", err)
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse merge patch: %v", err)
+	}
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// PayloadPatchHandler serves PATCH /tasks/{queue}/{id}/payload, applying the
+// request body as a JSON merge patch to a scheduled task of a known type
+func PayloadPatchHandler(inspector *asynq.Inspector, client *asynq.Client, history *History) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seg := admin.PathSegments(r, "/tasks/")
+		if len(seg) != 3 || seg[2] != "payload" {
+			admin.WriteError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodPatch {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		patch, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		info, err := UpdateScheduledTask(r.Context(), inspector, client, history, seg[0], seg[1], func(raw []byte) ([]byte, error) {
+			return MergePatch(raw, patch)
+		})
+		var conflict ErrTaskConflict
+		switch {
+		case errors.As(err, &conflict):
+			admin.WriteError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, asynq.ErrTaskNotFound), errors.Is(err, asynq.ErrQueueNotFound):
+			admin.WriteError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			admin.WriteError(w, http.StatusBadRequest, err.Error())
+		default:
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+				"id":              info.ID,
+				"queue":           info.Queue,
+				"next_process_at": info.NextProcessAt,
+				"payload":         json.RawMessage(info.Payload),
+			})
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package common_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/leak/leaktest"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestMergePatch fails unless patches follow RFC 7396: members are
+// replaced or added, nulls remove them, objects merge recursively and
+// anything else replaces the document
+func TestMergePatch(t *testing.T) {
+	for _, c := range []struct{ doc, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		got, err := common.MergePatch([]byte(c.doc), []byte(c.patch))
+		if err != nil || string(got) != c.want {
+			t.Errorf("MergePatch(%s, %s) = %s (%v), want %s", c.doc, c.patch, got, err, c.want)
+		}
+	}
+	if _, err := common.MergePatch([]byte(`{}`), []byte(`{`)); err == nil {
+		t.Error("malformed patch applied")
+	}
+}
+
+// TestPayloadPatch patches scheduled email tasks through
+// PATCH /tasks/{queue}/{id}/payload and fails unless the payload is
+// merged, metadata, process time and options are kept, the edit is in the
+// task's history, invalid results are refused with the task untouched,
+// and a task that left the scheduled state is a conflict
+func TestPayloadPatch(t *testing.T) {
+	leaktest.Check(t)
+	srv := leaktest.Redis(t)
+	r := srv.ConnOpt()
+	rdb := r.MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(r)
+	defer client.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	history := common.NewHistory(rdb)
+	h := common.PayloadPatchHandler(inspector, client, history)
+
+	payload, err := json.Marshal(common.EmailPayload{UserID: 7, Email: "ada@example.com", Subject: "Hi", Message: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := metadata.NewTask(common.TypeEmailTask, payload, metadata.Metadata{"source": "signup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	orig, err := client.Enqueue(task, asynq.ProcessAt(processAt), asynq.MaxRetry(4), asynq.Timeout(time.Minute), asynq.Retention(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := func(queue, id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/tasks/"+queue+"/"+id+"/payload", strings.NewReader(body)))
+		return w
+	}
+
+	if w := patch("default", orig.ID, `{"subject":"Welcome","locale":"de"}`); w.Code != http.StatusOK {
+		t.Fatalf("patch gave %d %s", w.Code, w.Body)
+	}
+	info, err := inspector.GetTaskInfo("default", orig.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, md := metadata.Unwrap(info.Payload)
+	var p common.EmailPayload
+	if err := json.Unmarshal(raw, &p); err != nil || p.Subject != "Welcome" || p.Locale != "de" || p.Email != "ada@example.com" || p.Message != "Hello" {
+		t.Errorf("patched payload %s (%v)", raw, err)
+	}
+	if md["source"] != "signup" {
+		t.Errorf("metadata %v lost", md)
+	}
+	if info.State != asynq.TaskStateScheduled || !info.NextProcessAt.Equal(processAt) || info.MaxRetry != 4 || info.Timeout != time.Minute || info.Retention != time.Hour {
+		t.Errorf("patched task %+v, want it scheduled at %v with its options", info, processAt)
+	}
+	entries, err := history.Entries(context.Background(), orig.Queue, orig.ID)
+	if err != nil || len(entries) != 1 || entries[0].Event != "payload_updated" || !strings.Contains(entries[0].Detail, `"subject":"Welcome"`) {
+		t.Errorf("history %+v (%v)", entries, err)
+	}
+
+	for _, body := range []string{`{"user_id":"seven"}`, `{"cc":"bob@example.com"}`, `{`} {
+		if w := patch("default", orig.ID, body); w.Code != http.StatusBadRequest {
+			t.Errorf("patch %s gave %d, want 400", body, w.Code)
+		}
+	}
+	if after, err := inspector.GetTaskInfo("default", orig.ID); err != nil || string(after.Payload) != string(info.Payload) {
+		t.Errorf("refused patch changed the task: %v", err)
+	}
+
+	if w := patch("default", "missing", `{"subject":"x"}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown task gave %d, want 404", w.Code)
+	}
+	// The task becomes due before the edit
+	if err := inspector.RunTask("default", orig.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = common.UpdateScheduledTask(context.Background(), inspector, client, history, "default", orig.ID, func(raw []byte) ([]byte, error) {
+		return common.MergePatch(raw, []byte(`{"subject":"Late"}`))
+	})
+	if conflict, ok := err.(common.ErrTaskConflict); !ok || conflict.State != "pending" {
+		t.Errorf("update of a pending task gave %v, want a conflict", err)
+	}
+	if w := patch("default", orig.ID, `{"subject":"Late"}`); w.Code != http.StatusConflict {
+		t.Errorf("patch of a pending task gave %d, want 409", w.Code)
+	}
+
+	// A worker picks the task up while the patch is applied
+	racing, err := client.Enqueue(task, asynq.Queue("race"), asynq.ProcessIn(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	worker := asynq.NewServer(r, asynq.Config{Queues: map[string]int{"race": 1}, LogLevel: asynq.FatalLevel})
+	if err := worker.Start(asynq.HandlerFunc(func(context.Context, *asynq.Task) error {
+		<-release
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	defer close(release)
+	_, err = common.UpdateScheduledTask(context.Background(), inspector, client, history, "race", racing.ID, func(raw []byte) ([]byte, error) {
+		if err := inspector.RunTask("race", racing.ID); err != nil {
+			return nil, err
+		}
+		waitFor(t, "the worker to pick the task up", func() bool {
+			info, err := inspector.GetTaskInfo("race", racing.ID)
+			return err == nil && info.State == asynq.TaskStateActive
+		})
+		return common.MergePatch(raw, []byte(`{"subject":"Raced"}`))
+	})
+	if _, ok := err.(common.ErrTaskConflict); !ok {
+		t.Errorf("update racing a worker gave %v, want a conflict", err)
+	}
+	if info, err := inspector.GetTaskInfo("race", racing.ID); err != nil || strings.Contains(string(info.Payload), "Raced") {
+		t.Errorf("raced task %+v (%v) was changed", info, err)
+	}
+}
@@ -0,0 +1,117 @@
+package concurrency
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"asynqdemo/admin"
+)
+
+// ErrAlreadyBumped is returned while an earlier bump is still in effect
+var ErrAlreadyBumped = errors.New("concurrency is already bumped")
+
+// ConcurrencyBumper raises concurrency for a limited time, e.g. to drain the
+// critical queue during an incident without a restart
+type ConcurrencyBumper struct {
+	setter   Setter
+	capacity int
+	bumped   *atomic.Bool
+
+	mu       sync.Mutex
+	original int
+	// raised is the concurrency the bump set
+	raised int
+	timer  *time.Timer
+	// gen tells the timer of the current bump from a stale one
+	gen int
+}
+
+// NewConcurrencyBumper bumps setter up to capacity, the concurrency the
+// asynq server was started with
+func NewConcurrencyBumper(setter Setter, capacity int) *ConcurrencyBumper {
+	return &ConcurrencyBumper{setter: setter, capacity: capacity, bumped: &atomic.Bool{}}
+}
+
+// Bump adds extra to the concurrency and restores it after duration. If
+// something else, like the advisor, changed the concurrency meanwhile, its
+// value is kept.
+func (b *ConcurrencyBumper) Bump(extra int, duration time.Duration) error {
+	if extra <= 0 || duration <= 0 {
+		return fmt.Errorf("extra and duration must be positive")
+	}
+	if !b.bumped.CompareAndSwap(false, true) {
+		return ErrAlreadyBumped
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	original := b.setter.Concurrency()
+	if original+extra > b.capacity {
+		b.bumped.Store(false)
+		return fmt.Errorf("cannot bump %d by %d: server capacity is %d", original, extra, b.capacity)
+	}
+	b.original, b.raised = original, original+extra
+	b.setter.SetConcurrency(b.raised)
+	fmt.Printf("⚡ Concurrency bumped to %d for %v\n", b.raised, duration)
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.gen++
+	gen := b.gen
+	b.timer = time.AfterFunc(duration, func() { b.restore(gen) })
+	return nil
+}
+
+// restore ends the bump of generation gen unless a later one replaced it
+func (b *ConcurrencyBumper) restore(gen int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.gen || !b.bumped.Load() {
+		return
+	}
+	b.timer = nil
+	if cur := b.setter.Concurrency(); cur != b.raised {
+		fmt.Printf("⚡ Bump ended; concurrency was changed to %d meanwhile and is kept\n", cur)
+	} else {
+		b.setter.SetConcurrency(b.original)
+		fmt.Printf("⚡ Concurrency restored to %d\n", b.original)
+	}
+	b.bumped.Store(false)
+}
+
+// Bumped reports whether a bump is in effect
+func (b *ConcurrencyBumper) Bumped() bool {
+	return b.bumped.Load()
+}
+
+// ServeHTTP handles POST /concurrency/bump with {"extra": 10, "seconds": 300}
+func (b *ConcurrencyBumper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Extra   int `json:"extra"`
+		Seconds int `json:"seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	err := b.Bump(req.Extra, time.Duration(req.Seconds)*time.Second)
+	switch {
+	case errors.Is(err, ErrAlreadyBumped):
+		admin.WriteError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		admin.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("⚡ Concurrency bump of %d for %ds requested by %s", req.Extra, req.Seconds, r.RemoteAddr)
+	admin.WriteJSON(w, http.StatusOK, map[string]int{"concurrency": b.setter.Concurrency()})
+}
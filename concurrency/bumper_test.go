@@ -0,0 +1,97 @@
+package concurrency_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/concurrency"
+)
+
+// waitRestored waits up to a second for the bump of b to end
+func waitRestored(t *testing.T, b *concurrency.ConcurrencyBumper) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for b.Bumped() {
+		if time.Now().After(deadline) {
+			t.Fatal("bump not restored")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestBump fails unless a bump raises the concurrency until its duration
+// ends, a second bump meanwhile is refused, bumps beyond the capacity are
+// refused, and a concurrency someone else set during the bump is kept
+func TestBump(t *testing.T) {
+	l := concurrency.NewLimiter(5)
+	b := concurrency.NewConcurrencyBumper(l, 20)
+
+	if err := b.Bump(10, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if l.Concurrency() != 15 || !b.Bumped() {
+		t.Fatalf("concurrency %d after a bump of 10", l.Concurrency())
+	}
+	if err := b.Bump(1, time.Minute); !errors.Is(err, concurrency.ErrAlreadyBumped) {
+		t.Errorf("second bump gave %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if l.Concurrency() != 15 {
+		t.Errorf("restored to %d before the duration", l.Concurrency())
+	}
+	waitRestored(t, b)
+	if l.Concurrency() != 5 {
+		t.Errorf("restored to %d, want 5", l.Concurrency())
+	}
+
+	if err := b.Bump(16, time.Minute); err == nil || b.Bumped() || l.Concurrency() != 5 {
+		t.Errorf("bump beyond the capacity gave %v, concurrency %d", err, l.Concurrency())
+	}
+
+	// The advisor lowers the concurrency during the bump
+	if err := b.Bump(5, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	l.SetConcurrency(8)
+	waitRestored(t, b)
+	if l.Concurrency() != 8 {
+		t.Errorf("concurrency %d after the bump, want the 8 set meanwhile", l.Concurrency())
+	}
+}
+
+// TestBumpHandler fails unless POST /concurrency/bump bumps and answers
+// the new concurrency, and a second bump, bad bodies and other methods
+// are refused
+func TestBumpHandler(t *testing.T) {
+	l := concurrency.NewLimiter(5)
+	b := concurrency.NewConcurrencyBumper(l, 20)
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/concurrency/bump", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post(`{"extra": 10, "seconds": 300}`)
+	var resp map[string]int
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK || resp["concurrency"] != 15 {
+		t.Fatalf("bump gave %d %s", rec.Code, rec.Body)
+	}
+	if rec := post(`{"extra": 1, "seconds": 1}`); rec.Code != http.StatusConflict {
+		t.Errorf("second bump gave %d", rec.Code)
+	}
+	for _, body := range []string{`not json`, `{"extra": 0, "seconds": 10}`} {
+		if rec := post(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("body %s gave %d", body, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/concurrency/bump", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET gave %d", rec.Code)
+	}
+}
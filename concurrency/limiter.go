@@ -0,0 +1,151 @@
+// Package concurrency adjusts how many tasks a worker processes at once.
+//
+// asynq fixes a server's concurrency when it starts, so the worker runs with
+// its maximum concurrency and a Limiter middleware holds tasks back to the
+// current limit. A task over the limit is already dequeued and its timeout is
+// running, so it parks in the middleware only briefly before it is handed
+// back to the queue to be tried again with a fresh timeout.
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"asynqdemo/flags"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+)
+
+// DefaultPark is how long a task waits for a slot before it is handed back
+const DefaultPark = time.Second
+
+// parkShare caps the wait for a slot at this share of the time the task
+// has left, so parking never takes much of a handler's timeout
+const parkShare = 10
+
+// ErrNoSlot is returned for a task that found no free slot while it was
+// parked. It unwraps to a flags.ErrDelayed, so the server config deferring
+// flagged tasks tries it again after Delay without using up a retry.
+type ErrNoSlot struct {
+	TaskType string
+	Delay    time.Duration
+}
+
+func (e ErrNoSlot) Error() string {
+	return fmt.Sprintf("no free concurrency slot for %s, retrying in %v", e.TaskType, e.Delay)
+}
+
+func (e ErrNoSlot) Unwrap() error {
+	return flags.ErrDelayed{TaskType: e.TaskType, Delay: e.Delay}
+}
+
+// Setter is anything whose concurrency can be changed at runtime
+type Setter interface {
+	SetConcurrency(n int)
+	Concurrency() int
+}
+
+// Limiter is a semaphore whose size can change while tasks hold it
+type Limiter struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	changed chan struct{}
+
+	// Park is how long the middleware holds a task waiting for a slot, at
+	// most a tenth of the time the task has left, and how long the task then
+	// waits in the queue before it is tried again
+	Park time.Duration
+}
+
+// NewLimiter creates a limiter allowing limit tasks at once
+func NewLimiter(limit int) *Limiter {
+	return &Limiter{limit: limit, changed: make(chan struct{}), Park: DefaultPark}
+}
+
+// SetConcurrency changes the limit. Lowering it lets running tasks finish.
+func (l *Limiter) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = n
+	l.broadcast()
+}
+
+// Concurrency returns the current limit
+func (l *Limiter) Concurrency() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Active returns the number of tasks holding the limiter
+func (l *Limiter) Active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// Acquire waits for a free slot or until ctx is done
+func (l *Limiter) Acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return nil
+		}
+		ch := l.changed
+		l.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.broadcast()
+}
+
+// broadcast wakes all waiters; l.mu must be held
+func (l *Limiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Middleware makes each task hold a slot while it runs. A task finding no
+// slot within its park time fails with ErrNoSlot.
+func (l *Limiter) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			park := l.Park
+			if deadline, ok := ctx.Deadline(); ok {
+				if left := time.Until(deadline) / parkShare; left < park {
+					park = left
+				}
+			}
+			parkCtx, cancel := context.WithTimeout(ctx, park)
+			err := l.Acquire(parkCtx)
+			cancel()
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return ErrNoSlot{TaskType: t.Type(), Delay: l.Park}
+			}
+			defer l.Release()
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package concurrency_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/concurrency"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestPark fails unless a task finding no slot waits at most its park time,
+// or a tenth of the time it has left, and then fails with an ErrNoSlot the
+// server does not count as a failure
+func TestPark(t *testing.T) {
+	l := concurrency.NewLimiter(1)
+	l.Park = 100 * time.Millisecond
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	h := l.Middleware()(asynq.HandlerFunc(func(context.Context, *asynq.Task) error {
+		called = true
+		return nil
+	}))
+	task := asynq.NewTask("report:generate", nil)
+
+	start := time.Now()
+	err := h.ProcessTask(context.Background(), task)
+	waited := time.Since(start)
+	var noSlot concurrency.ErrNoSlot
+	if !errors.As(err, &noSlot) || noSlot.Delay != l.Park || flags.IsFailure(err) || called {
+		t.Fatalf("task without a slot gave %v, handler called %v", err, called)
+	}
+	if waited < 100*time.Millisecond || waited > 200*time.Millisecond {
+		t.Errorf("parked for %v, want 100ms", waited)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := h.ProcessTask(ctx, task); !errors.As(err, &noSlot) {
+		t.Fatalf("task with a deadline gave %v", err)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Errorf("parked for %v of a 200ms timeout, want a tenth", waited)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.Release()
+	}()
+	if err := h.ProcessTask(context.Background(), task); err != nil || !called {
+		t.Errorf("task given a slot while parked gave %v", err)
+	}
+	if l.Active() != 0 {
+		t.Errorf("%d slots held after the task", l.Active())
+	}
+}
+
+// TestLimitWorker runs tasks through a worker of concurrency 4 whose limiter
+// allows one, and fails unless they never run two at once and all complete
+// without using up a retry
+func TestLimitWorker(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	l := concurrency.NewLimiter(1)
+	l.Park = 200 * time.Millisecond
+
+	var running, maxRunning atomic.Int32
+	var mu sync.Mutex
+	done := map[string]bool{}
+	mux := asynq.NewServeMux()
+	mux.Use(l.Middleware())
+	mux.HandleFunc("limit:test", func(ctx context.Context, t *asynq.Task) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		done[string(t.Payload())] = true
+		mu.Unlock()
+		return nil
+	})
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{
+		Concurrency:              4,
+		LogLevel:                 asynq.FatalLevel,
+		IsFailure:                flags.IsFailure,
+		RetryDelayFunc:           flags.RetryDelay(asynq.DefaultRetryDelayFunc),
+		DelayedTaskCheckInterval: 10 * time.Millisecond,
+	})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	for i := 0; i < 8; i++ {
+		if _, err := client.Enqueue(asynq.NewTask("limit:test", []byte(fmt.Sprint(i))), asynq.TaskID(fmt.Sprint(i)), asynq.MaxRetry(1), asynq.Retention(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		n := len(done)
+		mu.Unlock()
+		if n == 8 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 8 tasks completed", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if maxRunning.Load() != 1 {
+		t.Errorf("%d tasks ran at once, want 1", maxRunning.Load())
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 8; i++ {
+		info, err := inspector.GetTaskInfo("default", fmt.Sprint(i))
+		if err != nil || info.State != asynq.TaskStateCompleted || info.Retried != 0 {
+			t.Errorf("task %d: %+v (%v), want completed without a retry", i, info, err)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// Package config loads the Redis and server settings of the worker from a
+// YAML or JSON file, with environment variables overriding the file.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/redisconn"
+
+	"github.com/hibiken/asynq"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is read when -config is not given
+const DefaultFile = "config.yaml"
+
+// Redis is the connection part of the file. REDIS_URL, REDIS_MODE and the
+// other variables of redisconn.FromEnv still apply on top of it.
+type Redis struct {
+	// Addr is the server address, redisconn.DefaultAddr when empty
+	Addr     string `yaml:"addr" json:"addr"`
+	Password string `yaml:"password" json:"password"`
+	DB       int    `yaml:"db" json:"db"`
+	// PoolSize is the maximum number of connections, go-redis's default
+	// when zero
+	PoolSize int `yaml:"pool_size" json:"pool_size"`
+	// SentinelAddrs switches to a Sentinel setup: the worker asks these
+	// sentinels for the address of MasterName and follows failovers
+	SentinelAddrs    []string `yaml:"sentinel_addrs" json:"sentinel_addrs"`
+	MasterName       string   `yaml:"master_name" json:"master_name"`
+	SentinelPassword string   `yaml:"sentinel_password" json:"sentinel_password"`
+	// ClusterAddrs switches to a Redis Cluster, reached through these nodes
+	ClusterAddrs []string `yaml:"cluster_addrs" json:"cluster_addrs"`
+	// TLS connects over TLS, verifying the server against TLSCAFile if set
+	TLS           bool   `yaml:"tls" json:"tls"`
+	TLSCAFile     string `yaml:"tls_ca_file" json:"tls_ca_file"`
+	TLSServerName string `yaml:"tls_server_name" json:"tls_server_name"`
+}
+
+// Config is the settings the worker starts with
+type Config struct {
+	Redis Redis `yaml:"redis" json:"redis"`
+	// Concurrency is the number of tasks processed at once once warmed up
+	Concurrency int `yaml:"concurrency" json:"concurrency"`
+	// Queues maps the consumed queues to their priority weights
+	Queues map[string]int `yaml:"queues" json:"queues"`
+	// ShutdownTimeout is how long in-flight tasks get to finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+
+	// File is the file the settings were read from, empty when it was
+	// missing and the defaults apply
+	File string `yaml:"-" json:"-"`
+}
+
+// Default returns the settings used without a file
+func Default() *Config {
+	return &Config{
+		Concurrency: 5,
+		Queues: map[string]int{
+			"critical": 6,
+			"canary":   6,
+			"default":  3,
+			"low":      1,
+		},
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// Load reads path over the defaults, applies REDIS_DB, REDIS_POOL_SIZE,
+// WORKER_CONCURRENCY, QUEUE_WEIGHTS (e.g. "critical=6,default=3") and
+// SHUTDOWN_TIMEOUT, and validates the result. A missing file leaves the
+// defaults; a malformed one is an error naming the offending field.
+func Load(path string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.applyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		if c.File != "" {
+			return nil, fmt.Errorf("invalid config %s: %v", c.File, err)
+		}
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return c, nil
+}
+
+// readFile decodes the fields the file sets, JSON being valid YAML
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	c.File = path
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	// Queues replace the default ones rather than adding to them
+	var (
+		redis  yaml.Node
+		queues map[string]int
+	)
+	err = decodeFields(doc.Content[0], "", map[string]interface{}{
+		"redis":            &redis,
+		"concurrency":      &c.Concurrency,
+		"queues":           &queues,
+		"shutdown_timeout": &c.ShutdownTimeout,
+	})
+	if err == nil && redis.Kind != 0 {
+		err = decodeFields(&redis, "redis.", map[string]interface{}{
+			"addr":              &c.Redis.Addr,
+			"password":          &c.Redis.Password,
+			"db":                &c.Redis.DB,
+			"pool_size":         &c.Redis.PoolSize,
+			"sentinel_addrs":    &c.Redis.SentinelAddrs,
+			"master_name":       &c.Redis.MasterName,
+			"sentinel_password": &c.Redis.SentinelPassword,
+			"cluster_addrs":     &c.Redis.ClusterAddrs,
+			"tls":               &c.Redis.TLS,
+			"tls_ca_file":       &c.Redis.TLSCAFile,
+			"tls_server_name":   &c.Redis.TLSServerName,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	if queues != nil {
+		c.Queues = queues
+	}
+	return nil
+}
+
+// decodeFields decodes the values of a mapping into fields by key, so that
+// errors name the field rather than only the line
+func decodeFields(node *yaml.Node, prefix string, fields map[string]interface{}) error {
+	if node.Kind != yaml.MappingNode {
+		name := strings.TrimSuffix(prefix, ".")
+		if name == "" {
+			name = "document"
+		}
+		return fmt.Errorf("line %d: %s must be a mapping", node.Line, name)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := prefix + key.Value
+		field, ok := fields[key.Value]
+		if !ok {
+			return fmt.Errorf("line %d: unknown field %s", key.Line, name)
+		}
+		if err := value.Decode(field); err != nil {
+			var typeErr *yaml.TypeError
+			if errors.As(err, &typeErr) {
+				err = errors.New(strings.Join(typeErr.Errors, "; "))
+			}
+			return fmt.Errorf("field %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// applyEnv overrides the fields whose variables getenv returns
+func (c *Config) applyEnv(getenv func(string) string) error {
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"REDIS_DB", &c.Redis.DB},
+		{"REDIS_POOL_SIZE", &c.Redis.PoolSize},
+		{"WORKER_CONCURRENCY", &c.Concurrency},
+	}
+	for _, v := range ints {
+		s := getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", v.name, s, err)
+		}
+		*v.dst = n
+	}
+	if s := getenv("QUEUE_WEIGHTS"); s != "" {
+		queues := make(map[string]int)
+		for _, pair := range strings.Split(s, ",") {
+			name, weight, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			n, err := strconv.Atoi(weight)
+			if !ok || name == "" || err != nil {
+				return fmt.Errorf("invalid QUEUE_WEIGHTS %q: want queue=weight pairs", s)
+			}
+			queues[name] = n
+		}
+		c.Queues = queues
+	}
+	if s := getenv("SHUTDOWN_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q: %v", s, err)
+		}
+		c.ShutdownTimeout = d
+	}
+	return nil
+}
+
+// Validate checks the settings, naming the first offending field
+func (c *Config) Validate() error {
+	switch {
+	case c.Redis.DB < 0:
+		return fmt.Errorf("redis.db must be >= 0, got %d", c.Redis.DB)
+	case c.Redis.PoolSize < 0:
+		return fmt.Errorf("redis.pool_size must be >= 0, got %d", c.Redis.PoolSize)
+	case len(c.Redis.SentinelAddrs) > 0 && c.Redis.MasterName == "":
+		return errors.New("redis.master_name is required with redis.sentinel_addrs")
+	case len(c.Redis.SentinelAddrs) > 0 && len(c.Redis.ClusterAddrs) > 0:
+		return errors.New("redis.sentinel_addrs and redis.cluster_addrs are exclusive")
+	case c.Concurrency < 1:
+		return fmt.Errorf("concurrency must be >= 1, got %d", c.Concurrency)
+	case len(c.Queues) == 0:
+		return errors.New("queues must list at least one queue")
+	case c.ShutdownTimeout <= 0:
+		return fmt.Errorf("shutdown_timeout must be > 0, got %v", c.ShutdownTimeout)
+	}
+	names := make([]string, 0, len(c.Queues))
+	for q := range c.Queues {
+		names = append(names, q)
+	}
+	sort.Strings(names)
+	for _, q := range names {
+		if c.Queues[q] <= 0 {
+			return fmt.Errorf("queues.%s weight must be > 0, got %d", q, c.Queues[q])
+		}
+	}
+	return nil
+}
+
+// ConnOpt returns the connection options of redisconn.FromEnv with the
+// address, sentinels, cluster nodes, TLS settings and passwords of the file
+// where the environment sets none, and the file's db and pool size. A
+// REDIS_URL takes precedence over the file as over REDIS_ADDR: only the
+// pool size, which URLs lack, still applies. The options are a
+// RedisClientOpt, RedisFailoverClientOpt or RedisClusterClientOpt; the
+// client, server and scheduler must all use the same, so they follow a
+// Sentinel failover together.
+func (c *Config) ConnOpt() (asynq.RedisConnOpt, error) {
+	fromURL := os.Getenv("REDIS_URL") != ""
+	opt, err := redisconn.FromLookup(func(name string) string {
+		if v := os.Getenv(name); v != "" || fromURL {
+			return v
+		}
+		switch name {
+		case "REDIS_ADDR":
+			return c.Redis.Addr
+		case "REDIS_SENTINEL_ADDRS":
+			if os.Getenv("REDIS_SENTINELS") == "" {
+				return strings.Join(c.Redis.SentinelAddrs, ",")
+			}
+		case "REDIS_MASTER_NAME":
+			if os.Getenv("REDIS_MASTER") == "" {
+				return c.Redis.MasterName
+			}
+		case "REDIS_PASSWORD":
+			// A mounted secret still wins over the file
+			if os.Getenv("REDIS_PASSWORD_FILE") == "" {
+				return c.Redis.Password
+			}
+		case "SENTINEL_PASSWORD":
+			if os.Getenv("SENTINEL_PASSWORD_FILE") == "" {
+				return c.Redis.SentinelPassword
+			}
+		case "REDIS_CLUSTER_ADDRS":
+			return strings.Join(c.Redis.ClusterAddrs, ",")
+		case "REDIS_TLS":
+			if c.Redis.TLS {
+				return "true"
+			}
+		case "REDIS_TLS_CA_FILE":
+			return c.Redis.TLSCAFile
+		case "REDIS_TLS_SERVER_NAME":
+			return c.Redis.TLSServerName
+		}
+		return ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch o := opt.(type) {
+	case asynq.RedisClientOpt:
+		if c.Redis.DB != 0 && !fromURL {
+			o.DB = c.Redis.DB
+		}
+		if c.Redis.PoolSize != 0 {
+			o.PoolSize = c.Redis.PoolSize
+		}
+		return o, nil
+	case asynq.RedisFailoverClientOpt:
+		if c.Redis.DB != 0 && !fromURL {
+			o.DB = c.Redis.DB
+		}
+		if c.Redis.PoolSize != 0 {
+			o.PoolSize = c.Redis.PoolSize
+		}
+		return o, nil
+	case asynq.RedisClusterClientOpt:
+		if c.Redis.DB != 0 || c.Redis.PoolSize != 0 {
+			return nil, errors.New("redis.db and redis.pool_size are not supported by Redis Cluster")
+		}
+	}
+	return opt, nil
+}
@@ -0,0 +1,105 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/config"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestConfigLoad loads YAML and JSON config files and fails unless a
+// missing file gives the defaults, the files' values apply with the
+// environment overriding them, the connection options carry them, and
+// malformed files fail with an error naming the offending field.
+func TestConfigLoad(t *testing.T) {
+	for _, name := range []string{"REDIS_URL", "REDIS_MODE", "REDIS_ADDR", "REDIS_PASSWORD", "REDIS_PASSWORD_FILE", "REDIS_USERNAME", "REDIS_SENTINEL_ADDRS", "REDIS_SENTINELS", "REDIS_DB", "REDIS_POOL_SIZE", "WORKER_CONCURRENCY", "QUEUE_WEIGHTS", "SHUTDOWN_TIMEOUT"} {
+		t.Setenv(name, "")
+	}
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	cfg, err := config.Load(filepath.Join(dir, "missing.yaml"))
+	if err != nil || cfg.File != "" || !reflect.DeepEqual(cfg, config.Default()) {
+		t.Errorf("missing file gave %+v (%v), want the defaults", cfg, err)
+	}
+
+	yamlPath := write("config.yaml", "# worker settings\nredis:\n  addr: redis.internal:6379\n  password: secret\n  db: 2\n  pool_size: 20\nconcurrency: 8\nqueues:\n  critical: 4\n  default: 1\nshutdown_timeout: 45s\n")
+	cfg, err = config.Load(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config.Config{
+		Redis:           config.Redis{Addr: "redis.internal:6379", Password: "secret", DB: 2, PoolSize: 20},
+		Concurrency:     8,
+		Queues:          map[string]int{"critical": 4, "default": 1},
+		ShutdownTimeout: 45 * time.Second,
+		File:            yamlPath,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("YAML config %+v, want %+v", cfg, want)
+	}
+	opt, err := cfg.ConnOpt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := opt.(asynq.RedisClientOpt); !ok || c.Addr != "redis.internal:6379" || c.Password != "secret" || c.DB != 2 || c.PoolSize != 20 {
+		t.Errorf("connection options %+v", opt)
+	}
+
+	jsonPath := write("config.json", `{"redis": {"addr": "json:6379"}, "concurrency": 3, "shutdown_timeout": "5s"}`)
+	cfg, err = config.Load(jsonPath)
+	if err != nil || cfg.Redis.Addr != "json:6379" || cfg.Concurrency != 3 || cfg.ShutdownTimeout != 5*time.Second ||
+		!reflect.DeepEqual(cfg.Queues, config.Default().Queues) {
+		t.Errorf("JSON config %+v (%v)", cfg, err)
+	}
+
+	t.Setenv("REDIS_ADDR", "env:6379")
+	t.Setenv("REDIS_POOL_SIZE", "7")
+	t.Setenv("WORKER_CONCURRENCY", "2")
+	t.Setenv("QUEUE_WEIGHTS", "critical=9, low=1")
+	t.Setenv("SHUTDOWN_TIMEOUT", "1m")
+	cfg, err = config.Load(yamlPath)
+	if err != nil || cfg.Redis.PoolSize != 7 || cfg.Concurrency != 2 || cfg.ShutdownTimeout != time.Minute ||
+		!reflect.DeepEqual(cfg.Queues, map[string]int{"critical": 9, "low": 1}) {
+		t.Errorf("config with env overrides %+v (%v)", cfg, err)
+	}
+	if opt, err := cfg.ConnOpt(); err != nil || opt.(asynq.RedisClientOpt).Addr != "env:6379" || opt.(asynq.RedisClientOpt).Password != "secret" {
+		t.Errorf("REDIS_ADDR did not override the file: %+v (%v)", opt, err)
+	}
+	t.Setenv("WORKER_CONCURRENCY", "0")
+	if _, err := config.Load(yamlPath); err == nil || !strings.Contains(err.Error(), "concurrency") {
+		t.Errorf("WORKER_CONCURRENCY=0 gave %v", err)
+	}
+	for _, name := range []string{"REDIS_ADDR", "REDIS_POOL_SIZE", "WORKER_CONCURRENCY", "QUEUE_WEIGHTS", "SHUTDOWN_TIMEOUT"} {
+		t.Setenv(name, "")
+	}
+
+	for content, field := range map[string]string{
+		"concurrency: 0\n":                      "concurrency",
+		"queues:\n  default: 3\n  low: 0\n":     "queues.low",
+		"redis:\n  pool_size: many\n":           "redis.pool_size",
+		"redis:\n  port: 6379\n":                "redis.port",
+		"shutdown_timeout: soon\n":              "shutdown_timeout",
+		"queues: [default]\n":                   "queues",
+		`{"concurrency": 4, "queue": {"a": 1}}`: "queue",
+		"redis: [\n":                            "config",
+	} {
+		_, err := config.Load(write("bad.yaml", content))
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("malformed config %q gave %v, want an error naming %s", content, err, field)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package consistency
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ConsistencyIssue reports two Redis nodes disagreeing about the depth of a queue
+type ConsistencyIssue struct {
+	Queue  string
+	NodeA  string
+	NodeB  string
+	DepthA int
+	DepthB int
+	Delta  int
+}
+
+func (i ConsistencyIssue) String() string {
+	return fmt.Sprintf("queue %q: %s has %d tasks, %s has %d (delta %d)", i.Queue, i.NodeA, i.DepthA, i.NodeB, i.DepthB, i.Delta)
+}
+
+// ConsistencyChecker connects to every node of a Sentinel deployment on its own
+// and compares queue depths, which should only differ during a split-brain
+type ConsistencyChecker struct {
+	addrs     []string
+	password  string
+	tolerance int
+	timeout   time.Duration
+}
+
+// NewConsistencyChecker creates a checker for the given node addresses. Depth
+// differences up to tolerance are ignored to allow for replication lag.
+func NewConsistencyChecker(addrs []string, password string, tolerance int) *ConsistencyChecker {
+	return &ConsistencyChecker{
+		addrs:     addrs,
+		password:  password,
+		tolerance: tolerance,
+		timeout:   3 * time.Second,
+	}
+}
+
+// Check compares the depth of each queue across all nodes pairwise. Nodes that
+// cannot be reached are logged and left out of the comparison.
+func (c *ConsistencyChecker) Check(queues []string) []ConsistencyIssue {
+	depths := make(map[string]map[string]int, len(c.addrs))
+	var nodes []string
+	for _, addr := range c.addrs {
+		d, err := c.nodeDepths(addr, queues)
+		if err != nil {
+			log.Printf("⚠️  Consistency check skipped node %s: %v", addr, err)
+			continue
+		}
+		depths[addr] = d
+		nodes = append(nodes, addr)
+	}
+
+	var issues []ConsistencyIssue
+	for _, q := range queues {
+		for i := 0; i < len(nodes); i++ {
+			for j := i + 1; j < len(nodes); j++ {
+				a, b := depths[nodes[i]][q], depths[nodes[j]][q]
+				delta := a - b
+				if delta < 0 {
+					delta = -delta
+				}
+				if delta > c.tolerance {
+					issues = append(issues, ConsistencyIssue{
+						Queue:  q,
+						NodeA:  nodes[i],
+						NodeB:  nodes[j],
+						DepthA: a,
+						DepthB: b,
+						Delta:  delta,
+					})
+				}
+			}
+		}
+	}
+	return issues
+}
+
+// nodeDepths counts pending, scheduled and retry tasks of each queue on one node
+func (c *ConsistencyChecker) nodeDepths(addr string, queues []string) (map[string]int, error) {
+	rdb := redis.NewClient(&redis.Options{Addr: addr, Password: c.password})
+	defer rdb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	depths := make(map[string]int, len(queues))
+	for _, q := range queues {
+		pipe := rdb.Pipeline()
+		pending := pipe.LLen(ctx, queueKey(q, "pending"))
+		scheduled := pipe.ZCard(ctx, queueKey(q, "scheduled"))
+		retry := pipe.ZCard(ctx, queueKey(q, "retry"))
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to read queue %q: %v", q, err)
+		}
+		depths[q] = int(pending.Val() + scheduled.Val() + retry.Val())
+	}
+	return depths, nil
+}
+
+// queueKey follows asynq's key layout, e.g. asynq:{default}:pending
+func queueKey(queue, state string) string {
+	return fmt.Sprintf("asynq:{%s}:%s", queue, state)
+}
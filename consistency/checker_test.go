@@ -0,0 +1,62 @@
+package consistency_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"asynqdemo/consistency"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+)
+
+// fill enqueues n tasks on the default queue of a node, every third of
+// them scheduled
+func fill(t *testing.T, srv *embeddedredis.Server, n int) {
+	t.Helper()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	for i := 0; i < n; i++ {
+		var opts []asynq.Option
+		if i%3 == 0 {
+			opts = append(opts, asynq.ProcessIn(time.Hour))
+		}
+		if _, err := client.Enqueue(asynq.NewTask("check", []byte(fmt.Sprint(i))), opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestCheck fails unless two independent nodes whose default queues differ
+// by 5 tasks above the tolerance are reported, equal queues and differences
+// within the tolerance are not, and an unreachable node is left out.
+func TestCheck(t *testing.T) {
+	a, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fill(t, a, 9)
+	fill(t, b, 2)
+
+	queues := []string{"default", "critical"}
+	issues := consistency.NewConsistencyChecker([]string{a.Addr(), b.Addr()}, "", 2).Check(queues)
+	want := consistency.ConsistencyIssue{Queue: "default", NodeA: a.Addr(), NodeB: b.Addr(), DepthA: 9, DepthB: 2, Delta: 7}
+	if len(issues) != 1 || issues[0] != want {
+		t.Fatalf("got issues %v, want %v", issues, want)
+	}
+
+	if issues := consistency.NewConsistencyChecker([]string{a.Addr(), b.Addr()}, "", 7).Check(queues); len(issues) != 0 {
+		t.Errorf("difference within the tolerance reported: %v", issues)
+	}
+	unreachable := "127.0.0.1:1"
+	if issues := consistency.NewConsistencyChecker([]string{a.Addr(), unreachable}, "", 0).Check(queues); len(issues) != 0 {
+		t.Errorf("unreachable node compared: %v", issues)
+	}
+}
@@ -0,0 +1,172 @@
+// Package contracts pins the JSON payloads that services in other languages
+// enqueue directly into Redis. Every published task type has a canonical
+// fixture per payload version under testdata/contracts, named
+// <type>.v<version>.json with the colon of the type replaced by "_".
+//
+// The payload struct must decode every fixture without unknown fields, and
+// encode the fixture of the latest version back to the same JSON, modulo
+// field order. A struct change that breaks this is a breaking contract
+// change: instead of editing the fixture, keep the old field names and add a
+// payload version. List it in the TaskSpec's PayloadVersions so the fleet
+// gate holds producers back until workers handle it, add its fixture, and
+// send the other teams the new schema from "admin contracts export".
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"asynqdemo/common"
+)
+
+// DefaultDir is where the fixtures live, relative to the module root
+const DefaultDir = "testdata/contracts"
+
+// Published lists the task types other services enqueue
+var Published = []string{common.TypeWelcomeMessage, common.TypeEmailTask}
+
+// Fixture is the canonical payload of one task type and version
+type Fixture struct {
+	TaskType string
+	Version  int
+	// Latest is set for the newest version the worker handles
+	Latest  bool
+	File    string
+	Payload []byte
+}
+
+// FileName returns the fixture file name of a task type and version
+func FileName(taskType string, version int) string {
+	return fmt.Sprintf("%s.v%d.json", strings.ReplaceAll(taskType, ":", "_"), version)
+}
+
+// Load reads the fixtures of every published type and version from dir
+func Load(dir string) ([]Fixture, error) {
+	var fixtures []Fixture
+	for _, taskType := range Published {
+		spec, ok := common.LookupTaskSpec(taskType)
+		if !ok {
+			return nil, fmt.Errorf("published task type %s is not registered", taskType)
+		}
+		versions := spec.Versions()
+		latest := versions[0]
+		for _, v := range versions {
+			if v > latest {
+				latest = v
+			}
+		}
+		for _, v := range versions {
+			file := filepath.Join(dir, FileName(taskType, v))
+			payload, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s payload v%d fixture: %v", taskType, v, err)
+			}
+			fixtures = append(fixtures, Fixture{TaskType: taskType, Version: v, Latest: v == latest, File: file, Payload: payload})
+		}
+	}
+	return fixtures, nil
+}
+
+// ErrBrokenContract is returned when a payload struct no longer matches a
+// fixture
+type ErrBrokenContract struct {
+	TaskType string
+	Version  int
+	File     string
+	Reason   string
+}
+
+func (e ErrBrokenContract) Error() string {
+	return fmt.Sprintf("%s payload v%d no longer matches %s: %s. Other services enqueue this JSON, so do not edit the fixture: "+
+		"keep the old field names, or add payload version %d to the TaskSpec with its own fixture (see package contracts)",
+		e.TaskType, e.Version, e.File, e.Reason, e.Version+1)
+}
+
+// Check decodes the fixture into the registered payload struct and, for
+// the latest version, checks that it encodes back to the same JSON
+func Check(f Fixture) error {
+	spec, ok := common.LookupTaskSpec(f.TaskType)
+	if !ok || spec.NewPayload == nil {
+		return fmt.Errorf("no payload type registered for %s", f.TaskType)
+	}
+	broken := func(format string, args ...interface{}) error {
+		return ErrBrokenContract{TaskType: f.TaskType, Version: f.Version, File: f.File, Reason: fmt.Sprintf(format, args...)}
+	}
+	dec := json.NewDecoder(bytes.NewReader(f.Payload))
+	dec.DisallowUnknownFields()
+	payload := spec.NewPayload()
+	if err := dec.Decode(payload); err != nil {
+		return broken("%v", err)
+	}
+	if !f.Latest {
+		return nil
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s payload: %v", f.TaskType, err)
+	}
+	var want, got map[string]interface{}
+	if err := json.Unmarshal(f.Payload, &want); err != nil {
+		return fmt.Errorf("fixture %s is not a JSON object: %v", f.File, err)
+	}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		return fmt.Errorf("failed to decode %s payload: %v", f.TaskType, err)
+	}
+	if diff := diffFields(want, got); len(diff) > 0 {
+		return broken("%s", strings.Join(diff, "; "))
+	}
+	return nil
+}
+
+// CheckAll checks every fixture in dir
+func CheckAll(dir string) error {
+	fixtures, err := Load(dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range fixtures {
+		if err := Check(f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// diffFields describes how the top-level fields of got differ from want
+func diffFields(want, got map[string]interface{}) []string {
+	names := make(map[string]bool)
+	for name := range want {
+		names[name] = true
+	}
+	for name := range got {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var diff []string
+	for _, name := range sorted {
+		w, inWant := want[name]
+		g, inGot := got[name]
+		switch {
+		case !inGot:
+			diff = append(diff, fmt.Sprintf("field %q is no longer encoded", name))
+		case !inWant:
+			diff = append(diff, fmt.Sprintf("new required field %q", name))
+		case !reflect.DeepEqual(w, g):
+			diff = append(diff, fmt.Sprintf("field %q encodes as %v, fixture has %v", name, g, w))
+		}
+	}
+	return diff
+}
@@ -0,0 +1,28 @@
+package contracts_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"asynqdemo/contracts"
+)
+
+// TestContracts checks the payload structs against every contract fixture
+// of the module, one subtest per fixture
+func TestContracts(t *testing.T) {
+	fixtures, err := contracts.Load(filepath.Join("..", contracts.DefaultDir))
+	if err != nil {
+		t.Fatalf("failed to load contract fixtures: %v", err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no contract fixtures")
+	}
+	for _, f := range fixtures {
+		f := f
+		t.Run(filepath.Base(f.File), func(t *testing.T) {
+			if err := contracts.Check(f); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
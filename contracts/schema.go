@@ -0,0 +1,159 @@
+package contracts
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+)
+
+// schemaDialect is the JSON Schema version of the generated documents
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// Schema returns the JSON Schema of the current payload struct of taskType.
+// Fields without omitempty are required and unknown fields are rejected, as
+// the workers' validation does.
+func Schema(taskType string) (map[string]interface{}, error) {
+	spec, ok := common.LookupTaskSpec(taskType)
+	if !ok || spec.NewPayload == nil {
+		return nil, fmt.Errorf("no payload type registered for %s", taskType)
+	}
+	s := typeSchema(reflect.TypeOf(spec.NewPayload()))
+	s["$schema"] = schemaDialect
+	s["title"] = taskType
+	return s, nil
+}
+
+// TypeSchema returns the JSON Schema of the JSON encoding of v's type,
+// e.g. an HTTP response struct, titled title
+func TypeSchema(v interface{}, title string) map[string]interface{} {
+	s := typeSchema(reflect.TypeOf(v))
+	s["$schema"] = schemaDialect
+	s["title"] = title
+	return s
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json writes byte slices as base64
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		required := []string{}
+		addFields(t, props, &required)
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"required":             required,
+			"additionalProperties": false,
+		}
+	}
+	// Interfaces accept any JSON value
+	return map[string]interface{}{}
+}
+
+// addFields adds the JSON fields of struct t, including promoted fields of
+// embedded structs, the way encoding/json names them
+func addFields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addFields(ft, props, required)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = typeSchema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// Export writes the fixtures of dir and the schema of every published type's
+// latest payload version to out, for the teams of the other services
+func Export(dir, out string) ([]string, error) {
+	fixtures, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", out, err)
+	}
+	var written []string
+	write := func(name string, data []byte) error {
+		path := filepath.Join(out, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		written = append(written, path)
+		return nil
+	}
+	for _, f := range fixtures {
+		if err := write(filepath.Base(f.File), f.Payload); err != nil {
+			return nil, err
+		}
+		if !f.Latest {
+			continue
+		}
+		s, err := Schema(f.TaskType)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s schema: %v", f.TaskType, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(f.File), ".json") + ".schema.json"
+		if err := write(name, append(data, '\n')); err != nil {
+			return nil, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,134 @@
+package contracts
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Validate checks the JSON document data against schema, supporting the
+// keywords TypeSchema generates: type, properties, required,
+// additionalProperties, items and the date-time format
+func Validate(schema map[string]interface{}, data []byte) error {
+	// Round trip the schema so generated and decoded schemas look the same
+	raw, err := json.Marshal(schema)
+	if err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	return validate(s, v, "$")
+}
+
+func validate(schema map[string]interface{}, v interface{}, path string) error {
+	switch want, _ := schema["type"].(string); want {
+	case "":
+		return nil
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: got %s, want boolean", path, kind(v))
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("%s: got %s, want integer", path, kind(v))
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: got %s, want number", path, kind(v))
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: got %s, want string", path, kind(v))
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", path, s)
+			}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: got %s, want array", path, kind(v))
+		}
+		itemSchema, _ := schema["items"].(map[string]interface{})
+		for i, item := range items {
+			if err := validate(itemSchema, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: got %s, want object", path, kind(v))
+		}
+		return validateObject(schema, obj, path)
+	default:
+		return fmt.Errorf("%s: unsupported schema type %q", path, want)
+	}
+	return nil
+}
+
+func validateObject(schema map[string]interface{}, obj map[string]interface{}, path string) error {
+	props, _ := schema["properties"].(map[string]interface{})
+	required, _ := schema["required"].([]interface{})
+	for _, r := range required {
+		name, _ := r.(string)
+		if _, ok := obj[name]; !ok {
+			return fmt.Errorf("%s: missing required field %q", path, name)
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var fieldSchema map[string]interface{}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if p, ok := props[name].(map[string]interface{}); ok {
+				fieldSchema = p
+			} else if !extra {
+				return fmt.Errorf("%s: unknown field %q", path, name)
+			}
+		case map[string]interface{}:
+			fieldSchema = extra
+			if p, ok := props[name].(map[string]interface{}); ok {
+				fieldSchema = p
+			}
+		default:
+			fieldSchema, _ = props[name].(map[string]interface{})
+		}
+		if err := validate(fieldSchema, obj[name], path+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kind names the JSON type of a decoded value
+func kind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
@@ -0,0 +1,104 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"asynqdemo/sigv4"
+)
+
+// awsRevoked are the exceptions KMS answers for keys that cannot be used any more
+var awsRevoked = map[string]bool{
+	"DisabledException":        true,
+	"KMSInvalidStateException": true,
+	"NotFoundException":        true,
+	"AccessDeniedException":    true,
+}
+
+// awsKMSClient calls the AWS KMS JSON API with Signature Version 4 signed
+// requests
+type awsKMSClient struct {
+	region   string
+	endpoint string
+	creds    sigv4.Credentials
+	http     *http.Client
+	now      func() time.Time
+}
+
+func newAWSKMSClient(region string, creds sigv4.Credentials) *awsKMSClient {
+	return &awsKMSClient{
+		region:   region,
+		endpoint: fmt.Sprintf("https://kms.%s.amazonaws.com/", region),
+		creds:    creds,
+		http:     &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// Encrypt calls TrentService.Encrypt
+func (c *awsKMSClient) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	var out struct {
+		CiphertextBlob []byte
+	}
+	if err := c.call(ctx, "Encrypt", map[string]interface{}{"KeyId": keyID, "Plaintext": plaintext}, &out); err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+// Decrypt calls TrentService.Decrypt
+func (c *awsKMSClient) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	if err := c.call(ctx, "Decrypt", map[string]interface{}{"KeyId": keyID, "CiphertextBlob": ciphertext}, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// call sends one API request; byte slices travel base64 encoded, which is
+// how encoding/json marshals them
+func (c *awsKMSClient) call(ctx context.Context, action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s request: %v", action, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %v", action, err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	sigv4.Sign(req, sigv4.HashPayload(body), c.region, "kms", c.creds, c.now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %v", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s returned %s: %s", action, resp.Status, strings.TrimSpace(string(data)))
+		var apiErr struct {
+			Type string `json:"__type"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && awsRevoked[apiErr.Type[strings.LastIndex(apiErr.Type, "#")+1:]] {
+			return fmt.Errorf("%w: %v", ErrKeyRevoked, err)
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", action, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcpKMSEndpoint   = "https://cloudkms.googleapis.com/v1/"
+	gcpMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// gcpKMSClient calls the Cloud KMS REST API with an OAuth access token
+type gcpKMSClient struct {
+	http *http.Client
+
+	mu sync.Mutex
+	// token is fixed when given, otherwise fetched from the metadata server
+	// and refreshed before it expires
+	token   string
+	fixed   bool
+	expires time.Time
+}
+
+func newGCPKMSClient(token string) *gcpKMSClient {
+	return &gcpKMSClient{
+		http:  &http.Client{Timeout: 10 * time.Second},
+		token: token,
+		fixed: token != "",
+	}
+}
+
+// Encrypt calls cryptoKeys.encrypt
+func (c *gcpKMSClient) Encrypt(ctx context.Context, keyName string, plaintext []byte) ([]byte, error) {
+	var out struct {
+		Ciphertext []byte `json:"ciphertext"`
+	}
+	if err := c.call(ctx, keyName+":encrypt", map[string][]byte{"plaintext": plaintext}, &out); err != nil {
+		return nil, err
+	}
+	return out.Ciphertext, nil
+}
+
+// Decrypt calls cryptoKeys.decrypt
+func (c *gcpKMSClient) Decrypt(ctx context.Context, keyName string, ciphertext []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	if err := c.call(ctx, keyName+":decrypt", map[string][]byte{"ciphertext": ciphertext}, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+func (c *gcpKMSClient) call(ctx context.Context, path string, in, out interface{}) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gcpKMSEndpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return c.do(req, out)
+}
+
+// accessToken returns the fixed token or a cached metadata server token
+func (c *gcpKMSClient) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fixed || (c.token != "" && time.Now().Before(c.expires)) {
+		return c.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataToken, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %v", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := c.do(req, &out); err != nil {
+		return "", fmt.Errorf("failed to get access token: %v", err)
+	}
+	// Refresh a minute early so a token never expires mid-request
+	c.token = out.AccessToken
+	c.expires = time.Now().Add(time.Duration(out.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+func (c *gcpKMSClient) do(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %v", req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response of %s: %v", req.URL.Path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s returned %s: %s", req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+		// Disabled or destroyed key versions fail the precondition; removed
+		// IAM grants are denied
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound ||
+			(resp.StatusCode == http.StatusBadRequest && strings.Contains(string(data), "FAILED_PRECONDITION")) {
+			return fmt.Errorf("%w: %v", ErrKeyRevoked, err)
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode response of %s: %v", req.URL.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Package crypto encrypts task payloads with keys held by a cloud KMS, so no
+// key material is kept in the worker's environment.
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"asynqdemo/sigv4"
+)
+
+// ErrKeyRevoked is wrapped by provider errors when the KMS refuses to use a
+// key because it was disabled, scheduled for deletion or access was revoked
+var ErrKeyRevoked = errors.New("KMS key is revoked")
+
+// KMSProvider encrypts and decrypts small secrets with a key that never
+// leaves the KMS
+type KMSProvider interface {
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// AWSKMSAPI is the part of the AWS KMS API the provider calls
+type AWSKMSAPI interface {
+	Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// AWSKMSProvider uses a key of AWS KMS
+type AWSKMSProvider struct {
+	keyID  string
+	client AWSKMSAPI
+}
+
+// NewAWSKMSProvider creates a provider for the key with the given ID, ARN or alias
+func NewAWSKMSProvider(keyID string, client AWSKMSAPI) *AWSKMSProvider {
+	return &AWSKMSProvider{keyID: keyID, client: client}
+}
+
+// NewAWSKMSProviderFromEnv creates a provider for AWS_KMS_KEY_ID in
+// AWS_REGION, signing requests with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and the optional AWS_SESSION_TOKEN
+func NewAWSKMSProviderFromEnv() (*AWSKMSProvider, error) {
+	keyID := os.Getenv("AWS_KMS_KEY_ID")
+	if keyID == "" {
+		return nil, fmt.Errorf("AWS_KMS_KEY_ID is not set")
+	}
+	client, err := awsKMSClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewAWSKMSProvider(keyID, client), nil
+}
+
+func awsKMSClientFromEnv() (*awsKMSClient, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	creds := sigv4.CredentialsFromEnv()
+	if region == "" || !creds.Valid() {
+		return nil, fmt.Errorf("AWS KMS requires AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return newAWSKMSClient(region, creds), nil
+}
+
+// Encrypt encrypts plaintext under the key
+func (p *AWSKMSProvider) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	ciphertext, err := p.client.Encrypt(ctx, p.keyID, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with AWS KMS key %s: %w", p.keyID, err)
+	}
+	return ciphertext, nil
+}
+
+// Decrypt decrypts ciphertext produced by Encrypt
+func (p *AWSKMSProvider) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	plaintext, err := p.client.Decrypt(ctx, p.keyID, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with AWS KMS key %s: %w", p.keyID, err)
+	}
+	return plaintext, nil
+}
+
+// GCPKMSAPI is the part of the Cloud KMS API the provider calls
+type GCPKMSAPI interface {
+	Encrypt(ctx context.Context, keyName string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyName string, ciphertext []byte) ([]byte, error)
+}
+
+// GCPKMSProvider uses a key of Google Cloud KMS
+type GCPKMSProvider struct {
+	keyName string
+	client  GCPKMSAPI
+}
+
+// NewGCPKMSProvider creates a provider for the key with the given resource
+// name, projects/*/locations/*/keyRings/*/cryptoKeys/*
+func NewGCPKMSProvider(keyName string, client GCPKMSAPI) *GCPKMSProvider {
+	return &GCPKMSProvider{keyName: keyName, client: client}
+}
+
+// NewGCPKMSProviderFromEnv creates a provider for GCP_KMS_KEY_NAME,
+// authenticating with GCP_ACCESS_TOKEN or else the metadata server's service
+// account
+func NewGCPKMSProviderFromEnv() (*GCPKMSProvider, error) {
+	keyName := os.Getenv("GCP_KMS_KEY_NAME")
+	if keyName == "" {
+		return nil, fmt.Errorf("GCP_KMS_KEY_NAME is not set")
+	}
+	return NewGCPKMSProvider(keyName, newGCPKMSClient(os.Getenv("GCP_ACCESS_TOKEN"))), nil
+}
+
+// Encrypt encrypts plaintext under the key
+func (p *GCPKMSProvider) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	ciphertext, err := p.client.Encrypt(ctx, p.keyName, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with Cloud KMS key %s: %w", p.keyName, err)
+	}
+	return ciphertext, nil
+}
+
+// Decrypt decrypts ciphertext produced by Encrypt
+func (p *GCPKMSProvider) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	plaintext, err := p.client.Decrypt(ctx, p.keyName, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with Cloud KMS key %s: %w", p.keyName, err)
+	}
+	return plaintext, nil
+}
+
+// TenantKeysFromEnv returns the keys for the KMS PAYLOAD_KMS names, aws or
+// gcp, and nil when it is unset. The default key is AWS_KMS_KEY_ID or
+// GCP_KMS_KEY_NAME; tenants listed in the comma-separated PAYLOAD_KMS_TENANTS
+// use their own key, named by PAYLOAD_KMS_TENANT_KEY with {tenant} replaced,
+// such as alias/asynq-tenant-{tenant}.
+func TenantKeysFromEnv() (*TenantKeys, error) {
+	var defaultKey string
+	var provider func(keyID string) KMSProvider
+	switch kind := os.Getenv("PAYLOAD_KMS"); kind {
+	case "":
+		return nil, nil
+	case "aws":
+		defaultKey = os.Getenv("AWS_KMS_KEY_ID")
+		if defaultKey == "" {
+			return nil, fmt.Errorf("AWS_KMS_KEY_ID is not set")
+		}
+		client, err := awsKMSClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		provider = func(keyID string) KMSProvider { return NewAWSKMSProvider(keyID, client) }
+	case "gcp":
+		defaultKey = os.Getenv("GCP_KMS_KEY_NAME")
+		if defaultKey == "" {
+			return nil, fmt.Errorf("GCP_KMS_KEY_NAME is not set")
+		}
+		client := newGCPKMSClient(os.Getenv("GCP_ACCESS_TOKEN"))
+		provider = func(keyName string) KMSProvider { return NewGCPKMSProvider(keyName, client) }
+	default:
+		return nil, fmt.Errorf("unknown PAYLOAD_KMS %q, want aws or gcp", kind)
+	}
+
+	var tenants []string
+	for _, t := range strings.Split(os.Getenv("PAYLOAD_KMS_TENANTS"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tenants = append(tenants, t)
+		}
+	}
+	pattern := os.Getenv("PAYLOAD_KMS_TENANT_KEY")
+	if len(tenants) > 0 && !strings.Contains(pattern, TenantPlaceholder) {
+		return nil, fmt.Errorf("PAYLOAD_KMS_TENANTS requires PAYLOAD_KMS_TENANT_KEY containing %s", TenantPlaceholder)
+	}
+	return NewTenantKeys(defaultKey, pattern, tenants, provider), nil
+}
@@ -0,0 +1,198 @@
+package crypto_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"asynqdemo/crypto"
+)
+
+// fakeKMS stands in for the KMS API of either cloud. It wraps data keys into
+// opaque handles it alone can resolve, records every call, and answers
+// ErrKeyRevoked for the keys in revoked.
+type fakeKMS struct {
+	mu       sync.Mutex
+	wrapped  map[string][]byte // handle -> plaintext
+	keyOf    map[string]string // handle -> key ID
+	revoked  map[string]bool
+	encrypts []string // key IDs
+	decrypts []string
+}
+
+func newFakeKMS() *fakeKMS {
+	return &fakeKMS{wrapped: map[string][]byte{}, keyOf: map[string]string{}, revoked: map[string]bool{}}
+}
+
+func (k *fakeKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.encrypts = append(k.encrypts, keyID)
+	if k.revoked[keyID] {
+		return nil, fmt.Errorf("%w: DisabledException", crypto.ErrKeyRevoked)
+	}
+	handle := fmt.Sprintf("kms:%s:%d", keyID, len(k.wrapped))
+	k.wrapped[handle] = append([]byte(nil), plaintext...)
+	k.keyOf[handle] = keyID
+	return []byte(handle), nil
+}
+
+func (k *fakeKMS) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.decrypts = append(k.decrypts, keyID)
+	if k.revoked[keyID] {
+		return nil, fmt.Errorf("%w: DisabledException", crypto.ErrKeyRevoked)
+	}
+	plaintext, ok := k.wrapped[string(ciphertext)]
+	if !ok || k.keyOf[string(ciphertext)] != keyID {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return plaintext, nil
+}
+
+// calls returns the key IDs of the Encrypt and Decrypt calls so far
+func (k *fakeKMS) calls() (encrypts, decrypts []string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]string(nil), k.encrypts...), append([]string(nil), k.decrypts...)
+}
+
+// TestKMSProviders fails unless both providers hand the operations to the
+// KMS API with their key, name the key in errors and keep ErrKeyRevoked
+// detectable
+func TestKMSProviders(t *testing.T) {
+	ctx := context.Background()
+	kms := newFakeKMS()
+	for _, p := range []crypto.KMSProvider{
+		crypto.NewAWSKMSProvider("alias/asynq", kms),
+		crypto.NewGCPKMSProvider("projects/p/locations/l/keyRings/r/cryptoKeys/asynq", kms),
+	} {
+		ciphertext, err := p.Encrypt(ctx, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(ciphertext, []byte("secret")) {
+			t.Errorf("%T ciphertext %q holds the plaintext", p, ciphertext)
+		}
+		if plaintext, err := p.Decrypt(ctx, ciphertext); err != nil || string(plaintext) != "secret" {
+			t.Errorf("%T decrypted %q (%v)", p, plaintext, err)
+		}
+	}
+	encrypts, decrypts := kms.calls()
+	want := []string{"alias/asynq", "projects/p/locations/l/keyRings/r/cryptoKeys/asynq"}
+	if fmt.Sprint(encrypts) != fmt.Sprint(want) || fmt.Sprint(decrypts) != fmt.Sprint(want) {
+		t.Errorf("KMS saw encrypts %v and decrypts %v, want %v for each", encrypts, decrypts, want)
+	}
+
+	kms.revoked["alias/asynq"] = true
+	_, err := crypto.NewAWSKMSProvider("alias/asynq", kms).Encrypt(ctx, []byte("secret"))
+	if !errors.Is(err, crypto.ErrKeyRevoked) || !bytes.Contains([]byte(err.Error()), []byte("alias/asynq")) {
+		t.Errorf("revoked key gave %v", err)
+	}
+}
+
+// TestPayloadEncryptor fails unless every payload gets its own data key,
+// wrapped by the KMS and never stored in the clear, decryption unwraps it
+// through the KMS, and tampering is reported as malformed
+func TestPayloadEncryptor(t *testing.T) {
+	ctx := context.Background()
+	kms := newFakeKMS()
+	keys := crypto.NewTenantKeys("alias/asynq", "", nil, func(keyID string) crypto.KMSProvider {
+		return crypto.NewAWSKMSProvider(keyID, kms)
+	})
+	enc := crypto.NewPayloadEncryptor(keys, nil)
+
+	payload := []byte(`{"email":"user@example.com"}`)
+	first, err := enc.Encrypt(ctx, "", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := enc.Encrypt(ctx, "", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !crypto.IsEncrypted(first) || bytes.Contains(first, payload) || bytes.Equal(first, second) {
+		t.Fatalf("encrypted payloads %q and %q", first, second)
+	}
+	kms.mu.Lock()
+	for _, dataKey := range kms.wrapped {
+		if len(dataKey) != 32 {
+			t.Errorf("data key of %d bytes, want 32", len(dataKey))
+		}
+		if bytes.Contains(first, dataKey) || bytes.Contains(second, dataKey) {
+			t.Error("data key stored in the clear")
+		}
+	}
+	distinct := len(kms.wrapped)
+	kms.mu.Unlock()
+	if distinct != 2 {
+		t.Errorf("%d data keys for two payloads", distinct)
+	}
+
+	got, err := enc.Decrypt(ctx, first)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("decrypted %q (%v)", got, err)
+	}
+	encrypts, decrypts := kms.calls()
+	if len(encrypts) != 2 || len(decrypts) != 1 || decrypts[0] != "alias/asynq" {
+		t.Errorf("KMS saw encrypts %v and decrypts %v", encrypts, decrypts)
+	}
+	if id, err := enc.KeyID(first); err != nil || id != "alias/asynq" {
+		t.Errorf("key ID %q (%v)", id, err)
+	}
+
+	// Without the KMS the data key cannot be recovered
+	kms.mu.Lock()
+	kms.wrapped = map[string][]byte{}
+	kms.mu.Unlock()
+	if _, err := enc.Decrypt(ctx, second); err == nil {
+		t.Error("decrypted a payload the KMS no longer unwraps")
+	}
+
+	fresh, err := enc.Encrypt(ctx, "", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh[len(fresh)-1] ^= 1
+	if _, err := enc.Decrypt(ctx, fresh); !errors.Is(err, crypto.ErrMalformed) {
+		t.Errorf("tampered payload gave %v, want ErrMalformed", err)
+	}
+	if _, err := enc.Decrypt(ctx, fresh[:6]); !errors.Is(err, crypto.ErrMalformed) {
+		t.Errorf("truncated payload gave %v, want ErrMalformed", err)
+	}
+}
+
+// TestKMSFromEnv fails unless the providers require their key and, for
+// AWS, a region and credentials
+func TestKMSFromEnv(t *testing.T) {
+	for _, c := range []struct {
+		key, region, access, secret string
+		ok                          bool
+	}{
+		{"alias/asynq", "eu-west-1", "AKID", "SECRET", true},
+		{"", "eu-west-1", "AKID", "SECRET", false},
+		{"alias/asynq", "", "AKID", "SECRET", false},
+		{"alias/asynq", "eu-west-1", "", "", false},
+	} {
+		t.Setenv("AWS_KMS_KEY_ID", c.key)
+		t.Setenv("AWS_REGION", c.region)
+		t.Setenv("AWS_DEFAULT_REGION", "")
+		t.Setenv("AWS_ACCESS_KEY_ID", c.access)
+		t.Setenv("AWS_SECRET_ACCESS_KEY", c.secret)
+		if p, err := crypto.NewAWSKMSProviderFromEnv(); (err == nil) != c.ok || (p != nil) != c.ok {
+			t.Errorf("AWS with %+v gave %v", c, err)
+		}
+	}
+	t.Setenv("GCP_KMS_KEY_NAME", "")
+	if _, err := crypto.NewGCPKMSProviderFromEnv(); err == nil {
+		t.Error("GCP provider created without GCP_KMS_KEY_NAME")
+	}
+	t.Setenv("GCP_KMS_KEY_NAME", "projects/p/locations/l/keyRings/r/cryptoKeys/asynq")
+	if _, err := crypto.NewGCPKMSProviderFromEnv(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,259 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"asynqdemo/metadata"
+	"asynqdemo/middleware"
+	"asynqdemo/quarantine"
+
+	"github.com/hibiken/asynq"
+)
+
+// Encrypted payloads start with a version tag. ENC1 payloads predate tenant
+// keys and were all encrypted under the default key.
+var (
+	magicV1 = []byte("ENC1")
+	magic   = []byte("ENC2")
+)
+
+// ErrTenantKeyRevoked is returned for payloads whose key the KMS refuses to
+// use. It wraps asynq.SkipRetry, so the task is archived, and its message
+// starts with the code tenant_key_revoked to find such tasks among the
+// archived ones.
+type ErrTenantKeyRevoked struct {
+	Tenant string
+	KeyID  string
+	Err    error
+}
+
+func (e ErrTenantKeyRevoked) Error() string {
+	return fmt.Sprintf("tenant_key_revoked: key %s of tenant %q: %v", e.KeyID, e.Tenant, e.Err)
+}
+
+func (e ErrTenantKeyRevoked) Unwrap() []error {
+	return []error{asynq.SkipRetry, e.Err}
+}
+
+// ErrMalformed is wrapped by the errors of encrypted payloads that are
+// truncated or fail authentication, which no retry can decrypt
+var ErrMalformed = errors.New("malformed encrypted payload")
+
+// malformed is an ErrMalformed with its own message
+type malformed string
+
+func (m malformed) Error() string        { return string(m) }
+func (m malformed) Is(target error) bool { return target == ErrMalformed }
+
+// PayloadEncryptor encrypts payloads with AES-256-GCM under a fresh data key
+// per payload. The data key is encrypted with the tenant's KMS key, whose ID
+// is stored next to it so keys can be rotated per tenant:
+//
+//	"ENC2" | key ID length (uint16) | key ID | data key length (uint16) |
+//	encrypted data key | nonce | ciphertext
+type PayloadEncryptor struct {
+	keys  *TenantKeys
+	alert func(ctx context.Context, text string) error
+
+	// alerted holds the key IDs revocation was reported for
+	alerted sync.Map
+}
+
+// NewPayloadEncryptor creates an encryptor using keys. alert, which may be
+// nil, is called once per revoked key.
+func NewPayloadEncryptor(keys *TenantKeys, alert func(ctx context.Context, text string) error) *PayloadEncryptor {
+	return &PayloadEncryptor{keys: keys, alert: alert}
+}
+
+// PayloadEncryptorFromEnv creates an encryptor for the keys TenantKeysFromEnv
+// reads, and returns nil when PAYLOAD_KMS is unset
+func PayloadEncryptorFromEnv(alert func(ctx context.Context, text string) error) (*PayloadEncryptor, error) {
+	keys, err := TenantKeysFromEnv()
+	if err != nil || keys == nil {
+		return nil, err
+	}
+	return NewPayloadEncryptor(keys, alert), nil
+}
+
+// Encode returns an encrypted payload as a JSON string, the form the
+// metadata envelope, which only carries JSON, can hold. IsEncrypted, KeyID
+// and Decrypt accept either form.
+func Encode(data []byte) []byte {
+	encoded, _ := json.Marshal(data)
+	return encoded
+}
+
+// raw returns the encrypted payload of a JSON string made by Encode, and
+// payload itself otherwise
+func raw(payload []byte) []byte {
+	var data []byte
+	if len(payload) > 0 && payload[0] == '"' && json.Unmarshal(payload, &data) == nil {
+		return data
+	}
+	return payload
+}
+
+// IsEncrypted reports whether payload was produced by Encrypt
+func IsEncrypted(payload []byte) bool {
+	payload = raw(payload)
+	return bytes.HasPrefix(payload, magic) || bytes.HasPrefix(payload, magicV1)
+}
+
+// KeyID returns the ID of the key an encrypted payload was encrypted with
+func (e *PayloadEncryptor) KeyID(data []byte) (string, error) {
+	keyID, _, err := e.parseHeader(raw(data))
+	return keyID, err
+}
+
+// Encrypt encrypts payload with the key of tenant
+func (e *PayloadEncryptor) Encrypt(ctx context.Context, tenant string, payload []byte) ([]byte, error) {
+	keyID := e.keys.KeyFor(tenant)
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	wrapped, err := e.keys.Provider(keyID).Encrypt(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyID) > 0xffff || len(wrapped) > 0xffff {
+		return nil, fmt.Errorf("key ID or encrypted data key too long")
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	out := make([]byte, 0, len(magic)+4+len(keyID)+len(wrapped)+len(nonce)+len(payload)+gcm.Overhead())
+	out = append(out, magic...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(keyID)))
+	out = append(out, keyID...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	out = append(out, nonce...)
+	// The header is authenticated so the key cannot be swapped
+	return gcm.Seal(out, nonce, payload, out[:len(out)-len(nonce)]), nil
+}
+
+// Decrypt decrypts a payload produced by Encrypt. Errors from a revoked key
+// wrap ErrKeyRevoked.
+func (e *PayloadEncryptor) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	data = raw(data)
+	keyID, header, err := e.parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	keyLen := int(binary.BigEndian.Uint16(data[header-2:]))
+	if len(data) < header+keyLen {
+		return nil, malformed("encrypted payload is truncated")
+	}
+	dataKey, err := e.keys.Provider(keyID).Decrypt(ctx, data[header:header+keyLen])
+	if err != nil {
+		return nil, err
+	}
+	header += keyLen
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < header+gcm.NonceSize() {
+		return nil, malformed("encrypted payload is truncated")
+	}
+	nonce := data[header : header+gcm.NonceSize()]
+	payload, err := gcm.Open(nil, nonce, data[header+gcm.NonceSize():], data[:header])
+	if err != nil {
+		return nil, malformed("failed to decrypt payload: " + err.Error())
+	}
+	return payload, nil
+}
+
+// parseHeader returns the key ID of data and the offset of its data key
+// length
+func (e *PayloadEncryptor) parseHeader(data []byte) (string, int, error) {
+	switch {
+	case bytes.HasPrefix(data, magicV1):
+		if len(data) < len(magicV1)+2 {
+			return "", 0, malformed("encrypted payload is truncated")
+		}
+		return e.keys.DefaultKey(), len(magicV1) + 2, nil
+	case bytes.HasPrefix(data, magic):
+		if len(data) < len(magic)+2 {
+			return "", 0, malformed("encrypted payload is truncated")
+		}
+		idLen := int(binary.BigEndian.Uint16(data[len(magic):]))
+		header := len(magic) + 2 + idLen + 2
+		if len(data) < header {
+			return "", 0, malformed("encrypted payload is truncated")
+		}
+		return string(data[len(magic)+2 : len(magic)+2+idLen]), header, nil
+	}
+	return "", 0, fmt.Errorf("payload is not encrypted")
+}
+
+// Middleware decrypts encrypted payloads before the handler sees them. It
+// goes after the metadata middleware, as the envelope is not encrypted.
+// Payloads whose key was revoked are archived and alerted about.
+func (e *PayloadEncryptor) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			if !IsEncrypted(t.Payload()) {
+				return next.ProcessTask(ctx, t)
+			}
+			payload, err := e.Decrypt(ctx, t.Payload())
+			if errors.Is(err, ErrKeyRevoked) {
+				keyID, _ := e.KeyID(t.Payload())
+				revoked := ErrTenantKeyRevoked{Tenant: metadata.FromContext(ctx)[KeyTenantID], KeyID: keyID, Err: err}
+				e.alertRevoked(ctx, revoked)
+				return revoked
+			}
+			if errors.Is(err, ErrMalformed) {
+				return quarantine.ErrDecode{TaskType: t.Type(), Encoding: quarantine.EncodingEncrypted, Err: err}
+			}
+			if err != nil {
+				return fmt.Errorf("failed to decrypt %s payload: %v", t.Type(), err)
+			}
+			return next.ProcessTask(ctx, asynq.NewTask(t.Type(), payload))
+		})
+	}
+}
+
+// alertRevoked reports the first task failing on a revoked key
+func (e *PayloadEncryptor) alertRevoked(ctx context.Context, err ErrTenantKeyRevoked) {
+	if _, seen := e.alerted.LoadOrStore(err.KeyID, true); seen {
+		return
+	}
+	log.Printf("❌ %v", err)
+	if e.alert == nil {
+		return
+	}
+	text := fmt.Sprintf("Payload key %s of tenant %q is revoked; its tasks are archived with tenant_key_revoked", err.KeyID, err.Tenant)
+	if aerr := e.alert(ctx, text); aerr != nil {
+		log.Printf("⚠️  Failed to send key revocation alert: %v", aerr)
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return gcm, nil
+}
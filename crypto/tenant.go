@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"strings"
+	"sync"
+)
+
+// KeyTenantID is the metadata attribute naming the tenant whose key encrypts
+// the payload
+const KeyTenantID = "tenant_id"
+
+// TenantPlaceholder is replaced by the tenant ID in tenant key patterns
+const TenantPlaceholder = "{tenant}"
+
+// TenantKeys resolves the KMS key of a tenant: tenants with their own key use
+// the key the pattern names, all others share the default key
+type TenantKeys struct {
+	defaultKey string
+	pattern    string
+	tenants    map[string]bool
+	provider   func(keyID string) KMSProvider
+
+	mu        sync.Mutex
+	providers map[string]KMSProvider
+}
+
+// NewTenantKeys creates a resolver. provider creates the KMS provider of a
+// key ID.
+func NewTenantKeys(defaultKey, pattern string, tenants []string, provider func(keyID string) KMSProvider) *TenantKeys {
+	k := &TenantKeys{
+		defaultKey: defaultKey,
+		pattern:    pattern,
+		tenants:    make(map[string]bool, len(tenants)),
+		provider:   provider,
+		providers:  make(map[string]KMSProvider),
+	}
+	for _, t := range tenants {
+		k.tenants[t] = true
+	}
+	return k
+}
+
+// DefaultKey returns the ID of the key shared by tenants without their own
+func (k *TenantKeys) DefaultKey() string {
+	return k.defaultKey
+}
+
+// KeyFor returns the ID of the key encrypting payloads of tenant
+func (k *TenantKeys) KeyFor(tenant string) string {
+	if tenant == "" || !k.tenants[tenant] {
+		return k.defaultKey
+	}
+	return strings.ReplaceAll(k.pattern, TenantPlaceholder, tenant)
+}
+
+// Provider returns the KMS provider of a key ID
+func (k *TenantKeys) Provider(keyID string) KMSProvider {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	p, ok := k.providers[keyID]
+	if !ok {
+		p = k.provider(keyID)
+		k.providers[keyID] = p
+	}
+	return p
+}
@@ -0,0 +1,220 @@
+package crypto_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/crypto"
+	"asynqdemo/leak/leaktest"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// tenantKeys gives acme and globex their own keys next to the default one
+func tenantKeys(kms *fakeKMS) *crypto.TenantKeys {
+	return crypto.NewTenantKeys("alias/asynq", "alias/asynq-tenant-{tenant}", []string{"acme", "globex"}, func(keyID string) crypto.KMSProvider {
+		return crypto.NewAWSKMSProvider(keyID, kms)
+	})
+}
+
+// TestTenantKeys fails unless tenants with their own key get the key the
+// pattern names, all others the default key, and providers are made once
+// per key
+func TestTenantKeys(t *testing.T) {
+	keys := tenantKeys(newFakeKMS())
+	for tenant, want := range map[string]string{
+		"acme":    "alias/asynq-tenant-acme",
+		"globex":  "alias/asynq-tenant-globex",
+		"initech": "alias/asynq",
+		"":        "alias/asynq",
+	} {
+		if got := keys.KeyFor(tenant); got != want {
+			t.Errorf("key of %q is %s, want %s", tenant, got, want)
+		}
+	}
+	if keys.Provider("alias/asynq") != keys.Provider("alias/asynq") {
+		t.Error("a second provider was made for the same key")
+	}
+
+	t.Setenv("PAYLOAD_KMS", "gcp")
+	t.Setenv("GCP_KMS_KEY_NAME", "projects/p/locations/l/keyRings/r/cryptoKeys/asynq")
+	t.Setenv("PAYLOAD_KMS_TENANTS", "acme, globex")
+	t.Setenv("PAYLOAD_KMS_TENANT_KEY", "projects/p/locations/l/keyRings/r/cryptoKeys/tenant-{tenant}")
+	keys, err := crypto.TenantKeysFromEnv()
+	if err != nil || keys.KeyFor("globex") != "projects/p/locations/l/keyRings/r/cryptoKeys/tenant-globex" || keys.KeyFor("initech") != keys.DefaultKey() {
+		t.Errorf("keys from the environment: %v", err)
+	}
+	t.Setenv("PAYLOAD_KMS_TENANT_KEY", "projects/p/locations/l/keyRings/r/cryptoKeys/shared")
+	if _, err := crypto.TenantKeysFromEnv(); err == nil {
+		t.Error("tenant key pattern without {tenant} accepted")
+	}
+	t.Setenv("PAYLOAD_KMS", "vault")
+	if _, err := crypto.TenantKeysFromEnv(); err == nil {
+		t.Error("unknown PAYLOAD_KMS accepted")
+	}
+}
+
+// encryptV1 builds a payload in the format from before tenant keys, which
+// recorded no key ID
+func encryptV1(t *testing.T, kms *fakeKMS, payload []byte) []byte {
+	t.Helper()
+	dataKey := bytes.Repeat([]byte{7}, 32)
+	wrapped, err := kms.Encrypt(context.Background(), "alias/asynq", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(dataKey)
+	gcm, _ := cipher.NewGCM(block)
+	out := binary.BigEndian.AppendUint16([]byte("ENC1"), uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	nonce := make([]byte, gcm.NonceSize())
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, payload, out[:len(out)-len(nonce)])
+}
+
+// TestTenantEncryption processes encrypted tasks of two tenants with their
+// own keys, a tenant on the default key and a payload from before tenant
+// keys through a worker, encoded in the metadata envelope, and fails unless
+// each is decrypted with its key.
+// After acme's key is revoked its tasks must be archived with
+// tenant_key_revoked and alerted about once, while globex is unaffected.
+func TestTenantEncryption(t *testing.T) {
+	leaktest.Check(t)
+	srv := leaktest.Redis(t)
+	kms := newFakeKMS()
+	var mu sync.Mutex
+	var alerts []string
+	enc := crypto.NewPayloadEncryptor(tenantKeys(kms), func(ctx context.Context, text string) error {
+		mu.Lock()
+		alerts = append(alerts, text)
+		mu.Unlock()
+		return nil
+	})
+
+	got := make(chan string, 10)
+	mux := asynq.NewServeMux()
+	mux.Use(metadata.Middleware(), enc.Middleware())
+	mux.HandleFunc("tenant:test", func(ctx context.Context, task *asynq.Task) error {
+		got <- string(task.Payload())
+		return nil
+	})
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 2, LogLevel: asynq.FatalLevel})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	ctx := context.Background()
+	enqueue := func(tenant, id string, payload []byte) {
+		t.Helper()
+		md := metadata.Metadata{}
+		if tenant != "" {
+			md[crypto.KeyTenantID] = tenant
+		}
+		task, err := metadata.NewTask("tenant:test", payload, md, asynq.TaskID(id), asynq.MaxRetry(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Enqueue(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encrypt := func(tenant, payload string) []byte {
+		t.Helper()
+		data, err := enc.Encrypt(ctx, tenant, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crypto.Encode(data)
+	}
+	receive := func(n int) map[string]bool {
+		t.Helper()
+		seen := map[string]bool{}
+		for i := 0; i < n; i++ {
+			select {
+			case p := <-got:
+				seen[p] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("received %v, want %d payloads", seen, n)
+			}
+		}
+		return seen
+	}
+
+	acme := encrypt("acme", `{"tenant":"acme"}`)
+	for data, want := range map[string]string{string(acme): "alias/asynq-tenant-acme", string(encrypt("initech", "{}")): "alias/asynq"} {
+		if id, err := enc.KeyID([]byte(data)); err != nil || id != want {
+			t.Errorf("header records key %q (%v), want %s", id, err, want)
+		}
+	}
+	if !crypto.IsEncrypted(acme) {
+		t.Error("payload encoded for the envelope not recognized as encrypted")
+	}
+	enqueue("acme", "acme-1", acme)
+	enqueue("globex", "globex-1", encrypt("globex", `{"tenant":"globex"}`))
+	enqueue("initech", "initech-1", encrypt("initech", `{"tenant":"initech"}`))
+	enqueue("", "legacy", crypto.Encode(encryptV1(t, kms, []byte(`{"tenant":"legacy"}`))))
+	seen := receive(4)
+	for _, want := range []string{`{"tenant":"acme"}`, `{"tenant":"globex"}`, `{"tenant":"initech"}`, `{"tenant":"legacy"}`} {
+		if !seen[want] {
+			t.Errorf("handler did not get %s, got %v", want, seen)
+		}
+	}
+	_, decrypts := kms.calls()
+	counts := map[string]int{}
+	for _, key := range decrypts {
+		counts[key]++
+	}
+	if counts["alias/asynq-tenant-acme"] != 1 || counts["alias/asynq-tenant-globex"] != 1 || counts["alias/asynq"] != 2 {
+		t.Errorf("KMS decrypted with %v", counts)
+	}
+
+	// Encrypted before the revocation, processed after it
+	acme2, acme3 := encrypt("acme", `{"n":2}`), encrypt("acme", `{"n":3}`)
+	kms.mu.Lock()
+	kms.revoked["alias/asynq-tenant-acme"] = true
+	kms.mu.Unlock()
+	enqueue("acme", "acme-2", acme2)
+	enqueue("acme", "acme-3", acme3)
+	enqueue("globex", "globex-2", encrypt("globex", `{"tenant":"globex","n":2}`))
+	if seen := receive(1); !seen[`{"tenant":"globex","n":2}`] {
+		t.Errorf("globex payload not processed after acme's revocation: %v", seen)
+	}
+	for _, id := range []string{"acme-2", "acme-3"} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			info, err := inspector.GetTaskInfo("default", id)
+			if err == nil && info.State == asynq.TaskStateArchived {
+				if !strings.HasPrefix(info.LastErr, "tenant_key_revoked:") || info.Retried != 0 {
+					t.Errorf("%s archived after %d retries with %q", id, info.Retried, info.LastErr)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not archived: %+v (%v)", id, info, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "alias/asynq-tenant-acme") || !strings.Contains(alerts[0], `"acme"`) {
+		t.Errorf("alerts %q, want one about acme's key", alerts)
+	}
+	if _, err := enc.Encrypt(ctx, "acme", []byte("{}")); !errors.Is(err, crypto.ErrKeyRevoked) {
+		t.Errorf("encrypting with a revoked key gave %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+// Package dash serves the read-only JSON API of the dashboard under
+// /api/dash. Every response is shaped for charts, time series being arrays
+// of {t, v} points with t in Unix milliseconds, and carries an ETag so the
+// polling dashboard gets a 304 while nothing changed:
+//
+//	GET /api/dash/queues      task counts per queue, processed and failed per day
+//	GET /api/dash/throughput  tasks processed per minute and type, last hour
+//	GET /api/dash/failures    recent retried and archived tasks, ?limit=50
+//	GET /api/dash/workers     worker servers and the tasks they are running
+//	GET /api/dash/scheduler   periodic entries and when they run, one-shot entries
+//
+// Failure payloads are summarized: only allowlisted string fields keep their
+// values, encrypted payloads are not decoded.
+package dash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/queues"
+	"asynqdemo/scheduler"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Prefix is the path the handler is mounted at
+const Prefix = "/api/dash/"
+
+// Handler serves the dashboard API
+type Handler struct {
+	inspector *asynq.Inspector
+	rdb       redis.UniversalClient
+	stats     *queues.StatsCache
+
+	// OneShots lists the one-shot entries shown by /api/dash/scheduler,
+	// late by at most OneShotGrace; nil shows none
+	OneShots     scheduler.OneShotSource
+	OneShotGrace time.Duration
+}
+
+// NewHandler creates the dashboard API reading queue stats from stats, so
+// the dashboard shares its scans with /admin/queues
+func NewHandler(inspector *asynq.Inspector, rdb redis.UniversalClient, stats *queues.StatsCache) *Handler {
+	return &Handler{inspector: inspector, rdb: rdb, stats: stats}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var (
+		resp interface{}
+		err  error
+	)
+	switch strings.TrimPrefix(r.URL.Path, Prefix) {
+	case "queues":
+		resp, err = h.Queues()
+	case "throughput":
+		resp, err = h.Throughput(r.Context())
+	case "failures":
+		limit := DefaultFailureLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > MaxFailureLimit {
+				admin.WriteError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(MaxFailureLimit))
+				return
+			}
+		}
+		resp, err = h.Failures(limit)
+	case "workers":
+		resp, err = h.Workers()
+	case "scheduler":
+		resp, err = h.Scheduler(r.Context())
+	default:
+		admin.WriteError(w, http.StatusNotFound, "unknown dashboard endpoint")
+		return
+	}
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeTagged(w, r, resp)
+}
+
+// writeTagged writes v with an ETag of its encoding, or 304 when the
+// request's If-None-Match has it. Responses carry no per-request timestamps
+// so the ETag only changes with the data.
+func writeTagged(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if matches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(append(body, '\n'))
+	}
+}
+
+// matches reports whether an If-None-Match header lists etag, comparing
+// weakly as RFC 9110 requires
+func matches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Responses maps every endpoint to its response type, whose schemas are
+// kept as golden files in testdata/dash
+var Responses = map[string]interface{}{
+	"queues":     QueuesResponse{},
+	"throughput": ThroughputResponse{},
+	"failures":   FailuresResponse{},
+	"workers":    WorkersResponse{},
+	"scheduler":  SchedulerResponse{},
+}
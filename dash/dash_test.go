@@ -0,0 +1,228 @@
+package dash_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/contracts"
+	"asynqdemo/dash"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metrics"
+	"asynqdemo/queues"
+	"asynqdemo/scheduler"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// goldenDir holds the golden schemas of the responses
+var goldenDir = filepath.Join("..", "testdata", "dash")
+
+// TestDashSchemas fails unless the schema of every /api/dash response
+// type equals its golden file in testdata/dash. With UPDATE_GOLDEN=1 it
+// rewrites the golden files instead.
+func TestDashSchemas(t *testing.T) {
+	for _, name := range dashEndpoints() {
+		schema, err := json.MarshalIndent(contracts.TypeSchema(dash.Responses[name], dash.Prefix+name), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema = append(schema, '\n')
+		path := filepath.Join(goldenDir, name+".schema.json")
+		if os.Getenv("UPDATE_GOLDEN") == "1" {
+			if err := os.WriteFile(path, schema, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		golden, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read golden schema: %v", err)
+		}
+		if !bytes.Equal(golden, schema) {
+			t.Errorf("schema of %s%s differs from %s; rerun with UPDATE_GOLDEN=1 if the change is intended", dash.Prefix, name, path)
+		}
+	}
+}
+
+// TestDash serves the dashboard API over an embedded Redis with a worker
+// and a scheduler, and fails unless every response validates against its
+// golden schema in testdata/dash, a repeated request gets a 304 until the data
+// changes, and failure payloads are redacted.
+func TestDash(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	// Every email fails, once for good and once waiting for a retry
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{
+		Concurrency:    2,
+		Queues:         map[string]int{"default": 1},
+		RetryDelayFunc: func(int, error, *asynq.Task) time.Duration { return time.Hour },
+	})
+	if err := worker.Start(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		return fmt.Errorf("mailbox unavailable")
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	sched := asynq.NewScheduler(srv.ConnOpt(), nil)
+	if _, err := sched.Register("@every 1h", asynq.NewTask(common.TypeWelcomeMessage, []byte(`{"user_id":1}`))); err != nil {
+		t.Fatal(err)
+	}
+	if err := sched.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sched.Shutdown()
+	schedule := filepath.Join(t.TempDir(), "schedule.yaml")
+	if err := os.WriteFile(schedule, []byte("once:\n  - name: launch\n    at: 2100-01-01T09:00:00Z\n    type: "+common.TypeWelcomeMessage+"\n    payload: {user_id: 1}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	email := func(retries int) {
+		payload := []byte(`{"user_id":7,"email":"jane@example.com","subject":"Hi Jane","category":"marketing"}`)
+		if _, err := client.Enqueue(asynq.NewTask(common.TypeEmailTask, payload), asynq.MaxRetry(retries)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor := func(what string, done func() bool) {
+		deadline := time.Now().Add(15 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+	email(0)
+	email(3)
+	recorder, err := metrics.NewLatencyRecorder(rdb, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Observe(common.TypeEmailTask, 20*time.Millisecond)
+	if err := recorder.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("failed emails and scheduler entries", func() bool {
+		q, err := inspector.GetQueueInfo("default")
+		entries, _ := inspector.SchedulerEntries()
+		return err == nil && q.Retry == 1 && q.Archived == 1 && len(entries) == 1
+	})
+
+	h := dash.NewHandler(inspector, rdb, queues.NewStatsCache(inspector, 0))
+	h.OneShots, h.OneShotGrace = scheduler.EntriesFile(schedule), scheduler.DefaultOneShotGrace
+	api := httptest.NewServer(h)
+	defer api.Close()
+	get := func(name, etag string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, api.URL+dash.Prefix+name, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	etags := map[string]string{}
+	for _, name := range dashEndpoints() {
+		resp, body := get(name, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", name, resp.StatusCode, body)
+		}
+		golden, err := os.ReadFile(filepath.Join(goldenDir, name+".schema.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var schema map[string]interface{}
+		if err := json.Unmarshal(golden, &schema); err != nil {
+			t.Fatal(err)
+		}
+		if err := contracts.Validate(schema, body); err != nil {
+			t.Errorf("%s does not match its schema: %v", name, err)
+		}
+		etags[name] = resp.Header.Get("ETag")
+		repeat, _ := get(name, etags[name])
+		if repeat.StatusCode == http.StatusOK {
+			// The throughput window moved to the next minute in between
+			etags[name] = repeat.Header.Get("ETag")
+			repeat, _ = get(name, etags[name])
+		}
+		if repeat.StatusCode != http.StatusNotModified {
+			t.Errorf("%s: repeated request got status %d, want 304", name, repeat.StatusCode)
+		}
+	}
+
+	_, body := get("throughput", "")
+	var throughput dash.ThroughputResponse
+	if err := json.Unmarshal(body, &throughput); err != nil {
+		t.Fatal(err)
+	}
+	if len(throughput.Series) != 1 || len(throughput.Series[0].Points) != 60 || throughput.Series[0].Points[59].V+throughput.Series[0].Points[58].V != 1 {
+		t.Errorf("throughput does not show the recorded email: %+v", throughput.Series)
+	}
+
+	_, body = get("failures", "")
+	var failures dash.FailuresResponse
+	if err := json.Unmarshal(body, &failures); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures.Failures) != 2 {
+		t.Fatalf("got %d failures, want 2", len(failures.Failures))
+	}
+	for _, f := range failures.Failures {
+		if f.Payload["email"] != dash.Redacted || f.Payload["subject"] != dash.Redacted {
+			t.Errorf("failure %s leaks its payload: %v", f.ID, f.Payload)
+		}
+		if f.Payload["category"] != "marketing" || f.Payload["user_id"] != float64(7) {
+			t.Errorf("failure %s hides allowlisted fields: %v", f.ID, f.Payload)
+		}
+	}
+
+	// A new failure changes the ETag
+	email(0)
+	waitFor("the third failure", func() bool {
+		q, err := inspector.GetQueueInfo("default")
+		return err == nil && q.Archived == 2
+	})
+	if resp, _ := get("failures", etags["failures"]); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etags["failures"] {
+		t.Errorf("failures got status %d and the same ETag after a new failure", resp.StatusCode)
+	}
+	if resp, _ := get("nope", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown endpoint got status %d, want 404", resp.StatusCode)
+	}
+}
+
+func dashEndpoints() []string {
+	names := make([]string, 0, len(dash.Responses))
+	for name := range dash.Responses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,341 @@
+package dash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"asynqdemo/crypto"
+	"asynqdemo/metadata"
+	"asynqdemo/metrics"
+	"asynqdemo/scheduler"
+
+	"github.com/hibiken/asynq"
+)
+
+const (
+	// historyDays is how many days of processed and failed counts a queue shows
+	historyDays = 7
+	// throughputMinutes is how many minutes of throughput a series shows
+	throughputMinutes = 60
+)
+
+// Failure list limits
+const (
+	DefaultFailureLimit = 50
+	MaxFailureLimit     = 200
+)
+
+// QueueSummary is a queue's current task counts and its daily history
+type QueueSummary struct {
+	Queue     string `json:"queue"`
+	Paused    bool   `json:"paused"`
+	Size      int    `json:"size"`
+	Pending   int    `json:"pending"`
+	Active    int    `json:"active"`
+	Scheduled int    `json:"scheduled"`
+	Retry     int    `json:"retry"`
+	Archived  int    `json:"archived"`
+	Completed int    `json:"completed"`
+	// LatencySeconds is the age of the oldest pending task, in whole
+	// seconds so the ETag holds between polls
+	LatencySeconds int64           `json:"latency_seconds"`
+	Processed      []metrics.Point `json:"processed"`
+	Failed         []metrics.Point `json:"failed"`
+}
+
+// QueuesResponse is returned by /api/dash/queues
+type QueuesResponse struct {
+	Queues []QueueSummary `json:"queues"`
+}
+
+// Series is the throughput of one task type
+type Series struct {
+	TaskType string          `json:"task_type"`
+	Points   []metrics.Point `json:"points"`
+}
+
+// ThroughputResponse is returned by /api/dash/throughput
+type ThroughputResponse struct {
+	ResolutionSeconds int      `json:"resolution_seconds"`
+	Series            []Series `json:"series"`
+}
+
+// Failure is a task that failed and waits for a retry or was archived
+type Failure struct {
+	ID            string    `json:"id"`
+	Queue         string    `json:"queue"`
+	Type          string    `json:"type"`
+	State         string    `json:"state"`
+	Retried       int       `json:"retried"`
+	MaxRetry      int       `json:"max_retry"`
+	LastError     string    `json:"last_error"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+	NextProcessAt time.Time `json:"next_process_at,omitempty"`
+	// Payload is the redacted summary of the payload; PayloadNote says
+	// why it is empty when the payload cannot be summarized
+	Payload     map[string]interface{} `json:"payload"`
+	PayloadNote string                 `json:"payload_note,omitempty"`
+}
+
+// FailuresResponse is returned by /api/dash/failures, most recent first
+type FailuresResponse struct {
+	Failures []Failure `json:"failures"`
+}
+
+// ActiveTask is a task a worker server is running
+type ActiveTask struct {
+	TaskID  string    `json:"task_id"`
+	Type    string    `json:"type"`
+	Queue   string    `json:"queue"`
+	Started time.Time `json:"started"`
+}
+
+// Worker is a running worker server
+type Worker struct {
+	ID          string         `json:"id"`
+	Host        string         `json:"host"`
+	PID         int            `json:"pid"`
+	Status      string         `json:"status"`
+	Concurrency int            `json:"concurrency"`
+	Queues      map[string]int `json:"queues"`
+	Started     time.Time      `json:"started"`
+	Active      []ActiveTask   `json:"active"`
+}
+
+// WorkersResponse is returned by /api/dash/workers
+type WorkersResponse struct {
+	Workers []Worker `json:"workers"`
+}
+
+// SchedulerEntry is a periodic task registered by a scheduler
+type SchedulerEntry struct {
+	ID   string    `json:"id"`
+	Spec string    `json:"spec"`
+	Type string    `json:"type"`
+	Next time.Time `json:"next"`
+	// Prev is unset until the entry fired once
+	Prev time.Time `json:"prev,omitempty"`
+}
+
+// SchedulerResponse is returned by /api/dash/scheduler, the periodic
+// entries ordered by next run and the one-shot entries by time
+type SchedulerResponse struct {
+	Entries  []SchedulerEntry          `json:"entries"`
+	OneShots []scheduler.OneShotStatus `json:"one_shots"`
+}
+
+// Queues summarizes every queue
+func (h *Handler) Queues() (*QueuesResponse, error) {
+	snap, err := h.stats.Get(false)
+	if err != nil {
+		return nil, err
+	}
+	resp := &QueuesResponse{Queues: make([]QueueSummary, 0, len(snap.Queues))}
+	for _, q := range snap.Queues {
+		history, err := h.inspector.History(q.Queue, historyDays)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get history of queue %s: %v", q.Queue, err)
+		}
+		s := QueueSummary{
+			Queue:          q.Queue,
+			Paused:         q.Paused,
+			Size:           q.Size,
+			Pending:        q.Pending,
+			Active:         q.Active,
+			Scheduled:      q.Scheduled,
+			Retry:          q.Retry,
+			Archived:       q.Archived,
+			Completed:      q.Completed,
+			LatencySeconds: int64(q.Latency.Seconds()),
+			Processed:      make([]metrics.Point, 0, len(history)),
+			Failed:         make([]metrics.Point, 0, len(history)),
+		}
+		// History lists today first, charts want the oldest day first. Its
+		// dates are the time of the call, the points are at midnight UTC.
+		for i := len(history) - 1; i >= 0; i-- {
+			d := history[i]
+			day := d.Date.UTC().Truncate(24 * time.Hour).UnixMilli()
+			s.Processed = append(s.Processed, metrics.Point{T: day, V: float64(d.Processed)})
+			s.Failed = append(s.Failed, metrics.Point{T: day, V: float64(d.Failed)})
+		}
+		resp.Queues = append(resp.Queues, s)
+	}
+	return resp, nil
+}
+
+// Throughput returns the per-minute throughput of every task type over the
+// last hour
+func (h *Handler) Throughput(ctx context.Context) (*ThroughputResponse, error) {
+	types, err := metrics.TaskTypes(ctx, h.rdb)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	resp := &ThroughputResponse{ResolutionSeconds: int(time.Minute.Seconds()), Series: make([]Series, 0, len(types))}
+	for _, t := range types {
+		points, err := metrics.Throughput(ctx, h.rdb, t, throughputMinutes, now)
+		if err != nil {
+			return nil, err
+		}
+		resp.Series = append(resp.Series, Series{TaskType: t, Points: points})
+	}
+	return resp, nil
+}
+
+// Failures returns up to limit of the most recently failed tasks across
+// every queue
+func (h *Handler) Failures(limit int) (*FailuresResponse, error) {
+	names, err := h.inspector.Queues()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues: %v", err)
+	}
+	var tasks []*asynq.TaskInfo
+	for _, q := range names {
+		retry, err := h.inspector.ListRetryTasks(q, asynq.PageSize(limit))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list retry tasks of queue %s: %v", q, err)
+		}
+		archived, err := h.inspector.ListArchivedTasks(q, asynq.PageSize(limit))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list archived tasks of queue %s: %v", q, err)
+		}
+		tasks = append(append(tasks, retry...), archived...)
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if !tasks[i].LastFailedAt.Equal(tasks[j].LastFailedAt) {
+			return tasks[i].LastFailedAt.After(tasks[j].LastFailedAt)
+		}
+		return tasks[i].ID < tasks[j].ID
+	})
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	resp := &FailuresResponse{Failures: make([]Failure, 0, len(tasks))}
+	for _, t := range tasks {
+		f := Failure{
+			ID:           t.ID,
+			Queue:        t.Queue,
+			Type:         t.Type,
+			State:        t.State.String(),
+			Retried:      t.Retried,
+			MaxRetry:     t.MaxRetry,
+			LastError:    t.LastErr,
+			LastFailedAt: t.LastFailedAt.UTC(),
+		}
+		if t.State == asynq.TaskStateRetry {
+			f.NextProcessAt = t.NextProcessAt.UTC()
+		}
+		f.Payload, f.PayloadNote = Summarize(t.Payload)
+		resp.Failures = append(resp.Failures, f)
+	}
+	return resp, nil
+}
+
+// Workers lists the running worker servers
+func (h *Handler) Workers() (*WorkersResponse, error) {
+	servers, err := h.inspector.Servers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %v", err)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	resp := &WorkersResponse{Workers: make([]Worker, 0, len(servers))}
+	for _, s := range servers {
+		w := Worker{
+			ID:          s.ID,
+			Host:        s.Host,
+			PID:         s.PID,
+			Status:      s.Status,
+			Concurrency: s.Concurrency,
+			Queues:      s.Queues,
+			Started:     s.Started.UTC(),
+			Active:      make([]ActiveTask, 0, len(s.ActiveWorkers)),
+		}
+		if w.Queues == nil {
+			w.Queues = map[string]int{}
+		}
+		for _, a := range s.ActiveWorkers {
+			w.Active = append(w.Active, ActiveTask{TaskID: a.TaskID, Type: a.TaskType, Queue: a.Queue, Started: a.Started.UTC()})
+		}
+		sort.Slice(w.Active, func(i, j int) bool { return w.Active[i].TaskID < w.Active[j].TaskID })
+		resp.Workers = append(resp.Workers, w)
+	}
+	return resp, nil
+}
+
+// Scheduler lists the periodic entries of every scheduler
+func (h *Handler) Scheduler(ctx context.Context) (*SchedulerResponse, error) {
+	entries, err := h.inspector.SchedulerEntries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scheduler entries: %v", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Next.Equal(entries[j].Next) {
+			return entries[i].Next.Before(entries[j].Next)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	resp := &SchedulerResponse{Entries: make([]SchedulerEntry, 0, len(entries)), OneShots: []scheduler.OneShotStatus{}}
+	for _, e := range entries {
+		resp.Entries = append(resp.Entries, SchedulerEntry{ID: e.ID, Spec: e.Spec, Type: e.Task.Type(), Next: e.Next.UTC(), Prev: e.Prev.UTC()})
+	}
+	if h.OneShots == nil {
+		return resp, nil
+	}
+	shots, err := h.OneShots.OneShots()
+	if err != nil {
+		return nil, err
+	}
+	if resp.OneShots, err = scheduler.OneShotStatuses(ctx, h.inspector, h.rdb, shots, h.OneShotGrace, time.Now()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// visibleFields are the payload fields whose string values are shown;
+// the others may hold personal data
+var visibleFields = map[string]bool{
+	"category":  true,
+	"locale":    true,
+	"source":    true,
+	"tenant_id": true,
+	"timezone":  true,
+}
+
+// Redacted replaces the values Summarize hides
+const Redacted = "[redacted]"
+
+// Summarize returns the redacted summary of a task payload: numbers and
+// booleans are kept, strings only for visibleFields, nested values never.
+// Encrypted and non-object payloads are summarized by a note instead.
+func Summarize(payload []byte) (map[string]interface{}, string) {
+	payload, _ = metadata.Unwrap(payload)
+	summary := map[string]interface{}{}
+	if crypto.IsEncrypted(payload) {
+		return summary, "encrypted"
+	}
+	if len(payload) == 0 {
+		return summary, "empty"
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return summary, "not a JSON object"
+	}
+	for k, v := range fields {
+		switch v := v.(type) {
+		case nil, bool, float64:
+			summary[k] = v
+		case string:
+			if visibleFields[k] {
+				summary[k] = v
+			} else {
+				summary[k] = Redacted
+			}
+		default:
+			summary[k] = Redacted
+		}
+	}
+	return summary, ""
+}
@@ -0,0 +1,32 @@
+//go:build !debug
+
+package debug
+
+import (
+	"net/http"
+
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+)
+
+// Enabled reports whether task interception was compiled in
+const Enabled = false
+
+// Interceptor is only functional in builds with the debug tag
+type Interceptor struct{}
+
+// NewInterceptor returns an interceptor that never holds tasks
+func NewInterceptor() *Interceptor {
+	return &Interceptor{}
+}
+
+// InterceptingMiddleware passes tasks through in builds without the debug tag
+func InterceptingMiddleware(i *Interceptor) middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler { return next }
+}
+
+// Handler reports that the debug API is not compiled in
+func Handler(i *Interceptor) http.Handler {
+	return http.NotFoundHandler()
+}
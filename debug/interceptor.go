@@ -0,0 +1,151 @@
+//go:build debug
+
+// Package debug pauses tasks before their handler runs so a developer can
+// inspect state mid-flight and then let each task continue or skip it.
+package debug
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+)
+
+// Enabled reports whether task interception was compiled in
+const Enabled = true
+
+// PendingTask is a task held by the interceptor
+type PendingTask struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Payload string    `json:"payload"`
+	Since   time.Time `json:"since"`
+
+	decision chan bool
+}
+
+// Interceptor holds tasks until they are continued or skipped
+type Interceptor struct {
+	enabled *atomic.Bool
+	pending sync.Map // task ID -> *PendingTask
+}
+
+// NewInterceptor creates a disabled interceptor
+func NewInterceptor() *Interceptor {
+	return &Interceptor{enabled: &atomic.Bool{}}
+}
+
+// SetEnabled turns interception on or off. Turning it off continues all
+// held tasks.
+func (i *Interceptor) SetEnabled(on bool) {
+	i.enabled.Store(on)
+	if on {
+		return
+	}
+	i.pending.Range(func(key, _ interface{}) bool {
+		i.release(key.(string), true)
+		return true
+	})
+}
+
+// Continue runs a held task's handler
+func (i *Interceptor) Continue(taskID string) error {
+	return i.release(taskID, true)
+}
+
+// Skip completes a held task without running its handler
+func (i *Interceptor) Skip(taskID string) error {
+	return i.release(taskID, false)
+}
+
+func (i *Interceptor) release(taskID string, run bool) error {
+	v, ok := i.pending.LoadAndDelete(taskID)
+	if !ok {
+		return fmt.Errorf("task %s is not held", taskID)
+	}
+	v.(*PendingTask).decision <- run
+	return nil
+}
+
+// Pending lists the held tasks, oldest first
+func (i *Interceptor) Pending() []*PendingTask {
+	var tasks []*PendingTask
+	i.pending.Range(func(_, v interface{}) bool {
+		tasks = append(tasks, v.(*PendingTask))
+		return true
+	})
+	sort.Slice(tasks, func(a, b int) bool { return tasks[a].Since.Before(tasks[b].Since) })
+	return tasks
+}
+
+// InterceptingMiddleware holds every task while interception is enabled
+func InterceptingMiddleware(i *Interceptor) middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			if !i.enabled.Load() {
+				return next.ProcessTask(ctx, t)
+			}
+			id, _ := asynq.GetTaskID(ctx)
+			p := &PendingTask{ID: id, Type: t.Type(), Payload: string(t.Payload()), Since: time.Now(), decision: make(chan bool, 1)}
+			i.pending.Store(id, p)
+			fmt.Printf("⏸️  [Debug] Holding %s task %s\n", t.Type(), id)
+			select {
+			case run := <-p.decision:
+				if !run {
+					fmt.Printf("⏭️  [Debug] Skipped task %s\n", id)
+					return nil
+				}
+				return next.ProcessTask(ctx, t)
+			case <-ctx.Done():
+				i.pending.Delete(id)
+				return ctx.Err()
+			}
+		})
+	}
+}
+
+// Handler serves the debug API:
+//
+//	GET  /debug/tasks/                list held tasks
+//	POST /debug/tasks/{id}/continue   run a held task
+//	POST /debug/tasks/{id}/skip       drop a held task
+//	POST /debug/intercept?enabled=... turn interception on or off
+func Handler(i *Interceptor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/intercept" {
+			if r.Method != http.MethodPost {
+				admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			on := r.URL.Query().Get("enabled") == "true"
+			i.SetEnabled(on)
+			admin.WriteJSON(w, http.StatusOK, map[string]bool{"enabled": on})
+			return
+		}
+		seg := admin.PathSegments(r, "/debug/tasks/")
+		switch {
+		case len(seg) == 0 && r.Method == http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, i.Pending())
+		case len(seg) == 2 && r.Method == http.MethodPost && (seg[1] == "continue" || seg[1] == "skip"):
+			release := i.Continue
+			if seg[1] == "skip" {
+				release = i.Skip
+			}
+			if err := release(seg[0]); err != nil {
+				admin.WriteError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, map[string]string{"id": seg[0], "action": seg[1]})
+		default:
+			admin.WriteError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
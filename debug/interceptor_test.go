@@ -0,0 +1,141 @@
+//go:build debug
+
+package debug_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/debug"
+	"asynqdemo/leak/leaktest"
+
+	"github.com/hibiken/asynq"
+)
+
+// waitHeld polls until the interceptor holds n tasks
+func waitHeld(t *testing.T, i *debug.Interceptor, n int) []*debug.PendingTask {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		held := i.Pending()
+		if len(held) == n {
+			return held
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d tasks held, want %d", len(held), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestInterceptor processes tasks through a worker with interception on
+// and fails unless a held task's handler runs only after Continue, a
+// skipped task completes without it, the admin endpoints release tasks and
+// refuse unknown ones, and turning interception off releases what is held
+// and lets later tasks through.
+func TestInterceptor(t *testing.T) {
+	leaktest.Check(t)
+	srv := leaktest.Redis(t)
+	i := debug.NewInterceptor()
+	i.SetEnabled(true)
+
+	var mu sync.Mutex
+	ran := map[string]bool{}
+	done := make(chan string, 10)
+	mux := asynq.NewServeMux()
+	mux.Use(debug.InterceptingMiddleware(i))
+	mux.HandleFunc("debug:test", func(ctx context.Context, task *asynq.Task) error {
+		id, _ := asynq.GetTaskID(ctx)
+		mu.Lock()
+		ran[id] = true
+		mu.Unlock()
+		done <- id
+		return nil
+	})
+	hasRun := func(id string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return ran[id]
+	}
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 4, LogLevel: asynq.FatalLevel})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	enqueue := func(id string) {
+		t.Helper()
+		if _, err := client.Enqueue(asynq.NewTask("debug:test", []byte(`{"n":1}`), asynq.TaskID(id))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait := func(id string) {
+		t.Helper()
+		select {
+		case got := <-done:
+			if got != id {
+				t.Fatalf("handler ran %s, want %s", got, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler of %s never ran", id)
+		}
+	}
+
+	enqueue("held")
+	held := waitHeld(t, i, 1)
+	if held[0].ID != "held" || held[0].Type != "debug:test" || held[0].Payload != `{"n":1}` {
+		t.Errorf("holding %+v", held[0])
+	}
+	time.Sleep(100 * time.Millisecond)
+	if hasRun("held") {
+		t.Fatal("handler ran before Continue")
+	}
+	if err := i.Continue("held"); err != nil {
+		t.Fatal(err)
+	}
+	wait("held")
+	if err := i.Continue("held"); err == nil {
+		t.Error("continued a task that is no longer held")
+	}
+
+	enqueue("skipped")
+	waitHeld(t, i, 1)
+	if err := i.Skip("skipped"); err != nil {
+		t.Fatal(err)
+	}
+	waitHeld(t, i, 0)
+	time.Sleep(100 * time.Millisecond)
+	if hasRun("skipped") {
+		t.Error("handler of a skipped task ran")
+	}
+
+	api := debug.Handler(i)
+	serve := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+	enqueue("api")
+	waitHeld(t, i, 1)
+	if code := serve(http.MethodPost, "/debug/tasks/unknown/continue"); code != http.StatusNotFound {
+		t.Errorf("continuing an unknown task gave %d", code)
+	}
+	if code := serve(http.MethodPost, "/debug/tasks/api/continue"); code != http.StatusOK {
+		t.Errorf("continue endpoint gave %d", code)
+	}
+	wait("api")
+
+	enqueue("released")
+	waitHeld(t, i, 1)
+	if code := serve(http.MethodPost, "/debug/intercept?enabled=false"); code != http.StatusOK {
+		t.Errorf("intercept endpoint gave %d", code)
+	}
+	wait("released")
+	enqueue("through")
+	wait("through")
+}
@@ -0,0 +1,70 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// CanonicalJSON re-serializes a JSON document with object keys sorted at every
+// level and insignificant whitespace removed, so that payloads differing only
+// in field order compare equal. Numbers are kept verbatim.
+func CanonicalJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("failed to parse payload: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("failed to parse payload: trailing data after JSON value")
+	}
+
+	// encoding/json writes map keys in sorted order, which is all the
+	// normalization nested objects need
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, fmt.Errorf("failed to serialize canonical payload: %v", err)
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// CanonicalHash returns the hex SHA-256 of the canonical form of a JSON document
+func CanonicalHash(data []byte) (string, error) {
+	canonical, err := CanonicalJSON(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// EnqueueWithContentDedup enqueues the task with its payload in canonical form
+// and asynq's uniqueness lock held for window. It reports true, and no task
+// info, when an equal payload of the same type was already enqueued in the
+// same queue within the window. Options given to asynq.NewTask cannot be read
+// back from the task, so pass them in opts.
+func EnqueueWithContentDedup(client *asynq.Client, task *asynq.Task, window time.Duration, opts ...asynq.Option) (*asynq.TaskInfo, bool, error) {
+	canonical, err := CanonicalJSON(task.Payload())
+	if err != nil {
+		return nil, false, err
+	}
+	opts = append(opts, asynq.Unique(window))
+	info, err := client.Enqueue(asynq.NewTask(task.Type(), canonical), opts...)
+	if errors.Is(err, asynq.ErrDuplicateTask) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return info, false, nil
+}
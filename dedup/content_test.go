@@ -0,0 +1,84 @@
+package dedup_test
+
+import (
+	"testing"
+	"time"
+
+	"asynqdemo/dedup"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestCanonicalHash fails unless payloads differing only in field order or
+// whitespace hash alike, at every nesting level, and a changed value does not
+func TestCanonicalHash(t *testing.T) {
+	hash := func(s string) string {
+		t.Helper()
+		h, err := dedup.CanonicalHash([]byte(s))
+		if err != nil {
+			t.Fatalf("hash of %s: %v", s, err)
+		}
+		return h
+	}
+	if hash(`{"a":1,"b":2}`) != hash(`{"b":2,"a":1}`) {
+		t.Error("field order changed the hash")
+	}
+	if hash(`{"x":{"a":1,"b":[{"d":4,"c":3}]},"y":true}`) != hash(` {"y": true, "x": {"b": [{"c": 3, "d": 4}], "a": 1}} `) {
+		t.Error("field order of nested objects changed the hash")
+	}
+	if hash(`{"a":1,"b":2}`) == hash(`{"a":1,"b":3}`) {
+		t.Error("different values hash alike")
+	}
+	if hash(`{"n":1}`) == hash(`{"n":1.0}`) {
+		t.Error("numbers were not kept verbatim")
+	}
+
+	canonical, err := dedup.CanonicalJSON([]byte(`{"b":"<x>","a":[2,1]}`))
+	if err != nil || string(canonical) != `{"a":[2,1],"b":"<x>"}` {
+		t.Errorf("canonical form %s (%v)", canonical, err)
+	}
+	for _, bad := range []string{`{"a":`, `{"a":1} {"b":2}`, ``} {
+		if _, err := dedup.CanonicalHash([]byte(bad)); err == nil {
+			t.Errorf("%q hashed", bad)
+		}
+	}
+}
+
+// TestEnqueueWithContentDedup fails unless a reordered payload enqueued
+// within the window is reported as a duplicate, other payloads and queues
+// are enqueued, and the stored payload is the canonical form
+func TestEnqueueWithContentDedup(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+
+	enqueue := func(payload string, opts ...asynq.Option) (*asynq.TaskInfo, bool) {
+		t.Helper()
+		info, dup, err := dedup.EnqueueWithContentDedup(client, asynq.NewTask("dedup:content", []byte(payload)), time.Hour, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info, dup
+	}
+	info, dup := enqueue(`{"to":"a@example.com", "subject":"hi"}`)
+	if dup || info == nil || string(info.Payload) != `{"subject":"hi","to":"a@example.com"}` {
+		t.Fatalf("first enqueue: duplicate %v, info %+v", dup, info)
+	}
+	if info, dup := enqueue(`{"subject":"hi","to":"a@example.com"}`); !dup || info != nil {
+		t.Errorf("reordered payload: duplicate %v, info %+v", dup, info)
+	}
+	if _, dup := enqueue(`{"subject":"hello","to":"a@example.com"}`); dup {
+		t.Error("different payload reported as a duplicate")
+	}
+	if _, dup := enqueue(`{"to":"a@example.com","subject":"hi"}`, asynq.Queue("critical")); dup {
+		t.Error("same payload on another queue reported as a duplicate")
+	}
+	if _, _, err := dedup.EnqueueWithContentDedup(client, asynq.NewTask("dedup:content", []byte("not json")), time.Hour); err == nil {
+		t.Error("invalid payload enqueued")
+	}
+}
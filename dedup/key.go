@@ -0,0 +1,106 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultNamespace prefixes the dedup keys, outside asynq's "asynq:" keys
+const DefaultNamespace = "dedup:"
+
+// KeyOpt is the asynq.OptionType of DeduplicateBy, past asynq's own types.
+// asynq ignores the option; a Deduplicator acts on it.
+const KeyOpt asynq.OptionType = 100
+
+// ErrDuplicateTask is returned for a task whose dedup key was claimed by
+// another task within the window
+type ErrDuplicateTask struct {
+	Type string
+	Key  string
+}
+
+func (e ErrDuplicateTask) Error() string {
+	return fmt.Sprintf("duplicate %s task: key %q was enqueued within the dedup window", e.Type, e.Key)
+}
+
+// keyOption is the option of DeduplicateBy
+type keyOption struct {
+	keyFn  func(payload []byte) string
+	window time.Duration
+}
+
+func (o keyOption) String() string         { return fmt.Sprintf("DeduplicateBy(%v)", o.window) }
+func (o keyOption) Type() asynq.OptionType { return KeyOpt }
+func (o keyOption) Value() interface{}     { return o.window }
+
+// DeduplicateBy makes Deduplicator.Claim refuse a task whose payload has
+// the same keyFn key as a task claimed within window. An empty key is never
+// a duplicate.
+func DeduplicateBy(keyFn func(payload []byte) string, window time.Duration) asynq.Option {
+	return keyOption{keyFn: keyFn, window: window}
+}
+
+// Deduplicator claims the keys of the DeduplicateBy options of tasks before
+// they are enqueued
+type Deduplicator struct {
+	rdb redis.UniversalClient
+	// Namespace prefixes the keys, DefaultNamespace by default
+	Namespace string
+}
+
+// NewDeduplicator creates a deduplicator keeping its keys in rdb
+func NewDeduplicator(rdb redis.UniversalClient) *Deduplicator {
+	return &Deduplicator{rdb: rdb, Namespace: DefaultNamespace}
+}
+
+// Claim stores the key of each DeduplicateBy option in opts for its window
+// and returns the Redis keys stored, or ErrDuplicateTask when one is held
+// already. Keys claimed before the duplicate are released. A nil
+// Deduplicator claims nothing.
+func (d *Deduplicator) Claim(ctx context.Context, taskType string, payload []byte, opts ...asynq.Option) ([]string, error) {
+	if d == nil {
+		return nil, nil
+	}
+	var claimed []string
+	for _, opt := range opts {
+		o, ok := opt.(keyOption)
+		if !ok {
+			continue
+		}
+		key := o.keyFn(payload)
+		if key == "" {
+			continue
+		}
+		redisKey := d.Namespace + taskType + ":" + key
+		ok, err := d.rdb.SetNX(ctx, redisKey, time.Now().Unix(), o.window).Result()
+		if err != nil {
+			d.Release(ctx, claimed)
+			return nil, fmt.Errorf("failed to claim dedup key of %s: %v", taskType, err)
+		}
+		if !ok {
+			d.Release(ctx, claimed)
+			return nil, ErrDuplicateTask{Type: taskType, Key: key}
+		}
+		claimed = append(claimed, redisKey)
+	}
+	return claimed, nil
+}
+
+// Release deletes keys returned by Claim, so a task that could not be
+// enqueued after all can be retried at once. The keys are deleted one by
+// one, as they may live in different Redis Cluster slots.
+func (d *Deduplicator) Release(ctx context.Context, keys []string) {
+	if d == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := d.rdb.Del(ctx, key).Err(); err != nil {
+			log.Printf("⚠️  Failed to release dedup key %s: %v", key, err)
+		}
+	}
+}
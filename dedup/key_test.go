@@ -0,0 +1,104 @@
+package dedup_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/dedup"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestDeduplicateBy runs a producer loop over emails twice on an
+// embedded Redis, as after a crash, and fails unless the second run
+// enqueues nothing, emails differing only in their message count as the
+// same task, the keys live under the configured namespace, a released key
+// or one whose window passed can be enqueued again, and tasks without the
+// option are never refused.
+func TestDeduplicateBy(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	ctx := context.Background()
+
+	d := dedup.NewDeduplicator(rdb)
+	d.Namespace = "test-dedup:"
+	const window = time.Second
+	email := func(userID int, subject, message string) []byte {
+		data, _ := json.Marshal(common.EmailPayload{UserID: userID, Email: "u@example.com", Subject: subject, Message: message})
+		return data
+	}
+	produce := func(payload []byte, opts ...asynq.Option) error {
+		t.Helper()
+		keys, err := d.Claim(ctx, common.TypeEmailTask, payload, opts...)
+		if err != nil {
+			return err
+		}
+		if _, err := client.Enqueue(asynq.NewTask(common.TypeEmailTask, payload), opts...); err != nil {
+			d.Release(ctx, keys)
+			t.Fatal(err)
+		}
+		return nil
+	}
+	byEmail := dedup.DeduplicateBy(common.EmailDedupKey, window)
+	emails := [][]byte{email(1, "Welcome", "hi"), email(2, "Welcome", "hi"), email(1, "Invoice", "due")}
+
+	for _, p := range emails {
+		if err := produce(p, byEmail); err != nil {
+			t.Fatalf("first run: %v", err)
+		}
+	}
+	for _, p := range append(emails, email(1, "Welcome", "reworded")) {
+		var dup dedup.ErrDuplicateTask
+		if err := produce(p, byEmail); !errors.As(err, &dup) || dup.Type != common.TypeEmailTask {
+			t.Errorf("restarted run enqueued %s again: %v", p, err)
+		}
+	}
+	if info, err := inspector.GetQueueInfo("default"); err != nil || info.Size != len(emails) {
+		t.Errorf("queue holds %+v (%v), want the %d emails of the first run", info, err, len(emails))
+	}
+	if n, err := rdb.Exists(ctx, "test-dedup:"+common.TypeEmailTask+":1:Welcome").Result(); err != nil || n != 1 {
+		t.Errorf("key of user 1 not under the namespace: %d (%v)", n, err)
+	}
+	if err := produce(email(1, "Welcome", "hi")); err != nil {
+		t.Errorf("task without DeduplicateBy refused: %v", err)
+	}
+	if err := produce([]byte(`{"email":"anon@example.com"}`), byEmail); err != nil {
+		t.Errorf("email without a user, so without a key, refused: %v", err)
+	}
+
+	keys, err := d.Claim(ctx, common.TypeEmailTask, email(3, "Reset", ""), byEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Release(ctx, keys)
+	if err := produce(email(3, "Reset", ""), byEmail); err != nil {
+		t.Errorf("released key refused: %v", err)
+	}
+
+	// Once the window passes the same emails are enqueued again
+	time.Sleep(window + 300*time.Millisecond)
+	for _, p := range emails {
+		if err := produce(p, byEmail); err != nil {
+			t.Errorf("email after the window refused: %v", err)
+		}
+	}
+	var nilDeduper *dedup.Deduplicator
+	if keys, err := nilDeduper.Claim(ctx, common.TypeEmailTask, emails[0], byEmail); err != nil || keys != nil {
+		t.Errorf("nil deduplicator claimed %v (%v)", keys, err)
+	}
+}
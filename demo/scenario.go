@@ -0,0 +1,158 @@
+// Package demo runs scripted sample tasks for demo environments. Nothing in
+// it runs unless the worker is started with --demo or DEMO=1.
+package demo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/dedup"
+
+	"github.com/hibiken/asynq"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is the scenario run when no other is given
+const DefaultFile = "demo.yaml"
+
+// Enabled reports whether demo mode is on through the flag or DEMO=1
+func Enabled(flag bool) bool {
+	return flag || os.Getenv("DEMO") == "1"
+}
+
+// Step is one task of a scenario
+type Step struct {
+	Type    string                 `yaml:"type"`
+	Payload map[string]interface{} `yaml:"payload"`
+	// Delay postpones processing, e.g. "300ms"; zero processes right away
+	Delay time.Duration `yaml:"delay"`
+	// Queue overrides the queue the producer would pick
+	Queue string `yaml:"queue"`
+}
+
+// Scenario is a list of tasks to enqueue
+type Scenario struct {
+	Name  string `yaml:"name"`
+	Tasks []Step `yaml:"tasks"`
+
+	// payloads holds the validated JSON payload of every step
+	payloads [][]byte
+}
+
+// Load reads a scenario and checks every payload against its task type
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %v", err)
+	}
+	var s Scenario
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario %s: %v", path, err)
+	}
+	if s.Name == "" {
+		s.Name = path
+	}
+	for i, step := range s.Tasks {
+		payload, err := json.Marshal(step.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("task %d of %s: failed to marshal payload: %v", i+1, path, err)
+		}
+		if err := common.ValidatePayload(step.Type, payload); err != nil {
+			return nil, fmt.Errorf("task %d of %s: %v", i+1, path, err)
+		}
+		s.payloads = append(s.payloads, payload)
+	}
+	return &s, nil
+}
+
+// Enqueuer enqueues a task the way the worker's producers do
+type Enqueuer func(ctx context.Context, taskType string, payload []byte, opts ...asynq.Option) (*asynq.TaskInfo, error)
+
+// Summary reports one run of a scenario
+type Summary struct {
+	Enqueued map[string]int
+	// Duplicates were skipped as enqueued before, e.g. by a run that crashed
+	Duplicates int
+	Failed     int
+	Took       time.Duration
+}
+
+// String formats the summary on one line
+func (s Summary) String() string {
+	types := make([]string, 0, len(s.Enqueued))
+	for t := range s.Enqueued {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	parts := make([]string, len(types))
+	total := 0
+	for i, t := range types {
+		parts[i] = fmt.Sprintf("%s: %d", t, s.Enqueued[t])
+		total += s.Enqueued[t]
+	}
+	return fmt.Sprintf("%d enqueued (%s), %d duplicates skipped, %d failed in %v", total, strings.Join(parts, ", "), s.Duplicates, s.Failed, s.Took.Round(time.Millisecond))
+}
+
+// Run enqueues every task of the scenario once
+func (s *Scenario) Run(ctx context.Context, enqueue Enqueuer) Summary {
+	start := time.Now()
+	sum := Summary{Enqueued: make(map[string]int)}
+	for i, step := range s.Tasks {
+		var opts []asynq.Option
+		if step.Queue != "" {
+			opts = append(opts, asynq.Queue(step.Queue))
+		}
+		if step.Delay > 0 {
+			opts = append(opts, asynq.ProcessIn(step.Delay))
+		}
+		info, err := enqueue(ctx, step.Type, s.payloads[i], opts...)
+		var dup dedup.ErrDuplicateTask
+		if errors.As(err, &dup) {
+			fmt.Printf("⏭️  [Demo] Skipped %s task %d: %v\n", step.Type, i+1, err)
+			sum.Duplicates++
+			continue
+		}
+		if err != nil {
+			fmt.Printf("❌ [Demo] Failed to enqueue %s task %d: %v\n", step.Type, i+1, err)
+			sum.Failed++
+			continue
+		}
+		fmt.Printf("✅ [Demo] Enqueued %s task (ID: %s)\n", step.Type, info.ID)
+		sum.Enqueued[step.Type]++
+	}
+	sum.Took = time.Since(start)
+	return sum
+}
+
+// Runner runs a scenario once, or every Interval when it is set
+type Runner struct {
+	Scenario *Scenario
+	Enqueue  Enqueuer
+	Interval time.Duration
+}
+
+// Run runs the scenario until it is done or ctx is
+func (r *Runner) Run(ctx context.Context) error {
+	for round := 1; ; round++ {
+		fmt.Printf("📤 [Demo] Running scenario %s (round %d)\n", r.Scenario.Name, round)
+		sum := r.Scenario.Run(ctx, r.Enqueue)
+		fmt.Printf("🎉 [Demo] %s: %s\n", r.Scenario.Name, sum)
+		if r.Interval <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.Interval):
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package demo_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"asynqdemo/demo"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestScenario runs the default demo scenario against an embedded Redis
+// with a plain client and fails unless every queue gained one pending or
+// scheduled task per step
+func TestScenario(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	scenario, err := demo.Load(filepath.Join("..", demo.DefaultFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := asynq.NewClient(r)
+	defer client.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+
+	want := make(map[string]int)
+	for _, step := range scenario.Tasks {
+		q := step.Queue
+		if q == "" {
+			q = "default"
+		}
+		want[q]++
+	}
+	count := func(q string) int {
+		info, err := inspector.GetQueueInfo(q)
+		if err != nil {
+			return 0
+		}
+		return info.Pending + info.Scheduled
+	}
+	before := make(map[string]int)
+	for q := range want {
+		before[q] = count(q)
+	}
+
+	enqueue := func(ctx context.Context, taskType string, payload []byte, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+		return client.EnqueueContext(ctx, asynq.NewTask(taskType, payload), opts...)
+	}
+	sum := scenario.Run(context.Background(), enqueue)
+	if sum.Failed > 0 {
+		t.Fatalf("scenario %s: %s", scenario.Name, sum)
+	}
+	for q, n := range want {
+		if got := count(q) - before[q]; got != n {
+			t.Errorf("queue %s gained %d tasks, want %d", q, got, n)
+		}
+	}
+}
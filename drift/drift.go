@@ -0,0 +1,245 @@
+// Package drift detects fields of task payloads that the payload structs do
+// not know and json.Unmarshal drops silently, e.g. when a producer written
+// in another language adds one.
+package drift
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// typesKey is the set of task types with unknown fields
+	typesKey = "schema:drift:types"
+	// reportedKey is the set of "type path" fields the summary reported
+	reportedKey = "schema:drift:reported"
+)
+
+// fieldsKey is the hash of the unknown fields of a type, with a count,
+// an example and the first and last time seen of each
+func fieldsKey(taskType string) string {
+	return "schema:drift:" + taskType
+}
+
+// Field is an unknown field observed in the payloads of a task type
+type Field struct {
+	Type string `json:"type"`
+	// Path locates the field, e.g. "address.zip" or "items[].sku"
+	Path  string `json:"path"`
+	Count int64  `json:"count"`
+	// Example is the last value seen, redacted to its type and size
+	Example   string    `json:"example"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Detector samples task payloads and records their unknown fields in Redis
+type Detector struct {
+	rdb redis.UniversalClient
+	// Rate is the fraction of tasks checked, from 0 to 1
+	Rate float64
+	// Sample returns a number in [0, 1); a task is checked when it is
+	// below Rate
+	Sample func() float64
+}
+
+// NewDetector creates a detector checking the given fraction of tasks
+func NewDetector(rdb redis.UniversalClient, rate float64) *Detector {
+	return &Detector{rdb: rdb, Rate: rate, Sample: rand.Float64}
+}
+
+// Observe records the fields of payload that its type's registered payload
+// struct does not know, and returns their paths
+func (d *Detector) Observe(ctx context.Context, taskType string, payload []byte) ([]string, error) {
+	spec, ok := common.LookupTaskSpec(taskType)
+	if !ok || spec.NewPayload == nil {
+		return nil, nil
+	}
+	found, err := Unknown(spec.NewPayload(), payload)
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	key := fieldsKey(taskType)
+	_, err = d.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, typesKey, taskType)
+		for _, path := range paths {
+			pipe.HIncrBy(ctx, key, path+"|count", 1)
+			pipe.HSetNX(ctx, key, path+"|first", now)
+			pipe.HSet(ctx, key, path+"|last", now, path+"|example", Redact(found[path]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record unknown fields of %s: %v", taskType, err)
+	}
+	return paths, nil
+}
+
+// Middleware checks the sampled share of the tasks it runs. Install it
+// after the metadata and decrypt middlewares so it sees the plain payload;
+// it never fails a task.
+func (d *Detector) Middleware() asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			if d.Rate > 0 && d.Sample() < d.Rate {
+				if _, err := d.Observe(ctx, t.Type(), t.Payload()); err != nil {
+					log.Printf("⚠️  Schema drift check of %s: %v", t.Type(), err)
+				}
+			}
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
+
+// Fields returns the unknown fields recorded, by type and path
+func (d *Detector) Fields(ctx context.Context) ([]Field, error) {
+	types, err := d.rdb.SMembers(ctx, typesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schema drift: %v", err)
+	}
+	sort.Strings(types)
+	var fields []Field
+	for _, taskType := range types {
+		values, err := d.rdb.HGetAll(ctx, fieldsKey(taskType)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema drift of %s: %v", taskType, err)
+		}
+		byPath := make(map[string]*Field)
+		for name, value := range values {
+			i := strings.LastIndex(name, "|")
+			if i < 0 {
+				continue
+			}
+			path := name[:i]
+			f := byPath[path]
+			if f == nil {
+				f = &Field{Type: taskType, Path: path}
+				byPath[path] = f
+			}
+			switch name[i+1:] {
+			case "count":
+				f.Count, _ = strconv.ParseInt(value, 10, 64)
+			case "example":
+				f.Example = value
+			case "first":
+				sec, _ := strconv.ParseInt(value, 10, 64)
+				f.FirstSeen = time.Unix(sec, 0).UTC()
+			case "last":
+				sec, _ := strconv.ParseInt(value, 10, 64)
+				f.LastSeen = time.Unix(sec, 0).UTC()
+			}
+		}
+		paths := make([]string, 0, len(byPath))
+		for path := range byPath {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fields = append(fields, *byPath[path])
+		}
+	}
+	return fields, nil
+}
+
+// Handler serves GET /admin/schema-drift, the unknown fields recorded,
+// limited to one task type with ?type=
+func Handler(d *Detector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		fields, err := d.Fields(r.Context())
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		out := []Field{}
+		for _, f := range fields {
+			if taskType := r.URL.Query().Get("type"); taskType == "" || f.Type == taskType {
+				out = append(out, f)
+			}
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"sample_rate": d.Rate, "fields": out})
+	})
+}
+
+// Summary alerts about unknown fields that appeared since its last check;
+// each field is reported once, by whichever instance sees it first
+type Summary struct {
+	d     *Detector
+	alert func(ctx context.Context, text string) error
+	// Interval is how often Run checks
+	Interval time.Duration
+}
+
+// NewSummary creates an hourly summary alerting through alert; nil only logs
+func NewSummary(d *Detector, alert func(ctx context.Context, text string) error) *Summary {
+	return &Summary{d: d, alert: alert, Interval: time.Hour}
+}
+
+// Check reports the fields not reported before and returns the text sent,
+// empty when there are none
+func (s *Summary) Check(ctx context.Context) (string, error) {
+	fields, err := s.d.Fields(ctx)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, f := range fields {
+		added, err := s.d.rdb.SAdd(ctx, reportedKey, f.Type+" "+f.Path).Result()
+		if err != nil {
+			return "", fmt.Errorf("failed to mark schema drift reported: %v", err)
+		}
+		if added == 1 {
+			lines = append(lines, fmt.Sprintf("%s %s (%d times, e.g. %s)", f.Type, f.Path, f.Count, f.Example))
+		}
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	text := fmt.Sprintf("%d new unknown payload fields, dropped when decoding: %s; see /admin/schema-drift", len(lines), strings.Join(lines, ", "))
+	log.Printf("⚠️  %s", text)
+	if s.alert != nil {
+		if err := s.alert(ctx, text); err != nil {
+			return text, fmt.Errorf("failed to send the schema drift summary: %v", err)
+		}
+	}
+	return text, nil
+}
+
+// Run checks every Interval until ctx is done
+func (s *Summary) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if _, err := s.Check(ctx); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+	}
+}
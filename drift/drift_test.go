@@ -0,0 +1,163 @@
+package drift_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/drift"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+const driftOrderType = "drift:order"
+
+// driftOrder is a payload with nested structs, a list of structs, a map and
+// a struct decoding itself
+type driftOrder struct {
+	ID       int `json:"id"`
+	Customer struct {
+		Name string `json:"name"`
+	} `json:"customer"`
+	Items []struct {
+		SKU string `json:"sku"`
+	} `json:"items"`
+	Meta    map[string]string `json:"meta"`
+	Created time.Time         `json:"created"`
+	Secret  string            `json:"-"`
+}
+
+// TestSchemaDrift processes orders carrying fields the payload struct
+// does not know through a worker with the drift middleware on an embedded
+// Redis. It fails unless the unknown top-level, nested and list fields
+// are recorded with counts and redacted examples while known fields, map
+// keys and case variants are not, the summary reports new fields once,
+// and only the sampled share of tasks is checked.
+func TestSchemaDrift(t *testing.T) {
+	common.RegisterTaskSpec(common.TaskSpec{Type: driftOrderType, NewPayload: func() interface{} { return &driftOrder{} }})
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+
+	detector := drift.NewDetector(rdb, 1)
+	processed := make(chan struct{}, 10)
+	mux := asynq.NewServeMux()
+	mux.Use(detector.Middleware())
+	mux.HandleFunc(driftOrderType, func(ctx context.Context, t *asynq.Task) error {
+		processed <- struct{}{}
+		return nil
+	})
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 2, Queues: map[string]int{"default": 1}, LogLevel: asynq.WarnLevel})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+
+	orders := []string{
+		`{"id":1,"customer":{"name":"Ada","tier":"gold"},"items":[{"sku":"A1","price":9.5},{"sku":"B2"}],"meta":{"any":"key"},"created":"2024-01-01T00:00:00Z","coupon":"SPRING-2024-ADA"}`,
+		`{"ID":2,"customer":{"name":"Bob","tier":"silver"},"items":[{"sku":"C3","price":1}],"Secret":"x"}`,
+		`{"id":3,"customer":{"name":"Cy"}}`,
+	}
+	for _, o := range orders {
+		if _, err := client.Enqueue(asynq.NewTask(driftOrderType, []byte(o))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range orders {
+		select {
+		case <-processed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("orders were not processed")
+		}
+	}
+
+	fields, err := detector.Fields(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]drift.Field{}
+	for _, f := range fields {
+		got[f.Path] = f
+	}
+	want := map[string]int64{"Secret": 1, "coupon": 1, "customer.tier": 2, "items[].price": 2}
+	if len(got) != len(want) {
+		t.Errorf("unknown fields %+v, want %v", fields, want)
+	}
+	for path, count := range want {
+		if f := got[path]; f.Count != count || f.Type != driftOrderType || f.FirstSeen.IsZero() {
+			t.Errorf("field %s: %+v, want %d occurrences", path, f, count)
+		}
+	}
+	if ex := got["coupon"].Example; ex != "string(15)" || strings.Contains(ex, "SPRING") {
+		t.Errorf("example of coupon %q, want it redacted", ex)
+	}
+
+	rec := httptest.NewRecorder()
+	drift.Handler(detector).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/schema-drift?type="+driftOrderType, nil))
+	var resp struct {
+		Fields []drift.Field `json:"fields"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || len(resp.Fields) != len(want) {
+		t.Errorf("GET /admin/schema-drift: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var alerts []string
+	summary := drift.NewSummary(detector, func(ctx context.Context, text string) error {
+		alerts = append(alerts, text)
+		return nil
+	})
+	if text, err := summary.Check(context.Background()); err != nil || !strings.Contains(text, "customer.tier") || len(alerts) != 1 {
+		t.Errorf("first summary %q (%v), want the new fields", text, err)
+	}
+	if text, err := summary.Check(context.Background()); err != nil || text != "" {
+		t.Errorf("second summary %q (%v), want nothing new", text, err)
+	}
+
+	// Sampling: only tasks whose draw is below the rate are checked
+	sampled := drift.NewDetector(rdb, 0.25)
+	draws := []float64{0.1, 0.9, 0.5, 0.2, 0.3, 0.99, 0.24, 0.25}
+	sampled.Sample = func() float64 {
+		d := draws[0]
+		draws = draws[1:]
+		return d
+	}
+	sampledMux := asynq.NewServeMux()
+	sampledMux.Use(sampled.Middleware())
+	sampledMux.HandleFunc(driftOrderType, func(context.Context, *asynq.Task) error { return nil })
+	for i := 0; i < 8; i++ {
+		if err := sampledMux.ProcessTask(context.Background(), asynq.NewTask(driftOrderType, []byte(`{"id":4,"sampled":true}`))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	off := drift.NewDetector(rdb, 0)
+	nop := asynq.HandlerFunc(func(context.Context, *asynq.Task) error { return nil })
+	if err := off.Middleware()(nop).ProcessTask(context.Background(), asynq.NewTask(driftOrderType, []byte(`{"unsampled":1}`))); err != nil {
+		t.Fatal(err)
+	}
+	if fields, err = detector.Fields(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int64{}
+	for _, f := range fields {
+		counts[f.Path] = f.Count
+	}
+	if counts["sampled"] != 3 {
+		t.Errorf("sampled field counted %d times, want the 3 draws below 0.25", counts["sampled"])
+	}
+	if counts["unsampled"] != 0 {
+		t.Error("detector with rate 0 checked a task")
+	}
+}
@@ -0,0 +1,149 @@
+package drift
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// schema is the set of JSON keys a struct decodes, with the schema of the
+// values that are structs themselves; nil accepts any key, as for maps
+type schema map[string]*schema
+
+var (
+	rawMessageType  = reflect.TypeOf(json.RawMessage(nil))
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// schemaOf returns the schema of the values of t, nil when t is not a
+// struct or a container of structs. seen holds the schemas being built, so
+// recursive types end.
+func schemaOf(t reflect.Type, seen map[reflect.Type]*schema) *schema {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		if t == rawMessageType {
+			return nil
+		}
+		t = t.Elem()
+	}
+	// Structs decoding themselves, such as time.Time, accept any key
+	if t.Kind() != reflect.Struct || reflect.PointerTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+	if s, ok := seen[t]; ok {
+		return s
+	}
+	s := schema{}
+	seen[t] = &s
+	addFields(s, t, seen)
+	return &s
+}
+
+// addFields adds the keys of the fields of t to s, promoting the fields of
+// embedded structs as encoding/json does
+func addFields(s schema, t reflect.Type, seen map[reflect.Type]*schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			addFields(s, ft, seen)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s[name] = schemaOf(f.Type, seen)
+	}
+}
+
+// field returns the schema of key, matched case-insensitively as
+// encoding/json does
+func (s schema) field(key string) (*schema, bool) {
+	if sub, ok := s[key]; ok {
+		return sub, true
+	}
+	for name, sub := range s {
+		if strings.EqualFold(name, key) {
+			return sub, true
+		}
+	}
+	return nil, false
+}
+
+// unknown returns the paths of the keys of v that s does not know, such as
+// "address.zip" or "items[].sku", with their values
+func (s *schema) unknown(prefix string, v interface{}, found map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			s.unknown(prefix+"[]", item, found)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			sub, ok := s.field(key)
+			if !ok {
+				if _, seen := found[path]; !seen {
+					found[path] = v[key]
+				}
+				continue
+			}
+			sub.unknown(path, v[key], found)
+		}
+	}
+}
+
+// Unknown returns the fields of a JSON payload that decoding it into a
+// value like payload, a pointer to a struct, would drop, with their values
+func Unknown(payload interface{}, data []byte) (map[string]interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %v", err)
+	}
+	found := make(map[string]interface{})
+	schemaOf(reflect.TypeOf(payload), map[reflect.Type]*schema{}).unknown("", v, found)
+	return found, nil
+}
+
+// Redact describes a value by its type and size only, so samples keep no
+// customer data
+func Redact(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("string(%d)", len(v))
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return fmt.Sprintf("array(%d)", len(v))
+	case map[string]interface{}:
+		return fmt.Sprintf("object(%d keys)", len(v))
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,116 @@
+// Package emailhtml renders the HTML bodies of email payloads naming a
+// template. Every <name>.html in the template directory is a template of
+// that name; files starting with "_" are partials every template can use,
+// such as the shared layout.
+package emailhtml
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hibiken/asynq"
+)
+
+//go:embed templates/*.html
+var embedded embed.FS
+
+// View is what a template renders
+type View struct {
+	UserID   int
+	Email    string
+	Subject  string
+	Message  string
+	Locale   string
+	TenantID string
+	Category string
+	// UnsubscribeURL is set for marketing mail
+	UnsubscribeURL string
+	// Data is the TemplateData of the payload
+	Data map[string]interface{}
+}
+
+// ErrUnknownTemplate is returned for a template name the registry has no
+// template of. It wraps asynq.SkipRetry since a retry would not find it
+// either.
+type ErrUnknownTemplate struct {
+	Name string
+}
+
+func (e ErrUnknownTemplate) Error() string {
+	return fmt.Sprintf("unknown HTML email template %q", e.Name)
+}
+
+func (e ErrUnknownTemplate) Unwrap() error {
+	return asynq.SkipRetry
+}
+
+// Registry holds the parsed templates by name
+type Registry struct {
+	templates map[string]*template.Template
+}
+
+// Default returns the registry of the embedded templates
+func Default() (*Registry, error) {
+	return Load(embedded, "templates")
+}
+
+// Load parses every template in dir of fsys, failing on the first that
+// does not parse
+func Load(fsys fs.FS, dir string) (*Registry, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.html"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list HTML email templates: %v", err)
+	}
+	base := template.New("")
+	var pages []string
+	for _, file := range files {
+		if !strings.HasPrefix(path.Base(file), "_") {
+			pages = append(pages, file)
+			continue
+		}
+		if _, err := base.ParseFS(fsys, file); err != nil {
+			return nil, fmt.Errorf("failed to parse HTML email partial %s: %v", file, err)
+		}
+	}
+	r := &Registry{templates: make(map[string]*template.Template, len(pages))}
+	for _, file := range pages {
+		page, err := base.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("failed to clone HTML email partials: %v", err)
+		}
+		if page, err = page.ParseFS(fsys, file); err != nil {
+			return nil, fmt.Errorf("failed to parse HTML email template %s: %v", file, err)
+		}
+		r.templates[strings.TrimSuffix(path.Base(file), ".html")] = page.Lookup(path.Base(file))
+	}
+	return r, nil
+}
+
+// Names returns the names of the templates, sorted
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.templates))
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render renders the template of name with v
+func (r *Registry) Render(name string, v View) (string, error) {
+	t, ok := r.templates[name]
+	if !ok {
+		return "", ErrUnknownTemplate{Name: name}
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, v); err != nil {
+		return "", fmt.Errorf("failed to render HTML email template %s: %v", name, err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,139 @@
+package emailtmpl_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/emailtmpl"
+	"asynqdemo/embeddedredis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TestEmailTemplates stores tenant overrides in an embedded Redis and
+// fails unless templates leaving the sandbox or over the source size cap
+// are refused, a render over its time or output limit fails, a tenant's
+// category override wins over its catch-all override which wins over the
+// default, an update reaches another worker once its cache expires, and an override failing on a real email
+// falls back to the default and alerts its owner once.
+func TestEmailTemplates(t *testing.T) {
+	ctx := context.Background()
+
+	for name, src := range map[string]string{
+		"call":     `{{define "subject"}}{{call .Subject}}{{end}}{{define "body"}}x{{end}}`,
+		"printf":   `{{define "subject"}}{{printf "%999999999d" 1}}{{end}}{{define "body"}}x{{end}}`,
+		"range":    `{{define "subject"}}x{{end}}{{define "body"}}{{range .Message}}x{{end}}{{end}}`,
+		"template": `{{define "subject"}}x{{end}}{{define "body"}}{{template "body" .}}{{end}}`,
+		"define":   `{{define "subject"}}x{{end}}{{define "body"}}x{{end}}{{define "loop"}}x{{end}}`,
+		"no body":  `{{define "subject"}}x{{end}}`,
+	} {
+		if _, err := emailtmpl.Parse(name, src, emailtmpl.DefaultLimits); err == nil {
+			t.Errorf("template using %s was accepted", name)
+		}
+	}
+
+	p := &common.EmailPayload{UserID: 7, Email: "user@example.com", Subject: "Hello", Message: strings.Repeat("m", 200), TenantID: "acme"}
+	slowSource := `{{define "subject"}}x{{end}}{{define "body"}}` + strings.Repeat("{{.Message}}", 10000) + `{{end}}`
+	if _, err := emailtmpl.Parse("slow", slowSource, emailtmpl.DefaultLimits); err == nil {
+		t.Errorf("template of %d bytes was accepted", len(slowSource))
+	}
+	slow, err := emailtmpl.Parse("slow", slowSource, emailtmpl.Limits{MaxSource: len(slowSource)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := emailtmpl.Execute(ctx, slow, p, emailtmpl.Limits{Timeout: time.Microsecond, MaxOutput: 1 << 30}); !errors.Is(err, emailtmpl.ErrTimeout) {
+		t.Errorf("render past its timeout returned %v, want %v", err, emailtmpl.ErrTimeout)
+	}
+	if _, _, err := emailtmpl.Execute(ctx, slow, p, emailtmpl.Limits{Timeout: time.Minute, MaxOutput: 1000}); !errors.Is(err, emailtmpl.ErrTooLarge) {
+		t.Errorf("render over its size cap returned %v, want %v", err, emailtmpl.ErrTooLarge)
+	}
+
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	templates, err := emailtmpl.New(rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alerts []emailtmpl.Override
+	templates.Alert = func(ctx context.Context, o emailtmpl.Override, text string) error {
+		alerts = append(alerts, o)
+		return nil
+	}
+	// Another worker, which has cached that acme has no overrides
+	other, err := emailtmpl.New(rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := func(s *emailtmpl.Templates, tenant, category, locale string) string {
+		t.Helper()
+		q := *p
+		q.TenantID, q.Category, q.Locale = tenant, category, locale
+		subject, _, err := s.Render(ctx, &q)
+		if err != nil {
+			t.Fatalf("render for %s/%s: %v", tenant, category, err)
+		}
+		return subject
+	}
+	if got := subject(other, "acme", common.CategoryMarketing, ""); got != "Hello" {
+		t.Fatalf("default subject is %q, want %q", got, "Hello")
+	}
+
+	if err := templates.Set(ctx, emailtmpl.Override{Tenant: "acme", Category: emailtmpl.AnyCategory, Source: `{{define "subject"}}[Acme] {{.Subject}}{{end}}{{define "body"}}{{.Message}}{{end}}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := templates.Set(ctx, emailtmpl.Override{Tenant: "acme", Category: common.CategoryMarketing, Source: `{{define "subject"}}[Acme News] {{upper .Subject}}{{end}}{{define "body"}}{{.Message}}{{end}}`}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ tenant, category, want string }{
+		{"acme", common.CategoryMarketing, "[Acme News] HELLO"},
+		{"acme", common.CategoryDigest, "[Acme] Hello"},
+		{"acme", "", "[Acme] Hello"},
+		{"globex", common.CategoryMarketing, "Hello"},
+		{"", common.CategoryMarketing, "Hello"},
+	} {
+		if got := subject(templates, c.tenant, c.category, ""); got != c.want {
+			t.Errorf("subject for %q/%q is %q, want %q", c.tenant, c.category, got, c.want)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for subject(other, "acme", common.CategoryMarketing, "") != "[Acme News] HELLO" {
+		if time.Now().After(deadline) {
+			t.Fatal("other worker never picked up the override")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := templates.Delete(ctx, "acme", common.CategoryMarketing); err != nil {
+		t.Fatal(err)
+	}
+	if got := subject(templates, "acme", common.CategoryMarketing, ""); got != "[Acme] Hello" {
+		t.Errorf("subject after deleting the marketing override is %q, want the catch-all's", got)
+	}
+
+	// Passes the sample render on save but fails for German recipients
+	if err := templates.Set(ctx, emailtmpl.Override{Tenant: "acme", Category: common.CategoryDigest, Owner: "owner@acme.example", Source: `{{define "subject"}}{{if eq .Locale "de"}}{{index .Message 1000}}{{end}}Digest{{end}}{{define "body"}}{{.Message}}{{end}}`}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if got := subject(templates, "acme", common.CategoryDigest, "de"); got != "Hello" {
+			t.Fatalf("subject of a failing override is %q, want the default %q", got, "Hello")
+		}
+	}
+	if len(alerts) != 1 || alerts[0].Owner != "owner@acme.example" {
+		t.Errorf("owner alerts of a failing override are %+v, want one to owner@acme.example", alerts)
+	}
+	if got := subject(templates, "acme", common.CategoryDigest, "en"); got != "Digest" {
+		t.Errorf("subject of an override rendering fine is %q, want %q", got, "Digest")
+	}
+	if err := templates.Set(ctx, emailtmpl.Override{Tenant: "acme", Category: common.CategoryDigest, Source: `{{define "subject"}}{{index .Message 1000}}{{end}}{{define "body"}}x{{end}}`}); err == nil {
+		t.Error("override failing the sample render was stored")
+	}
+}
@@ -0,0 +1,84 @@
+package emailtmpl
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"asynqdemo/admin"
+)
+
+// setRequest is the body of PUT /admin/templates/{tenant}/{category}
+type setRequest struct {
+	Source string `json:"source"`
+	Owner  string `json:"owner"`
+}
+
+// Handler serves the tenant overrides: GET /admin/templates/{tenant} lists
+// a tenant's overrides, GET, PUT and DELETE
+// /admin/templates/{tenant}/{category} read, set and remove one. PUT takes
+// {"source": "...", "owner": "..."}; the source must stay within the
+// sandbox and render a sample email, or the override is refused.
+func Handler(s *Templates, authz *admin.Authorizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seg := admin.PathSegments(r, "/admin/templates")
+		switch {
+		case r.Method == http.MethodGet && len(seg) == 1:
+			list, err := s.List(r.Context(), seg[0])
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, list)
+		case r.Method == http.MethodGet && len(seg) == 2:
+			o, err := s.Get(r.Context(), seg[0], seg[1])
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if o == nil {
+				admin.WriteError(w, http.StatusNotFound, "no template override of "+seg[0]+" for "+seg[1])
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, o)
+		case r.Method == http.MethodPut && len(seg) == 2:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err != nil {
+				admin.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			var req setRequest
+			if err := json.Unmarshal(body, &req); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, `expected body {"source": "...", "owner": "..."}`)
+				return
+			}
+			name, _ := authz.Authenticate(r)
+			o := Override{Tenant: seg[0], Category: seg[1], Source: req.Source, Owner: req.Owner, UpdatedBy: "admin:" + name}
+			if err := s.Set(r.Context(), o); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			stored, err := s.Get(r.Context(), o.Tenant, o.Category)
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, stored)
+		case r.Method == http.MethodDelete && len(seg) == 2:
+			deleted, err := s.Delete(r.Context(), seg[0], seg[1])
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !deleted {
+				admin.WriteError(w, http.StatusNotFound, "no template override of "+seg[0]+" for "+seg[1])
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case len(seg) == 0 || len(seg) > 2:
+			admin.WriteError(w, http.StatusNotFound, "not found")
+		default:
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
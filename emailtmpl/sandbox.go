@@ -0,0 +1,229 @@
+// Package emailtmpl renders the subject and body of emails from templates:
+// an embedded default, which tenants can override per category through the
+// admin API. Tenant templates run in a sandbox: they may only call a
+// curated set of functions, cannot loop or call other templates, and every
+// render is bounded in time and output size.
+package emailtmpl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+
+	"asynqdemo/common"
+)
+
+// Limits bound a template and the work of rendering it
+type Limits struct {
+	// Timeout is the most one render of subject and body may take
+	Timeout time.Duration
+	// MaxOutput is the most bytes subject and body may have together
+	MaxOutput int
+	// MaxSource is the most bytes the source of a template may have
+	MaxSource int
+}
+
+// DefaultLimits are the limits of every render unless changed
+var DefaultLimits = Limits{Timeout: 100 * time.Millisecond, MaxOutput: 256 << 10, MaxSource: 64 << 10}
+
+var (
+	// ErrTimeout is returned for a render that took longer than its Timeout
+	ErrTimeout = errors.New("template render timed out")
+	// ErrTooLarge is returned for a render writing more than MaxOutput
+	ErrTooLarge = errors.New("rendered email is too large")
+)
+
+// funcs is the curated FuncMap of templates
+var funcs = template.FuncMap{
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"trim":     strings.TrimSpace,
+	"truncate": truncate,
+	"default":  defaultString,
+}
+
+// builtins are the text/template builtins templates may call. call could
+// reach functions outside the sandbox, and the print family and slice can
+// allocate far more than they write, so they are left out.
+var builtins = map[string]bool{
+	"and": true, "or": true, "not": true,
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+	"len": true, "index": true, "html": true, "urlquery": true,
+}
+
+// subjectBreaks would end the Subject header and start another one
+var subjectBreaks = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// truncate shortens s to at most n runes, marking the cut with "…"
+func truncate(n int, s string) string {
+	if n < 1 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// defaultString returns v, or def when v is empty
+func defaultString(def, v string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// Parse parses the source of a template defining "subject" and "body" and
+// checks it stays within the sandbox
+func Parse(name, source string, limits Limits) (*template.Template, error) {
+	if len(source) > limits.MaxSource {
+		return nil, fmt.Errorf("template %s has %d bytes, at most %d allowed", name, len(source), limits.MaxSource)
+	}
+	t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %v", name, err)
+	}
+	for _, part := range []string{"subject", "body"} {
+		if t.Lookup(part) == nil {
+			return nil, fmt.Errorf("template %s does not define %q", name, part)
+		}
+	}
+	for _, tt := range t.Templates() {
+		switch tt.Name() {
+		case name, "subject", "body":
+		default:
+			return nil, fmt.Errorf("template %s defines %q, only subject and body are allowed", name, tt.Name())
+		}
+		if tt.Tree == nil {
+			continue
+		}
+		if err := check(tt.Tree.Root); err != nil {
+			return nil, fmt.Errorf("template %s: %v", name, err)
+		}
+	}
+	return t, nil
+}
+
+// check rejects the nodes of a template that could escape the sandbox or
+// run without bound: calls of functions not allowed, loops and calls of
+// other templates. What remains renders in time linear in its size.
+func check(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := check(child); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return check(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			if err := check(cmd); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if err := check(arg); err != nil {
+				return err
+			}
+		}
+	case *parse.ChainNode:
+		return check(n.Node)
+	case *parse.IdentifierNode:
+		if funcs[n.Ident] == nil && !builtins[n.Ident] {
+			return fmt.Errorf("function %s is not allowed", n.Ident)
+		}
+	case *parse.IfNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		return fmt.Errorf("range is not allowed")
+	case *parse.TemplateNode:
+		return fmt.Errorf("calling template %q is not allowed", n.Name)
+	}
+	return nil
+}
+
+func checkBranch(n *parse.BranchNode) error {
+	for _, child := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := check(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Data is what templates see as dot, e.g. {{.Subject}}; every field is a
+// string
+func Data(p *common.EmailPayload) map[string]string {
+	return map[string]string{
+		"UserID":   strconv.Itoa(p.UserID),
+		"Email":    p.Email,
+		"Subject":  p.Subject,
+		"Message":  p.Message,
+		"Locale":   p.Locale,
+		"TenantID": p.TenantID,
+		"Category": categoryOf(p),
+	}
+}
+
+// categoryOf returns the category of p, transactional by default
+func categoryOf(p *common.EmailPayload) string {
+	if p.Category == "" {
+		return common.CategoryTransactional
+	}
+	return p.Category
+}
+
+// limitedWriter collects a render. Its writes fail once the context is
+// done or the output is over budget, which stops the execution.
+type limitedWriter struct {
+	ctx  context.Context
+	left int
+	buf  strings.Builder
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if deadline, ok := w.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return 0, ErrTimeout
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > w.left {
+		return 0, ErrTooLarge
+	}
+	w.left -= len(p)
+	return w.buf.Write(p)
+}
+
+// Execute renders the subject and body of t for p within limits
+func Execute(ctx context.Context, t *template.Template, p *common.EmailPayload, limits Limits) (subject, body string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+	data := Data(p)
+	w := &limitedWriter{ctx: ctx, left: limits.MaxOutput}
+	for _, part := range []struct {
+		name string
+		out  *string
+	}{{"subject", &subject}, {"body", &body}} {
+		w.buf.Reset()
+		if err := t.ExecuteTemplate(w, part.name, data); err != nil {
+			return "", "", fmt.Errorf("failed to render %s of %s: %w", part.name, t.Name(), err)
+		}
+		*part.out = w.buf.String()
+	}
+	return subjectBreaks.Replace(subject), body, nil
+}
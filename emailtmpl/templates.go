@@ -0,0 +1,262 @@
+package emailtmpl
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"asynqdemo/common"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AnyCategory is the category of an override used for every category the
+// tenant has no override of its own for
+const AnyCategory = "*"
+
+// AlertEvery is how often the owner of a failing override is alerted at most
+const AlertEvery = time.Hour
+
+const (
+	// overridesKey prefixes the hash of a tenant's overrides by category
+	overridesKey = "emailtmpl:overrides:"
+	// versionKey is bumped by every change, so every worker drops the
+	// overrides it cached
+	versionKey = "emailtmpl:version"
+	alertedKey = "emailtmpl:alerted:"
+	// cacheFor is how long the cached overrides are used before the
+	// version is checked again
+	cacheFor = 2 * time.Second
+)
+
+//go:embed templates/default.tmpl
+var defaultSource string
+
+// Override is a tenant's template for a category
+type Override struct {
+	Tenant   string `json:"tenant"`
+	Category string `json:"category"`
+	Source   string `json:"source"`
+	// Owner is told when the override fails to render, e.g. an email address
+	Owner     string    `json:"owner,omitempty"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// cachedOverride is the parsed override of a tenant and category; nil
+// when there is none, err is set when it does not parse
+type cachedOverride struct {
+	override Override
+	tmpl     *template.Template
+	err      error
+}
+
+// Templates renders emails with their tenant's override of their category,
+// falling back to the embedded default. An override failing to render
+// does not fail the send: the default is used and the override's owner is
+// alerted at most every AlertEvery.
+type Templates struct {
+	rdb    redis.UniversalClient
+	Limits Limits
+	// Alert tells the owner of an override that it failed; nil only logs
+	Alert func(ctx context.Context, o Override, text string) error
+
+	defaults *template.Template
+
+	mu        sync.Mutex
+	version   string
+	checkedAt time.Time
+	cached    map[string]*cachedOverride
+}
+
+// New creates the templates of the overrides stored in rdb
+func New(rdb redis.UniversalClient) (*Templates, error) {
+	defaults, err := Parse("default", defaultSource, DefaultLimits)
+	if err != nil {
+		return nil, fmt.Errorf("embedded email template is broken: %v", err)
+	}
+	return &Templates{rdb: rdb, Limits: DefaultLimits, defaults: defaults}, nil
+}
+
+// Render renders the subject and body of p
+func (s *Templates) Render(ctx context.Context, p *common.EmailPayload) (subject, body string, err error) {
+	if p.TenantID != "" {
+		c, err := s.lookup(ctx, p.TenantID, categoryOf(p))
+		if err != nil {
+			return "", "", err
+		}
+		if c != nil {
+			err := c.err
+			if err == nil {
+				if subject, body, err = Execute(ctx, c.tmpl, p, s.Limits); err == nil {
+					return subject, body, nil
+				}
+			}
+			s.fallback(ctx, c.override, err)
+		}
+	}
+	return Execute(ctx, s.defaults, p, s.Limits)
+}
+
+// fallback logs an override that failed and alerts its owner, unless one
+// of the workers did within AlertEvery
+func (s *Templates) fallback(ctx context.Context, o Override, err error) {
+	log.Printf("⚠️  Email template %s/%s failed, using the default: %v", o.Tenant, o.Category, err)
+	if s.Alert == nil {
+		return
+	}
+	claimed, rerr := s.rdb.SetNX(ctx, alertedKey+o.Tenant+":"+o.Category, time.Now().Unix(), AlertEvery).Result()
+	if rerr != nil || !claimed {
+		return
+	}
+	text := fmt.Sprintf("The email template of tenant %s for %s mail failed and the default template was used instead: %v", o.Tenant, o.Category, err)
+	if aerr := s.Alert(ctx, o, text); aerr != nil {
+		log.Printf("❌ Failed to alert about email template %s/%s: %v", o.Tenant, o.Category, aerr)
+	}
+}
+
+// lookup returns the override of the tenant for category, or for
+// AnyCategory when there is none, nil when there is neither
+func (s *Templates) lookup(ctx context.Context, tenant, category string) (*cachedOverride, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached == nil || time.Since(s.checkedAt) >= cacheFor {
+		version, err := s.rdb.Get(ctx, versionKey).Result()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to read email template version: %v", err)
+		}
+		if s.cached == nil || version != s.version {
+			s.cached = make(map[string]*cachedOverride)
+		}
+		s.version, s.checkedAt = version, time.Now()
+	}
+	key := tenant + "/" + category
+	if c, ok := s.cached[key]; ok {
+		return c, nil
+	}
+	values, err := s.rdb.HMGet(ctx, overridesKey+tenant, category, AnyCategory).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read email templates of %s: %v", tenant, err)
+	}
+	var c *cachedOverride
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		c = &cachedOverride{}
+		if c.err = json.Unmarshal([]byte(data), &c.override); c.err == nil {
+			c.tmpl, c.err = Parse(tenant+"/"+c.override.Category, c.override.Source, s.Limits)
+		}
+		break
+	}
+	s.cached[key] = c
+	return c, nil
+}
+
+// invalidate drops the cached overrides
+func (s *Templates) invalidate() {
+	s.mu.Lock()
+	s.cached = nil
+	s.mu.Unlock()
+}
+
+// Check parses source and renders a sample email of the tenant and
+// category with it
+func (s *Templates) Check(ctx context.Context, tenant, category, source string) error {
+	t, err := Parse(tenant+"/"+category, source, s.Limits)
+	if err != nil {
+		return err
+	}
+	if category == AnyCategory {
+		category = common.CategoryTransactional
+	}
+	sample := common.EmailPayload{UserID: 1, Email: "preview@example.com", Subject: "Preview", Message: "Preview message", Locale: "en", TenantID: tenant, Category: category}
+	_, _, err = Execute(ctx, t, &sample, s.Limits)
+	return err
+}
+
+// Get returns the override of the tenant for category, nil when there is none
+func (s *Templates) Get(ctx context.Context, tenant, category string) (*Override, error) {
+	data, err := s.rdb.HGet(ctx, overridesKey+tenant, category).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read email template %s/%s: %v", tenant, category, err)
+	}
+	var o Override
+	if err := json.Unmarshal([]byte(data), &o); err != nil {
+		return nil, fmt.Errorf("invalid email template %s/%s: %v", tenant, category, err)
+	}
+	return &o, nil
+}
+
+// List returns the overrides of the tenant by category
+func (s *Templates) List(ctx context.Context, tenant string) ([]Override, error) {
+	all, err := s.rdb.HGetAll(ctx, overridesKey+tenant).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read email templates of %s: %v", tenant, err)
+	}
+	list := make([]Override, 0, len(all))
+	for category, data := range all {
+		var o Override
+		if err := json.Unmarshal([]byte(data), &o); err != nil {
+			return nil, fmt.Errorf("invalid email template %s/%s: %v", tenant, category, err)
+		}
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Category < list[j].Category })
+	return list, nil
+}
+
+// Set checks and stores an override; every worker uses it within cacheFor
+func (s *Templates) Set(ctx context.Context, o Override) error {
+	if err := checkCategory(o.Category); err != nil {
+		return err
+	}
+	if err := s.Check(ctx, o.Tenant, o.Category, o.Source); err != nil {
+		return err
+	}
+	o.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(o)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email template: %v", err)
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, overridesKey+o.Tenant, o.Category, data)
+	pipe.Incr(ctx, versionKey)
+	pipe.Del(ctx, alertedKey+o.Tenant+":"+o.Category)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store email template %s/%s: %v", o.Tenant, o.Category, err)
+	}
+	s.invalidate()
+	return nil
+}
+
+// Delete removes an override and reports whether there was one
+func (s *Templates) Delete(ctx context.Context, tenant, category string) (bool, error) {
+	pipe := s.rdb.TxPipeline()
+	deleted := pipe.HDel(ctx, overridesKey+tenant, category)
+	pipe.Incr(ctx, versionKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, fmt.Errorf("failed to delete email template %s/%s: %v", tenant, category, err)
+	}
+	s.invalidate()
+	return deleted.Val() > 0, nil
+}
+
+// checkCategory accepts the email categories and AnyCategory
+func checkCategory(category string) error {
+	switch category {
+	case AnyCategory, common.CategoryMarketing, common.CategoryTransactional, common.CategoryDigest, common.CategorySecurity, common.CategoryWelcome:
+		return nil
+	}
+	return fmt.Errorf("unknown category %q, want an email category or %s", category, AnyCategory)
+}
@@ -0,0 +1,120 @@
+package embeddedredis_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/demo"
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestEmbeddedDemo runs the demo scenario end to end against an
+// embedded Redis: a worker with the real handlers, a scheduler and an
+// inspector all connect to it. It fails unless every task is processed
+// and kept for its retention, the scheduler fires, the summary counts
+// match, and cluster and sentinel settings are rejected.
+func TestEmbeddedDemo(t *testing.T) {
+	for _, mode := range []string{"cluster", "failover"} {
+		t.Setenv("REDIS_MODE", mode)
+		if err := embeddedredis.CheckEnv(); err == nil {
+			t.Errorf("embedded mode accepted REDIS_MODE=%s", mode)
+		}
+	}
+	t.Setenv("REDIS_MODE", "")
+
+	scenario, err := demo.Load(filepath.Join("..", demo.DefaultFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if !strings.Contains(srv.Banner(), srv.Addr()) {
+		t.Errorf("banner does not show the address %s", srv.Addr())
+	}
+	r := srv.ConnOpt()
+
+	mux := asynq.NewServeMux()
+	mux.HandleFunc(common.TypeWelcomeMessage, func(ctx context.Context, t *asynq.Task) error {
+		var p common.WelcomePayload
+		if err := json.Unmarshal(t.Payload(), &p); err != nil {
+			return err
+		}
+		return common.HandleWelcomeTask(ctx, &p)
+	})
+	mux.HandleFunc(common.TypeEmailTask, func(ctx context.Context, t *asynq.Task) error {
+		var p common.EmailPayload
+		if err := json.Unmarshal(t.Payload(), &p); err != nil {
+			return err
+		}
+		return common.HandleEmailTask(ctx, &p)
+	})
+	mux.HandleFunc(common.TypeServerInfo, func(ctx context.Context, t *asynq.Task) error {
+		var p common.ServerInfoPayload
+		if err := json.Unmarshal(t.Payload(), &p); err != nil {
+			return err
+		}
+		return common.HandleServerInfoTask(ctx, &p)
+	})
+	worker := asynq.NewServer(r, asynq.Config{Concurrency: 4, Queues: map[string]int{"default": 1, "low": 1}, LogLevel: asynq.WarnLevel})
+	if err := worker.Start(mux); err != nil {
+		t.Fatalf("failed to start worker: %v", err)
+	}
+	defer worker.Shutdown()
+
+	sched := asynq.NewScheduler(r, &asynq.SchedulerOpts{LogLevel: asynq.WarnLevel})
+	if _, err := sched.Register("@every 1s", asynq.NewTask(common.TypeServerInfo, []byte(`{"timestamp":1,"source":"embedded"}`), asynq.Queue("low"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := sched.Start(); err != nil {
+		t.Fatalf("failed to start scheduler: %v", err)
+	}
+	defer sched.Shutdown()
+
+	client := asynq.NewClient(r)
+	defer client.Close()
+	enqueue := func(ctx context.Context, taskType string, payload []byte, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+		return client.EnqueueContext(ctx, asynq.NewTask(taskType, payload), append(opts, asynq.Retention(time.Hour))...)
+	}
+	if sum := scenario.Run(context.Background(), enqueue); sum.Failed > 0 {
+		t.Fatalf("scenario %s: %s", scenario.Name, sum)
+	}
+
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	want := len(scenario.Tasks)
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		completed, _ := inspector.ListCompletedTasks("default")
+		low, _ := inspector.GetQueueInfo("low")
+		if len(completed) == want && low != nil && low.ProcessedTotal > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d of %d scenario tasks completed, scheduler fired: %v", len(completed), want, low != nil && low.ProcessedTotal > 0)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	sum, err := embeddedredis.Summarize(inspector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range sum {
+		if q.Queue == "default" && (q.Processed != want || q.Failed != 0) {
+			t.Errorf("summary of default: %+v, want %d processed", q, want)
+		}
+	}
+	if !strings.Contains(sum.String(), "total") {
+		t.Errorf("summary has no total:\n%s", sum)
+	}
+}
@@ -0,0 +1,173 @@
+// Package embeddedredis runs an in-process Redis for demos, so the worker
+// can be tried without installing Redis. Data lives in memory only and is
+// lost on exit.
+package embeddedredis
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+// DefaultAddr is the redisconn default, so the admin CLI reaches the
+// embedded instance without any configuration
+const DefaultAddr = "localhost:6380"
+
+// tick is how often the embedded clock follows the wall clock
+const tick = 100 * time.Millisecond
+
+// Server is an embedded Redis
+type Server struct {
+	mr   *miniredis.Miniredis
+	stop chan struct{}
+	done chan struct{}
+}
+
+// CheckEnv rejects Redis settings the single embedded node cannot serve
+func CheckEnv() error {
+	if uri := os.Getenv("REDIS_URL"); uri != "" {
+		return fmt.Errorf("--embedded-redis cannot be combined with REDIS_URL")
+	}
+	for _, name := range []string{"REDIS_SENTINEL_ADDRS", "REDIS_CLUSTER_ADDRS"} {
+		if os.Getenv(name) != "" {
+			return fmt.Errorf("--embedded-redis runs a single node, %s is not supported", name)
+		}
+	}
+	switch mode := os.Getenv("REDIS_MODE"); mode {
+	case "", "client":
+		return nil
+	case "failover", "cluster":
+		return fmt.Errorf("--embedded-redis runs a single node, REDIS_MODE=%s is not supported", mode)
+	default:
+		return fmt.Errorf("unknown REDIS_MODE %q", mode)
+	}
+}
+
+// Start listens on addr, e.g. DefaultAddr or "127.0.0.1:0" for any port
+func Start(addr string) (*Server, error) {
+	mr := miniredis.NewMiniRedis()
+	if err := mr.StartAddr(addr); err != nil {
+		return nil, fmt.Errorf("failed to start embedded redis on %s: %v", addr, err)
+	}
+	s := &Server{mr: mr, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.run()
+	return s, nil
+}
+
+// run advances the embedded clock with the wall clock. miniredis only
+// expires keys when told time passed, and asynq relies on expiring keys
+// for server heartbeats, scheduler entries and leases.
+func (s *Server) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	last := time.Now()
+	s.mr.SetTime(last)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.mr.SetTime(now)
+			s.mr.FastForward(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() string {
+	return s.mr.Addr()
+}
+
+// ConnOpt returns the connection options of the server
+func (s *Server) ConnOpt() asynq.RedisConnOpt {
+	return asynq.RedisClientOpt{Addr: s.mr.Addr()}
+}
+
+// FastForward expires keys as if d passed, so tests need not wait out TTLs
+func (s *Server) FastForward(d time.Duration) {
+	s.mr.FastForward(d)
+}
+
+// Connections returns the number of clients currently connected
+func (s *Server) Connections() int {
+	return s.mr.CurrentConnectionCount()
+}
+
+// Close stops the server and drops its data
+func (s *Server) Close() {
+	close(s.stop)
+	<-s.done
+	s.mr.Close()
+}
+
+// Banner warns that the data of the server is ephemeral
+func (s *Server) Banner() string {
+	return strings.Join([]string{
+		"⚠️  ================================================================",
+		"⚠️  EMBEDDED REDIS on " + s.Addr() + " — for demos only",
+		"⚠️  Data lives in this process and is lost on exit. Single node:",
+		"⚠️  no persistence, replication, sentinel or cluster.",
+		"⚠️  ================================================================",
+	}, "\n")
+}
+
+// QueueSummary counts the tasks of one queue; Processed includes Failed
+type QueueSummary struct {
+	Queue     string
+	Processed int
+	Failed    int
+	Pending   int
+	Scheduled int
+	Retry     int
+	Archived  int
+}
+
+// Summary counts the tasks of every queue
+type Summary []QueueSummary
+
+// Summarize reads the counts of every queue from inspector
+func Summarize(inspector *asynq.Inspector) (Summary, error) {
+	queues, err := inspector.Queues()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues: %v", err)
+	}
+	sort.Strings(queues)
+	sum := make(Summary, 0, len(queues))
+	for _, q := range queues {
+		info, err := inspector.GetQueueInfo(q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read queue %s: %v", q, err)
+		}
+		sum = append(sum, QueueSummary{
+			Queue:     q,
+			Processed: info.ProcessedTotal,
+			Failed:    info.FailedTotal,
+			Pending:   info.Pending,
+			Scheduled: info.Scheduled,
+			Retry:     info.Retry,
+			Archived:  info.Archived,
+		})
+	}
+	return sum, nil
+}
+
+// String formats one line per queue and a total
+func (s Summary) String() string {
+	var b strings.Builder
+	var total QueueSummary
+	for _, q := range s {
+		fmt.Fprintf(&b, "   %-10s processed %d (%d failed), left %d pending, %d scheduled, %d retry, %d archived\n",
+			q.Queue, q.Processed, q.Failed, q.Pending, q.Scheduled, q.Retry, q.Archived)
+		total.Processed += q.Processed
+		total.Failed += q.Failed
+	}
+	fmt.Fprintf(&b, "   total      processed %d (%d failed)", total.Processed, total.Failed)
+	return b.String()
+}
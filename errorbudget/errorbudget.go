@@ -0,0 +1,195 @@
+// Package errorbudget delays the non-essential tasks of a type whose error
+// rate exceeds its budget, so a struggling downstream such as the email
+// provider is not kept busy with mail that can wait, and restores the type
+// once the rate stayed within budget for a while.
+package errorbudget
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/flags"
+	"asynqdemo/metrics"
+)
+
+// DefaultBudgets is used when ERROR_BUDGETS is unset
+const DefaultBudgets = "email:send=20%/5m"
+
+// DefaultRecovery is how long the error rate of a delayed type must stay
+// within budget before it is restored
+const DefaultRecovery = 10 * time.Minute
+
+// Owner is the SetBy of flags changed by the controller; it only restores
+// flags it set itself, never those an operator set
+const Owner = "error-budget"
+
+// Budget allows at most MaxRate of a type's tasks to fail over Window
+type Budget struct {
+	MaxRate float64
+	Window  time.Duration
+}
+
+func (b Budget) String() string {
+	return fmt.Sprintf("%s%%/%v", strconv.FormatFloat(b.MaxRate*100, 'f', -1, 64), b.Window)
+}
+
+// ParseBudgets parses "type=rate%/window,...", e.g. "email:send=20%/5m"
+func ParseBudgets(s string) (map[string]Budget, error) {
+	budgets := make(map[string]Budget)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		taskType, spec, ok := strings.Cut(part, "=")
+		rate, window, ok2 := strings.Cut(spec, "%/")
+		if !ok || !ok2 || taskType == "" {
+			return nil, fmt.Errorf("invalid budget %q, want type=rate%%/window", part)
+		}
+		var b Budget
+		pct, err := strconv.ParseFloat(rate, 64)
+		if err != nil || pct <= 0 || pct >= 100 {
+			return nil, fmt.Errorf("invalid budget %q: rate must be a percentage between 0 and 100", part)
+		}
+		b.MaxRate = pct / 100
+		if b.Window, err = time.ParseDuration(window); err != nil || b.Window <= 0 {
+			return nil, fmt.Errorf("invalid budget %q: window must be a positive duration", part)
+		}
+		budgets[taskType] = b
+	}
+	return budgets, nil
+}
+
+// BudgetsFromEnv reads ERROR_BUDGETS, DefaultBudgets when unset and none
+// when "off"
+func BudgetsFromEnv() (map[string]Budget, error) {
+	v := os.Getenv("ERROR_BUDGETS")
+	switch v {
+	case "":
+		v = DefaultBudgets
+	case "off":
+		return nil, nil
+	}
+	budgets, err := ParseBudgets(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ERROR_BUDGETS: %v", err)
+	}
+	return budgets, nil
+}
+
+// Controller flips the flags of task types that exhaust their budget to
+// delayed, and back on once the rate stayed within budget for Recovery.
+// Each worker judges from the tasks it processed itself; the flags are
+// shared, so the first worker to see a breach delays the type fleet-wide.
+type Controller struct {
+	rates   *metrics.ErrorRates
+	flags   *flags.Store
+	budgets map[string]Budget
+
+	// Recovery is how long the rate must stay within budget to restore
+	Recovery time.Duration
+	// MinSamples is the fewest tasks in a window that can exhaust a budget
+	MinSamples int
+	// Interval is how often Run checks the budgets
+	Interval time.Duration
+
+	// healthySince is when the rate of a delayed type was last seen back
+	// within budget, zero while it is not
+	healthySince map[string]time.Time
+}
+
+// NewController creates a controller of budgets reading rates
+func NewController(rates *metrics.ErrorRates, store *flags.Store, budgets map[string]Budget) *Controller {
+	return &Controller{
+		rates:        rates,
+		flags:        store,
+		budgets:      budgets,
+		Recovery:     DefaultRecovery,
+		MinSamples:   20,
+		Interval:     10 * time.Second,
+		healthySince: make(map[string]time.Time),
+	}
+}
+
+// Check compares the error rate of every budgeted type with its budget at
+// now and changes the flags that need it
+func (c *Controller) Check(ctx context.Context, now time.Time) error {
+	types := make([]string, 0, len(c.budgets))
+	for t := range c.budgets {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, taskType := range types {
+		b := c.budgets[taskType]
+		rate, samples := c.rates.Rate(taskType, b.Window, now)
+		exhausted := samples >= c.MinSamples && rate > b.MaxRate
+		f, err := c.flags.Get(ctx, taskType)
+		if err != nil {
+			return err
+		}
+		switch {
+		case f.State == flags.StateOn && exhausted:
+			reason := fmt.Sprintf("error rate %.0f%% over %d tasks in %v exceeds the budget of %v", rate*100, samples, b.Window, b)
+			if _, err := c.flags.Set(ctx, flags.Flag{TaskType: taskType, State: flags.StateDelayed, Reason: reason, SetBy: Owner}); err != nil {
+				return err
+			}
+			delete(c.healthySince, taskType)
+		case f.State != flags.StateDelayed || f.SetBy != Owner:
+		case exhausted:
+			delete(c.healthySince, taskType)
+		default:
+			// Within budget, or too few essential tasks to tell otherwise
+			since, ok := c.healthySince[taskType]
+			if !ok {
+				c.healthySince[taskType] = now
+				continue
+			}
+			if now.Sub(since) < c.Recovery {
+				continue
+			}
+			reason := fmt.Sprintf("error rate %.0f%% over %d tasks stayed within the budget of %v for %v", rate*100, samples, b, c.Recovery)
+			if _, err := c.flags.Set(ctx, flags.Flag{TaskType: taskType, State: flags.StateOn, Reason: reason, SetBy: Owner}); err != nil {
+				return err
+			}
+			delete(c.healthySince, taskType)
+		}
+	}
+	return nil
+}
+
+// Run checks the budgets every Interval until ctx is done
+func (c *Controller) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := c.Check(ctx, now); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+		}
+	}
+}
+
+// NewRates creates the error rate tracking budgets need: it keeps the
+// longest window, in buckets of a thirtieth of the shortest
+func NewRates(budgets map[string]Budget) *metrics.ErrorRates {
+	var shortest, longest time.Duration
+	for _, b := range budgets {
+		if shortest == 0 || b.Window < shortest {
+			shortest = b.Window
+		}
+		if b.Window > longest {
+			longest = b.Window
+		}
+	}
+	return metrics.NewErrorRates(shortest/30, longest, flags.IsFailure)
+}
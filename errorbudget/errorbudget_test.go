@@ -0,0 +1,192 @@
+package errorbudget_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/chaos"
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/errorbudget"
+	"asynqdemo/flags"
+	"asynqdemo/metrics"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestErrorBudget simulates an email provider outage with the chaos
+// mailer against an embedded Redis, and fails unless the controller
+// delays email once the outage exhausts the budget, marketing email is then
+// held back while transactional email keeps flowing, the flag is restored
+// only after the rate stayed within budget for the recovery period, a flag
+// set by an operator is left alone, and every transition is alerted and
+// listed on /admin/flags. It skips t in builds without the chaos tag.
+func TestErrorBudget(t *testing.T) {
+	if !chaos.Enabled {
+		t.Skip("the provider outage is simulated by chaos mode, run with -tags chaos")
+	}
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var alerts []string
+	store := flags.NewStore(rdb, func(ctx context.Context, text string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		alerts = append(alerts, text)
+		return nil
+	})
+	budgets, err := errorbudget.ParseBudgets("email:send=20%/1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates := errorbudget.NewRates(budgets)
+	controller := errorbudget.NewController(rates, store, budgets)
+	controller.Recovery, controller.MinSamples = 1500*time.Millisecond, 10
+
+	mailer, err := chaos.NewFailingMailer(nil, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := metrics.NewLatencyRecorder(rdb, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.TrackErrors(rates)
+	sent := 0
+	handler := recorder.Middleware()(store.Middleware(common.IsEssential)(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		var p common.EmailPayload
+		if err := json.Unmarshal(task.Payload(), &p); err != nil {
+			return err
+		}
+		if err := mailer.Send(ctx, common.BuildEmail(&p, nil)); err != nil {
+			return err
+		}
+		sent++
+		return nil
+	})))
+	email := func(category string) *asynq.Task {
+		return asynq.NewTask(common.TypeEmailTask, []byte(fmt.Sprintf(`{"user_id":1,"email":"a@example.com","subject":"s","category":%q}`, category)))
+	}
+	send := func(n int, category string) (errs int) {
+		for i := 0; i < n; i++ {
+			if handler.ProcessTask(ctx, email(category)) != nil {
+				errs++
+			}
+		}
+		return errs
+	}
+	state := func() flags.Flag {
+		f, err := store.Get(ctx, common.TypeEmailTask)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	check := func() {
+		if err := controller.Check(ctx, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Healthy traffic leaves the flag on
+	send(20, common.CategoryMarketing)
+	check()
+	if f := state(); f.State != flags.StateOn {
+		t.Fatalf("flag is %s with a healthy provider", f.State)
+	}
+
+	// The outage exhausts the budget
+	mailer.SetFailRate(1)
+	send(20, common.CategoryTransactional)
+	check()
+	if f := state(); f.State != flags.StateDelayed || f.SetBy != errorbudget.Owner {
+		t.Fatalf("flag is %+v after the outage, want delayed by %s", f, errorbudget.Owner)
+	}
+	err = handler.ProcessTask(ctx, email(common.CategoryMarketing))
+	if !flags.IsDelayed(err) || flags.IsFailure(err) {
+		t.Errorf("marketing email got %v while delayed, want a non-failure ErrDelayed", err)
+	}
+	if d := flags.RetryDelay(asynq.DefaultRetryDelayFunc)(0, err, nil); d != flags.DefaultDelay {
+		t.Errorf("delayed task retries in %v, want %v", d, flags.DefaultDelay)
+	}
+
+	// The provider recovers; transactional email keeps flowing and the
+	// flag stays delayed until the rate was within budget for Recovery
+	mailer.SetFailRate(0)
+	before := sent
+	deadline := time.Now().Add(10 * time.Second)
+	var healthyAt time.Time
+	for state().State == flags.StateDelayed {
+		if time.Now().After(deadline) {
+			t.Fatalf("flag still delayed after the provider recovered")
+		}
+		send(5, common.CategoryTransactional)
+		if rate, _ := rates.Rate(common.TypeEmailTask, time.Second, time.Now()); rate <= 0.2 && healthyAt.IsZero() {
+			healthyAt = time.Now()
+		}
+		check()
+		time.Sleep(100 * time.Millisecond)
+	}
+	if restored := time.Now(); restored.Sub(healthyAt) < controller.Recovery-controller.Recovery/10 {
+		t.Errorf("flag restored %v after the rate recovered, want at least %v", restored.Sub(healthyAt), controller.Recovery)
+	}
+	if sent == before {
+		t.Errorf("no transactional email was sent while email was delayed")
+	}
+	if err := handler.ProcessTask(ctx, email(common.CategoryMarketing)); err != nil {
+		t.Errorf("marketing email failed after the restore: %v", err)
+	}
+
+	// A flag an operator set is not restored by the controller
+	if _, err := store.Set(ctx, flags.Flag{TaskType: common.TypeEmailTask, State: flags.StateDelayed, SetBy: "admin:ops", Reason: "maintenance"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		send(10, common.CategoryTransactional)
+		controller.Check(ctx, time.Now().Add(time.Duration(i)*controller.Recovery))
+	}
+	if f := state(); f.State != flags.StateDelayed || f.SetBy != "admin:ops" {
+		t.Errorf("operator flag became %+v", f)
+	}
+
+	mu.Lock()
+	got := len(alerts)
+	mu.Unlock()
+	if got != 3 {
+		t.Errorf("got %d alerts, want one per transition (3): %v", got, alerts)
+	}
+
+	rec := httptest.NewRecorder()
+	flags.Handler(store, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/flags", nil))
+	var listed struct {
+		Flags   []flags.Flag `json:"flags"`
+		History []flags.Flag `json:"history"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/flags: %d %s", rec.Code, rec.Body)
+	}
+	var sequence []string
+	for i := len(listed.History) - 1; i >= 0; i-- {
+		sequence = append(sequence, listed.History[i].State+" by "+listed.History[i].SetBy)
+	}
+	want := "delayed by error-budget, on by error-budget, delayed by admin:ops"
+	if got := strings.Join(sequence, ", "); got != want || len(listed.Flags) != 1 {
+		t.Errorf("/admin/flags history %q with %d flags, want %q with 1", got, len(listed.Flags), want)
+	}
+}
@@ -0,0 +1,256 @@
+package eventlog_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/eventlog"
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+)
+
+// runEventLog runs w until the returned function is called, which waits
+// for the buffered events to be written
+func runEventLog(w *eventlog.Writer) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// TestEventLog writes events through a Writer and fails unless files
+// rotate exactly at their size and age limits, only MaxFiles rotated files
+// are kept, queries filter by time, kind, type and outcome across files,
+// writes over the rate or buffer are dropped without blocking, deferred
+// tasks are not logged as archived at their last attempt, and a full disk
+// drops and counts events until space is back.
+func TestEventLog(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// Events of both types marshal to lines of the same length
+	event := func(i int) eventlog.Event {
+		e := eventlog.Event{At: base.Add(time.Duration(i) * time.Minute), Kind: eventlog.KindTask, TaskID: fmt.Sprintf("t%02d", i), Type: "email:send", Outcome: eventlog.OutcomeSucceeded}
+		if i%2 == 1 {
+			e.Type, e.Outcome = "report:render", eventlog.OutcomeFailed
+		}
+		return e
+	}
+	line, err := json.Marshal(event(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineSize := int64(len(line) + 1)
+
+	// Three lines fill a file exactly, the fourth starts the next one
+	dir := t.TempDir()
+	w, err := eventlog.NewWriter(eventlog.Config{Dir: dir, MaxBytes: 3 * lineSize, MaxAge: time.Hour, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := runEventLog(w)
+	for i := 1; i <= 7; i++ {
+		w.Write(event(i))
+	}
+	stop()
+	files := func() (rotated []int64, current int64) {
+		t.Helper()
+		paths, _ := filepath.Glob(filepath.Join(dir, "events-*.jsonl"))
+		for _, p := range paths {
+			info, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rotated = append(rotated, info.Size())
+		}
+		info, err := os.Stat(filepath.Join(dir, "events.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rotated, info.Size()
+	}
+	if rotated, current := files(); len(rotated) != 2 || rotated[0] != 3*lineSize || rotated[1] != 3*lineSize || current != lineSize {
+		t.Errorf("7 events over 3-line files gave rotated sizes %v and current %d, want 2 full files and one line", rotated, current)
+	}
+	stop = runEventLog(w)
+	for i := 8; i <= 11; i++ {
+		w.Write(event(i))
+	}
+	stop()
+	if rotated, current := files(); len(rotated) != 2 || current != 2*lineSize {
+		t.Errorf("4 more events gave rotated sizes %v and current %d, want the oldest file removed", rotated, current)
+	}
+
+	// Queries span the rotated files and skip lines cut short
+	f, err := os.OpenFile(filepath.Join(dir, "events.jsonl"), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"at":"2024-05-01T12:`)
+	f.Close()
+	query := func(f eventlog.Filter) []string {
+		t.Helper()
+		events, err := eventlog.Query(dir, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(events))
+		for i, e := range events {
+			ids[i] = e.TaskID
+		}
+		return ids
+	}
+	for _, c := range []struct {
+		filter eventlog.Filter
+		want   string
+	}{
+		{eventlog.Filter{}, "t04 t05 t06 t07 t08 t09 t10 t11"},
+		{eventlog.Filter{From: base.Add(6 * time.Minute), To: base.Add(9 * time.Minute)}, "t06 t07 t08"},
+		{eventlog.Filter{Type: "report:render"}, "t05 t07 t09 t11"},
+		{eventlog.Filter{Outcome: eventlog.OutcomeSucceeded, From: base.Add(8 * time.Minute)}, "t08 t10"},
+		{eventlog.Filter{Kind: eventlog.KindAlert}, ""},
+	} {
+		if got := strings.Join(query(c.filter), " "); got != c.want {
+			t.Errorf("query %+v gave %q, want %q", c.filter, got, c.want)
+		}
+	}
+	events, _ := eventlog.Query(dir, eventlog.Filter{From: base.Add(11 * time.Minute)})
+	var out bytes.Buffer
+	if err := eventlog.Print(&out, events); err != nil || !strings.Contains(out.String(), "report:render") || !strings.Contains(out.String(), "t11") {
+		t.Errorf("printed events:\n%s(%v)", out.String(), err)
+	}
+
+	// Age rotates a file however small it is
+	ageDir := t.TempDir()
+	w, err = eventlog.NewWriter(eventlog.Config{Dir: ageDir, MaxAge: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop = runEventLog(w)
+	w.Write(event(1))
+	time.Sleep(100 * time.Millisecond)
+	w.Write(event(2))
+	stop()
+	if paths, _ := filepath.Glob(filepath.Join(ageDir, "events-*.jsonl")); len(paths) != 1 {
+		t.Errorf("event after MaxAge gave rotated files %v, want one", paths)
+	}
+
+	// Writes over the rate or the buffer are dropped rather than waiting
+	w, err = eventlog.NewWriter(eventlog.Config{Dir: t.TempDir(), Rate: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		w.Write(event(i))
+	}
+	if w.Dropped() != 15 {
+		t.Errorf("20 events at once at 5/s dropped %d, want 15", w.Dropped())
+	}
+	w, err = eventlog.NewWriter(eventlog.Config{Dir: t.TempDir(), Buffer: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Write(event(i))
+	}
+	if w.Dropped() != 3 {
+		t.Errorf("5 events into a buffer of 2 dropped %d, want 3", w.Dropped())
+	}
+
+	// Task outcomes and alerts are recorded by the hooks. Without retry
+	// counts in the context every attempt is the last, where deferred tasks
+	// are still not archived.
+	hookDir := t.TempDir()
+	w, err = eventlog.NewWriter(eventlog.Config{Dir: hookDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop = runEventLog(w)
+	handler := eventlog.Hook(w)(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		switch string(task.Payload()) {
+		case "skip":
+			return fmt.Errorf("bad payload: %w", asynq.SkipRetry)
+		case "open":
+			return circuit.ErrOpen{Provider: "smtp", ProbeAt: time.Now().Add(time.Second), Delay: time.Second}
+		case "delayed":
+			return flags.ErrDelayed{TaskType: "email:send", Delay: time.Minute}
+		case "fail":
+			return errors.New("smtp down")
+		}
+		return nil
+	}))
+	for _, payload := range []string{"", "skip", "open", "delayed", "fail"} {
+		handler.ProcessTask(context.Background(), asynq.NewTask("email:send", []byte(payload)))
+	}
+	if err := w.Alerts(nil)(context.Background(), "queue critical backed up"); err != nil {
+		t.Errorf("alert without Slack gave %v", err)
+	}
+	stop()
+	if got := eventOutcomes(t, hookDir); got != "task/succeeded task/skipped task/deferred task/deferred task/archived alert/" {
+		t.Errorf("hooks recorded %q", got)
+	}
+
+	// A full disk fails writes, which are dropped and counted, until space
+	// is freed
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Log("no /dev/full, skipping the full disk case")
+		return
+	}
+	fullDir := t.TempDir()
+	if err := os.Symlink("/dev/full", filepath.Join(fullDir, "events.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	w, err = eventlog.NewWriter(eventlog.Config{Dir: fullDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop = runEventLog(w)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w.Write(event(i))
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("writes on a full disk took %v", time.Since(start))
+	}
+	stop()
+	if w.Failed() != 3 || w.Dropped() != 0 {
+		t.Errorf("full disk failed %d and dropped %d events, want 3 failed", w.Failed(), w.Dropped())
+	}
+	if err := os.Remove(filepath.Join(fullDir, "events.jsonl")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	stop = runEventLog(w)
+	w.Write(event(3))
+	stop()
+	if ids := eventOutcomes(t, fullDir); w.Failed() != 3 || ids != "task/failed" {
+		t.Errorf("after space was freed: %d failed, events %q", w.Failed(), ids)
+	}
+}
+
+// eventOutcomes lists the kind and outcome of every event in dir
+func eventOutcomes(t *testing.T, dir string) string {
+	t.Helper()
+	events, err := eventlog.Query(dir, eventlog.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make([]string, len(events))
+	for i, e := range events {
+		parts[i] = e.Kind + "/" + e.Outcome
+	}
+	return strings.Join(parts, " ")
+}
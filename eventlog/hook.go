@@ -0,0 +1,74 @@
+package eventlog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+)
+
+// Hook returns a middleware recording the outcome of every task: succeeded,
+// failed when it will be retried, deferred when retried without using up a
+// retry, archived after its last attempt or skipped. Recording never waits on the disk.
+func Hook(w *Writer) asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			start := time.Now()
+			err := next.ProcessTask(ctx, t)
+
+			e := Event{
+				Kind:       KindTask,
+				Type:       t.Type(),
+				Outcome:    outcome(ctx, err),
+				DurationMs: time.Since(start).Milliseconds(),
+			}
+			e.TaskID, _ = asynq.GetTaskID(ctx)
+			e.Queue, _ = asynq.GetQueueName(ctx)
+			if err != nil {
+				e.Message = summarize(err.Error())
+			}
+			w.Write(e)
+			return err
+		})
+	}
+}
+
+func outcome(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return OutcomeSucceeded
+	case errors.Is(err, asynq.SkipRetry):
+		return OutcomeSkipped
+	case !flags.IsFailure(err):
+		return OutcomeDeferred
+	}
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	if retried >= maxRetry {
+		return OutcomeArchived
+	}
+	return OutcomeFailed
+}
+
+// Alerts wraps an alert function so that every alert is also recorded,
+// which makes the log the alert channel when next is nil
+func (w *Writer) Alerts(next func(ctx context.Context, text string) error) func(ctx context.Context, text string) error {
+	return func(ctx context.Context, text string) error {
+		w.Write(Event{Kind: KindAlert, Message: summarize(text)})
+		if next == nil {
+			return nil
+		}
+		return next(ctx, text)
+	}
+}
+
+func summarize(s string) string {
+	const max = 500
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
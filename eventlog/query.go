@@ -0,0 +1,110 @@
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Filter selects events; zero fields match every event
+type Filter struct {
+	From, To time.Time
+	Kind     string
+	Type     string
+	Outcome  string
+}
+
+// Match reports whether e passes the filter. From is inclusive, To is not.
+func (f Filter) Match(e Event) bool {
+	return (f.From.IsZero() || !e.At.Before(f.From)) &&
+		(f.To.IsZero() || e.At.Before(f.To)) &&
+		(f.Kind == "" || e.Kind == f.Kind) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome)
+}
+
+// Query reads the matching events of the current and rotated files in dir,
+// oldest first. Rotated files closed before f.From are not read; lines cut
+// short by a failed write are skipped.
+func Query(dir string, f Filter) ([]Event, error) {
+	rotated, err := rotatedFiles(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list event logs: %v", err)
+	}
+	var paths []string
+	for _, r := range rotated {
+		if f.From.IsZero() || !r.at.Before(f.From) {
+			paths = append(paths, r.path)
+		}
+	}
+	paths = append(paths, filepath.Join(dir, currentFile))
+
+	var matches []Event
+	for _, p := range paths {
+		file, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open event log: %v", err)
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var e Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if f.Match(e) {
+				matches = append(matches, e)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", p, err)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].At.Before(matches[j].At) })
+	return matches, nil
+}
+
+// Print writes events as a table, one per line
+func Print(w io.Writer, events []Event) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tKIND\tTYPE\tQUEUE\tOUTCOME\tDETAIL")
+	for _, e := range events {
+		detail := e.Message
+		if e.Kind == KindTask && e.TaskID != "" {
+			detail = strings.TrimSpace(fmt.Sprintf("%s %dms %s", e.TaskID, e.DurationMs, e.Message))
+		}
+		if len(e.Counts) > 0 {
+			names := make([]string, 0, len(e.Counts))
+			for name := range e.Counts {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			parts := make([]string, len(names))
+			for i, name := range names {
+				parts[i] = fmt.Sprintf("%s=%d", name, e.Counts[name])
+			}
+			detail = strings.Join(parts, " ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.At.Local().Format(time.RFC3339), e.Kind, dash(e.Type), dash(e.Queue), dash(e.Outcome), detail)
+	}
+	return tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,328 @@
+// Package eventlog keeps task completions, failures, alerts and queue
+// snapshots in a local JSONL file rotated by size and age, for deployments
+// with no log shipper, metrics or Slack, just a disk.
+package eventlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Kinds of events
+const (
+	KindTask  = "task"
+	KindAlert = "alert"
+	KindQueue = "queue"
+)
+
+// Outcomes of task events. Failed tasks will be retried, deferred ones too
+// but without using up a retry, archived ones failed their last attempt.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeDeferred  = "deferred"
+	OutcomeSkipped   = "skipped"
+	OutcomeArchived  = "archived"
+)
+
+// Event is one line of the log
+type Event struct {
+	At         time.Time      `json:"at"`
+	Kind       string         `json:"kind"`
+	Type       string         `json:"type,omitempty"`
+	TaskID     string         `json:"task_id,omitempty"`
+	Queue      string         `json:"queue,omitempty"`
+	Outcome    string         `json:"outcome,omitempty"`
+	DurationMs int64          `json:"duration_ms,omitempty"`
+	Message    string         `json:"message,omitempty"`
+	Counts     map[string]int `json:"counts,omitempty"`
+}
+
+// currentFile is the file being written; rotated files are named
+// events-<UTC time of rotation>.jsonl
+const (
+	currentFile  = "events.jsonl"
+	rotatedTime  = "20060102T150405.000000000Z"
+	rotatedGlob  = "events-*.jsonl"
+	rotatedStart = "events-"
+)
+
+// Config sizes the log
+type Config struct {
+	// Dir holds the current and rotated files, empty disables the log
+	Dir string
+	// MaxBytes rotates the file before a line would take it past this size
+	MaxBytes int64
+	// MaxAge rotates the file once the writer had it open this long
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int
+	// Rate limits the events per second written, excess ones are dropped
+	Rate float64
+	// Buffer is the number of events waiting to be written
+	Buffer int
+}
+
+// DefaultConfig is the configuration of a log in dir
+func DefaultConfig(dir string) Config {
+	return Config{Dir: dir, MaxBytes: 10 << 20, MaxAge: 24 * time.Hour, MaxFiles: 10, Rate: 100, Buffer: 1000}
+}
+
+// ConfigFromEnv reads EVENT_LOG_DIR, EVENT_LOG_MAX_MB, EVENT_LOG_MAX_AGE,
+// EVENT_LOG_MAX_FILES and EVENT_LOG_RATE over DefaultConfig
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig(os.Getenv("EVENT_LOG_DIR"))
+	if v := os.Getenv("EVENT_LOG_MAX_MB"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid EVENT_LOG_MAX_MB %q", v)
+		}
+		cfg.MaxBytes = n << 20
+	}
+	if v := os.Getenv("EVENT_LOG_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid EVENT_LOG_MAX_AGE %q", v)
+		}
+		cfg.MaxAge = d
+	}
+	if v := os.Getenv("EVENT_LOG_MAX_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid EVENT_LOG_MAX_FILES %q", v)
+		}
+		cfg.MaxFiles = n
+	}
+	if v := os.Getenv("EVENT_LOG_RATE"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 {
+			return cfg, fmt.Errorf("invalid EVENT_LOG_RATE %q, want events per second or 0 for no limit", v)
+		}
+		cfg.Rate = r
+	}
+	return cfg, nil
+}
+
+// Writer appends events to the log from a bounded buffer in the background.
+// Only Run touches the files, so rotation is safe however many goroutines
+// call Write; one writer per directory.
+type Writer struct {
+	cfg     Config
+	buf     chan Event
+	limiter *rate.Limiter
+
+	file   *os.File
+	size   int64
+	opened time.Time
+	// failing is set while writes fail, to log the first failure only
+	failing bool
+
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// NewWriter creates a writer for cfg, creating its directory
+func NewWriter(cfg Config) (*Writer, error) {
+	def := DefaultConfig(cfg.Dir)
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = def.MaxBytes
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = def.MaxAge
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = def.MaxFiles
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = def.Buffer
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create event log dir: %v", err)
+	}
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if cfg.Rate > 0 {
+		burst := int(cfg.Rate)
+		if burst < 1 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(cfg.Rate), burst)
+	}
+	return &Writer{cfg: cfg, buf: make(chan Event, cfg.Buffer), limiter: limiter}, nil
+}
+
+// Write queues e, stamped with the current time unless it has one. It
+// never blocks: over the rate or with the buffer full the event is dropped
+// and counted. A nil writer drops nothing and writes nothing.
+func (w *Writer) Write(e Event) {
+	if w == nil {
+		return
+	}
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	if !w.limiter.Allow() {
+		w.dropped.Add(1)
+		return
+	}
+	select {
+	case w.buf <- e:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of events dropped over the rate or with the
+// buffer full
+func (w *Writer) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// Failed returns the number of events lost to failed writes, such as on a
+// full disk
+func (w *Writer) Failed() int64 {
+	return w.failed.Load()
+}
+
+// Run writes events until ctx is done, then writes those still buffered
+// and closes the file
+func (w *Writer) Run(ctx context.Context) error {
+	defer w.close()
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-w.buf:
+					w.write(e)
+				default:
+					return nil
+				}
+			}
+		case e := <-w.buf:
+			w.write(e)
+		}
+	}
+}
+
+func (w *Writer) write(e Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		w.fail(fmt.Errorf("failed to marshal event: %v", err))
+		return
+	}
+	line = append(line, '\n')
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			w.fail(err)
+			return
+		}
+	}
+	if w.size > 0 && (w.size+int64(len(line)) > w.cfg.MaxBytes || time.Since(w.opened) >= w.cfg.MaxAge) {
+		if err := w.rotate(); err != nil {
+			log.Printf("⚠️  Failed to rotate event log: %v", err)
+		}
+		if err := w.open(); err != nil {
+			w.fail(err)
+			return
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		// Reopen on the next event, the file may have been removed to free space
+		w.close()
+		w.fail(fmt.Errorf("failed to write event log: %v", err))
+		return
+	}
+	if w.failing {
+		w.failing = false
+		fmt.Printf("✅ Event log writable again, %d events lost\n", w.failed.Load())
+	}
+}
+
+func (w *Writer) fail(err error) {
+	w.failed.Add(1)
+	if !w.failing {
+		w.failing = true
+		log.Printf("⚠️  %v, dropping events until writes succeed", err)
+	}
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(filepath.Join(w.cfg.Dir, currentFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	w.file, w.size, w.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (w *Writer) close() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// rotate renames the current file after the time of rotation and removes
+// the oldest rotated files past MaxFiles
+func (w *Writer) rotate() error {
+	w.close()
+	name := rotatedStart + time.Now().UTC().Format(rotatedTime) + ".jsonl"
+	if err := os.Rename(filepath.Join(w.cfg.Dir, currentFile), filepath.Join(w.cfg.Dir, name)); err != nil {
+		return err
+	}
+	rotated, err := rotatedFiles(w.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for len(rotated) > w.cfg.MaxFiles {
+		if err := os.Remove(rotated[0].path); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// rotatedFile is a rotated file with the time it was rotated at, after
+// every event in it
+type rotatedFile struct {
+	path string
+	at   time.Time
+}
+
+// rotatedFiles lists the rotated files of dir, oldest first
+func rotatedFiles(dir string) ([]rotatedFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, rotatedGlob))
+	if err != nil {
+		return nil, err
+	}
+	var files []rotatedFile
+	for _, p := range paths {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), rotatedStart), ".jsonl")
+		at, err := time.Parse(rotatedTime, stamp)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{path: p, at: at})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].at.Before(files[j].at) })
+	return files, nil
+}
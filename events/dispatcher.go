@@ -0,0 +1,193 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+)
+
+// Dispatcher publishes events from a bounded buffer in the background, retrying
+// failed publications so that task processing never waits on the publisher
+type Dispatcher struct {
+	pub         Publisher
+	buf         chan Event
+	maxAttempts int
+	backoff     time.Duration
+
+	dropped atomic.Int64
+}
+
+// drainTimeout bounds the last flush when the dispatcher stops
+const drainTimeout = 5 * time.Second
+
+// NewDispatcher creates a dispatcher holding at most size pending events
+func NewDispatcher(pub Publisher, size int) *Dispatcher {
+	if size <= 0 {
+		size = 1000
+	}
+	return &Dispatcher{
+		pub:         pub,
+		buf:         make(chan Event, size),
+		maxAttempts: 5,
+		backoff:     500 * time.Millisecond,
+	}
+}
+
+// Run publishes events until ctx is done, then makes a last attempt to flush
+// buffered events within drainTimeout and closes the publisher if it holds a
+// connection
+func (d *Dispatcher) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			d.drain()
+			return nil
+		case e := <-d.buf:
+			d.publish(ctx, e)
+		}
+	}
+}
+
+func (d *Dispatcher) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if c, ok := d.pub.(io.Closer); ok {
+		defer c.Close()
+	}
+	for {
+		select {
+		case e := <-d.buf:
+			if err := d.pub.Publish(ctx, e); err != nil {
+				log.Printf("❌ Dropping event for task %s on shutdown: %v", e.TaskID, err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Submit queues an event for publication. It never blocks: when the buffer is
+// full the event is dropped and counted.
+func (d *Dispatcher) Submit(e Event) bool {
+	select {
+	case d.buf <- e:
+		return true
+	default:
+		d.dropped.Add(1)
+		log.Printf("⚠️  Event buffer full, dropping event for task %s", e.TaskID)
+		return false
+	}
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (d *Dispatcher) Dropped() int64 {
+	return d.dropped.Load()
+}
+
+func (d *Dispatcher) publish(ctx context.Context, e Event) {
+	delay := d.backoff
+	for attempt := 1; ; attempt++ {
+		pctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := d.pub.Publish(pctx, e)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt == d.maxAttempts {
+			log.Printf("❌ Giving up publishing event for task %s after %d attempts: %v", e.TaskID, attempt, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			// Put it back so the drain gets one more chance at it
+			d.Submit(e)
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// CompletionHook returns a middleware that submits an event whenever a task of a
+// type opted in via the registry reaches a terminal state. Retryable failures
+// are not terminal and publish nothing.
+func CompletionHook(d *Dispatcher) asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			spec, ok := common.LookupTaskSpec(t.Type())
+			if !ok || !spec.PublishEvents {
+				return next.ProcessTask(ctx, t)
+			}
+
+			start := time.Now()
+			err := next.ProcessTask(ctx, t)
+			outcome, terminal := classify(ctx, err)
+			if !terminal {
+				return err
+			}
+
+			id, _ := asynq.GetTaskID(ctx)
+			e := Event{
+				TaskID:     id,
+				Type:       t.Type(),
+				Tenant:     tenantOf(t),
+				Outcome:    outcome,
+				DurationMs: time.Since(start).Milliseconds(),
+				At:         time.Now(),
+			}
+			if err != nil {
+				e.Result = summarize(err.Error())
+			}
+			d.Submit(e)
+			return err
+		})
+	}
+}
+
+// classify maps a handler result to a terminal outcome, if it is one
+func classify(ctx context.Context, err error) (string, bool) {
+	if err == nil {
+		return OutcomeSucceeded, true
+	}
+	if errors.Is(err, asynq.SkipRetry) {
+		return OutcomeSkipped, true
+	}
+	// Deferred tasks are retried without using up a retry
+	if !flags.IsFailure(err) {
+		return "", false
+	}
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	if retried >= maxRetry {
+		return OutcomeArchived, true
+	}
+	return "", false
+}
+
+// tenantOf reads an optional top-level tenant_id from the payload
+func tenantOf(t *asynq.Task) string {
+	var p struct {
+		TenantID string `json:"tenant_id"`
+	}
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return ""
+	}
+	return p.TenantID
+}
+
+func summarize(s string) string {
+	const max = 200
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
@@ -0,0 +1,273 @@
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/events"
+	"asynqdemo/flags"
+	"asynqdemo/leak/leaktest"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// memoryPublisher keeps the events it is given, failing the first fail
+// publications
+type memoryPublisher struct {
+	mu     sync.Mutex
+	events []events.Event
+	fail   int
+	calls  int
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	if p.fail > 0 {
+		p.fail--
+		return errors.New("publisher unavailable")
+	}
+	p.events = append(p.events, e)
+	return nil
+}
+
+// wait returns the published events, waiting up to 5s for n of them
+func (p *memoryPublisher) wait(t *testing.T, n int) []events.Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		got := append([]events.Event(nil), p.events...)
+		p.mu.Unlock()
+		if len(got) >= n || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestCompletionHook runs opted-in tasks that succeed, skip retries, are
+// archived and are retried through a worker with the completion hook, and
+// fails unless one event per terminal outcome reaches the publisher, with
+// the tenant of the payload, and retried failures and types not opted in
+// publish nothing.
+func TestCompletionHook(t *testing.T) {
+	const taskType = "events:test"
+	common.RegisterTaskSpec(common.TaskSpec{Type: taskType, PublishEvents: true})
+
+	leaktest.Check(t)
+	srv := leaktest.Redis(t)
+	pub := &memoryPublisher{}
+	d := events.NewDispatcher(pub, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	mux := asynq.NewServeMux()
+	mux.Use(events.CompletionHook(d))
+	handler := func(ctx context.Context, task *asynq.Task) error {
+		var p struct {
+			Outcome string `json:"outcome"`
+		}
+		if err := json.Unmarshal(task.Payload(), &p); err != nil {
+			return err
+		}
+		mu.Lock()
+		attempts[p.Outcome]++
+		n := attempts[p.Outcome]
+		mu.Unlock()
+		switch {
+		case p.Outcome == "skipped":
+			return fmt.Errorf("invalid payload: %w", asynq.SkipRetry)
+		case p.Outcome == "archived":
+			return errors.New("smtp down")
+		case p.Outcome == "retried" && n == 1:
+			return errors.New("try again")
+		}
+		return nil
+	}
+	mux.HandleFunc(taskType, handler)
+	mux.HandleFunc("events:other", handler)
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{
+		Concurrency:    2,
+		LogLevel:       asynq.FatalLevel,
+		RetryDelayFunc: func(int, error, *asynq.Task) time.Duration { return time.Millisecond },
+	})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	for _, task := range []*asynq.Task{
+		asynq.NewTask(taskType, []byte(`{"outcome":"succeeded","tenant_id":"acme"}`), asynq.TaskID("succeeded")),
+		asynq.NewTask(taskType, []byte(`{"outcome":"skipped"}`), asynq.TaskID("skipped")),
+		asynq.NewTask(taskType, []byte(`{"outcome":"archived"}`), asynq.TaskID("archived"), asynq.MaxRetry(0)),
+		asynq.NewTask(taskType, []byte(`{"outcome":"retried"}`), asynq.TaskID("retried"), asynq.MaxRetry(1)),
+		asynq.NewTask("events:other", []byte(`{"outcome":"other"}`), asynq.TaskID("other")),
+	} {
+		if _, err := client.Enqueue(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pub.wait(t, 4)
+	// Let a stray event for the retry or the other type arrive
+	time.Sleep(300 * time.Millisecond)
+	got := pub.wait(t, 0)
+	byID := map[string]events.Event{}
+	for _, e := range got {
+		byID[e.TaskID] = e
+	}
+	if len(got) != 4 || len(byID) != 4 {
+		t.Fatalf("got events %+v, want one per terminal outcome", got)
+	}
+	for id, want := range map[string]string{"succeeded": events.OutcomeSucceeded, "skipped": events.OutcomeSkipped, "archived": events.OutcomeArchived, "retried": events.OutcomeSucceeded} {
+		if e := byID[id]; e.Outcome != want || e.Type != taskType {
+			t.Errorf("event of %s: %+v, want outcome %s", id, e, want)
+		}
+	}
+	if byID["succeeded"].Tenant != "acme" || byID["succeeded"].Result != "" {
+		t.Errorf("success event %+v, want tenant acme and no result", byID["succeeded"])
+	}
+	if byID["archived"].Result != "smtp down" {
+		t.Errorf("archive event result %q", byID["archived"].Result)
+	}
+}
+
+// TestDispatcher fails unless failed publications are retried in the
+// background and a full buffer drops events without blocking
+func TestDispatcher(t *testing.T) {
+	pub := &memoryPublisher{fail: 2}
+	d := events.NewDispatcher(pub, 1)
+	if !d.Submit(events.Event{TaskID: "a"}) {
+		t.Fatal("first event refused")
+	}
+	if d.Submit(events.Event{TaskID: "b"}) || d.Dropped() != 1 {
+		t.Errorf("full buffer accepted an event, %d dropped", d.Dropped())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(ctx)
+	}()
+	got := pub.wait(t, 1)
+	cancel()
+	<-done
+	if len(got) != 1 || got[0].TaskID != "a" || pub.calls != 3 {
+		t.Errorf("published %+v in %d calls, want a after 2 failures", got, pub.calls)
+	}
+}
+
+// TestRedisPublisher fails unless events reach subscribers of the channel
+// as JSON
+func TestRedisPublisher(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+	sub := rdb.Subscribe(ctx, "asynq.events")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := events.NewPublisher(events.Config{Backend: "redis", Subject: "asynq.events"}, srv.ConnOpt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.(*events.RedisPublisher).Close()
+	if err := pub.Publish(ctx, events.Event{TaskID: "t1", Type: common.TypeEmailTask, Outcome: events.OutcomeSucceeded}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-sub.Channel():
+		var e events.Event
+		if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil || e.TaskID != "t1" || e.Outcome != events.OutcomeSucceeded {
+			t.Errorf("received %s (%v)", msg.Payload, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	if _, err := events.NewPublisher(events.Config{Backend: "kafka"}, srv.ConnOpt()); err == nil {
+		t.Error("unknown backend accepted")
+	}
+}
+
+// TestDeferredAtMaxRetry runs a task without retries whose provider's
+// circuit is open, with the server config of main, and fails unless the
+// deferred attempt publishes nothing and the task's only event is its
+// success once the probe gets through
+func TestDeferredAtMaxRetry(t *testing.T) {
+	const taskType = "events:deferred"
+	common.RegisterTaskSpec(common.TaskSpec{Type: taskType, PublishEvents: true})
+
+	leaktest.Check(t)
+	srv := leaktest.Redis(t)
+	pub := &memoryPublisher{}
+	d := events.NewDispatcher(pub, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	breakers, err := circuit.NewRegistry(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	breakers.Threshold, breakers.Cooldown, breakers.Slack = 1, time.Second, 0
+	breaker := breakers.Breaker("provider")
+	breaker.Do(ctx, func(context.Context) error { return errors.New("provider unavailable") })
+	var calls atomic.Int32
+	mux := asynq.NewServeMux()
+	mux.Use(events.CompletionHook(d))
+	mux.HandleFunc(taskType, func(ctx context.Context, task *asynq.Task) error {
+		return breaker.Do(ctx, func(context.Context) error {
+			calls.Add(1)
+			return nil
+		})
+	})
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	if _, err := client.Enqueue(asynq.NewTask(taskType, nil), asynq.TaskID("deferred"), asynq.MaxRetry(0)); err != nil {
+		t.Fatal(err)
+	}
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{
+		Concurrency:              1,
+		LogLevel:                 asynq.FatalLevel,
+		DelayedTaskCheckInterval: 50 * time.Millisecond,
+		IsFailure:                flags.IsFailure,
+		RetryDelayFunc:           flags.RetryDelay(asynq.DefaultRetryDelayFunc),
+	})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	pub.wait(t, 1)
+	// Let a stray second event arrive
+	time.Sleep(300 * time.Millisecond)
+	got := pub.wait(t, 0)
+	if len(got) != 1 || got[0].Outcome != events.OutcomeSucceeded || calls.Load() != 1 {
+		t.Errorf("got events %+v after %d provider calls, want one success after the probe", got, calls.Load())
+	}
+}
@@ -0,0 +1,103 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Outcomes of a task that reached a terminal state
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeSkipped   = "skipped"
+	OutcomeArchived  = "archived"
+)
+
+// Event is the compact message published when a task reaches a terminal state
+type Event struct {
+	TaskID     string    `json:"task_id"`
+	Type       string    `json:"type"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Outcome    string    `json:"outcome"`
+	DurationMs int64     `json:"duration_ms"`
+	Result     string    `json:"result,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// Publisher delivers events to downstream systems
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Config selects and configures the publisher backend
+type Config struct {
+	// Backend is "redis" or "nats", empty disables publication
+	Backend string
+	// NATSURL is the server to publish to when Backend is "nats"
+	NATSURL string
+	// Subject is the Redis channel or NATS subject events go to
+	Subject string
+}
+
+// ConfigFromEnv reads EVENTS_BACKEND, EVENTS_NATS_URL and EVENTS_SUBJECT
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Backend: os.Getenv("EVENTS_BACKEND"),
+		NATSURL: "nats://localhost:4222",
+		Subject: "asynq.events",
+	}
+	if url := os.Getenv("EVENTS_NATS_URL"); url != "" {
+		cfg.NATSURL = url
+	}
+	if subject := os.Getenv("EVENTS_SUBJECT"); subject != "" {
+		cfg.Subject = subject
+	}
+	return cfg
+}
+
+// NewPublisher builds the publisher selected by cfg. The Redis connection is
+// only used by the "redis" backend.
+func NewPublisher(cfg Config, redisConnOpt asynq.RedisConnOpt) (Publisher, error) {
+	switch cfg.Backend {
+	case "redis":
+		rdb, ok := redisConnOpt.MakeRedisClient().(redis.UniversalClient)
+		if !ok {
+			return nil, fmt.Errorf("unsupported RedisConnOpt type %T", redisConnOpt)
+		}
+		return NewRedisPublisher(rdb, cfg.Subject), nil
+	case "nats":
+		return NewNATSPublisher(cfg.NATSURL, cfg.Subject)
+	default:
+		return nil, fmt.Errorf("unknown events backend %q", cfg.Backend)
+	}
+}
+
+// RedisPublisher publishes events on a Redis pub/sub channel
+type RedisPublisher struct {
+	client  redis.UniversalClient
+	channel string
+}
+
+// NewRedisPublisher creates a publisher for the given channel
+func NewRedisPublisher(client redis.UniversalClient, channel string) *RedisPublisher {
+	return &RedisPublisher{client: client, channel: channel}
+}
+
+// Publish sends the event as JSON to the channel
+func (p *RedisPublisher) Publish(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	return p.client.Publish(ctx, p.channel, data).Err()
+}
+
+// Close closes the Redis client
+func (p *RedisPublisher) Close() error {
+	return p.client.Close()
+}
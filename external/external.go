@@ -0,0 +1,215 @@
+// Package external runs handlers of selected task types in a separate
+// process, so a plugin that crashes, leaks or hangs cannot take the worker
+// down with it.
+//
+// The process gets a Request as JSON on stdin and may write a Response as
+// JSON to stdout. Exiting 0 completes the task, ExitSkipRetry archives it,
+// and any other exit or a crash fails it for a retry. When the task's
+// deadline passes, the process group is killed.
+package external
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+	"gopkg.in/yaml.v3"
+)
+
+// ExitSkipRetry is the exit code of a handler rejecting a task for good,
+// e.g. for an invalid payload (EX_DATAERR)
+const ExitSkipRetry = 65
+
+// maxOutput caps what is read from a handler's stdout and kept of its stderr
+const maxOutput = 1 << 20
+
+// Request is written to the handler's stdin
+type Request struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	// Payload is set for JSON payloads, PayloadBase64 for any other
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	PayloadBase64 []byte          `json:"payload_base64,omitempty"`
+	Deadline      time.Time       `json:"deadline,omitempty"`
+}
+
+// Response is read from the handler's stdout, which may also be empty.
+// Result is stored as the task's result; Error explains a non-zero exit.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Spec configures the external handler of a task type
+type Spec struct {
+	Type string   `yaml:"type"`
+	Path string   `yaml:"path"`
+	Args []string `yaml:"args"`
+	// Env is the whole environment of the process besides PATH, so the
+	// worker's secrets do not reach plugins
+	Env []string `yaml:"env"`
+}
+
+// LoadSpecs reads the "handlers" list of a YAML file
+func LoadSpecs(path string) ([]Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read external handlers: %v", err)
+	}
+	var file struct {
+		Handlers []Spec `yaml:"handlers"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse external handlers %s: %v", path, err)
+	}
+	seen := make(map[string]bool, len(file.Handlers))
+	for i, s := range file.Handlers {
+		switch {
+		case s.Type == "":
+			return nil, fmt.Errorf("handler %d of %s has no type", i+1, path)
+		case seen[s.Type]:
+			return nil, fmt.Errorf("handler %s of %s is duplicated", s.Type, path)
+		case s.Path == "":
+			return nil, fmt.Errorf("handler %s of %s has no path", s.Type, path)
+		}
+		if _, ok := common.LookupTaskSpec(s.Type); ok {
+			return nil, fmt.Errorf("handler %s of %s would replace a built-in task type", s.Type, path)
+		}
+		seen[s.Type] = true
+	}
+	return file.Handlers, nil
+}
+
+// SpecsFromEnv reads the file EXTERNAL_HANDLERS_FILE names, none when unset
+func SpecsFromEnv() ([]Spec, error) {
+	path := os.Getenv("EXTERNAL_HANDLERS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	return LoadSpecs(path)
+}
+
+// Handler runs one process per task
+type Handler struct {
+	Spec Spec
+	// WaitDelay is how long output is still read after the process exited,
+	// in case a child it left behind holds stdout open
+	WaitDelay time.Duration
+}
+
+// NewHandler creates the handler of spec
+func NewHandler(spec Spec) *Handler {
+	return &Handler{Spec: spec, WaitDelay: time.Second}
+}
+
+// ProcessTask runs the process for t
+func (h *Handler) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	req := Request{Type: t.Type()}
+	req.ID, _ = asynq.GetTaskID(ctx)
+	req.Deadline, _ = ctx.Deadline()
+	switch {
+	case len(t.Payload()) == 0:
+	case json.Valid(t.Payload()):
+		req.Payload = t.Payload()
+	default:
+		req.PayloadBase64 = t.Payload()
+	}
+	in, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %v", err)
+	}
+
+	cmd := exec.Command(h.Spec.Path, h.Spec.Args...)
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, h.Spec.Env...)
+	if dir, err := common.TaskTempDir(ctx); err == nil {
+		cmd.Dir = dir
+	}
+	var stdout, stderr tailBuffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(in), &stdout, &stderr
+	cmd.WaitDelay = h.WaitDelay
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start external handler %s: %v", h.Spec.Path, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+		// Children the handler left behind die with the task
+		killProcessGroup(cmd)
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return fmt.Errorf("external handler %s killed: %v", h.Spec.Path, ctx.Err())
+	}
+
+	var resp Response
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 && !stdout.truncated {
+		if jerr := json.Unmarshal(out, &resp); jerr != nil && err == nil {
+			return fmt.Errorf("external handler %s wrote an invalid response: %v", h.Spec.Path, jerr)
+		}
+	}
+	var exit *exec.ExitError
+	switch {
+	case errors.As(err, &exit) && exit.ExitCode() == ExitSkipRetry:
+		return fmt.Errorf("external handler %s rejected the task: %s: %w", h.Spec.Path, reason(resp, &stderr, exit), asynq.SkipRetry)
+	case errors.As(err, &exit):
+		return fmt.Errorf("external handler %s failed: %s", h.Spec.Path, reason(resp, &stderr, exit))
+	case err != nil:
+		return fmt.Errorf("external handler %s failed: %v", h.Spec.Path, err)
+	case resp.Error != "":
+		return fmt.Errorf("external handler %s failed: %s", h.Spec.Path, resp.Error)
+	}
+	if w := t.ResultWriter(); w != nil && len(resp.Result) > 0 {
+		if _, err := w.Write(resp.Result); err != nil {
+			return fmt.Errorf("failed to write result: %v", err)
+		}
+	}
+	return nil
+}
+
+// reason explains a failed exit by the response's error, else the last
+// line of stderr, else the exit status
+func reason(resp Response, stderr *tailBuffer, exit *exec.ExitError) string {
+	if resp.Error != "" {
+		return resp.Error
+	}
+	lines := strings.Split(strings.TrimSpace(string(stderr.Bytes())), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return fmt.Sprintf("%s (%v)", last, exit)
+	}
+	return exit.Error()
+}
+
+// Register adds the handler of every spec to mux
+func Register(mux *common.ControlMux, specs []Spec) {
+	for _, s := range specs {
+		mux.Handle(s.Type, NewHandler(s))
+	}
+}
+
+// tailBuffer keeps the first maxOutput bytes written to it
+type tailBuffer struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	if room := maxOutput - b.Len(); len(p) > room {
+		b.truncated = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
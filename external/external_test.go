@@ -0,0 +1,149 @@
+package external_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/external"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestExternalHandler builds cmd/external-handler and fails unless a
+// worker configured with it completes a task with the handler's result,
+// an invalid payload skips retries, a panic or a crash fails the task for a
+// retry, and a handler outliving the deadline is killed together with its
+// children. It skips when the go command or /bin/sh is not available.
+func TestExternalHandler(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skipf("go command not available: %v", err)
+	}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skipf("/bin/sh not available: %v", err)
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "external-handler")
+	if out, err := exec.Command("go", "build", "-o", bin, "asynqdemo/cmd/external-handler").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the sample handler: %v\n%s", err, out)
+	}
+
+	config := filepath.Join(dir, "handlers.yaml")
+	write := func(yaml string) {
+		if err := os.WriteFile(config, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("handlers:\n  - type: " + common.TypeEmailTask + "\n    path: " + bin + "\n")
+	if _, err := external.LoadSpecs(config); err == nil {
+		t.Errorf("an external handler replaced %s", common.TypeEmailTask)
+	}
+	write("handlers:\n  - type: text:count\n    path: " + bin + "\n")
+	specs, err := external.LoadSpecs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Success: the worker stores the handler's result
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	mux := common.NewControlMux()
+	external.Register(mux, specs)
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 1})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	info, err := client.Enqueue(asynq.NewTask("text:count", []byte(`{"text":"one two three"}`)), asynq.Retention(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		task, err := inspector.GetTaskInfo(info.Queue, info.ID)
+		if err == nil && task.State == asynq.TaskStateCompleted {
+			if got := strings.TrimSpace(string(task.Result)); got != `{"words":3}` {
+				t.Errorf("task result is %s, want {\"words\":3}", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the external task was not completed: %+v, %v", task, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	run := func(spec external.Spec, payload string, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return external.NewHandler(spec).ProcessTask(ctx, asynq.NewTask("text:count", []byte(payload)))
+	}
+	sample := external.Spec{Type: "text:count", Path: bin}
+	if err := run(sample, `{}`, 10*time.Second); !errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("an invalid payload returned %v, want SkipRetry", err)
+	}
+	if err := run(sample, `{"text":"x","crash":true}`, 10*time.Second); err == nil || errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("a panicking handler returned %v, want a retryable error", err)
+	}
+	crash := external.Spec{Type: "text:count", Path: "/bin/sh", Args: []string{"-c", "kill -SEGV $$"}}
+	if err := run(crash, `{}`, 10*time.Second); err == nil || errors.Is(err, asynq.SkipRetry) || !strings.Contains(err.Error(), "signal") {
+		t.Errorf("a crashing handler returned %v, want a retryable error naming the signal", err)
+	}
+
+	// Timeout: the handler and the child it started are killed
+	pidFile := filepath.Join(dir, "child.pid")
+	hang := external.Spec{Type: "text:count", Path: "/bin/sh", Args: []string{"-c", fmt.Sprintf("sleep 30 & echo $! > %s; wait", pidFile)}}
+	start := time.Now()
+	err = run(hang, `{}`, 500*time.Millisecond)
+	took := time.Since(start)
+	if err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("a hanging handler returned %v, want it killed", err)
+	}
+	if took > 3*time.Second {
+		t.Errorf("a hanging handler ran for %v past its 500ms deadline", took)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	deadline = time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Errorf("child %d of the hanging handler survived it", pid)
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// processAlive reports whether pid runs on Linux; zombies count as dead
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesized command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package external
+
+import "os/exec"
+
+// setProcessGroup does nothing where there are no process groups
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process itself; children it spawned survive
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,236 @@
+// Package flags holds per task type feature flags shared by the fleet
+// through Redis. The tasks of a delayed type wait and are tried again
+// later, except those the middleware is told are essential.
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Flag states
+const (
+	StateOn      = "on"
+	StateDelayed = "delayed"
+)
+
+// DefaultDelay is how long the task of a delayed type waits before it is
+// tried again
+const DefaultDelay = time.Minute
+
+const (
+	// stateKey maps task types to their state, detailKey to their Flag
+	stateKey    = "flags:task-types"
+	detailKey   = "flags:task-types:detail"
+	historyKey  = "flags:history"
+	historySize = 100
+	// cacheFor is how long the middleware uses the flags it read
+	cacheFor = 2 * time.Second
+)
+
+// setScript changes a flag unless it already is in the state, records the
+// change and reports whether there was one
+var setScript = redis.NewScript(`
+local old = redis.call("HGET", KEYS[1], ARGV[1]) or "on"
+if old == ARGV[2] then
+  return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+redis.call("LPUSH", KEYS[3], ARGV[3])
+redis.call("LTRIM", KEYS[3], 0, tonumber(ARGV[4]) - 1)
+return 1
+`)
+
+// Flag is the state of a task type and who set it why
+type Flag struct {
+	TaskType string    `json:"task_type"`
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	SetBy    string    `json:"set_by,omitempty"`
+	SetAt    time.Time `json:"set_at"`
+}
+
+// ErrDelayed is returned for a task held back by its type's flag. It is
+// not a failure: with IsFailure and RetryDelay in the server config the
+// task is tried again after Delay without using up a retry.
+type ErrDelayed struct {
+	TaskType string
+	Delay    time.Duration
+}
+
+func (e ErrDelayed) Error() string {
+	return fmt.Sprintf("%s is delayed by its feature flag, retrying in %v", e.TaskType, e.Delay)
+}
+
+// IsDelayed reports whether err is an ErrDelayed
+func IsDelayed(err error) bool {
+	var d ErrDelayed
+	return errors.As(err, &d)
+}
+
+// IsFailure is asynq's Config.IsFailure counting every error but ErrDelayed
+func IsFailure(err error) bool {
+	return !IsDelayed(err)
+}
+
+// RetryDelay returns a Config.RetryDelayFunc waiting the delay of an
+// ErrDelayed, and fallback's for any other error
+func RetryDelay(fallback asynq.RetryDelayFunc) asynq.RetryDelayFunc {
+	return func(n int, err error, t *asynq.Task) time.Duration {
+		var d ErrDelayed
+		if errors.As(err, &d) {
+			return d.Delay
+		}
+		return fallback(n, err, t)
+	}
+}
+
+// Store reads and changes the flags; every change is alerted
+type Store struct {
+	rdb   redis.UniversalClient
+	alert func(ctx context.Context, text string) error
+	// Delay is how long tasks of delayed types wait
+	Delay time.Duration
+
+	mu       sync.Mutex
+	cached   map[string]string
+	loadedAt time.Time
+}
+
+// NewStore creates a store; alert may be nil to only log changes
+func NewStore(rdb redis.UniversalClient, alert func(ctx context.Context, text string) error) *Store {
+	return &Store{rdb: rdb, alert: alert, Delay: DefaultDelay}
+}
+
+// State returns the state of taskType, read from Redis at most every
+// cacheFor
+func (s *Store) State(ctx context.Context, taskType string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached == nil || time.Since(s.loadedAt) >= cacheFor {
+		states, err := s.rdb.HGetAll(ctx, stateKey).Result()
+		if err != nil {
+			return "", fmt.Errorf("failed to read feature flags: %v", err)
+		}
+		s.cached, s.loadedAt = states, time.Now()
+	}
+	if state, ok := s.cached[taskType]; ok {
+		return state, nil
+	}
+	return StateOn, nil
+}
+
+// Get returns the flag of taskType, on when it was never set
+func (s *Store) Get(ctx context.Context, taskType string) (Flag, error) {
+	data, err := s.rdb.HGet(ctx, detailKey, taskType).Result()
+	if err == redis.Nil {
+		return Flag{TaskType: taskType, State: StateOn}, nil
+	}
+	if err != nil {
+		return Flag{}, fmt.Errorf("failed to read flag of %s: %v", taskType, err)
+	}
+	var f Flag
+	if err := json.Unmarshal([]byte(data), &f); err != nil {
+		return Flag{}, fmt.Errorf("invalid flag of %s: %v", taskType, err)
+	}
+	return f, nil
+}
+
+// All returns every flag ever set, by task type
+func (s *Store) All(ctx context.Context) ([]Flag, error) {
+	details, err := s.rdb.HGetAll(ctx, detailKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feature flags: %v", err)
+	}
+	all := make([]Flag, 0, len(details))
+	for taskType, data := range details {
+		var f Flag
+		if err := json.Unmarshal([]byte(data), &f); err != nil {
+			return nil, fmt.Errorf("invalid flag of %s: %v", taskType, err)
+		}
+		all = append(all, f)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].TaskType < all[j].TaskType })
+	return all, nil
+}
+
+// History returns the last changes, newest first
+func (s *Store) History(ctx context.Context) ([]Flag, error) {
+	items, err := s.rdb.LRange(ctx, historyKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flag history: %v", err)
+	}
+	history := make([]Flag, 0, len(items))
+	for _, data := range items {
+		var f Flag
+		if json.Unmarshal([]byte(data), &f) == nil {
+			history = append(history, f)
+		}
+	}
+	return history, nil
+}
+
+// Set changes the flag of f.TaskType to f.State, stamping SetAt, and
+// alerts; it reports false without alerting when the flag already was in
+// that state
+func (s *Store) Set(ctx context.Context, f Flag) (bool, error) {
+	if f.State != StateOn && f.State != StateDelayed {
+		return false, fmt.Errorf("invalid flag state %q, want %s or %s", f.State, StateOn, StateDelayed)
+	}
+	f.SetAt = time.Now().UTC()
+	data, err := json.Marshal(f)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal flag: %v", err)
+	}
+	changed, err := setScript.Run(ctx, s.rdb, []string{stateKey, detailKey, historyKey}, f.TaskType, f.State, data, historySize).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to set flag of %s: %v", f.TaskType, err)
+	}
+	if changed == 0 {
+		return false, nil
+	}
+	s.mu.Lock()
+	s.cached = nil
+	s.mu.Unlock()
+
+	text := fmt.Sprintf("Feature flag of %s is now %s (set by %s): %s", f.TaskType, f.State, f.SetBy, f.Reason)
+	log.Printf("🚩 %s", text)
+	if s.alert != nil {
+		if err := s.alert(ctx, text); err != nil {
+			log.Printf("❌ Failed to alert about the flag of %s: %v", f.TaskType, err)
+		}
+	}
+	return true, nil
+}
+
+// Middleware returns ErrDelayed for the tasks of delayed types unless
+// essential reports them as essential. Install it where it sees the plain
+// payload, after the metadata and decrypt middlewares. Tasks run when the
+// flags cannot be read.
+func (s *Store) Middleware(essential func(t *asynq.Task) bool) middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			state, err := s.State(ctx, t.Type())
+			if err != nil {
+				log.Printf("⚠️  %v", err)
+				return next.ProcessTask(ctx, t)
+			}
+			if state == StateDelayed && !essential(t) {
+				return ErrDelayed{TaskType: t.Type(), Delay: s.Delay}
+			}
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
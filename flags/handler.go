@@ -0,0 +1,70 @@
+package flags
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"asynqdemo/admin"
+)
+
+// flagsResponse is the body of GET /admin/flags
+type flagsResponse struct {
+	Flags   []Flag `json:"flags"`
+	History []Flag `json:"history"`
+}
+
+// setRequest is the body of PUT /admin/flags/{type}
+type setRequest struct {
+	State  string `json:"state"`
+	Reason string `json:"reason"`
+}
+
+// Handler serves GET /admin/flags, listing the flags and their last
+// changes, and PUT /admin/flags/{type} with {"state": "on"|"delayed",
+// "reason": "..."}, recorded as set by the caller's admin token
+func Handler(s *Store, authz *admin.Authorizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seg := admin.PathSegments(r, "/admin/flags")
+		switch {
+		case r.Method == http.MethodGet && len(seg) == 0:
+			all, err := s.All(r.Context())
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			history, err := s.History(r.Context())
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, flagsResponse{Flags: all, History: history})
+		case r.Method == http.MethodPut && len(seg) == 1:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+			if err != nil {
+				admin.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			var req setRequest
+			if err := json.Unmarshal(body, &req); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, `expected body {"state": "on"|"delayed", "reason": "..."}`)
+				return
+			}
+			name, _ := authz.Authenticate(r)
+			if _, err := s.Set(r.Context(), Flag{TaskType: seg[0], State: req.State, Reason: req.Reason, SetBy: "admin:" + name}); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			f, err := s.Get(r.Context(), seg[0])
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, f)
+		case len(seg) > 1:
+			admin.WriteError(w, http.StatusNotFound, "not found")
+		default:
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
@@ -0,0 +1,279 @@
+// Package fleet lets workers advertise their build and capabilities so that
+// producers can avoid enqueuing payloads no live worker understands.
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/common"
+	"asynqdemo/metadata"
+	"asynqdemo/pkg/taskclient"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyPayloadVersion is the task metadata attribute holding the payload version
+const KeyPayloadVersion = taskclient.KeyPayloadVersion
+
+const keyPrefix = "fleet:worker:"
+
+// Set at build time with -ldflags "-X asynqdemo/fleet.GitSHA=... -X asynqdemo/fleet.BuildTime=..."
+var (
+	GitSHA    string
+	BuildTime string
+)
+
+// WorkerInfo is what a worker advertises about itself
+type WorkerInfo struct {
+	ID        string           `json:"id"`
+	GitSHA    string           `json:"git_sha"`
+	BuildTime string           `json:"build_time"`
+	StartedAt time.Time        `json:"started_at"`
+	TaskTypes map[string][]int `json:"task_types"`
+	Features  []string         `json:"features"`
+}
+
+// Supports reports whether the worker handles the payload version of taskType
+func (w WorkerInfo) Supports(taskType string, version int) bool {
+	for _, v := range w.TaskTypes[taskType] {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalInfo describes this process from its build and the task registry
+func LocalInfo(features []string) WorkerInfo {
+	host, _ := os.Hostname()
+	info := WorkerInfo{
+		ID:        fmt.Sprintf("%s:%d", host, os.Getpid()),
+		GitSHA:    GitSHA,
+		BuildTime: BuildTime,
+		StartedAt: time.Now(),
+		TaskTypes: make(map[string][]int),
+		Features:  features,
+	}
+	// Fall back to the VCS stamp the go tool embeds
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.GitSHA == "":
+				info.GitSHA = s.Value
+			case s.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = s.Value
+			}
+		}
+	}
+	for _, spec := range common.TaskSpecs() {
+		info.TaskTypes[spec.Type] = spec.Versions()
+	}
+	return info
+}
+
+// Announcer keeps a worker's info in Redis while it runs. The key expires
+// when heartbeats stop, so crashed workers drop out of the fleet view.
+type Announcer struct {
+	rdb  redis.UniversalClient
+	info WorkerInfo
+	ttl  time.Duration
+}
+
+// NewAnnouncer creates an announcer whose entry lives for ttl without heartbeats
+func NewAnnouncer(rdb redis.UniversalClient, info WorkerInfo, ttl time.Duration) *Announcer {
+	return &Announcer{rdb: rdb, info: info, ttl: ttl}
+}
+
+// Run publishes the info and refreshes it until ctx is done, then removes
+// the worker from the fleet
+func (a *Announcer) Run(ctx context.Context) error {
+	if err := a.publish(ctx); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(a.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := a.rdb.Del(context.Background(), keyPrefix+a.info.ID).Err(); err != nil {
+				log.Printf("⚠️  Failed to remove fleet entry %s: %v", a.info.ID, err)
+			}
+			return nil
+		case <-ticker.C:
+			if err := a.publish(ctx); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+		}
+	}
+}
+
+func (a *Announcer) publish(ctx context.Context) error {
+	types, err := json.Marshal(a.info.TaskTypes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task types: %v", err)
+	}
+	features, err := json.Marshal(a.info.Features)
+	if err != nil {
+		return fmt.Errorf("failed to marshal features: %v", err)
+	}
+	key := keyPrefix + a.info.ID
+	pipe := a.rdb.TxPipeline()
+	pipe.HSet(ctx, key,
+		"id", a.info.ID,
+		"git_sha", a.info.GitSHA,
+		"build_time", a.info.BuildTime,
+		"started_at", a.info.StartedAt.Format(time.RFC3339),
+		"task_types", types,
+		"features", features,
+	)
+	pipe.Expire(ctx, key, a.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to publish fleet entry %s: %v", a.info.ID, err)
+	}
+	return nil
+}
+
+// List returns the live workers sorted by ID
+func List(ctx context.Context, rdb redis.UniversalClient) ([]WorkerInfo, error) {
+	var workers []WorkerInfo
+	iter := rdb.Scan(ctx, 0, keyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		fields, err := rdb.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", iter.Val(), err)
+		}
+		if len(fields) == 0 {
+			// Expired between SCAN and HGETALL
+			continue
+		}
+		w := WorkerInfo{ID: fields["id"], GitSHA: fields["git_sha"], BuildTime: fields["build_time"]}
+		w.StartedAt, _ = time.Parse(time.RFC3339, fields["started_at"])
+		if err := json.Unmarshal([]byte(fields["task_types"]), &w.TaskTypes); err != nil {
+			return nil, fmt.Errorf("failed to parse task types of %s: %v", w.ID, err)
+		}
+		if err := json.Unmarshal([]byte(fields["features"]), &w.Features); err != nil {
+			return nil, fmt.Errorf("failed to parse features of %s: %v", w.ID, err)
+		}
+		workers = append(workers, w)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan fleet: %v", err)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].ID < workers[j].ID })
+	return workers, nil
+}
+
+// Handler serves GET /admin/fleet
+func Handler(rdb redis.UniversalClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		workers, err := List(r.Context(), rdb)
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, workers)
+	})
+}
+
+// ErrUnsupportedVersion is returned by a refusing Gate when no live worker
+// handles the payload version of a task
+type ErrUnsupportedVersion struct {
+	TaskType string
+	Version  int
+}
+
+func (e ErrUnsupportedVersion) Error() string {
+	return fmt.Sprintf("no live worker supports %s payload version %d", e.TaskType, e.Version)
+}
+
+// Gate checks tasks against the fleet before they are enqueued. The fleet
+// view is cached for a few seconds to keep enqueues cheap.
+type Gate struct {
+	rdb    redis.UniversalClient
+	refuse bool
+
+	mu       sync.Mutex
+	workers  []WorkerInfo
+	loadedAt time.Time
+}
+
+// NewGate creates a gate that refuses unsupported tasks, or only warns about
+// them when refuse is false
+func NewGate(rdb redis.UniversalClient, refuse bool) *Gate {
+	return &Gate{rdb: rdb, refuse: refuse}
+}
+
+// Check decides whether a payload version of taskType may be enqueued
+func (g *Gate) Check(ctx context.Context, taskType string, version int) error {
+	workers, err := g.fleet(ctx)
+	if err != nil {
+		// Without a fleet view the check cannot be made; do not block producers
+		log.Printf("⚠️  Skipping version gate for %s: %v", taskType, err)
+		return nil
+	}
+	if Allowed(workers, taskType, version) {
+		return nil
+	}
+	gateErr := ErrUnsupportedVersion{TaskType: taskType, Version: version}
+	if g.refuse {
+		return gateErr
+	}
+	log.Printf("⚠️  %v", gateErr)
+	return nil
+}
+
+// Enqueue enqueues task after checking its payload_version metadata (default 1)
+func (g *Gate) Enqueue(ctx context.Context, client *asynq.Client, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	version := 1
+	if v, ok := metadata.FromTask(task)[KeyPayloadVersion]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", KeyPayloadVersion, v, err)
+		}
+		version = n
+	}
+	if err := g.Check(ctx, task.Type(), version); err != nil {
+		return nil, err
+	}
+	return client.EnqueueContext(ctx, task, opts...)
+}
+
+func (g *Gate) fleet(ctx context.Context) ([]WorkerInfo, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.loadedAt.IsZero() && time.Since(g.loadedAt) < 5*time.Second {
+		return g.workers, nil
+	}
+	workers, err := List(ctx, g.rdb)
+	if err != nil {
+		return nil, err
+	}
+	g.workers, g.loadedAt = workers, time.Now()
+	return workers, nil
+}
+
+// Allowed reports whether any worker supports the payload version of taskType
+func Allowed(workers []WorkerInfo, taskType string, version int) bool {
+	for _, w := range workers {
+		if w.Supports(taskType, version) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package fleet_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/fleet"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// announce runs an announcer for info until the returned stop is called
+func announce(t *testing.T, rdb redis.UniversalClient, info fleet.WorkerInfo) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := fleet.NewAnnouncer(rdb, info, time.Minute).Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitWorkers waits up to 5s for the fleet to list n workers
+func waitWorkers(t *testing.T, rdb redis.UniversalClient, n int) []fleet.WorkerInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		workers, err := fleet.List(context.Background(), rdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(workers) == n {
+			return workers
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fleet lists %d workers, want %d", len(workers), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestGate runs an old worker handling email payload version 1 and a new
+// one also handling version 2, and fails unless a refusing gate lets
+// versions some live worker handles through and refuses others without
+// enqueuing them, a warning gate enqueues them anyway, and version 2 is
+// refused once the new worker leaves the fleet
+func TestGate(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	old := fleet.WorkerInfo{ID: "worker-old", GitSHA: "aaa", TaskTypes: map[string][]int{"email:send": {1}}, Features: []string{"quota"}}
+	stopOld := announce(t, rdb, old)
+	defer stopOld()
+	stopNew := announce(t, rdb, fleet.WorkerInfo{ID: "worker-new", GitSHA: "bbb", TaskTypes: map[string][]int{"email:send": {1, 2}, "sms:send": {1}}})
+
+	workers := waitWorkers(t, rdb, 2)
+	if workers[0].ID != "worker-new" || workers[1].ID != "worker-old" || workers[1].GitSHA != "aaa" || workers[1].Features[0] != "quota" {
+		t.Errorf("fleet %+v", workers)
+	}
+	w := httptest.NewRecorder()
+	fleet.Handler(rdb).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/fleet", nil))
+	var listed []fleet.WorkerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 2 || !listed[0].Supports("email:send", 2) {
+		t.Errorf("GET /admin/fleet gave %d %s", w.Code, w.Body)
+	}
+
+	ctx := context.Background()
+	gate := fleet.NewGate(rdb, true)
+	for _, c := range []struct {
+		taskType string
+		version  int
+		allowed  bool
+	}{
+		{"email:send", 1, true},
+		{"email:send", 2, true},
+		{"email:send", 3, false},
+		{"sms:send", 1, true},
+		{"push:send", 1, false},
+	} {
+		err := gate.Check(ctx, c.taskType, c.version)
+		var unsupported fleet.ErrUnsupportedVersion
+		if c.allowed && err != nil || !c.allowed && (!errors.As(err, &unsupported) || unsupported.Version != c.version) {
+			t.Errorf("%s v%d: %v, allowed %v", c.taskType, c.version, err, c.allowed)
+		}
+	}
+
+	task := func(version string) *asynq.Task {
+		task, err := metadata.NewTask("email:send", []byte(`{}`), metadata.Metadata{fleet.KeyPayloadVersion: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return task
+	}
+	if _, err := gate.Enqueue(ctx, client, task("3")); err == nil {
+		t.Error("refusing gate enqueued version 3")
+	}
+	if _, err := gate.Enqueue(ctx, client, task("two")); err == nil {
+		t.Error("malformed version enqueued")
+	}
+	if _, err := gate.Enqueue(ctx, client, task("2")); err != nil {
+		t.Error(err)
+	}
+	if _, err := fleet.NewGate(rdb, false).Enqueue(ctx, client, task("3")); err != nil {
+		t.Errorf("warning gate refused: %v", err)
+	}
+	if q, err := inspector.GetQueueInfo("default"); err != nil || q.Pending != 2 {
+		t.Errorf("queue %+v (%v), want the version 2 and the warned task", q, err)
+	}
+
+	stopNew()
+	waitWorkers(t, rdb, 1)
+	if err := fleet.NewGate(rdb, true).Check(ctx, "email:send", 2); err == nil {
+		t.Error("version 2 allowed after its only worker left")
+	}
+}
+
+// TestGateWithoutFleet fails unless producers are not blocked when the
+// fleet cannot be read
+func TestGateWithoutFleet(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer rdb.Close()
+	if err := fleet.NewGate(rdb, true).Check(context.Background(), "email:send", 9); err != nil {
+		t.Errorf("gate without a fleet view refused: %v", err)
+	}
+}
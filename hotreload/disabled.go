@@ -0,0 +1,21 @@
+//go:build !dev
+
+package hotreload
+
+import "fmt"
+
+// Enabled reports whether hot reload was compiled in
+const Enabled = false
+
+// HandlerWatcher is only available in builds with the dev tag
+type HandlerWatcher struct{}
+
+// Watch fails in builds without the dev tag
+func Watch(dirs []string, registry *HandlerRegistry) (*HandlerWatcher, error) {
+	return nil, fmt.Errorf("hot reload requires building with -tags dev")
+}
+
+// Close does nothing
+func (hw *HandlerWatcher) Close() error {
+	return nil
+}
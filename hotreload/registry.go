@@ -0,0 +1,52 @@
+// Package hotreload swaps task handlers at runtime during development.
+package hotreload
+
+import (
+	"context"
+	"sync"
+
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+)
+
+// HandlerRegistry holds handlers that override the mux's, keyed by task type
+type HandlerRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]asynq.Handler
+}
+
+// NewHandlerRegistry creates an empty registry
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{handlers: make(map[string]asynq.Handler)}
+}
+
+// UpdateHandlers replaces the handlers of the given task types
+func (r *HandlerRegistry) UpdateHandlers(handlers map[string]asynq.Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for taskType, h := range handlers {
+		r.handlers[taskType] = h
+	}
+}
+
+// Lookup returns the handler registered for a task type
+func (r *HandlerRegistry) Lookup(taskType string) (asynq.Handler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[taskType]
+	return h, ok
+}
+
+// Middleware dispatches tasks to reloaded handlers ahead of the mux routes.
+// Install it last so the other middlewares still wrap reloaded handlers.
+func (r *HandlerRegistry) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			if h, ok := r.Lookup(t.Type()); ok {
+				return h.ProcessTask(ctx, t)
+			}
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
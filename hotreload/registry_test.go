@@ -0,0 +1,45 @@
+package hotreload_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"asynqdemo/hotreload"
+
+	"github.com/hibiken/asynq"
+)
+
+// reply returns a handler failing with msg, so tests can tell handlers apart
+func reply(msg string) asynq.Handler {
+	return asynq.HandlerFunc(func(context.Context, *asynq.Task) error { return errors.New(msg) })
+}
+
+// dispatch returns the message of the handler mux sends a taskType task to
+func dispatch(mux asynq.Handler, taskType string) string {
+	return mux.ProcessTask(context.Background(), asynq.NewTask(taskType, nil)).Error()
+}
+
+// TestHandlerRegistry fails unless reloaded handlers take over their task
+// types from the mux and other types still reach the mux routes
+func TestHandlerRegistry(t *testing.T) {
+	reg := hotreload.NewHandlerRegistry()
+	mux := asynq.NewServeMux()
+	mux.Use(asynq.MiddlewareFunc(reg.Middleware()))
+	mux.Handle("email:send", reply("built-in email"))
+	mux.Handle("sms:send", reply("built-in sms"))
+
+	if got := dispatch(mux, "email:send"); got != "built-in email" {
+		t.Errorf("email went to %q before a reload", got)
+	}
+	reg.UpdateHandlers(map[string]asynq.Handler{"email:send": reply("reloaded email")})
+	reg.UpdateHandlers(map[string]asynq.Handler{"push:send": reply("reloaded push")})
+	for taskType, want := range map[string]string{"email:send": "reloaded email", "sms:send": "built-in sms", "push:send": "reloaded push"} {
+		if got := dispatch(mux, taskType); got != want {
+			t.Errorf("%s went to %q, want %q", taskType, got, want)
+		}
+	}
+	if _, ok := reg.Lookup("sms:send"); ok {
+		t.Error("sms handler registered without a reload")
+	}
+}
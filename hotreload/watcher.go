@@ -0,0 +1,154 @@
+//go:build dev
+
+package hotreload
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hibiken/asynq"
+)
+
+// Enabled reports whether hot reload was compiled in
+const Enabled = true
+
+// debounce collapses the burst of events an editor save produces
+const debounce = 200 * time.Millisecond
+
+// HandlerWatcher recompiles handlers when their sources change
+type HandlerWatcher struct {
+	dirs     []string
+	registry *HandlerRegistry
+	compiler func(path string) (map[string]asynq.Handler, error)
+
+	watcher *fsnotify.Watcher
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+}
+
+// NewHandlerWatcher watches the .go files in dirs and loads what compiler
+// builds from a changed file into registry
+func NewHandlerWatcher(dirs []string, registry *HandlerRegistry, compiler func(path string) (map[string]asynq.Handler, error)) (*HandlerWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %v", err)
+	}
+	for _, dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("failed to watch %s: %v", dir, err)
+		}
+	}
+	return &HandlerWatcher{dirs: dirs, registry: registry, compiler: compiler, watcher: w, timers: make(map[string]*time.Timer)}, nil
+}
+
+// Start processes file events in the background until Close
+func (hw *HandlerWatcher) Start() {
+	go func() {
+		for {
+			select {
+			case ev, ok := <-hw.watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Ext(ev.Name) == ".go" && ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					hw.schedule(ev.Name)
+				}
+			case err, ok := <-hw.watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("⚠️  Hot reload watcher error: %v", err)
+			}
+		}
+	}()
+}
+
+func (hw *HandlerWatcher) schedule(path string) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if t, ok := hw.timers[path]; ok {
+		t.Reset(debounce)
+		return
+	}
+	hw.timers[path] = time.AfterFunc(debounce, func() {
+		hw.mu.Lock()
+		delete(hw.timers, path)
+		hw.mu.Unlock()
+		hw.reload(path)
+	})
+}
+
+func (hw *HandlerWatcher) reload(path string) {
+	handlers, err := hw.compiler(path)
+	if err != nil {
+		log.Printf("❌ Hot reload of %s failed: %v", path, err)
+		return
+	}
+	hw.registry.UpdateHandlers(handlers)
+	types := make([]string, 0, len(handlers))
+	for t := range handlers {
+		types = append(types, t)
+	}
+	fmt.Printf("🔥 Reloaded %s: %s\n", path, strings.Join(types, ", "))
+}
+
+// Close stops watching
+func (hw *HandlerWatcher) Close() error {
+	return hw.watcher.Close()
+}
+
+// GoPluginCompiler builds the package holding path as a Go plugin and returns
+// the handlers from its exported func Handlers() map[string]asynq.Handler.
+// Plugins must live inside this module so they share its asynq build.
+func GoPluginCompiler(path string) (map[string]asynq.Handler, error) {
+	dir := filepath.Dir(path)
+	out, err := os.CreateTemp("", "hotreload-*.so")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plugin file: %v", err)
+	}
+	out.Close()
+
+	// A plugin path can only be loaded once per process, so give every build its own
+	pluginPath := fmt.Sprintf("hotreload/%s/%d", filepath.Base(dir), time.Now().UnixNano())
+	target := dir
+	if !filepath.IsAbs(dir) {
+		target = "./" + filepath.ToSlash(dir)
+	}
+	cmd := exec.Command("go", "build", "-buildmode=plugin", "-ldflags=-pluginpath="+pluginPath, "-o", out.Name(), target)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to build plugin: %v\n%s", err, output)
+	}
+
+	p, err := plugin.Open(out.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plugin: %v", err)
+	}
+	sym, err := p.Lookup("Handlers")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Handlers in plugin: %v", err)
+	}
+	handlers, ok := sym.(func() map[string]asynq.Handler)
+	if !ok {
+		return nil, fmt.Errorf("plugin Handlers has type %T, want func() map[string]asynq.Handler", sym)
+	}
+	return handlers(), nil
+}
+
+// Watch starts reloading handlers from the plugin packages under dirs
+func Watch(dirs []string, registry *HandlerRegistry) (*HandlerWatcher, error) {
+	hw, err := NewHandlerWatcher(dirs, registry, GoPluginCompiler)
+	if err != nil {
+		return nil, err
+	}
+	hw.Start()
+	return hw, nil
+}
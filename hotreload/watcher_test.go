@@ -0,0 +1,95 @@
+//go:build dev
+
+package hotreload_test
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"asynqdemo/hotreload"
+
+	"github.com/hibiken/asynq"
+)
+
+// constCompiler stands in for a plugin build: it registers a handler for
+// each string constant of the file, keyed by the constant's value and
+// replying with its name
+func constCompiler(path string) (map[string]asynq.Handler, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	handlers := map[string]asynq.Handler{}
+	for _, d := range f.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.CONST {
+			continue
+		}
+		for _, s := range gd.Specs {
+			vs := s.(*ast.ValueSpec)
+			lit, ok := vs.Values[0].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				continue
+			}
+			taskType, _ := strconv.Unquote(lit.Value)
+			handlers[taskType] = reply(vs.Names[0].Name)
+		}
+	}
+	return handlers, nil
+}
+
+// TestHandlerWatcher writes a handler file into a watched directory,
+// changes it, and fails unless the mux dispatches to each version within
+// 2 seconds and a file that does not compile keeps the last version
+func TestHandlerWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "handlers.go")
+	reg := hotreload.NewHandlerRegistry()
+	hw, err := hotreload.NewHandlerWatcher([]string{dir}, reg, constCompiler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hw.Close()
+	hw.Start()
+
+	mux := asynq.NewServeMux()
+	mux.Use(asynq.MiddlewareFunc(reg.Middleware()))
+	mux.Handle("email:send", reply("builtIn"))
+
+	write := func(src string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	await := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			got := dispatch(mux, "email:send")
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("email went to %q 2s after the change, want %q", got, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	await("builtIn")
+	write(fmt.Sprintf("package handlers\n\nconst v1 = %q\n", "email:send"))
+	await("v1")
+	write(fmt.Sprintf("package handlers\n\nconst v2 = %q\n", "email:send"))
+	await("v2")
+	write("package handlers\n\nconst broken = \n")
+	time.Sleep(500 * time.Millisecond)
+	await("v2")
+}
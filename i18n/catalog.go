@@ -0,0 +1,200 @@
+package i18n
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultLocale is the locale every lookup finally falls back to
+const DefaultLocale = "en"
+
+//go:embed locales/*.json
+var embedded embed.FS
+
+// Recorder is told about every lookup that had to fall back to another locale
+type Recorder interface {
+	RecordFallback(ctx context.Context, locale, key, taskType string)
+}
+
+// Catalog holds the message bundles of every locale plus per-tenant overrides
+// layered on top of them
+type Catalog struct {
+	base    map[string]map[string]string            // locale -> key -> message
+	tenants map[string]map[string]map[string]string // tenant -> locale -> key -> message
+
+	mu       sync.RWMutex
+	recorder Recorder
+}
+
+// Default returns the catalog built from the embedded locale bundles
+func Default() (*Catalog, error) {
+	return Load(embedded, "locales")
+}
+
+// Load reads <locale>.json bundles from dir and tenant overrides from
+// dir/tenants/<tenant>/<locale>.json
+func Load(fsys fs.FS, dir string) (*Catalog, error) {
+	c := &Catalog{
+		base:    make(map[string]map[string]string),
+		tenants: make(map[string]map[string]map[string]string),
+	}
+	if err := loadBundles(fsys, dir, c.base); err != nil {
+		return nil, err
+	}
+	if _, ok := c.base[DefaultLocale]; !ok {
+		return nil, fmt.Errorf("i18n catalog in %s has no %s bundle", dir, DefaultLocale)
+	}
+
+	tenantDir := path.Join(dir, "tenants")
+	entries, err := fs.ReadDir(fsys, tenantDir)
+	if err != nil {
+		// Tenant overrides are optional
+		return c, nil
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		bundles := make(map[string]map[string]string)
+		if err := loadBundles(fsys, path.Join(tenantDir, e.Name()), bundles); err != nil {
+			return nil, err
+		}
+		c.tenants[e.Name()] = bundles
+	}
+	return c, nil
+}
+
+func loadBundles(fsys fs.FS, dir string, into map[string]map[string]string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to list locale bundles in %s: %v", dir, err)
+	}
+	for _, f := range files {
+		data, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return fmt.Errorf("failed to read locale bundle %s: %v", f, err)
+		}
+		var msgs map[string]string
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			return fmt.Errorf("failed to parse locale bundle %s: %v", f, err)
+		}
+		into[strings.TrimSuffix(path.Base(f), ".json")] = msgs
+	}
+	return nil
+}
+
+// SetRecorder installs the recorder told about fallbacks
+func (c *Catalog) SetRecorder(r Recorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recorder = r
+}
+
+// Locales returns the configured base locales
+func (c *Catalog) Locales() []string {
+	locales := make([]string, 0, len(c.base))
+	for l := range c.base {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Translate looks key up for the tenant's override of locale, then the base
+// locale, then the default locale. Falling back to the default locale is
+// recorded; a key missing everywhere is returned as is.
+func (c *Catalog) Translate(ctx context.Context, locale, tenant, taskType, key string) string {
+	if locale == "" {
+		locale = DefaultLocale
+	}
+	if msg, ok := c.tenants[tenant][locale][key]; ok && tenant != "" {
+		return msg
+	}
+	if msg, ok := c.base[locale][key]; ok {
+		return msg
+	}
+
+	c.mu.RLock()
+	r := c.recorder
+	c.mu.RUnlock()
+	if r != nil {
+		r.RecordFallback(ctx, locale, key, taskType)
+	}
+
+	if msg, ok := c.tenants[tenant][DefaultLocale][key]; ok && tenant != "" {
+		return msg
+	}
+	if msg, ok := c.base[DefaultLocale][key]; ok {
+		return msg
+	}
+	return key
+}
+
+// Gap is a referenced key missing from a locale
+type Gap struct {
+	Locale   string `json:"locale"`
+	Key      string `json:"key"`
+	TaskType string `json:"task_type"`
+}
+
+func (g Gap) String() string {
+	return fmt.Sprintf("%s: %q (used by %s)", g.Locale, g.Key, g.TaskType)
+}
+
+// Check cross-references every referenced key against every base locale
+func (c *Catalog) Check() []Gap {
+	var gaps []Gap
+	for _, ref := range References() {
+		for _, locale := range c.Locales() {
+			if _, ok := c.base[locale][ref.Key]; !ok {
+				gaps = append(gaps, Gap{Locale: locale, Key: ref.Key, TaskType: ref.TaskType})
+			}
+		}
+	}
+	return gaps
+}
+
+// Reference is a message key used by a handler or template
+type Reference struct {
+	TaskType string
+	Key      string
+}
+
+var (
+	refsMu sync.Mutex
+	refs   = map[Reference]bool{}
+)
+
+// Use declares the keys a task type's handler or templates look up, so the
+// startup check can verify them
+func Use(taskType string, keys ...string) {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+	for _, k := range keys {
+		refs[Reference{TaskType: taskType, Key: k}] = true
+	}
+}
+
+// References returns all declared keys sorted by task type and key
+func References() []Reference {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+	out := make([]Reference, 0, len(refs))
+	for r := range refs {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].TaskType != out[j].TaskType {
+			return out[i].TaskType < out[j].TaskType
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
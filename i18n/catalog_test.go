@@ -0,0 +1,148 @@
+package i18n_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/i18n"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testBundles has an English and a German base bundle, German missing
+// "bye", and an acme override of one English and one German message
+var testBundles = fstest.MapFS{
+	"locales/en.json":              {Data: []byte(`{"hello": "Hello", "bye": "Bye"}`)},
+	"locales/de.json":              {Data: []byte(`{"hello": "Hallo"}`)},
+	"locales/tenants/acme/en.json": {Data: []byte(`{"bye": "See you at Acme"}`)},
+	"locales/tenants/acme/de.json": {Data: []byte(`{"hello": "Servus"}`)},
+}
+
+// recording keeps the fallbacks it is told about
+type recording []string
+
+func (r *recording) RecordFallback(ctx context.Context, locale, key, taskType string) {
+	*r = append(*r, locale+"|"+key+"|"+taskType)
+}
+
+// TestTenantOverrides fails unless a tenant's bundle wins over the base
+// locale, other tenants see the base, and only lookups falling back to
+// English are recorded
+func TestTenantOverrides(t *testing.T) {
+	c, err := i18n.Load(testBundles, "locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec recording
+	c.SetRecorder(&rec)
+	ctx := context.Background()
+	for _, tc := range []struct{ locale, tenant, key, want string }{
+		{"de", "acme", "hello", "Servus"},
+		{"de", "globex", "hello", "Hallo"},
+		{"de", "", "hello", "Hallo"},
+		{"en", "acme", "bye", "See you at Acme"},
+		{"en", "acme", "hello", "Hello"},
+		{"", "", "bye", "Bye"},
+		{"de", "acme", "bye", "See you at Acme"},
+		{"de", "globex", "bye", "Bye"},
+		{"fr", "", "hello", "Hello"},
+		{"en", "", "unknown", "unknown"},
+	} {
+		if got := c.Translate(ctx, tc.locale, tc.tenant, "test", tc.key); got != tc.want {
+			t.Errorf("Translate(%s, %s, %s) = %q, want %q", tc.locale, tc.tenant, tc.key, got, tc.want)
+		}
+	}
+	want := []string{"de|bye|test", "de|bye|test", "fr|hello|test", "en|unknown|test"}
+	if len(rec) != len(want) {
+		t.Fatalf("recorded %v, want %v", rec, want)
+	}
+	for i := range want {
+		if rec[i] != want[i] {
+			t.Errorf("recorded %v, want %v", rec, want)
+			break
+		}
+	}
+
+	if _, err := i18n.Load(fstest.MapFS{"locales/de.json": {Data: []byte(`{}`)}}, "locales"); err == nil {
+		t.Error("catalog without an en bundle loaded")
+	}
+	if _, err := i18n.Load(fstest.MapFS{"locales/en.json": {Data: []byte(`{`)}}, "locales"); err == nil {
+		t.Error("malformed bundle loaded")
+	}
+}
+
+// TestCheck fails unless a key declared by a task type and missing from a
+// locale is reported as a gap, and the embedded catalog has none
+func TestCheck(t *testing.T) {
+	c, err := i18n.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gaps := c.Check(); len(gaps) != 0 {
+		t.Errorf("embedded catalog has gaps %v", gaps)
+	}
+
+	i18n.Use("i18n:test", "hello", "bye")
+	c, err = i18n.Load(testBundles, "locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []i18n.Gap
+	for _, g := range c.Check() {
+		if g.TaskType == "i18n:test" {
+			found = append(found, g)
+		}
+	}
+	want := i18n.Gap{Locale: "de", Key: "bye", TaskType: "i18n:test"}
+	if len(found) != 1 || found[0] != want {
+		t.Errorf("gaps %v, want %v", found, want)
+	}
+}
+
+// TestMissingHandler records fallbacks in Redis and fails unless
+// GET /admin/i18n/missing lists them most frequent first
+func TestMissingHandler(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+
+	c, err := i18n.Load(testBundles, "locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetRecorder(i18n.NewRedisRecorder(rdb))
+	ctx := context.Background()
+	c.Translate(ctx, "fr", "", "email:send", "hello")
+	c.Translate(ctx, "de", "", "email:send", "bye")
+	c.Translate(ctx, "de", "", "email:send", "bye")
+	c.Translate(ctx, "de", "", "email:send", "hello")
+
+	w := httptest.NewRecorder()
+	i18n.MissingHandler(rdb).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/i18n/missing", nil))
+	var got []i18n.Missing
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET gave %d %s", w.Code, w.Body)
+	}
+	want := []i18n.Missing{
+		{Locale: "de", Key: "bye", TaskType: "email:send", Count: 2},
+		{Locale: "fr", Key: "hello", TaskType: "email:send", Count: 1},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("missing %+v, want %+v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	i18n.MissingHandler(rdb).ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/i18n/missing", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE gave %d", w.Code)
+	}
+}
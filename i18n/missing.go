@@ -0,0 +1,84 @@
+package i18n
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"asynqdemo/admin"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MissingKey is the Redis hash counting translation fallbacks
+const MissingKey = "i18n:missing"
+
+// Missing is one recorded fallback with the number of times it happened
+type Missing struct {
+	Locale   string `json:"locale"`
+	Key      string `json:"key"`
+	TaskType string `json:"task_type"`
+	Count    int64  `json:"count"`
+}
+
+// RedisRecorder counts fallbacks in a Redis hash keyed by locale, key and task type
+type RedisRecorder struct {
+	rdb redis.UniversalClient
+}
+
+// NewRedisRecorder creates a recorder writing to MissingKey
+func NewRedisRecorder(rdb redis.UniversalClient) *RedisRecorder {
+	return &RedisRecorder{rdb: rdb}
+}
+
+// RecordFallback increments the counter of the fallback. Errors are only logged
+// since a failed recording must never fail a task.
+func (r *RedisRecorder) RecordFallback(ctx context.Context, locale, key, taskType string) {
+	field := strings.Join([]string{locale, key, taskType}, "|")
+	if err := r.rdb.HIncrBy(ctx, MissingKey, field, 1).Err(); err != nil {
+		log.Printf("⚠️  Failed to record missing translation %s: %v", field, err)
+	}
+}
+
+// ListMissing returns all recorded fallbacks, most frequent first
+func ListMissing(ctx context.Context, rdb redis.UniversalClient) ([]Missing, error) {
+	fields, err := rdb.HGetAll(ctx, MissingKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Missing, 0, len(fields))
+	for field, v := range fields {
+		parts := strings.SplitN(field, "|", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		n, _ := strconv.ParseInt(v, 10, 64)
+		out = append(out, Missing{Locale: parts[0], Key: parts[1], TaskType: parts[2], Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Locale+out[i].Key < out[j].Locale+out[j].Key
+	})
+	return out, nil
+}
+
+// MissingHandler serves GET /admin/i18n/missing
+func MissingHandler(rdb redis.UniversalClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		missing, err := ListMissing(r.Context(), rdb)
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, missing)
+	})
+}
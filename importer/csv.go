@@ -0,0 +1,157 @@
+// Package importer turns bulk files into tasks.
+package importer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"asynqdemo/common"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// RowToTask builds the task for one CSV row
+type RowToTask func(header, row []string) (*asynq.Task, error)
+
+// CSVImporter enqueues a task per CSV row
+type CSVImporter struct {
+	client  *asynq.Client
+	factory RowToTask
+	opts    []asynq.Option
+
+	journal   *Journal
+	keyColumn string
+}
+
+// NewCSVImporter creates an importer enqueuing the tasks of factory with opts
+func NewCSVImporter(client *asynq.Client, factory RowToTask, opts ...asynq.Option) *CSVImporter {
+	return &CSVImporter{client: client, factory: factory, opts: opts}
+}
+
+// WithJournal records the rows in j and skips those it already has. Rows
+// are keyed by the value of keyColumn, or by line number when it is empty.
+func (ci *CSVImporter) WithJournal(j *Journal, keyColumn string) *CSVImporter {
+	ci.journal, ci.keyColumn = j, keyColumn
+	return ci
+}
+
+// ImportFromCSV reads a CSV file with a header line and enqueues the rows in
+// batches of batchSize. Rows that do not parse or that factory rejects are
+// skipped; their errors and enqueue failures are returned in errs.
+func (ci *CSVImporter) ImportFromCSV(r io.Reader, batchSize int) (imported, skipped int, errs []error) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return 0, 0, []error{fmt.Errorf("failed to read CSV header: %v", err)}
+	}
+	// Rows must have as many fields as the header
+	cr.FieldsPerRecord = len(header)
+	keyIndex := -1
+	if ci.keyColumn != "" {
+		for i, name := range header {
+			if name == ci.keyColumn {
+				keyIndex = i
+			}
+		}
+		if keyIndex < 0 {
+			return 0, 0, []error{fmt.Errorf("key column %q is not in the CSV header", ci.keyColumn)}
+		}
+	}
+
+	type row struct {
+		key string
+		t   *asynq.Task
+	}
+	batch := make([]row, 0, batchSize)
+	flush := func() {
+		for _, r := range batch {
+			if ci.journal != nil {
+				ok, err := ci.journal.Enqueue(ci.client, r.key, r.t, ci.opts...)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("row %s: failed to enqueue %s task: %v", r.key, r.t.Type(), err))
+				} else if ok {
+					imported++
+				}
+				continue
+			}
+			if _, err := ci.client.Enqueue(r.t, ci.opts...); err != nil {
+				errs = append(errs, fmt.Errorf("failed to enqueue %s task: %v", r.t.Type(), err))
+				continue
+			}
+			imported++
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				errs = append(errs, fmt.Errorf("failed to read CSV: %v", err))
+				break
+			}
+			skipped++
+			errs = append(errs, err)
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		t, err := ci.factory(header, record)
+		if err != nil {
+			skipped++
+			errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		key := "line:" + strconv.Itoa(line)
+		if keyIndex >= 0 {
+			key = record[keyIndex]
+		}
+		batch = append(batch, row{key: key, t: t})
+		if len(batch) == batchSize {
+			flush()
+		}
+	}
+	flush()
+	return imported, skipped, errs
+}
+
+// ColumnsAsPayload is a RowToTask that uses the header as payload field
+// names. Numbers and booleans are kept as JSON literals, and the payload must
+// validate against the registered type of taskType.
+func ColumnsAsPayload(taskType string) RowToTask {
+	return func(header, row []string) (*asynq.Task, error) {
+		fields := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			fields[name] = literal(row[i])
+		}
+		payload, err := json.Marshal(fields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal payload: %v", err)
+		}
+		if err := common.ValidatePayload(taskType, payload); err != nil {
+			return nil, err
+		}
+		return metadata.NewTask(taskType, payload, nil)
+	}
+}
+
+func literal(s string) interface{} {
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return json.Number(s)
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+	return s
+}
@@ -0,0 +1,65 @@
+package importer_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/importer"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestImportFromCSV imports 100 rows of which two have the wrong number of
+// fields and three a user ID that is not a number, in batches of 20, and fails unless the
+// 95 others are enqueued as email tasks with typed payloads and the 5 are
+// skipped with an error each
+func TestImportFromCSV(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	var csv strings.Builder
+	csv.WriteString("user_id,email,subject,message\n")
+	for i := 1; i <= 100; i++ {
+		switch {
+		case i == 10 || i == 50:
+			fmt.Fprintf(&csv, "%d,user%d@example.com,Hello\n", i, i)
+		case i%30 == 0:
+			fmt.Fprintf(&csv, "user-%d,user%d@example.com,Hello,Row %d\n", i, i, i)
+		default:
+			fmt.Fprintf(&csv, "%d,user%d@example.com,Hello,Row %d\n", i, i, i)
+		}
+	}
+
+	ci := importer.NewCSVImporter(client, importer.ColumnsAsPayload(common.TypeEmailTask), asynq.Queue("import"))
+	imported, skipped, errs := ci.ImportFromCSV(strings.NewReader(csv.String()), 20)
+	if imported != 95 || skipped != 5 || len(errs) != 5 {
+		t.Fatalf("imported %d, skipped %d with errors %v", imported, skipped, errs)
+	}
+	tasks, err := inspector.ListPendingTasks("import", asynq.PageSize(200))
+	if err != nil || len(tasks) != 95 {
+		t.Fatalf("%d tasks pending (%v), want 95", len(tasks), err)
+	}
+	for _, task := range tasks {
+		payload, _ := metadata.Unwrap(task.Payload)
+		var p common.EmailPayload
+		if task.Type != common.TypeEmailTask || json.Unmarshal(payload, &p) != nil || p.Email != fmt.Sprintf("user%d@example.com", p.UserID) {
+			t.Errorf("task %s %s", task.Type, payload)
+		}
+	}
+
+	if _, _, errs := ci.ImportFromCSV(strings.NewReader(""), 20); len(errs) != 1 || !strings.Contains(errs[0].Error(), "header") {
+		t.Errorf("empty file gave %v", errs)
+	}
+}
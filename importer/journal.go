@@ -0,0 +1,167 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Journal outcomes of a row
+const (
+	OutcomeEnqueued = "enqueued"
+	// OutcomeDuplicate is a row whose task ID was already taken, i.e. it
+	// was enqueued by an earlier run whose journal entry was lost
+	OutcomeDuplicate = "duplicate"
+	OutcomeFailed    = "failed"
+)
+
+// Default sync policy of a journal
+const (
+	DefaultSyncEvery    = 1000
+	DefaultSyncInterval = time.Second
+)
+
+// JournalEntry is one line of a journal
+type JournalEntry struct {
+	Key     string `json:"key"`
+	TaskID  string `json:"task_id"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Journal is an append-only file of the rows an import enqueued, so a
+// resumed import skips them. Entries are fsynced every SyncEvery entries
+// or SyncInterval, not per row; entries lost in a crash are caught by the
+// deterministic task IDs instead.
+type Journal struct {
+	// Job namespaces the task IDs, the same job must use the same name
+	Job          string
+	SyncEvery    int
+	SyncInterval time.Duration
+
+	f        *os.File
+	w        *bufio.Writer
+	done     map[string]bool
+	pending  int
+	lastSync time.Time
+
+	// Resumed counts rows skipped because the journal has them
+	Resumed int
+	// Duplicates counts rows whose task ID was already taken
+	Duplicates int
+}
+
+// OpenJournal opens the journal at path for job. With resume, the rows an
+// existing journal recorded as enqueued are skipped; without, an existing
+// journal is an error so two imports are never mixed.
+func OpenJournal(path, job string, resume bool) (*Journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read journal: %v", err)
+	}
+	if len(data) > 0 && !resume {
+		return nil, fmt.Errorf("journal %s exists, resume the import or remove it", path)
+	}
+	j := &Journal{Job: job, SyncEvery: DefaultSyncEvery, SyncInterval: DefaultSyncInterval, done: make(map[string]bool), lastSync: time.Now()}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var e JournalEntry
+		// A crash may have torn the last line
+		if json.Unmarshal(line, &e) != nil {
+			continue
+		}
+		j.done[e.Key] = e.Outcome == OutcomeEnqueued || e.Outcome == OutcomeDuplicate
+	}
+	if j.f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+	j.w = bufio.NewWriter(j.f)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		// Start on a fresh line after a torn one
+		j.w.WriteByte('\n')
+	}
+	return j, nil
+}
+
+// TaskID returns the deterministic task ID of the row key. Enqueuing the
+// same row twice fails with asynq.ErrTaskIDConflict while the first task
+// is pending, scheduled, retried or retained, even without a journal.
+func (j *Journal) TaskID(key string) string {
+	sum := sha256.Sum256([]byte(j.Job + "\x00" + key))
+	return "import-" + hex.EncodeToString(sum[:16])
+}
+
+// Done reports whether an earlier run enqueued the row key
+func (j *Journal) Done(key string) bool {
+	return j.done[key]
+}
+
+// Enqueue enqueues the task of row key under its deterministic ID unless
+// the journal has it, and records the outcome. It returns false for a row
+// that was not enqueued now, with the error of a failed one.
+func (j *Journal) Enqueue(client *asynq.Client, key string, t *asynq.Task, opts ...asynq.Option) (bool, error) {
+	if j.Done(key) {
+		j.Resumed++
+		return false, nil
+	}
+	id := j.TaskID(key)
+	_, err := client.Enqueue(t, append(opts[:len(opts):len(opts)], asynq.TaskID(id))...)
+	e := JournalEntry{Key: key, TaskID: id, Outcome: OutcomeEnqueued}
+	switch {
+	case errors.Is(err, asynq.ErrTaskIDConflict):
+		e.Outcome, err = OutcomeDuplicate, nil
+		j.Duplicates++
+	case err != nil:
+		e.Outcome, e.Error = OutcomeFailed, err.Error()
+	}
+	if jerr := j.record(e); jerr != nil {
+		return false, jerr
+	}
+	return e.Outcome == OutcomeEnqueued, err
+}
+
+// record appends e, syncing per the journal's policy
+func (j *Journal) record(e JournalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %v", err)
+	}
+	j.w.Write(line)
+	if err := j.w.WriteByte('\n'); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	j.done[e.Key] = e.Outcome != OutcomeFailed
+	j.pending++
+	if j.pending >= j.SyncEvery || time.Since(j.lastSync) >= j.SyncInterval {
+		return j.Sync()
+	}
+	return nil
+}
+
+// Sync writes the buffered entries to the file and fsyncs it
+func (j *Journal) Sync() error {
+	if err := j.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %v", err)
+	}
+	j.pending, j.lastSync = 0, time.Now()
+	return nil
+}
+
+// Close syncs and closes the journal
+func (j *Journal) Close() error {
+	err := j.Sync()
+	if cerr := j.f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to close journal: %v", cerr)
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// maxLineSize bounds a single JSONL record
+const maxLineSize = 1 << 20
+
+// JSONLinesImporter enqueues a task per line of a newline-delimited JSON file.
+// Each line is an object whose typeField holds the task type and whose
+// payloadField holds the payload.
+type JSONLinesImporter struct {
+	client       *asynq.Client
+	typeField    string
+	payloadField string
+
+	journal  *Journal
+	keyField string
+}
+
+// NewJSONLinesImporter creates an importer reading the given fields, "type"
+// and "payload" when empty
+func NewJSONLinesImporter(client *asynq.Client, typeField, payloadField string) *JSONLinesImporter {
+	if typeField == "" {
+		typeField = "type"
+	}
+	if payloadField == "" {
+		payloadField = "payload"
+	}
+	return &JSONLinesImporter{client: client, typeField: typeField, payloadField: payloadField}
+}
+
+// WithJournal records the lines in j and skips those it already has. Lines
+// are keyed by their keyField, or by line number when it is empty.
+func (ji *JSONLinesImporter) WithJournal(j *Journal, keyField string) *JSONLinesImporter {
+	ji.journal, ji.keyField = j, keyField
+	return ji
+}
+
+// ImportFromJSONLines streams r line by line into queueName. Blank lines are
+// ignored; malformed lines and failed enqueues are returned in errs without
+// stopping the import.
+func (ji *JSONLinesImporter) ImportFromJSONLines(r io.Reader, queueName string, opts ...asynq.Option) (imported int, errs []error) {
+	opts = append(opts, asynq.Queue(queueName))
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxLineSize)
+	line := 0
+	for sc.Scan() {
+		line++
+		data := bytes.TrimSpace(sc.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		t, key, err := ji.parse(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		if ji.journal != nil {
+			if key == "" {
+				key = "line:" + strconv.Itoa(line)
+			}
+			ok, err := ji.journal.Enqueue(ji.client, key, t, opts...)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: failed to enqueue %s task: %v", line, t.Type(), err))
+			} else if ok {
+				imported++
+			}
+			continue
+		}
+		if _, err := ji.client.Enqueue(t, opts...); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: failed to enqueue %s task: %v", line, t.Type(), err))
+			continue
+		}
+		imported++
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to read JSONL after line %d: %v", line, err))
+	}
+	return imported, errs
+}
+
+// parse returns the task of a line and its journal key, empty when the
+// importer has no key field
+func (ji *JSONLinesImporter) parse(data []byte) (*asynq.Task, string, error) {
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, "", fmt.Errorf("malformed JSON: %v", err)
+	}
+	var taskType string
+	if err := json.Unmarshal(record[ji.typeField], &taskType); err != nil || taskType == "" {
+		return nil, "", fmt.Errorf("missing or invalid %q field", ji.typeField)
+	}
+	payload, ok := record[ji.payloadField]
+	if !ok {
+		return nil, "", fmt.Errorf("missing %q field", ji.payloadField)
+	}
+	var key string
+	if ji.keyField != "" {
+		raw, ok := record[ji.keyField]
+		if !ok {
+			return nil, "", fmt.Errorf("missing key field %q", ji.keyField)
+		}
+		// String keys without their quotes, numbers as written
+		if json.Unmarshal(raw, &key) != nil {
+			key = string(raw)
+		}
+	}
+	t, err := metadata.NewTask(taskType, payload, nil)
+	return t, key, err
+}
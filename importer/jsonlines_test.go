@@ -0,0 +1,83 @@
+package importer_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/importer"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestImportFromJSONLines streams 50 valid lines and 5 invalid ones
+// between them, and fails unless the 50 are enqueued into the queue with
+// their type and payload, blank lines are ignored, and each invalid line
+// is reported by number without stopping the import
+func TestImportFromJSONLines(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	invalid := map[int]string{
+		3:  `{"kind": "email:send", "data": {"user_id": 3}`,
+		11: `not json`,
+		20: `{"data": {"user_id": 20}}`,
+		33: `{"kind": "email:send"}`,
+		47: `{"kind": 47, "data": {}}`,
+	}
+	var in strings.Builder
+	line := 0
+	for valid := 0; valid < 50; {
+		line++
+		if bad, ok := invalid[line]; ok {
+			in.WriteString(bad + "\n")
+			continue
+		}
+		if line%10 == 0 {
+			in.WriteString("\n")
+			continue
+		}
+		typ := "email:send"
+		if valid%2 == 1 {
+			typ = "report:generate"
+		}
+		fmt.Fprintf(&in, `{"kind": %q, "data": {"n": %d}}`+"\n", typ, valid)
+		valid++
+	}
+
+	ji := importer.NewJSONLinesImporter(client, "kind", "data")
+	imported, errs := ji.ImportFromJSONLines(strings.NewReader(in.String()), "import", asynq.MaxRetry(2))
+	if imported != 50 || len(errs) != 5 {
+		t.Fatalf("imported %d with errors %v, want 50 and 5", imported, errs)
+	}
+	for i, n := range []int{3, 11, 20, 33, 47} {
+		if !strings.HasPrefix(errs[i].Error(), fmt.Sprintf("line %d: ", n)) {
+			t.Errorf("error %q, want it for line %d", errs[i], n)
+		}
+	}
+
+	tasks, err := inspector.ListPendingTasks("import", asynq.PageSize(100))
+	if err != nil || len(tasks) != 50 {
+		t.Fatalf("%d tasks pending (%v), want 50", len(tasks), err)
+	}
+	types := map[string]int{}
+	for _, task := range tasks {
+		types[task.Type]++
+		payload, _ := metadata.Unwrap(task.Payload)
+		if !strings.HasPrefix(string(payload), `{"n":`) || task.MaxRetry != 2 {
+			t.Errorf("task %s with payload %s and max retry %d", task.Type, payload, task.MaxRetry)
+		}
+	}
+	if types["email:send"] != 25 || types["report:generate"] != 25 {
+		t.Errorf("imported types %v", types)
+	}
+}
@@ -0,0 +1,143 @@
+package importer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestImportResume builds cmd/admin and imports a large CSV against an
+// embedded Redis, killing the import midway. It fails unless resuming
+// from the journal completes the remaining rows without duplicates, and a
+// rerun whose journal was lost enqueues nothing thanks to the
+// deterministic task IDs. It skips when the go command is not available.
+func TestImportResume(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skipf("go command not available: %v", err)
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "admin")
+	if out, err := exec.Command("go", "build", "-o", bin, "asynqdemo/cmd/admin").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the admin CLI: %v\n%s", err, out)
+	}
+	const rows = 20000
+	var csv bytes.Buffer
+	csv.WriteString("user_id,email,subject,message\n")
+	for i := 1; i <= rows; i++ {
+		fmt.Fprintf(&csv, "%d,user%d@example.com,Hello,Row %d\n", i, i, i)
+	}
+	input := filepath.Join(dir, "users.csv")
+	if err := os.WriteFile(input, csv.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	pending := func() int {
+		q, err := inspector.GetQueueInfo("import")
+		if err != nil {
+			return 0
+		}
+		return q.Pending
+	}
+	importCmd := func(journal string, resume bool) *exec.Cmd {
+		args := []string{"import-csv", "--type", common.TypeEmailTask, "--queue", "import", "--journal", journal}
+		if resume {
+			args = append(args, "--resume")
+		}
+		cmd := exec.Command(bin, append(args, input)...)
+		cmd.Env = append(os.Environ(), "REDIS_URL=", "REDIS_MODE=", "REDIS_ADDR="+srv.Addr())
+		return cmd
+	}
+
+	// Kill the first run once a quarter of the rows are in
+	journal := filepath.Join(dir, "import.journal")
+	first := importCmd(journal, false)
+	if err := first.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- first.Wait() }()
+	deadline := time.Now().Add(30 * time.Second)
+	for pending() < rows/4 {
+		select {
+		case err := <-exited:
+			t.Fatalf("the import finished before it could be killed: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the import enqueued %d rows in 30s", pending())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	first.Process.Kill()
+	<-exited
+	killedAt := pending()
+	if killedAt >= rows {
+		t.Fatalf("the import completed before it was killed")
+	}
+
+	out, err := importCmd(journal, true).CombinedOutput()
+	if err != nil {
+		t.Fatalf("the resumed import failed: %v\n%s", err, out)
+	}
+	if want := fmt.Sprintf("Imported %d tasks", rows-killedAt); !strings.Contains(string(out), want) {
+		t.Errorf("the resumed import after %d rows reported %q, want %q", killedAt, out, want)
+	}
+	checkImported(t, inspector, rows)
+
+	// A lost journal degrades to dedupe by task ID
+	out, err = importCmd(filepath.Join(dir, "lost.journal"), false).CombinedOutput()
+	if err != nil {
+		t.Fatalf("the rerun failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Imported 0 tasks") || !strings.Contains(string(out), fmt.Sprintf("%d already enqueued", rows)) {
+		t.Errorf("the rerun without journal reported %q, want every row already enqueued", out)
+	}
+	checkImported(t, inspector, rows)
+	if _, err := importCmd(journal, false).CombinedOutput(); err == nil {
+		t.Errorf("an import reused an existing journal without --resume")
+	}
+}
+
+// checkImported fails unless the import queue holds one task per user
+// 1 to rows
+func checkImported(t *testing.T, inspector *asynq.Inspector, rows int) {
+	t.Helper()
+	tasks, err := inspector.ListPendingTasks("import", asynq.PageSize(rows+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool, len(tasks))
+	for _, task := range tasks {
+		payload, _ := metadata.Unwrap(task.Payload)
+		var p common.EmailPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			t.Fatal(err)
+		}
+		if seen[p.UserID] {
+			t.Errorf("user %d was imported twice", p.UserID)
+		}
+		seen[p.UserID] = true
+	}
+	if len(seen) != rows {
+		t.Errorf("got %d of %d rows imported", len(seen), rows)
+	}
+}
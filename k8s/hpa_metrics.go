@@ -0,0 +1,152 @@
+// Package k8s exposes queue depth through the Kubernetes custom metrics API so
+// a HorizontalPodAutoscaler can scale workers with the backlog.
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/queues"
+)
+
+// MetricQueueDepth is the metric served to the autoscaler
+const MetricQueueDepth = "asynq_queue_depth"
+
+const apiPrefix = "/apis/custom.metrics.k8s.io/v1beta1"
+
+// ObjectReference identifies the object a metric describes
+type ObjectReference struct {
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	APIVersion string `json:"apiVersion"`
+}
+
+// MetricValue is one sample of the custom metrics API
+type MetricValue struct {
+	DescribedObject ObjectReference `json:"describedObject"`
+	MetricName      string          `json:"metricName"`
+	Timestamp       time.Time       `json:"timestamp"`
+	Value           string          `json:"value"`
+}
+
+// MetricValueList is the custom metrics API response
+type MetricValueList struct {
+	Kind       string            `json:"kind"`
+	APIVersion string            `json:"apiVersion"`
+	Metadata   map[string]string `json:"metadata"`
+	Items      []MetricValue     `json:"items"`
+}
+
+// HPAMetricsServer implements the part of custom.metrics.k8s.io/v1beta1 an
+// HPA with a Pods metric queries:
+//
+//	GET /apis/custom.metrics.k8s.io/v1beta1/namespaces/{ns}/pods/*/asynq_queue_depth
+//
+// The value is the number of pending tasks over all watched queues.
+type HPAMetricsServer struct {
+	stats  *queues.StatsCache
+	queues []string
+	addr   string
+	srv    *http.Server
+}
+
+// NewHPAMetricsServer creates a server reporting the depth of watched queues
+// on addr, read from the shared stats cache
+func NewHPAMetricsServer(stats *queues.StatsCache, watched []string, addr string) *HPAMetricsServer {
+	s := &HPAMetricsServer{stats: stats, queues: watched, addr: addr}
+	s.srv = &http.Server{Addr: addr, Handler: s, ReadHeaderTimeout: 5 * time.Second}
+	return s
+}
+
+// Run serves requests until ctx is done, then waits up to five seconds for
+// in-flight requests
+func (s *HPAMetricsServer) Run(ctx context.Context) error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.srv.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		return fmt.Errorf("HPA metrics server error: %v", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down HPA metrics server: %v", err)
+	}
+	return nil
+}
+
+// ServeHTTP answers discovery and metric queries
+func (s *HPAMetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if strings.TrimRight(r.URL.Path, "/") == apiPrefix {
+		admin.WriteJSON(w, http.StatusOK, discovery())
+		return
+	}
+	// namespaces/{ns}/pods/{name}/{metric}
+	seg := admin.PathSegments(r, apiPrefix+"/")
+	if len(seg) != 5 || seg[0] != "namespaces" || seg[2] != "pods" {
+		admin.WriteError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if seg[4] != MetricQueueDepth {
+		admin.WriteError(w, http.StatusNotFound, fmt.Sprintf("unknown metric %q", seg[4]))
+		return
+	}
+	depth, err := s.depth()
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	admin.WriteJSON(w, http.StatusOK, MetricValueList{
+		Kind:       "MetricValueList",
+		APIVersion: "custom.metrics.k8s.io/v1beta1",
+		Metadata:   map[string]string{"selfLink": r.URL.Path},
+		Items: []MetricValue{{
+			DescribedObject: ObjectReference{Kind: "Pod", Namespace: seg[1], Name: seg[3], APIVersion: "/v1"},
+			MetricName:      MetricQueueDepth,
+			Timestamp:       time.Now().UTC().Truncate(time.Second),
+			Value:           strconv.Itoa(depth),
+		}},
+	})
+}
+
+// depth sums the pending tasks of the watched queues. Queues that do not
+// exist yet count as empty.
+func (s *HPAMetricsServer) depth() (int, error) {
+	snap, err := s.stats.Get(false)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, q := range s.queues {
+		if info := snap.Queue(q); info != nil {
+			total += info.Pending
+		}
+	}
+	return total, nil
+}
+
+// discovery lists the metric as a resource, which the API aggregator expects
+func discovery() map[string]interface{} {
+	return map[string]interface{}{
+		"kind":         "APIResourceList",
+		"apiVersion":   "v1",
+		"groupVersion": "custom.metrics.k8s.io/v1beta1",
+		"resources": []map[string]interface{}{{
+			"name":       "pods/" + MetricQueueDepth,
+			"namespaced": true,
+			"kind":       "MetricValueList",
+			"verbs":      []string{"get"},
+		}},
+	}
+}
@@ -0,0 +1,128 @@
+package k8s_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/k8s"
+	"asynqdemo/queues"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestHPAMetrics queries the server the way the API aggregator does for an
+// HPA Pods metric and fails unless the answer is a MetricValueList of the
+// custom metrics API whose asynq_queue_depth value is the pending tasks of
+// the watched queues only, discovery lists the metric, and other metrics,
+// paths and methods are refused.
+func TestHPAMetrics(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	for queue, n := range map[string]int{"default": 3, "critical": 2, "low": 4} {
+		for i := 0; i < n; i++ {
+			if _, err := client.Enqueue(asynq.NewTask("hpa:test", nil), asynq.Queue(queue)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Scheduled tasks are not pending
+	if _, err := client.Enqueue(asynq.NewTask("hpa:test", nil), asynq.ProcessIn(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	stats := queues.NewStatsCache(inspector, time.Second)
+	ts := httptest.NewServer(k8s.NewHPAMetricsServer(stats, []string{"default", "critical", "missing"}, ""))
+	defer ts.Close()
+
+	get := func(path string, into interface{}) int {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if into != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	path := "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/pods/*/asynq_queue_depth"
+	var list struct {
+		Kind       string            `json:"kind"`
+		APIVersion string            `json:"apiVersion"`
+		Metadata   map[string]string `json:"metadata"`
+		Items      []struct {
+			DescribedObject map[string]string `json:"describedObject"`
+			MetricName      string            `json:"metricName"`
+			Timestamp       string            `json:"timestamp"`
+			Value           string            `json:"value"`
+		} `json:"items"`
+	}
+	if code := get(path, &list); code != http.StatusOK {
+		t.Fatalf("metric query gave %d", code)
+	}
+	if list.Kind != "MetricValueList" || list.APIVersion != "custom.metrics.k8s.io/v1beta1" || list.Metadata["selfLink"] != path || len(list.Items) != 1 {
+		t.Fatalf("got %+v, want a MetricValueList of one item", list)
+	}
+	item := list.Items[0]
+	if item.MetricName != "asynq_queue_depth" || item.Value != "5" {
+		t.Errorf("metric %s = %s, want asynq_queue_depth = 5", item.MetricName, item.Value)
+	}
+	want := map[string]string{"kind": "Pod", "namespace": "default", "name": "*", "apiVersion": "/v1"}
+	for k, v := range want {
+		if item.DescribedObject[k] != v {
+			t.Errorf("describedObject %v, want %v", item.DescribedObject, want)
+			break
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, item.Timestamp); err != nil {
+		t.Errorf("timestamp %q is not RFC 3339: %v", item.Timestamp, err)
+	}
+
+	var discovery struct {
+		Kind         string `json:"kind"`
+		GroupVersion string `json:"groupVersion"`
+		Resources    []struct {
+			Name       string `json:"name"`
+			Namespaced bool   `json:"namespaced"`
+		} `json:"resources"`
+	}
+	if code := get("/apis/custom.metrics.k8s.io/v1beta1", &discovery); code != http.StatusOK {
+		t.Fatalf("discovery gave %d", code)
+	}
+	if discovery.Kind != "APIResourceList" || discovery.GroupVersion != "custom.metrics.k8s.io/v1beta1" ||
+		len(discovery.Resources) != 1 || discovery.Resources[0].Name != "pods/asynq_queue_depth" || !discovery.Resources[0].Namespaced {
+		t.Errorf("discovery %+v", discovery)
+	}
+
+	for _, p := range []string{
+		strings.Replace(path, "asynq_queue_depth", "cpu_usage", 1),
+		"/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/services/*/asynq_queue_depth",
+	} {
+		if code := get(p, nil); code != http.StatusNotFound {
+			t.Errorf("GET %s gave %d, want 404", p, code)
+		}
+	}
+	resp, err := http.Post(ts.URL+path, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST gave %d", resp.StatusCode)
+	}
+}
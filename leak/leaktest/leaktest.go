@@ -0,0 +1,135 @@
+// Package leaktest fails tests that leave goroutines, Redis connections or
+// temporary files behind.
+package leaktest
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/leak"
+)
+
+// grace is how long cleanup waits for goroutines and connections that are
+// on their way out
+const grace = 2 * time.Second
+
+// Allowed holds prefixes of the creators of goroutines that outlive a test
+// by design
+var Allowed = []string{
+	// Keep-alive connections of HTTP clients
+	"net/http.(*Transport).dialConn",
+}
+
+// Check fails t at cleanup when goroutines started during the test are still
+// running after a grace period, listing their stacks. Goroutines of Allowed
+// and of the creators given in allowed are ignored. Call it first so the
+// cleanups of the test run before it.
+func Check(t testing.TB, allowed ...string) {
+	t.Helper()
+	before := leak.CountByCreator()
+	allowed = append(allowed, Allowed...)
+	t.Cleanup(func() {
+		var leaked map[string]int
+		if poll(func() bool {
+			leaked = grown(before, leak.CountByCreator(), allowed)
+			return len(leaked) == 0
+		}) {
+			return
+		}
+		var creators, stacks []string
+		for creator, n := range leaked {
+			creators = append(creators, creator+" +"+strconv.Itoa(n))
+		}
+		for _, g := range leak.Stacks() {
+			if leaked[leak.Creator(g)] > 0 {
+				stacks = append(stacks, g)
+			}
+		}
+		sort.Strings(creators)
+		t.Errorf("leaked goroutines: %s\n\n%s", strings.Join(creators, ", "), strings.Join(stacks, "\n\n"))
+	})
+}
+
+// grown returns the creators with more goroutines after than before, except
+// the allowed ones
+func grown(before, after map[string]int, allowed []string) map[string]int {
+	out := make(map[string]int)
+	for creator, n := range after {
+		if d := n - before[creator]; d > 0 && !isAllowed(creator, allowed) {
+			out[creator] = d
+		}
+	}
+	return out
+}
+
+func isAllowed(creator string, allowed []string) bool {
+	for _, prefix := range allowed {
+		if strings.HasPrefix(creator, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redis starts an embedded Redis for the test. At cleanup it fails t when
+// clients, inspectors or MakeRedisClient connections of the test still hold
+// connections to it, then stops it.
+func Redis(t testing.TB) *embeddedredis.Server {
+	t.Helper()
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		defer srv.Close()
+		if !poll(func() bool { return srv.Connections() == 0 }) {
+			t.Errorf("%d Redis connections left open", srv.Connections())
+		}
+	})
+	return srv
+}
+
+// TempDir returns a directory for temporary files the code under test must
+// remove itself. At cleanup it fails t listing the files left in it.
+func TempDir(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		var left []string
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != dir {
+				rel, _ := filepath.Rel(dir, path)
+				left = append(left, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("failed to list temp dir: %v", err)
+		}
+		if len(left) > 0 {
+			t.Errorf("temporary files left behind: %s", strings.Join(left, ", "))
+		}
+	})
+	return dir
+}
+
+// poll reports whether cond became true within the grace period
+func poll(cond func() bool) bool {
+	deadline := time.Now().Add(grace)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package leaktest_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"asynqdemo/leak/leaktest"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// recorder runs the cleanups of a harness check on demand and keeps the
+// errors it reports instead of failing the test
+type recorder struct {
+	testing.TB
+	cleanups []func()
+	errors   []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Cleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// finish runs the cleanups last first and returns the reported errors
+func (r *recorder) finish() string {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+	return strings.Join(r.errors, "\n")
+}
+
+func leaky(release chan struct{}) {
+	go func() { <-release }()
+}
+
+// TestCheck fails unless a goroutine left running is reported with its
+// stack, and allowed creators and finished goroutines are not
+func TestCheck(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	r := &recorder{TB: t}
+	leaktest.Check(r)
+	leaky(release)
+	if got := r.finish(); !strings.Contains(got, "leaktest_test.leaky +1") || !strings.Contains(got, "leaktest_test.leaky.func1") {
+		t.Errorf("leak reported as %q", got)
+	}
+
+	r = &recorder{TB: t}
+	leaktest.Check(r, "asynqdemo/leak/leaktest_test.leaky")
+	leaky(release)
+	if got := r.finish(); got != "" {
+		t.Errorf("allowed goroutine reported: %s", got)
+	}
+
+	r = &recorder{TB: t}
+	leaktest.Check(r)
+	done := make(chan struct{})
+	go close(done)
+	<-done
+	if got := r.finish(); got != "" {
+		t.Errorf("finished goroutine reported: %s", got)
+	}
+}
+
+// TestRedis fails unless a Redis client left open is reported and a
+// closed one is not
+func TestRedis(t *testing.T) {
+	r := &recorder{TB: t}
+	srv := leaktest.Redis(r)
+	open := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	if err := open.Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	got := r.finish()
+	open.Close()
+	if !strings.Contains(got, "1 Redis connections left open") {
+		t.Errorf("open client reported as %q", got)
+	}
+
+	r = &recorder{TB: t}
+	srv = leaktest.Redis(r)
+	closed := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	if err := closed.Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if got := r.finish(); got != "" {
+		t.Errorf("closed client reported: %s", got)
+	}
+}
+
+// TestTempDir fails unless files left in the directory are reported and
+// an emptied directory is not
+func TestTempDir(t *testing.T) {
+	r := &recorder{TB: t}
+	dir := leaktest.TempDir(r)
+	if err := os.MkdirAll(filepath.Join(dir, "task-1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "task-1", "upload.csv"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.finish(); !strings.Contains(got, "task-1, "+filepath.Join("task-1", "upload.csv")) {
+		t.Errorf("left files reported as %q", got)
+	}
+
+	r = &recorder{TB: t}
+	dir = leaktest.TempDir(r)
+	if err := os.WriteFile(filepath.Join(dir, "upload.csv"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "upload.csv")); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.finish(); got != "" {
+		t.Errorf("removed file reported: %s", got)
+	}
+}
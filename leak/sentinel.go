@@ -0,0 +1,113 @@
+// Package leak watches the worker for goroutines that are started and never exit.
+package leak
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sentinel samples the goroutine count and logs when it grew at every sample
+// over a whole window, which a steady-state worker should never do
+type Sentinel struct {
+	interval time.Duration
+	samples  int
+	logf     func(format string, args ...interface{})
+}
+
+// NewSentinel samples every interval and reports growth sustained over window
+func NewSentinel(interval, window time.Duration) *Sentinel {
+	n := int(window / interval)
+	if n < 2 {
+		n = 2
+	}
+	return &Sentinel{interval: interval, samples: n, logf: log.Printf}
+}
+
+// Run samples until ctx is done
+func (s *Sentinel) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	counts := []int{runtime.NumGoroutine()}
+	creators := CountByCreator()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n := runtime.NumGoroutine()
+		if n <= counts[len(counts)-1] {
+			// Growth stopped, start a new window from here
+			counts = counts[:0]
+			creators = CountByCreator()
+		}
+		counts = append(counts, n)
+		if len(counts) <= s.samples {
+			continue
+		}
+		now := CountByCreator()
+		s.logf("⚠️  Goroutines grew on every sample for %v: %d -> %d; growth by creator: %s",
+			time.Duration(s.samples)*s.interval, counts[0], n, Growth(creators, now))
+		counts = []int{n}
+		creators = now
+	}
+}
+
+// CountByCreator counts live goroutines by the function that started them
+func CountByCreator() map[string]int {
+	counts := make(map[string]int)
+	for _, g := range Stacks() {
+		counts[Creator(g)]++
+	}
+	return counts
+}
+
+// Stacks returns the stack of every live goroutine
+func Stacks() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	return strings.Split(string(buf), "\n\n")
+}
+
+// Creator returns the function that started the goroutine of a stack, or
+// main for the main goroutine
+func Creator(stack string) string {
+	for _, line := range strings.Split(stack, "\n") {
+		if strings.HasPrefix(line, "created by ") {
+			creator := strings.TrimPrefix(line, "created by ")
+			if i := strings.Index(creator, " in goroutine"); i >= 0 {
+				creator = creator[:i]
+			}
+			return creator
+		}
+	}
+	return "main"
+}
+
+// Growth formats the creators whose goroutine count increased from before to after
+func Growth(before, after map[string]int) string {
+	var parts []string
+	for creator, n := range after {
+		if d := n - before[creator]; d > 0 {
+			parts = append(parts, fmt.Sprintf("%s +%d", creator, d))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
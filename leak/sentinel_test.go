@@ -0,0 +1,94 @@
+package leak_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/leak"
+)
+
+// syncBuffer is a bytes.Buffer safe for the logger and the test to share
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// park starts n goroutines blocked until release is closed
+func park(n int, release chan struct{}) {
+	for i := 0; i < n; i++ {
+		go func() { <-release }()
+	}
+}
+
+// TestCountByCreator fails unless goroutines are counted by the function
+// that started them
+func TestCountByCreator(t *testing.T) {
+	before := leak.CountByCreator()
+	release := make(chan struct{})
+	defer close(release)
+	park(3, release)
+	if got := leak.Growth(before, leak.CountByCreator()); !strings.Contains(got, "leak_test.park +3") {
+		t.Errorf("growth %q, want park +3", got)
+	}
+	if got := leak.Growth(before, before); got != "none" {
+		t.Errorf("growth without change %q", got)
+	}
+}
+
+// TestSentinel starts a goroutine per tick that never exits and fails
+// unless the sentinel logs the growth with its creator, and stays quiet
+// once the count is steady
+func TestSentinel(t *testing.T) {
+	var out syncBuffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&out)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leak.NewSentinel(10*time.Millisecond, 50*time.Millisecond).Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	release := make(chan struct{})
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "Goroutines grew") {
+		if time.Now().After(deadline) {
+			t.Fatal("sustained growth not reported")
+		}
+		park(1, release)
+		time.Sleep(3 * time.Millisecond)
+	}
+	if !strings.Contains(out.String(), "leak_test.park +") {
+		t.Errorf("report does not name the creator: %s", out.String())
+	}
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	reported := out.String()
+	time.Sleep(200 * time.Millisecond)
+	if got := out.String(); got != reported {
+		t.Errorf("steady goroutine count reported: %s", strings.TrimPrefix(got, reported))
+	}
+}
@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+
+	"asynqdemo/circuit"
+	"asynqdemo/common"
+)
+
+// breakerMailer sends through inner unless the provider's circuit is open
+type breakerMailer struct {
+	inner   common.Mailer
+	breaker *circuit.Breaker
+}
+
+// WithBreaker returns inner guarded by breaker. A recipient the server
+// refused does not count against the server.
+func WithBreaker(inner common.Mailer, breaker *circuit.Breaker) common.Mailer {
+	return &breakerMailer{inner: inner, breaker: breaker}
+}
+
+// Send delivers msg, implementing common.Mailer
+func (m *breakerMailer) Send(ctx context.Context, msg common.EmailMessage) error {
+	var refused error
+	err := m.breaker.Do(ctx, func(ctx context.Context) error {
+		err := m.inner.Send(ctx, msg)
+		var r refusedError
+		if errors.As(err, &r) {
+			refused = err
+			return nil
+		}
+		return err
+	})
+	if refused != nil {
+		return refused
+	}
+	return err
+}
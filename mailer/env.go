@@ -0,0 +1,77 @@
+package mailer
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// DefaultPort is the submission port used when SMTP_HOST is set without
+// SMTP_PORT
+const DefaultPort = 587
+
+// AddrFromEnv returns the SMTP server address: SMTP_ADDR (host:port), else
+// SMTP_HOST with SMTP_PORT, else "" when email is not configured and
+// messages are only printed
+func AddrFromEnv() (string, error) {
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return addr, nil
+	}
+	host, port := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT")
+	if host == "" {
+		if port != "" {
+			return "", fmt.Errorf("SMTP_PORT %s is set without SMTP_HOST", port)
+		}
+		return "", nil
+	}
+	if port == "" {
+		port = strconv.Itoa(DefaultPort)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid SMTP_PORT %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Email providers of EMAIL_PROVIDER
+const (
+	ProviderSMTP     = "smtp"
+	ProviderSendGrid = "sendgrid"
+)
+
+// ProviderFromEnv returns the email provider named by EMAIL_PROVIDER, by
+// default smtp when smtpAddr is set, else "" when messages are only
+// printed. SendGrid needs SENDGRID_API_KEY.
+func ProviderFromEnv(smtpAddr string) (string, error) {
+	provider := os.Getenv("EMAIL_PROVIDER")
+	switch provider {
+	case "":
+		if smtpAddr != "" {
+			return ProviderSMTP, nil
+		}
+		return "", nil
+	case ProviderSMTP:
+		if smtpAddr == "" {
+			return "", fmt.Errorf("EMAIL_PROVIDER smtp needs SMTP_ADDR or SMTP_HOST")
+		}
+	case ProviderSendGrid:
+		if os.Getenv("SENDGRID_API_KEY") == "" {
+			return "", fmt.Errorf("EMAIL_PROVIDER sendgrid needs SENDGRID_API_KEY")
+		}
+	default:
+		return "", fmt.Errorf("unknown EMAIL_PROVIDER %q, want %s or %s", provider, ProviderSMTP, ProviderSendGrid)
+	}
+	return provider, nil
+}
+
+// FromAddress returns the sender address of every provider: EMAIL_FROM,
+// else SMTP_FROM, else noreply@example.com
+func FromAddress() string {
+	for _, name := range []string{"EMAIL_FROM", "SMTP_FROM"} {
+		if from := os.Getenv(name); from != "" {
+			return from
+		}
+	}
+	return "noreply@example.com"
+}
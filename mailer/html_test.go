@@ -0,0 +1,162 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"asynqdemo/common"
+	"asynqdemo/emailhtml"
+	"asynqdemo/mailer"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// htmlEmails are the payloads whose HTML bodies are kept as golden files,
+// <name>.html, in testdata/emailhtml
+var htmlEmails = map[string]common.EmailPayload{
+	"welcome": {
+		UserID: 7, Email: "alice@example.com", Subject: "Welcome aboard", Message: "Thanks for signing up.",
+		Locale: "en", Category: common.CategoryWelcome, TemplateName: "welcome",
+		TemplateData: map[string]interface{}{"name": "Alice <admin>", "login_url": "https://example.com/login?next=/home&ref=email"},
+	},
+	"newsletter": {
+		UserID: 7, Email: "alice@example.com", Subject: "October news", Message: "Here is what happened this month.",
+		Locale: "de", Category: common.CategoryMarketing, TemplateName: "newsletter",
+		TemplateData: map[string]interface{}{
+			"title": "News & updates",
+			"articles": []interface{}{
+				map[string]interface{}{"title": "Faster queues", "url": "https://example.com/blog/queues", "summary": "Workers now pick up tasks sooner."},
+				map[string]interface{}{"title": "Bad link", "url": "javascript:alert(1)", "summary": "<b>Not bold</b>"},
+			},
+		},
+	},
+}
+
+// TestHTMLEmail fails unless the welcome and newsletter payloads render
+// to their golden files in testdata/emailhtml, escaping their data, an unknown template
+// fails HandleEmailTask with asynq.SkipRetry before anything is sent, a
+// template that does not parse fails the registry, and SMTP sends the HTML
+// as the alternative of the text. With UPDATE_GOLDEN=1 it rewrites the
+// golden files instead.
+func TestHTMLEmail(t *testing.T) {
+	dir := filepath.Join("..", "testdata", "emailhtml")
+	html, err := emailhtml.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsubscribe := func(email, category string) string {
+		return "https://example.com/unsubscribe?email=" + email + "&category=" + category
+	}
+	for name, p := range htmlEmails {
+		p := p
+		got, err := common.BuildHTML(html, &p, unsubscribe)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		path := filepath.Join(dir, name+".html")
+		if os.Getenv("UPDATE_GOLDEN") == "1" {
+			if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		golden, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read golden email: %v", err)
+		}
+		if got != string(golden) {
+			t.Errorf("%s email differs from %s; rerun with UPDATE_GOLDEN=1 if the change is intended:\n%s", name, path, got)
+		}
+	}
+
+	// An unknown template is not retried and sends nothing
+	mock := &recordingMailer{}
+	deps := common.DefaultDeps()
+	deps.Mailer = mock
+	ctx := common.WithDeps(context.Background(), deps)
+	unknown := htmlEmails["welcome"]
+	unknown.TemplateName = "welcom"
+	err = common.HandleEmailTask(ctx, &unknown)
+	var notFound emailhtml.ErrUnknownTemplate
+	if !errors.Is(err, asynq.SkipRetry) || !errors.As(err, &notFound) || notFound.Name != "welcom" || len(mock.sent) != 0 {
+		t.Errorf("unknown template gave %v and sent %d emails", err, len(mock.sent))
+	}
+
+	// Templates are parsed up front, sharing the partials
+	broken := fstest.MapFS{
+		"t/_layout.html": {Data: []byte(`{{define "layout"}}<p>{{template "content" .}}</p>{{end}}`)},
+		"t/ok.html":      {Data: []byte(`{{template "layout" .}}{{define "content"}}{{.Subject}}{{end}}`)},
+		"t/bad.html":     {Data: []byte(`{{template "layout" .}}{{define "content"}}{{if .Subject}}{{end}}`)},
+	}
+	if _, err := emailhtml.Load(broken, "t"); err == nil || !strings.Contains(err.Error(), "t/bad.html") {
+		t.Errorf("template with a syntax error gave %v", err)
+	}
+	delete(broken, "t/bad.html")
+	partials, err := emailhtml.Load(broken, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := partials.Render("ok", emailhtml.View{Subject: "a < b"}); err != nil || out != "<p>a &lt; b</p>" {
+		t.Errorf("partials rendered %q (%v)", out, err)
+	}
+	if names := partials.Names(); len(names) != 1 || names[0] != "ok" {
+		t.Errorf("partials listed as templates: %v", names)
+	}
+
+	// SMTP sends the text and the HTML as alternatives
+	server := startFakeSMTP(t, nil, nil)
+	defer server.close()
+	pool, err := mailer.NewPool(mailer.PoolConfig{Addr: server.addr()}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Drain(context.Background())
+	deps.Mailer = mailer.NewSMTPSender(pool, "noreply@example.com")
+	welcome := htmlEmails["welcome"]
+	if err := common.HandleEmailTask(common.WithDeps(context.Background(), deps), &welcome); err != nil {
+		t.Fatal(err)
+	}
+	want, err := common.BuildHTML(html, &welcome, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := server.accepted()
+	if len(msgs) != 1 {
+		t.Fatalf("server accepted %d messages", len(msgs))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(msgs[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("message is %s (%v)", msg.Header.Get("Content-Type"), err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		bodies = append(bodies, part.Header.Get("Content-Type")+"\n"+string(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))))
+	}
+	if len(bodies) != 2 || bodies[0] != "text/plain; charset=utf-8\n"+welcome.Message || bodies[1] != "text/html; charset=utf-8\n"+want {
+		t.Errorf("message parts are %q", bodies)
+	}
+}
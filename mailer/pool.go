@@ -0,0 +1,289 @@
+// Package mailer delivers email over SMTP through a pool of reused
+// connections, since the provider limits connections rather than messages.
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrPoolClosed is returned once the pool is draining
+var ErrPoolClosed = errors.New("smtp pool closed")
+
+// PoolConfig configures an SMTP connection pool
+type PoolConfig struct {
+	// Addr is the host:port of the SMTP server
+	Addr     string
+	Username string
+	Password string
+	// MaxConns bounds the open connections, 2 when zero
+	MaxConns int
+	// MaxMessagesPerConn retires a connection after this many messages, 100 when zero
+	MaxMessagesPerConn int
+	// IdleTimeout closes connections unused for this long, 30s when zero
+	IdleTimeout time.Duration
+	// SendTimeout bounds each exchange with the server, dialing, a health
+	// check, a message or QUIT, so a stalled server cannot hold a
+	// connection forever, 30s when zero
+	SendTimeout time.Duration
+}
+
+type conn struct {
+	client   *smtp.Client
+	nc       net.Conn
+	sent     int
+	lastUsed time.Time
+}
+
+// deadline limits the next exchange on c to timeout, or to the deadline of
+// ctx when that is sooner
+func (c *conn) deadline(ctx context.Context, timeout time.Duration) {
+	d := time.Now().Add(timeout)
+	if cd, ok := ctx.Deadline(); ok && cd.Before(d) {
+		d = cd
+	}
+	c.nc.SetDeadline(d)
+}
+
+// Pool hands out SMTP connections. Idle connections are checked with NOOP
+// before reuse, and senders wait while all connections are busy.
+type Pool struct {
+	cfg  PoolConfig
+	host string
+	dial func(ctx context.Context) (*conn, error)
+
+	// slots holds a token per open connection
+	slots chan struct{}
+	idle  chan *conn
+
+	mu     sync.Mutex
+	closed bool
+
+	dials   prometheus.Counter
+	reuses  prometheus.Counter
+	retired *prometheus.CounterVec
+	open    prometheus.GaugeFunc
+	waits   prometheus.Histogram
+}
+
+// NewPool creates a pool and registers its metrics with reg
+func NewPool(cfg PoolConfig, reg prometheus.Registerer) (*Pool, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %v", cfg.Addr, err)
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = 2
+	}
+	if cfg.MaxMessagesPerConn <= 0 {
+		cfg.MaxMessagesPerConn = 100
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 30 * time.Second
+	}
+	if cfg.SendTimeout <= 0 {
+		cfg.SendTimeout = 30 * time.Second
+	}
+	p := &Pool{
+		cfg:   cfg,
+		host:  host,
+		slots: make(chan struct{}, cfg.MaxConns),
+		idle:  make(chan *conn, cfg.MaxConns),
+		dials: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smtp_pool_dials_total",
+			Help: "SMTP connections opened.",
+		}),
+		reuses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "smtp_pool_reuses_total",
+			Help: "Messages sent over an already open SMTP connection.",
+		}),
+		retired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smtp_pool_retired_total",
+			Help: "SMTP connections closed, by reason.",
+		}, []string{"reason"}),
+		waits: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "smtp_pool_wait_seconds",
+			Help:    "Time spent waiting for an SMTP connection.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+	}
+	p.open = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "smtp_pool_open_connections",
+		Help: "SMTP connections currently open.",
+	}, func() float64 { return float64(len(p.slots)) })
+	p.dial = p.dialSMTP
+	for _, c := range []prometheus.Collector{p.dials, p.reuses, p.retired, p.open, p.waits} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register SMTP pool metrics: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// get returns a healthy connection, waiting until one is free or ctx, which
+// carries the task deadline, is done
+func (p *Pool) get(ctx context.Context) (*conn, error) {
+	start := time.Now()
+	defer func() { p.waits.Observe(time.Since(start).Seconds()) }()
+	for {
+		p.mu.Lock()
+		closed := p.closed
+		p.mu.Unlock()
+		if closed {
+			return nil, ErrPoolClosed
+		}
+
+		// Prefer an idle connection over opening another one
+		select {
+		case c := <-p.idle:
+			if p.healthy(ctx, c) {
+				p.reuses.Inc()
+				return c, nil
+			}
+			continue
+		default:
+		}
+
+		select {
+		case c := <-p.idle:
+			if p.healthy(ctx, c) {
+				p.reuses.Inc()
+				return c, nil
+			}
+		case p.slots <- struct{}{}:
+			c, err := p.dial(ctx)
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			p.dials.Inc()
+			return c, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for an SMTP connection: %w", ctx.Err())
+		}
+	}
+}
+
+// put returns a connection after use. Connections that failed or reached
+// their message cap are closed instead of pooled.
+func (p *Pool) put(c *conn, err error) {
+	c.lastUsed = time.Now()
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	switch {
+	case err != nil:
+		p.retire(c, "error")
+	case c.sent >= p.cfg.MaxMessagesPerConn:
+		p.retire(c, "message_cap")
+	case closed:
+		p.retire(c, "drain")
+	default:
+		p.idle <- c
+	}
+}
+
+// healthy retires expired and dead connections
+func (p *Pool) healthy(ctx context.Context, c *conn) bool {
+	if time.Since(c.lastUsed) > p.cfg.IdleTimeout {
+		p.retire(c, "idle")
+		return false
+	}
+	c.deadline(ctx, p.cfg.SendTimeout)
+	if err := c.client.Noop(); err != nil {
+		p.retire(c, "noop")
+		return false
+	}
+	return true
+}
+
+func (p *Pool) retire(c *conn, reason string) {
+	c.deadline(context.Background(), p.cfg.SendTimeout)
+	if err := c.client.Quit(); err != nil {
+		c.client.Close()
+	}
+	<-p.slots
+	p.retired.WithLabelValues(reason).Inc()
+}
+
+// Drain stops handing out connections and closes them as they come back,
+// waiting for busy ones until ctx is done
+func (p *Pool) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	for len(p.slots) > 0 {
+		select {
+		case c := <-p.idle:
+			p.retire(c, "drain")
+		case <-time.After(50 * time.Millisecond):
+			// Busy connections are retired when they come back
+		case <-ctx.Done():
+			return fmt.Errorf("%d SMTP connections still busy: %v", len(p.slots), ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (p *Pool) dialSMTP(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: p.cfg.SendTimeout}
+	nc, err := d.DialContext(ctx, "tcp", p.cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SMTP server %s: %v", p.cfg.Addr, err)
+	}
+	c := &conn{nc: nc}
+	// The greeting, TLS handshake and authentication share one deadline
+	c.deadline(ctx, p.cfg.SendTimeout)
+	client, err := smtp.NewClient(nc, p.host)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to greet SMTP server %s: %v", p.cfg.Addr, err)
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: p.host}); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to start TLS with %s: %v", p.cfg.Addr, err)
+		}
+	}
+	if p.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", p.cfg.Username, p.cfg.Password, p.host)); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to authenticate with %s: %v", p.cfg.Addr, err)
+		}
+	}
+	log.Printf("📮 Opened SMTP connection to %s", p.cfg.Addr)
+	c.client = client
+	return c, nil
+}
+
+// CheckConnectivity connects to addr and greets the server without sending
+func CheckConnectivity(ctx context.Context, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP address %q: %v", addr, err)
+	}
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server %s: %v", addr, err)
+	}
+	client, err := smtp.NewClient(nc, host)
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("failed to greet SMTP server %s: %v", addr, err)
+	}
+	defer client.Close()
+	if err := client.Hello("localhost"); err != nil {
+		return fmt.Errorf("SMTP server %s refused EHLO: %v", addr, err)
+	}
+	return client.Quit()
+}
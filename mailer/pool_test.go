@@ -0,0 +1,183 @@
+package mailer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/mailer"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolMetric returns the value of the pool metric name in reg, the one with
+// the given reason label for smtp_pool_retired_total
+func poolMetric(t *testing.T, reg *prometheus.Registry, name, reason string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if reason != "" && (len(m.GetLabel()) != 1 || m.GetLabel()[0].GetValue() != reason) {
+				continue
+			}
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+// TestPool sends messages through a pool and fails unless connections are
+// reused up to the per-connection message cap, a sender waits for a busy
+// connection until its deadline, idle connections past the idle timeout
+// are replaced, and a drained pool closes its connections and refuses to
+// send.
+func TestPool(t *testing.T) {
+	server := startFakeSMTP(t, nil, nil)
+	defer server.close()
+	reg := prometheus.NewRegistry()
+	pool, err := mailer.NewPool(mailer.PoolConfig{Addr: server.addr(), MaxConns: 1, MaxMessagesPerConn: 3, IdleTimeout: 200 * time.Millisecond}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := mailer.NewSMTPSender(pool, "noreply@example.com")
+	send := func(ctx context.Context) error {
+		return sender.Send(ctx, common.EmailMessage{To: "user@example.com", Subject: "Hi", Body: "Hello"})
+	}
+
+	for i := 0; i < 7; i++ {
+		if err := send(context.Background()); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	server.mu.Lock()
+	conns := len(server.conns)
+	server.mu.Unlock()
+	if conns != 3 || len(server.accepted()) != 7 {
+		t.Errorf("7 messages took %d connections with %d accepted, want 3 with a cap of 3", conns, len(server.accepted()))
+	}
+	for _, c := range []struct {
+		name, reason string
+		want         float64
+	}{
+		{"smtp_pool_dials_total", "", 3},
+		{"smtp_pool_reuses_total", "", 4},
+		{"smtp_pool_retired_total", "message_cap", 2},
+		{"smtp_pool_open_connections", "", 1},
+	} {
+		if got := poolMetric(t, reg, c.name, c.reason); got != c.want {
+			t.Errorf("%s{%s} is %v, want %v", c.name, c.reason, got, c.want)
+		}
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if err := send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := poolMetric(t, reg, "smtp_pool_retired_total", "idle"); got != 1 {
+		t.Errorf("%v idle connections retired, want 1", got)
+	}
+
+	if err := pool.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(context.Background()); !errors.Is(err, mailer.ErrPoolClosed) {
+		t.Errorf("send after drain gave %v", err)
+	}
+	if got := poolMetric(t, reg, "smtp_pool_open_connections", ""); got != 0 {
+		t.Errorf("%v connections open after drain", got)
+	}
+}
+
+// TestPoolTimeout fails unless a server that never greets or never answers
+// a message fails the send after SendTimeout and frees the connection for
+// the next send, and unless a sender waiting behind the stalled message
+// gives up at its own deadline.
+func TestPoolTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	// A server accepting connections without a greeting
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var held []net.Conn
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			held = append(held, c)
+		}
+	}()
+	defer func() {
+		ln.Close()
+		wg.Wait()
+		for _, c := range held {
+			c.Close()
+		}
+	}()
+	silent, err := mailer.NewPool(mailer.PoolConfig{Addr: ln.Addr().String(), SendTimeout: timeout}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = mailer.NewSMTPSender(silent, "noreply@example.com").Send(context.Background(), common.EmailMessage{To: "user@example.com", Subject: "Hi", Body: "Hello"})
+	if err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("send to a silent server gave %v after %v", err, time.Since(start))
+	}
+
+	server := startFakeSMTP(t, nil, map[string]string{"slow@example.com": "hang"})
+	defer server.close()
+	reg := prometheus.NewRegistry()
+	pool, err := mailer.NewPool(mailer.PoolConfig{Addr: server.addr(), MaxConns: 1, SendTimeout: timeout}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Drain(context.Background())
+	sender := mailer.NewSMTPSender(pool, "noreply@example.com")
+
+	stalled := make(chan error, 1)
+	start = time.Now()
+	go func() {
+		stalled <- sender.Send(context.Background(), common.EmailMessage{To: "slow@example.com", Subject: "Hi", Body: "Hello"})
+	}()
+	for poolMetric(t, reg, "smtp_pool_open_connections", "") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sender.Send(ctx, common.EmailMessage{To: "user@example.com", Subject: "Hi", Body: "Hello"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("send behind a stalled message gave %v, want its deadline", err)
+	}
+	select {
+	case err := <-stalled:
+		if err == nil || time.Since(start) > 2*time.Second {
+			t.Errorf("stalled message gave %v after %v", err, time.Since(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled message never returned")
+	}
+	if got := poolMetric(t, reg, "smtp_pool_retired_total", "error"); got != 1 {
+		t.Errorf("%v connections retired after the stall, want 1", got)
+	}
+	if err := sender.Send(context.Background(), common.EmailMessage{To: "user@example.com", Subject: "Hi", Body: "Hello"}); err != nil || len(server.accepted()) != 1 {
+		t.Errorf("send after the stall gave %v with %d accepted", err, len(server.accepted()))
+	}
+}
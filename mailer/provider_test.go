@@ -0,0 +1,152 @@
+package mailer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/common"
+	"asynqdemo/mailer"
+
+	"github.com/hibiken/asynq"
+)
+
+// recordingMailer is a common.Mailer keeping the messages it is given
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []common.EmailMessage
+	err  error
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg common.EmailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return m.err
+}
+
+// TestEmailProviders fails unless HandleEmailTask hands the rendered
+// message to the mailer of its Deps, SendGrid gets the message with the API
+// key, and the answers of either provider are sorted into permanent
+// failures wrapping asynq.SkipRetry and retried ones, keeping Retry-After,
+// and unless EMAIL_PROVIDER selects the provider.
+func TestEmailProviders(t *testing.T) {
+	payload := &common.EmailPayload{UserID: 7, Email: "user@example.com", Subject: "News", Message: "Hello", Category: common.CategoryMarketing}
+
+	// A mock mailer injected through Deps gets the rendered message
+	mock := &recordingMailer{}
+	deps := common.DefaultDeps()
+	deps.Mailer = mock
+	deps.UnsubscribeURL = func(email, category string) string { return "https://example.com/unsubscribe/" + category }
+	if err := common.HandleEmailTask(common.WithDeps(context.Background(), deps), payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.sent) != 1 || mock.sent[0].To != payload.Email || mock.sent[0].Subject != "News" ||
+		mock.sent[0].Headers["List-Unsubscribe"] != "<https://example.com/unsubscribe/marketing>" {
+		t.Errorf("mock mailer got %+v", mock.sent)
+	}
+	mock.err = mailer.ErrRejected{Code: 550, Err: errors.New("no such user")}
+	if err := common.HandleEmailTask(common.WithDeps(context.Background(), deps), payload); !errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("permanent failure of the mock gave %v", err)
+	}
+
+	// SendGrid answers by recipient
+	var (
+		mu       sync.Mutex
+		requests []map[string]interface{}
+		auth     []string
+	)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		requests = append(requests, body)
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		to, _ := body["personalizations"].([]interface{})[0].(map[string]interface{})["to"].([]interface{})[0].(map[string]interface{})["email"].(string)
+		switch to {
+		case "invalid@example.com":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors": [{"message": "The to email does not contain a valid address.", "field": "personalizations.0.to"}]}`))
+		case "busy@example.com":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "down@example.com":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "badkey@example.com":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer api.Close()
+	sendGrid := mailer.NewSendGridSender("SG.test-key", "noreply@example.com")
+	sendGrid.Endpoint = api.URL
+	deps.Mailer = sendGrid
+	ctx := common.WithDeps(context.Background(), deps)
+	send := func(to string) error {
+		p := *payload
+		p.Email = to
+		return common.HandleEmailTask(ctx, &p)
+	}
+	if err := send("user@example.com"); err != nil {
+		t.Fatalf("email through SendGrid: %v", err)
+	}
+	mu.Lock()
+	first, key := requests[0], auth[0]
+	mu.Unlock()
+	if key != "Bearer SG.test-key" || first["subject"] != "News" || first["from"].(map[string]interface{})["email"] != "noreply@example.com" ||
+		first["headers"].(map[string]interface{})["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Errorf("SendGrid got %v with %q", first, key)
+	}
+
+	for _, c := range []struct {
+		to         string
+		permanent  bool
+		retryAfter time.Duration
+	}{
+		{"invalid@example.com", true, 0},
+		{"busy@example.com", false, 30 * time.Second},
+		{"down@example.com", false, 0},
+		{"badkey@example.com", false, 0},
+	} {
+		err := send(c.to)
+		var rejected mailer.ErrRejected
+		var ra circuit.ErrRetryAfter
+		if err == nil || errors.Is(err, asynq.SkipRetry) != c.permanent || errors.As(err, &rejected) != c.permanent {
+			t.Errorf("email to %s gave %v, want permanent %v", c.to, err, c.permanent)
+		}
+		if errors.As(err, &ra) != (c.retryAfter > 0) || ra.After != c.retryAfter {
+			t.Errorf("email to %s gave %v, want Retry-After %v", c.to, err, c.retryAfter)
+		}
+	}
+	if err := send("invalid@example.com"); err == nil || !errors.Is(err, asynq.SkipRetry) || err.Error() != "failed to send email to invalid@example.com: rejected permanently: SendGrid returned 400 Bad Request: The to email does not contain a valid address." {
+		t.Errorf("SendGrid rejection reads %v", err)
+	}
+
+	for _, c := range []struct {
+		provider, smtpAddr, key string
+		want                    string
+		ok                      bool
+	}{
+		{"", "", "", "", true},
+		{"", "smtp:587", "", mailer.ProviderSMTP, true},
+		{"sendgrid", "smtp:587", "SG.key", mailer.ProviderSendGrid, true},
+		{"sendgrid", "", "", "", false},
+		{"smtp", "", "", "", false},
+		{"ses", "", "", "", false},
+	} {
+		t.Setenv("EMAIL_PROVIDER", c.provider)
+		t.Setenv("SENDGRID_API_KEY", c.key)
+		got, err := mailer.ProviderFromEnv(c.smtpAddr)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("EMAIL_PROVIDER=%q with SMTP %q gave %q (%v), want %q", c.provider, c.smtpAddr, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+)
+
+// SMTPSender sends email messages through a Pool
+type SMTPSender struct {
+	pool *Pool
+	from string
+}
+
+// NewSMTPSender creates a sender using from as the envelope and header sender
+func NewSMTPSender(pool *Pool, from string) *SMTPSender {
+	return &SMTPSender{pool: pool, from: from}
+}
+
+// Send delivers msg, implementing common.Mailer
+func (s *SMTPSender) Send(ctx context.Context, msg common.EmailMessage) error {
+	data, err := format(s.from, msg)
+	if err != nil {
+		return err
+	}
+	c, err := s.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	c.deadline(ctx, s.pool.cfg.SendTimeout)
+	err = s.send(c, msg.To, data)
+	var refused refusedError
+	var rejected ErrRejected
+	if errors.As(err, &refused) || errors.As(err, &rejected) {
+		// The connection is fine, only this message is refused
+		s.pool.put(c, nil)
+		return err
+	}
+	s.pool.put(c, err)
+	return err
+}
+
+// refusedError is a recipient the server refused after a successful reset
+type refusedError struct {
+	to  string
+	err error
+}
+
+func (e refusedError) Error() string {
+	return fmt.Sprintf("SMTP server refused recipient %s: %v", e.to, e.err)
+}
+
+func (e refusedError) Unwrap() error {
+	return e.err
+}
+
+// ErrRejected is a permanent refusal of a recipient or message content by
+// any provider, such as an unknown recipient: a 5xx SMTP reply or a 400 or
+// 413 API answer, whose code is Code. It wraps asynq.SkipRetry since
+// sending the same message again would be rejected again; temporary
+// replies, outages and connection errors are retried.
+type ErrRejected struct {
+	Code int
+	Err  error
+}
+
+func (e ErrRejected) Error() string {
+	return fmt.Sprintf("rejected permanently: %v", e.Err)
+}
+
+func (e ErrRejected) Unwrap() []error {
+	return []error{asynq.SkipRetry, e.Err}
+}
+
+// rejection returns err, a reply to RCPT or DATA, as ErrRejected when it is
+// permanent
+func rejection(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return ErrRejected{Code: reply.Code, Err: err}
+	}
+	return err
+}
+
+func (s *SMTPSender) send(c *conn, to string, data []byte) error {
+	if err := c.client.Mail(s.from); err != nil {
+		// Not a rejection: a refused sender fails every message until the
+		// configuration is fixed, so those are retried
+		return fmt.Errorf("failed to set sender: %v", err)
+	}
+	if err := c.client.Rcpt(to); err != nil {
+		if rerr := c.client.Reset(); rerr != nil {
+			return fmt.Errorf("failed to reset after refused recipient %s: %v", to, rerr)
+		}
+		return refusedError{to: to, err: rejection(err)}
+	}
+	w, err := c.client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start message: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send message to %s: %w", to, rejection(err))
+	}
+	c.sent++
+	return nil
+}
+
+// checkHeader refuses a header field whose name or value would end the
+// line, since a payload could otherwise add recipients or headers of its own
+func checkHeader(name, value string) error {
+	if name == "" || strings.ContainsAny(name, "\r\n: ") || strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid email header %q: line breaks are not allowed: %w", name, asynq.SkipRetry)
+	}
+	return nil
+}
+
+// format renders msg as an RFC 5322 message, multipart/alternative when it
+// has an HTML body. Header fields with line breaks are refused with
+// asynq.SkipRetry.
+func format(from string, msg common.EmailMessage) ([]byte, error) {
+	var sb strings.Builder
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := [][2]string{{"From", from}, {"To", msg.To}, {"Subject", msg.Subject}}
+	for _, name := range names {
+		fields = append(fields, [2]string{name, msg.Headers[name]})
+	}
+	for _, f := range fields {
+		if err := checkHeader(f[0], f[1]); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&sb, "%s: %s\r\n", f[0], f[1])
+	}
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	if msg.HTML == "" {
+		sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		sb.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+		return []byte(sb.String()), nil
+	}
+	parts := multipart.NewWriter(&sb)
+	fmt.Fprintf(&sb, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	text, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	text.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n")))
+	// Quoted-printable keeps the long lines of HTML within the SMTP limit
+	html, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}, "Content-Transfer-Encoding": {"quoted-printable"}})
+	qp := quotedprintable.NewWriter(html)
+	qp.Write([]byte(msg.HTML))
+	qp.Close()
+	parts.Close()
+	return []byte(sb.String()), nil
+}
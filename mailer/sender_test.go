@@ -0,0 +1,295 @@
+package mailer_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"asynqdemo/common"
+	"asynqdemo/mailer"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeSMTP is an SMTP server for tests. It accepts any sender, answers
+// RCPT and DATA with the replies configured for the recipient, 250 by
+// default, and records the messages it accepts, with the line endings
+// textproto reads them with. A DATA reply of "hang" never answers.
+type fakeSMTP struct {
+	ln   net.Listener
+	rcpt map[string]string
+	data map[string]string
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	auth     []string
+	messages []fakeMessage
+	wg       sync.WaitGroup
+}
+
+type fakeMessage struct {
+	From, To, Data string
+}
+
+// startFakeSMTP listens on a free local port until close is called
+func startFakeSMTP(t *testing.T, rcpt, data map[string]string) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, rcpt: rcpt, data: data}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(c)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSMTP) close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *fakeSMTP) accepted() []fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMessage(nil), s.messages...)
+}
+
+func (s *fakeSMTP) serve(c net.Conn) {
+	defer c.Close()
+	r := textproto.NewReader(bufio.NewReader(c))
+	reply := func(line string) {
+		c.Write([]byte(line + "\r\n"))
+	}
+	reply("220 fake ESMTP")
+	var from, to string
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-fake")
+			reply("250 AUTH PLAIN")
+		case "HELO", "NOOP":
+			reply("250 OK")
+		case "AUTH":
+			creds, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			s.mu.Lock()
+			s.auth = append(s.auth, string(creds))
+			s.mu.Unlock()
+			reply("235 2.7.0 Authenticated")
+		case "MAIL":
+			from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			reply("250 OK")
+		case "RCPT":
+			to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if r, ok := s.rcpt[to]; ok {
+				to = ""
+				reply(r)
+				continue
+			}
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			data, err := r.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			if r, ok := s.data[to]; ok {
+				if r == "hang" {
+					io.Copy(io.Discard, c)
+					return
+				}
+				reply(r)
+				continue
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, fakeMessage{From: from, To: to, Data: string(data)})
+			s.mu.Unlock()
+			reply("250 OK")
+		case "RSET":
+			from, to = "", ""
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// TestSMTPMailer sends emails through HandleEmailTask to a fake SMTP
+// server and fails unless accepted messages carry the payload's address,
+// subject and message, permanent 5xx rejections of a recipient or message
+// wrap asynq.SkipRetry while 4xx replies and connection failures are
+// retried, the server address is read from SMTP_ADDR or SMTP_HOST and
+// SMTP_PORT, and the handler only prints without SMTP configured.
+func TestSMTPMailer(t *testing.T) {
+	server := startFakeSMTP(t,
+		map[string]string{"unknown@example.com": "550 5.1.1 No such user", "full@example.com": "452 4.2.2 Mailbox full"},
+		map[string]string{"spam@example.com": "554 5.7.1 Message rejected"})
+	defer server.close()
+	pool, err := mailer.NewPool(mailer.PoolConfig{Addr: server.addr(), Username: "mailer", Password: "secret"}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Drain(context.Background())
+	deps := common.DefaultDeps()
+	deps.Mailer = mailer.NewSMTPSender(pool, "noreply@example.com")
+	ctx := common.WithDeps(context.Background(), deps)
+	send := func(ctx context.Context, to string) error {
+		return common.HandleEmailTask(ctx, &common.EmailPayload{UserID: 7, Email: to, Subject: "Welcome", Message: "Hello\nthere"})
+	}
+
+	if err := send(ctx, "user@example.com"); err != nil {
+		t.Fatalf("email to an accepted recipient: %v", err)
+	}
+	msgs := server.accepted()
+	if len(msgs) != 1 || msgs[0].From != "noreply@example.com" || msgs[0].To != "user@example.com" ||
+		!strings.Contains(msgs[0].Data, "Subject: Welcome\n") || !strings.Contains(msgs[0].Data, "Hello\nthere") {
+		t.Errorf("server accepted %+v", msgs)
+	}
+	server.mu.Lock()
+	auth := server.auth
+	server.mu.Unlock()
+	if len(auth) != 1 || auth[0] != "\x00mailer\x00secret" {
+		t.Errorf("server saw credentials %q", auth)
+	}
+
+	for _, c := range []struct {
+		to        string
+		permanent bool
+	}{
+		{"unknown@example.com", true},
+		{"spam@example.com", true},
+		{"full@example.com", false},
+	} {
+		err := send(ctx, c.to)
+		var rejected mailer.ErrRejected
+		if err == nil || errors.Is(err, asynq.SkipRetry) != c.permanent || errors.As(err, &rejected) != c.permanent {
+			t.Errorf("email to %s gave %v, want permanent %v", c.to, err, c.permanent)
+		}
+	}
+	// Rejections leave the connection usable
+	if err := send(ctx, "user@example.com"); err != nil || len(server.accepted()) != 2 {
+		t.Errorf("email after rejections gave %v with %d accepted", err, len(server.accepted()))
+	}
+
+	// A server that cannot be reached is retried
+	down := startFakeSMTP(t, nil, nil)
+	downAddr := down.addr()
+	down.close()
+	downPool, err := mailer.NewPool(mailer.PoolConfig{Addr: downAddr}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps.Mailer = mailer.NewSMTPSender(downPool, "noreply@example.com")
+	if err := send(common.WithDeps(context.Background(), deps), "user@example.com"); err == nil || errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("email with the server down gave %v, want a retried error", err)
+	}
+
+	// Without SMTP the handler prints the email
+	deps.Mailer = nil
+	if err := send(common.WithDeps(context.Background(), deps), "user@example.com"); err != nil {
+		t.Errorf("print-only email gave %v", err)
+	}
+
+	for _, c := range []struct {
+		addr, host, port string
+		want             string
+		ok               bool
+	}{
+		{"", "", "", "", true},
+		{"", "smtp.example.com", "", "smtp.example.com:587", true},
+		{"", "smtp.example.com", "2525", "smtp.example.com:2525", true},
+		{"relay:25", "smtp.example.com", "2525", "relay:25", true},
+		{"", "smtp.example.com", "smtp", "", false},
+		{"", "", "2525", "", false},
+	} {
+		t.Setenv("SMTP_ADDR", c.addr)
+		t.Setenv("SMTP_HOST", c.host)
+		t.Setenv("SMTP_PORT", c.port)
+		addr, err := mailer.AddrFromEnv()
+		if addr != c.want || (err == nil) != c.ok {
+			t.Errorf("SMTP_ADDR=%q SMTP_HOST=%q SMTP_PORT=%q gave %q (%v), want %q", c.addr, c.host, c.port, addr, err, c.want)
+		}
+	}
+}
+
+// TestFormat fails unless text-only messages declare their MIME type and
+// header fields with line breaks, which would let a payload add recipients,
+// are refused with asynq.SkipRetry before anything is sent
+func TestFormat(t *testing.T) {
+	server := startFakeSMTP(t, nil, nil)
+	defer server.close()
+	pool, err := mailer.NewPool(mailer.PoolConfig{Addr: server.addr()}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Drain(context.Background())
+	sender := mailer.NewSMTPSender(pool, "noreply@example.com")
+	ctx := context.Background()
+
+	msg := common.EmailMessage{To: "user@example.com", Subject: "Welcome", Body: "Hello", Headers: map[string]string{"List-Unsubscribe": "<https://example.com/u>"}}
+	if err := sender.Send(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.accepted(); len(got) != 1 || !strings.Contains(got[0].Data, "MIME-Version: 1.0\nContent-Type: text/plain; charset=utf-8\n") ||
+		!strings.Contains(got[0].Data, "List-Unsubscribe: <https://example.com/u>\n") {
+		t.Errorf("server accepted %+v", got)
+	}
+
+	for _, bad := range []common.EmailMessage{
+		{To: "user@example.com", Subject: "Hi\r\nBcc: victim@example.com", Body: "x"},
+		{To: "user@example.com\nBcc: victim@example.com", Subject: "Hi", Body: "x"},
+		{To: "user@example.com", Subject: "Hi", Body: "x", Headers: map[string]string{"X-Tag": "a\rBcc: victim@example.com"}},
+		{To: "user@example.com", Subject: "Hi", Body: "x", Headers: map[string]string{"Bcc: victim@example.com\r\nX-Tag": "a"}},
+	} {
+		if err := sender.Send(ctx, bad); !errors.Is(err, asynq.SkipRetry) {
+			t.Errorf("message %+v gave %v, want asynq.SkipRetry", bad, err)
+		}
+	}
+	if got := server.accepted(); len(got) != 1 {
+		t.Errorf("server accepted %d messages, want only the valid one", len(got))
+	}
+	if badFrom := mailer.NewSMTPSender(pool, "noreply@example.com\r\nBcc: victim@example.com"); !errors.Is(badFrom.Send(ctx, msg), asynq.SkipRetry) {
+		t.Error("sender with a line break accepted")
+	}
+}
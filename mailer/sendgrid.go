@@ -0,0 +1,129 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/common"
+)
+
+// SendGridEndpoint is the v3 mail send API
+const SendGridEndpoint = "https://api.sendgrid.com/v3/mail/send"
+
+// SendGridSender sends email messages through the SendGrid API
+type SendGridSender struct {
+	// Endpoint is SendGridEndpoint unless pointed elsewhere, e.g. a sandbox
+	Endpoint string
+	Client   *http.Client
+	apiKey   string
+	from     string
+}
+
+// NewSendGridSender creates a sender authenticating with apiKey and sending
+// from from
+func NewSendGridSender(apiKey, from string) *SendGridSender {
+	return &SendGridSender{Endpoint: SendGridEndpoint, Client: &http.Client{Timeout: 10 * time.Second}, apiKey: apiKey, from: from}
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridMail struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+// Send delivers msg, implementing common.Mailer. A 400 or 413 answer means
+// the message itself is refused and fails with ErrRejected; a 429 or 503
+// with Retry-After fails with circuit.ErrRetryAfter, and the other errors,
+// including a refused API key, are retried.
+func (s *SendGridSender) Send(ctx context.Context, msg common.EmailMessage) error {
+	mail := sendGridMail{
+		Personalizations: []sendGridPersonalization{{To: []sendGridAddress{{Email: msg.To}}}},
+		From:             sendGridAddress{Email: s.from},
+		Subject:          msg.Subject,
+		Content:          []sendGridContent{{Type: "text/plain", Value: msg.Body}},
+	}
+	if msg.HTML != "" {
+		// SendGrid wants text/plain before text/html
+		mail.Content = append(mail.Content, sendGridContent{Type: "text/html", Value: msg.HTML})
+	}
+	if len(msg.Headers) > 0 {
+		mail.Headers = msg.Headers
+	}
+	body, err := json.Marshal(mail)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email to %s: %v", msg.To, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create SendGrid request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach SendGrid: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("SendGrid returned %s%s", resp.Status, sendGridErrors(resp.Body))
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return ErrRejected{Code: resp.StatusCode, Err: err}
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if after, ok := circuit.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return circuit.ErrRetryAfter{Err: err, After: after}
+		}
+	}
+	return err
+}
+
+// sendGridErrors returns the messages of an error answer, e.g. ": The to
+// email does not contain a valid address"
+func sendGridErrors(r io.Reader) string {
+	var answer struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.NewDecoder(io.LimitReader(r, 64<<10)).Decode(&answer) != nil {
+		return ""
+	}
+	var messages []string
+	for _, e := range answer.Errors {
+		if e.Message != "" {
+			messages = append(messages, e.Message)
+		}
+	}
+	if len(messages) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(messages, "; ")
+}
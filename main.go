@@ -1,194 +1,1252 @@
 package main
 
 import (
+	"asynqdemo/admin"
+	"asynqdemo/advisor"
+	"asynqdemo/affinity"
+	"asynqdemo/api"
+	"asynqdemo/app"
+	"asynqdemo/artifacts"
+	"asynqdemo/audit"
+	"asynqdemo/canary"
+	"asynqdemo/chaos"
+	"asynqdemo/circuit"
 	"asynqdemo/common"
+	"asynqdemo/concurrency"
+	"asynqdemo/config"
+	"asynqdemo/crypto"
+	"asynqdemo/dash"
+	"asynqdemo/debug"
+	"asynqdemo/dedup"
+	"asynqdemo/demo"
+	"asynqdemo/drift"
+	"asynqdemo/emailtmpl"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/errorbudget"
+	"asynqdemo/eventlog"
+	"asynqdemo/events"
+	"asynqdemo/external"
+	"asynqdemo/flags"
+	"asynqdemo/fleet"
+	"asynqdemo/hotreload"
+	"asynqdemo/i18n"
+	"asynqdemo/k8s"
+	"asynqdemo/leak"
+	"asynqdemo/mailer"
+	"asynqdemo/maintenance"
+	"asynqdemo/metadata"
+	"asynqdemo/metrics"
+	"asynqdemo/notify"
+	"asynqdemo/orphans"
+	"asynqdemo/predict"
+	"asynqdemo/push"
+	"asynqdemo/quarantine"
+	"asynqdemo/queues"
+	"asynqdemo/quiethours"
+	"asynqdemo/quota"
+	"asynqdemo/ratelimit"
+	"asynqdemo/retrysim"
+	"asynqdemo/scheduler"
+	"asynqdemo/startup"
+	"asynqdemo/stats"
+	"asynqdemo/throttle"
+	"asynqdemo/timeout"
+	"asynqdemo/tracing"
+	"asynqdemo/trash"
+	"asynqdemo/unsubscribe"
+	"asynqdemo/validation"
+	"asynqdemo/variants"
+	"asynqdemo/warmup"
+	"asynqdemo/webhooks"
+	"asynqdemo/workflow"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
 )
 
-// HandleWelcomeTask wraps the common handler for Asynq
-func HandleWelcomeTask(ctx context.Context, t *asynq.Task) error {
-	var p common.WelcomePayload
-	if err := json.Unmarshal(t.Payload(), &p); err != nil {
-		return fmt.Errorf("failed to unmarshal welcome payload: %v", err)
+// enqueueTask enqueues a task the way this service's producers do: with the
+// user in the metadata for quotas, email encrypted under the tenant's key,
+// deferred or refused (throttle.ErrThrottled) over its frequency cap, held
+// for the recipient's quiet hours when it is marketing, checked against the
+// fleet's payload versions and recorded for audits. Control tasks only get
+// the version check.
+func enqueueTask(ctx context.Context, client *asynq.Client, gate *fleet.Gate, router *affinity.Router, encryptor *crypto.PayloadEncryptor, quiet *quiethours.Config, ledger *throttle.Ledger, auditStore *audit.Store, taskType string, payload []byte, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	// Control tasks have no payload to wrap, encrypt or audit
+	if common.IsControl(taskType) {
+		return gate.Enqueue(ctx, client, asynq.NewTask(taskType, nil), opts...)
 	}
-	return common.HandleWelcomeTask(ctx, &p)
-}
-
-// HandleEmailTask wraps the common handler for Asynq
-func HandleEmailTask(ctx context.Context, t *asynq.Task) error {
-	var p common.EmailPayload
-	if err := json.Unmarshal(t.Payload(), &p); err != nil {
-		return fmt.Errorf("failed to unmarshal email payload: %v", err)
+	var ids struct {
+		UserID   int    `json:"user_id"`
+		TenantID string `json:"tenant_id"`
+	}
+	if err := json.Unmarshal(payload, &ids); err != nil {
+		return nil, fmt.Errorf("failed to read %s payload: %v", taskType, err)
+	}
+	md := metadata.Metadata{}
+	if ids.UserID != 0 {
+		md[quota.KeyUserID] = strconv.Itoa(ids.UserID)
 	}
-	return common.HandleEmailTask(ctx, &p)
+	if taskType == common.TypeEmailTask {
+		var p common.EmailPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return nil, fmt.Errorf("failed to read %s payload: %v", taskType, err)
+		}
+		now := time.Now()
+		var err error
+		if opts, err = ledger.Options(ctx, &p, now, false, opts...); err != nil {
+			return nil, err
+		}
+		opts = quiet.Options(&p, now, opts...)
+	}
+	if taskType == common.TypeEmailTask && encryptor != nil {
+		var err error
+		if payload, err = encryptor.Encrypt(ctx, ids.TenantID, payload); err != nil {
+			return nil, fmt.Errorf("failed to encrypt %s payload: %v", taskType, err)
+		}
+		payload = crypto.Encode(payload)
+		if ids.TenantID != "" {
+			md[crypto.KeyTenantID] = ids.TenantID
+		}
+	}
+	// asynq has no place for the trace context of WithTraceContext
+	tracing.Inject(md, opts...)
+	// The options of the type's constructor, e.g. common.NewEmailTask; the
+	// payload is wrapped here, so the constructor itself cannot be used
+	spec, _ := common.LookupTaskSpec(taskType)
+	t, err := metadata.NewTask(taskType, payload, md, spec.DefaultOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s task: %v", taskType, err)
+	}
+	// Options given by the caller, such as the queue, win over the routing
+	info, err := gate.Enqueue(ctx, client, t, common.EnqueueOptions(taskType, append(router.QueueOption(t), opts...)...)...)
+	if err != nil {
+		return nil, err
+	}
+	auditStore.RecordEnqueued(ctx, info)
+	return info, nil
 }
 
-// HandleServerInfoTask wraps the common handler for Asynq
-func HandleServerInfoTask(ctx context.Context, t *asynq.Task) error {
-	var p common.ServerInfoPayload
-	if err := json.Unmarshal(t.Payload(), &p); err != nil {
-		return fmt.Errorf("failed to unmarshal server info payload: %v", err)
+// envDuration parses the duration in env var name, zero when it is unset
+func envDuration(name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
 	}
-	return common.HandleServerInfoTask(ctx, &p)
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("❌ Invalid %s %q: %v", name, v, err)
+	}
+	return d
 }
 
 func main() {
-	// Redis connection config
-	redisAddr := "localhost:6380"
-	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
-		redisAddr = addr
+	checkI18n := flag.Bool("check-i18n", false, "verify every referenced message key exists in all locales and exit")
+	hotReload := flag.Bool("hot-reload", false, "reload handler plugins when their sources change (dev builds only)")
+	hotReloadDirs := flag.String("hot-reload-dirs", "plugins", "comma-separated plugin directories watched by -hot-reload")
+	chaosMode := flag.Bool("chaos-mode", false, "inject scheduler failures (chaos builds only)")
+	chaosFailRate := flag.Float64("chaos-fail-rate", 0.1, "fraction of scheduler calls failed by -chaos-mode")
+	chaosMailerFailRate := flag.Float64("chaos-mailer-fail-rate", 0, "fraction of email sends failed by -chaos-mode, as in a provider outage")
+	demoMode := flag.Bool("demo", false, "enqueue the sample tasks of -demo-file (also DEMO=1)")
+	demoFile := flag.String("demo-file", demo.DefaultFile, "demo scenario run by -demo")
+	demoInterval := flag.Duration("demo-interval", 0, "run the demo scenario again at this interval; zero runs it once")
+	embeddedRedis := flag.Bool("embedded-redis", false, "run an in-process Redis for demos; its data is lost on exit")
+	embeddedRedisAddr := flag.String("embedded-redis-addr", embeddedredis.DefaultAddr, "address the -embedded-redis instance listens on")
+	configFile := flag.String("config", config.DefaultFile, "YAML or JSON file with the Redis and server settings; env vars override it and the defaults apply when it is missing")
+	modeFlag := flag.String("mode", string(app.ModeAll), "role to run: worker, schedule, produce (enqueue the -demo-file tasks once and exit) or all")
+	flag.Parse()
+	mode, err := app.ParseMode(*modeFlag)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
 	}
 
-	redisConnOpt := asynq.RedisClientOpt{
-		Addr: redisAddr,
+	deps := common.DefaultDeps()
+	if *checkI18n {
+		gaps := deps.Catalog.Check()
+		if len(gaps) == 0 {
+			fmt.Println("✅ All referenced translations are present")
+			return
+		}
+		fmt.Println("❌ Missing translations:")
+		for _, g := range gaps {
+			fmt.Printf("   %s\n", g)
+		}
+		os.Exit(1)
+	}
+
+	// Redis connection from REDIS_URL or REDIS_MODE/REDIS_ADDR, or an
+	// in-process instance with --embedded-redis
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
 	}
-	// Support Redis password via environment variable
-	if pwd := os.Getenv("REDIS_PASSWORD"); pwd != "" {
-		redisConnOpt.Password = pwd
+	if cfg.File != "" {
+		fmt.Printf("✅ Loaded config from %s\n", cfg.File)
+	}
+	conn, err := app.ConnectRedis(cfg, *embeddedRedis, *embeddedRedisAddr)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	defer conn.Close()
+	redisConnOpt, rdb, embedded := conn.ConnOpt, conn.Client, conn.Embedded
+
+	// Record translations that fall back to the default locale
+	deps.Catalog.SetRecorder(i18n.NewRedisRecorder(rdb))
+
+	// Suppress marketing mail to recipients who unsubscribed
+	deps.Preferences = common.NewRedisPreferences(rdb)
+
+	// Signed unsubscribe links, enabled by UNSUBSCRIBE_SECRET
+	var unsubscribeSigner *unsubscribe.Signer
+	if secret := os.Getenv("UNSUBSCRIBE_SECRET"); secret != "" {
+		signer, err := unsubscribe.NewSigner([]byte(secret))
+		if err != nil {
+			log.Fatalf("❌ Invalid UNSUBSCRIBE_SECRET: %v", err)
+		}
+		baseURL := os.Getenv("UNSUBSCRIBE_BASE_URL")
+		if baseURL == "" {
+			baseURL = "http://" + admin.AddrFromEnv()
+		}
+		unsubscribeSigner = signer
+		deps.UnsubscribeURL = signer.URLFunc(baseURL)
+	}
+
+	// Send email through EMAIL_PROVIDER: over pooled SMTP connections, the
+	// default when SMTP_ADDR or SMTP_HOST is set, or the SendGrid API;
+	// without a provider emails are only printed
+	smtpAddr, err := mailer.AddrFromEnv()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	emailProvider, err := mailer.ProviderFromEnv(smtpAddr)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	var smtpPool *mailer.Pool
+	switch emailProvider {
+	case mailer.ProviderSMTP:
+		poolCfg := mailer.PoolConfig{
+			Addr:     smtpAddr,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+		if v := os.Getenv("SMTP_MAX_CONNS"); v != "" {
+			if poolCfg.MaxConns, err = strconv.Atoi(v); err != nil {
+				log.Fatalf("❌ Invalid SMTP_MAX_CONNS %q: %v", v, err)
+			}
+		}
+		if v := os.Getenv("SMTP_MAX_MESSAGES_PER_CONN"); v != "" {
+			if poolCfg.MaxMessagesPerConn, err = strconv.Atoi(v); err != nil {
+				log.Fatalf("❌ Invalid SMTP_MAX_MESSAGES_PER_CONN %q: %v", v, err)
+			}
+		}
+		if v := os.Getenv("SMTP_IDLE_TIMEOUT"); v != "" {
+			if poolCfg.IdleTimeout, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("❌ Invalid SMTP_IDLE_TIMEOUT %q: %v", v, err)
+			}
+		}
+		if v := os.Getenv("SMTP_SEND_TIMEOUT"); v != "" {
+			if poolCfg.SendTimeout, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("❌ Invalid SMTP_SEND_TIMEOUT %q: %v", v, err)
+			}
+		}
+		if smtpPool, err = mailer.NewPool(poolCfg, prometheus.DefaultRegisterer); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		deps.Mailer = mailer.NewSMTPSender(smtpPool, mailer.FromAddress())
+	case mailer.ProviderSendGrid:
+		deps.Mailer = mailer.NewSendGridSender(os.Getenv("SENDGRID_API_KEY"), mailer.FromAddress())
+	}
+
+	// Email provider outage simulated by -chaos-mode -chaos-mailer-fail-rate
+	if *chaosMode && *chaosMailerFailRate > 0 {
+		failing, err := chaos.NewFailingMailer(deps.Mailer, *chaosMailerFailRate, time.Now().UnixNano())
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		deps.Mailer = failing
+	}
+
+	// Circuit breakers of the downstream providers: after CIRCUIT_THRESHOLD
+	// (default 5) consecutive failures a provider is left alone for
+	// CIRCUIT_COOLDOWN (default 30s) or its Retry-After, and the tasks
+	// needing it wait for the next probe without using up their retries
+	breakers, err := circuit.RegistryFromEnv(prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if deps.Mailer != nil {
+		// The chaos mailer without a provider stands in for SMTP
+		breaker := emailProvider
+		if breaker == "" {
+			breaker = mailer.ProviderSMTP
+		}
+		deps.Mailer = mailer.WithBreaker(deps.Mailer, breakers.Breaker(breaker))
 	}
 
 	// Create client for enqueuing tasks
 	client := asynq.NewClient(redisConnOpt)
 	defer client.Close()
 
-	// Create server for processing tasks
-	srv := asynq.NewServer(
-		redisConnOpt,
-		asynq.Config{
-			Concurrency: 5,
-			Queues: map[string]int{
-				"critical": 6,
-				"default":  3,
-				"low":      1,
-			},
-		},
-	)
+	inspector := asynq.NewInspector(redisConnOpt)
+	defer inspector.Close()
 
-	// Register task handlers
-	mux := asynq.NewServeMux()
-	mux.HandleFunc(common.TypeWelcomeMessage, HandleWelcomeTask)
-	mux.HandleFunc(common.TypeEmailTask, HandleEmailTask)
-	mux.HandleFunc(common.TypeServerInfo, HandleServerInfoTask)
+	// AFFINITY_CONFIG shards task types per user; workers also consume their claimed shards
+	var router *affinity.Router
+	if path := os.Getenv("AFFINITY_CONFIG"); path != "" {
+		cfg, err := affinity.LoadConfig(path)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if w := os.Getenv("AFFINITY_WORKER"); w != "" {
+			cfg.Worker = w
+		}
+		if router, err = affinity.NewRouter(cfg); err != nil {
+			log.Fatalf("❌ Invalid affinity config: %v", err)
+		}
+		fmt.Printf("🧲 Affinity routing enabled, claimed shards: %v\n", router.ClaimedQueues())
+	}
 
-	fmt.Println("🚀 Starting Asynq Demo...")
-	fmt.Printf("📍 Redis: %s\n", redisAddr)
+	// Slack for result notifications and operational alerts
+	var slackClient notify.SlackClient
+	if url := os.Getenv("SLACK_WEBHOOK_URL"); url != "" {
+		slackClient = notify.WebhookSlackClient{URL: url}
+	}
+	// Operational alerts go to ALERT_SLACK_CHANNEL when Slack is configured
+	var alert func(ctx context.Context, text string) error
+	if slackClient != nil {
+		alert = func(ctx context.Context, text string) error {
+			return slackClient.PostMessage(ctx, os.Getenv("ALERT_SLACK_CHANNEL"), text)
+		}
+	}
 
-	// Start consumer in background
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		fmt.Println("🐰 Consumer started, waiting for tasks...")
-		if err := srv.Run(mux); err != nil {
-			log.Printf("❌ Consumer error: %v", err)
+	// Local JSONL event log in EVENT_LOG_DIR for deployments with only a disk:
+	// task outcomes, alerts and queue snapshots, queried with admin events
+	eventLogCfg, err := eventlog.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	var eventLog *eventlog.Writer
+	if eventLogCfg.Dir != "" {
+		if eventLog, err = eventlog.NewWriter(eventLogCfg); err != nil {
+			log.Fatalf("❌ %v", err)
 		}
-	}()
+		alert = eventLog.Alerts(alert)
+	}
+	deps.Alert = alert
 
-	// Give consumer time to start
-	time.Sleep(1 * time.Second)
+	// Server info tasks alert when the runtime stats exceed STATS_MAX_*,
+	// the thresholds the admin stats command exits non-zero on
+	if deps.StatsThresholds, err = stats.ThresholdsFromEnv(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
 
-	// Start scheduler for periodic tasks
-	scheduler := asynq.NewScheduler(redisConnOpt, nil)
+	// Optional features enabled below, advertised to the fleet
+	var features []string
+	if embedded != nil {
+		features = append(features, "embedded-redis")
+	}
+	if emailProvider != "" {
+		features = append(features, "email-"+emailProvider)
+	}
 
-	// Register periodic server info task every 30 seconds
-	serverInfoPayload := &common.ServerInfoPayload{
-		Timestamp: time.Now().Unix(),
-		Source:    "periodic-monitor",
+	// W3C trace context travels from producers to handlers in the task
+	// metadata; spans go to the OpenTelemetry collector at
+	// OTEL_EXPORTER_OTLP_ENDPOINT as OTEL_SERVICE_NAME
+	var (
+		tracer tracing.Tracer
+		spans  *tracing.OTLPExporter
+	)
+	if endpoint := tracing.EndpointFromEnv(); endpoint != "" {
+		spans = tracing.NewOTLPExporter(endpoint, tracing.ServiceNameFromEnv())
+		tracer = tracing.NewTracer(spans.Export)
+		features = append(features, "tracing")
+		fmt.Printf("🔭 Exporting spans to %s\n", endpoint)
 	}
 
-	payload, err := json.Marshal(serverInfoPayload)
+	// Email payloads are encrypted with the tenant's cloud KMS key, enabled by
+	// PAYLOAD_KMS; tasks whose key was revoked are archived and alerted about
+	encryptor, err := crypto.PayloadEncryptorFromEnv(alert)
 	if err != nil {
-		log.Printf("❌ Failed to marshal server info payload: %v", err)
-	} else {
-		if _, err := scheduler.Register("@every 30s", asynq.NewTask(common.TypeServerInfo, payload)); err != nil {
-			log.Printf("❌ Failed to register server info scheduler: %v", err)
-		} else {
-			fmt.Println("⏰ Server info scheduler registered - runs every 30 seconds")
+		log.Fatalf("❌ Failed to set up payload encryption: %v", err)
+	}
+	if encryptor != nil {
+		features = append(features, "payload-encryption")
+		fmt.Printf("🔐 Email payloads encrypted via %s KMS\n", os.Getenv("PAYLOAD_KMS"))
+	}
+
+	// Marketing and digest email waits for the recipient's send window, set
+	// by QUIET_HOURS and QUIET_HOURS_TENANTS
+	quiet, err := quiethours.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if quiet != nil {
+		features = append(features, "quiet-hours")
+		fmt.Printf("🌙 Marketing email sent only within %v recipient time (%d tenant overrides)\n", quiet.Default.Window, len(quiet.Tenants))
+	}
+
+	// Per-user caps on email of a category across campaigns and workflows,
+	// EMAIL_FREQUENCY_CAPS (one welcome email per 7 days by default); sends
+	// are recorded in the ledger once they succeed
+	caps, err := throttle.CapsFromEnv()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	ledger := throttle.NewLedger(rdb, caps)
+	if ledger != nil {
+		features = append(features, "frequency-caps")
+		fmt.Printf("🚦 Email frequency caps: %v\n", caps)
+	}
+
+	// Task lifecycle audit log, enabled by AUDIT_ENABLED
+	var auditStore *audit.Store
+	if os.Getenv("AUDIT_ENABLED") == "true" {
+		auditStore = audit.NewStore(rdb)
+		auditStore.IsFailure = flags.IsFailure
+		if err := auditStore.Enable(context.Background()); err != nil {
+			log.Printf("❌ Failed to enable audit store: %v", err)
+		}
+		features = append(features, "audit")
+	}
+
+	// Producers check payload versions against the fleet; FLEET_GATE=refuse blocks instead of warning
+	gate := fleet.NewGate(rdb, os.Getenv("FLEET_GATE") == "refuse")
+
+	// Producers skip a task whose type's natural key, such as an email's
+	// user and subject, was enqueued within PRODUCER_DEDUP_WINDOW, so a
+	// producer restarted after a crash does not enqueue it twice. The keys
+	// live under DEDUP_NAMESPACE (default "dedup:").
+	var deduper *dedup.Deduplicator
+	dedupWindow := envDuration("PRODUCER_DEDUP_WINDOW")
+	if dedupWindow > 0 {
+		deduper = dedup.NewDeduplicator(rdb)
+		if ns := os.Getenv("DEDUP_NAMESPACE"); ns != "" {
+			deduper.Namespace = ns
 		}
+		features = append(features, "producer-dedup")
+		fmt.Printf("🔁 Producers skip tasks with a key enqueued within %v\n", dedupWindow)
 	}
 
-	// Start scheduler in background
-	if err := scheduler.Start(); err != nil {
-		log.Printf("❌ Failed to start scheduler: %v", err)
+	produce := func(ctx context.Context, taskType string, payload []byte, opts ...asynq.Option) (info *asynq.TaskInfo, err error) {
+		if tracer != nil {
+			var span tracing.Span
+			ctx, span = tracer.Start(ctx, taskType+" publish", tracing.SpanKindProducer)
+			defer func() {
+				span.RecordError(err)
+				span.End()
+			}()
+		}
+		opts = append(opts, tracing.WithTraceContext(ctx))
+		if spec, ok := common.LookupTaskSpec(taskType); ok && spec.DedupKey != nil && deduper != nil {
+			opts = append(opts, dedup.DeduplicateBy(spec.DedupKey, dedupWindow))
+		}
+		keys, err := deduper.Claim(ctx, taskType, payload, opts...)
+		if err != nil {
+			return nil, err
+		}
+		info, err = enqueueTask(ctx, client, gate, router, encryptor, quiet, ledger, auditStore, taskType, payload, opts...)
+		if err != nil {
+			deduper.Release(ctx, keys)
+		}
+		return info, err
+	}
+	// The producer only enqueues the sample tasks and exits
+	if mode == app.ModeProduce {
+		if err := app.Produce(context.Background(), *demoFile, produce); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if spans != nil {
+			if err := spans.Flush(context.Background()); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+		}
+		return
+	}
+
+	// Normal number of concurrent tasks; the limiter below sets the effective
+	// value, and the server keeps headroom for temporary bumps
+	maxConcurrency := cfg.Concurrency
+	const bumpHeadroom = 20
+
+	// Background components, started once the worker is configured and stopped
+	// in reverse order: the consumer gives in-flight tasks the shutdown
+	// timeout, the components stopped after it get drainGrace more
+	const drainGrace = 10 * time.Second
+	supervisor := common.NewSupervisor(cfg.ShutdownTimeout + drainGrace)
+
+	// Added first to stop last, after the consumer recorded its last outcomes
+	if spans != nil {
+		supervisor.Add("otlp-exporter", common.RestartOnError, spans)
+	}
+	if eventLog != nil {
+		supervisor.Add("event-log", common.RestartOnError, eventLog)
+		features = append(features, "event-log")
+		fmt.Printf("📝 Event log written to %s\n", eventLogCfg.Dir)
 	}
 
-	// Producer: Create sample welcome message tasks
-	fmt.Println("📤 Creating welcome message tasks...")
+	// Startup report, served on /healthz once startup finished
+	health := &startup.Holder{}
 
-	welcomeTasks := []common.WelcomePayload{
-		{UserID: 1, Username: "Alice", Message: "Welcome to our amazing platform!"},
-		{UserID: 2, Username: "Bob", Message: "Thanks for joining our community!"},
-		{UserID: 3, Username: "Charlie", Message: "We're excited to have you here!"},
+	// Round-trip canary: the scheduler enqueues a canary task on its own
+	// queue every 30s, its handler records the task ID as a nonce, and the
+	// verifier alerts when one is not processed within CANARY_MAX_LATENCY
+	// (default 15s). The latency is exported and shown on /healthz.
+	canaryMaxLatency := envDuration("CANARY_MAX_LATENCY")
+	if canaryMaxLatency == 0 {
+		canaryMaxLatency = 15 * time.Second
 	}
+	roundtrip, err := canary.NewRoundtrip(rdb, 30*time.Second, canaryMaxLatency, alert, prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	health.AddCheck("canary", func() interface{} { return roundtrip.Status() })
+	health.AddCheck("circuits", func() interface{} { return breakers.States() })
+
+	// Schedule of PERIODIC_ENTRIES_FILE, shown on the dashboard and run by
+	// the sharded scheduler below
+	shardCfg, err := scheduler.ShardConfigFromEnv()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	// Queue sizes, task durations and failures by error class, and scheduler
+	// runs under the asynq namespace; queue sizes are polled every
+	// METRICS_POLL_INTERVAL (default 15s)
+	exporter := metrics.NewPrometheusExporter(inspector, "asynq")
+	exporter.IsFailure = flags.IsFailure
+	if v := os.Getenv("METRICS_POLL_INTERVAL"); v != "" {
+		if exporter.Interval, err = time.ParseDuration(v); err != nil || exporter.Interval <= 0 {
+			log.Fatalf("❌ Invalid METRICS_POLL_INTERVAL %q", v)
+		}
+	}
+	if err := exporter.Register(prometheus.DefaultRegisterer); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	supervisor.Add("prometheus-exporter", common.RestartOnError, exporter)
+
+	// What this process runs, for the startup report
+	var (
+		queueMap    map[string]int
+		middlewares []string
+		periodic    *scheduler.ObservabilityWrapper
+	)
+
+	// Worker: the mux with its middlewares and handlers, the consumer and
+	// the components and admin API around it
+	if mode.Worker() {
+		// Queues this worker consumes and their priorities, plus the canary
+		// queue the round-trip canary needs
+		queueMap = make(map[string]int, len(cfg.Queues)+1)
+		for q, weight := range cfg.Queues {
+			queueMap[q] = weight
+		}
+		if _, ok := queueMap["canary"]; !ok {
+			queueMap["canary"] = 6
+		}
+		// and the shards claimed by affinity routing
+		if router != nil {
+			for _, q := range router.ClaimedQueues() {
+				queueMap[q] = 3
+			}
+		}
+		// Warn about tasks stranded in queues no longer in the queue map
+		queues.WarnUnconsumed(inspector, queueMap)
+
+		// Create server for processing tasks; queue weights can change at
+		// runtime through /admin/queues/weights, which starts a new server
+		srv := queues.NewDynamicQueues(
+			redisConnOpt,
+			asynq.Config{
+				Concurrency:     maxConcurrency + bumpHeadroom,
+				Queues:          queueMap,
+				ShutdownTimeout: cfg.ShutdownTimeout,
+				// How often scheduled and retry tasks are moved to pending and
+				// the server heartbeat is written; zero keeps asynq's 5s and 15s
+				DelayedTaskCheckInterval: envDuration("ASYNQ_DELAYED_TASK_CHECK_INTERVAL"),
+				HealthCheckInterval:      envDuration("ASYNQ_HEALTH_CHECK_INTERVAL"),
+				// Hand the handler dependencies (clock, ...) to every task
+				BaseContext: func() context.Context {
+					return common.WithDeps(context.Background(), deps)
+				},
+				// Tasks delayed by their feature flag or an open circuit are
+				// tried again later without counting as failed or using up a
+				// retry; a provider's Retry-After stretches the retry delay, and
+				// types with a retry policy back off as it says
+				IsFailure:      flags.IsFailure,
+				RetryDelayFunc: retrysim.RetryDelay(common.RetryDelay),
+			},
+		)
 
-	for i, task := range welcomeTasks {
-		payload, err := json.Marshal(task)
+		// Register task handlers
+		// Control tasks such as the canary skip the middlewares installed with
+		// use; those installed with useAll run for them too
+		mux := common.NewControlMux()
+		use := func(name string, mw asynq.MiddlewareFunc) {
+			mux.Use(mw)
+			middlewares = append(middlewares, name)
+		}
+		useAll := func(name string, mw asynq.MiddlewareFunc) {
+			mux.UseAll(mw)
+			middlewares = append(middlewares, name)
+		}
+		// Effective concurrency, ramped up from 1 after startup to avoid a burst.
+		// Tasks over it park briefly and then go back to the queue, see
+		// concurrency.ErrNoSlot
+		concurrencyLimiter := concurrency.NewLimiter(1)
+		use("concurrency", concurrencyLimiter.Middleware())
+		curve, err := warmup.NewWarmupCurve(1, maxConcurrency, 30*time.Second, warmup.SCurve)
+		if err != nil {
+			log.Fatalf("❌ Invalid warmup curve: %v", err)
+		}
+		supervisor.Add("warmup", common.RestartNever, common.ComponentFunc(func(ctx context.Context) error {
+			return warmup.ApplyWarmup(ctx, concurrencyLimiter, curve)
+		}))
+		// Concurrency recommended from the recorded workload, served on
+		// /admin/advisor and set on the limiter with ADVISOR_APPLY
+		advisorCfg, err := advisor.ConfigFromEnv(maxConcurrency + bumpHeadroom)
 		if err != nil {
-			log.Printf("❌ Failed to marshal welcome task for %s: %v", task.Username, err)
-			continue
+			log.Fatalf("❌ %v", err)
+		}
+		concurrencyAdvisor := advisor.NewAdvisor(advisorCfg)
+		advisorCollector := advisor.RedisCollector(rdb, inspector, 15)
+		supervisor.Add("advisor", common.RestartOnError, common.ComponentFunc(func(ctx context.Context) error {
+			return concurrencyAdvisor.Run(ctx, advisorCollector, concurrencyLimiter)
+		}))
+		if advisorCfg.Apply {
+			features = append(features, "concurrency-advisor")
+			fmt.Printf("🧮 Concurrency advisor applies its recommendations within [%d, %d]\n", advisorCfg.Min, advisorCfg.Max)
 		}
 
-		var info *asynq.TaskInfo
+		// Notify requesters named in the notify_to metadata; it reads the envelope,
+		// so it goes ahead of the unwrapping
+		use("notify", notify.ResultNotificationMiddleware(notify.NotifyConfig{
+			OnSuccess:        true,
+			OnFailure:        true,
+			ChannelExtractor: notify.MetadataChannel,
+			IsFailure:        flags.IsFailure,
+		}, notify.TaskEmailSender{Client: client}, slackClient))
 
-		if i%2 == 0 {
-			// Immediate task
-			info, err = client.Enqueue(asynq.NewTask(common.TypeWelcomeMessage, payload))
-		} else {
-			// Delayed task
-			info, err = client.Enqueue(asynq.NewTask(common.TypeWelcomeMessage, payload), asynq.ProcessIn(time.Duration(i)*300*time.Millisecond))
+		// Runtime figures of the server info task, as Prometheus gauges
+		if err := metrics.RegisterRuntimeMetrics(prometheus.DefaultRegisterer); err != nil {
+			log.Fatalf("❌ %v", err)
 		}
 
+		// Per-type latency percentiles, shared through Redis and exported to Prometheus
+		latency, err := metrics.NewLatencyRecorder(rdb, prometheus.DefaultRegisterer)
 		if err != nil {
-			log.Printf("❌ Failed to enqueue welcome task for %s: %v", task.Username, err)
-			continue
+			log.Fatalf("❌ Failed to create latency recorder: %v", err)
 		}
-		fmt.Printf("✅ Enqueued welcome task for %s (ID: %s)\n", task.Username, info.ID)
-	}
+		supervisor.Add("latency", common.RestartOnError, latency)
+		useAll("latency", latency.Middleware())
+		useAll("prometheus", exporter.Middleware())
+		// Record where each task runs, so tasks of a killed worker can be told apart
+		use("orphans", orphans.Middleware(rdb))
+		// Steps of workflow templates enqueue their dependents as they complete
+		use("workflows", workflow.NewEngine(client, rdb).Middleware())
 
-	// Producer: Create sample email tasks
-	fmt.Println("📤 Creating email tasks...")
+		// Payloads that fail to decode are archived, counted and copied to the
+		// quarantine queue as enqueued; a daily alert reports more than
+		// QUARANTINE_ALERT_THRESHOLD (default 10) of them
+		quarantined, err := quarantine.New(client, rdb, prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		use("quarantine", quarantined.Middleware())
+		quarantineSummary := quarantine.NewSummary(rdb, 10, alert)
+		if v := os.Getenv("QUARANTINE_ALERT_THRESHOLD"); v != "" {
+			if quarantineSummary.Threshold, err = strconv.ParseInt(v, 10, 64); err != nil {
+				log.Fatalf("❌ Invalid QUARANTINE_ALERT_THRESHOLD %q: %v", v, err)
+			}
+		}
+		supervisor.Add("quarantine-summary", common.RestartOnError, quarantineSummary)
 
-	emailTasks := []common.EmailPayload{
-		{UserID: 4, Email: "alice@example.com", Subject: "Welcome!", Message: "Welcome to our platform, Alice!"},
-		{UserID: 5, Email: "bob@example.com", Subject: "Getting Started", Message: "Here are some tips to get you started, Bob."},
-		{UserID: 6, Email: "charlie@example.com", Subject: "Weekly Newsletter", Message: "Check out this week's highlights!"},
+		// Email subjects and bodies render from the embedded template or the
+		// tenant's override, set on /admin/templates; an override that fails
+		// falls back to the default and its owner gets an email, Slack when it
+		// has none
+		templates, err := emailtmpl.New(rdb)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		templates.Alert = func(ctx context.Context, o emailtmpl.Override, text string) error {
+			if o.Owner != "" {
+				return notify.TaskEmailSender{Client: client}.SendEmail(ctx, o.Owner, "Email template of "+o.Tenant+" failed", text)
+			}
+			if alert != nil {
+				return alert(ctx, text)
+			}
+			return nil
+		}
+		deps.Templates = templates
+
+		// Hand tasks their result writer while asynq's is still on the task;
+		// results are kept for TASK_RESULT_TTL
+		resultTTL := envDuration("TASK_RESULT_TTL")
+		if resultTTL <= 0 {
+			resultTTL = common.DefaultResultTTL
+		}
+		use("results", common.ResultWriterMiddleware(rdb, resultTTL))
+		// Unwrap metadata envelopes so later middlewares see the plain payload
+		use("metadata", metadata.Middleware())
+		// Handlers run in a span continuing the producer's trace
+		if tracer != nil {
+			use("tracing", tracing.OTelMiddleware(tracing.TraceContext{}, tracer))
+		}
+		if encryptor != nil {
+			use("decrypt", encryptor.Middleware())
+		}
+		use("validation", validation.ValidationMiddleware(validation.DefaultRegistry()))
+
+		// Payload fields the payload structs do not know, checked for the
+		// SCHEMA_DRIFT_SAMPLE_RATE share of tasks (e.g. 0.01) and listed on
+		// /admin/schema-drift; new ones are alerted hourly
+		var driftDetector *drift.Detector
+		if v := os.Getenv("SCHEMA_DRIFT_SAMPLE_RATE"); v != "" {
+			rate, err := strconv.ParseFloat(v, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				log.Fatalf("❌ Invalid SCHEMA_DRIFT_SAMPLE_RATE %q, want 0 to 1", v)
+			}
+			driftDetector = drift.NewDetector(rdb, rate)
+			use("schema-drift", driftDetector.Middleware())
+			supervisor.Add("schema-drift-summary", common.RestartOnError, drift.NewSummary(driftDetector, alert))
+			features = append(features, "schema-drift")
+		}
+
+		// Per task type feature flags, listed and set on /admin/flags; a delayed
+		// type holds back all its tasks but essential email
+		flagStore := flags.NewStore(rdb, alert)
+		use("flags", flagStore.Middleware(common.IsEssential))
+
+		// Error budgets, ERROR_BUDGETS (email:send=20%/5m by default): a type
+		// failing more is delayed until its error rate stayed within budget for
+		// ERROR_BUDGET_RECOVERY (10m)
+		budgets, err := errorbudget.BudgetsFromEnv()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if len(budgets) > 0 {
+			rates := errorbudget.NewRates(budgets)
+			latency.TrackErrors(rates)
+			controller := errorbudget.NewController(rates, flagStore, budgets)
+			if v := os.Getenv("ERROR_BUDGET_RECOVERY"); v != "" {
+				if controller.Recovery, err = time.ParseDuration(v); err != nil {
+					log.Fatalf("❌ Invalid ERROR_BUDGET_RECOVERY %q: %v", v, err)
+				}
+			}
+			supervisor.Add("error-budget", common.RestartOnError, controller)
+			features = append(features, "error-budget")
+			fmt.Printf("📉 Error budgets: %v\n", budgets)
+		}
+
+		if ledger != nil {
+			use("frequency-caps", ledger.Middleware())
+		}
+		if auditStore != nil {
+			use("audit", auditStore.Middleware())
+		}
+
+		// Per-attempt temp dirs, removed when the attempt ends; stale ones from
+		// crashed processes are swept at startup
+		tempCfg := common.TempDirConfig{Root: filepath.Join(os.TempDir(), "asynqdemo-tasks"), QuotaBytes: 100 << 20}
+		if root := os.Getenv("TASK_TMP_ROOT"); root != "" {
+			tempCfg.Root = root
+		}
+		if n, err := common.SweepTempDirs(tempCfg.Root, 24*time.Hour, deps.Clock); err != nil {
+			log.Printf("⚠️  %v", err)
+		} else if n > 0 {
+			fmt.Printf("🧹 Removed %d stale task temp dirs\n", n)
+		}
+		use("tempdir", common.TempDirMiddleware(tempCfg))
+
+		// Answer redelivered tasks that already committed their result
+		use("exactly-once", common.ExactlyOnce(rdb))
+
+		// Push notifications of concurrent tasks share provider calls of up to
+		// push.MaxBatch tokens, sent after PUSH_BATCH_WAIT (default 50ms) or
+		// before the earliest task deadline, and on shutdown
+		pushWait := envDuration("PUSH_BATCH_WAIT")
+		if pushWait == 0 {
+			pushWait = push.DefaultBatchWait
+		}
+		pusher, err := push.NewHandler(push.LogProvider{}, pushWait, prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		mux.Handle(push.TypeSend, pusher)
+		supervisor.Add("push-batcher", common.RestartNever, pusher)
+
+		// Out-of-process handlers of the task types EXTERNAL_HANDLERS_FILE lists
+		externalSpecs, err := external.SpecsFromEnv()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if len(externalSpecs) > 0 {
+			external.Register(mux, externalSpecs)
+			features = append(features, "external-handlers")
+		}
+
+		// Signed webhooks to WEBHOOK_URL when a queue's pending count crosses its
+		// QUEUE_THRESHOLDS entry, e.g. "critical=50,*=1000". The thresholds are
+		// checked after every periodic server info task; a crossing is notified
+		// once it held for QUEUE_THRESHOLD_HOLD (default 1m).
+		webhook, err := webhooks.DelivererFromEnv()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		thresholds, thresholdHold, err := webhooks.ThresholdsFromEnv()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		var serverInfo asynq.Handler = asynq.HandlerFunc(app.HandleServerInfoTask)
+		if webhook != nil {
+			webhook.Breaker = breakers.Breaker("webhook")
+			mux.Handle(webhooks.TypeDeliver, webhook)
+			if len(thresholds) > 0 {
+				watcher := webhooks.NewWatcher(inspector, rdb, thresholds, func(ctx context.Context, e webhooks.Event) error {
+					t, err := webhooks.NewDeliverTask(e)
+					if err != nil {
+						return err
+					}
+					_, err = client.EnqueueContext(ctx, t)
+					return err
+				})
+				watcher.Hold = thresholdHold
+				serverInfo = watcher.After(serverInfo)
+				features = append(features, "queue-webhooks")
+				fmt.Printf("🪝 Queue thresholds of %d queues reported to %s\n", len(thresholds), webhook.URL)
+			}
+		} else if len(thresholds) > 0 {
+			log.Printf("⚠️  QUEUE_THRESHOLDS is set without WEBHOOK_URL, thresholds are not watched")
+		}
+		app.RegisterHandlers(mux, serverInfo)
+
+		compactor, err := maintenance.NewCompactor(rdb, prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalf("❌ Failed to create compactor: %v", err)
+		}
+		mux.Handle(maintenance.TypeCompact, compactor)
+
+		// Task artifacts such as server info reports, kept on disk or in S3 per
+		// ARTIFACT_STORE and garbage-collected by compaction with their task.
+		// Download URLs of the file store are signed with ARTIFACT_URL_SECRET.
+		var artifactSigner *artifacts.URLSigner
+		blobs, err := artifacts.BlobStoreFromEnv()
+		if err != nil {
+			log.Fatalf("❌ Failed to set up artifact storage: %v", err)
+		}
+		if blobs != nil {
+			deps.Artifacts = artifacts.New(blobs, rdb)
+			compactor.Artifacts = deps.Artifacts
+			features = append(features, "artifacts")
+			if secret := os.Getenv("ARTIFACT_URL_SECRET"); secret != "" {
+				baseURL := os.Getenv("ARTIFACT_BASE_URL")
+				if baseURL == "" {
+					baseURL = "http://" + admin.AddrFromEnv()
+				}
+				if artifactSigner, err = artifacts.NewURLSigner([]byte(secret), baseURL); err != nil {
+					log.Fatalf("❌ Invalid ARTIFACT_URL_SECRET: %v", err)
+				}
+			}
+			fmt.Printf("📦 Task artifacts stored in %s\n", os.Getenv("ARTIFACT_STORE"))
+		}
+		mux.Handle(trash.TypePurge, trash.PurgeHandler(inspector))
+
+		// Hourly preflight of templates, locales and SMTP; failures alert Slack
+		// once per deploy
+		deploy := fleet.LocalInfo(nil).GitSHA
+		if deploy == "" {
+			deploy = time.Now().UTC().Format(time.RFC3339)
+		}
+		mux.Handle(maintenance.TypePreflight, maintenance.NewPreflight(rdb, smtpAddr, deploy, alert))
+
+		// Shorten deadlines by the time tasks waited in the queue
+		if v := os.Getenv("TASK_TIME_BUDGET"); v != "" {
+			budget, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("❌ Invalid TASK_TIME_BUDGET %q: %v", v, err)
+			}
+			use("contextual-timeout", timeout.ContextualTimeoutMiddleware(budget))
+			features = append(features, "contextual-timeout")
+			fmt.Printf("⏳ Tasks get a %v budget from enqueue time\n", budget)
+		}
+
+		// Monthly per-user quotas, e.g. MONTHLY_QUOTAS="1=1000,2=50"
+		if v := os.Getenv("MONTHLY_QUOTAS"); v != "" {
+			limits, err := quota.ParseLimits(v)
+			if err != nil {
+				log.Fatalf("❌ Invalid MONTHLY_QUOTAS: %v", err)
+			}
+			use("quota", quota.QuotaMiddleware(quota.NewMonthlyQuota(rdb, limits)))
+			features = append(features, "monthly-quota")
+			fmt.Printf("📊 Monthly quotas enforced for %d users\n", len(limits))
+		}
+
+		// Publish terminal-state events for task types opted in via the registry
+		var dispatcher *events.Dispatcher
+		if cfg := events.ConfigFromEnv(); cfg.Backend != "" {
+			pub, err := events.NewPublisher(cfg, redisConnOpt)
+			if err != nil {
+				log.Printf("❌ Failed to set up event publisher: %v", err)
+			} else {
+				dispatcher = events.NewDispatcher(pub, 1000)
+				supervisor.Add("events", common.RestartOnError, dispatcher)
+				use("events", events.CompletionHook(dispatcher))
+				features = append(features, "events")
+				fmt.Printf("📣 Publishing task events via %s to %s\n", cfg.Backend, cfg.Subject)
+			}
+		}
+
+		// Task outcomes recorded in the event log
+		if eventLog != nil {
+			use("event-log", eventlog.Hook(eventLog))
+		}
+
+		// Global email throughput limit shared by all workers through Redis
+		if v := os.Getenv("EMAIL_RATE_LIMIT"); v != "" {
+			perSecond, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				log.Fatalf("❌ Invalid EMAIL_RATE_LIMIT %q: %v", v, err)
+			}
+			// Workers sharing the limit before Redis reports their number
+			workers := 1
+			if v := os.Getenv("EMAIL_RATE_WORKERS"); v != "" {
+				if workers, err = strconv.Atoi(v); err != nil {
+					log.Fatalf("❌ Invalid EMAIL_RATE_WORKERS %q: %v", v, err)
+				}
+			}
+			limiter, err := ratelimit.New(rdb, ratelimit.Config{
+				Key:        "ratelimit:email",
+				Rate:       perSecond,
+				Workers:    workers,
+				FailClosed: os.Getenv("EMAIL_RATE_FAIL_CLOSED") == "true",
+			})
+			if err != nil {
+				log.Fatalf("❌ Failed to create email rate limiter: %v", err)
+			}
+			use("ratelimit", ratelimit.Middleware(limiter, common.TypeEmailTask))
+			features = append(features, "email-rate-limit")
+			fmt.Printf("🚦 Email rate limited to %v/s\n", perSecond)
+		}
+
+		// Debug builds hold tasks before their handler while interception is on
+		var interceptor *debug.Interceptor
+		if debug.Enabled {
+			interceptor = debug.NewInterceptor()
+			use("debug", debug.InterceptingMiddleware(interceptor))
+		}
+
+		// Development: handlers rebuilt from plugin sources take over their task types
+		if *hotReload {
+			reloaded := hotreload.NewHandlerRegistry()
+			watcher, err := hotreload.Watch(strings.Split(*hotReloadDirs, ","), reloaded)
+			if err != nil {
+				log.Fatalf("❌ Failed to enable hot reload: %v", err)
+			}
+			defer watcher.Close()
+			use("hot-reload", reloaded.Middleware())
+			fmt.Printf("🔥 Hot reload watching %s\n", *hotReloadDirs)
+		}
+
+		// Progressive delivery of handler versions: the tasks of a type are split
+		// between the variants of HANDLER_VARIANTS_FILE by weight and task ID,
+		// reread every 10s; a variant failing more than the stable one by its
+		// rollback margin is set to weight 0 on every worker
+		if path := os.Getenv("HANDLER_VARIANTS_FILE"); path != "" {
+			variantRouter, err := variants.NewRouter(rdb, variants.File(path), flags.IsFailure, prometheus.DefaultRegisterer)
+			if err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			variantRouter.Alert = alert
+			// New implementations of a handler are registered here, before the
+			// first sync, e.g. variantRouter.Register(common.TypeEmailTask, "v2", handler)
+			if err := variantRouter.Sync(context.Background()); err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			use("variants", variantRouter.Middleware())
+			supervisor.Add("variants", common.RestartOnError, variantRouter)
+			features = append(features, "handler-variants")
+			fmt.Printf("🧪 Handler variants from %s\n", path)
+		}
+
+		// Canary variants of handlers, adjustable through the admin API
+		canaries := canary.NewRegistry()
+
+		// Queue stats shared by the admin API, Prometheus and the HPA metrics,
+		// rescanned at most every QUEUE_STATS_TTL
+		statsTTL, err := queues.StatsTTLFromEnv()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		queueStats := queues.NewStatsCache(inspector, statsTTL)
+		if err := prometheus.DefaultRegisterer.Register(metrics.NewQueueStatsCollector(queueStats)); err != nil {
+			log.Fatalf("❌ Failed to register queue metrics: %v", err)
+		}
+
+		// Queue depth for a Kubernetes HPA, enabled by HPA_METRICS_ADDR
+		if addr := os.Getenv("HPA_METRICS_ADDR"); addr != "" {
+			watched := make([]string, 0, len(queueMap))
+			for q := range queueMap {
+				watched = append(watched, q)
+			}
+			supervisor.Add("hpa-metrics", common.RestartOnError, k8s.NewHPAMetricsServer(queueStats, watched, addr))
+			fmt.Printf("📈 HPA custom metrics listening on %s\n", addr)
+		}
+
+		// Pause the lower-priority queues after IDLE_PAUSE_WINDOW without a
+		// processed task, so idle workers stop polling them; critical stays live
+		// and new work resumes the rest
+		idleWindow, err := queues.IdleWindowFromEnv()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if idleWindow > 0 {
+			supervisor.Add("idle-pause", common.RestartOnError, queues.NewIdlePauser(rdb, inspector, queueMap, idleWindow, latency.LastProcessed))
+			features = append(features, "idle-pause")
+			fmt.Printf("💤 Idle queues paused after %v\n", idleWindow)
+		}
+
+		// Active tasks past their timeout plus ORPHAN_MARGIN (default 5m) are
+		// alerted about; "admin orphans recover" requeues them
+		orphanMargin, err := orphans.MarginFromEnv()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		orphanDetector := orphans.NewDetector(inspector, rdb)
+		orphanDetector.Margin = orphanMargin
+		supervisor.Add("orphans", common.RestartOnError, orphans.NewMonitor(orphanDetector, time.Minute, alert))
+
+		mux.Handle(canary.TypeRoundtrip, roundtrip)
+		supervisor.Add("roundtrip-canary", common.RestartOnError, roundtrip)
+
+		// Admin HTTP API, enabled by ADMIN_ADDR. Operations require a token of
+		// ADMIN_TOKENS_FILE (or ADMIN_TOKEN) with a viewer, operator or admin
+		// role; accesses are logged to the audit store when it is enabled.
+		// Probes, metrics and signed links stay public.
+		if addr := admin.AddrFromEnv(); addr != "" {
+			authz, err := admin.AuthorizerFromEnv(auditStore)
+			if err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			if authz.Tokens() == 0 {
+				log.Printf("⚠️  No admin tokens configured, admin operations refuse every request")
+			}
+			// Per-token limits on the task types, queues, delays and batch
+			// sizes the enqueue endpoints accept, from ENQUEUE_POLICIES_FILE
+			var enqueuePolicies *admin.EnqueuePolicies
+			if path := os.Getenv("ENQUEUE_POLICIES_FILE"); path != "" {
+				if enqueuePolicies, err = admin.NewEnqueuePolicies(path, authz, prometheus.DefaultRegisterer); err != nil {
+					log.Fatalf("❌ %v", err)
+				}
+				enqueuePolicies.Alert = alert
+				supervisor.Add("enqueue-policies", common.RestartOnError, enqueuePolicies)
+				features = append(features, "enqueue-policies")
+			}
+			viewer := func(op string, h http.Handler) http.Handler {
+				return authz.Require(admin.Allow(op, admin.RoleViewer), h)
+			}
+			adminSrv := admin.NewServer(addr)
+			adminSrv.Handle("/healthz", health)
+			adminSrv.Handle("/metrics", promhttp.Handler())
+			adminSrv.Handle("/handlers/", authz.Require(admin.ReadWrite("canary-rate", admin.RoleOperator), canaries))
+			adminSrv.Handle("/admin/i18n/missing", viewer("i18n.missing", i18n.MissingHandler(rdb)))
+			adminSrv.Handle("/admin/fleet", viewer("fleet.read", fleet.Handler(rdb)))
+			adminSrv.Handle("/concurrency/bump", authz.Require(admin.Allow("concurrency.bump", admin.RoleOperator), concurrency.NewConcurrencyBumper(concurrencyLimiter, maxConcurrency+bumpHeadroom)))
+			adminSrv.Handle("/admin/advisor", viewer("advisor.read", advisor.Handler(concurrencyAdvisor, advisorCollector, concurrencyLimiter)))
+			adminSrv.Handle("/admin/latency", viewer("latency.read", metrics.LatencyHandler(rdb)))
+			adminSrv.Handle("/admin/queues", viewer("queues.read", queues.StatsHandler(queueStats)))
+			dashboard := dash.NewHandler(inspector, rdb, queueStats)
+			if shardCfg != nil {
+				dashboard.OneShots, dashboard.OneShotGrace = scheduler.EntriesFile(shardCfg.File), shardCfg.OneShotGrace
+				// Suspensions of the entries and groups of the schedule file
+				suspensions := scheduler.NewSuspensions(rdb, scheduler.EntriesFile(shardCfg.File))
+				adminSrv.Handle("/admin/schedule/", authz.Require(admin.ReadWrite("schedule", admin.RoleOperator), scheduler.Handler(suspensions, client)))
+			}
+			adminSrv.Handle(dash.Prefix, viewer("dash.read", dashboard))
+			adminSrv.Handle("/admin/queues/", authz.Require(queues.ActionPolicy, queues.ActionHandler(inspector, client, rdb)))
+			adminSrv.Handle("/admin/queues/weights", authz.Require(admin.ReadWrite("queues.weights", admin.RoleOperator), queues.WeightsHandler(srv)))
+			adminSrv.Handle("/admin/flags", authz.Require(admin.ReadWrite("flags", admin.RoleOperator), flags.Handler(flagStore, authz)))
+			adminSrv.Handle("/admin/flags/", authz.Require(admin.ReadWrite("flags", admin.RoleOperator), flags.Handler(flagStore, authz)))
+			adminSrv.Handle("/admin/templates/", authz.Require(admin.ReadWrite("templates", admin.RoleOperator), emailtmpl.Handler(templates, authz)))
+			adminSrv.Handle("/admin/results/", viewer("results.read", common.ResultHandler(common.NewResultStore(rdb, inspector))))
+			if driftDetector != nil {
+				adminSrv.Handle("/admin/schema-drift", viewer("schema-drift.read", drift.Handler(driftDetector)))
+			}
+			adminSrv.Handle("/admin/orphans", viewer("orphans.read", orphans.Handler(orphanDetector)))
+			adminSrv.Handle("/admin/test-webhook", authz.Require(admin.Allow("webhook.test", admin.RoleOperator), webhooks.TestHandler(webhook)))
+
+			// Enqueue endpoints, limited to API_ENQUEUE_RATE requests per second
+			enqueueRate := 50.0
+			if v := os.Getenv("API_ENQUEUE_RATE"); v != "" {
+				if enqueueRate, err = strconv.ParseFloat(v, 64); err != nil {
+					log.Fatalf("❌ Invalid API_ENQUEUE_RATE %q: %v", v, err)
+				}
+			}
+			limiter := rate.NewLimiter(rate.Limit(enqueueRate), int(math.Max(1, enqueueRate)))
+			adminSrv.Handle("/api/tasks", api.HTTPRateLimitMiddleware(limiter)(api.EnqueueHandler(client, quiet, ledger, authz, enqueuePolicies, auditStore, inspector, predict.NewDurationPredictor(rdb))))
+			batch := api.NewBatchHandler(client, inspector, quiet, ledger, auditStore)
+			batch.Policies = enqueuePolicies
+			adminSrv.Handle("/tasks/email/batch", api.HTTPRateLimitMiddleware(limiter)(batch))
+			if unsubscribeSigner != nil {
+				adminSrv.Handle("/unsubscribe/", unsubscribe.Handler(unsubscribeSigner, client))
+			}
+			payloadPatch := authz.Require(admin.Allow("tasks.patch", admin.RoleOperator), common.PayloadPatchHandler(inspector, client, common.NewHistory(rdb)))
+			if deps.Artifacts != nil {
+				adminSrv.Handle("/tasks/", artifacts.Handler(deps.Artifacts, inspector, artifactSigner, authz, artifacts.URLTTLFromEnv(), payloadPatch))
+				if artifactSigner != nil {
+					adminSrv.Handle(artifacts.DownloadPath, artifacts.DownloadHandler(deps.Artifacts, artifactSigner))
+				}
+			} else {
+				adminSrv.Handle("/tasks/", payloadPatch)
+			}
+			if interceptor != nil {
+				adminSrv.Handle("/debug/tasks/", authz.Require(admin.ReadWrite("debug.tasks", admin.RoleOperator), debug.Handler(interceptor)))
+				adminSrv.Handle("/debug/intercept", authz.Require(admin.Allow("debug.intercept", admin.RoleAdmin), debug.Handler(interceptor)))
+			}
+			supervisor.Add("admin", common.RestartOnError, adminSrv)
+			fmt.Printf("🛠️  Admin API listening on %s\n", addr)
+		}
+
+		// Advertise this worker's build and capabilities while it runs
+		supervisor.Add("fleet", common.RestartOnError, fleet.NewAnnouncer(rdb, fleet.LocalInfo(features), 30*time.Second))
+
+		// Consumer; it is stopped after the components added later and before
+		// those it depends on, such as the event dispatcher
+		supervisor.Add("consumer", common.RestartNever, common.ComponentFunc(func(ctx context.Context) error {
+			if err := srv.Start(mux); err != nil {
+				return fmt.Errorf("failed to start consumer: %v", err)
+			}
+			fmt.Println("🐰 Consumer started, waiting for tasks...")
+			return srv.Run(ctx)
+		}))
+
+		// Queue counter snapshots for "what changed" reports, and the event log
+		supervisor.Add("audit-snapshots", common.RestartOnError, common.ComponentFunc(func(ctx context.Context) error {
+			snapshotter := audit.NewSnapshotter(inspector, rdb, time.Minute)
+			if eventLog != nil {
+				snapshotter.OnSnapshot = func(snap audit.QueueSnapshot) {
+					eventLog.Write(eventlog.Event{At: snap.At, Kind: eventlog.KindQueue, Queue: snap.Queue, Counts: map[string]int{
+						"backlog": snap.Backlog, "archived": snap.Archived, "processed_total": snap.ProcessedTotal, "failed_total": snap.FailedTotal,
+					}})
+				}
+			}
+			snapshotter.Run(ctx)
+			return nil
+		}))
 	}
 
-	for i, task := range emailTasks {
-		payload, err := json.Marshal(task)
+	// Log goroutine growth sustained over an hour
+	supervisor.Add("leak-sentinel", common.RestartOnError, common.ComponentFunc(func(ctx context.Context) error {
+		leak.NewSentinel(5*time.Minute, time.Hour).Run(ctx)
+		return nil
+	}))
+
+	if mode.Schedules() {
+		// Start scheduler for periodic tasks
+		schedOpts := &asynq.SchedulerOpts{PostEnqueueFunc: func(info *asynq.TaskInfo, err error) {
+			exporter.PostEnqueue(info, err)
+			roundtrip.PostEnqueue(info, err)
+		}}
+		var sched scheduler.Runner = asynq.NewScheduler(redisConnOpt, schedOpts)
+		if *chaosMode {
+			chaosSched, err := chaos.NewChaosScheduler(redisConnOpt, schedOpts, *chaosFailRate, time.Now().UnixNano())
+			if err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			sched = chaosSched
+		}
+		periodic, err = scheduler.NewObservabilityWrapper(sched, prometheus.DefaultRegisterer)
 		if err != nil {
-			log.Printf("❌ Failed to marshal email task for %s: %v", task.Email, err)
-			continue
+			log.Fatalf("❌ Failed to instrument scheduler: %v", err)
 		}
 
-		var info *asynq.TaskInfo
+		// Purge soft-deleted tasks once their grace period (TRASH_TTL, default 24h) is over
+		trashTTL := 24 * time.Hour
+		if v := os.Getenv("TRASH_TTL"); v != "" {
+			if trashTTL, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("❌ Invalid TRASH_TTL %q: %v", v, err)
+			}
+		}
+		app.RegisterPeriodic(periodic, trashTTL)
 
-		if i%2 == 0 {
-			// Immediate task
-			info, err = client.Enqueue(asynq.NewTask(common.TypeEmailTask, payload))
-		} else {
-			// Delayed task
-			info, err = client.Enqueue(asynq.NewTask(common.TypeEmailTask, payload), asynq.ProcessIn(time.Duration(i+1)*500*time.Millisecond))
+		supervisor.Add("scheduler", common.RestartNever, common.ComponentFunc(func(ctx context.Context) error {
+			if err := sched.Start(); err != nil {
+				return fmt.Errorf("failed to start scheduler: %v", err)
+			}
+			<-ctx.Done()
+			sched.Shutdown()
+			return nil
+		}))
+
+		// Per-customer periodic entries of PERIODIC_ENTRIES_FILE, spread over
+		// the scheduler instances by consistent hashing into shards that each
+		// instance claims through a Redis lease
+		if shardCfg != nil {
+			shardCfg.PostEnqueueFunc = exporter.PostEnqueue
+			sharded, err := scheduler.NewShardedScheduler(redisConnOpt, rdb, fleet.LocalInfo(nil).ID, shardCfg)
+			if err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			supervisor.Add("sharded-scheduler", common.RestartOnError, sharded)
+			features = append(features, "sharded-schedule")
+			fmt.Printf("🧩 Sharded schedule from %s: %d shards, preferring %v\n", shardCfg.File, shardCfg.Shards, shardCfg.Preferred)
+
+			// One-shot entries of the same file, enqueued by every instance
+			// under a task ID of their name
+			oneShots := scheduler.NewOneShotLoader(scheduler.EntriesFile(shardCfg.File), client, rdb, shardCfg.SyncInterval)
+			oneShots.Grace = shardCfg.OneShotGrace
+			supervisor.Add("one-shots", common.RestartOnError, oneShots)
 		}
+	}
 
+	// Sample tasks from the demo scenario, only with --demo or DEMO=1; the
+	// produce mode enqueues them once instead
+	if mode == app.ModeAll && demo.Enabled(*demoMode) {
+		scenario, err := demo.Load(*demoFile)
 		if err != nil {
-			log.Printf("❌ Failed to enqueue email task for %s: %v", task.Email, err)
-			continue
+			log.Fatalf("❌ %v", err)
+		}
+		supervisor.Add("demo", common.RestartNever, &demo.Runner{Scenario: scenario, Enqueue: produce, Interval: *demoInterval})
+		features = append(features, "demo")
+	}
+
+	supervisor.Start(context.Background())
+
+	// Report what this worker runs, as JSON with LOG_FORMAT=json
+	report := startup.NewReport(redisConnOpt)
+	report.Mode = string(mode)
+	if mode.Worker() {
+		report.Queues = queueMap
+		report.Concurrency = maxConcurrency
+	}
+	report.Features = features
+	report.Middlewares = middlewares
+	if periodic != nil {
+		report.ScheduleEntries = periodic.Entries()
+	}
+	if path := os.Getenv("AFFINITY_CONFIG"); path != "" {
+		if err := report.AddConfigFile(path); err != nil {
+			log.Printf("⚠️  %v", err)
 		}
-		fmt.Printf("✅ Enqueued email task for %s (ID: %s)\n", task.Email, info.ID)
 	}
+	report.Log(os.Getenv("LOG_FORMAT"))
+	health.Set(report)
 
-	fmt.Println("🎉 All tasks created! Consumer will process them shortly.")
 	fmt.Println("Press Ctrl+C to stop...")
 
 	// Wait for interrupt signal
@@ -198,14 +1256,29 @@ func main() {
 
 	fmt.Println("\n🛑 Shutting down...")
 
-	// Shutdown scheduler
-	scheduler.Shutdown()
+	// Stops the scheduler and the consumer before the admin API, the event
+	// dispatcher and the latency flush
+	if err := supervisor.Shutdown(); err != nil {
+		log.Printf("❌ %v", err)
+	}
 
-	// Shutdown server
-	srv.Shutdown()
+	// Close pooled SMTP connections once no more email can be sent
+	if smtpPool != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := smtpPool.Drain(ctx); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		cancel()
+	}
 
-	// Wait for consumer to finish
-	wg.Wait()
+	// The embedded instance takes its data with it, so show what it held
+	if embedded != nil {
+		if sum, err := embeddedredis.Summarize(inspector); err != nil {
+			log.Printf("⚠️  %v", err)
+		} else {
+			fmt.Printf("📊 Processed with embedded Redis:\n%s\n", sum)
+		}
+	}
 
 	fmt.Println("✅ Shutdown complete")
 }
@@ -0,0 +1,244 @@
+// Package maintenance holds housekeeping tasks for the keys this service keeps
+// next to asynq's own.
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"asynqdemo/artifacts"
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// TypeCompact removes orphaned per-task keys and trims history lists
+const TypeCompact = "maintenance:compact"
+
+// cursorKey stores where each key family's scan stopped, so runs can resume
+const cursorKey = "maintenance:compact:cursor"
+
+// CompactPayload configures one compaction run
+type CompactPayload struct {
+	// BudgetSeconds bounds how long a run may take, 30 when zero
+	BudgetSeconds int `json:"budget_seconds,omitempty"`
+}
+
+// CompactResult is written as the task result
+type CompactResult struct {
+	Removed  map[string]int `json:"removed"`
+	Trimmed  int            `json:"trimmed"`
+	Complete bool           `json:"complete"`
+}
+
+// family is a set of keys matching pattern whose task ID follows marker.
+// Keys hash-tagged with {queue} name the queue owning the task.
+type family struct {
+	name    string
+	pattern string
+	marker  string
+}
+
+var families = []family{
+	{name: "history", pattern: "task:{*}:history:*", marker: "}:history:"},
+	{name: "done", pattern: "task:{*}:done:*", marker: "}:done:"},
+	{name: "artifacts", pattern: artifacts.IndexPrefix + "*", marker: artifacts.IndexPrefix},
+}
+
+// split returns the queue and task ID named by key, the queue being empty
+// for keys without a hash tag
+func (f family) split(key string) (queue, id string) {
+	i := strings.Index(key, f.marker)
+	if i < 0 {
+		return "", key
+	}
+	id = key[i+len(f.marker):]
+	if open := strings.IndexByte(key, '{'); open >= 0 && open < i {
+		queue = key[open+1 : i]
+	}
+	return queue, id
+}
+
+// compactOptions keep compaction off the busy queues and avoid retry storms
+var compactOptions = []asynq.Option{asynq.Queue("low"), asynq.MaxRetry(1)}
+
+func init() {
+	common.RegisterTaskSpec(common.TaskSpec{Type: TypeCompact, NewPayload: func() interface{} { return &CompactPayload{} }, DefaultOptions: compactOptions})
+}
+
+// NewCompactTask creates a compaction task for the low priority queue
+func NewCompactTask(budget time.Duration) (*asynq.Task, error) {
+	payload, err := json.Marshal(CompactPayload{BudgetSeconds: int(budget.Seconds())})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal compact payload: %v", err)
+	}
+	return asynq.NewTask(TypeCompact, payload, compactOptions...), nil
+}
+
+// Compactor handles TypeCompact tasks
+type Compactor struct {
+	rdb redis.UniversalClient
+	// HistoryCap is the number of most recent history entries kept per task
+	HistoryCap int64
+	// KeysPerSecond bounds the rate keys are inspected at
+	KeysPerSecond float64
+	// Artifacts removes the artifacts of tasks whose retention expired; the
+	// artifacts family is skipped when nil
+	Artifacts *artifacts.Store
+
+	reclaimed *prometheus.CounterVec
+}
+
+// NewCompactor creates a compactor and registers its metrics with reg
+func NewCompactor(rdb redis.UniversalClient, reg prometheus.Registerer) (*Compactor, error) {
+	reclaimed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maintenance_compact_reclaimed_keys_total",
+		Help: "Keys removed or trimmed by the compaction task.",
+	}, []string{"family", "action"})
+	if err := reg.Register(reclaimed); err != nil {
+		return nil, fmt.Errorf("failed to register compaction metrics: %v", err)
+	}
+	return &Compactor{rdb: rdb, HistoryCap: 100, KeysPerSecond: 500, reclaimed: reclaimed}, nil
+}
+
+// ProcessTask runs one time-boxed compaction pass
+func (c *Compactor) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	var p CompactPayload
+	if err := json.Unmarshal(t.Payload(), &p); err != nil {
+		return fmt.Errorf("failed to unmarshal compact payload: %v", err)
+	}
+	budget := time.Duration(p.BudgetSeconds) * time.Second
+	if budget <= 0 {
+		budget = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	res, err := c.compact(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🧹 [Compact] removed %v, trimmed %d, complete: %v\n", res.Removed, res.Trimmed, res.Complete)
+	if w := t.ResultWriter(); w != nil {
+		data, err := json.Marshal(res)
+		if err != nil {
+			return fmt.Errorf("failed to marshal compact result: %v", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to write compact result: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *Compactor) compact(ctx context.Context) (*CompactResult, error) {
+	res := &CompactResult{Removed: make(map[string]int), Complete: true}
+	queues, err := c.rdb.SMembers(ctx, "asynq:queues").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues: %v", err)
+	}
+	limiter := rate.NewLimiter(rate.Limit(c.KeysPerSecond), 1)
+
+	for _, f := range families {
+		if f.name == "artifacts" && c.Artifacts == nil {
+			continue
+		}
+		cursor, err := c.rdb.HGet(ctx, cursorKey, f.name).Uint64()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to read %s cursor: %v", f.name, err)
+		}
+		for {
+			keys, next, err := c.rdb.Scan(ctx, cursor, f.pattern, 100).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan %s keys: %v", f.name, err)
+			}
+			for _, key := range keys {
+				if err := limiter.Wait(ctx); err != nil {
+					// Out of budget: the cursor still points at this batch
+					res.Complete = false
+					return res, nil
+				}
+				if err := c.inspect(ctx, f, key, queues, res); err != nil {
+					return nil, err
+				}
+			}
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+			if err := c.rdb.HSet(ctx, cursorKey, f.name, cursor).Err(); err != nil {
+				return nil, fmt.Errorf("failed to save %s cursor: %v", f.name, err)
+			}
+		}
+		if err := c.rdb.HDel(ctx, cursorKey, f.name).Err(); err != nil {
+			return nil, fmt.Errorf("failed to reset %s cursor: %v", f.name, err)
+		}
+	}
+	return res, nil
+}
+
+// inspect removes key if its task no longer exists and trims history lists
+func (c *Compactor) inspect(ctx context.Context, f family, key string, queues []string, res *CompactResult) error {
+	queue, id := f.split(key)
+	if queue != "" {
+		queues = []string{queue}
+	}
+	live, err := c.taskExists(ctx, queues, id)
+	if err != nil {
+		return err
+	}
+	if !live && f.name == "artifacts" {
+		// The blobs go with the index, which DeleteAll removes last
+		if _, err := c.Artifacts.DeleteAll(ctx, id); err != nil {
+			return fmt.Errorf("failed to delete artifacts of task %s: %v", id, err)
+		}
+		res.Removed[f.name]++
+		c.reclaimed.WithLabelValues(f.name, "removed").Inc()
+		return nil
+	}
+	if !live {
+		if err := c.rdb.Del(ctx, key).Err(); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+		res.Removed[f.name]++
+		c.reclaimed.WithLabelValues(f.name, "removed").Inc()
+		return nil
+	}
+	if f.name != "history" {
+		return nil
+	}
+	n, err := c.rdb.LLen(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read length of %s: %v", key, err)
+	}
+	if n > c.HistoryCap {
+		if err := c.rdb.LTrim(ctx, key, -c.HistoryCap, -1).Err(); err != nil {
+			return fmt.Errorf("failed to trim %s: %v", key, err)
+		}
+		res.Trimmed++
+		c.reclaimed.WithLabelValues(f.name, "trimmed").Inc()
+	}
+	return nil
+}
+
+// taskExists reports whether asynq still holds the task in any queue and state
+func (c *Compactor) taskExists(ctx context.Context, queues []string, id string) (bool, error) {
+	if len(queues) == 0 {
+		return false, nil
+	}
+	keys := make([]string, len(queues))
+	for i, q := range queues {
+		keys[i] = fmt.Sprintf("asynq:{%s}:t:%s", q, id)
+	}
+	n, err := c.rdb.Exists(ctx, keys...).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to look up task %s: %v", id, err)
+	}
+	return n > 0, nil
+}
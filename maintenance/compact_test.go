@@ -0,0 +1,153 @@
+package maintenance_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/maintenance"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestCompact plants history lists and processed markers of tasks asynq no
+// longer holds next to those of a live task, and runs time-boxed
+// compaction tasks until one completes. It fails unless a run runs out of
+// budget and the next resumes, every orphan is removed, the live task's
+// keys and asynq's data stay, its history is trimmed to the cap, and the
+// counts are reported as the task result and in the metrics.
+func TestCompact(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	rdb := r.MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(r)
+	defer client.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	ctx := context.Background()
+
+	live, err := client.Enqueue(asynq.NewTask("report:daily", nil), asynq.ProcessIn(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := common.NewHistory(rdb)
+	for i := 0; i < 15; i++ {
+		if err := history.Record(ctx, "default", live.ID, common.HistoryEntry{At: time.Now(), Event: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rdb.Set(ctx, "task:{default}:done:"+live.ID, "{}", time.Hour).Err(); err != nil {
+		t.Fatal(err)
+	}
+	const orphans = 15
+	for i := 0; i < orphans; i++ {
+		id := fmt.Sprintf("gone-%d", i)
+		if err := history.Record(ctx, "default", id, common.HistoryEntry{At: time.Now(), Event: "completed"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rdb.Set(ctx, "task:{default}:done:"+id, "{}", time.Hour).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	compactor, err := maintenance.NewCompactor(rdb, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactor.HistoryCap = 10
+	compactor.KeysPerSecond = 20
+	mux := asynq.NewServeMux()
+	mux.Handle(maintenance.TypeCompact, compactor)
+	worker := asynq.NewServer(r, asynq.Config{Queues: map[string]int{"low": 1}, LogLevel: asynq.FatalLevel})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	removed := map[string]int{}
+	trimmed := 0
+	var results []maintenance.CompactResult
+	for len(results) == 0 || !results[len(results)-1].Complete {
+		if len(results) == 5 {
+			t.Fatalf("compaction did not complete in 5 runs: %+v", results)
+		}
+		task, err := maintenance.NewCompactTask(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := client.Enqueue(task, asynq.Retention(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for info.State != asynq.TaskStateCompleted {
+			if time.Now().After(deadline) {
+				t.Fatalf("compaction task is %v", info.State)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if info, err = inspector.GetTaskInfo("low", info.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var res maintenance.CompactResult
+		if err := json.Unmarshal(info.Result, &res); err != nil {
+			t.Fatalf("result %s: %v", info.Result, err)
+		}
+		results = append(results, res)
+		for f, n := range res.Removed {
+			removed[f] += n
+		}
+		trimmed += res.Trimmed
+	}
+	if len(results) < 2 {
+		t.Errorf("one 1s run at 20 keys/s inspected all %d keys", 2*orphans+2)
+	}
+	if removed["history"] != orphans || removed["done"] != orphans || trimmed != 1 {
+		t.Errorf("removed %v and trimmed %d, want %d per family and the live history", removed, trimmed, orphans)
+	}
+
+	for i := 0; i < orphans; i++ {
+		if n := rdb.Exists(ctx, fmt.Sprintf("task:{default}:done:gone-%d", i)).Val(); n != 0 {
+			t.Errorf("marker of gone-%d left", i)
+		}
+		if entries, _ := history.Entries(ctx, "default", fmt.Sprintf("gone-%d", i)); len(entries) != 0 {
+			t.Errorf("history of gone-%d left", i)
+		}
+	}
+	entries, err := history.Entries(ctx, "default", live.ID)
+	if err != nil || len(entries) != 10 || entries[0].Event != "5" {
+		t.Errorf("live history %+v (%v), want the 10 most recent entries", entries, err)
+	}
+	if rdb.Exists(ctx, "task:{default}:done:"+live.ID).Val() != 1 {
+		t.Error("marker of the live task removed")
+	}
+	if info, err := inspector.GetTaskInfo("default", live.ID); err != nil || info.State != asynq.TaskStateScheduled {
+		t.Errorf("live task %+v (%v)", info, err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := 0.0
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			counted += m.GetCounter().GetValue()
+		}
+	}
+	if counted != 2*orphans+1 {
+		t.Errorf("metrics count %v reclaimed keys, want %d", counted, 2*orphans+1)
+	}
+}
@@ -0,0 +1,190 @@
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/mailer"
+	"asynqdemo/unsubscribe"
+	"asynqdemo/validation"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TypePreflight renders every template with fixture data and checks the
+// assets and services email depends on
+const TypePreflight = "maintenance:preflight"
+
+// PreflightPayload is empty; the checks come from the registered fixtures
+type PreflightPayload struct{}
+
+// CheckResult is the outcome of one preflight check
+type CheckResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// PreflightResult is written as the task result
+type PreflightResult struct {
+	At     time.Time     `json:"at"`
+	OK     bool          `json:"ok"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// Fixture renders one template with known data and fails when the output is
+// broken
+type Fixture struct {
+	Name   string
+	Render func(deps common.Deps) error
+}
+
+var fixtures []Fixture
+
+// RegisterFixture adds a template fixture to the preflight checks
+func RegisterFixture(f Fixture) {
+	fixtures = append(fixtures, f)
+}
+
+var preflightOptions = []asynq.Option{asynq.Queue("low"), asynq.MaxRetry(0)}
+
+func init() {
+	common.RegisterTaskSpec(common.TaskSpec{Type: TypePreflight, NewPayload: func() interface{} { return &PreflightPayload{} }, DefaultOptions: preflightOptions})
+
+	RegisterFixture(Fixture{Name: "email/transactional", Render: func(deps common.Deps) error {
+		return renderEmail(deps, common.EmailPayload{UserID: 1, Email: "preflight@example.com", Subject: "Preflight", Message: "Preflight check"})
+	}})
+	RegisterFixture(Fixture{Name: "email/marketing", Render: func(deps common.Deps) error {
+		return renderEmail(deps, common.EmailPayload{UserID: 1, Email: "preflight@example.com", Subject: "Preflight", Message: "Preflight check", Category: common.CategoryMarketing})
+	}})
+	RegisterFixture(Fixture{Name: "unsubscribe/confirmation", Render: func(deps common.Deps) error {
+		return unsubscribe.RenderConfirmation(io.Discard, "preflight@example.com", common.CategoryMarketing)
+	}})
+}
+
+// renderEmail builds the email of a fixture payload the way the handler does
+func renderEmail(deps common.Deps, p common.EmailPayload) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fixture: %v", err)
+	}
+	if err := validation.DefaultRegistry().Validate(common.TypeEmailTask, payload); err != nil {
+		return err
+	}
+	unsubscribeURL := deps.UnsubscribeURL
+	if unsubscribeURL == nil {
+		// Still exercise the unsubscribe part of the template
+		unsubscribeURL = func(email, category string) string { return "https://example.com/unsubscribe/preflight" }
+	}
+	msg := common.BuildEmail(&p, unsubscribeURL)
+	if msg.To == "" || msg.Subject == "" || msg.Body == "" {
+		return fmt.Errorf("rendered email is missing its recipient, subject or body")
+	}
+	if p.Category == common.CategoryMarketing {
+		if msg.Headers["List-Unsubscribe"] == "" || !strings.Contains(msg.Body, "Unsubscribe:") {
+			return fmt.Errorf("marketing email has no unsubscribe link")
+		}
+	}
+	return nil
+}
+
+// RunPreflight runs the fixtures, the locale check and, when smtpAddr is
+// set, an SMTP greeting
+func RunPreflight(ctx context.Context, deps common.Deps, smtpAddr string) PreflightResult {
+	res := PreflightResult{At: time.Now(), OK: true}
+	add := func(name string, err error) {
+		c := CheckResult{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			res.OK = false
+		}
+		res.Checks = append(res.Checks, c)
+	}
+
+	for _, f := range fixtures {
+		add("template:"+f.Name, f.Render(deps))
+	}
+
+	var localeErr error
+	if gaps := deps.Catalog.Check(); len(gaps) > 0 {
+		missing := make([]string, len(gaps))
+		for i, g := range gaps {
+			missing[i] = g.String()
+		}
+		localeErr = fmt.Errorf("missing translations: %s", strings.Join(missing, "; "))
+	}
+	add("locales", localeErr)
+
+	if smtpAddr != "" {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		add("smtp", mailer.CheckConnectivity(ctx, smtpAddr))
+		cancel()
+	}
+	return res
+}
+
+// NewPreflightTask creates a preflight task for the low priority queue
+func NewPreflightTask() *asynq.Task {
+	return asynq.NewTask(TypePreflight, []byte("{}"), preflightOptions...)
+}
+
+// Preflight handles TypePreflight tasks and alerts about failing checks once
+// per deploy
+type Preflight struct {
+	rdb      redis.UniversalClient
+	smtpAddr string
+	// deploy identifies the running build, so a fix rolled out alerts anew
+	deploy string
+	alert  func(ctx context.Context, text string) error
+}
+
+// NewPreflight creates the handler. alert may be nil to only log failures.
+func NewPreflight(rdb redis.UniversalClient, smtpAddr, deploy string, alert func(ctx context.Context, text string) error) *Preflight {
+	return &Preflight{rdb: rdb, smtpAddr: smtpAddr, deploy: deploy, alert: alert}
+}
+
+// ProcessTask runs the checks. Failing checks are reported, not retried.
+func (p *Preflight) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	res := RunPreflight(ctx, common.DepsFrom(ctx), p.smtpAddr)
+	for _, c := range res.Checks {
+		key := fmt.Sprintf("preflight:alerted:%s:%s", p.deploy, c.Name)
+		if c.OK {
+			// A later regression of the same check alerts again
+			if err := p.rdb.Del(ctx, key).Err(); err != nil {
+				log.Printf("⚠️  Failed to clear preflight alert state: %v", err)
+			}
+			continue
+		}
+		log.Printf("❌ [Preflight] %s: %s", c.Name, c.Error)
+		first, err := p.rdb.SetNX(ctx, key, time.Now().Unix(), 7*24*time.Hour).Result()
+		if err != nil {
+			log.Printf("⚠️  Failed to read preflight alert state: %v", err)
+			continue
+		}
+		if first && p.alert != nil {
+			if err := p.alert(ctx, fmt.Sprintf("Preflight check %s failed: %s", c.Name, c.Error)); err != nil {
+				log.Printf("⚠️  Failed to send preflight alert: %v", err)
+			}
+		}
+	}
+	if res.OK {
+		fmt.Printf("✈️  [Preflight] all %d checks passed\n", len(res.Checks))
+	}
+	if w := t.ResultWriter(); w != nil {
+		data, err := json.Marshal(res)
+		if err != nil {
+			return fmt.Errorf("failed to marshal preflight result: %v", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to write preflight result: %v", err)
+		}
+	}
+	return nil
+}
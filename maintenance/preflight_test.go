@@ -0,0 +1,120 @@
+package maintenance_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/i18n"
+	"asynqdemo/maintenance"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// failed returns the names of the failing checks of res
+func failed(res maintenance.PreflightResult) []string {
+	var names []string
+	for _, c := range res.Checks {
+		if !c.OK {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// TestPreflight breaks a registered template fixture and fails unless the
+// preflight reports it while the built-in fixtures and locales pass, the
+// handler alerts once per deploy for a check that stays broken and again
+// after it recovered, and a missing translation and an unreachable SMTP
+// server fail their checks.
+func TestPreflight(t *testing.T) {
+	var mu sync.Mutex
+	source := "Hello {{.Name}}"
+	maintenance.RegisterFixture(maintenance.Fixture{Name: "test/greeting", Render: func(deps common.Deps) error {
+		mu.Lock()
+		defer mu.Unlock()
+		tmpl, err := template.New("greeting").Parse(source)
+		if err != nil {
+			return err
+		}
+		return tmpl.Execute(io.Discard, map[string]string{"Name": "preflight"})
+	}})
+	setSource := func(s string) {
+		mu.Lock()
+		source = s
+		mu.Unlock()
+	}
+
+	ctx := common.WithDeps(context.Background(), common.DefaultDeps())
+	res := maintenance.RunPreflight(ctx, common.DefaultDeps(), "")
+	if !res.OK || len(failed(res)) != 0 {
+		t.Fatalf("preflight of working templates failed: %+v", res.Checks)
+	}
+	names := map[string]bool{}
+	for _, c := range res.Checks {
+		names[c.Name] = true
+	}
+	for _, want := range []string{"template:email/transactional", "template:email/marketing", "template:unsubscribe/confirmation", "template:test/greeting", "locales"} {
+		if !names[want] {
+			t.Errorf("no %s check in %+v", want, res.Checks)
+		}
+	}
+
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	var alerts []string
+	alert := func(ctx context.Context, text string) error {
+		alerts = append(alerts, text)
+		return nil
+	}
+	handler := maintenance.NewPreflight(rdb, "", "v1", alert)
+	run := func(h *maintenance.Preflight) {
+		t.Helper()
+		if err := h.ProcessTask(ctx, maintenance.NewPreflightTask()); err != nil {
+			t.Fatalf("failing checks failed the task: %v", err)
+		}
+	}
+
+	setSource("Hello {{.Name")
+	res = maintenance.RunPreflight(ctx, common.DefaultDeps(), "")
+	if got := failed(res); res.OK || len(got) != 1 || got[0] != "template:test/greeting" {
+		t.Fatalf("broken fixture gave failures %v", got)
+	}
+	run(handler)
+	run(handler)
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "template:test/greeting") {
+		t.Fatalf("two runs with a broken template alerted %q, want once", alerts)
+	}
+	run(maintenance.NewPreflight(rdb, "", "v2", alert))
+	if len(alerts) != 2 {
+		t.Errorf("a new deploy alerted %d times in all, want 2", len(alerts))
+	}
+	setSource("Hello {{.Name}}")
+	run(handler)
+	setSource("Hello {{.Name")
+	run(handler)
+	if len(alerts) != 3 {
+		t.Errorf("a regression after recovery alerted %d times in all, want 3", len(alerts))
+	}
+	setSource("Hello {{.Name}}")
+
+	res = maintenance.RunPreflight(ctx, common.DefaultDeps(), "127.0.0.1:1")
+	if got := failed(res); len(got) != 1 || got[0] != "smtp" {
+		t.Errorf("unreachable SMTP server gave failures %v", got)
+	}
+	i18n.Use("preflight:test", "preflight.test.missing")
+	res = maintenance.RunPreflight(ctx, common.DefaultDeps(), "")
+	if got := failed(res); len(got) != 1 || got[0] != "locales" {
+		t.Errorf("missing translation gave failures %v", got)
+	}
+}
@@ -0,0 +1,115 @@
+// Package metadata carries string attributes alongside a task payload. asynq
+// tasks only have a type and a payload, so the attributes travel in an
+// envelope around the payload that Middleware removes before the handler runs.
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"asynqdemo/middleware"
+	"asynqdemo/pkg/taskclient"
+	"asynqdemo/quarantine"
+
+	"github.com/hibiken/asynq"
+)
+
+// KeyEnqueuedAt holds the RFC 3339 time the task was created by NewTask
+const KeyEnqueuedAt = taskclient.KeyEnqueuedAt
+
+// Metadata is the set of attributes attached to a task
+type Metadata = taskclient.Metadata
+
+// NewTask creates a task whose JSON payload is wrapped with md. The enqueued_at
+// attribute is stamped with the current time unless md already sets it.
+func NewTask(typeName string, payload []byte, md Metadata, opts ...asynq.Option) (*asynq.Task, error) {
+	return taskclient.NewTask(typeName, payload, md, opts...)
+}
+
+// Wrap puts a JSON payload and its metadata into an envelope as is
+func Wrap(payload []byte, md Metadata) ([]byte, error) {
+	return taskclient.Wrap(payload, md)
+}
+
+// With returns a copy of t with md merged into its metadata. Options given to
+// asynq.NewTask cannot be read back from t, so pass them to Enqueue instead.
+func With(t *asynq.Task, md Metadata) (*asynq.Task, error) {
+	payload, existing := Unwrap(t.Payload())
+	merged := make(Metadata, len(existing)+len(md))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return NewTask(t.Type(), payload, merged)
+}
+
+// Unwrap splits an enveloped payload into the inner payload and its metadata.
+// Payloads without an envelope are returned unchanged with nil metadata.
+func Unwrap(payload []byte) ([]byte, Metadata) {
+	return taskclient.Unwrap(payload)
+}
+
+// FromTask returns the metadata of a task that has not been unwrapped yet
+func FromTask(t *asynq.Task) Metadata {
+	_, md := Unwrap(t.Payload())
+	return md
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns a context carrying md
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// FromContext returns the metadata of the task being processed, or nil
+func FromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// Middleware strips the envelope so handlers see the original payload and
+// exposes the metadata through FromContext. It must be installed before any
+// middleware that reads the payload. The unwrapped task has no ResultWriter.
+func Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			payload, md := Unwrap(t.Payload())
+			if md == nil {
+				if err := malformedEnvelope(t.Payload()); err != nil {
+					return quarantine.ErrDecode{TaskType: t.Type(), Encoding: quarantine.EncodingEnvelope, Err: err}
+				}
+				return next.ProcessTask(ctx, t)
+			}
+			return next.ProcessTask(WithMetadata(ctx, md), asynq.NewTask(t.Type(), payload))
+		})
+	}
+}
+
+// malformedEnvelope explains why a payload Unwrap left alone has envelope
+// fields, nil when it has none
+func malformedEnvelope(payload []byte) error {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(payload, &fields) != nil {
+		return nil
+	}
+	meta, hasMeta := fields["_meta"]
+	_, hasPayload := fields["_payload"]
+	switch {
+	case !hasMeta && !hasPayload:
+		return nil
+	case !hasMeta:
+		return errors.New("envelope without _meta")
+	case !hasPayload:
+		return errors.New("envelope without _payload")
+	}
+	var md Metadata
+	if err := json.Unmarshal(meta, &md); err != nil || md == nil {
+		return fmt.Errorf("envelope _meta is not an object of strings: %s", meta)
+	}
+	return errors.New("malformed envelope")
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// outcomes counts the tasks of one type that ended in one bucket
+type outcomes struct {
+	total  int
+	failed int
+}
+
+// ErrorRates counts task outcomes per type in buckets of a fixed
+// resolution, for error rates over a rolling window. It sees the tasks of
+// this worker only.
+type ErrorRates struct {
+	resolution time.Duration
+	keep       time.Duration
+	isFailure  func(error) bool
+
+	mu      sync.Mutex
+	buckets map[string]map[int64]*outcomes
+}
+
+// NewErrorRates keeps outcomes for rates over windows up to keep, counted
+// in buckets of resolution. Errors for which isFailure reports false, like
+// asynq's Config.IsFailure, do not count; nil counts every error.
+func NewErrorRates(resolution, keep time.Duration, isFailure func(error) bool) *ErrorRates {
+	if isFailure == nil {
+		isFailure = func(error) bool { return true }
+	}
+	return &ErrorRates{
+		resolution: resolution,
+		keep:       keep,
+		isFailure:  isFailure,
+		buckets:    make(map[string]map[int64]*outcomes),
+	}
+}
+
+func (e *ErrorRates) bucket(t time.Time) int64 {
+	return t.UnixNano() / int64(e.resolution)
+}
+
+// Record counts a task that ended at with err
+func (e *ErrorRates) Record(taskType string, err error, at time.Time) {
+	if err != nil && !e.isFailure(err) {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	byBucket, ok := e.buckets[taskType]
+	if !ok {
+		byBucket = make(map[int64]*outcomes)
+		e.buckets[taskType] = byBucket
+	}
+	b := e.bucket(at)
+	o, ok := byBucket[b]
+	if !ok {
+		o = &outcomes{}
+		byBucket[b] = o
+		// A new bucket is the time to drop those past keep
+		oldest := e.bucket(at.Add(-e.keep))
+		for k := range byBucket {
+			if k < oldest {
+				delete(byBucket, k)
+			}
+		}
+	}
+	o.total++
+	if err != nil {
+		o.failed++
+	}
+}
+
+// Rate returns the share of failed tasks of taskType within window before
+// now, and how many tasks that share is based on
+func (e *ErrorRates) Rate(taskType string, window time.Duration, now time.Time) (rate float64, samples int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	from, to := e.bucket(now.Add(-window)), e.bucket(now)
+	var failed int
+	for b, o := range e.buckets[taskType] {
+		if b > from && b <= to {
+			samples += o.total
+			failed += o.failed
+		}
+	}
+	if samples == 0 {
+		return 0, 0
+	}
+	return float64(failed) / float64(samples), samples
+}
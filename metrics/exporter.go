@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultExportInterval is how often a PrometheusExporter polls queue sizes
+const DefaultExportInterval = 15 * time.Second
+
+// Error classes of the failures counted by a PrometheusExporter
+const (
+	ClassPermanent  = "permanent"
+	ClassTimeout    = "timeout"
+	ClassCanceled   = "canceled"
+	ClassRetryAfter = "retry_after"
+	ClassError      = "error"
+)
+
+// ErrorClass sorts a handler error for the failure counter: permanent
+// (asynq.SkipRetry), timeout, canceled, retry_after (the provider asked to
+// wait) or error
+func ErrorClass(err error) string {
+	var ra circuit.ErrRetryAfter
+	switch {
+	case errors.Is(err, asynq.SkipRetry):
+		return ClassPermanent
+	case errors.Is(err, context.DeadlineExceeded):
+		return ClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	case errors.As(err, &ra):
+		return ClassRetryAfter
+	}
+	return ClassError
+}
+
+// PrometheusExporter exports the queue sizes it polls from the inspector,
+// and the task durations, failures and scheduler runs its hooks observe,
+// under one namespace. Queue sizes are polled every Interval by Run rather
+// than on scrape, so scrapes never wait for Redis.
+type PrometheusExporter struct {
+	inspector *asynq.Inspector
+	// Interval is how often Run polls the inspector
+	Interval time.Duration
+	// IsFailure tells failures from errors that are not, such as delays;
+	// nil counts every error
+	IsFailure func(error) bool
+
+	queueSize *prometheus.Desc
+	durations *prometheus.HistogramVec
+	failures  *prometheus.CounterVec
+	runs      *prometheus.CounterVec
+
+	mu     sync.Mutex
+	sizes  []queueSize
+	polled time.Time
+}
+
+type queueSize struct {
+	queue, state string
+	n            int
+}
+
+// NewPrometheusExporter creates an exporter of the queues of inspector,
+// naming its metrics namespace_queue_size and so on
+func NewPrometheusExporter(inspector *asynq.Inspector, namespace string) *PrometheusExporter {
+	return &PrometheusExporter{
+		inspector: inspector,
+		Interval:  DefaultExportInterval,
+		queueSize: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "queue_size"), "Number of tasks in a queue by state, as last polled.", []string{"queue", "state"}, nil),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "task_duration_seconds",
+			Help:      "Time handlers took to process tasks.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"task_type"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_failures_total",
+			Help:      "Tasks whose handler failed, by error class.",
+		}, []string{"task_type", "error_class"}),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scheduler_runs_total",
+			Help:      "Periodic tasks the scheduler enqueued or failed to enqueue.",
+		}, []string{"result"}),
+	}
+}
+
+// Register registers the exporter with reg
+func (e *PrometheusExporter) Register(reg prometheus.Registerer) error {
+	if err := reg.Register(e); err != nil {
+		return fmt.Errorf("failed to register Prometheus exporter: %v", err)
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector
+func (e *PrometheusExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.queueSize
+	e.durations.Describe(ch)
+	e.failures.Describe(ch)
+	e.runs.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (e *PrometheusExporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	for _, s := range e.sizes {
+		ch <- prometheus.MustNewConstMetric(e.queueSize, prometheus.GaugeValue, float64(s.n), s.queue, s.state)
+	}
+	e.mu.Unlock()
+	e.durations.Collect(ch)
+	e.failures.Collect(ch)
+	e.runs.Collect(ch)
+}
+
+// Poll reads the size of every queue by state
+func (e *PrometheusExporter) Poll() error {
+	names, err := e.inspector.Queues()
+	if err != nil {
+		return fmt.Errorf("failed to list queues: %v", err)
+	}
+	sizes := make([]queueSize, 0, len(names)*6)
+	for _, q := range names {
+		info, err := e.inspector.GetQueueInfo(q)
+		if err != nil {
+			return fmt.Errorf("failed to read queue %s: %v", q, err)
+		}
+		sizes = append(sizes,
+			queueSize{q, "pending", info.Pending},
+			queueSize{q, "active", info.Active},
+			queueSize{q, "scheduled", info.Scheduled},
+			queueSize{q, "retry", info.Retry},
+			queueSize{q, "archived", info.Archived},
+			queueSize{q, "completed", info.Completed},
+		)
+	}
+	e.mu.Lock()
+	e.sizes, e.polled = sizes, time.Now()
+	e.mu.Unlock()
+	return nil
+}
+
+// Run polls at once and then every Interval until ctx is done. A failed
+// poll keeps the sizes of the last one.
+func (e *PrometheusExporter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		if err := e.Poll(); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Middleware times every task by type and counts its failures by class
+func (e *PrometheusExporter) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			start := time.Now()
+			err := next.ProcessTask(ctx, t)
+			e.durations.WithLabelValues(t.Type()).Observe(time.Since(start).Seconds())
+			if err != nil && (e.IsFailure == nil || e.IsFailure(err)) {
+				e.failures.WithLabelValues(t.Type(), ErrorClass(err)).Inc()
+			}
+			return err
+		})
+	}
+}
+
+// PostEnqueue counts a scheduler run; chain it into the PostEnqueueFunc
+// of the scheduler
+func (e *PrometheusExporter) PostEnqueue(info *asynq.TaskInfo, err error) {
+	result := "enqueued"
+	if err != nil {
+		result = "failed"
+	}
+	e.runs.WithLabelValues(result).Inc()
+}
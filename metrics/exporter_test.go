@@ -0,0 +1,146 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/flags"
+	"asynqdemo/metrics"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestPrometheusExporter fails unless the exporter registered with a
+// registry reports the queue sizes of its last poll of an embedded Redis,
+// times tasks by type through its middleware, counts their failures by
+// error class leaving delays out, and counts scheduler runs by result.
+func TestPrometheusExporter(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	reg := prometheus.NewRegistry()
+	exporter := metrics.NewPrometheusExporter(inspector, "asynq")
+	exporter.IsFailure = flags.IsFailure
+	if err := exporter.Register(reg); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Enqueue(asynq.NewTask("email:send", nil), asynq.Queue("email")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Enqueue(asynq.NewTask("report:render", nil), asynq.Queue("reports"), asynq.ProcessIn(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	// Sizes are those of the poll, not of the scrape
+	if _, err := client.Enqueue(asynq.NewTask("email:send", nil), asynq.Queue("email")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Handlers of two types, failing in each class
+	failures := map[string]error{
+		"ok":          nil,
+		"permanent":   fmt.Errorf("failed to send email: %w", asynq.SkipRetry),
+		"timeout":     fmt.Errorf("email:send task timed out after 1s: %w", context.DeadlineExceeded),
+		"retry_after": circuit.ErrRetryAfter{Err: errors.New("SendGrid returned 429"), After: time.Minute},
+		"error":       errors.New("smtp down"),
+		"delayed":     flags.ErrDelayed{TaskType: "email:send", Delay: time.Minute},
+	}
+	mw := exporter.Middleware()
+	for _, name := range []string{"ok", "permanent", "timeout", "retry_after", "error", "delayed", "ok"} {
+		want := failures[name]
+		h := mw(asynq.HandlerFunc(func(ctx context.Context, _ *asynq.Task) error {
+			time.Sleep(10 * time.Millisecond)
+			return want
+		}))
+		if err := h.ProcessTask(context.Background(), asynq.NewTask("email:send", nil)); err != want {
+			t.Errorf("middleware changed %v into %v", want, err)
+		}
+	}
+	if err := mw(asynq.HandlerFunc(func(context.Context, *asynq.Task) error { return nil })).ProcessTask(context.Background(), asynq.NewTask("report:render", nil)); err != nil {
+		t.Fatal(err)
+	}
+	exporter.PostEnqueue(&asynq.TaskInfo{ID: "a"}, nil)
+	exporter.PostEnqueue(&asynq.TaskInfo{ID: "b"}, nil)
+	exporter.PostEnqueue(nil, errors.New("redis down"))
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	var slowest float64
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := make([]string, 0, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			var value string
+			switch {
+			case m.GetGauge() != nil:
+				value = fmt.Sprint(m.GetGauge().GetValue())
+			case m.GetCounter() != nil:
+				value = fmt.Sprint(m.GetCounter().GetValue())
+			case m.GetHistogram() != nil:
+				value = fmt.Sprint(m.GetHistogram().GetSampleCount())
+				if strings.Contains(strings.Join(labels, ","), "email:send") {
+					slowest = m.GetHistogram().GetSampleSum()
+				}
+			}
+			if value == "0" {
+				continue
+			}
+			got[f.GetName()] = append(got[f.GetName()], strings.Join(labels, ",")+" "+value)
+		}
+	}
+	for name := range got {
+		sort.Strings(got[name])
+	}
+	want := map[string][]string{
+		"asynq_queue_size": {
+			"queue=email,state=pending 3",
+			"queue=reports,state=scheduled 1",
+		},
+		"asynq_task_duration_seconds": {
+			"task_type=email:send 7",
+			"task_type=report:render 1",
+		},
+		"asynq_task_failures_total": {
+			"error_class=error,task_type=email:send 1",
+			"error_class=permanent,task_type=email:send 1",
+			"error_class=retry_after,task_type=email:send 1",
+			"error_class=timeout,task_type=email:send 1",
+		},
+		"asynq_scheduler_runs_total": {
+			"result=enqueued 2",
+			"result=failed 1",
+		},
+	}
+	for name, series := range want {
+		if fmt.Sprint(got[name]) != fmt.Sprint(series) {
+			t.Errorf("%s:\n%s\nwant\n%s", name, strings.Join(got[name], "\n"), strings.Join(series, "\n"))
+		}
+	}
+	if slowest < 0.07 {
+		t.Errorf("email:send durations sum to %vs, want at least 70ms", slowest)
+	}
+}
@@ -0,0 +1,362 @@
+// Package metrics instruments task processing.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// Latencies are counted in logarithmic buckets growing by bucketGrowth, so an
+// estimate is within 5% of the true value at any scale
+const bucketGrowth = 1.1
+
+// Windows are hourly and kept for a day, so a query sums the last 24 windows
+const (
+	window     = time.Hour
+	windows    = 24
+	typesKey   = "latency:types"
+	flushEvery = time.Minute
+)
+
+// Throughput is counted per minute in hourly hashes kept for two hours
+const (
+	throughputResolution = time.Minute
+	throughputKeep       = 2 * time.Hour
+)
+
+// maxScript raises the max field of a window when the given value exceeds it
+var maxScript = redis.NewScript(`
+local cur = tonumber(redis.call("HGET", KEYS[1], "max") or "0")
+if tonumber(ARGV[1]) > cur then
+  redis.call("HSET", KEYS[1], "max", ARGV[1])
+end
+return 1
+`)
+
+func bucketOf(d time.Duration) int {
+	ms := float64(d) / float64(time.Millisecond)
+	if ms <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log(ms) / math.Log(bucketGrowth)))
+}
+
+// bucketValue is the geometric middle of a bucket in milliseconds
+func bucketValue(b int) float64 {
+	if b == 0 {
+		return 1
+	}
+	return math.Pow(bucketGrowth, float64(b)-0.5)
+}
+
+func windowKey(taskType string, t time.Time) string {
+	return fmt.Sprintf("latency:%s:%d", taskType, t.Truncate(window).Unix())
+}
+
+type accumulator struct {
+	buckets map[int]int64
+	maxUs   int64
+	// perMinute counts the tasks by the Unix time of their minute
+	perMinute map[int64]int64
+}
+
+func throughputKey(taskType string, t time.Time) string {
+	return fmt.Sprintf("throughput:%s:%d", taskType, t.Truncate(window).Unix())
+}
+
+// LatencyRecorder accumulates processing latencies per task type and adds
+// them to the shared Redis windows every minute
+type LatencyRecorder struct {
+	rdb  redis.UniversalClient
+	hist *prometheus.HistogramVec
+
+	mu      sync.Mutex
+	pending map[string]*accumulator
+	// last is when a task was last processed, in Unix nanoseconds
+	last atomic.Int64
+
+	errors *ErrorRates
+}
+
+// NewLatencyRecorder creates a recorder and registers its histogram with reg
+func NewLatencyRecorder(rdb redis.UniversalClient, reg prometheus.Registerer) (*LatencyRecorder, error) {
+	hist := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "task_processing_duration_seconds",
+		Help:    "Time spent processing tasks.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"task_type"})
+	if err := reg.Register(hist); err != nil {
+		return nil, fmt.Errorf("failed to register latency histogram: %v", err)
+	}
+	return &LatencyRecorder{
+		rdb:     rdb,
+		hist:    hist,
+		pending: make(map[string]*accumulator),
+	}, nil
+}
+
+// Observe records one processing duration
+func (r *LatencyRecorder) Observe(taskType string, d time.Duration) {
+	r.last.Store(time.Now().UnixNano())
+	r.hist.WithLabelValues(taskType).Observe(d.Seconds())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	acc, ok := r.pending[taskType]
+	if !ok {
+		acc = &accumulator{buckets: make(map[int]int64), perMinute: make(map[int64]int64)}
+		r.pending[taskType] = acc
+	}
+	acc.buckets[bucketOf(d)]++
+	acc.perMinute[time.Now().Truncate(throughputResolution).Unix()]++
+	if us := d.Microseconds(); us > acc.maxUs {
+		acc.maxUs = us
+	}
+}
+
+// LastProcessed returns when a task was last processed, zero before the first
+func (r *LatencyRecorder) LastProcessed() time.Time {
+	if ns := r.last.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// TrackErrors makes the middleware count task outcomes in e; call it
+// before the server starts
+func (r *LatencyRecorder) TrackErrors(e *ErrorRates) {
+	r.errors = e
+}
+
+// Middleware times every task, and counts its outcome when errors are
+// tracked
+func (r *LatencyRecorder) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			start := time.Now()
+			err := next.ProcessTask(ctx, t)
+			r.Observe(t.Type(), time.Since(start))
+			if r.errors != nil {
+				r.errors.Record(t.Type(), err, time.Now())
+			}
+			return err
+		})
+	}
+}
+
+// Run flushes to Redis every minute until ctx is done, then flushes what is
+// left
+func (r *LatencyRecorder) Run(ctx context.Context) error {
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.Flush(context.Background()); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+			return nil
+		case <-ticker.C:
+			if err := r.Flush(ctx); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+		}
+	}
+}
+
+// Flush adds the accumulated latencies to the current window
+func (r *LatencyRecorder) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*accumulator)
+	r.mu.Unlock()
+
+	now := time.Now()
+	for taskType, acc := range pending {
+		key := windowKey(taskType, now)
+		pipe := r.rdb.TxPipeline()
+		for b, n := range acc.buckets {
+			pipe.HIncrBy(ctx, key, strconv.Itoa(b), n)
+		}
+		pipe.Expire(ctx, key, (windows+1)*window)
+		for minute, n := range acc.perMinute {
+			tkey := throughputKey(taskType, time.Unix(minute, 0))
+			pipe.HIncrBy(ctx, tkey, strconv.FormatInt(minute, 10), n)
+			pipe.Expire(ctx, tkey, throughputKeep)
+		}
+		pipe.SAdd(ctx, typesKey, taskType)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("failed to flush latencies of %s: %v", taskType, err)
+		}
+		if err := maxScript.Run(ctx, r.rdb, []string{key}, acc.maxUs).Err(); err != nil {
+			return fmt.Errorf("failed to flush max latency of %s: %v", taskType, err)
+		}
+	}
+	return nil
+}
+
+// LatencySummary holds a task type's latency percentiles over the last 24h
+type LatencySummary struct {
+	TaskType string  `json:"task_type"`
+	Count    int64   `json:"count"`
+	P50Ms    float64 `json:"p50_ms"`
+	P90Ms    float64 `json:"p90_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+	MaxMs    float64 `json:"max_ms"`
+}
+
+// Summaries merges the windows of the last 24h written by all workers
+func Summaries(ctx context.Context, rdb redis.UniversalClient) ([]LatencySummary, error) {
+	types, err := TaskTypes(ctx, rdb)
+	if err != nil {
+		return nil, err
+	}
+	var out []LatencySummary
+	for _, taskType := range types {
+		s, ok, err := Summary(ctx, rdb, taskType)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// Summary merges the windows of the last 24h of one task type. It reports
+// false when no latency of the type was recorded.
+func Summary(ctx context.Context, rdb redis.UniversalClient, taskType string) (LatencySummary, bool, error) {
+	now := time.Now()
+	buckets := make(map[int]int64)
+	var maxMs float64
+	for i := 0; i < windows; i++ {
+		fields, err := rdb.HGetAll(ctx, windowKey(taskType, now.Add(-time.Duration(i)*window))).Result()
+		if err != nil {
+			return LatencySummary{}, false, fmt.Errorf("failed to read latencies of %s: %v", taskType, err)
+		}
+		for f, v := range fields {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			if f == "max" {
+				// Stored in microseconds
+				maxMs = math.Max(maxMs, float64(n)/1000)
+				continue
+			}
+			b, err := strconv.Atoi(f)
+			if err != nil {
+				continue
+			}
+			buckets[b] += n
+		}
+	}
+	s, ok := summarize(taskType, buckets, maxMs)
+	return s, ok, nil
+}
+
+func summarize(taskType string, buckets map[int]int64, maxMs float64) (LatencySummary, bool) {
+	idx := make([]int, 0, len(buckets))
+	var total int64
+	for b, n := range buckets {
+		idx = append(idx, b)
+		total += n
+	}
+	if total == 0 {
+		return LatencySummary{}, false
+	}
+	sort.Ints(idx)
+	quantile := func(q float64) float64 {
+		rank := int64(math.Ceil(q * float64(total)))
+		var seen int64
+		for _, b := range idx {
+			seen += buckets[b]
+			if seen >= rank {
+				return math.Min(bucketValue(b), maxMs)
+			}
+		}
+		return maxMs
+	}
+	return LatencySummary{
+		TaskType: taskType,
+		Count:    total,
+		P50Ms:    quantile(0.5),
+		P90Ms:    quantile(0.9),
+		P99Ms:    quantile(0.99),
+		MaxMs:    maxMs,
+	}, true
+}
+
+// Point is a value at a time, for charts; T is in Unix milliseconds
+type Point struct {
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+// TaskTypes lists every task type whose latency was recorded
+func TaskTypes(ctx context.Context, rdb redis.UniversalClient) ([]string, error) {
+	types, err := rdb.SMembers(ctx, typesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list task types: %v", err)
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// Throughput returns how many tasks of taskType all workers processed in
+// each of the n minutes up to now, oldest first, with zeros for idle
+// minutes. Counts reach Redis with the minutely flush, so the current
+// minute is incomplete.
+func Throughput(ctx context.Context, rdb redis.UniversalClient, taskType string, n int, now time.Time) ([]Point, error) {
+	last := now.Truncate(throughputResolution)
+	first := last.Add(-time.Duration(n-1) * throughputResolution)
+	counts := make(map[int64]float64)
+	for h := first.Truncate(window); !h.After(last); h = h.Add(window) {
+		fields, err := rdb.HGetAll(ctx, throughputKey(taskType, h)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read throughput of %s: %v", taskType, err)
+		}
+		for f, v := range fields {
+			minute, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				continue
+			}
+			c, _ := strconv.ParseFloat(v, 64)
+			counts[minute] += c
+		}
+	}
+	points := make([]Point, 0, n)
+	for m := first; !m.After(last); m = m.Add(throughputResolution) {
+		points = append(points, Point{T: m.UnixMilli(), V: counts[m.Unix()]})
+	}
+	return points, nil
+}
+
+// LatencyHandler serves GET /admin/latency
+func LatencyHandler(rdb redis.UniversalClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		summaries, err := Summaries(r.Context(), rdb)
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, summaries)
+	})
+}
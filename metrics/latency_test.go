@@ -0,0 +1,88 @@
+package metrics_test
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// within reports whether got is within 5% of want
+func within(got, want float64) bool {
+	return math.Abs(got-want) <= want*0.05
+}
+
+// TestLatencyPercentiles feeds two workers the halves of a uniform
+// distribution from 1ms to 1s and a fixed 40ms one, and fails unless the
+// merged percentiles served by GET /admin/latency are within 5% of the true
+// ones, the max is exact, and the windows roll off after a day.
+func TestLatencyPercentiles(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+
+	var workers []*metrics.LatencyRecorder
+	for i := 0; i < 2; i++ {
+		r, err := metrics.NewLatencyRecorder(rdb, prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		workers = append(workers, r)
+	}
+	for ms := 1; ms <= 1000; ms++ {
+		workers[ms%2].Observe("report", time.Duration(ms)*time.Millisecond)
+		workers[ms%2].Observe("email", 40*time.Millisecond)
+	}
+	for _, w := range workers {
+		if err := w.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api := httptest.NewServer(metrics.LatencyHandler(rdb))
+	defer api.Close()
+	resp, err := http.Get(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summaries []metrics.LatencySummary
+	err = json.NewDecoder(resp.Body).Decode(&summaries)
+	resp.Body.Close()
+	if err != nil || len(summaries) != 2 {
+		t.Fatalf("got %+v (%v), want email and report", summaries, err)
+	}
+	email, report := summaries[0], summaries[1]
+	if email.TaskType != "email" || email.Count != 1000 || !within(email.P50Ms, 40) || !within(email.P99Ms, 40) || email.MaxMs != 40 {
+		t.Errorf("email %+v, want every percentile at 40ms", email)
+	}
+	if report.TaskType != "report" || report.Count != 1000 || report.MaxMs != 1000 {
+		t.Errorf("report %+v, want 1000 tasks up to 1000ms", report)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{{"p50", report.P50Ms, 500}, {"p90", report.P90Ms, 900}, {"p99", report.P99Ms, 990}} {
+		if !within(c.got, c.want) {
+			t.Errorf("report %s %.1fms, want %.0fms within 5%%", c.name, c.got, c.want)
+		}
+	}
+
+	srv.FastForward(25 * time.Hour)
+	if s, ok, err := metrics.Summary(ctx, rdb, "report"); err != nil || ok {
+		t.Errorf("latencies of a day ago still summarized: %+v (%v)", s, err)
+	}
+}
@@ -0,0 +1,60 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metrics"
+	"asynqdemo/queues"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestQueueStatsCollector fails unless scrapes export the queue sizes of
+// the shared stats cache and cost no scan of their own while it is fresh
+func TestQueueStatsCollector(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := client.Enqueue(asynq.NewTask("stats:test", nil), asynq.Queue("critical")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	cache := queues.NewStatsCache(inspector, time.Hour)
+	if _, err := cache.Get(false); err != nil {
+		t.Fatal(err)
+	}
+
+	c := metrics.NewQueueStatsCollector(cache)
+	want := `
+# HELP asynq_queue_paused Whether a queue is paused.
+# TYPE asynq_queue_paused gauge
+asynq_queue_paused{queue="critical"} 0
+# HELP asynq_queue_tasks Number of tasks in a queue by state.
+# TYPE asynq_queue_tasks gauge
+asynq_queue_tasks{queue="critical",state="active"} 0
+asynq_queue_tasks{queue="critical",state="archived"} 0
+asynq_queue_tasks{queue="critical",state="completed"} 0
+asynq_queue_tasks{queue="critical",state="pending"} 2
+asynq_queue_tasks{queue="critical",state="retry"} 0
+asynq_queue_tasks{queue="critical",state="scheduled"} 0
+`
+	for i := 0; i < 2; i++ {
+		if err := testutil.CollectAndCompare(c, strings.NewReader(want), "asynq_queue_tasks", "asynq_queue_paused"); err != nil {
+			t.Error(err)
+		}
+	}
+	if n := cache.Scans(); n != 1 {
+		t.Errorf("two scrapes of a fresh cache ran %d scans in all, want 1", n)
+	}
+}
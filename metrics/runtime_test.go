@@ -0,0 +1,73 @@
+package metrics_test
+
+import (
+	"runtime"
+	"testing"
+
+	"asynqdemo/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gcCount returns the sample count of go_gc_duration_seconds in reg
+func gcCount(t *testing.T, reg *prometheus.Registry) uint64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "go_gc_duration_seconds" {
+			return f.GetMetric()[0].GetSummary().GetSampleCount()
+		}
+	}
+	t.Fatal("go_gc_duration_seconds not gathered")
+	return 0
+}
+
+// TestRuntimeMetrics registers the collector in place of the client
+// library's Go collector and fails unless go_goroutines matches
+// runtime.NumGoroutine, a GC shows up in go_gc_duration_seconds, and the
+// memory gauges are exported
+func TestRuntimeMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector())
+	if err := metrics.RegisterRuntimeMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Collect in this goroutine, as a gatherer's own goroutines would count
+	c := metrics.NewRuntimeMetricsCollector()
+	ch := make(chan prometheus.Metric, 5)
+	want := runtime.NumGoroutine()
+	c.Collect(ch)
+	close(ch)
+	var m dto.Metric
+	if err := (<-ch).Write(&m); err != nil || m.GetGauge().GetValue() != float64(want) {
+		t.Errorf("go_goroutines %v (%v), want %d", m.GetGauge().GetValue(), err, want)
+	}
+
+	before := gcCount(t, reg)
+	runtime.GC()
+	runtime.GC()
+	if after := gcCount(t, reg); after < before+2 {
+		t.Errorf("GC count went from %d to %d after two collections", before, after)
+	}
+	for _, name := range []string{"go_memstats_alloc_bytes", "go_memstats_heap_objects", "go_memstats_sys_bytes"} {
+		if n := testutil.CollectAndCount(c, name); n != 1 {
+			t.Errorf("%d %s metrics, want 1", n, name)
+		}
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "go_memstats_sys_bytes" && f.GetMetric()[0].GetGauge().GetValue() <= 0 {
+			t.Errorf("go_memstats_sys_bytes is %v", f.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+}
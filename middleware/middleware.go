@@ -0,0 +1,8 @@
+// Package middleware holds the types shared by the task handler middlewares.
+package middleware
+
+import "github.com/hibiken/asynq"
+
+// HandlerMiddleware wraps a task handler; it is asynq's MiddlewareFunc so
+// middlewares can be passed straight to ServeMux.Use
+type HandlerMiddleware = asynq.MiddlewareFunc
@@ -0,0 +1,174 @@
+// Package notify tells requesters when their long-running tasks finish.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/metadata"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+)
+
+// KeyNotifyTo is the task metadata attribute naming the channel to notify,
+// written as "email:user@example.com" or "slack:#reports"
+const KeyNotifyTo = "notify_to"
+
+// Channel types
+const (
+	ChannelEmail = "email"
+	ChannelSlack = "slack"
+)
+
+// NotifyChannel is where a notification goes; the zero value means nowhere
+type NotifyChannel struct {
+	Type    string
+	Address string
+}
+
+// NotifyConfig selects which outcomes are notified and where
+type NotifyConfig struct {
+	OnSuccess        bool
+	OnFailure        bool
+	ChannelExtractor func(*asynq.Task) NotifyChannel
+	// IsFailure is the server's Config.IsFailure; errors it does not count
+	// as failures are never notified. Nil counts every error.
+	IsFailure func(error) bool
+}
+
+// EmailSender delivers notification emails
+type EmailSender interface {
+	SendEmail(ctx context.Context, to, subject, body string) error
+}
+
+// SlackClient posts notification messages to Slack
+type SlackClient interface {
+	PostMessage(ctx context.Context, channel, text string) error
+}
+
+// MetadataChannel reads the channel from the notify_to metadata. It needs the
+// enveloped task, so install the middleware before metadata.Middleware.
+func MetadataChannel(t *asynq.Task) NotifyChannel {
+	typ, addr, ok := strings.Cut(metadata.FromTask(t)[KeyNotifyTo], ":")
+	if !ok {
+		return NotifyChannel{}
+	}
+	return NotifyChannel{Type: typ, Address: addr}
+}
+
+// ResultNotificationMiddleware notifies the task's channel once the task
+// succeeded or failed for good. Failures that will be retried are not
+// reported, and delivery problems are logged without affecting the task.
+func ResultNotificationMiddleware(config NotifyConfig, emailSender EmailSender, slackClient SlackClient) middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			ch := config.ChannelExtractor(t)
+			if ch.Type == "" {
+				return next.ProcessTask(ctx, t)
+			}
+			start := time.Now()
+			err := next.ProcessTask(ctx, t)
+			duration := time.Since(start)
+
+			if err == nil && !config.OnSuccess || err != nil && (!config.OnFailure || !final(ctx, err)) {
+				return err
+			}
+			if err != nil && config.IsFailure != nil && !config.IsFailure(err) {
+				return err
+			}
+			subject, body := message(t.Type(), duration, err)
+			var sendErr error
+			switch {
+			case ch.Type == ChannelEmail && emailSender != nil:
+				sendErr = emailSender.SendEmail(ctx, ch.Address, subject, body)
+			case ch.Type == ChannelSlack && slackClient != nil:
+				sendErr = slackClient.PostMessage(ctx, ch.Address, subject+"\n"+body)
+			default:
+				sendErr = fmt.Errorf("no sender for channel type %q", ch.Type)
+			}
+			if sendErr != nil {
+				log.Printf("⚠️  Failed to notify %s:%s about %s: %v", ch.Type, ch.Address, t.Type(), sendErr)
+			}
+			return err
+		})
+	}
+}
+
+// final reports whether a failed attempt is the last one
+func final(ctx context.Context, err error) bool {
+	if errors.Is(err, asynq.SkipRetry) {
+		return true
+	}
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	return retried >= maxRetry
+}
+
+func message(taskType string, duration time.Duration, err error) (subject, body string) {
+	status := "succeeded"
+	if err != nil {
+		status = "failed"
+	}
+	subject = fmt.Sprintf("Task %s %s", taskType, status)
+	body = fmt.Sprintf("Task type: %s\nStatus: %s\nDuration: %s", taskType, status, duration.Round(time.Millisecond))
+	if err != nil {
+		body += fmt.Sprintf("\nError: %v", err)
+	}
+	return subject, body
+}
+
+// TaskEmailSender sends notifications as regular email tasks
+type TaskEmailSender struct {
+	Client *asynq.Client
+}
+
+// SendEmail enqueues a transactional email
+func (s TaskEmailSender) SendEmail(ctx context.Context, to, subject, body string) error {
+	task, err := common.NewEmailTask(common.EmailPayload{Email: to, Subject: subject, Message: body, Category: common.CategoryTransactional})
+	if err != nil {
+		return fmt.Errorf("failed to create notification email: %v", err)
+	}
+	_, err = s.Client.EnqueueContext(ctx, task)
+	return err
+}
+
+// WebhookSlackClient posts through a Slack incoming webhook
+type WebhookSlackClient struct {
+	URL  string
+	HTTP *http.Client
+}
+
+// PostMessage posts text to channel
+func (c WebhookSlackClient) PostMessage(ctx context.Context, channel, text string) error {
+	body, err := json.Marshal(map[string]string{"channel": channel, "text": text})
+	if err != nil {
+		return fmt.Errorf("failed to marshal slack message: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create slack request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post to slack: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/metadata"
+	"asynqdemo/notify"
+
+	"github.com/hibiken/asynq"
+)
+
+// sent is one notification handed to a mock sender
+type sent struct {
+	via, to, text string
+}
+
+type mockEmail struct{ got *[]sent }
+
+func (m mockEmail) SendEmail(ctx context.Context, to, subject, body string) error {
+	*m.got = append(*m.got, sent{"email", to, subject + "\n" + body})
+	return nil
+}
+
+type mockSlack struct{ got *[]sent }
+
+func (m mockSlack) PostMessage(ctx context.Context, channel, text string) error {
+	*m.got = append(*m.got, sent{"slack", channel, text})
+	return nil
+}
+
+// TestResultNotification processes a successful report addressed to an
+// email and a failed one addressed to Slack, and fails unless each reaches
+// only its own sender with the task type, status and duration, the error of
+// the failure is included, and tasks without a channel or outcomes turned
+// off notify nobody.
+func TestResultNotification(t *testing.T) {
+	var got []sent
+	config := notify.NotifyConfig{OnSuccess: true, OnFailure: true, ChannelExtractor: notify.MetadataChannel}
+	handler := func(ctx context.Context, t *asynq.Task) error {
+		time.Sleep(20 * time.Millisecond)
+		if strings.Contains(string(t.Payload()), "fail") {
+			return fmt.Errorf("render failed: %w", asynq.SkipRetry)
+		}
+		return nil
+	}
+	run := func(config notify.NotifyConfig, payload, to string) error {
+		t.Helper()
+		md := metadata.Metadata{}
+		if to != "" {
+			md[notify.KeyNotifyTo] = to
+		}
+		task, err := metadata.NewTask("report:generate", []byte(payload), md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := notify.ResultNotificationMiddleware(config, mockEmail{&got}, mockSlack{&got})(asynq.HandlerFunc(handler))
+		return h.ProcessTask(context.Background(), task)
+	}
+
+	if err := run(config, `{"ok":true}`, "email:ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(config, `{"fail":true}`, "slack:#reports"); !errors.Is(err, asynq.SkipRetry) {
+		t.Fatalf("the handler's error was replaced by %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("sent %+v, want one email and one slack message", got)
+	}
+	if got[0].via != "email" || got[0].to != "ada@example.com" ||
+		!strings.HasPrefix(got[0].text, "Task report:generate succeeded\nTask type: report:generate\nStatus: succeeded\nDuration: ") {
+		t.Errorf("success notification %+v", got[0])
+	}
+	if got[1].via != "slack" || got[1].to != "#reports" ||
+		!strings.HasPrefix(got[1].text, "Task report:generate failed\nTask type: report:generate\nStatus: failed\nDuration: ") ||
+		!strings.HasSuffix(got[1].text, "\nError: render failed: skip retry for the task") {
+		t.Errorf("failure notification %+v", got[1])
+	}
+	for _, n := range got {
+		var d time.Duration
+		for _, line := range strings.Split(n.text, "\n") {
+			if s, ok := strings.CutPrefix(line, "Duration: "); ok {
+				d, _ = time.ParseDuration(s)
+			}
+		}
+		if d < 20*time.Millisecond {
+			t.Errorf("duration %s of %+v is shorter than the handler", d, n)
+		}
+	}
+
+	got = nil
+	run(config, `{"ok":true}`, "")
+	run(notify.NotifyConfig{OnFailure: true, ChannelExtractor: notify.MetadataChannel}, `{"ok":true}`, "email:ada@example.com")
+	run(notify.NotifyConfig{OnSuccess: true, ChannelExtractor: notify.MetadataChannel}, `{"fail":true}`, "slack:#reports")
+	if len(got) != 0 {
+		t.Errorf("sent %+v without a channel or with the outcome turned off", got)
+	}
+}
+
+// TestWebhookSlackClient fails unless messages are posted as JSON and a
+// webhook error is returned
+func TestWebhookSlackClient(t *testing.T) {
+	var body map[string]string
+	status := http.StatusOK
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(status)
+	}))
+	defer hook.Close()
+
+	c := notify.WebhookSlackClient{URL: hook.URL}
+	if err := c.PostMessage(context.Background(), "#reports", "done"); err != nil {
+		t.Fatal(err)
+	}
+	if body["channel"] != "#reports" || body["text"] != "done" {
+		t.Errorf("posted %v", body)
+	}
+	status = http.StatusForbidden
+	if err := c.PostMessage(context.Background(), "#reports", "done"); err == nil {
+		t.Error("webhook error ignored")
+	}
+}
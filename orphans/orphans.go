@@ -0,0 +1,357 @@
+// Package orphans finds active tasks left behind by workers that died, e.g.
+// after an OOM kill, and puts them back in their queue.
+package orphans
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// startsKey maps the IDs of tasks being processed to their StartRecord
+const startsKey = "orphans:started"
+
+// defaultTimeout is what asynq applies to tasks with neither a timeout nor a
+// deadline
+const defaultTimeout = 30 * time.Minute
+
+// DefaultMargin is how long past its timeout a task may stay active before it
+// is flagged
+const DefaultMargin = 5 * time.Minute
+
+// MarginFromEnv returns ORPHAN_MARGIN, or DefaultMargin when it is unset
+func MarginFromEnv() (time.Duration, error) {
+	v := os.Getenv("ORPHAN_MARGIN")
+	if v == "" {
+		return DefaultMargin, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid ORPHAN_MARGIN %q", v)
+	}
+	return d, nil
+}
+
+// StartRecord is written when a worker starts a task and removed when it
+// returns, so it survives the worker dying mid-task. Host and PID identify
+// the asynq server the way Inspector.Servers does.
+type StartRecord struct {
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+// RecordStart stores the start record of a task
+func RecordStart(ctx context.Context, rdb redis.UniversalClient, taskID string, rec StartRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal start of task %s: %v", taskID, err)
+	}
+	if err := rdb.HSet(ctx, startsKey, taskID, data).Err(); err != nil {
+		return fmt.Errorf("failed to record start of task %s: %v", taskID, err)
+	}
+	return nil
+}
+
+// Middleware records when and where each task was started
+func Middleware(rdb redis.UniversalClient) middleware.HandlerMiddleware {
+	host, _ := os.Hostname()
+	pid := os.Getpid()
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			id, ok := asynq.GetTaskID(ctx)
+			if !ok {
+				return next.ProcessTask(ctx, t)
+			}
+			if err := RecordStart(ctx, rdb, id, StartRecord{Host: host, PID: pid, Started: time.Now()}); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+			defer func() {
+				if err := rdb.HDel(context.Background(), startsKey, id).Err(); err != nil {
+					log.Printf("⚠️  Failed to clear start of task %s: %v", id, err)
+				}
+			}()
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
+
+// Orphan is an active task that ran past its timeout plus the margin, or
+// whose lease expired without a start record to tell when it began
+type Orphan struct {
+	ID      string        `json:"id"`
+	Queue   string        `json:"queue"`
+	Type    string        `json:"type"`
+	Started *time.Time    `json:"started,omitempty"`
+	Elapsed time.Duration `json:"-"`
+	Timeout time.Duration `json:"-"`
+	Host    string        `json:"host,omitempty"`
+	PID     int           `json:"pid,omitempty"`
+	// LeaseExpired is asynq's own sign that no worker extends the task
+	LeaseExpired bool `json:"lease_expired"`
+	// ServerAlive is set while the owning server still heartbeats; such
+	// tasks are never recovered
+	ServerAlive bool `json:"server_alive"`
+}
+
+// MarshalJSON adds the durations in seconds
+func (o Orphan) MarshalJSON() ([]byte, error) {
+	type plain Orphan
+	return json.Marshal(struct {
+		plain
+		ElapsedSeconds float64 `json:"elapsed_seconds,omitempty"`
+		TimeoutSeconds float64 `json:"timeout_seconds"`
+	}{plain(o), o.Elapsed.Seconds(), o.Timeout.Seconds()})
+}
+
+// Detector lists orphaned active tasks
+type Detector struct {
+	inspector *asynq.Inspector
+	rdb       redis.UniversalClient
+	// Margin is added to a task's timeout before it is flagged
+	Margin time.Duration
+}
+
+// NewDetector creates a detector with DefaultMargin
+func NewDetector(inspector *asynq.Inspector, rdb redis.UniversalClient) *Detector {
+	return &Detector{inspector: inspector, rdb: rdb, Margin: DefaultMargin}
+}
+
+// liveness is a snapshot of the servers that heartbeat
+type liveness struct {
+	hosts map[string]bool
+	tasks map[string]bool
+}
+
+func (d *Detector) liveness() (*liveness, error) {
+	servers, err := d.inspector.Servers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %v", err)
+	}
+	l := &liveness{hosts: make(map[string]bool), tasks: make(map[string]bool)}
+	for _, s := range servers {
+		l.hosts[fmt.Sprintf("%s:%d", s.Host, s.PID)] = true
+		for _, w := range s.ActiveWorkers {
+			l.tasks[w.TaskID] = true
+		}
+	}
+	return l, nil
+}
+
+// alive reports whether a live server owns the task
+func (l *liveness) alive(o Orphan) bool {
+	return l.tasks[o.ID] || (o.Host != "" && l.hosts[fmt.Sprintf("%s:%d", o.Host, o.PID)])
+}
+
+// Find returns the orphaned active tasks of every queue
+func (d *Detector) Find(ctx context.Context) ([]Orphan, error) {
+	scanned := time.Now()
+	live, err := d.liveness()
+	if err != nil {
+		return nil, err
+	}
+	starts, err := d.rdb.HGetAll(ctx, startsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task starts: %v", err)
+	}
+	queues, err := d.inspector.Queues()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues: %v", err)
+	}
+
+	var orphans []Orphan
+	active := make(map[string]bool)
+	for _, q := range queues {
+		for page := 1; ; page++ {
+			tasks, err := d.inspector.ListActiveTasks(q, asynq.Page(page), asynq.PageSize(100))
+			if err != nil {
+				return nil, fmt.Errorf("failed to list active tasks of %s: %v", q, err)
+			}
+			for _, t := range tasks {
+				active[t.ID] = true
+				if o, ok := d.check(t, starts[t.ID], scanned); ok {
+					o.ServerAlive = live.alive(o)
+					orphans = append(orphans, o)
+				}
+			}
+			if len(tasks) < 100 {
+				break
+			}
+		}
+	}
+	d.prune(ctx, starts, active, scanned)
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].ID < orphans[j].ID })
+	return orphans, nil
+}
+
+// check flags t when it ran past its timeout plus the margin
+func (d *Detector) check(t *asynq.TaskInfo, start string, now time.Time) (Orphan, bool) {
+	o := Orphan{ID: t.ID, Queue: t.Queue, Type: t.Type, Timeout: t.Timeout, LeaseExpired: t.IsOrphaned}
+	if o.Timeout == 0 && t.Deadline.IsZero() {
+		o.Timeout = defaultTimeout
+	}
+	var rec StartRecord
+	if start == "" || json.Unmarshal([]byte(start), &rec) != nil {
+		// Started before the middleware was installed or by another build
+		return o, t.IsOrphaned
+	}
+	o.Started, o.Host, o.PID = &rec.Started, rec.Host, rec.PID
+	o.Elapsed = now.Sub(rec.Started)
+	limit := rec.Started.Add(o.Timeout + d.Margin)
+	if o.Timeout == 0 || (!t.Deadline.IsZero() && t.Deadline.Before(rec.Started.Add(o.Timeout))) {
+		limit = t.Deadline.Add(d.Margin)
+	}
+	return o, now.After(limit)
+}
+
+// prune drops start records left by tasks that asynq recovered and that
+// ended elsewhere. Paging over the active lists can miss tasks that move
+// meanwhile, so recent records are kept.
+func (d *Detector) prune(ctx context.Context, starts map[string]string, active map[string]bool, scanned time.Time) {
+	for id, data := range starts {
+		var rec StartRecord
+		if active[id] || (json.Unmarshal([]byte(data), &rec) == nil && scanned.Sub(rec.Started) < defaultTimeout) {
+			continue
+		}
+		d.rdb.HDel(ctx, startsKey, id)
+	}
+}
+
+// requeueScript moves a task from active back to the head of pending, as
+// asynq does for tasks of a server that shuts down
+//
+// KEYS[1] active list, KEYS[2] lease set, KEYS[3] pending list, KEYS[4] task hash
+// ARGV[1] task ID
+var requeueScript = redis.NewScript(`
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
+  return 0
+end
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("RPUSH", KEYS[3], ARGV[1])
+redis.call("HSET", KEYS[4], "state", "pending")
+return 1
+`)
+
+// ErrServerAlive is returned for tasks whose server still heartbeats
+var ErrServerAlive = errors.New("owning server is still alive")
+
+// Recover cancels o and moves it back to pending. It checks again that no
+// live server owns the task, since workers may have come back since Find.
+func (d *Detector) Recover(ctx context.Context, o Orphan) error {
+	live, err := d.liveness()
+	if err != nil {
+		return err
+	}
+	if live.alive(o) {
+		return ErrServerAlive
+	}
+	// Stops the handler should the worker be alive but cut off from Redis
+	if err := d.inspector.CancelProcessing(o.ID); err != nil {
+		log.Printf("⚠️  Failed to cancel task %s: %v", o.ID, err)
+	}
+	keys := []string{
+		fmt.Sprintf("asynq:{%s}:active", o.Queue),
+		fmt.Sprintf("asynq:{%s}:lease", o.Queue),
+		fmt.Sprintf("asynq:{%s}:pending", o.Queue),
+		fmt.Sprintf("asynq:{%s}:t:%s", o.Queue, o.ID),
+	}
+	moved, err := requeueScript.Run(ctx, d.rdb, keys, o.ID).Int()
+	if err != nil {
+		return fmt.Errorf("failed to requeue task %s: %v", o.ID, err)
+	}
+	if moved == 0 {
+		return fmt.Errorf("task %s is no longer active", o.ID)
+	}
+	return d.rdb.HDel(ctx, startsKey, o.ID).Err()
+}
+
+// Monitor checks for orphans every interval and alerts once per task
+type Monitor struct {
+	detector *Detector
+	interval time.Duration
+	alert    func(ctx context.Context, text string) error
+	alerted  map[string]bool
+}
+
+// NewMonitor creates a monitor; alert may be nil to only log
+func NewMonitor(detector *Detector, interval time.Duration, alert func(ctx context.Context, text string) error) *Monitor {
+	return &Monitor{detector: detector, interval: interval, alert: alert, alerted: make(map[string]bool)}
+}
+
+// Run checks until ctx is done
+func (m *Monitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		found, err := m.detector.Find(ctx)
+		if err != nil {
+			log.Printf("⚠️  %v", err)
+			continue
+		}
+		seen := make(map[string]bool, len(found))
+		for _, o := range found {
+			seen[o.ID] = true
+			if m.alerted[o.ID] {
+				continue
+			}
+			m.alerted[o.ID] = true
+			text := fmt.Sprintf("Task %s (%s) in queue %s looks orphaned: active past its %v timeout", o.ID, o.Type, o.Queue, o.Timeout)
+			if o.ServerAlive {
+				text += ", but its server still heartbeats"
+			} else {
+				text += "; run `admin orphans recover` to requeue it"
+			}
+			log.Printf("⚠️  %s", text)
+			if m.alert != nil {
+				if err := m.alert(ctx, text); err != nil {
+					log.Printf("❌ Failed to alert about orphaned task %s: %v", o.ID, err)
+				}
+			}
+		}
+		// Forget recovered tasks so they alert again if they get stuck again
+		for id := range m.alerted {
+			if !seen[id] {
+				delete(m.alerted, id)
+			}
+		}
+	}
+}
+
+// Handler serves GET /admin/orphans
+func Handler(detector *Detector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		found, err := detector.Find(r.Context())
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if found == nil {
+			found = []Orphan{}
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{
+			"margin_seconds": detector.Margin.Seconds(),
+			"orphans":        found,
+		})
+	})
+}
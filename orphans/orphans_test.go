@@ -0,0 +1,105 @@
+package orphans_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/orphans"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// abandonTask moves a pending task to active the way a worker's dequeue does,
+// with its lease expiring at leaseExpiry, as if the worker died holding it
+func abandonTask(ctx context.Context, rdb redis.UniversalClient, queue, id string, leaseExpiry time.Time) error {
+	pipe := rdb.TxPipeline()
+	pipe.LRem(ctx, fmt.Sprintf("asynq:{%s}:pending", queue), 0, id)
+	pipe.LPush(ctx, fmt.Sprintf("asynq:{%s}:active", queue), id)
+	pipe.ZAdd(ctx, fmt.Sprintf("asynq:{%s}:lease", queue), redis.Z{Score: float64(leaseExpiry.Unix()), Member: id})
+	pipe.HSet(ctx, fmt.Sprintf("asynq:{%s}:t:%s", queue, id), "state", "active")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to abandon task %s: %v", id, err)
+	}
+	return nil
+}
+
+// TestOrphanRecovery abandons two tasks on an embedded Redis: one started an
+// hour ago by a server that no longer exists, and one whose lease is still
+// held. It fails unless only the first is detected and recovery puts it back
+// in pending.
+func TestOrphanRecovery(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	const queue = "orphans-test"
+	ctx := context.Background()
+	rdb, ok := r.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		t.Fatalf("unsupported redis connection %T", r)
+	}
+	defer rdb.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	client := asynq.NewClient(r)
+	defer client.Close()
+
+	enqueue := func(id string) {
+		t.Helper()
+		if _, err := client.Enqueue(asynq.NewTask("orphans:probe", nil), asynq.Queue(queue), asynq.TaskID(id), asynq.Timeout(time.Minute)); err != nil {
+			t.Fatalf("failed to enqueue %s: %v", id, err)
+		}
+	}
+	enqueue("abandoned")
+	enqueue("leased")
+	if err := abandonTask(ctx, rdb, queue, "abandoned", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := orphans.RecordStart(ctx, rdb, "abandoned", orphans.StartRecord{Host: "gone.invalid", PID: 1, Started: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := abandonTask(ctx, rdb, queue, "leased", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	detector := orphans.NewDetector(inspector, rdb)
+	found, err := detector.Find(ctx)
+	if err != nil {
+		t.Fatalf("failed to find orphans: %v", err)
+	}
+	var abandoned *orphans.Orphan
+	for i, o := range found {
+		switch o.ID {
+		case "abandoned":
+			abandoned = &found[i]
+		case "leased":
+			t.Errorf("task with a held lease and no start record was flagged: %+v", o)
+		}
+	}
+	if abandoned == nil {
+		t.Fatalf("abandoned task was not detected, found %+v", found)
+	}
+	if abandoned.ServerAlive || !abandoned.LeaseExpired {
+		t.Errorf("abandoned task flagged as alive %v, lease expired %v", abandoned.ServerAlive, abandoned.LeaseExpired)
+	}
+
+	if err := detector.Recover(ctx, *abandoned); err != nil {
+		t.Fatalf("failed to recover abandoned task: %v", err)
+	}
+	info, err := inspector.GetTaskInfo(queue, "abandoned")
+	if err != nil {
+		t.Fatalf("failed to get recovered task: %v", err)
+	}
+	if info.State != asynq.TaskStatePending {
+		t.Errorf("recovered task is %v, want pending", info.State)
+	}
+	if err := detector.Recover(ctx, *abandoned); err == nil {
+		t.Errorf("recovering a task twice succeeded")
+	}
+}
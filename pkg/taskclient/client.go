@@ -0,0 +1,215 @@
+// Package taskclient enqueues this service's tasks from other Go services.
+// It holds the payload types, the metadata envelope and the enqueue options
+// and nothing of the workers, so importing it pulls in asynq only.
+//
+// A client enqueues either straight to Redis or through the HTTP API:
+//
+//	c, err := taskclient.New(asynq.RedisClientOpt{Addr: "localhost:6379"})
+//	c, err := taskclient.New("https://tasks.example.com", taskclient.WithToken(token))
+//
+// Both send the same envelope, but only the HTTP API applies the server's
+// policies on the way in: frequency caps, quiet hours, payload encryption
+// and audit records. Services that need them should use the API.
+package taskclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// TaskInfo describes an enqueued task
+type TaskInfo struct {
+	ID            string
+	Type          string
+	Queue         string
+	NextProcessAt time.Time
+}
+
+// ClientOption configures a Client
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	token      string
+	httpClient *http.Client
+}
+
+// WithToken sends token as the bearer token of HTTP API requests
+func WithToken(token string) ClientOption {
+	return func(c *clientConfig) { c.token = token }
+}
+
+// WithHTTPClient sets the client for HTTP API requests, http.DefaultClient
+// by default
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *clientConfig) { c.httpClient = hc }
+}
+
+type transport interface {
+	enqueue(ctx context.Context, taskType string, payload []byte, md Metadata, o *options) (*TaskInfo, error)
+	close() error
+}
+
+// Client enqueues tasks
+type Client struct {
+	t transport
+}
+
+// New creates a client for target, which is either an asynq.RedisConnOpt,
+// a redis:// or rediss:// URL, or the http:// or https:// base URL of the
+// HTTP API
+func New(target interface{}, opts ...ClientOption) (*Client, error) {
+	cfg := &clientConfig{httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	switch t := target.(type) {
+	case asynq.RedisConnOpt:
+		return &Client{t: &redisTransport{client: asynq.NewClient(t)}}, nil
+	case string:
+		u, err := url.Parse(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q: %v", t, err)
+		}
+		switch u.Scheme {
+		case "redis", "rediss":
+			connOpt, err := asynq.ParseRedisURI(t)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %q: %v", t, err)
+			}
+			return &Client{t: &redisTransport{client: asynq.NewClient(connOpt)}}, nil
+		case "http", "https":
+			return &Client{t: &httpTransport{base: strings.TrimSuffix(t, "/"), cfg: cfg}}, nil
+		}
+		return nil, fmt.Errorf("invalid target %q: want a redis, rediss, http or https URL", t)
+	}
+	return nil, fmt.Errorf("invalid target of type %T: want an asynq.RedisConnOpt or a URL", target)
+}
+
+// Close releases the client's connections
+func (c *Client) Close() error {
+	return c.t.close()
+}
+
+// Enqueue enqueues p with its task type, payload version and user
+func (c *Client) Enqueue(ctx context.Context, p Payload, opts ...Option) (*TaskInfo, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %v", p.TaskType(), err)
+	}
+	o := newOptions(opts)
+	md := make(Metadata, len(o.metadata)+2)
+	for k, v := range o.metadata {
+		md[k] = v
+	}
+	md[KeyPayloadVersion] = strconv.Itoa(p.PayloadVersion())
+	// The user is charged for the task, like the service's own producers do
+	var ids struct {
+		UserID int `json:"user_id"`
+	}
+	if json.Unmarshal(payload, &ids) == nil && ids.UserID != 0 {
+		md[KeyUserID] = strconv.Itoa(ids.UserID)
+	}
+	return c.t.enqueue(ctx, p.TaskType(), payload, md, o)
+}
+
+// EnqueueEmail enqueues an email task
+func (c *Client) EnqueueEmail(ctx context.Context, p EmailPayload, opts ...Option) (*TaskInfo, error) {
+	return c.Enqueue(ctx, p, opts...)
+}
+
+// EnqueueWelcome enqueues a welcome message task
+func (c *Client) EnqueueWelcome(ctx context.Context, p WelcomePayload, opts ...Option) (*TaskInfo, error) {
+	return c.Enqueue(ctx, p, opts...)
+}
+
+// EnqueuePreferencesUpdate enqueues a preferences update task
+func (c *Client) EnqueuePreferencesUpdate(ctx context.Context, p PreferencesUpdatePayload, opts ...Option) (*TaskInfo, error) {
+	return c.Enqueue(ctx, p, opts...)
+}
+
+// redisTransport enqueues straight to Redis
+type redisTransport struct {
+	client *asynq.Client
+}
+
+func (t *redisTransport) enqueue(ctx context.Context, taskType string, payload []byte, md Metadata, o *options) (*TaskInfo, error) {
+	task, err := NewTask(taskType, payload, md)
+	if err != nil {
+		return nil, err
+	}
+	info, err := t.client.EnqueueContext(ctx, task, o.asynqOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue %s: %v", taskType, err)
+	}
+	return &TaskInfo{ID: info.ID, Type: info.Type, Queue: info.Queue, NextProcessAt: info.NextProcessAt}, nil
+}
+
+func (t *redisTransport) close() error {
+	return t.client.Close()
+}
+
+// httpTransport enqueues through POST /api/tasks
+type httpTransport struct {
+	base string
+	cfg  *clientConfig
+}
+
+func (t *httpTransport) enqueue(ctx context.Context, taskType string, payload []byte, md Metadata, o *options) (*TaskInfo, error) {
+	if o.maxRetry >= 0 {
+		return nil, fmt.Errorf("MaxRetry is not supported by the HTTP API")
+	}
+	req := EnqueueRequest{Type: taskType, Payload: payload, Queue: o.queue, Metadata: md}
+	// The API schedules in whole seconds; round up so a task never runs early
+	if d := o.delay(time.Now()); d > 0 {
+		req.ProcessInSeconds = int(math.Ceil(d.Seconds()))
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.base+"/api/tasks", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if t.cfg.token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+t.cfg.token)
+	}
+	resp, err := t.cfg.httpClient.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue %s: %v", taskType, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		var e ThrottledResponse
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			apiErr.Message, apiErr.NextAllowed = e.Error, e.NextAllowed
+		}
+		return nil, apiErr
+	}
+	var er EnqueueResponse
+	if err := json.Unmarshal(data, &er); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	return &TaskInfo{ID: er.ID, Type: taskType, Queue: er.Queue, NextProcessAt: er.NextProcessAt}, nil
+}
+
+func (t *httpTransport) close() error {
+	return nil
+}
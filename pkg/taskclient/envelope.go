@@ -0,0 +1,65 @@
+package taskclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Metadata attributes set by this package
+const (
+	// KeyEnqueuedAt holds the RFC 3339 time the task was created by NewTask
+	KeyEnqueuedAt = "enqueued_at"
+	// KeyPayloadVersion holds the version of the payload, 1 when unset
+	KeyPayloadVersion = "payload_version"
+	// KeyUserID identifies the user a task is charged to
+	KeyUserID = "user_id"
+)
+
+// Metadata is the set of attributes attached to a task
+type Metadata map[string]string
+
+type envelope struct {
+	Meta    Metadata        `json:"_meta"`
+	Payload json.RawMessage `json:"_payload"`
+}
+
+// NewTask creates a task whose JSON payload is wrapped with md. The enqueued_at
+// attribute is stamped with the current time unless md already sets it.
+func NewTask(typeName string, payload []byte, md Metadata, opts ...asynq.Option) (*asynq.Task, error) {
+	meta := make(Metadata, len(md)+1)
+	for k, v := range md {
+		meta[k] = v
+	}
+	if _, ok := meta[KeyEnqueuedAt]; !ok {
+		meta[KeyEnqueuedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	data, err := Wrap(payload, meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap payload of %s: %v", typeName, err)
+	}
+	return asynq.NewTask(typeName, data, opts...), nil
+}
+
+// Wrap puts a JSON payload and its metadata into an envelope as is
+func Wrap(payload []byte, md Metadata) ([]byte, error) {
+	if !json.Valid(payload) {
+		return nil, fmt.Errorf("payload is not valid JSON")
+	}
+	if md == nil {
+		md = Metadata{}
+	}
+	return json.Marshal(envelope{Meta: md, Payload: payload})
+}
+
+// Unwrap splits an enveloped payload into the inner payload and its metadata.
+// Payloads without an envelope are returned unchanged with nil metadata.
+func Unwrap(payload []byte) ([]byte, Metadata) {
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil || env.Meta == nil || env.Payload == nil {
+		return payload, nil
+	}
+	return env.Payload, env.Meta
+}
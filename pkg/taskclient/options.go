@@ -0,0 +1,90 @@
+package taskclient
+
+import (
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Queues served by the workers, from most to least urgent
+const (
+	QueueCritical = "critical"
+	QueueDefault  = "default"
+	QueueLow      = "low"
+)
+
+// DefaultQueue is where tasks go without a Queue option
+const DefaultQueue = QueueDefault
+
+// Option configures one enqueue
+type Option func(*options)
+
+type options struct {
+	queue     string
+	processAt time.Time
+	processIn time.Duration
+	maxRetry  int
+	metadata  Metadata
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{queue: DefaultQueue, maxRetry: -1}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Queue sends the task to queue instead of DefaultQueue
+func Queue(queue string) Option {
+	return func(o *options) { o.queue = queue }
+}
+
+// ProcessIn delays the task by d; it replaces an earlier ProcessAt
+func ProcessIn(d time.Duration) Option {
+	return func(o *options) { o.processIn, o.processAt = d, time.Time{} }
+}
+
+// ProcessAt delays the task until t; it replaces an earlier ProcessIn
+func ProcessAt(t time.Time) Option {
+	return func(o *options) { o.processAt, o.processIn = t, 0 }
+}
+
+// MaxRetry sets how often a failed task is retried. Only a Redis client
+// can set it; the HTTP API refuses it.
+func MaxRetry(n int) Option {
+	return func(o *options) { o.maxRetry = n }
+}
+
+// WithMetadata attaches the attribute key to the task
+func WithMetadata(key, value string) Option {
+	return func(o *options) {
+		if o.metadata == nil {
+			o.metadata = Metadata{}
+		}
+		o.metadata[key] = value
+	}
+}
+
+// asynqOptions returns the options for enqueueing straight to Redis
+func (o *options) asynqOptions() []asynq.Option {
+	opts := []asynq.Option{asynq.Queue(o.queue)}
+	switch {
+	case !o.processAt.IsZero():
+		opts = append(opts, asynq.ProcessAt(o.processAt))
+	case o.processIn > 0:
+		opts = append(opts, asynq.ProcessIn(o.processIn))
+	}
+	if o.maxRetry >= 0 {
+		opts = append(opts, asynq.MaxRetry(o.maxRetry))
+	}
+	return opts
+}
+
+// delay returns how long from now the task should wait
+func (o *options) delay(now time.Time) time.Duration {
+	if !o.processAt.IsZero() {
+		return o.processAt.Sub(now)
+	}
+	return o.processIn
+}
@@ -0,0 +1,86 @@
+package taskclient
+
+// Task types
+const (
+	TypeWelcomeMessage    = "welcome:message"
+	TypeEmailTask         = "email:send"
+	TypePreferencesUpdate = "preferences:update"
+)
+
+// Email categories; recipients can opt out of marketing mail only
+const (
+	CategoryMarketing     = "marketing"
+	CategoryTransactional = "transactional"
+	CategoryDigest        = "digest"
+	CategorySecurity      = "security"
+	CategoryWelcome       = "welcome"
+)
+
+// Payload versions, sent as the payload_version metadata of every task. A
+// version is bumped when a change to its struct is not backward compatible;
+// the fleet refuses versions no worker handles.
+const (
+	WelcomePayloadVersion           = 1
+	EmailPayloadVersion             = 1
+	PreferencesUpdatePayloadVersion = 1
+)
+
+// Payload is a task payload this package can enqueue
+type Payload interface {
+	TaskType() string
+	PayloadVersion() int
+}
+
+// WelcomePayload represents the payload for welcome message tasks
+type WelcomePayload struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Message  string `json:"message"`
+	Locale   string `json:"locale,omitempty"`
+	TenantID string `json:"tenant_id,omitempty"`
+}
+
+// TaskType returns TypeWelcomeMessage
+func (WelcomePayload) TaskType() string { return TypeWelcomeMessage }
+
+// PayloadVersion returns WelcomePayloadVersion
+func (WelcomePayload) PayloadVersion() int { return WelcomePayloadVersion }
+
+// EmailPayload represents the payload for email tasks
+type EmailPayload struct {
+	UserID   int    `json:"user_id"`
+	Email    string `json:"email"`
+	Subject  string `json:"subject"`
+	Message  string `json:"message"`
+	Locale   string `json:"locale,omitempty"`
+	TenantID string `json:"tenant_id,omitempty"`
+	// Category is one of the Category constants, CategoryTransactional by default
+	Category string `json:"category,omitempty"`
+	// Timezone is the recipient's IANA zone, e.g. "Europe/Berlin", used to
+	// hold marketing and digest mail for quiet hours
+	Timezone string `json:"timezone,omitempty"`
+	// TemplateName names the HTML template the message is also sent as,
+	// e.g. "welcome"; empty sends text only
+	TemplateName string `json:"template_name,omitempty"`
+	// TemplateData is what the HTML template fills in, e.g. {"name": "Alice"}
+	TemplateData map[string]interface{} `json:"template_data,omitempty"`
+}
+
+// TaskType returns TypeEmailTask
+func (EmailPayload) TaskType() string { return TypeEmailTask }
+
+// PayloadVersion returns EmailPayloadVersion
+func (EmailPayload) PayloadVersion() int { return EmailPayloadVersion }
+
+// PreferencesUpdatePayload changes whether a recipient gets a category of mail
+type PreferencesUpdatePayload struct {
+	Email    string `json:"email"`
+	Category string `json:"category"`
+	OptedOut bool   `json:"opted_out"`
+}
+
+// TaskType returns TypePreferencesUpdate
+func (PreferencesUpdatePayload) TaskType() string { return TypePreferencesUpdate }
+
+// PayloadVersion returns PreferencesUpdatePayloadVersion
+func (PreferencesUpdatePayload) PayloadVersion() int { return PreferencesUpdatePayloadVersion }
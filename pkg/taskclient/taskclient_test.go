@@ -0,0 +1,118 @@
+package taskclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/pkg/taskclient"
+)
+
+// TestTaskclientConsumer builds testdata/taskclient-consumer, an external
+// service importing asynqdemo/pkg/taskclient, and fails unless it compiles
+// and taskclient depends on no other package of this module. It skips when
+// the go command is not available.
+func TestTaskclientConsumer(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skipf("go command not available: %v", err)
+	}
+	build := exec.Command("go", "build", "-o", "/dev/null", ".")
+	dir := filepath.Join("..", "..", "testdata", "taskclient-consumer")
+	build.Dir = dir
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("consumer does not build against the public surface: %v\n%s", err, out)
+	}
+	list := exec.Command("go", "list", "-deps", "asynqdemo/pkg/taskclient")
+	list.Dir = dir
+	out, err := list.Output()
+	if err != nil {
+		t.Fatalf("failed to list taskclient dependencies: %v", err)
+	}
+	for _, pkg := range strings.Fields(string(out)) {
+		if strings.HasPrefix(pkg, "asynqdemo/") && pkg != "asynqdemo/pkg/taskclient" {
+			t.Errorf("taskclient depends on internal package %s", pkg)
+		}
+	}
+}
+
+// TestTaskclientHTTP enqueues through a client of a fake HTTP API and
+// fails unless requests carry the payload, queue, delay, token and
+// payload_version and user_id metadata, a 429 comes back as an APIError
+// with NextAllowed, and options the API cannot express are refused.
+func TestTaskclientHTTP(t *testing.T) {
+	nextAllowed := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var got taskclient.EnqueueRequest
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/tasks" || r.Method != http.MethodPost {
+			admin.WriteError(w, http.StatusNotFound, "not found")
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			admin.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if strings.Contains(string(got.Payload), "capped") {
+			admin.WriteJSON(w, http.StatusTooManyRequests, taskclient.ThrottledResponse{Error: "capped", NextAllowed: nextAllowed})
+			return
+		}
+		admin.WriteJSON(w, http.StatusCreated, taskclient.EnqueueResponse{ID: "task-1", Queue: got.Queue, NextProcessAt: time.Now()})
+	}))
+	defer srv.Close()
+
+	c, err := taskclient.New(srv.URL+"/", taskclient.WithToken("secret"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	info, err := c.EnqueueEmail(ctx, taskclient.EmailPayload{UserID: 7, Email: "a@example.com", Subject: "Hi"},
+		taskclient.Queue(taskclient.QueueLow), taskclient.ProcessIn(1500*time.Millisecond), taskclient.WithMetadata("source", "test"))
+	if err != nil {
+		t.Fatalf("EnqueueEmail: %v", err)
+	}
+	if info.ID != "task-1" || info.Type != taskclient.TypeEmailTask || info.Queue != taskclient.QueueLow {
+		t.Errorf("got task info %+v", info)
+	}
+	var p taskclient.EmailPayload
+	if err := json.Unmarshal(got.Payload, &p); err != nil || p.Email != "a@example.com" {
+		t.Errorf("got payload %s (%v)", got.Payload, err)
+	}
+	switch {
+	case got.Type != taskclient.TypeEmailTask:
+		t.Errorf("got type %q", got.Type)
+	case got.ProcessInSeconds != 2:
+		t.Errorf("got process_in_seconds %d, want 1.5s rounded up to 2", got.ProcessInSeconds)
+	case got.Metadata[taskclient.KeyPayloadVersion] != "1" || got.Metadata[taskclient.KeyUserID] != "7" || got.Metadata["source"] != "test":
+		t.Errorf("got metadata %v", got.Metadata)
+	case auth != "Bearer secret":
+		t.Errorf("got Authorization %q", auth)
+	}
+
+	if _, err := c.EnqueueWelcome(ctx, taskclient.WelcomePayload{UserID: 7}); err != nil || got.Queue != taskclient.DefaultQueue {
+		t.Errorf("welcome went to queue %q (%v), want %q", got.Queue, err, taskclient.DefaultQueue)
+	}
+
+	_, err = c.EnqueueEmail(ctx, taskclient.EmailPayload{UserID: 7, Email: "a@example.com", Subject: "capped"})
+	var apiErr *taskclient.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || !apiErr.NextAllowed.Equal(nextAllowed) {
+		t.Errorf("got %v for a capped email, want an APIError with status 429 and next allowed %s", err, nextAllowed)
+	}
+
+	if _, err := c.EnqueueWelcome(ctx, taskclient.WelcomePayload{UserID: 7}, taskclient.MaxRetry(3)); err == nil {
+		t.Errorf("MaxRetry over the HTTP API succeeded, want an error")
+	}
+	if _, err := taskclient.New("ftp://example.com"); err == nil {
+		t.Errorf("New accepted an ftp URL")
+	}
+}
@@ -0,0 +1,47 @@
+package taskclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EnqueueRequest is the body of POST /api/tasks
+type EnqueueRequest struct {
+	Type             string          `json:"type"`
+	Payload          json.RawMessage `json:"payload"`
+	Queue            string          `json:"queue,omitempty"`
+	ProcessInSeconds int             `json:"process_in_seconds,omitempty"`
+	Metadata         Metadata        `json:"metadata,omitempty"`
+	// OverrideFrequencyCap enqueues an email past its category's frequency
+	// cap; it needs an admin token and is recorded in the audit log
+	OverrideFrequencyCap bool `json:"override_frequency_cap,omitempty"`
+}
+
+// EnqueueResponse describes the enqueued task
+type EnqueueResponse struct {
+	ID            string    `json:"id"`
+	Queue         string    `json:"queue"`
+	NextProcessAt time.Time `json:"next_process_at"`
+	// EstimatedCompletion is set for pending tasks when there is history to
+	// estimate from
+	EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+}
+
+// ThrottledResponse is the body of a 429 for an email over its frequency cap
+type ThrottledResponse struct {
+	Error       string    `json:"error"`
+	NextAllowed time.Time `json:"next_allowed"`
+}
+
+// APIError is an error answered by the HTTP API
+type APIError struct {
+	StatusCode int
+	Message    string
+	// NextAllowed is when a throttled email (429) would be accepted
+	NextAllowed time.Time
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("enqueue failed with status %d: %s", e.StatusCode, e.Message)
+}
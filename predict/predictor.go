@@ -0,0 +1,147 @@
+// Package predict estimates how long tasks take to process and when a newly
+// enqueued task will be done.
+package predict
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"asynqdemo/audit"
+	"asynqdemo/metrics"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNoHistory is returned when too little was recorded to predict from
+var ErrNoHistory = errors.New("not enough history to predict from")
+
+// throughputWindow is how far back queue snapshots are read for the dequeue rate
+const throughputWindow = time.Hour
+
+// DurationPredictor estimates processing times from the latency percentiles
+// all workers record, and queue waits from the queue snapshots
+type DurationPredictor struct {
+	rdb redis.UniversalClient
+}
+
+// NewDurationPredictor creates a predictor reading history from rdb
+func NewDurationPredictor(rdb redis.UniversalClient) *DurationPredictor {
+	return &DurationPredictor{rdb: rdb}
+}
+
+// Predict returns the duration a percentile, between 0 and 1, of taskType
+// tasks completes within over the last 24h
+func (p *DurationPredictor) Predict(ctx context.Context, taskType string, percentile float64) (time.Duration, error) {
+	if percentile <= 0 || percentile > 1 {
+		return 0, fmt.Errorf("percentile %v is not in (0, 1]", percentile)
+	}
+	s, ok, err := metrics.Summary(ctx, p.rdb, taskType)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("no latencies of %s: %w", taskType, ErrNoHistory)
+	}
+	ms := Interpolate(percentile, s.P50Ms, s.P90Ms, s.P99Ms, s.MaxMs)
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
+// Interpolate estimates a percentile from the P50, P90 and P99 of durations.
+// Durations are usually close to log-normal, so the logarithm of the known
+// percentiles is interpolated linearly in the normal quantile of the
+// percentile, which is exact for log-normal data. Below P50 and above P99 the
+// nearest segment is extended; the result never exceeds max.
+func Interpolate(percentile, p50, p90, p99, max float64) float64 {
+	if percentile >= 1 {
+		return max
+	}
+	known := []struct{ z, v float64 }{
+		{normalQuantile(0.5), p50},
+		{normalQuantile(0.9), p90},
+		{normalQuantile(0.99), p99},
+	}
+	z := normalQuantile(percentile)
+	a, b := known[0], known[1]
+	if z > known[1].z {
+		a, b = known[1], known[2]
+	}
+	if a.v <= 0 || b.v <= 0 {
+		// No logarithm of zero; fall back to the nearest known value
+		if math.Abs(z-a.z) < math.Abs(z-b.z) {
+			return a.v
+		}
+		return b.v
+	}
+	la, lb := math.Log(a.v), math.Log(b.v)
+	v := math.Exp(la + (lb-la)*(z-a.z)/(b.z-a.z))
+	if max > 0 && v > max {
+		return max
+	}
+	return v
+}
+
+// normalQuantile is the inverse of the standard normal distribution function
+func normalQuantile(p float64) float64 {
+	return math.Sqrt2 * math.Erfinv(2*p-1)
+}
+
+// DequeueRate returns the median number of tasks per minute processed from
+// queue over the last hour, from the snapshots the audit snapshotter takes
+func (p *DurationPredictor) DequeueRate(ctx context.Context, queue string) (float64, error) {
+	now := time.Now()
+	snaps, err := audit.Snapshots(ctx, p.rdb, queue, now.Add(-throughputWindow), now)
+	if err != nil {
+		return 0, err
+	}
+	var rates []float64
+	for i := 1; i < len(snaps); i++ {
+		elapsed := snaps[i].At.Sub(snaps[i-1].At).Minutes()
+		processed := snaps[i].ProcessedTotal - snaps[i-1].ProcessedTotal
+		// A negative count means the counters were reset
+		if elapsed <= 0 || processed < 0 {
+			continue
+		}
+		rates = append(rates, float64(processed)/elapsed)
+	}
+	if len(rates) == 0 {
+		return 0, fmt.Errorf("no snapshots of queue %s: %w", queue, ErrNoHistory)
+	}
+	sort.Float64s(rates)
+	mid := len(rates) / 2
+	if len(rates)%2 == 0 {
+		return (rates[mid-1] + rates[mid]) / 2, nil
+	}
+	return rates[mid], nil
+}
+
+// EstimatedCompletion estimates when task, enqueued now to queue, will be
+// done: the tasks pending in the queue drain at the median dequeue rate, then
+// the task takes its median duration
+func (p *DurationPredictor) EstimatedCompletion(ctx context.Context, inspector *asynq.Inspector, task *asynq.Task, queue string) (time.Time, error) {
+	now := time.Now()
+	info, err := inspector.GetQueueInfo(queue)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get queue %s: %v", queue, err)
+	}
+	var wait time.Duration
+	if info.Pending > 0 {
+		rate, err := p.DequeueRate(ctx, queue)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if rate == 0 {
+			return time.Time{}, fmt.Errorf("queue %s processed nothing over the last %v: %w", queue, throughputWindow, ErrNoHistory)
+		}
+		wait = time.Duration(float64(info.Pending) / rate * float64(time.Minute))
+	}
+	duration, err := p.Predict(ctx, task.Type(), 0.5)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(wait + duration), nil
+}
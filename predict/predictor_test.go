@@ -0,0 +1,179 @@
+package predict_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"asynqdemo/audit"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metrics"
+	"asynqdemo/predict"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// Durations follow a log-normal distribution with a median of 100ms
+const (
+	mu    = 4.605170186 // ln(100)
+	sigma = 0.5
+)
+
+// lognormal returns the duration at percentile p of the distribution
+func lognormal(p float64) time.Duration {
+	z := math.Sqrt2 * math.Erfinv(2*p-1)
+	return time.Duration(math.Exp(mu+sigma*z) * float64(time.Millisecond))
+}
+
+// TestPredict records 1000 durations spread over the log-normal
+// distribution and fails unless the predicted P50 and P95 are within 5% of
+// the analytical values, and types without history or percentiles out of
+// range are refused
+func TestPredict(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+
+	rec, err := metrics.NewLatencyRecorder(rdb, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		rec.Observe("report", lognormal((float64(i)+0.5)/1000))
+	}
+	if err := rec.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	p := predict.NewDurationPredictor(rdb)
+	for _, c := range []struct {
+		percentile float64
+		want       time.Duration
+	}{{0.5, lognormal(0.5)}, {0.95, lognormal(0.95)}} {
+		got, err := p.Predict(ctx, "report", c.percentile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(got-c.want)) > 0.05*float64(c.want) {
+			t.Errorf("P%.0f %v, want %v within 5%%", c.percentile*100, got, c.want)
+		}
+	}
+	if _, err := p.Predict(ctx, "unknown", 0.95); !errors.Is(err, predict.ErrNoHistory) {
+		t.Errorf("unknown type gave %v", err)
+	}
+	for _, bad := range []float64{0, -0.5, 1.5} {
+		if _, err := p.Predict(ctx, "report", bad); err == nil {
+			t.Errorf("percentile %v accepted", bad)
+		}
+	}
+}
+
+// TestInterpolate fails unless percentiles of log-normal data are
+// reproduced exactly between and beyond the known ones, the max caps the
+// estimate and zero percentiles fall back to the nearest known value
+func TestInterpolate(t *testing.T) {
+	ms := func(p float64) float64 { return float64(lognormal(p)) / float64(time.Millisecond) }
+	for _, p := range []float64{0.25, 0.75, 0.95, 0.995} {
+		got := predict.Interpolate(p, ms(0.5), ms(0.9), ms(0.99), 10000)
+		if math.Abs(got-ms(p)) > 0.001*ms(p) {
+			t.Errorf("P%v %.2fms, want %.2fms", p*100, got, ms(p))
+		}
+	}
+	if got := predict.Interpolate(0.999, ms(0.5), ms(0.9), ms(0.99), 300); got != 300 {
+		t.Errorf("estimate %v above the max of 300", got)
+	}
+	if got := predict.Interpolate(1, ms(0.5), ms(0.9), ms(0.99), 300); got != 300 {
+		t.Errorf("P100 %v, want the max", got)
+	}
+	if got := predict.Interpolate(0.6, 0, 40, 50, 60); got != 0 {
+		t.Errorf("P60 with a zero median %v, want the median", got)
+	}
+}
+
+// TestEstimatedCompletion fails unless the estimate is the pending tasks
+// drained at the median dequeue rate of the snapshots plus the median
+// duration, and an empty queue waits for no rate
+func TestEstimatedCompletion(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+
+	rec, err := metrics.NewLatencyRecorder(rdb, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		rec.Observe("report", time.Second)
+	}
+	if err := rec.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	task := asynq.NewTask("report", nil)
+	p := predict.NewDurationPredictor(rdb)
+
+	// Nothing pending: only the duration counts, no snapshots needed
+	if _, err := client.Enqueue(task, asynq.Queue("empty"), asynq.ProcessIn(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	eta, err := p.EstimatedCompletion(ctx, inspector, task, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := eta.Sub(start); d < 950*time.Millisecond || d > 1100*time.Millisecond {
+		t.Errorf("empty queue ETA in %v, want the 1s duration", d)
+	}
+
+	for i := 0; i < 30; i++ {
+		if _, err := client.Enqueue(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.EstimatedCompletion(ctx, inspector, task, "default"); !errors.Is(err, predict.ErrNoHistory) {
+		t.Errorf("queue without snapshots gave %v", err)
+	}
+	// Snapshots 10 minutes apart: 10 and then 20 tasks a minute, then a
+	// counter reset, which is skipped
+	now := time.Now()
+	for i, processed := range []int{0, 100, 300, 50} {
+		at := now.Add(time.Duration(i-4) * 10 * time.Minute)
+		data, err := json.Marshal(audit.QueueSnapshot{At: at, Queue: "default", ProcessedTotal: processed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rdb.ZAdd(ctx, "stats:snapshots:default", redis.Z{Score: float64(at.UnixMilli()), Member: data}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rate, err := p.DequeueRate(ctx, "default"); err != nil || rate != 15 {
+		t.Errorf("dequeue rate %v (%v), want the median of 10 and 20", rate, err)
+	}
+	start = time.Now()
+	eta, err = p.EstimatedCompletion(ctx, inspector, task, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 2*time.Minute + time.Second
+	if d := eta.Sub(start); d < want-50*time.Millisecond || d > want+100*time.Millisecond {
+		t.Errorf("ETA in %v, want 30 tasks at 15/min plus 1s", d)
+	}
+}
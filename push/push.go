@@ -0,0 +1,123 @@
+// Package push sends push notifications. The provider charges per call and
+// accepts up to MaxBatch tokens per call, so the notifications of
+// concurrent tasks are sent together while each task still succeeds or
+// fails on its own.
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"asynqdemo/batcher"
+	"asynqdemo/common"
+	"asynqdemo/quarantine"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TypeSend sends one push notification
+const TypeSend = "push:send"
+
+// MaxBatch is the most notifications the provider accepts per call
+const MaxBatch = 500
+
+// DefaultBatchWait is how long a notification waits for others to share
+// its provider call
+const DefaultBatchWait = 50 * time.Millisecond
+
+// Payload is one notification to a device token
+type Payload struct {
+	UserID int               `json:"user_id"`
+	Token  string            `json:"token"`
+	Title  string            `json:"title"`
+	Body   string            `json:"body"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+var sendOptions = []asynq.Option{asynq.MaxRetry(5), asynq.Timeout(30 * time.Second)}
+
+func init() {
+	common.RegisterTaskSpec(common.TaskSpec{Type: TypeSend, NewPayload: func() interface{} { return &Payload{} }, DefaultOptions: sendOptions})
+}
+
+// NewSendTask creates a task sending p
+func NewSendTask(p Payload) (*asynq.Task, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal push payload: %v", err)
+	}
+	return asynq.NewTask(TypeSend, payload, sendOptions...), nil
+}
+
+// ErrUnregistered is returned by a provider for a token of an uninstalled
+// app; retrying cannot deliver it
+var ErrUnregistered = errors.New("push token is not registered")
+
+// Provider sends notifications in one call, returning the error of each in
+// order, nil when all were sent, or the error of the whole call
+type Provider interface {
+	Send(ctx context.Context, msgs []Payload) ([]error, error)
+}
+
+// LogProvider prints the notifications instead of sending them
+type LogProvider struct{}
+
+// Send prints msgs
+func (LogProvider) Send(ctx context.Context, msgs []Payload) ([]error, error) {
+	fmt.Printf("📲 Push call with %d notifications\n", len(msgs))
+	for _, m := range msgs {
+		fmt.Printf("   → user %d: %s\n", m.UserID, m.Title)
+	}
+	return nil, nil
+}
+
+// Handler handles TypeSend tasks through a batcher; run it as a component
+// so shutdown flushes the notifications waiting for a batch
+type Handler struct {
+	Batcher *batcher.Batcher[Payload]
+}
+
+// NewHandler creates a handler sending through provider, waiting at most
+// wait for a batch to fill
+func NewHandler(provider Provider, wait time.Duration, reg prometheus.Registerer) (*Handler, error) {
+	b, err := batcher.New("push", MaxBatch, wait, func(ctx context.Context, msgs []Payload) []error {
+		errs, err := provider.Send(ctx, msgs)
+		if err == nil {
+			return errs
+		}
+		errs = make([]error, len(msgs))
+		for i := range errs {
+			errs[i] = fmt.Errorf("failed to send push notifications: %v", err)
+		}
+		return errs
+	}, reg)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{Batcher: b}, nil
+}
+
+// ProcessTask sends the task's notification with those of concurrent tasks
+func (h *Handler) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	var p Payload
+	if err := quarantine.DecodeJSON(t, &p); err != nil {
+		return err
+	}
+	if p.Token == "" {
+		return fmt.Errorf("push notification to user %d has no token: %w", p.UserID, asynq.SkipRetry)
+	}
+	err := h.Batcher.Do(ctx, p)
+	if errors.Is(err, ErrUnregistered) {
+		return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+	}
+	return err
+}
+
+// Run flushes the pending notifications once ctx is done
+func (h *Handler) Run(ctx context.Context) error {
+	return h.Batcher.Run(ctx)
+}
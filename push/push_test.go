@@ -0,0 +1,188 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/push"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pushRecorder is a push provider recording its calls; tokens starting
+// with "gone" are unregistered
+type pushRecorder struct {
+	mu    sync.Mutex
+	calls [][]push.Payload
+}
+
+func (r *pushRecorder) Send(ctx context.Context, msgs []push.Payload) ([]error, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, msgs)
+	r.mu.Unlock()
+	var errs []error
+	for i, m := range msgs {
+		if strings.HasPrefix(m.Token, "gone") {
+			if errs == nil {
+				errs = make([]error, len(msgs))
+			}
+			errs[i] = fmt.Errorf("%w: %s", push.ErrUnregistered, m.Token)
+		}
+	}
+	return errs, nil
+}
+
+// take returns the sizes of the calls since the last take, sorted
+func (r *pushRecorder) take() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sizes := make([]int, len(r.calls))
+	for i, c := range r.calls {
+		sizes[i] = len(c)
+	}
+	r.calls = nil
+	sort.Ints(sizes)
+	return sizes
+}
+
+// TestPushBatching runs concurrent push handler invocations and fails
+// unless their notifications are sent in provider calls of at most the
+// batch size, each invocation gets the result of its own token, a batch is
+// sent before the earliest deadline of its tasks and on shutdown, a
+// cancelled task leaves its batch, and the flushes are counted by reason.
+func TestPushBatching(t *testing.T) {
+	provider := &pushRecorder{}
+	reg := prometheus.NewRegistry()
+	h, err := push.NewHandler(provider, 200*time.Millisecond, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Batcher.MaxSize = 10
+	process := func(ctx context.Context, token string) error {
+		task, err := push.NewSendTask(push.Payload{UserID: 1, Token: token, Title: "Hi"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.ProcessTask(ctx, task)
+	}
+	// run processes a task per token concurrently and returns their errors
+	run := func(ctx context.Context, tokens ...string) map[string]error {
+		var (
+			mu   sync.Mutex
+			wg   sync.WaitGroup
+			errs = make(map[string]error, len(tokens))
+		)
+		for _, token := range tokens {
+			wg.Add(1)
+			go func(token string) {
+				defer wg.Done()
+				err := process(ctx, token)
+				mu.Lock()
+				errs[token] = err
+				mu.Unlock()
+			}(token)
+		}
+		wg.Wait()
+		return errs
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// 25 tasks fill two batches and the last is sent after the wait
+	var tokens []string
+	for i := 0; i < 25; i++ {
+		prefix := "device"
+		if i%4 == 0 {
+			prefix = "gone"
+		}
+		tokens = append(tokens, fmt.Sprintf("%s-%d", prefix, i))
+	}
+	for token, err := range run(ctx, tokens...) {
+		gone := strings.HasPrefix(token, "gone")
+		switch {
+		case gone && (!errors.Is(err, push.ErrUnregistered) || !errors.Is(err, asynq.SkipRetry) || !strings.Contains(err.Error(), ": "+token+":")):
+			t.Errorf("%s got %v, want its own unregistered error without retries", token, err)
+		case !gone && err != nil:
+			t.Errorf("%s got %v, want success", token, err)
+		}
+	}
+	if got := provider.take(); fmt.Sprint(got) != "[5 10 10]" {
+		t.Errorf("25 notifications were sent in calls of %v, want [5 10 10]", got)
+	}
+
+	// A task due in 1.5s is sent a second before its deadline, not after the wait
+	h.Batcher.MaxWait = time.Hour
+	short, cancelShort := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancelShort()
+	started := time.Now()
+	if err := process(short, "device-short"); err != nil {
+		t.Errorf("task near its deadline got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("task near its deadline was sent after %v", elapsed)
+	}
+	if got := provider.take(); fmt.Sprint(got) != "[1]" {
+		t.Errorf("task near its deadline was sent in calls of %v, want [1]", got)
+	}
+
+	// Shutdown sends the waiting tasks but not the cancelled one
+	runCtx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		h.Run(runCtx)
+		close(stopped)
+	}()
+	cancelled, cancelTask := context.WithCancel(ctx)
+	waiting := make(chan map[string]error)
+	go func() { waiting <- run(ctx, "device-a", "device-b", "device-c") }()
+	go func() { waiting <- run(cancelled, "device-cancelled") }()
+	time.Sleep(100 * time.Millisecond)
+	cancelTask()
+	if err := (<-waiting)["device-cancelled"]; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled task got %v, want context.Canceled", err)
+	}
+	stop()
+	for token, err := range <-waiting {
+		if err != nil {
+			t.Errorf("%s got %v on shutdown, want success", token, err)
+		}
+	}
+	<-stopped
+	if err := process(ctx, "device-late"); err != nil {
+		t.Errorf("task after shutdown got %v", err)
+	}
+	if got := provider.take(); fmt.Sprint(got) != "[1 3]" {
+		t.Errorf("shutdown sent calls of %v, want [1 3]", got)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushes := map[string]float64{}
+	var batches uint64
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch f.GetName() {
+			case "asynq_batch_flushes_total":
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "reason" {
+						flushes[l.GetValue()] = m.GetCounter().GetValue()
+					}
+				}
+			case "asynq_batch_size":
+				batches = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	if want := map[string]float64{"size": 2, "wait": 1, "deadline": 1, "shutdown": 2}; fmt.Sprint(flushes) != fmt.Sprint(want) || batches != 6 {
+		t.Errorf("flushes counted %v in %d batches, want %v in 6", flushes, batches, want)
+	}
+}
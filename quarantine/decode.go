@@ -0,0 +1,44 @@
+// Package quarantine classifies payloads that cannot be decoded, counts
+// them per task type, and keeps their raw bytes in the quarantine queue,
+// which no worker consumes, for inspection with `admin quarantine list`.
+package quarantine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hibiken/asynq"
+)
+
+// Encodings a payload passes through, in the order workers decode them
+const (
+	EncodingEnvelope  = "envelope"
+	EncodingEncrypted = "encrypted"
+	EncodingJSON      = "json"
+)
+
+// ErrDecode is returned for a payload that cannot be decoded. It wraps
+// asynq.SkipRetry, since the same bytes fail again, and its message starts
+// with the code payload_decode_failed to tell garbage apart from business
+// failures among the archived tasks.
+type ErrDecode struct {
+	TaskType string
+	Encoding string
+	Err      error
+}
+
+func (e ErrDecode) Error() string {
+	return fmt.Sprintf("payload_decode_failed: %s payload of %s: %v", e.Encoding, e.TaskType, e.Err)
+}
+
+func (e ErrDecode) Unwrap() []error {
+	return []error{asynq.SkipRetry, e.Err}
+}
+
+// DecodeJSON unmarshals the payload of t into v, failing with ErrDecode
+func DecodeJSON(t *asynq.Task, v interface{}) error {
+	if err := json.Unmarshal(t.Payload(), v); err != nil {
+		return ErrDecode{TaskType: t.Type(), Encoding: EncodingJSON, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package quarantine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// Queue holds the quarantined payloads. It is paused, like the trash, so a
+// worker consuming it by mistake does not drain it.
+const Queue = "quarantine"
+
+// TypeQuarantined is the task type of a quarantined payload
+const TypeQuarantined = "quarantine:payload"
+
+// countsTTL keeps the daily counts for a week
+const countsTTL = 7 * 24 * time.Hour
+
+// countsKey is the hash of the decode failures per task type on day
+func countsKey(day time.Time) string {
+	return "quarantine:counts:" + day.UTC().Format("2006-01-02")
+}
+
+// Entry is the payload of a quarantine task
+type Entry struct {
+	TaskType      string    `json:"task_type"`
+	TaskID        string    `json:"task_id"`
+	Queue         string    `json:"queue"`
+	Encoding      string    `json:"encoding"`
+	Error         string    `json:"error"`
+	Raw           []byte    `json:"raw"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// Quarantine routes tasks failing with ErrDecode to the quarantine queue
+type Quarantine struct {
+	client   *asynq.Client
+	rdb      redis.UniversalClient
+	failures *prometheus.CounterVec
+}
+
+// New creates a quarantine enqueuing with client
+func New(client *asynq.Client, rdb redis.UniversalClient, reg prometheus.Registerer) (*Quarantine, error) {
+	q := &Quarantine{
+		client: client,
+		rdb:    rdb,
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "asynq_payload_decode_failures_total",
+			Help: "Tasks whose payload could not be decoded, by task type and the encoding that failed.",
+		}, []string{"task_type", "encoding"}),
+	}
+	if err := reg.Register(q.failures); err != nil {
+		return nil, fmt.Errorf("failed to register quarantine metrics: %v", err)
+	}
+	return q, nil
+}
+
+// Middleware quarantines the raw payload of tasks failing with ErrDecode,
+// as enqueued, so encrypted payloads stay encrypted. Install it before the
+// metadata and decrypt middlewares.
+func (q *Quarantine) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			err := next.ProcessTask(ctx, t)
+			var decode ErrDecode
+			if !errors.As(err, &decode) {
+				return err
+			}
+			e := Entry{TaskType: t.Type(), Encoding: decode.Encoding, Error: err.Error(), Raw: t.Payload(), QuarantinedAt: time.Now().UTC()}
+			e.TaskID, _ = asynq.GetTaskID(ctx)
+			e.Queue, _ = asynq.GetQueueName(ctx)
+			// Use a fresh context so an expired task deadline does not lose the payload
+			if qerr := q.Add(context.Background(), e); qerr != nil {
+				log.Printf("⚠️  %v", qerr)
+			}
+			return err
+		})
+	}
+}
+
+// Add counts e and enqueues it to the quarantine queue, once per task ID
+func (q *Quarantine) Add(ctx context.Context, e Entry) error {
+	q.failures.WithLabelValues(e.TaskType, e.Encoding).Inc()
+	key := countsKey(e.QuarantinedAt)
+	pipe := q.rdb.Pipeline()
+	pipe.HIncrBy(ctx, key, e.TaskType, 1)
+	pipe.Expire(ctx, key, countsTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("⚠️  Failed to count the decode failure of %s: %v", e.TaskType, err)
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode quarantine entry: %v", err)
+	}
+	// asynq's PauseQueue fails when the queue already is, so the flag is set directly
+	if err := q.rdb.SetNX(ctx, fmt.Sprintf("asynq:{%s}:paused", Queue), time.Now().Unix(), 0).Err(); err != nil {
+		return fmt.Errorf("failed to pause quarantine queue: %v", err)
+	}
+	opts := []asynq.Option{asynq.Queue(Queue), asynq.MaxRetry(0)}
+	if e.TaskID != "" {
+		opts = append(opts, asynq.TaskID("quarantine-"+e.TaskID))
+	}
+	_, err = q.client.EnqueueContext(ctx, asynq.NewTask(TypeQuarantined, payload), opts...)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to quarantine %s task %s: %v", e.TaskType, e.TaskID, err)
+	}
+	return nil
+}
+
+// List returns up to n quarantined entries, oldest first
+func List(inspector *asynq.Inspector, n int) ([]Entry, error) {
+	tasks, err := inspector.ListPendingTasks(Queue, asynq.PageSize(n))
+	if err != nil && !errors.Is(err, asynq.ErrQueueNotFound) {
+		return nil, fmt.Errorf("failed to list quarantined tasks: %v", err)
+	}
+	entries := make([]Entry, 0, len(tasks))
+	for _, t := range tasks {
+		var e Entry
+		if err := json.Unmarshal(t.Payload, &e); err != nil {
+			return nil, fmt.Errorf("quarantined task %s: %v", t.ID, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Counts returns the decode failures per task type on day
+func Counts(ctx context.Context, rdb redis.UniversalClient, day time.Time) (map[string]int64, error) {
+	fields, err := rdb.HGetAll(ctx, countsKey(day)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decode failures: %v", err)
+	}
+	counts := make(map[string]int64, len(fields))
+	for taskType, v := range fields {
+		var n int64
+		fmt.Sscan(v, &n)
+		counts[taskType] = n
+	}
+	return counts, nil
+}
+
+// Summary alerts once a day when the previous day had more than Threshold
+// decode failures
+type Summary struct {
+	rdb       redis.UniversalClient
+	alert     func(ctx context.Context, text string) error
+	Threshold int64
+	Interval  time.Duration
+}
+
+// NewSummary creates a daily summary alerting through alert over threshold
+func NewSummary(rdb redis.UniversalClient, threshold int64, alert func(ctx context.Context, text string) error) *Summary {
+	return &Summary{rdb: rdb, alert: alert, Threshold: threshold, Interval: time.Hour}
+}
+
+// Check sends the summary of the day before now unless an instance sent it
+// already; it returns the text sent, empty when within the threshold
+func (s *Summary) Check(ctx context.Context, now time.Time) (string, error) {
+	day := now.UTC().AddDate(0, 0, -1)
+	claimed, err := s.rdb.SetNX(ctx, countsKey(day)+":summarized", now.Unix(), countsTTL).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to claim the quarantine summary: %v", err)
+	}
+	if !claimed {
+		return "", nil
+	}
+	counts, err := Counts(ctx, s.rdb, day)
+	if err != nil {
+		return "", err
+	}
+	var total int64
+	types := make([]string, 0, len(counts))
+	for taskType, n := range counts {
+		total += n
+		types = append(types, taskType)
+	}
+	if total <= s.Threshold {
+		return "", nil
+	}
+	sort.Slice(types, func(i, j int) bool { return counts[types[i]] > counts[types[j]] })
+	lines := make([]string, 0, len(types))
+	for _, taskType := range types {
+		lines = append(lines, fmt.Sprintf("%s: %d", taskType, counts[taskType]))
+	}
+	text := fmt.Sprintf("%d task payloads could not be decoded on %s and were quarantined (%s); see `admin quarantine list`", total, day.Format("2006-01-02"), strings.Join(lines, ", "))
+	log.Printf("⚠️  %s", text)
+	if s.alert != nil {
+		if err := s.alert(ctx, text); err != nil {
+			return text, fmt.Errorf("failed to send the quarantine summary: %v", err)
+		}
+	}
+	return text, nil
+}
+
+// Run checks for a summary every interval until ctx is done
+func (s *Summary) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Check(ctx, time.Now()); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
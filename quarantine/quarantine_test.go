@@ -0,0 +1,151 @@
+package quarantine_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/crypto"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metadata"
+	"asynqdemo/quarantine"
+	"asynqdemo/validation"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestQuarantine runs a worker with the payload middlewares in the
+// order main installs them against an embedded Redis, and enqueues an email
+// whose envelope, encryption or JSON is malformed. It fails unless each
+// is archived without retries as payload_decode_failed with its encoding,
+// copied as enqueued to the quarantine queue, counted per type and
+// encoding, and reported once by the daily summary over its threshold,
+// while a valid email is processed.
+func TestQuarantine(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	reg := prometheus.NewRegistry()
+	q, err := quarantine.New(client, rdb, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor := crypto.NewPayloadEncryptor(crypto.NewTenantKeys("default", "", nil, nil), nil)
+	handler := asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		var p common.EmailPayload
+		return quarantine.DecodeJSON(task, &p)
+	})
+	chain := q.Middleware()(metadata.Middleware()(encryptor.Middleware()(validation.ValidationMiddleware(validation.DefaultRegistry())(handler))))
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 2, Queues: map[string]int{"default": 1}})
+	if err := worker.Start(chain); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	malformed := map[string][]byte{
+		quarantine.EncodingJSON:      []byte(`{"user_id": 1, "email": `),
+		quarantine.EncodingEnvelope:  []byte(`{"_meta": 5, "_payload": {"user_id": 1}}`),
+		quarantine.EncodingEncrypted: []byte("ENC2\x00"),
+	}
+	ids := make(map[string]string)
+	for encoding, payload := range malformed {
+		info, err := client.Enqueue(asynq.NewTask(common.TypeEmailTask, payload), asynq.MaxRetry(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[info.ID] = encoding
+	}
+	valid, err := metadata.NewTask(common.TypeEmailTask, []byte(`{"user_id":1,"email":"a@example.com","subject":"s","message":"m"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Enqueue(valid, asynq.Retention(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info, err := inspector.GetQueueInfo("default")
+		if err == nil && info.Archived == len(malformed) && info.Completed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the malformed emails were not archived and the valid one completed: %+v", info)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	archived, err := inspector.ListArchivedTasks("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range archived {
+		encoding := ids[task.ID]
+		if want := "payload_decode_failed: " + encoding + " "; !strings.HasPrefix(task.LastErr, want) || task.Retried != 0 {
+			t.Errorf("%s payload archived after %d retries with %q, want no retry and %q", encoding, task.Retried, task.LastErr, want)
+		}
+	}
+
+	entries, err := quarantine.List(inspector, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(malformed) {
+		t.Fatalf("got %d quarantined payloads, want %d", len(entries), len(malformed))
+	}
+	for _, e := range entries {
+		if ids[e.TaskID] != e.Encoding || !bytes.Equal(e.Raw, malformed[e.Encoding]) || e.Queue != "default" {
+			t.Errorf("quarantine entry %+v does not match the %s payload enqueued as %s", e, ids[e.TaskID], e.TaskID)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["task_type"] == common.TypeEmailTask {
+				counted[labels["encoding"]] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	for encoding := range malformed {
+		if counted[encoding] != 1 {
+			t.Errorf("decode failures of %s counted %v times, want once", encoding, counted[encoding])
+		}
+	}
+
+	var alerts []string
+	summary := quarantine.NewSummary(rdb, 2, func(ctx context.Context, text string) error {
+		alerts = append(alerts, text)
+		return nil
+	})
+	tomorrow := time.Now().Add(24 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := summary.Check(context.Background(), tomorrow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "3 task payloads") || !strings.Contains(alerts[0], common.TypeEmailTask+": 3") {
+		t.Errorf("daily summary alerts: %q, want one reporting 3 %s payloads", alerts, common.TypeEmailTask)
+	}
+}
@@ -0,0 +1,66 @@
+package queues
+
+import (
+	"net/http"
+
+	"asynqdemo/admin"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// ActionPolicy lets operators pause and resume queues and only admins
+// migrate them
+func ActionPolicy(r *http.Request) (string, admin.Role) {
+	seg := admin.PathSegments(r, "/admin/queues/")
+	if len(seg) == 2 && seg[1] == "migrate" {
+		return "queues.migrate", admin.RoleAdmin
+	}
+	return "queues.pause", admin.RoleOperator
+}
+
+// ActionHandler serves queue actions below /admin/queues/:
+//
+//	POST /admin/queues/{queue}/pause
+//	POST /admin/queues/{queue}/resume
+//	POST /admin/queues/{queue}/migrate?to=Q   moves its tasks to queue Q
+func ActionHandler(inspector *asynq.Inspector, client *asynq.Client, rdb redis.UniversalClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seg := admin.PathSegments(r, "/admin/queues/")
+		if len(seg) != 2 {
+			admin.WriteError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodPost {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		queue := seg[0]
+		switch seg[1] {
+		case "pause", "resume":
+			action := inspector.PauseQueue
+			if seg[1] == "resume" {
+				action = inspector.UnpauseQueue
+			}
+			if err := action(queue); err != nil {
+				admin.WriteError(w, http.StatusConflict, err.Error())
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, map[string]string{"queue": queue, "action": seg[1]})
+		case "migrate":
+			to := r.URL.Query().Get("to")
+			if to == "" || to == queue {
+				admin.WriteError(w, http.StatusBadRequest, "expected ?to=<another queue>")
+				return
+			}
+			res, err := Migrate(r.Context(), inspector, client, rdb, queue, to)
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, res)
+		default:
+			admin.WriteError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package queues
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"asynqdemo/admin"
+
+	"github.com/hibiken/asynq"
+)
+
+// settle is how long weights must stay unchanged before a new server is
+// started with them, so that several changes in a row start one
+const settle = time.Second
+
+// DynamicQueues runs an asynq server whose queue weights can change while
+// the worker runs. asynq reads a server's queues when it starts, so on a
+// change Run starts a server with the new weights and then shuts down the
+// previous one, whose in-flight tasks finish. A queue of weight 0 is not
+// consumed by this worker. While the two overlap each has the configured
+// concurrency, so keep a concurrency limiter in the handler.
+type DynamicQueues struct {
+	connOpt asynq.RedisConnOpt
+	cfg     asynq.Config
+
+	mu      sync.RWMutex
+	weights map[string]int
+	changed chan struct{}
+	handler asynq.Handler
+	srv     *asynq.Server
+	applied map[string]int
+}
+
+// NewDynamicQueues wraps the server configuration cfg, starting from the
+// weights of cfg.Queues
+func NewDynamicQueues(connOpt asynq.RedisConnOpt, cfg asynq.Config) *DynamicQueues {
+	weights := make(map[string]int, len(cfg.Queues))
+	for q, w := range cfg.Queues {
+		weights[q] = w
+	}
+	return &DynamicQueues{connOpt: connOpt, cfg: cfg, weights: weights, changed: make(chan struct{})}
+}
+
+// SetWeight changes the weight of queue, adding it if it is new. The
+// server consumes the new weights within a second or two; 0 stops
+// consuming the queue, but at least one queue must keep a positive weight.
+func (d *DynamicQueues) SetWeight(queue string, weight int) error {
+	if strings.TrimSpace(queue) == "" {
+		return errors.New("queue name cannot be empty")
+	}
+	if weight < 0 {
+		return fmt.Errorf("weight of %s must not be negative, got %d", queue, weight)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if weight == 0 {
+		consumed := false
+		for q, w := range d.weights {
+			if q != queue && w > 0 {
+				consumed = true
+			}
+		}
+		if !consumed {
+			return fmt.Errorf("cannot set %s to 0: it is the last queue consumed", queue)
+		}
+	}
+	if w, ok := d.weights[queue]; ok && w == weight {
+		return nil
+	}
+	d.weights[queue] = weight
+	close(d.changed)
+	d.changed = make(chan struct{})
+	return nil
+}
+
+// GetWeights returns a copy of the current weights, including those of 0
+func (d *DynamicQueues) GetWeights() map[string]int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	weights := make(map[string]int, len(d.weights))
+	for q, w := range d.weights {
+		weights[q] = w
+	}
+	return weights
+}
+
+// Applied returns the queues of the running server, nil before Start
+func (d *DynamicQueues) Applied() map[string]int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.applied == nil {
+		return nil
+	}
+	applied := make(map[string]int, len(d.applied))
+	for q, w := range d.applied {
+		applied[q] = w
+	}
+	return applied
+}
+
+// consumed returns the weights above 0, the queues a server is started with
+func (d *DynamicQueues) consumed() map[string]int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	queues := make(map[string]int, len(d.weights))
+	for q, w := range d.weights {
+		if w > 0 {
+			queues[q] = w
+		}
+	}
+	return queues
+}
+
+// Start starts a server with the current weights, processing tasks with
+// handler
+func (d *DynamicQueues) Start(handler asynq.Handler) error {
+	d.mu.Lock()
+	d.handler = handler
+	d.mu.Unlock()
+	_, err := d.restart()
+	return err
+}
+
+// restart starts a server with the current weights unless the running one
+// has them, and returns the server it replaced, if any
+func (d *DynamicQueues) restart() (*asynq.Server, error) {
+	queues := d.consumed()
+	d.mu.RLock()
+	handler, running := d.handler, reflect.DeepEqual(queues, d.applied)
+	d.mu.RUnlock()
+	if running {
+		return nil, nil
+	}
+	cfg := d.cfg
+	cfg.Queues = queues
+	srv := asynq.NewServer(d.connOpt, cfg)
+	if err := srv.Start(handler); err != nil {
+		return nil, fmt.Errorf("failed to start server with queues %v: %v", queues, err)
+	}
+	d.mu.Lock()
+	old := d.srv
+	d.srv, d.applied = srv, queues
+	d.mu.Unlock()
+	return old, nil
+}
+
+// Run starts a new server whenever the weights change, after they settled,
+// until ctx is done. It then shuts down the servers, waiting for those
+// still finishing their tasks.
+func (d *DynamicQueues) Run(ctx context.Context) error {
+	var draining sync.WaitGroup
+	defer func() {
+		d.mu.RLock()
+		srv := d.srv
+		d.mu.RUnlock()
+		if srv != nil {
+			srv.Shutdown()
+		}
+		draining.Wait()
+	}()
+	for {
+		d.mu.RLock()
+		changed := d.changed
+		d.mu.RUnlock()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+		// Wait for the weights to settle
+		for settled := false; !settled; {
+			d.mu.RLock()
+			changed = d.changed
+			d.mu.RUnlock()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-changed:
+			case <-time.After(settle):
+				settled = true
+			}
+		}
+		old, err := d.restart()
+		if err != nil {
+			// The running server keeps its weights; the next change tries again
+			log.Printf("⚠️  %v", err)
+			continue
+		}
+		if old != nil {
+			fmt.Printf("⚖️  Queue weights now %v\n", d.Applied())
+			draining.Add(1)
+			go func() {
+				defer draining.Done()
+				old.Shutdown()
+			}()
+		}
+	}
+}
+
+// WeightsHandler serves the weights of d:
+//
+//	GET  /admin/queues/weights   the weights and the queues being consumed
+//	POST /admin/queues/weights   {"queue": "email", "weight": 10}
+func WeightsHandler(d *DynamicQueues) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Queue  string `json:"queue"`
+				Weight *int   `json:"weight"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil {
+				admin.WriteError(w, http.StatusBadRequest, `expected {"queue": "name", "weight": n}`)
+				return
+			}
+			if err := d.SetWeight(req.Queue, *req.Weight); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			log.Printf("⚖️  Weight of queue %s set to %d by %s", req.Queue, *req.Weight, r.RemoteAddr)
+		default:
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]map[string]int{"weights": d.GetWeights(), "consumed": d.Applied()})
+	})
+}
@@ -0,0 +1,121 @@
+package queues_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/queues"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestDynamicQueues runs a DynamicQueues server on an embedded Redis and
+// fails unless weights are validated, a queue set to weight 0 stops
+// being consumed while the others are, and raising its weight again
+// resumes it, all without restarting the worker.
+func TestDynamicQueues(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+
+	var mu sync.Mutex
+	processed := map[string]int{}
+	handler := asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		queue, _ := asynq.GetQueueName(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		processed[queue]++
+		return nil
+	})
+	count := func(queue string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return processed[queue]
+	}
+	enqueue := func(queue string) {
+		t.Helper()
+		if _, err := client.Enqueue(asynq.NewTask("dyn:task", nil), asynq.Queue(queue)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	d := queues.NewDynamicQueues(srv.ConnOpt(), asynq.Config{
+		Concurrency: 2,
+		Queues:      map[string]int{"email": 3, "default": 1},
+		LogLevel:    asynq.WarnLevel,
+	})
+	for _, c := range []struct {
+		queue  string
+		weight int
+	}{{"", 1}, {"email", -1}} {
+		if err := d.SetWeight(c.queue, c.weight); err == nil {
+			t.Errorf("SetWeight(%q, %d) was accepted", c.queue, c.weight)
+		}
+	}
+	if err := d.Start(handler); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	enqueue("email")
+	enqueue("default")
+	waitFor("both queues to be consumed", func() bool { return count("email") == 1 && count("default") == 1 })
+
+	// Weight 0 pauses the queue's selection on this worker only
+	if err := d.SetWeight("email", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetWeight("default", 0); err == nil {
+		t.Error("setting the last consumed queue to 0 was accepted")
+	}
+	if w := d.GetWeights(); !reflect.DeepEqual(w, map[string]int{"email": 0, "default": 1}) {
+		t.Errorf("weights %v after pausing email", w)
+	}
+	waitFor("the weights to apply", func() bool { return reflect.DeepEqual(d.Applied(), map[string]int{"default": 1}) })
+	enqueue("email")
+	enqueue("default")
+	waitFor("the default queue to be consumed", func() bool { return count("default") == 2 })
+	time.Sleep(1500 * time.Millisecond)
+	if count("email") != 1 {
+		t.Errorf("email tasks were processed at weight 0: %d", count("email"))
+	}
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	if info, err := inspector.GetQueueInfo("email"); err != nil || info.Pending != 1 || info.Paused {
+		t.Errorf("email queue at weight 0: %+v (%v), want its task pending and the queue not paused for other workers", info, err)
+	}
+
+	// Raising the weight resumes it
+	if err := d.SetWeight("email", 5); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("email to be consumed again", func() bool { return count("email") == 2 })
+	if a := d.Applied(); !reflect.DeepEqual(a, map[string]int{"email": 5, "default": 1}) {
+		t.Errorf("applied weights %v, want email 5 and default 1", a)
+	}
+}
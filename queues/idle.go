@@ -0,0 +1,267 @@
+package queues
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// idlePausedKey holds the queues paused for idleness, so whichever worker
+// sees work first resumes them and operator pauses are never undone
+const idlePausedKey = "queues:idle-paused"
+
+// pendingPattern matches keyspace events of every queue's pending list
+const pendingPattern = "__keyspace@*__:asynq:{*}:pending"
+
+// IdleWindowFromEnv returns IDLE_PAUSE_WINDOW, zero when idle pausing is off
+func IdleWindowFromEnv() (time.Duration, error) {
+	v := os.Getenv("IDLE_PAUSE_WINDOW")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid IDLE_PAUSE_WINDOW %q", v)
+	}
+	return d, nil
+}
+
+// IdlePauser pauses all but the highest-priority queues once no task was
+// processed for a window, cutting the dequeue polls asynq sends for them,
+// and resumes them as soon as work arrives. Work is noticed through keyspace
+// notifications on the pending lists when Redis sends them (flags K and l),
+// otherwise by polling the lists every PollInterval.
+type IdlePauser struct {
+	rdb       redis.UniversalClient
+	inspector *asynq.Inspector
+	window    time.Duration
+	// activity returns when the last task was processed
+	activity func() time.Time
+	// pausable holds the queues below the top priority, highest first
+	pausable []string
+
+	// PollInterval bounds how long new work waits for a resume without
+	// keyspace notifications
+	PollInterval time.Duration
+	// ResumeStep spaces out resuming successive queues
+	ResumeStep time.Duration
+
+	paused   []string
+	pausedAt time.Time
+	// quietSince is when the current idle window started
+	quietSince time.Time
+}
+
+// NewIdlePauser creates a pauser for the queues and priorities of queueMap
+func NewIdlePauser(rdb redis.UniversalClient, inspector *asynq.Inspector, queueMap map[string]int, window time.Duration, activity func() time.Time) *IdlePauser {
+	top := 0
+	for _, prio := range queueMap {
+		if prio > top {
+			top = prio
+		}
+	}
+	var pausable []string
+	for q, prio := range queueMap {
+		if prio < top {
+			pausable = append(pausable, q)
+		}
+	}
+	sort.Slice(pausable, func(i, j int) bool {
+		if queueMap[pausable[i]] != queueMap[pausable[j]] {
+			return queueMap[pausable[i]] > queueMap[pausable[j]]
+		}
+		return pausable[i] < pausable[j]
+	})
+	return &IdlePauser{
+		rdb:          rdb,
+		inspector:    inspector,
+		window:       window,
+		activity:     activity,
+		pausable:     pausable,
+		PollInterval: 250 * time.Millisecond,
+		ResumeStep:   100 * time.Millisecond,
+	}
+}
+
+// Run pauses and resumes queues until ctx is done, then resumes everything
+// it paused
+func (p *IdlePauser) Run(ctx context.Context) error {
+	// Take over pauses left by a worker that stopped without resuming
+	left, err := p.rdb.SMembers(ctx, idlePausedKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read idle-paused queues: %v", err)
+	}
+	p.paused = p.ordered(left)
+	p.pausedAt = time.Now()
+	p.quietSince = time.Now()
+
+	wake := make(chan struct{}, 1)
+	notified := p.listen(ctx, wake)
+	// With notifications the lists are still polled now and then, in case
+	// an event was missed while reconnecting
+	poll := p.PollInterval
+	if notified {
+		poll = 5 * time.Second
+	}
+	lastPoll := time.Now()
+
+	ticker := time.NewTicker(p.PollInterval)
+	defer ticker.Stop()
+	for {
+		woken := false
+		select {
+		case <-ctx.Done():
+			p.resume(context.Background(), "shutting down")
+			return nil
+		case <-wake:
+			woken = true
+		case <-ticker.C:
+		}
+
+		if len(p.paused) == 0 {
+			if last := p.activity(); last.After(p.quietSince) {
+				p.quietSince = last
+			}
+			if time.Since(p.quietSince) >= p.window {
+				p.pause(ctx)
+			}
+			continue
+		}
+		if last := p.activity(); last.After(p.pausedAt) {
+			p.resume(ctx, "a task was processed")
+			continue
+		}
+		if !woken && time.Since(lastPoll) < poll {
+			continue
+		}
+		lastPoll = time.Now()
+		if q, err := p.pending(ctx); err != nil {
+			log.Printf("⚠️  %v", err)
+		} else if q != "" {
+			p.resume(ctx, fmt.Sprintf("work arrived in %s", q))
+		}
+	}
+}
+
+// pause pauses the pausable queues that hold no work
+func (p *IdlePauser) pause(ctx context.Context) {
+	// Restart the window whatever happens, so a busy fleet is checked once
+	// per window rather than on every tick
+	p.quietSince = time.Now()
+	for _, q := range p.pausable {
+		info, err := p.inspector.GetQueueInfo(q)
+		if err != nil {
+			// Queues asynq has not seen yet have nothing to poll for
+			continue
+		}
+		if info.Paused || info.Pending+info.Active+info.Scheduled+info.Retry > 0 {
+			continue
+		}
+		if err := p.inspector.PauseQueue(q); err != nil {
+			continue
+		}
+		if err := p.rdb.SAdd(ctx, idlePausedKey, q).Err(); err != nil {
+			log.Printf("⚠️  Failed to record idle pause of %s: %v", q, err)
+		}
+		p.paused = append(p.paused, q)
+	}
+	if len(p.paused) > 0 {
+		p.pausedAt = time.Now()
+		fmt.Printf("💤 [Idle] No tasks for %v, paused queues %s\n", p.window, strings.Join(p.paused, ", "))
+	}
+}
+
+// resume unpauses the paused queues, highest priority first, one every
+// ResumeStep. A queue is only unpaused by the worker whose SREM claims it.
+func (p *IdlePauser) resume(ctx context.Context, reason string) {
+	var resumed []string
+	for i, q := range p.paused {
+		if i > 0 {
+			time.Sleep(p.ResumeStep)
+		}
+		n, err := p.rdb.SRem(ctx, idlePausedKey, q).Result()
+		if err != nil {
+			log.Printf("❌ Failed to claim idle-paused queue %s: %v", q, err)
+			continue
+		}
+		if n == 0 {
+			// Another worker resumed it already
+			continue
+		}
+		if err := p.inspector.UnpauseQueue(q); err != nil {
+			log.Printf("⚠️  Failed to resume queue %s: %v", q, err)
+			continue
+		}
+		resumed = append(resumed, q)
+	}
+	p.paused = nil
+	p.quietSince = time.Now()
+	if len(resumed) > 0 {
+		fmt.Printf("⏰ [Idle] Resumed queues %s: %s\n", strings.Join(resumed, ", "), reason)
+	}
+}
+
+// pending returns a paused queue with pending work, "" when there is none
+func (p *IdlePauser) pending(ctx context.Context) (string, error) {
+	pipe := p.rdb.Pipeline()
+	lens := make([]*redis.IntCmd, len(p.paused))
+	for i, q := range p.paused {
+		lens[i] = pipe.LLen(ctx, fmt.Sprintf("asynq:{%s}:pending", q))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", fmt.Errorf("failed to check pending work of paused queues: %v", err)
+	}
+	for i, n := range lens {
+		if n.Val() > 0 {
+			return p.paused[i], nil
+		}
+	}
+	return "", nil
+}
+
+// listen wakes Run on every change of a pending list and reports whether
+// Redis sends the keyspace notifications for that
+func (p *IdlePauser) listen(ctx context.Context, wake chan<- struct{}) bool {
+	cfg, err := p.rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	flags := cfg["notify-keyspace-events"]
+	if err != nil || !strings.Contains(flags, "K") || !strings.ContainsAny(flags, "lA") {
+		fmt.Printf("⚠️  [Idle] Keyspace notifications are off, polling paused queues every %v\n", p.PollInterval)
+		return false
+	}
+	sub := p.rdb.PSubscribe(ctx, pendingPattern)
+	go func() {
+		for range sub.Channel() {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		sub.Close()
+	}()
+	return true
+}
+
+// ordered sorts queues in resume order, dropping those that are not pausable
+func (p *IdlePauser) ordered(queues []string) []string {
+	set := make(map[string]bool, len(queues))
+	for _, q := range queues {
+		set[q] = true
+	}
+	var out []string
+	for _, q := range p.pausable {
+		if set[q] {
+			out = append(out, q)
+		}
+	}
+	return out
+}
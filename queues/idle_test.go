@@ -0,0 +1,83 @@
+package queues_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/queues"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestIdleResume runs an IdlePauser over a critical and a low queue with no
+// processed tasks, waits for the low queue to be paused after the idle
+// window, then enqueues into it and fails unless the queue is resumed
+// within a second.
+func TestIdleResume(t *testing.T) {
+	const window, maxLatency = time.Second, time.Second
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	const critical, low = "idle-critical", "idle-low"
+	rdb, ok := r.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		t.Fatalf("unsupported redis connection %T", r)
+	}
+	defer rdb.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	client := asynq.NewClient(r)
+	defer client.Close()
+
+	// asynq only reports queues that held a task once
+	if _, err := client.Enqueue(asynq.NewTask("idle:probe", nil), asynq.Queue(low)); err != nil {
+		t.Fatalf("failed to create queue %s: %v", low, err)
+	}
+	if _, err := inspector.DeleteAllPendingTasks(low); err != nil {
+		t.Fatalf("failed to empty queue %s: %v", low, err)
+	}
+
+	// Nothing is ever processed, so the worker looks idle throughout
+	pauser := queues.NewIdlePauser(rdb, inspector, map[string]int{critical: 6, low: 1}, window, func() time.Time { return time.Time{} })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- pauser.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if !waitPaused(inspector, low, true, window+5*time.Second) {
+		t.Fatalf("queue %s was not paused within %v of idleness", low, window+5*time.Second)
+	}
+	start := time.Now()
+	if _, err := client.Enqueue(asynq.NewTask("idle:work", nil), asynq.Queue(low)); err != nil {
+		t.Fatalf("failed to enqueue work: %v", err)
+	}
+	if !waitPaused(inspector, low, false, 5*time.Second) {
+		t.Fatalf("queue %s was not resumed within 5s of new work", low)
+	}
+	latency := time.Since(start)
+	t.Logf("queue %s resumed %v after new work", low, latency)
+	if latency > maxLatency {
+		t.Errorf("queue %s resumed after %v, want at most %v", low, latency, maxLatency)
+	}
+}
+
+// waitPaused polls until queue is paused or unpaused as wanted
+func waitPaused(inspector *asynq.Inspector, queue string, paused bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if info, err := inspector.GetQueueInfo(queue); err == nil && info.Paused == paused {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+// Package queues inspects queues and moves tasks between them when the queue
+// layout changes.
+package queues
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// MigrationResult reports what a migration moved
+type MigrationResult struct {
+	From  string         `json:"from"`
+	To    string         `json:"to"`
+	Moved map[string]int `json:"moved"`
+}
+
+func progressKey(from string) string {
+	return "queue-migration:" + from
+}
+
+// Migrate moves the pending, scheduled and retry tasks of queue from to queue
+// to, keeping IDs, process times and options. The old queue is paused while
+// tasks move and unpaused at the end. Each task is copied before it is deleted
+// and a copy that already exists is not copied again, so an interrupted run
+// can simply be started again. Retry counts restart at zero in the new queue.
+func Migrate(ctx context.Context, inspector *asynq.Inspector, client *asynq.Client, rdb redis.UniversalClient, from, to string) (*MigrationResult, error) {
+	info, err := inspector.GetQueueInfo(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get queue %s: %v", from, err)
+	}
+	expected := info.Pending + info.Scheduled + info.Retry
+	if !info.Paused {
+		if err := inspector.PauseQueue(from); err != nil {
+			return nil, fmt.Errorf("failed to pause queue %s: %v", from, err)
+		}
+	}
+	key := progressKey(from)
+	if prev, err := rdb.HGetAll(ctx, key).Result(); err == nil && prev["to"] != "" {
+		if prev["to"] != to {
+			return nil, fmt.Errorf("queue %s has an unfinished migration to %s", from, prev["to"])
+		}
+		moved, _ := strconv.Atoi(prev["moved"])
+		fmt.Printf("🔁 Resuming migration of %s to %s (%d tasks moved before)\n", from, to, moved)
+	}
+	if err := rdb.HSet(ctx, key, "to", to, "started_at", time.Now().Format(time.RFC3339)).Err(); err != nil {
+		return nil, fmt.Errorf("failed to save migration progress: %v", err)
+	}
+
+	res := &MigrationResult{From: from, To: to, Moved: make(map[string]int)}
+	states := []struct {
+		name string
+		list func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error)
+	}{
+		{"pending", inspector.ListPendingTasks},
+		{"scheduled", inspector.ListScheduledTasks},
+		{"retry", inspector.ListRetryTasks},
+	}
+	for _, st := range states {
+		for {
+			// Moved tasks leave the list, so the first page is always the next batch
+			tasks, err := st.list(from, asynq.PageSize(100))
+			if err != nil {
+				return res, fmt.Errorf("failed to list %s tasks of %s: %v", st.name, from, err)
+			}
+			if len(tasks) == 0 {
+				break
+			}
+			for _, t := range tasks {
+				if err := move(ctx, inspector, client, t, to); err != nil {
+					return res, err
+				}
+				res.Moved[st.name]++
+				if err := rdb.HIncrBy(ctx, key, "moved", 1).Err(); err != nil {
+					log.Printf("⚠️  Failed to save migration progress: %v", err)
+				}
+			}
+		}
+	}
+
+	after, err := inspector.GetQueueInfo(from)
+	if err != nil {
+		return res, fmt.Errorf("failed to verify queue %s: %v", from, err)
+	}
+	if left := after.Pending + after.Scheduled + after.Retry; left != 0 {
+		return res, fmt.Errorf("%d tasks still in %s after migration, queue left paused", left, from)
+	}
+	if moved := res.Moved["pending"] + res.Moved["scheduled"] + res.Moved["retry"]; moved < expected {
+		// Only possible when a previous run had moved some already
+		fmt.Printf("ℹ️  Moved %d of %d tasks in this run, the rest moved earlier\n", moved, expected)
+	}
+	if err := inspector.UnpauseQueue(from); err != nil {
+		return res, fmt.Errorf("failed to unpause queue %s: %v", from, err)
+	}
+	if err := rdb.Del(ctx, key).Err(); err != nil {
+		log.Printf("⚠️  Failed to clear migration progress: %v", err)
+	}
+	return res, nil
+}
+
+func move(ctx context.Context, inspector *asynq.Inspector, client *asynq.Client, t *asynq.TaskInfo, to string) error {
+	opts := []asynq.Option{
+		asynq.TaskID(t.ID),
+		asynq.Queue(to),
+		asynq.MaxRetry(t.MaxRetry),
+	}
+	if !t.NextProcessAt.IsZero() && t.State != asynq.TaskStatePending {
+		opts = append(opts, asynq.ProcessAt(t.NextProcessAt))
+	}
+	if t.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(t.Timeout))
+	}
+	if !t.Deadline.IsZero() {
+		opts = append(opts, asynq.Deadline(t.Deadline))
+	}
+	if t.Retention > 0 {
+		opts = append(opts, asynq.Retention(t.Retention))
+	}
+	_, err := client.EnqueueContext(ctx, asynq.NewTask(t.Type, t.Payload), opts...)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to copy task %s to %s: %v", t.ID, to, err)
+	}
+	if err := inspector.DeleteTask(t.Queue, t.ID); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+		return fmt.Errorf("failed to delete task %s from %s: %v", t.ID, t.Queue, err)
+	}
+	return nil
+}
+
+// WarnUnconsumed logs unpaused queues holding tasks that no queue in queueMap
+// consumes
+func WarnUnconsumed(inspector *asynq.Inspector, queueMap map[string]int) {
+	names, err := inspector.Queues()
+	if err != nil {
+		log.Printf("⚠️  Failed to list queues: %v", err)
+		return
+	}
+	sort.Strings(names)
+	for _, q := range names {
+		if _, ok := queueMap[q]; ok {
+			continue
+		}
+		info, err := inspector.GetQueueInfo(q)
+		if err != nil {
+			log.Printf("⚠️  Failed to inspect queue %s: %v", q, err)
+			continue
+		}
+		// Paused queues, like the trash, hold tasks on purpose
+		if info.Paused {
+			continue
+		}
+		if n := info.Pending + info.Scheduled + info.Retry; n > 0 {
+			log.Printf("⚠️  Queue %s holds %d tasks but this worker does not consume it; migrate it with: admin migrate-queues %s=<queue>", q, n, q)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package queues_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/queues"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// failRetries makes n tasks of queue retry tasks by failing them once
+// through a worker that retries after an hour
+func failRetries(t *testing.T, r asynq.RedisConnOpt, client *asynq.Client, inspector *asynq.Inspector, queue string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := client.Enqueue(asynq.NewTask("migrate:retry", []byte(fmt.Sprint(i))), asynq.Queue(queue), asynq.MaxRetry(5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	worker := asynq.NewServer(r, asynq.Config{
+		Queues:         map[string]int{queue: 1},
+		LogLevel:       asynq.FatalLevel,
+		RetryDelayFunc: func(int, error, *asynq.Task) time.Duration { return time.Hour },
+	})
+	if err := worker.Start(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		return fmt.Errorf("fail once")
+	})); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := inspector.GetQueueInfo(queue)
+		if err == nil && info.Retry == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d tasks failed", info.Retry, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestMigrate populates a queue with pending, scheduled and retry tasks,
+// interrupts a migration of it and one of its copies, and fails unless the
+// resumed migration moves every task once with its ID, process time and
+// options, leaves the old queue empty and unpaused, and refuses another
+// target while one is unfinished.
+func TestMigrate(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	rdb := r.MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(r)
+	defer client.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	ctx := context.Background()
+
+	failRetries(t, r, client, inspector, "low", 3)
+	base := time.Now().Add(time.Hour).Truncate(time.Second)
+	for i := 0; i < 20; i++ {
+		opts := []asynq.Option{asynq.Queue("low"), asynq.TaskID(fmt.Sprintf("task-%d", i)), asynq.MaxRetry(i), asynq.Timeout(time.Duration(i+1) * time.Minute)}
+		if i%2 == 0 {
+			opts = append(opts, asynq.ProcessAt(base.Add(time.Duration(i)*time.Minute)))
+		}
+		if _, err := client.Enqueue(asynq.NewTask("migrate:test", []byte(fmt.Sprint(i))), opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := map[string]*asynq.TaskInfo{}
+	for _, list := range []func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error){inspector.ListPendingTasks, inspector.ListScheduledTasks, inspector.ListRetryTasks} {
+		tasks, err := list("low")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ti := range tasks {
+			before[ti.ID] = ti
+		}
+	}
+	if len(before) != 23 {
+		t.Fatalf("populated %d tasks, want 23", len(before))
+	}
+
+	// The run stops at its first copy as Redis goes away under its client,
+	// and a crash left task-0 copied but not deleted
+	gone, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := asynq.NewClient(gone.ConnOpt())
+	defer broken.Close()
+	gone.Close()
+	if _, err := queues.Migrate(ctx, inspector, broken, rdb, "low", "bulk"); err == nil {
+		t.Fatal("interrupted migration reported success")
+	}
+	if _, err := client.Enqueue(asynq.NewTask("migrate:test", []byte("0")), asynq.Queue("bulk"), asynq.TaskID("task-0"), asynq.MaxRetry(0), asynq.Timeout(time.Minute), asynq.ProcessAt(base)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queues.Migrate(ctx, inspector, client, rdb, "low", "other"); err == nil || !strings.Contains(err.Error(), "unfinished migration to bulk") {
+		t.Errorf("migration to another queue during an unfinished one gave %v", err)
+	}
+
+	res, err := queues.Migrate(ctx, inspector, client, rdb, "low", "bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Moved["pending"] != 10 || res.Moved["scheduled"] != 10 || res.Moved["retry"] != 3 {
+		t.Errorf("moved %v, want 10 pending, 10 scheduled and 3 retry", res.Moved)
+	}
+	old, err := inspector.GetQueueInfo("low")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Paused || old.Size != 0 {
+		t.Errorf("old queue paused %v with %d tasks", old.Paused, old.Size)
+	}
+	moved, err := inspector.GetQueueInfo("bulk")
+	if err != nil || moved.Size != 23 {
+		t.Fatalf("new queue holds %d tasks (%v), want 23", moved.Size, err)
+	}
+	for id, was := range before {
+		now, err := inspector.GetTaskInfo("bulk", id)
+		if err != nil {
+			t.Errorf("task %s lost: %v", id, err)
+			continue
+		}
+		if string(now.Payload) != string(was.Payload) || now.MaxRetry != was.MaxRetry || now.Timeout != was.Timeout {
+			t.Errorf("task %s changed from %+v to %+v", id, was, now)
+		}
+		if was.State != asynq.TaskStatePending && !now.NextProcessAt.Equal(was.NextProcessAt) {
+			t.Errorf("task %s processes at %v, want %v", id, now.NextProcessAt, was.NextProcessAt)
+		}
+	}
+	if n, err := rdb.Exists(ctx, "queue-migration:low").Result(); err != nil || n != 0 {
+		t.Errorf("progress of the finished migration kept (%v)", err)
+	}
+}
+
+// TestWarnUnconsumed fails unless a queue holding tasks outside the queue
+// map is warned about, and consumed, paused and empty queues are not
+func TestWarnUnconsumed(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	for _, q := range []string{"default", "stranded", "trash", "drained"} {
+		if _, err := client.Enqueue(asynq.NewTask("migrate:test", nil), asynq.Queue(q)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inspector.PauseQueue("trash"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inspector.DeleteAllPendingTasks("drained"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	queues.WarnUnconsumed(inspector, map[string]int{"default": 1})
+	got := buf.String()
+	if strings.Count(got, "⚠️") != 1 || !strings.Contains(got, "Queue stranded holds 1 tasks") {
+		t.Errorf("warned %q, want only the stranded queue", got)
+	}
+}
@@ -0,0 +1,191 @@
+package queues
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"asynqdemo/admin"
+
+	"github.com/hibiken/asynq"
+)
+
+// DefaultStatsTTL is how long a queue scan is served before Redis is asked again
+const DefaultStatsTTL = 5 * time.Second
+
+// StatsTTLFromEnv returns QUEUE_STATS_TTL, or DefaultStatsTTL when it is unset
+func StatsTTLFromEnv() (time.Duration, error) {
+	v := os.Getenv("QUEUE_STATS_TTL")
+	if v == "" {
+		return DefaultStatsTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid QUEUE_STATS_TTL %q: %v", v, err)
+	}
+	return ttl, nil
+}
+
+// Snapshot is the state of every queue at one point in time
+type Snapshot struct {
+	At     time.Time
+	Queues []*asynq.QueueInfo
+}
+
+// Queue returns the info of queue q, nil when it does not exist
+func (s *Snapshot) Queue(q string) *asynq.QueueInfo {
+	for _, info := range s.Queues {
+		if info.Queue == q {
+			return info
+		}
+	}
+	return nil
+}
+
+// scan is an Inspector scan in progress that later callers wait for
+type scan struct {
+	done chan struct{}
+	snap *Snapshot
+	err  error
+}
+
+// StatsCache serves queue stats for ttl and lets concurrent callers share a
+// single Inspector scan, so dashboards polling several endpoints cost one
+// scan per ttl
+type StatsCache struct {
+	inspector *asynq.Inspector
+	ttl       time.Duration
+
+	mu      sync.Mutex
+	snap    *Snapshot
+	pending *scan
+	scans   int64
+}
+
+// NewStatsCache creates a cache serving scans of inspector for ttl
+func NewStatsCache(inspector *asynq.Inspector, ttl time.Duration) *StatsCache {
+	return &StatsCache{inspector: inspector, ttl: ttl}
+}
+
+// Get returns the cached snapshot while it is younger than the TTL. With fresh
+// set, or once the snapshot expired, it scans the queues, joining a scan that
+// is already running.
+func (c *StatsCache) Get(fresh bool) (*Snapshot, error) {
+	c.mu.Lock()
+	if !fresh && c.snap != nil && time.Since(c.snap.At) < c.ttl {
+		snap := c.snap
+		c.mu.Unlock()
+		return snap, nil
+	}
+	if s := c.pending; s != nil {
+		c.mu.Unlock()
+		<-s.done
+		return s.snap, s.err
+	}
+	s := &scan{done: make(chan struct{})}
+	c.pending = s
+	c.scans++
+	c.mu.Unlock()
+
+	s.snap, s.err = c.scan()
+
+	c.mu.Lock()
+	c.pending = nil
+	if s.err == nil {
+		c.snap = s.snap
+	}
+	c.mu.Unlock()
+	close(s.done)
+	return s.snap, s.err
+}
+
+// Scans returns how many Inspector scans the cache has run
+func (c *StatsCache) Scans() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scans
+}
+
+func (c *StatsCache) scan() (*Snapshot, error) {
+	names, err := c.inspector.Queues()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues: %v", err)
+	}
+	sort.Strings(names)
+	snap := &Snapshot{At: time.Now(), Queues: make([]*asynq.QueueInfo, 0, len(names))}
+	for _, q := range names {
+		info, err := c.inspector.GetQueueInfo(q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get queue %s: %v", q, err)
+		}
+		snap.Queues = append(snap.Queues, info)
+	}
+	return snap, nil
+}
+
+// QueueStats is the JSON view of one queue
+type QueueStats struct {
+	Queue       string `json:"queue"`
+	Paused      bool   `json:"paused"`
+	Size        int    `json:"size"`
+	Pending     int    `json:"pending"`
+	Active      int    `json:"active"`
+	Scheduled   int    `json:"scheduled"`
+	Retry       int    `json:"retry"`
+	Archived    int    `json:"archived"`
+	Completed   int    `json:"completed"`
+	Processed   int    `json:"processed_today"`
+	Failed      int    `json:"failed_today"`
+	LatencyMs   int64  `json:"latency_ms"`
+	MemoryUsage int64  `json:"memory_usage_bytes"`
+}
+
+// StatsResponse is returned by StatsHandler
+type StatsResponse struct {
+	Queues     []QueueStats `json:"queues"`
+	ScannedAt  time.Time    `json:"scanned_at"`
+	AgeSeconds float64      `json:"age_seconds"`
+}
+
+// StatsHandler serves GET requests with the cached stats of every queue;
+// ?fresh=1 scans the queues instead
+func StatsHandler(cache *StatsCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		snap, err := cache.Get(r.URL.Query().Get("fresh") == "1")
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp := StatsResponse{
+			Queues:     make([]QueueStats, 0, len(snap.Queues)),
+			ScannedAt:  snap.At.UTC(),
+			AgeSeconds: time.Since(snap.At).Seconds(),
+		}
+		for _, q := range snap.Queues {
+			resp.Queues = append(resp.Queues, QueueStats{
+				Queue:       q.Queue,
+				Paused:      q.Paused,
+				Size:        q.Size,
+				Pending:     q.Pending,
+				Active:      q.Active,
+				Scheduled:   q.Scheduled,
+				Retry:       q.Retry,
+				Archived:    q.Archived,
+				Completed:   q.Completed,
+				Processed:   q.Processed,
+				Failed:      q.Failed,
+				LatencyMs:   q.Latency.Milliseconds(),
+				MemoryUsage: q.MemoryUsage,
+			})
+		}
+		w.Header().Set("Age", fmt.Sprintf("%d", int(resp.AgeSeconds)))
+		admin.WriteJSON(w, http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,206 @@
+package queues_test
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/queues"
+
+	"github.com/hibiken/asynq"
+)
+
+// slowProxy forwards connections to addr, holding every request for delay,
+// so an Inspector scan through it lasts long enough to be joined
+type slowProxy struct {
+	ln       net.Listener
+	requests atomic.Int64
+	wg       sync.WaitGroup
+}
+
+func startSlowProxy(t *testing.T, addr string, delay time.Duration) *slowProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &slowProxy{ln: ln}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			p.wg.Add(2)
+			go func() {
+				defer p.wg.Done()
+				defer server.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := client.Read(buf)
+					if err != nil {
+						return
+					}
+					p.requests.Add(1)
+					time.Sleep(delay)
+					if _, err := server.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer p.wg.Done()
+				defer client.Close()
+				io.Copy(client, server)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		p.wg.Wait()
+	})
+	return p
+}
+
+// TestStatsCache fails unless callers arriving during a scan, fresh or not,
+// share it, later callers are served the cached snapshot until the TTL
+// passes, and fresh bypasses the cache
+func TestStatsCache(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	for _, q := range []string{"default", "critical", "low"} {
+		if _, err := client.Enqueue(asynq.NewTask("stats:test", nil), asynq.Queue(q)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	proxy := startSlowProxy(t, srv.Addr(), 20*time.Millisecond)
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: proxy.ln.Addr().String()})
+	defer inspector.Close()
+	cache := queues.NewStatsCache(inspector, 300*time.Millisecond)
+
+	first := make(chan *queues.Snapshot, 1)
+	go func() {
+		snap, err := cache.Get(false)
+		if err != nil {
+			t.Error(err)
+		}
+		first <- snap
+	}()
+	for proxy.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The scan takes a round trip per queue and more, 20ms each
+	var wg sync.WaitGroup
+	snaps := make([]*queues.Snapshot, 10)
+	for i := range snaps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			snap, err := cache.Get(i%2 == 0)
+			if err != nil {
+				t.Error(err)
+			}
+			snaps[i] = snap
+		}(i)
+	}
+	wg.Wait()
+	shared := <-first
+	if n := cache.Scans(); n != 1 {
+		t.Fatalf("11 overlapping callers ran %d scans, want 1", n)
+	}
+	for i, snap := range snaps {
+		if snap != shared {
+			t.Errorf("caller %d got its own snapshot", i)
+		}
+	}
+	if len(shared.Queues) != 3 || shared.Queue("critical") == nil || shared.Queue("critical").Pending != 1 {
+		t.Errorf("snapshot %+v", shared.Queues)
+	}
+
+	if snap, _ := cache.Get(false); snap != shared || cache.Scans() != 1 {
+		t.Errorf("cached snapshot not served, %d scans", cache.Scans())
+	}
+	fresh, err := cache.Get(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == shared || !fresh.At.After(shared.At) || cache.Scans() != 2 {
+		t.Errorf("fresh served the cached snapshot, %d scans", cache.Scans())
+	}
+	time.Sleep(300 * time.Millisecond)
+	if snap, _ := cache.Get(false); snap == fresh || cache.Scans() != 3 {
+		t.Errorf("expired snapshot served, %d scans", cache.Scans())
+	}
+}
+
+// TestStatsHandler fails unless the endpoint reports the cached stats with
+// their age and ?fresh=1 scans again
+func TestStatsHandler(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	if _, err := client.Enqueue(asynq.NewTask("stats:test", nil), asynq.ProcessIn(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	cache := queues.NewStatsCache(inspector, time.Hour)
+	h := queues.StatsHandler(cache)
+
+	get := func(path string) (queues.StatsResponse, *httptest.ResponseRecorder) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp queues.StatsResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, rec
+	}
+	resp, rec := get("/admin/queues/stats")
+	if rec.Code != http.StatusOK || len(resp.Queues) != 1 || resp.Queues[0].Queue != "default" || resp.Queues[0].Scheduled != 1 {
+		t.Fatalf("got %d %+v", rec.Code, resp)
+	}
+	scanned := resp.ScannedAt
+
+	time.Sleep(50 * time.Millisecond)
+	resp, rec = get("/admin/queues/stats")
+	if !resp.ScannedAt.Equal(scanned) || resp.AgeSeconds < 0.05 || rec.Header().Get("Age") != "0" || cache.Scans() != 1 {
+		t.Errorf("cached answer scanned at %v, %vs old, Age %q, %d scans", resp.ScannedAt, resp.AgeSeconds, rec.Header().Get("Age"), cache.Scans())
+	}
+	resp, _ = get("/admin/queues/stats?fresh=1")
+	if !resp.ScannedAt.After(scanned) || resp.AgeSeconds >= 0.05 || cache.Scans() != 2 {
+		t.Errorf("fresh answer scanned at %v, %vs old, %d scans", resp.ScannedAt, resp.AgeSeconds, cache.Scans())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/queues/stats", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST gave %d", rec.Code)
+	}
+}
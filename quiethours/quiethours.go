@@ -0,0 +1,228 @@
+// Package quiethours holds marketing and digest email back until the
+// recipient's local time is inside an allowed send window.
+package quiethours
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+)
+
+// Window is the part of the day mail may be sent in, as wall-clock offsets
+// from midnight. A window whose end is before its start spans midnight; one
+// whose end equals its start is open all day.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses "HH:MM-HH:MM", e.g. "09:00-21:00" or "22:00-02:00"
+func ParseWindow(s string) (Window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid window %q, want HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %v", s, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %v", s, err)
+	}
+	return Window{Start: start, End: end}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w Window) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.Start) + "-" + format(w.End)
+}
+
+// clockOf returns the wall-clock time of t as an offset from midnight
+func clockOf(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// contains reports whether the wall-clock time of t is inside the window
+func (w Window) contains(t time.Time) bool {
+	clock := clockOf(t)
+	switch {
+	case w.Start == w.End:
+		return true
+	case w.Start < w.End:
+		return clock >= w.Start && clock < w.End
+	default:
+		return clock >= w.Start || clock < w.End
+	}
+}
+
+// Policy is the send window and fallback time zone of a tenant
+type Policy struct {
+	Window Window
+	// Zone is used for recipients without a known time zone
+	Zone *time.Location
+}
+
+// Config holds the global policy and the tenants overriding it
+type Config struct {
+	Default Policy
+	Tenants map[string]Policy
+}
+
+// ConfigFromEnv reads QUIET_HOURS, the global window ("09:00-21:00" unless
+// only tenants are set), QUIET_HOURS_TZ, the global fallback zone (UTC by
+// default), and QUIET_HOURS_TENANTS, e.g.
+// "acme=08:00-20:00@America/New_York,globex=@Europe/Paris", where either
+// part may be left out to use the global one. It returns nil when neither
+// QUIET_HOURS nor QUIET_HOURS_TENANTS is set.
+func ConfigFromEnv() (*Config, error) {
+	global, tenants := os.Getenv("QUIET_HOURS"), os.Getenv("QUIET_HOURS_TENANTS")
+	if global == "" && tenants == "" {
+		return nil, nil
+	}
+	c := &Config{Default: Policy{Window: Window{Start: 9 * time.Hour, End: 21 * time.Hour}, Zone: time.UTC}, Tenants: make(map[string]Policy)}
+	if global != "" {
+		w, err := ParseWindow(global)
+		if err != nil {
+			return nil, fmt.Errorf("invalid QUIET_HOURS: %v", err)
+		}
+		c.Default.Window = w
+	}
+	if tz := os.Getenv("QUIET_HOURS_TZ"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid QUIET_HOURS_TZ: %v", err)
+		}
+		c.Default.Zone = loc
+	}
+	for _, part := range strings.Split(tenants, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tenant, spec, ok := strings.Cut(part, "=")
+		if !ok || tenant == "" {
+			return nil, fmt.Errorf("invalid QUIET_HOURS_TENANTS entry %q, want tenant=window@zone", part)
+		}
+		p := c.Default
+		window, zone, _ := strings.Cut(spec, "@")
+		if window != "" {
+			w, err := ParseWindow(window)
+			if err != nil {
+				return nil, fmt.Errorf("invalid QUIET_HOURS_TENANTS entry %q: %v", part, err)
+			}
+			p.Window = w
+		}
+		if zone != "" {
+			loc, err := time.LoadLocation(zone)
+			if err != nil {
+				return nil, fmt.Errorf("invalid QUIET_HOURS_TENANTS entry %q: %v", part, err)
+			}
+			p.Zone = loc
+		}
+		c.Tenants[tenant] = p
+	}
+	return c, nil
+}
+
+// Applies reports whether mail of a category waits for the send window;
+// transactional and security mail never does
+func Applies(category string) bool {
+	return category == common.CategoryMarketing || category == common.CategoryDigest
+}
+
+// policy returns the policy of a tenant, the default one for others
+func (c *Config) policy(tenantID string) Policy {
+	if p, ok := c.Tenants[tenantID]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// Location returns the recipient's zone tz, falling back to the tenant's
+// zone when tz is empty or unknown
+func (c *Config) Location(tenantID, tz string) *time.Location {
+	if tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			return loc
+		}
+	}
+	if zone := c.policy(tenantID).Zone; zone != nil {
+		return zone
+	}
+	return time.UTC
+}
+
+// SendAt returns at when it is inside the recipient's window, otherwise
+// the start of the next window. Windows are in wall-clock time, so they
+// follow DST changes of the recipient's zone.
+func (c *Config) SendAt(at time.Time, tenantID, tz string) time.Time {
+	loc := c.Location(tenantID, tz)
+	w := c.policy(tenantID).Window
+	local := at.In(loc)
+	if w.contains(local) {
+		return at
+	}
+	y, m, d := local.Date()
+	for day := 0; day <= 2; day++ {
+		start := time.Date(y, m, d+day, int(w.Start.Hours()), int(w.Start.Minutes())%60, 0, 0, loc)
+		if clockOf(start) != w.Start {
+			start = afterGap(start, time.Date(y, m, d+day, 12, 0, 0, 0, loc), w.Start)
+		}
+		if start.After(at) {
+			return start
+		}
+	}
+	return at
+}
+
+// afterGap returns the first minute the clocks show start or later on the
+// day of noon, when DST skipped start that day. time.Date returns such a
+// skipped time shifted by the size of the gap, to either side of it.
+func afterGap(t, noon time.Time, start time.Duration) time.Time {
+	end := t.Add(2 * time.Hour)
+	for m := t.Add(-2 * time.Hour).Truncate(time.Minute); m.Before(end); m = m.Add(time.Minute) {
+		if m.Day() == noon.Day() && clockOf(m) >= start {
+			return m
+		}
+	}
+	return t
+}
+
+// Options returns opts with a ProcessAt moving the email p into the send
+// window when its category waits for one. The intended time is the last
+// ProcessAt or ProcessIn of opts, now when there is none.
+func (c *Config) Options(p *common.EmailPayload, now time.Time, opts ...asynq.Option) []asynq.Option {
+	if c == nil || !Applies(p.Category) {
+		return opts
+	}
+	at := now
+	for _, o := range opts {
+		switch o.Type() {
+		case asynq.ProcessAtOpt:
+			at = o.Value().(time.Time)
+		case asynq.ProcessInOpt:
+			at = now.Add(o.Value().(time.Duration))
+		}
+	}
+	send := c.SendAt(at, p.TenantID, p.Timezone)
+	if send.Equal(at) {
+		return opts
+	}
+	return append(opts[:len(opts):len(opts)], asynq.ProcessAt(send))
+}
@@ -0,0 +1,79 @@
+package quiethours_test
+
+import (
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/quiethours"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestQuietHours fails unless send times are shifted into the window
+// for unknown time zones (falling back to the tenant's zone), across DST
+// transitions and for windows spanning midnight, and unless transactional
+// and security mail is never held.
+func TestQuietHours(t *testing.T) {
+	load := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skipf("time zone database unavailable: %v", err)
+		}
+		return loc
+	}
+	tokyo, newYork := load("Asia/Tokyo"), load("America/New_York")
+	window := func(s string) quiethours.Window {
+		w, err := quiethours.ParseWindow(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	c := &quiethours.Config{
+		Default: quiethours.Policy{Window: window("09:00-21:00"), Zone: time.UTC},
+		Tenants: map[string]quiethours.Policy{
+			"acme":  {Window: window("09:00-21:00"), Zone: tokyo},
+			"night": {Window: window("22:00-02:00"), Zone: time.UTC},
+			"early": {Window: window("02:30-21:00"), Zone: newYork},
+		},
+	}
+	cases := []struct {
+		name, tenant, tz string
+		at, want         time.Time
+	}{
+		{"unknown zone uses the tenant's", "acme", "Mars/Olympus", time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC), time.Date(2024, 6, 2, 9, 0, 0, 0, tokyo)},
+		{"unknown zone without tenant uses the global one", "", "Mars/Olympus", time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC), time.Date(2024, 6, 2, 9, 0, 0, 0, time.UTC)},
+		{"recipient zone wins", "acme", "America/New_York", time.Date(2024, 6, 1, 14, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 14, 0, 0, 0, time.UTC)},
+		{"DST starts overnight", "", "America/New_York", time.Date(2024, 3, 9, 22, 0, 0, 0, newYork), time.Date(2024, 3, 10, 9, 0, 0, 0, newYork)},
+		{"DST ends overnight", "", "America/New_York", time.Date(2024, 11, 2, 22, 0, 0, 0, newYork), time.Date(2024, 11, 3, 9, 0, 0, 0, newYork)},
+		{"window start skipped by DST", "early", "", time.Date(2024, 3, 10, 0, 0, 0, 0, newYork), time.Date(2024, 3, 10, 3, 0, 0, 0, newYork)},
+		{"midnight window, after midnight", "night", "", time.Date(2024, 6, 1, 1, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 1, 0, 0, 0, time.UTC)},
+		{"midnight window, before midnight", "night", "", time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC), time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC)},
+		{"midnight window, closed", "night", "", time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 22, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		if got := c.SendAt(tc.at, tc.tenant, tc.tz); !got.Equal(tc.want) {
+			t.Errorf("%s: send at %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	now := time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC)
+	for _, category := range []string{"", common.CategoryTransactional, common.CategorySecurity} {
+		p := &common.EmailPayload{Category: category}
+		if opts := c.Options(p, now); len(opts) != 0 {
+			t.Errorf("%q mail was held: %v", category, opts)
+		}
+	}
+	for _, category := range []string{common.CategoryMarketing, common.CategoryDigest} {
+		p := &common.EmailPayload{Category: category}
+		opts := c.Options(p, now, asynq.ProcessIn(time.Hour))
+		if len(opts) != 2 || opts[1].Type() != asynq.ProcessAtOpt {
+			t.Errorf("%q mail outside the window was not held: %v", category, opts)
+			continue
+		}
+		if got, want := opts[1].Value().(time.Time), time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC); !got.Equal(want) {
+			t.Errorf("%q mail held until %v, want %v", category, got, want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package quota enforces per-user task processing quotas.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/metadata"
+	"asynqdemo/middleware"
+	"asynqdemo/pkg/taskclient"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyUserID is the task metadata attribute identifying the user to charge
+const KeyUserID = taskclient.KeyUserID
+
+// ErrQuotaExceeded is returned when a user has used up this month's quota
+type ErrQuotaExceeded struct {
+	UserID int
+	Used   int64
+	Limit  int64
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("monthly quota exceeded for user %d: %d/%d", e.UserID, e.Used, e.Limit)
+}
+
+// Unwrap makes the task skip its retries, which would only be refused again
+// until the month ends
+func (e ErrQuotaExceeded) Unwrap() error {
+	return asynq.SkipRetry
+}
+
+// charge counts a task unless that takes the counter over the limit, and sets
+// the counter to expire at the end of the month when it is created. It
+// returns the tasks counted and 1 if this one was, 0 if it was refused.
+//
+// KEYS[1] counter, ARGV[1] limit, ARGV[2] seconds until the end of the month
+var charge = redis.NewScript(`
+local used = redis.call("INCR", KEYS[1])
+if used == 1 then
+  redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+if used > tonumber(ARGV[1]) then
+  return {redis.call("DECR", KEYS[1]), 0}
+end
+return {used, 1}
+`)
+
+// refund takes back a charge unless the counter has expired since
+//
+// KEYS[1] counter
+var refund = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+  return redis.call("DECR", KEYS[1])
+end
+return 0
+`)
+
+// MonthlyQuota counts processed tasks per user and calendar month (UTC) in
+// Redis. Users without a limit are not counted.
+type MonthlyQuota struct {
+	redis  redis.UniversalClient
+	limits map[int]int64
+}
+
+// NewMonthlyQuota creates a quota with the per-user limits
+func NewMonthlyQuota(rdb redis.UniversalClient, limits map[int]int64) *MonthlyQuota {
+	return &MonthlyQuota{redis: rdb, limits: limits}
+}
+
+// ParseLimits parses limits written as "userID=limit,userID=limit"
+func ParseLimits(s string) (map[int]int64, error) {
+	limits := make(map[int]int64)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		user, limit, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid quota %q, want userID=limit", part)
+		}
+		id, err := strconv.Atoi(user)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID in quota %q: %v", part, err)
+		}
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit in quota %q: %v", part, err)
+		}
+		limits[id] = n
+	}
+	return limits, nil
+}
+
+// Charge counts one task for the user in the month of now. A task over the
+// limit is refused with ErrQuotaExceeded and not counted.
+func (q *MonthlyQuota) Charge(ctx context.Context, userID int, now time.Time) error {
+	limit, ok := q.limits[userID]
+	if !ok {
+		return nil
+	}
+	now = now.UTC()
+	endOfMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := int64(math.Ceil(endOfMonth.Sub(now).Seconds()))
+	res, err := charge.Run(ctx, q.redis, []string{counterKey(userID, now)}, limit, ttl).Int64Slice()
+	if err != nil {
+		return fmt.Errorf("failed to count quota for user %d: %v", userID, err)
+	}
+	if res[1] == 0 {
+		return ErrQuotaExceeded{UserID: userID, Used: res[0], Limit: limit}
+	}
+	return nil
+}
+
+// Refund takes back a task charged at chargedAt that did not succeed
+func (q *MonthlyQuota) Refund(ctx context.Context, userID int, chargedAt time.Time) error {
+	if _, ok := q.limits[userID]; !ok {
+		return nil
+	}
+	if err := refund.Run(ctx, q.redis, []string{counterKey(userID, chargedAt.UTC())}).Err(); err != nil {
+		return fmt.Errorf("failed to refund quota for user %d: %v", userID, err)
+	}
+	return nil
+}
+
+func counterKey(userID int, now time.Time) string {
+	return fmt.Sprintf("quota:%d:%s", userID, now.Format("2006-01"))
+}
+
+// QuotaMiddleware charges the user_id from the task metadata before running
+// the task and refunds the charge when the task fails, so only successful
+// tasks are counted. Install it after metadata.Middleware.
+func QuotaMiddleware(q *MonthlyQuota) middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			v, ok := metadata.FromContext(ctx)[KeyUserID]
+			if !ok {
+				return next.ProcessTask(ctx, t)
+			}
+			userID, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %v", KeyUserID, v, err)
+			}
+			now := common.DepsFrom(ctx).Clock.Now()
+			if err := q.Charge(ctx, userID, now); err != nil {
+				return err
+			}
+			succeeded := false
+			defer func() {
+				if succeeded {
+					return
+				}
+				// The task context may be done already
+				if err := q.Refund(context.WithoutCancel(ctx), userID, now); err != nil {
+					log.Printf("⚠️  %v", err)
+				}
+			}()
+			err = next.ProcessTask(ctx, t)
+			succeeded = err == nil
+			return err
+		})
+	}
+}
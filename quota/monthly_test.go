@@ -0,0 +1,149 @@
+package quota_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/common/clock"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metadata"
+	"asynqdemo/quota"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestQuotaMiddleware fails unless tasks over a user's monthly limit are
+// refused without a retry, failed and panicking tasks are refunded, users
+// without a limit are not counted, and the count starts over in a new month
+func TestQuotaMiddleware(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+
+	fake := clock.NewFake(time.Date(2024, 1, 31, 23, 58, 0, 0, time.UTC))
+	ctx := common.WithDeps(context.Background(), common.Deps{Clock: fake})
+	q := quota.NewMonthlyQuota(rdb, map[int]int64{7: 2, 8: 1})
+	var ran int
+	h := quota.QuotaMiddleware(q)(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		ran++
+		switch string(t.Payload()) {
+		case "fail":
+			return errors.New("smtp down")
+		case "panic":
+			panic("handler bug")
+		}
+		return nil
+	}))
+	run := func(userID int, payload string) (err error) {
+		t.Helper()
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New("panicked")
+			}
+		}()
+		md := metadata.Metadata{quota.KeyUserID: strconv.Itoa(userID)}
+		return h.ProcessTask(metadata.WithMetadata(ctx, md), asynq.NewTask("quota:test", []byte(payload)))
+	}
+	used := func(userID int, month string) string {
+		v, _ := rdb.Get(ctx, "quota:"+strconv.Itoa(userID)+":"+month).Result()
+		return v
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := run(7, "ok"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ran = 0
+	err = run(7, "ok")
+	var exceeded quota.ErrQuotaExceeded
+	if !errors.As(err, &exceeded) || exceeded != (quota.ErrQuotaExceeded{UserID: 7, Used: 2, Limit: 2}) || ran != 0 {
+		t.Fatalf("third task gave %v, ran %d; want the quota exceeded", err, ran)
+	}
+	if !errors.Is(err, asynq.SkipRetry) {
+		t.Error("exceeded quota is retried")
+	}
+	if got := used(7, "2024-01"); got != "2" {
+		t.Errorf("user 7 used %s after a refused task, want 2", got)
+	}
+	if ttl := rdb.TTL(ctx, "quota:7:2024-01").Val(); ttl != 2*time.Minute {
+		t.Errorf("counter expires in %v, want at the end of the month", ttl)
+	}
+
+	if err := run(8, "fail"); err == nil {
+		t.Fatal("failing task succeeded")
+	}
+	if err := run(8, "panic"); err == nil {
+		t.Fatal("panicking task succeeded")
+	}
+	if got := used(8, "2024-01"); got != "0" {
+		t.Errorf("user 8 used %s after failures, want them refunded", got)
+	}
+	if err := run(8, "ok"); err != nil {
+		t.Errorf("user 8 refused after refunds: %v", err)
+	}
+
+	if err := run(9, "ok"); err != nil || used(9, "2024-01") != "" {
+		t.Errorf("user without a limit gave %v and was counted", err)
+	}
+	ran = 0
+	if err := h.ProcessTask(ctx, asynq.NewTask("quota:test", []byte("ok"))); err != nil || ran != 1 {
+		t.Errorf("task without a user gave %v", err)
+	}
+
+	// A new month
+	fake.Advance(3 * time.Minute)
+	srv.FastForward(3 * time.Minute)
+	if err := run(7, "ok"); err != nil {
+		t.Fatalf("user 7 refused in February: %v", err)
+	}
+	if used(7, "2024-01") != "" || used(7, "2024-02") != "1" {
+		t.Errorf("counters January %q, February %q", used(7, "2024-01"), used(7, "2024-02"))
+	}
+}
+
+// TestChargeConcurrent charges one user from many goroutines and fails
+// unless exactly the limit is let through
+func TestChargeConcurrent(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+
+	q := quota.NewMonthlyQuota(rdb, map[int]int64{7: 10})
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := q.Charge(context.Background(), 7, now); err == nil {
+				allowed.Add(1)
+			} else if !errors.As(err, new(quota.ErrQuotaExceeded)) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed.Load() != 10 {
+		t.Errorf("%d charges allowed, want 10", allowed.Load())
+	}
+	if ttl := rdb.TTL(context.Background(), "quota:7:2024-03").Val(); ttl <= 0 {
+		t.Errorf("counter has no expiry (%v)", ttl)
+	}
+}
@@ -0,0 +1,247 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"asynqdemo/circuit"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// ErrUnavailable is returned by a fail-closed limiter when Redis cannot be reached
+var ErrUnavailable = errors.New("rate limiter state unavailable")
+
+// workerTTL is how long a worker counts as sharing the bucket after its last
+// round trip
+const workerTTL = time.Minute
+
+// tokenBucket refills the bucket from the elapsed time since the last call and
+// grants up to the requested number of tokens. Redis' own clock is used so all
+// workers agree on time. The calling worker is recorded in the same hash and
+// the number of workers seen within the TTL is returned with the grant.
+//
+// KEYS[1] bucket hash, ARGV[1] tokens per second, ARGV[2] burst, ARGV[3] requested,
+// ARGV[4] worker ID, ARGV[5] worker TTL in milliseconds
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local requested = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[5])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil then
+  tokens = burst
+  last = now
+end
+
+tokens = math.min(burst, tokens + (now - last) * rate / 1000)
+local granted = math.min(requested, math.floor(tokens))
+tokens = tokens - granted
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now, "worker:" .. ARGV[4], now)
+local workers = 0
+local fields = redis.call("HGETALL", KEYS[1])
+for i = 1, #fields, 2 do
+  if string.sub(fields[i], 1, 7) == "worker:" then
+    if now - tonumber(fields[i + 1]) > ttl then
+      redis.call("HDEL", KEYS[1], fields[i])
+    else
+      workers = workers + 1
+    end
+  end
+end
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + ttl)
+return {granted, workers}
+`)
+
+// Config configures a shared token bucket
+type Config struct {
+	// Key is the Redis key holding the bucket state
+	Key string
+	// Rate is the number of tokens added per second across all workers
+	Rate float64
+	// Burst is the bucket capacity
+	Burst int
+	// Batch is how many tokens a worker reserves per Redis round trip
+	Batch int
+	// Reservation is how long reserved tokens stay usable locally
+	Reservation time.Duration
+	// Workers is the number of workers assumed to share the bucket until
+	// Redis reports how many do, 1 if unset
+	Workers int
+	// FailClosed denies work when Redis is unavailable instead of falling back
+	// to a purely local limiter at the worker's share of Rate
+	FailClosed bool
+	// RetryAfter is how long tasks denied by a fail-closed limiter wait
+	// before their retry, 30s if unset
+	RetryAfter time.Duration
+}
+
+// Limiter is a token bucket whose state lives in Redis, so it is shared by all
+// workers and survives restarts. Tokens are reserved from Redis in small
+// batches to avoid a round trip per task. While Redis is unavailable each
+// worker falls back to a local bucket holding its share of the rate, as
+// divided among the workers Redis last reported.
+type Limiter struct {
+	rdb redis.UniversalClient
+	cfg Config
+	id  string
+
+	mu         sync.Mutex
+	reserved   int
+	reservedAt time.Time
+	workers    int
+	fallback   *rate.Limiter
+	lastWarn   time.Time
+}
+
+// New creates a limiter, filling in defaults for Burst, Batch and Reservation
+func New(rdb redis.UniversalClient, cfg Config) (*Limiter, error) {
+	if cfg.Key == "" {
+		return nil, fmt.Errorf("rate limiter key is required")
+	}
+	if cfg.Rate <= 0 {
+		return nil, fmt.Errorf("rate limiter rate must be positive, got %v", cfg.Rate)
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(cfg.Rate) + 1
+	}
+	if cfg.Batch <= 0 {
+		cfg.Batch = 5
+	}
+	if cfg.Batch > cfg.Burst {
+		cfg.Batch = cfg.Burst
+	}
+	if cfg.Reservation <= 0 {
+		cfg.Reservation = time.Second
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = 30 * time.Second
+	}
+	l := &Limiter{
+		rdb: rdb,
+		cfg: cfg,
+		id:  uuid.NewString(),
+	}
+	l.share(cfg.Workers)
+	return l, nil
+}
+
+// share sizes the local fallback to this worker's share of the bucket
+func (l *Limiter) share(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers == l.workers {
+		return
+	}
+	l.workers = workers
+	burst := l.cfg.Burst / workers
+	if burst < 1 {
+		burst = 1
+	}
+	l.fallback = rate.NewLimiter(rate.Limit(l.cfg.Rate/float64(workers)), burst)
+}
+
+// Workers returns the number of workers the bucket is shared by, as last
+// reported by Redis
+func (l *Limiter) Workers() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.workers
+}
+
+// Allow takes one token if one is available
+func (l *Limiter) Allow(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.reserved > 0 && time.Since(l.reservedAt) < l.cfg.Reservation {
+		l.reserved--
+		return true, nil
+	}
+	l.reserved = 0
+
+	res, err := tokenBucket.Run(ctx, l.rdb, []string{l.cfg.Key},
+		l.cfg.Rate, l.cfg.Burst, l.cfg.Batch, l.id, workerTTL.Milliseconds()).Int64Slice()
+	if err == nil && len(res) != 2 {
+		err = fmt.Errorf("unexpected token bucket reply %v", res)
+	}
+	if err != nil {
+		if l.cfg.FailClosed {
+			return false, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		if time.Since(l.lastWarn) > time.Minute {
+			log.Printf("⚠️  Rate limiter %s falling back to local limits of %v/s: %v",
+				l.cfg.Key, l.cfg.Rate/float64(l.workers), err)
+			l.lastWarn = time.Now()
+		}
+		return l.fallback.Allow(), nil
+	}
+	granted := int(res[0])
+	l.share(int(res[1]))
+	if granted == 0 {
+		return false, nil
+	}
+	l.reserved = granted - 1
+	l.reservedAt = time.Now()
+	return true, nil
+}
+
+// Wait blocks until a token is available or ctx is done
+func (l *Limiter) Wait(ctx context.Context) error {
+	interval := time.Duration(float64(time.Second) / l.cfg.Rate)
+	if interval > 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	for {
+		ok, err := l.Allow(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Middleware makes tasks of the given types wait for a token before running.
+// Tasks denied by a fail-closed limiter are retried after Config.RetryAfter.
+func Middleware(l *Limiter, taskTypes ...string) asynq.MiddlewareFunc {
+	limited := make(map[string]bool, len(taskTypes))
+	for _, t := range taskTypes {
+		limited[t] = true
+	}
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			if limited[t.Type()] {
+				if err := l.Wait(ctx); errors.Is(err, ErrUnavailable) {
+					return circuit.ErrRetryAfter{Err: fmt.Errorf("rate limit %s: %w", l.cfg.Key, err), After: l.cfg.RetryAfter}
+				} else if err != nil {
+					return fmt.Errorf("rate limit %s: %v", l.cfg.Key, err)
+				}
+			}
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/ratelimit"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// startRedis starts an embedded Redis, which the caller closes, and a
+// client that fails at once when it is gone
+func startRedis(t *testing.T) (*embeddedredis.Server, redis.UniversalClient) {
+	t.Helper()
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: srv.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { rdb.Close() })
+	return srv, rdb
+}
+
+func newLimiter(t *testing.T, rdb redis.UniversalClient, cfg ratelimit.Config) *ratelimit.Limiter {
+	t.Helper()
+	l, err := ratelimit.New(rdb, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// drain takes tokens until the limiter refuses one and returns how many it got
+func drain(t *testing.T, l *ratelimit.Limiter) int {
+	t.Helper()
+	n := 0
+	for {
+		ok, err := l.Allow(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return n
+		}
+		n++
+		if n > 1000 {
+			t.Fatal("limiter never refused a token")
+		}
+	}
+}
+
+// TestRestart drains the bucket, restarts the limiter mid-window and fails
+// unless the restarted limiter gets no fresh burst and keeps to the rate
+func TestRestart(t *testing.T) {
+	srv, rdb := startRedis(t)
+	defer srv.Close()
+	cfg := ratelimit.Config{Key: "ratelimit:test", Rate: 20, Burst: 20, Batch: 5}
+
+	if n := drain(t, newLimiter(t, rdb, cfg)); n < 20 || n > 22 {
+		t.Fatalf("first run got %d tokens, want the burst of 20", n)
+	}
+	restarted := newLimiter(t, rdb, cfg)
+	if n := drain(t, restarted); n > 1 {
+		t.Errorf("restart got a burst of %d tokens", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	n := 0
+	for restarted.Wait(ctx) == nil {
+		n++
+	}
+	if n > 12 {
+		t.Errorf("%d tokens in 500ms after the restart, want at most 10 at 20/s", n)
+	}
+}
+
+// TestFallbackShare fails unless a worker losing Redis falls back to its
+// share of the bucket among the workers Redis reported, or the configured
+// number of workers when it never reached Redis
+func TestFallbackShare(t *testing.T) {
+	srv, rdb := startRedis(t)
+	cfg := ratelimit.Config{Key: "ratelimit:test", Rate: 1, Burst: 10, Batch: 1}
+	a, b := newLimiter(t, rdb, cfg), newLimiter(t, rdb, cfg)
+	for _, l := range []*ratelimit.Limiter{a, b, a} {
+		if _, err := l.Allow(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Workers() != 2 || b.Workers() != 2 {
+		t.Fatalf("workers %d and %d, want 2", a.Workers(), b.Workers())
+	}
+
+	srv.Close()
+	if n := drain(t, a); n != 5 {
+		t.Errorf("fallback gave %d tokens, want half the burst of 10", n)
+	}
+	cfg.Workers = 4
+	if n := drain(t, newLimiter(t, rdb, cfg)); n != 2 {
+		t.Errorf("fallback without Redis gave %d tokens, want a quarter of the burst", n)
+	}
+}
+
+// TestFailClosed fails unless a fail-closed limiter without Redis refuses
+// tasks with a retry after Config.RetryAfter and never runs them
+func TestFailClosed(t *testing.T) {
+	srv, rdb := startRedis(t)
+	l := newLimiter(t, rdb, ratelimit.Config{Key: "ratelimit:test", Rate: 10, FailClosed: true, RetryAfter: 5 * time.Second})
+	srv.Close()
+
+	ran := false
+	h := ratelimit.Middleware(l, "email:send")(asynq.HandlerFunc(func(context.Context, *asynq.Task) error {
+		ran = true
+		return nil
+	}))
+	err := h.ProcessTask(context.Background(), asynq.NewTask("email:send", nil))
+	var ra circuit.ErrRetryAfter
+	if !errors.As(err, &ra) || ra.After != 5*time.Second || !errors.Is(err, ratelimit.ErrUnavailable) || ran {
+		t.Fatalf("got %v, ran %v; want a retry after 5s", err, ran)
+	}
+	delay := circuit.RetryDelay(func(int, error, *asynq.Task) time.Duration { return time.Second })
+	if d := delay(1, err, asynq.NewTask("email:send", nil)); d != 5*time.Second {
+		t.Errorf("retry delay %v, want 5s", d)
+	}
+	if err := h.ProcessTask(context.Background(), asynq.NewTask("sms:send", nil)); err != nil || !ran {
+		t.Errorf("unlimited type gave %v, ran %v", err, ran)
+	}
+}
@@ -0,0 +1,146 @@
+package redisconn_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/redisconn"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// aclStub stands in for Redis ACLs: it denies the commands in deny with
+// NOPERM, as Redis does, and answers ACL WHOAMI with user
+type aclStub struct {
+	user string
+	deny map[string]bool
+}
+
+func (aclStub) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (s aclStub) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		name := strings.ToUpper(cmd.Name())
+		if name == "ACL" {
+			cmd.(*redis.Cmd).SetVal(s.user)
+			return nil
+		}
+		if s.deny[name] {
+			err := errors.New("NOPERM this user has no permissions to run the '" + strings.ToLower(name) + "' command")
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (aclStub) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// TestACLUsername fails unless REDIS_USERNAME and REDIS_PASSWORD, or their
+// files, set the credentials of every connection mode, the URL's user is
+// kept and summaries never show the password
+func TestACLUsername(t *testing.T) {
+	dir := t.TempDir()
+	userFile, passFile := filepath.Join(dir, "user"), filepath.Join(dir, "pass")
+	os.WriteFile(userFile, []byte("worker\n"), 0o600)
+	os.WriteFile(passFile, []byte("s3cret\n"), 0o600)
+
+	for mode, vars := range map[string]map[string]string{
+		"client":   {"REDIS_ADDR": "redis:6379"},
+		"failover": {"REDIS_MASTER_NAME": "main", "REDIS_SENTINEL_ADDRS": "s1:26379"},
+		"cluster":  {"REDIS_CLUSTER_ADDRS": "n1:6379,n2:6379"},
+		"url":      {"REDIS_URL": "redis://other@redis:6379/1"},
+	} {
+		for _, creds := range []map[string]string{
+			{"REDIS_USERNAME": "worker", "REDIS_PASSWORD": "s3cret"},
+			{"REDIS_USERNAME_FILE": userFile, "REDIS_PASSWORD_FILE": passFile},
+		} {
+			opt, err := redisconn.FromLookup(func(name string) string {
+				if v, ok := creds[name]; ok {
+					return v
+				}
+				return vars[name]
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			var user, pass string
+			switch o := opt.(type) {
+			case asynq.RedisClientOpt:
+				user, pass = o.Username, o.Password
+			case asynq.RedisFailoverClientOpt:
+				user, pass = o.Username, o.Password
+			case asynq.RedisClusterClientOpt:
+				user, pass = o.Username, o.Password
+			}
+			if user != "worker" || pass != "s3cret" {
+				t.Errorf("%s with %v authenticates as %q/%q", mode, creds, user, pass)
+			}
+			if s := redisconn.Summarize(opt); s.Username != "worker" || s.Password != redisconn.Redacted {
+				t.Errorf("%s summary %+v", mode, s)
+			}
+		}
+	}
+	opt, err := redisconn.FromLookup(func(name string) string {
+		return map[string]string{"REDIS_URL": "redis://reader:pw@redis:6379"}[name]
+	})
+	if c, ok := opt.(asynq.RedisClientOpt); err != nil || !ok || c.Username != "reader" || c.Password != "pw" {
+		t.Errorf("URL credentials gave %#v (%v)", opt, err)
+	}
+	if _, err := redisconn.FromLookup(func(name string) string {
+		return map[string]string{"REDIS_USERNAME_FILE": filepath.Join(dir, "missing")}[name]
+	}); err == nil || !strings.Contains(err.Error(), "REDIS_USERNAME_FILE") {
+		t.Errorf("missing username file gave %v", err)
+	}
+}
+
+// TestCheckPermissions fails unless a user allowed everything passes, and a
+// user denied commands gets an error naming the user, every denied command
+// and the ACL SETUSER granting them
+func TestCheckPermissions(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			srv.Close()
+		}
+	}()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+
+	if err := redisconn.CheckPermissions(ctx, rdb); err != nil {
+		t.Fatalf("unrestricted user: %v", err)
+	}
+	if n, _ := rdb.Keys(ctx, "asynq:{acl-probe}*").Result(); len(n) != 0 {
+		t.Errorf("probe keys left: %v", n)
+	}
+
+	rdb.AddHook(aclStub{user: "worker", deny: map[string]bool{"EVALSHA": true, "PUBLISH": true}})
+	err = redisconn.CheckPermissions(ctx, rdb)
+	var missing redisconn.ErrMissingPermissions
+	if !errors.As(err, &missing) || missing.User != "worker" || strings.Join(missing.Commands, ",") != "EVALSHA,PUBLISH" {
+		t.Fatalf("restricted user gave %v", err)
+	}
+	want := `redis user "worker" lacks permission for EVALSHA, PUBLISH; grant them with ACL SETUSER worker +evalsha +publish`
+	if err.Error() != want {
+		t.Errorf("message %q, want %q", err, want)
+	}
+
+	srv.Close()
+	stopped = true
+	if err := redisconn.CheckPermissions(ctx, rdb); err == nil || errors.As(err, &missing) {
+		t.Errorf("unreachable Redis gave %v, want a connection error", err)
+	}
+}
@@ -0,0 +1,131 @@
+package redisconn_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/config"
+	"asynqdemo/redisconn"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestClusterConnOpt fails unless the connection options are a
+// RedisClusterClientOpt when cluster nodes are listed or REDIS_ADDR lists
+// several addresses, a RedisClientOpt for a single address, with the
+// password and TLS settings of the environment or config file applied.
+func TestClusterConnOpt(t *testing.T) {
+	lookup := func(vars map[string]string) (asynq.RedisConnOpt, error) {
+		return redisconn.FromLookup(func(name string) string { return vars[name] })
+	}
+
+	opt, err := lookup(map[string]string{"REDIS_ADDR": "redis:6379"})
+	if _, ok := opt.(asynq.RedisClientOpt); err != nil || !ok {
+		t.Errorf("single address gave %#v (%v), want a plain client", opt, err)
+	}
+	opt, err = lookup(map[string]string{"REDIS_ADDR": "n1:7000, n2:7000,n3:7000", "REDIS_PASSWORD": "secret"})
+	if want := (asynq.RedisClusterClientOpt{Addrs: []string{"n1:7000", "n2:7000", "n3:7000"}, Password: "secret"}); err != nil || !reflect.DeepEqual(opt, want) {
+		t.Errorf("several addresses gave %#v (%v), want %#v", opt, err, want)
+	}
+	opt, err = lookup(map[string]string{"REDIS_ADDR": "ignored:6379", "REDIS_CLUSTER_ADDRS": "n1:7000,n2:7000"})
+	if c, ok := opt.(asynq.RedisClusterClientOpt); err != nil || !ok || !reflect.DeepEqual(c.Addrs, []string{"n1:7000", "n2:7000"}) {
+		t.Errorf("REDIS_CLUSTER_ADDRS gave %#v (%v)", opt, err)
+	}
+	opt, err = lookup(map[string]string{"REDIS_MODE": "client", "REDIS_ADDR": "redis:6379", "REDIS_CLUSTER_ADDRS": "n1:7000,n2:7000"})
+	if _, ok := opt.(asynq.RedisClientOpt); err != nil || !ok {
+		t.Errorf("REDIS_MODE=client with cluster nodes gave %#v (%v), want a plain client", opt, err)
+	}
+	if _, err := lookup(map[string]string{"REDIS_CLUSTER_ADDRS": "n1:7000", "REDIS_SENTINEL_ADDRS": "s1:26379"}); err == nil {
+		t.Error("cluster nodes with sentinels were accepted")
+	}
+
+	// TLS applies to every mode, verified against the CA file when given
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, selfSignedPEM(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opt, err = lookup(map[string]string{"REDIS_CLUSTER_ADDRS": "n1:7000,n2:7000", "REDIS_TLS": "true", "REDIS_TLS_CA_FILE": caFile, "REDIS_TLS_SERVER_NAME": "redis.internal"})
+	if c, ok := opt.(asynq.RedisClusterClientOpt); err != nil || !ok || c.TLSConfig == nil || c.TLSConfig.RootCAs == nil || c.TLSConfig.ServerName != "redis.internal" {
+		t.Errorf("cluster over TLS gave %#v (%v)", opt, err)
+	}
+	if s := redisconn.Summarize(opt); s.Mode != "cluster" || !s.TLS {
+		t.Errorf("summary of cluster over TLS %+v", s)
+	}
+	opt, err = lookup(map[string]string{"REDIS_ADDR": "redis:6379", "REDIS_TLS": "true"})
+	if c, ok := opt.(asynq.RedisClientOpt); err != nil || !ok || c.TLSConfig == nil {
+		t.Errorf("plain client over TLS gave %#v (%v)", opt, err)
+	}
+	for name, vars := range map[string]map[string]string{
+		"REDIS_TLS":         {"REDIS_TLS": "yes"},
+		"REDIS_TLS_CA_FILE": {"REDIS_TLS": "true", "REDIS_TLS_CA_FILE": filepath.Join(dir, "missing.pem")},
+	} {
+		if _, err := lookup(vars); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("invalid %s gave %v", name, err)
+		}
+	}
+
+	// The config file picks cluster mode the same way
+	for _, name := range []string{"REDIS_URL", "REDIS_MODE", "REDIS_ADDR", "REDIS_PASSWORD", "REDIS_PASSWORD_FILE", "REDIS_USERNAME",
+		"REDIS_SENTINEL_ADDRS", "REDIS_SENTINELS", "REDIS_CLUSTER_ADDRS", "REDIS_TLS", "REDIS_TLS_CA_FILE", "REDIS_TLS_SERVER_NAME",
+		"REDIS_DB", "REDIS_POOL_SIZE", "WORKER_CONCURRENCY", "QUEUE_WEIGHTS", "SHUTDOWN_TIMEOUT"} {
+		t.Setenv(name, "")
+	}
+	path := filepath.Join(dir, "config.yaml")
+	load := func(content string) (asynq.RedisConnOpt, error) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.ConnOpt()
+	}
+	opt, err = load("redis:\n  cluster_addrs: [n1:7000, n2:7000]\n  password: secret\n  tls: true\n  tls_ca_file: " + caFile + "\n")
+	if c, ok := opt.(asynq.RedisClusterClientOpt); err != nil || !ok || !reflect.DeepEqual(c.Addrs, []string{"n1:7000", "n2:7000"}) ||
+		c.Password != "secret" || c.TLSConfig == nil || c.TLSConfig.RootCAs == nil {
+		t.Errorf("config file with cluster nodes gave %#v (%v)", opt, err)
+	}
+	if _, err := load("redis:\n  cluster_addrs: [n1:7000, n2:7000]\n  db: 1\n"); err == nil || !strings.Contains(err.Error(), "redis.db") {
+		t.Errorf("config file with cluster nodes and a db gave %v", err)
+	}
+	if _, err := load("redis:\n  cluster_addrs: [n1:7000]\n  sentinel_addrs: [s1:26379]\n  master_name: m\n"); err == nil || !strings.Contains(err.Error(), "exclusive") {
+		t.Errorf("config file with cluster nodes and sentinels gave %v", err)
+	}
+}
+
+// selfSignedPEM returns a self-signed CA certificate in PEM form
+func selfSignedPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -0,0 +1,66 @@
+package redisconn
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hibiken/asynq"
+)
+
+// Profile is the Redis connection of an environment
+type Profile struct {
+	// Env is the APP_ENV of the environment, e.g. "production" or "staging"
+	Env     string
+	ConnOpt asynq.RedisConnOpt
+}
+
+// CurrentProfile is the environment of this process: APP_ENV and FromEnv
+func CurrentProfile() (*Profile, error) {
+	opt, err := FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &Profile{Env: os.Getenv("APP_ENV"), ConnOpt: opt}, nil
+}
+
+// LoadProfile reads an env file of another environment, with KEY=VALUE
+// lines of APP_ENV and the REDIS_* variables FromEnv reads. Blank lines and
+// lines starting with # are skipped; values may be quoted.
+func LoadProfile(path string) (*Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open profile: %v", err)
+	}
+	defer f.Close()
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[strings.TrimSpace(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profile: %v", err)
+	}
+	getenv := func(name string) string { return vars[name] }
+	if getenv("REDIS_URL") == "" && getenv("REDIS_ADDR") == "" {
+		return nil, fmt.Errorf("profile %s sets neither REDIS_URL nor REDIS_ADDR", path)
+	}
+	opt, err := FromLookup(getenv)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %v", path, err)
+	}
+	return &Profile{Env: vars["APP_ENV"], ConnOpt: opt}, nil
+}
@@ -0,0 +1,472 @@
+// Package redisconn builds the Redis connection options shared by the worker
+// and the admin CLI from environment variables.
+//
+// In cluster mode asynq puts the queue name in a hash tag, "asynq:{name}:",
+// so all keys of a queue share a slot and its Lua scripts stay on one node.
+// A queue is therefore served by a single node however many the cluster
+// has: spread busy traffic over several queues, whose names hash to
+// different slots, rather than one large queue. Our own keys outside that
+// scheme must not be used together in one multi-key command or transaction
+// unless they share a hash tag, as the ACL probe keys do, or the cluster
+// refuses it with CROSSSLOT. The task markers and histories are tagged with
+// their queue; other keys are not yet, so the worker refuses to start in
+// cluster mode.
+package redisconn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultAddr is used when neither REDIS_URL nor REDIS_ADDR is set
+const DefaultAddr = "localhost:6380"
+
+// FromEnv reads the connection options.
+//
+// REDIS_URL takes precedence and accepts the redis://, rediss:// (TLS),
+// redis-socket:// and redis-sentinel:// forms, e.g.
+// rediss://:password@host:6380/2; the user part of the first three
+// authenticates against the data node, and for sentinel URLs it is the
+// sentinel password. The variables it shadows are listed by Shadowed.
+// Otherwise REDIS_MODE picks client, failover
+// (REDIS_MASTER_NAME and comma-separated REDIS_SENTINEL_ADDRS, or their
+// older names REDIS_MASTER and REDIS_SENTINELS) or cluster (comma-separated
+// REDIS_CLUSTER_ADDRS, or REDIS_ADDR). Without REDIS_MODE it is failover
+// when sentinel addresses are set, cluster when cluster addresses are set
+// or REDIS_ADDR lists several, and client otherwise.
+//
+// REDIS_USERNAME and REDIS_PASSWORD, or REDIS_USERNAME_FILE and
+// REDIS_PASSWORD_FILE for mounted secrets, override the credentials of any
+// mode. Redis 6+ ACL users need both. SENTINEL_PASSWORD, or
+// SENTINEL_PASSWORD_FILE, authenticates against the sentinels.
+//
+// REDIS_TLS=true connects over TLS in any mode, verifying the server
+// against REDIS_TLS_CA_FILE, if set, and REDIS_TLS_SERVER_NAME, if the
+// name differs from the address.
+func FromEnv() (asynq.RedisConnOpt, error) {
+	return FromLookup(os.Getenv)
+}
+
+// FromLookup reads the connection options of FromEnv through getenv, e.g.
+// from a profile of another environment
+func FromLookup(getenv func(string) string) (asynq.RedisConnOpt, error) {
+	username, err := secret(getenv, "REDIS_USERNAME")
+	if err != nil {
+		return nil, err
+	}
+	password, err := secret(getenv, "REDIS_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	sentinelPassword, err := secret(getenv, "SENTINEL_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsFrom(getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	if uri := getenv("REDIS_URL"); uri != "" {
+		opt, err := ParseURL(uri)
+		if err != nil {
+			return nil, err
+		}
+		// rediss:// turns TLS on, verifying the URL's host unless
+		// REDIS_TLS_SERVER_NAME names another, against REDIS_TLS_CA_FILE if set
+		if c, ok := opt.(asynq.RedisClientOpt); ok && c.TLSConfig != nil {
+			if v := getenv("REDIS_TLS"); v == "false" || v == "0" {
+				return nil, fmt.Errorf("REDIS_TLS=%s contradicts the rediss:// REDIS_URL, use redis:// for a plain connection", v)
+			}
+			if tlsConfig, err = tlsFrom(func(name string) string {
+				if name == "REDIS_TLS" {
+					return "true"
+				}
+				return getenv(name)
+			}); err != nil {
+				return nil, err
+			}
+			if tlsConfig.ServerName == "" {
+				tlsConfig.ServerName = c.TLSConfig.ServerName
+			}
+		}
+		return withTLS(withSentinelPassword(withCredentials(opt, username, password), sentinelPassword), tlsConfig), nil
+	}
+
+	addr := getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	sentinels := splitAddrs(firstOf(getenv, "REDIS_SENTINEL_ADDRS", "REDIS_SENTINELS"))
+	nodes := splitAddrs(getenv("REDIS_CLUSTER_ADDRS"))
+	mode := getenv("REDIS_MODE")
+	if mode == "" {
+		switch {
+		case len(sentinels) > 0 && len(nodes) > 0:
+			return nil, fmt.Errorf("REDIS_SENTINEL_ADDRS and REDIS_CLUSTER_ADDRS are exclusive")
+		case len(sentinels) > 0:
+			mode = "failover"
+		case len(nodes) > 0 || len(splitAddrs(addr)) > 1:
+			mode = "cluster"
+		}
+	}
+	var opt asynq.RedisConnOpt
+	switch mode {
+	case "", "client":
+		opt = asynq.RedisClientOpt{Addr: addr}
+	case "failover":
+		master := firstOf(getenv, "REDIS_MASTER_NAME", "REDIS_MASTER")
+		if master == "" || len(sentinels) == 0 {
+			return nil, fmt.Errorf("REDIS_MODE=failover requires REDIS_MASTER_NAME and REDIS_SENTINEL_ADDRS")
+		}
+		opt = asynq.RedisFailoverClientOpt{MasterName: master, SentinelAddrs: sentinels}
+	case "cluster":
+		if len(nodes) == 0 {
+			nodes = splitAddrs(addr)
+		}
+		opt = asynq.RedisClusterClientOpt{Addrs: nodes}
+	default:
+		return nil, fmt.Errorf("unknown REDIS_MODE %q, want client, failover or cluster", mode)
+	}
+	return withTLS(withSentinelPassword(withCredentials(opt, username, password), sentinelPassword), tlsConfig), nil
+}
+
+// tlsFrom returns the TLS config of REDIS_TLS, nil when it is off
+func tlsFrom(getenv func(string) string) (*tls.Config, error) {
+	switch v := getenv("REDIS_TLS"); v {
+	case "", "false", "0":
+		return nil, nil
+	case "true", "1":
+	default:
+		return nil, fmt.Errorf("invalid REDIS_TLS %q, want true or false", v)
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: getenv("REDIS_TLS_SERVER_NAME")}
+	if path := getenv("REDIS_TLS_CA_FILE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read REDIS_TLS_CA_FILE: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("REDIS_TLS_CA_FILE %s holds no PEM certificates", path)
+		}
+	}
+	return cfg, nil
+}
+
+// withTLS sets the TLS config of opt when it is not nil
+func withTLS(opt asynq.RedisConnOpt, cfg *tls.Config) asynq.RedisConnOpt {
+	if cfg == nil {
+		return opt
+	}
+	switch o := opt.(type) {
+	case asynq.RedisClientOpt:
+		o.TLSConfig = cfg
+		return o
+	case asynq.RedisFailoverClientOpt:
+		o.TLSConfig = cfg
+		return o
+	case asynq.RedisClusterClientOpt:
+		o.TLSConfig = cfg
+		return o
+	}
+	return opt
+}
+
+// firstOf returns the first of the variables getenv has a value for
+func firstOf(getenv func(string) string, names ...string) string {
+	for _, name := range names {
+		if v := getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// shadowedByURL are the variables REDIS_URL takes precedence over
+var shadowedByURL = []string{"REDIS_MODE", "REDIS_ADDR", "REDIS_DB", "REDIS_SENTINEL_ADDRS", "REDIS_SENTINELS",
+	"REDIS_MASTER_NAME", "REDIS_MASTER", "REDIS_CLUSTER_ADDRS"}
+
+// Shadowed returns the variables that are set but ignored because
+// REDIS_URL is. The connection is read from, in order of precedence:
+//
+//  1. REDIS_URL
+//  2. REDIS_MODE, REDIS_ADDR and the sentinel and cluster variables
+//  3. the config file
+//  4. DefaultAddr
+//
+// REDIS_USERNAME and REDIS_PASSWORD, and their _FILE forms, override the
+// credentials of any of them, and REDIS_TLS turns on TLS for any.
+func Shadowed(getenv func(string) string) []string {
+	if getenv("REDIS_URL") == "" {
+		return nil
+	}
+	var names []string
+	for _, name := range shadowedByURL {
+		if getenv(name) != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// urlExample is the form REDIS_URL errors suggest
+const urlExample = "rediss://:password@host:6380/2"
+
+// ParseURL is asynq.ParseRedisURI with errors saying how to fix the URL,
+// which never repeat its password, the ACL username, which asynq drops,
+// the default port when the URL has none, and TLS 1.2 at least for
+// rediss:// URLs
+func ParseURL(uri string) (asynq.RedisConnOpt, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		// url.Error repeats the URL, password included
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("invalid REDIS_URL: %v, want e.g. %s", err, urlExample)
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid REDIS_URL %s: no host, want e.g. %s", u.Redacted(), urlExample)
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "6379")
+		}
+		if path := strings.Trim(u.Path, "/"); path != "" {
+			if db, err := strconv.Atoi(path); err != nil || db < 0 {
+				return nil, fmt.Errorf("invalid REDIS_URL %s: the path must be the database number, e.g. /2", u.Redacted())
+			}
+		}
+	case "redis-socket":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid REDIS_URL %s: no socket path, want e.g. redis-socket:///run/redis.sock?db=2", u.Redacted())
+		}
+	case "redis-sentinel":
+		if u.Query().Get("master") == "" {
+			return nil, fmt.Errorf("invalid REDIS_URL %s: no master name, want e.g. redis-sentinel://s1:26379,s2:26379?master=mymaster", u.Redacted())
+		}
+	default:
+		return nil, fmt.Errorf("invalid REDIS_URL %s: unsupported scheme %q, want redis, rediss (TLS), redis-socket or redis-sentinel", u.Redacted(), u.Scheme)
+	}
+	opt, err := asynq.ParseRedisURI(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL %s: %v", u.Redacted(), err)
+	}
+	if c, ok := opt.(asynq.RedisClientOpt); ok {
+		if u.User != nil {
+			c.Username = u.User.Username()
+		}
+		if c.TLSConfig != nil {
+			c.TLSConfig.MinVersion = tls.VersionTLS12
+		}
+		opt = c
+	}
+	return opt, nil
+}
+
+// withCredentials sets the username and password that are not empty
+func withCredentials(opt asynq.RedisConnOpt, username, password string) asynq.RedisConnOpt {
+	switch o := opt.(type) {
+	case asynq.RedisClientOpt:
+		if username != "" {
+			o.Username = username
+		}
+		if password != "" {
+			o.Password = password
+		}
+		return o
+	case asynq.RedisFailoverClientOpt:
+		if username != "" {
+			o.Username = username
+		}
+		if password != "" {
+			o.Password = password
+		}
+		return o
+	case asynq.RedisClusterClientOpt:
+		if username != "" {
+			o.Username = username
+		}
+		if password != "" {
+			o.Password = password
+		}
+		return o
+	}
+	return opt
+}
+
+// withSentinelPassword sets the sentinel password of failover options when
+// it is not empty
+func withSentinelPassword(opt asynq.RedisConnOpt, password string) asynq.RedisConnOpt {
+	if o, ok := opt.(asynq.RedisFailoverClientOpt); ok && password != "" {
+		o.SentinelPassword = password
+		return o
+	}
+	return opt
+}
+
+// Redacted stands in for secrets in reports
+const Redacted = "[redacted]"
+
+// Summary is a loggable view of connection options with the password redacted
+type Summary struct {
+	Mode     string   `json:"mode"`
+	Addrs    []string `json:"addrs"`
+	Master   string   `json:"master,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	// SentinelPassword is redacted like Password
+	SentinelPassword string `json:"sentinel_password,omitempty"`
+	DB               int    `json:"db"`
+	TLS              bool   `json:"tls"`
+}
+
+// Summarize describes opt without exposing its password
+func Summarize(opt asynq.RedisConnOpt) Summary {
+	var s Summary
+	var password string
+	switch o := opt.(type) {
+	case asynq.RedisClientOpt:
+		s = Summary{Mode: "client", Addrs: []string{o.Addr}, Username: o.Username, DB: o.DB, TLS: o.TLSConfig != nil}
+		password = o.Password
+	case asynq.RedisFailoverClientOpt:
+		s = Summary{Mode: "failover", Addrs: o.SentinelAddrs, Master: o.MasterName, Username: o.Username, DB: o.DB, TLS: o.TLSConfig != nil}
+		password = o.Password
+		if o.SentinelPassword != "" {
+			s.SentinelPassword = Redacted
+		}
+	case asynq.RedisClusterClientOpt:
+		s = Summary{Mode: "cluster", Addrs: o.Addrs, Username: o.Username, TLS: o.TLSConfig != nil}
+		password = o.Password
+	default:
+		s = Summary{Mode: fmt.Sprintf("%T", opt)}
+	}
+	if password != "" {
+		s.Password = Redacted
+	}
+	return s
+}
+
+// secret reads NAME, or the file named by NAME_FILE
+func secret(getenv func(string) string, name string) (string, error) {
+	if v := getenv(name); v != "" {
+		return v, nil
+	}
+	path := getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %v", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func splitAddrs(s string) []string {
+	var addrs []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// ErrMissingPermissions lists the commands the connected user may not run
+type ErrMissingPermissions struct {
+	User     string
+	Commands []string
+}
+
+func (e ErrMissingPermissions) Error() string {
+	return fmt.Sprintf("redis user %q lacks permission for %s; grant them with ACL SETUSER %s +%s",
+		e.User, strings.Join(e.Commands, ", "), e.User, strings.ToLower(strings.Join(e.Commands, " +")))
+}
+
+// probeKey lives under asynq's prefix so key patterns granted for asynq cover it
+const probeKey = "asynq:{acl-probe}"
+
+// probes run one representative of each command family asynq uses
+var probes = []struct {
+	command string
+	run     func(ctx context.Context, rdb redis.UniversalClient) error
+}{
+	{"EVAL", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.Eval(ctx, "return 1", []string{probeKey}).Err()
+	}},
+	{"EVALSHA", func(ctx context.Context, rdb redis.UniversalClient) error {
+		// The script is unknown, so a NOSCRIPT error means the call was allowed
+		err := rdb.EvalSha(ctx, "0000000000000000000000000000000000000000", []string{probeKey}).Err()
+		if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			return nil
+		}
+		return err
+	}},
+	{"SET", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.Set(ctx, probeKey, "1", 0).Err()
+	}},
+	{"ZADD", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.ZAdd(ctx, probeKey+":z", redis.Z{Member: "probe"}).Err()
+	}},
+	{"LPUSH", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.LPush(ctx, probeKey+":l", "probe").Err()
+	}},
+	{"HSET", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.HSet(ctx, probeKey+":h", "probe", "1").Err()
+	}},
+	{"SADD", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.SAdd(ctx, probeKey+":s", "probe").Err()
+	}},
+	{"SMEMBERS", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.SMembers(ctx, probeKey+":s").Err()
+	}},
+	{"PUBLISH", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.Publish(ctx, "asynq:cancel", "").Err()
+	}},
+	{"INFO", func(ctx context.Context, rdb redis.UniversalClient) error {
+		// The permission covers every section, so ask for a small one
+		return rdb.Info(ctx, "clients").Err()
+	}},
+	{"DEL", func(ctx context.Context, rdb redis.UniversalClient) error {
+		return rdb.Del(ctx, probeKey, probeKey+":z", probeKey+":l", probeKey+":h", probeKey+":s").Err()
+	}},
+}
+
+// CheckPermissions runs the probe commands and reports those the user is
+// denied by ACLs. Other errors abort the check.
+func CheckPermissions(ctx context.Context, rdb redis.UniversalClient) error {
+	var denied []string
+	for _, p := range probes {
+		err := p.run(ctx, rdb)
+		switch {
+		case err == nil:
+		case strings.HasPrefix(err.Error(), "NOPERM"):
+			denied = append(denied, p.command)
+		default:
+			return fmt.Errorf("failed to check %s permission: %v", p.command, err)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	user, err := rdb.Do(ctx, "ACL", "WHOAMI").Text()
+	if err != nil {
+		user = "default"
+	}
+	return ErrMissingPermissions{User: user, Commands: denied}
+}
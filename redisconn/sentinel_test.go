@@ -0,0 +1,96 @@
+package redisconn_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"asynqdemo/config"
+	"asynqdemo/redisconn"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestSentinelConnOpt fails unless the connection options are a
+// RedisClientOpt without sentinel addresses and a RedisFailoverClientOpt
+// with them, from the environment or the config file, with the master
+// name and sentinel password applied and required settings checked.
+func TestSentinelConnOpt(t *testing.T) {
+	lookup := func(vars map[string]string) (asynq.RedisConnOpt, error) {
+		return redisconn.FromLookup(func(name string) string { return vars[name] })
+	}
+
+	opt, err := lookup(map[string]string{"REDIS_ADDR": "redis:6379", "REDIS_PASSWORD": "secret"})
+	if want := (asynq.RedisClientOpt{Addr: "redis:6379", Password: "secret"}); err != nil || !reflect.DeepEqual(opt, want) {
+		t.Errorf("plain config gave %#v (%v), want %#v", opt, err, want)
+	}
+	opt, err = lookup(map[string]string{
+		"REDIS_ADDR":           "ignored:6379",
+		"REDIS_SENTINEL_ADDRS": "s1:26379, s2:26379,s3:26379",
+		"REDIS_MASTER_NAME":    "mymaster",
+		"REDIS_PASSWORD":       "secret",
+		"SENTINEL_PASSWORD":    "sentinel-secret",
+	})
+	want := asynq.RedisFailoverClientOpt{
+		MasterName:       "mymaster",
+		SentinelAddrs:    []string{"s1:26379", "s2:26379", "s3:26379"},
+		SentinelPassword: "sentinel-secret",
+		Password:         "secret",
+	}
+	if err != nil || !reflect.DeepEqual(opt, want) {
+		t.Errorf("sentinel config gave %#v (%v), want %#v", opt, err, want)
+	}
+	if s := redisconn.Summarize(opt); s.Mode != "failover" || s.SentinelPassword != redisconn.Redacted {
+		t.Errorf("summary of sentinel config %+v", s)
+	}
+	opt, err = lookup(map[string]string{"REDIS_MODE": "failover", "REDIS_SENTINELS": "s1:26379", "REDIS_MASTER": "old"})
+	if f, ok := opt.(asynq.RedisFailoverClientOpt); err != nil || !ok || f.MasterName != "old" {
+		t.Errorf("REDIS_MODE=failover with the older names gave %#v (%v)", opt, err)
+	}
+	opt, err = lookup(map[string]string{"REDIS_MODE": "client", "REDIS_SENTINEL_ADDRS": "s1:26379", "REDIS_MASTER_NAME": "mymaster"})
+	if _, ok := opt.(asynq.RedisClientOpt); err != nil || !ok {
+		t.Errorf("REDIS_MODE=client with sentinels gave %#v (%v), want a plain client", opt, err)
+	}
+	if _, err := lookup(map[string]string{"REDIS_SENTINEL_ADDRS": "s1:26379"}); err == nil || !strings.Contains(err.Error(), "REDIS_MASTER_NAME") {
+		t.Errorf("sentinels without a master name gave %v", err)
+	}
+
+	// The config file selects Sentinel the same way
+	for _, name := range []string{"REDIS_URL", "REDIS_MODE", "REDIS_ADDR", "REDIS_PASSWORD", "REDIS_PASSWORD_FILE", "REDIS_USERNAME",
+		"REDIS_SENTINEL_ADDRS", "REDIS_SENTINELS", "REDIS_MASTER_NAME", "REDIS_MASTER", "SENTINEL_PASSWORD", "SENTINEL_PASSWORD_FILE",
+		"REDIS_DB", "REDIS_POOL_SIZE", "WORKER_CONCURRENCY", "QUEUE_WEIGHTS", "SHUTDOWN_TIMEOUT"} {
+		t.Setenv(name, "")
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(content string) (asynq.RedisConnOpt, error) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.ConnOpt()
+	}
+	opt, err = load("redis:\n  addr: redis:6379\n  db: 1\n")
+	if c, ok := opt.(asynq.RedisClientOpt); err != nil || !ok || c.Addr != "redis:6379" || c.DB != 1 {
+		t.Errorf("config file without sentinels gave %#v (%v)", opt, err)
+	}
+	sentinelFile := "redis:\n  sentinel_addrs: [s1:26379, s2:26379]\n  master_name: mymaster\n  sentinel_password: from-file\n  db: 1\n  pool_size: 5\n"
+	opt, err = load(sentinelFile)
+	f, ok := opt.(asynq.RedisFailoverClientOpt)
+	if err != nil || !ok || f.MasterName != "mymaster" || !reflect.DeepEqual(f.SentinelAddrs, []string{"s1:26379", "s2:26379"}) ||
+		f.SentinelPassword != "from-file" || f.DB != 1 || f.PoolSize != 5 {
+		t.Errorf("config file with sentinels gave %#v (%v)", opt, err)
+	}
+	t.Setenv("SENTINEL_PASSWORD", "from-env")
+	if opt, err = load(sentinelFile); err != nil || opt.(asynq.RedisFailoverClientOpt).SentinelPassword != "from-env" {
+		t.Errorf("SENTINEL_PASSWORD did not override the file: %#v (%v)", opt, err)
+	}
+	if _, err := load("redis:\n  sentinel_addrs: [s1:26379]\n"); err == nil || !strings.Contains(err.Error(), "redis.master_name") {
+		t.Errorf("config file with sentinels and no master gave %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package redrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rules scrub the fields of a payload, named by dotted paths into nested
+// objects such as "address.street". Only fields the payload has are
+// touched.
+type Rules struct {
+	// Remove lists the fields deleted from the copy
+	Remove []string `yaml:"remove"`
+	// Replace maps fields to the fixture values they get in the copy
+	Replace map[string]interface{} `yaml:"replace"`
+}
+
+// Mapping is the scrubbing file of copy-task: rules for every payload, and
+// under types the rules of single task types, applied after them:
+//
+//	remove: [phone]
+//	replace:
+//	  email: qa@example.com
+//	types:
+//	  email:send:
+//	    replace:
+//	      subject: Copied task
+type Mapping struct {
+	Rules `yaml:",inline"`
+	Types map[string]Rules `yaml:"types"`
+}
+
+// LoadMapping reads a mapping file
+func LoadMapping(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scrub mapping: %v", err)
+	}
+	var m Mapping
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to parse scrub mapping %s: %v", path, err)
+	}
+	return &m, nil
+}
+
+// Apply returns payload, a JSON object, scrubbed by the rules of taskType
+func (m *Mapping) Apply(taskType string, payload []byte) ([]byte, error) {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil || obj == nil {
+		return nil, fmt.Errorf("payload is not a JSON object")
+	}
+	for _, rules := range []Rules{m.Rules, m.Types[taskType]} {
+		for _, path := range rules.Remove {
+			if parent, name := lookup(obj, path); parent != nil {
+				delete(parent, name)
+			}
+		}
+		for path, value := range rules.Replace {
+			if parent, name := lookup(obj, path); parent != nil {
+				parent[name] = value
+			}
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// lookup returns the object holding the field at path and its name, nil
+// when the payload has no such field
+func lookup(obj map[string]interface{}, path string) (map[string]interface{}, string) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := obj[part].(map[string]interface{})
+		if !ok {
+			return nil, ""
+		}
+		obj = next
+	}
+	name := parts[len(parts)-1]
+	if _, ok := obj[name]; !ok {
+		return nil, ""
+	}
+	return obj, name
+}
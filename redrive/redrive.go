@@ -0,0 +1,143 @@
+// Package redrive copies a task from the Redis of one environment into
+// another, e.g. a failing production task into staging to reproduce a bug,
+// with its personal data scrubbed on the way.
+package redrive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"asynqdemo/crypto"
+	"asynqdemo/metadata"
+	"asynqdemo/redisconn"
+
+	"github.com/hibiken/asynq"
+)
+
+// Production is the APP_ENV no other environment may copy into
+const Production = "production"
+
+// Metadata keys marking a copy
+const (
+	// KeyCopiedFrom is "env/queue/task ID" of the original task
+	KeyCopiedFrom = "copied_from"
+	// KeyCopiedAt is the RFC 3339 time of the copy
+	KeyCopiedAt = "copied_at"
+)
+
+// ErrDirection is returned for a copy into production from another, or an
+// unnamed, environment
+type ErrDirection struct {
+	From, To string
+}
+
+func (e ErrDirection) Error() string {
+	return fmt.Sprintf("refusing to copy a task from %s into %s", envName(e.From), envName(e.To))
+}
+
+// CheckDirection fails with ErrDirection unless a copy from one APP_ENV into
+// the other is allowed
+func CheckDirection(from, to string) error {
+	if to == Production && from != Production {
+		return ErrDirection{From: from, To: to}
+	}
+	return nil
+}
+
+func envName(env string) string {
+	if env == "" {
+		return "an unnamed environment"
+	}
+	return env
+}
+
+// Copier copies tasks between the Redis of two environments
+type Copier struct {
+	From, To *redisconn.Profile
+	// Queue is the queue of the copies, that of the original when empty
+	Queue string
+	// Mapping scrubs the payloads; nil copies them as they are
+	Mapping *Mapping
+}
+
+// Copy reads the task id of queue in any state and enqueues a copy of it
+// with a new ID, the options of the original and its origin in the
+// metadata
+func (c *Copier) Copy(ctx context.Context, queue, id string) (*asynq.TaskInfo, error) {
+	if err := CheckDirection(c.From.Env, c.To.Env); err != nil {
+		return nil, err
+	}
+	inspector := asynq.NewInspector(c.From.ConnOpt)
+	defer inspector.Close()
+	info, err := inspector.GetTaskInfo(queue, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task %s of %s: %v", id, queue, err)
+	}
+	task, opts, err := c.task(info, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	client := asynq.NewClient(c.To.ConnOpt)
+	defer client.Close()
+	copied, err := client.EnqueueContext(ctx, task, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue copy of task %s: %v", id, err)
+	}
+	return copied, nil
+}
+
+// task returns the copy of info and its options
+func (c *Copier) task(info *asynq.TaskInfo, now time.Time) (*asynq.Task, []asynq.Option, error) {
+	payload, md := metadata.Unwrap(info.Payload)
+	if crypto.IsEncrypted(payload) {
+		return nil, nil, fmt.Errorf("task %s is encrypted with keys of %s and cannot be copied", info.ID, envName(c.From.Env))
+	}
+	if !json.Valid(payload) {
+		return nil, nil, fmt.Errorf("task %s does not have a JSON payload", info.ID)
+	}
+	if c.Mapping != nil {
+		var err error
+		if payload, err = c.Mapping.Apply(info.Type, payload); err != nil {
+			return nil, nil, fmt.Errorf("failed to scrub task %s: %v", info.ID, err)
+		}
+	}
+	marked := make(metadata.Metadata, len(md)+2)
+	for k, v := range md {
+		marked[k] = v
+	}
+	marked[KeyCopiedFrom] = fmt.Sprintf("%s/%s/%s", c.From.Env, info.Queue, info.ID)
+	marked[KeyCopiedAt] = now.UTC().Format(time.RFC3339)
+	task, err := metadata.NewTask(info.Type, payload, marked)
+	if err != nil {
+		return nil, nil, err
+	}
+	return task, Options(info, c.Queue, now), nil
+}
+
+// Options returns the enqueue options of a copy of info into queue, that of
+// info when empty. A deadline or process time already past is dropped, so
+// the copy runs now.
+func Options(info *asynq.TaskInfo, queue string, now time.Time) []asynq.Option {
+	if queue == "" {
+		queue = info.Queue
+	}
+	opts := []asynq.Option{asynq.Queue(queue), asynq.MaxRetry(info.MaxRetry)}
+	if info.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(info.Timeout))
+	}
+	if info.Deadline.After(now) {
+		opts = append(opts, asynq.Deadline(info.Deadline))
+	}
+	if info.Retention > 0 {
+		opts = append(opts, asynq.Retention(info.Retention))
+	}
+	if info.Group != "" {
+		opts = append(opts, asynq.Group(info.Group))
+	}
+	if info.State == asynq.TaskStateScheduled && info.NextProcessAt.After(now) {
+		opts = append(opts, asynq.ProcessAt(info.NextProcessAt))
+	}
+	return opts
+}
@@ -0,0 +1,127 @@
+package redrive_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metadata"
+	"asynqdemo/redisconn"
+	"asynqdemo/redrive"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestCopyTask copies tasks between two embedded Redis instances and
+// fails unless a copy keeps the type, options and metadata of the
+// original in any state under a new ID with its origin marked, its payload is scrubbed
+// by the mapping, and copies into production from staging or an unnamed
+// environment are refused.
+func TestCopyTask(t *testing.T) {
+	var profiles []*redisconn.Profile
+	for _, env := range []string{"production", "staging"} {
+		srv, err := embeddedredis.Start("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		// The source is read from an env file as copy-task --from does
+		path := filepath.Join(t.TempDir(), env+".env")
+		if err := os.WriteFile(path, []byte("# "+env+"\nAPP_ENV="+env+"\nREDIS_URL=\"redis://"+srv.Addr()+"\"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		profile, err := redisconn.LoadProfile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		profiles = append(profiles, profile)
+	}
+	prod, staging := profiles[0], profiles[1]
+	ctx := context.Background()
+
+	client := asynq.NewClient(prod.ConnOpt)
+	defer client.Close()
+	payload := []byte(`{"user_id":7,"email":"jane@example.com","subject":"Your invoice","message":"Hi Jane","profile":{"phone":"+1 555 0100","city":"Lyon"}}`)
+	task, err := metadata.NewTask(common.TypeEmailTask, payload, metadata.Metadata{"user_id": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	original, err := client.Enqueue(task, asynq.Queue("critical"), asynq.MaxRetry(7), asynq.Timeout(2*time.Minute), asynq.Retention(time.Hour), asynq.ProcessAt(processAt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappingFile := filepath.Join(t.TempDir(), "scrub.yaml")
+	mapping := "remove: [profile.phone, missing.field]\nreplace:\n  email: qa@example.com\n  unknown: x\ntypes:\n  " + common.TypeEmailTask + ":\n    replace:\n      message: Fixture message\n"
+	if err := os.WriteFile(mappingFile, []byte(mapping), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := redrive.LoadMapping(mappingFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copier := &redrive.Copier{From: prod, To: staging, Mapping: m}
+	copied, err := copier.Copy(ctx, "critical", original.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector := asynq.NewInspector(staging.ConnOpt)
+	defer inspector.Close()
+	info, err := inspector.GetTaskInfo("critical", copied.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case info.ID == original.ID:
+		t.Errorf("copy kept the task ID %s", info.ID)
+	case info.Type != common.TypeEmailTask || info.MaxRetry != 7 || info.Timeout != 2*time.Minute || info.Retention != time.Hour:
+		t.Errorf("copy is %s with max retry %d, timeout %v, retention %v; want the options of the original", info.Type, info.MaxRetry, info.Timeout, info.Retention)
+	case info.State != asynq.TaskStateScheduled || !info.NextProcessAt.Equal(processAt):
+		t.Errorf("copy is %s for %s, want scheduled for %s", info.State, info.NextProcessAt, processAt)
+	}
+	inner, md := metadata.Unwrap(info.Payload)
+	if md[redrive.KeyCopiedFrom] != "production/critical/"+original.ID || md[redrive.KeyCopiedAt] == "" || md["user_id"] != "7" {
+		t.Errorf("copy metadata is %v, want the original's with its origin", md)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(inner, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"user_id": 7.0, "email": "qa@example.com", "subject": "Your invoice", "message": "Fixture message", "profile": map[string]interface{}{"city": "Lyon"}}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("scrubbed payload is %s, want %s", gotJSON, wantJSON)
+	}
+
+	// An archived task is copied too, and runs right away
+	prodInspector := asynq.NewInspector(prod.ConnOpt)
+	defer prodInspector.Close()
+	if err := prodInspector.ArchiveTask("critical", original.ID); err != nil {
+		t.Fatal(err)
+	}
+	again, err := copier.Copy(ctx, "critical", original.ID)
+	if err != nil || again.State != asynq.TaskStatePending || again.ID == copied.ID {
+		t.Errorf("copy of the archived task is %+v (%v), want a new pending task", again, err)
+	}
+
+	// Nothing goes into production but from production
+	for _, from := range []*redisconn.Profile{staging, {ConnOpt: staging.ConnOpt}} {
+		back := &redrive.Copier{From: from, To: prod}
+		var dir redrive.ErrDirection
+		if _, err := back.Copy(ctx, "critical", copied.ID); !errors.As(err, &dir) {
+			t.Errorf("copy from %q into production got %v, want ErrDirection", from.Env, err)
+		}
+	}
+	if q, err := prodInspector.GetQueueInfo("critical"); err != nil || q.Size != 1 {
+		t.Errorf("production has %+v (%v), want only the original", q, err)
+	}
+}
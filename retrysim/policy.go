@@ -0,0 +1,159 @@
+// Package retrysim replays the failure timelines of the event log against a
+// candidate retry configuration, to see how the failures would have played
+// out before MaxRetry, backoff or maintenance windows change. It is pure
+// computation: nothing is read from or written to Redis.
+package retrysim
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/common"
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultMaxRetry is asynq's retry count of tasks enqueued without MaxRetry
+const DefaultMaxRetry = 25
+
+// RetryDelay is the Config.RetryDelayFunc of the workers: a feature flag's
+// delay, else the policy delay policy returns with asynq's default as its
+// fallback, stretched to a provider's Retry-After. The workers run it with
+// common.RetryDelay and simulations with the policies of a Config, so the
+// two cannot drift apart.
+func RetryDelay(policy func(fallback asynq.RetryDelayFunc) asynq.RetryDelayFunc) asynq.RetryDelayFunc {
+	return flags.RetryDelay(circuit.RetryDelay(policy(asynq.DefaultRetryDelayFunc)))
+}
+
+// Window is a maintenance window: no task runs from Start until End
+type Window struct {
+	Start time.Time `yaml:"start" json:"start"`
+	End   time.Time `yaml:"end" json:"end"`
+}
+
+// Config is a retry configuration to replay timelines under
+type Config struct {
+	// Policies by task type; types without one retry DefaultMaxRetry times
+	// with asynq's default delays
+	Policies map[string]common.RetryPolicy
+	// Maintenance holds the retries due in a window until it ends
+	Maintenance []Window
+}
+
+// CurrentConfig is the configuration of the workers: the registered retry
+// policies and no maintenance windows
+func CurrentConfig() Config {
+	c := Config{Policies: map[string]common.RetryPolicy{}}
+	for _, spec := range common.TaskSpecs() {
+		if spec.RetryPolicy != nil {
+			c.Policies[spec.Type] = *spec.RetryPolicy
+		}
+	}
+	return c
+}
+
+// policyFile is the YAML of a candidate configuration
+type policyFile struct {
+	Policies map[string]struct {
+		MaxRetries   *int           `yaml:"max_retries"`
+		InitialDelay *time.Duration `yaml:"initial_delay"`
+		Multiplier   *float64       `yaml:"multiplier"`
+		MaxDelay     *time.Duration `yaml:"max_delay"`
+		Jitter       *bool          `yaml:"jitter"`
+		MaxTotal     *time.Duration `yaml:"max_total"`
+	} `yaml:"policies"`
+	Maintenance []Window `yaml:"maintenance"`
+}
+
+// LoadConfig reads a candidate from a YAML file of policies by task type
+// and maintenance windows. Fields a policy leaves out keep their value in
+// base, as do the types it leaves out.
+func LoadConfig(path string, base Config) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read retry config: %v", err)
+	}
+	var f policyFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return Config{}, fmt.Errorf("invalid retry config %s: %v", path, err)
+	}
+	c := Config{Policies: make(map[string]common.RetryPolicy, len(base.Policies)+len(f.Policies)), Maintenance: f.Maintenance}
+	for taskType, p := range base.Policies {
+		c.Policies[taskType] = p
+	}
+	for taskType, fp := range f.Policies {
+		p, ok := base.Policies[taskType]
+		if !ok {
+			p = common.RetryPolicy{MaxRetries: DefaultMaxRetry}
+		}
+		if fp.MaxRetries != nil {
+			p.MaxRetries = *fp.MaxRetries
+		}
+		if fp.InitialDelay != nil {
+			p.InitialDelay = *fp.InitialDelay
+		}
+		if fp.Multiplier != nil {
+			p.Multiplier = *fp.Multiplier
+		}
+		if fp.MaxDelay != nil {
+			p.MaxDelay = *fp.MaxDelay
+		}
+		if fp.Jitter != nil {
+			p.Jitter = *fp.Jitter
+		}
+		if fp.MaxTotal != nil {
+			p.MaxTotal = *fp.MaxTotal
+		}
+		if p.MaxRetries < 0 {
+			return Config{}, fmt.Errorf("invalid retry config %s: %s has %d max_retries", path, taskType, p.MaxRetries)
+		}
+		c.Policies[taskType] = p
+	}
+	for _, w := range c.Maintenance {
+		if w.Start.IsZero() || !w.End.After(w.Start) {
+			return Config{}, fmt.Errorf("invalid retry config %s: maintenance window %s - %s does not end after it starts", path, w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339))
+		}
+	}
+	sort.Slice(c.Maintenance, func(i, j int) bool { return c.Maintenance[i].Start.Before(c.Maintenance[j].Start) })
+	return c, nil
+}
+
+// policyOf returns the policy of taskType, nil when it has none
+func (c Config) policyOf(taskType string) *common.RetryPolicy {
+	p, ok := c.Policies[taskType]
+	if !ok {
+		return nil
+	}
+	return &p
+}
+
+// maxRetry is the retry count of tasks of taskType, as EnqueueOptions sets it
+func (c Config) maxRetry(taskType string) int {
+	if p := c.policyOf(taskType); p != nil {
+		return p.Retries()
+	}
+	return DefaultMaxRetry
+}
+
+// retryDelay is the RetryDelay of the policies
+func (c Config) retryDelay() asynq.RetryDelayFunc {
+	return RetryDelay(func(fallback asynq.RetryDelayFunc) asynq.RetryDelayFunc {
+		return common.PolicyRetryDelay(c.policyOf, fallback)
+	})
+}
+
+// hold returns when a task due at t runs: at the end of the maintenance
+// window t falls in, t itself outside of them
+func (c Config) hold(t time.Time) time.Time {
+	for _, w := range c.Maintenance {
+		if !t.Before(w.Start) && t.Before(w.End) {
+			t = w.End
+		}
+	}
+	return t
+}
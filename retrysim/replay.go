@@ -0,0 +1,223 @@
+package retrysim
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/eventlog"
+	"asynqdemo/flags"
+
+	"github.com/hibiken/asynq"
+)
+
+// maxAttempts bounds a replay whose task is delayed without end
+const maxAttempts = 1000
+
+// Attempt is one run of a task as the event log recorded it
+type Attempt struct {
+	// At is when the run ended
+	At       time.Time
+	Duration time.Duration
+	Outcome  string
+	Message  string
+}
+
+// start is when the run began
+func (a Attempt) start() time.Time {
+	return a.At.Add(-a.Duration)
+}
+
+// Timeline is the runs of a task, oldest first
+type Timeline struct {
+	TaskID   string
+	Type     string
+	Queue    string
+	Attempts []Attempt
+}
+
+// Timelines groups the task events of the event log by task, keeping the
+// tasks that did not succeed at their first run
+func Timelines(events []eventlog.Event) []Timeline {
+	byID := map[string]*Timeline{}
+	var ids []string
+	for _, e := range events {
+		if e.Kind != eventlog.KindTask || e.TaskID == "" {
+			continue
+		}
+		tl, ok := byID[e.TaskID]
+		if !ok {
+			tl = &Timeline{TaskID: e.TaskID, Type: e.Type, Queue: e.Queue}
+			byID[e.TaskID] = tl
+			ids = append(ids, e.TaskID)
+		}
+		tl.Attempts = append(tl.Attempts, Attempt{
+			At:       e.At,
+			Duration: time.Duration(e.DurationMs) * time.Millisecond,
+			Outcome:  e.Outcome,
+			Message:  e.Message,
+		})
+	}
+	var timelines []Timeline
+	for _, id := range ids {
+		tl := byID[id]
+		sort.SliceStable(tl.Attempts, func(i, j int) bool { return tl.Attempts[i].At.Before(tl.Attempts[j].At) })
+		if len(tl.Attempts) > 1 || tl.Attempts[0].Outcome != eventlog.OutcomeSucceeded {
+			timelines = append(timelines, *tl)
+		}
+	}
+	return timelines
+}
+
+var (
+	delayedMessage    = regexp.MustCompile(`(?:is delayed by its feature flag|no free concurrency slot for \S+|circuit of \S+ (?:is open until \S+|reopened after a failed probe .*)), retrying in ([0-9.a-zµ]+)$`)
+	retryAfterMessage = regexp.MustCompile(`^(.*) \(retry after ([0-9.a-zµ]+)\)`)
+)
+
+// ErrorFromMessage rebuilds the error of a logged message as far as the
+// retry delay sees it: a flags.ErrDelayed for tasks held back by a flag, an
+// open circuit or the concurrency limit, a circuit.ErrRetryAfter for
+// provider answers asking to wait, and a plain error otherwise. Messages
+// cut short by the event log lose their delay.
+func ErrorFromMessage(msg string) error {
+	if m := delayedMessage.FindStringSubmatch(msg); m != nil {
+		if d, err := time.ParseDuration(m[1]); err == nil {
+			return flags.ErrDelayed{Delay: d}
+		}
+	}
+	if m := retryAfterMessage.FindStringSubmatch(msg); m != nil {
+		if d, err := time.ParseDuration(m[2]); err == nil {
+			return circuit.ErrRetryAfter{Err: errors.New(m[1]), After: d}
+		}
+	}
+	return errors.New(msg)
+}
+
+// Result is how a timeline plays out under a config. A task neither
+// succeeded nor archived was still delayed after maxAttempts runs.
+type Result struct {
+	Succeeded bool
+	Archived  bool
+	// Retries is the runs after the first one
+	Retries int
+	// Latency is the time from the end of the first run to the end of the
+	// last one
+	Latency time.Duration
+}
+
+// Replay plays tl out under c as asynq would: every run ends as the logged
+// run that had started by then, the first one before it; errors that are
+// no failures retry without using up a retry, SkipRetry and the last retry
+// archive, and retries due in a maintenance window wait for its end. The
+// delays are those of RetryDelay, jitter included.
+func Replay(tl Timeline, c Config) Result {
+	var (
+		res      Result
+		delay    = c.retryDelay()
+		maxRetry = c.maxRetry(tl.Type)
+		task     = asynq.NewTask(tl.Type, nil)
+		start    = tl.Attempts[0].start()
+		retried  int
+		firstEnd time.Time
+	)
+	for run := 0; run < maxAttempts; run++ {
+		a := attemptAt(tl.Attempts, start)
+		end := start.Add(a.Duration)
+		if run == 0 {
+			firstEnd = end
+		} else {
+			res.Retries++
+		}
+		res.Latency = end.Sub(firstEnd)
+
+		var d time.Duration
+		switch a.Outcome {
+		case eventlog.OutcomeSucceeded:
+			res.Succeeded = true
+			return res
+		case eventlog.OutcomeSkipped:
+			res.Archived = true
+			return res
+		default:
+			err := ErrorFromMessage(a.Message)
+			failure := flags.IsFailure(err)
+			if failure && retried >= maxRetry {
+				res.Archived = true
+				return res
+			}
+			d = delay(retried, err, task)
+			if failure {
+				retried++
+			}
+		}
+		start = c.hold(end.Add(d))
+	}
+	return res
+}
+
+// attemptAt returns the last logged run that had started by t, the first
+// one when none had
+func attemptAt(attempts []Attempt, t time.Time) Attempt {
+	a := attempts[0]
+	for _, next := range attempts[1:] {
+		if next.start().After(t) {
+			break
+		}
+		a = next
+	}
+	return a
+}
+
+// Totals sums the results of the timelines of a task type
+type Totals struct {
+	Tasks     int           `json:"tasks"`
+	Succeeded int           `json:"succeeded"`
+	Archived  int           `json:"archived"`
+	Retries   int           `json:"retries"`
+	Latency   time.Duration `json:"latency_ns"`
+}
+
+func (t *Totals) add(r Result) {
+	t.Tasks++
+	if r.Succeeded {
+		t.Succeeded++
+	}
+	if r.Archived {
+		t.Archived++
+	}
+	t.Retries += r.Retries
+	t.Latency += r.Latency
+}
+
+// Row compares a task type under the current and the candidate config
+type Row struct {
+	Type      string `json:"type"`
+	Current   Totals `json:"current"`
+	Candidate Totals `json:"candidate"`
+}
+
+// Simulate replays the timelines under both configs, one row per task type
+// sorted by type
+func Simulate(timelines []Timeline, current, candidate Config) []Row {
+	byType := map[string]*Row{}
+	for _, tl := range timelines {
+		if len(tl.Attempts) == 0 {
+			continue
+		}
+		row, ok := byType[tl.Type]
+		if !ok {
+			row = &Row{Type: tl.Type}
+			byType[tl.Type] = row
+		}
+		row.Current.add(Replay(tl, current))
+		row.Candidate.add(Replay(tl, candidate))
+	}
+	rows := make([]Row, 0, len(byType))
+	for _, row := range byType {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Type < rows[j].Type })
+	return rows
+}
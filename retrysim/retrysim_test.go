@@ -0,0 +1,178 @@
+package retrysim_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"asynqdemo/circuit"
+	"asynqdemo/common"
+	"asynqdemo/eventlog"
+	"asynqdemo/flags"
+	"asynqdemo/retrysim"
+)
+
+// TestRetrySimulator fails unless replaying failure timelines matches
+// hand-computed outcomes: retries exhausted or reached in time under
+// another MaxRetry or backoff, Retry-After and feature flag delays read
+// back from the logged messages, flag delays not using up retries, skipped
+// tasks archived, types without a policy retried as often as asynq does,
+// retries held to the end of a maintenance window, and the run durations
+// of the log; and unless a candidate file merges over the current policies.
+func TestRetrySimulator(t *testing.T) {
+	const taskType = "sim:test"
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration, outcome, msg string) retrysim.Attempt {
+		return retrysim.Attempt{At: t0.Add(d), Outcome: outcome, Message: msg}
+	}
+	policy := func(retries int, initial time.Duration) retrysim.Config {
+		p := common.RetryPolicy{MaxRetries: retries, InitialDelay: initial, Multiplier: 2}
+		return retrysim.Config{Policies: map[string]common.RetryPolicy{taskType: p, "sim:other": p}}
+	}
+
+	// Failing at 0s, 10s and 30s and succeeding from 70s
+	flaky := retrysim.Timeline{TaskID: "flaky", Type: taskType, Attempts: []retrysim.Attempt{
+		at(0, eventlog.OutcomeFailed, "smtp down"),
+		at(10*time.Second, eventlog.OutcomeFailed, "smtp down"),
+		at(30*time.Second, eventlog.OutcomeArchived, "smtp down"),
+		at(70*time.Second, eventlog.OutcomeSucceeded, ""),
+	}}
+	withWindow := policy(3, 10*time.Second)
+	withWindow.Maintenance = []retrysim.Window{{Start: t0.Add(5 * time.Second), End: t0.Add(60 * time.Second)}}
+	// Held back by its flag for 5m, then failing once
+	delayed := retrysim.Timeline{TaskID: "delayed", Type: taskType, Attempts: []retrysim.Attempt{
+		at(0, eventlog.OutcomeFailed, flags.ErrDelayed{TaskType: taskType, Delay: 5 * time.Minute}.Error()),
+		at(5*time.Minute, eventlog.OutcomeFailed, "boom"),
+		at(5*time.Minute+10*time.Second, eventlog.OutcomeSucceeded, ""),
+	}}
+	// Runs of 2s: the retry starts at 12s and ends at 14s
+	slow := retrysim.Timeline{TaskID: "slow", Type: taskType, Attempts: []retrysim.Attempt{
+		{At: t0.Add(2 * time.Second), Duration: 2 * time.Second, Outcome: eventlog.OutcomeFailed, Message: "timeout"},
+		{At: t0.Add(14 * time.Second), Duration: 2 * time.Second, Outcome: eventlog.OutcomeSucceeded},
+	}}
+	for _, c := range []struct {
+		name   string
+		tl     retrysim.Timeline
+		config retrysim.Config
+		want   retrysim.Result
+	}{
+		// 10s, 20s: the third run at 30s is the last
+		{"exhausted", flaky, policy(2, 10*time.Second), retrysim.Result{Archived: true, Retries: 2, Latency: 30 * time.Second}},
+		// 10s, 20s, 40s: the fourth run at 70s succeeds
+		{"one more retry", flaky, policy(3, 10*time.Second), retrysim.Result{Succeeded: true, Retries: 3, Latency: 70 * time.Second}},
+		// 60s: the run at 60s fails as the one at 30s did
+		{"longer backoff", flaky, policy(1, time.Minute), retrysim.Result{Archived: true, Retries: 1, Latency: time.Minute}},
+		// 90s: the run at 90s succeeds
+		{"longest backoff", flaky, policy(1, 90*time.Second), retrysim.Result{Succeeded: true, Retries: 1, Latency: 90 * time.Second}},
+		// The retry due at 10s waits until 60s and fails, 20s later it succeeds
+		{"maintenance", flaky, withWindow, retrysim.Result{Succeeded: true, Retries: 2, Latency: 80 * time.Second}},
+		// The provider asked for 2m, longer than the policy's 10s
+		{"retry after", retrysim.Timeline{TaskID: "limited", Type: taskType, Attempts: []retrysim.Attempt{
+			at(0, eventlog.OutcomeFailed, circuit.ErrRetryAfter{Err: errors.New("sendgrid: 429 Too Many Requests"), After: 2 * time.Minute}.Error()),
+			at(2*time.Minute, eventlog.OutcomeSucceeded, ""),
+		}}, policy(3, 10*time.Second), retrysim.Result{Succeeded: true, Retries: 1, Latency: 2 * time.Minute}},
+		// 5m for the flag, then the one retry waits 10s
+		{"flag delay", delayed, policy(1, 10*time.Second), retrysim.Result{Succeeded: true, Retries: 2, Latency: 5*time.Minute + 10*time.Second}},
+		// The flag delay is no failure, so a task without retries still runs again
+		{"flag delay without retries", delayed, policy(0, 10*time.Second), retrysim.Result{Archived: true, Retries: 1, Latency: 5 * time.Minute}},
+		{"skipped", retrysim.Timeline{TaskID: "skipped", Type: taskType, Attempts: []retrysim.Attempt{
+			at(0, eventlog.OutcomeSkipped, "invalid payload: skip retry for the task"),
+		}}, policy(3, 10*time.Second), retrysim.Result{Archived: true}},
+		{"durations", slow, policy(1, 10*time.Second), retrysim.Result{Succeeded: true, Retries: 1, Latency: 12 * time.Second}},
+	} {
+		if got := retrysim.Replay(c.tl, c.config); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	// Types without a policy retry as often as asynq's default
+	failing := retrysim.Timeline{TaskID: "failing", Type: taskType, Attempts: flaky.Attempts[:2]}
+	if got := retrysim.Replay(failing, retrysim.Config{}); !got.Archived || got.Retries != retrysim.DefaultMaxRetry {
+		t.Errorf("without a policy: got %+v, want archived after %d retries", got, retrysim.DefaultMaxRetry)
+	}
+
+	// Logged messages come back as the errors the retry delay acts on
+	open := circuit.ErrOpen{Provider: "smtp", ProbeAt: t0, Delay: 45 * time.Second}
+	var d flags.ErrDelayed
+	if err := retrysim.ErrorFromMessage("failed to send email: " + open.Error()); !errors.As(err, &d) || d.Delay != 45*time.Second {
+		t.Errorf("open circuit read back as %#v", err)
+	}
+	var ra circuit.ErrRetryAfter
+	if err := retrysim.ErrorFromMessage("sendgrid: 503 (retry after 1m30s)"); !errors.As(err, &ra) || ra.After != 90*time.Second || ra.Err.Error() != "sendgrid: 503" {
+		t.Errorf("retry after read back as %#v", err)
+	}
+	if err := retrysim.ErrorFromMessage("sendgrid: 503 (retry after 1m30s"); !flags.IsFailure(err) || errors.As(err, &ra) {
+		t.Errorf("cut short message read back as %#v", err)
+	}
+
+	// Tasks that succeeded at their first run are left out, runs are ordered
+	var events []eventlog.Event
+	for i, e := range []struct {
+		id, outcome string
+		at          time.Duration
+	}{
+		{"b", eventlog.OutcomeSucceeded, 30 * time.Second},
+		{"a", eventlog.OutcomeSucceeded, 50 * time.Second},
+		{"b", eventlog.OutcomeFailed, 0},
+		{"c", eventlog.OutcomeSucceeded, 0},
+		{"a", eventlog.OutcomeFailed, 0},
+	} {
+		typ := taskType
+		if i == 0 || i == 2 {
+			typ = "sim:other"
+		}
+		events = append(events, eventlog.Event{At: t0.Add(e.at), Kind: eventlog.KindTask, Type: typ, TaskID: e.id, Outcome: e.outcome, Message: "smtp down"})
+	}
+	events = append(events, eventlog.Event{At: t0, Kind: eventlog.KindAlert, Message: "queue backlog"})
+	timelines := retrysim.Timelines(events)
+	if len(timelines) != 2 || timelines[0].TaskID != "b" || timelines[1].TaskID != "a" ||
+		timelines[1].Attempts[0].Outcome != eventlog.OutcomeFailed || timelines[1].Attempts[1].Outcome != eventlog.OutcomeSucceeded {
+		t.Fatalf("timelines %+v", timelines)
+	}
+	rows := retrysim.Simulate(timelines, policy(1, 10*time.Second), policy(1, time.Minute))
+	want := []retrysim.Row{
+		{Type: "sim:other", Current: retrysim.Totals{Tasks: 1, Archived: 1, Retries: 1, Latency: 10 * time.Second}, Candidate: retrysim.Totals{Tasks: 1, Succeeded: 1, Retries: 1, Latency: time.Minute}},
+		{Type: taskType, Current: retrysim.Totals{Tasks: 1, Archived: 1, Retries: 1, Latency: 10 * time.Second}, Candidate: retrysim.Totals{Tasks: 1, Succeeded: 1, Retries: 1, Latency: time.Minute}},
+	}
+	if len(rows) != len(want) || rows[0] != want[0] || rows[1] != want[1] {
+		t.Errorf("rows %+v, want %+v", rows, want)
+	}
+
+	// The candidate file merges over the current policies
+	current := retrysim.CurrentConfig()
+	if current.Policies[common.TypeEmailTask] != common.EmailRetryPolicy {
+		t.Errorf("current email policy %+v", current.Policies[common.TypeEmailTask])
+	}
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(`policies:
+  email:send:
+    max_retries: 4
+    jitter: false
+  sim:test:
+    initial_delay: 30s
+maintenance:
+  - start: 2024-03-01T13:00:00Z
+    end: 2024-03-01T14:00:00Z
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	candidate, err := retrysim.LoadConfig(path, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := common.EmailRetryPolicy
+	email.MaxRetries, email.Jitter = 4, false
+	if candidate.Policies[common.TypeEmailTask] != email || candidate.Policies[common.TypeWelcomeMessage] != common.WelcomeRetryPolicy ||
+		candidate.Policies[taskType] != (common.RetryPolicy{MaxRetries: retrysim.DefaultMaxRetry, InitialDelay: 30 * time.Second}) ||
+		len(candidate.Maintenance) != 1 || !candidate.Maintenance[0].End.Equal(t0.Add(2*time.Hour)) {
+		t.Errorf("candidate %+v", candidate)
+	}
+	if err := os.WriteFile(path, []byte("maintenance:\n  - start: 2024-03-01T14:00:00Z\n    end: 2024-03-01T13:00:00Z\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := retrysim.LoadConfig(path, current); err == nil {
+		t.Error("window ending before its start accepted")
+	}
+}
@@ -38,7 +38,7 @@ go build -o bin/asynq-demo main.go
 
 # Run the demo
 echo "🎯 Running demo..."
-./bin/asynq-demo
+./bin/asynq-demo --demo
 
 # Cleanup
 if docker ps -a | grep -q asynq-redis; then
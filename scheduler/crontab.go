@@ -0,0 +1,396 @@
+package scheduler
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// CrontabRule translates the crontab commands its Command regexp matches
+// into tasks of Type. String values of Payload may reference the groups
+// of the match, as in regexp.Expand; a value that is only a reference to
+// an integer becomes a number.
+type CrontabRule struct {
+	Command string                 `yaml:"command"`
+	Type    string                 `yaml:"type"`
+	Payload map[string]interface{} `yaml:"payload"`
+
+	re *regexp.Regexp
+}
+
+// Translation is the table of CrontabRules, the first matching rule wins
+type Translation []CrontabRule
+
+// LoadTranslation reads a YAML list of CrontabRules
+func LoadTranslation(path string) (Translation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read crontab translation: %v", err)
+	}
+	var rules Translation
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse crontab translation %s: %v", path, err)
+	}
+	return rules, rules.compile()
+}
+
+func (t Translation) compile() error {
+	for i := range t {
+		r := &t[i]
+		if r.Type == "" {
+			return fmt.Errorf("crontab rule %d has no type", i+1)
+		}
+		re, err := regexp.Compile(r.Command)
+		if err != nil {
+			return fmt.Errorf("crontab rule %d: invalid command pattern: %v", i+1, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// translate returns the task type and payload of command, false when no
+// rule matches it
+func (t Translation) translate(command string) (string, map[string]interface{}, bool) {
+	for _, r := range t {
+		match := r.re.FindStringSubmatchIndex(command)
+		if match == nil {
+			continue
+		}
+		payload, _ := expandPayload(r.re, command, match, r.Payload).(map[string]interface{})
+		return r.Type, payload, true
+	}
+	return "", nil, false
+}
+
+// wholeRef matches a payload value that is only a group reference
+var wholeRef = regexp.MustCompile(`^\$(\w+|\{\w+\})$`)
+
+func expandPayload(re *regexp.Regexp, command string, match []int, v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		s := string(re.ExpandString(nil, v, command, match))
+		if wholeRef.MatchString(v) {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return int(n)
+			}
+		}
+		return s
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = expandPayload(re, command, match, e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = expandPayload(re, command, match, e)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// Unmapped is a crontab line the import left out
+type Unmapped struct {
+	Line   int
+	Text   string
+	Reason string
+}
+
+// cronParser accepts the specs asynq's scheduler does
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// ImportCrontab translates the lines of a crontab into schedule entries.
+// Variable lines apply to the lines after them: QUEUE, MAX_RETRY, TIMEOUT
+// and CRON_TZ set the options of the entries, other variables are
+// reported as unmapped along with @reboot lines, invalid specs and
+// commands no rule matches. Entry IDs derive from the spec and command,
+// so importing the same crontab again gives the same entries.
+func ImportCrontab(r io.Reader, t Translation) ([]Entry, []Unmapped, error) {
+	var (
+		entries  []Entry
+		unmapped []Unmapped
+		queue    string
+		maxRetry *int
+		timeout  time.Duration
+		tz       string
+	)
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		skip := func(reason string) {
+			unmapped = append(unmapped, Unmapped{Line: n, Text: line, Reason: reason})
+		}
+		if name, value, ok := crontabVariable(line); ok {
+			switch name {
+			case "QUEUE":
+				queue = value
+			case "MAX_RETRY":
+				if value == "" {
+					maxRetry = nil
+					continue
+				}
+				v, err := strconv.Atoi(value)
+				if err != nil || v < 0 {
+					skip("MAX_RETRY is not a non-negative integer")
+					continue
+				}
+				maxRetry = &v
+			case "TIMEOUT":
+				if value == "" {
+					timeout = 0
+					continue
+				}
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					skip("TIMEOUT is not a positive duration")
+					continue
+				}
+				timeout = d
+			case "CRON_TZ":
+				if _, err := time.LoadLocation(value); err != nil {
+					skip(fmt.Sprintf("unknown time zone %q", value))
+					continue
+				}
+				tz = value
+			default:
+				skip(fmt.Sprintf("variable %s has no schedule equivalent", name))
+			}
+			continue
+		}
+
+		spec, command := splitCrontabLine(line)
+		switch {
+		case command == "":
+			skip("no command")
+			continue
+		case spec == "@reboot":
+			skip("@reboot has no schedule equivalent")
+			continue
+		}
+		if tz != "" {
+			spec = "CRON_TZ=" + tz + " " + spec
+		}
+		if _, err := cronParser.Parse(spec); err != nil {
+			skip(fmt.Sprintf("invalid schedule: %v", err))
+			continue
+		}
+		taskType, payload, ok := t.translate(command)
+		if !ok {
+			skip("no rule matches the command")
+			continue
+		}
+		if err := checkPayload(taskType, payload); err != nil {
+			skip(err.Error())
+			continue
+		}
+		id := crontabEntryID(spec, command)
+		if first, dup := seen[id]; dup {
+			skip(fmt.Sprintf("duplicate of line %d", first))
+			continue
+		}
+		seen[id] = n
+		e := Entry{ID: id, Cronspec: spec, Type: taskType, Payload: payload, Queue: queue, Timeout: timeout}
+		if maxRetry != nil {
+			v := *maxRetry
+			e.MaxRetry = &v
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read crontab: %v", err)
+	}
+	return entries, unmapped, nil
+}
+
+// variableLine matches the NAME=value lines of a crontab
+var variableLine = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+
+// crontabVariable parses a variable line, unquoting the value
+func crontabVariable(line string) (string, string, bool) {
+	m := variableLine.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", false
+	}
+	value := m[2]
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return m[1], value, true
+}
+
+// splitCrontabLine splits a line into its schedule, a descriptor or five
+// fields, and its command
+func splitCrontabLine(line string) (string, string) {
+	fields := 5
+	if strings.HasPrefix(line, "@") {
+		fields = 1
+	}
+	parts := strings.Fields(line)
+	if len(parts) <= fields {
+		return line, ""
+	}
+	rest := line
+	for i := 0; i < fields; i++ {
+		rest = strings.TrimLeft(rest, " \t")
+		rest = rest[strings.IndexAny(rest, " \t"):]
+	}
+	return strings.Join(parts[:fields], " "), strings.TrimSpace(rest)
+}
+
+func crontabEntryID(spec, command string) string {
+	h := fnv.New32a()
+	h.Write([]byte(spec + "\x00" + command))
+	return fmt.Sprintf("cron-%08x", h.Sum32())
+}
+
+// MergeEntries appends entries to the schedule file at path, creating it
+// if needed and keeping its comments. Entries whose ID is already in the
+// file are skipped when equal and refused when they differ. It returns
+// the number of entries added.
+func MergeEntries(path string, entries []Entry) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read periodic entries: %v", err)
+	}
+	existing := make(map[string]Entry)
+	if len(bytes.TrimSpace(data)) > 0 {
+		file, err := EntriesFile(path).load()
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range file.Entries {
+			existing[e.ID] = e
+		}
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return 0, fmt.Errorf("failed to parse periodic entries %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	var list *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "entries" {
+			list = root.Content[i+1]
+		}
+	}
+	if list == nil {
+		list = &yaml.Node{}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "entries"}, list)
+	}
+	if list.Kind != yaml.SequenceNode {
+		// "entries:" without a value, or an empty flow list
+		*list = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	list.Style = 0
+
+	added := 0
+	for _, e := range entries {
+		if old, ok := existing[e.ID]; ok {
+			if !reflect.DeepEqual(normalizeEntry(old), normalizeEntry(e)) {
+				return 0, fmt.Errorf("entry %s of %s differs from the imported one", e.ID, path)
+			}
+			continue
+		}
+		var n yaml.Node
+		if err := n.Encode(e); err != nil {
+			return 0, fmt.Errorf("failed to encode entry %s: %v", e.ID, err)
+		}
+		list.Content = append(list.Content, &n)
+		existing[e.ID] = e
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return 0, fmt.Errorf("failed to encode periodic entries: %v", err)
+	}
+	if err := enc.Close(); err != nil {
+		return 0, fmt.Errorf("failed to encode periodic entries: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".entries-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to write periodic entries: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write periodic entries: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write periodic entries: %v", err)
+	}
+	if _, err := EntriesFile(tmp.Name()).load(); err != nil {
+		return 0, fmt.Errorf("merged periodic entries are invalid: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to write periodic entries: %v", err)
+	}
+	return added, nil
+}
+
+// normalizeEntry gives entries that encode the same a single form, as a
+// YAML round trip turns the numbers of a payload into ints
+func normalizeEntry(e Entry) Entry {
+	var out Entry
+	data, err := yaml.Marshal(e)
+	if err != nil || yaml.Unmarshal(data, &out) != nil {
+		return e
+	}
+	return out
+}
+
+// Export writes the entries and one-shot entries of the file as YAML, in
+// the layout the file is read in
+func (path EntriesFile) Export(w io.Writer) error {
+	file, err := path.load()
+	if err != nil {
+		return err
+	}
+	return encodeSchedule(w, file)
+}
+
+// WriteEntries writes entries in the layout of a schedule file
+func WriteEntries(w io.Writer, entries []Entry) error {
+	return encodeSchedule(w, &scheduleFile{Entries: entries})
+}
+
+func encodeSchedule(w io.Writer, file *scheduleFile) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(file); err != nil {
+		return fmt.Errorf("failed to encode periodic entries: %v", err)
+	}
+	return enc.Close()
+}
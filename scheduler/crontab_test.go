@@ -0,0 +1,149 @@
+package scheduler_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/scheduler"
+
+	"gopkg.in/yaml.v3"
+)
+
+// crontabRules translates the commands of testCrontab
+const crontabRules = `
+- command: '^/opt/jobs/digest --user=(?P<user>\d+) --to=(\S+)$'
+  type: email:send
+  payload: {user_id: "${user}", email: "$2", subject: "Daily digest", category: digest}
+- command: '^/opt/jobs/report'
+  type: server:info
+  payload: {source: crontab}
+`
+
+// testCrontab mixes comments, variables, step values and lines that cannot
+// be imported
+const testCrontab = `# Ops crontab
+SHELL=/bin/sh
+MAILTO=ops@example.com
+
+*/15 * * * * /opt/jobs/report --quick
+QUEUE=low
+MAX_RETRY=2
+TIMEOUT="5m"
+0 9-17/2 * * 1-5 /opt/jobs/digest --user=42 --to=ada@example.com
+*/15 * * * * /opt/jobs/report --quick
+  # indented comment
+CRON_TZ=Asia/Shanghai
+@daily /opt/jobs/digest --user=7 --to=bob@example.com
+@reboot /opt/jobs/report
+0 3 * * * /usr/bin/backup.sh
+61 * * * * /opt/jobs/report
+0 1 * * * /opt/jobs/digest --user=x --to=carol@example.com
+`
+
+// TestCrontabImport imports a representative crontab and fails unless
+// its cron lines become entries with the options of the variables before
+// them, every other line is reported unmapped, merging into a schedule
+// file keeps its comments and entries and adds nothing the second time,
+// and exporting the file gives back the imported entries.
+func TestCrontabImport(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(rulesPath, []byte(crontabRules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := scheduler.LoadTranslation(rulesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, unmapped, err := scheduler.ImportCrontab(strings.NewReader(testCrontab), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("imported %d entries, want 3: %+v", len(entries), entries)
+	}
+	report, digest, tz := entries[0], entries[1], entries[2]
+	if report.Cronspec != "*/15 * * * *" || report.Type != common.TypeServerInfo || report.Queue != "" || report.MaxRetry != nil {
+		t.Errorf("report entry %+v", report)
+	}
+	if digest.Cronspec != "0 9-17/2 * * 1-5" || digest.Type != common.TypeEmailTask || digest.Queue != "low" ||
+		digest.MaxRetry == nil || *digest.MaxRetry != 2 || digest.Timeout != 5*time.Minute {
+		t.Errorf("digest entry %+v", digest)
+	}
+	if digest.Payload["user_id"] != 42 || digest.Payload["email"] != "ada@example.com" || digest.Payload["category"] != common.CategoryDigest {
+		t.Errorf("digest payload %v", digest.Payload)
+	}
+	if tz.Cronspec != "CRON_TZ=Asia/Shanghai @daily" || tz.Payload["user_id"] != 7 {
+		t.Errorf("entry after CRON_TZ %+v", tz)
+	}
+	for _, e := range entries {
+		if _, err := e.Config(); err != nil {
+			t.Errorf("entry %s: %v", e.ID, err)
+		}
+	}
+	again, _, err := scheduler.ImportCrontab(strings.NewReader(testCrontab), rules)
+	if err != nil || !reflect.DeepEqual(again, entries) {
+		t.Errorf("importing again gave other entries: %v", err)
+	}
+
+	wantLines := []int{2, 3, 10, 14, 15, 16, 17}
+	var gotLines []int
+	for _, u := range unmapped {
+		gotLines = append(gotLines, u.Line)
+		if u.Reason == "" {
+			t.Errorf("line %d unmapped without reason", u.Line)
+		}
+	}
+	if !reflect.DeepEqual(gotLines, wantLines) {
+		t.Errorf("unmapped lines %v, want %v: %+v", gotLines, wantLines, unmapped)
+	}
+
+	schedule := filepath.Join(dir, "schedule.yaml")
+	existing := "# Customer digests\nentries:\n  - id: digest-1 # first customer\n    cron: \"0 8 * * *\"\n    type: email:send\n    payload: {user_id: 1, email: a@example.com, subject: Digest}\n"
+	if err := os.WriteFile(schedule, []byte(existing), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	added, err := scheduler.MergeEntries(schedule, entries)
+	if err != nil || added != 3 {
+		t.Fatalf("merge added %d entries: %v", added, err)
+	}
+	data, err := os.ReadFile(schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "# Customer digests") || !strings.Contains(string(data), "# first customer") {
+		t.Errorf("merge dropped the comments of the file:\n%s", data)
+	}
+	if added, err := scheduler.MergeEntries(schedule, entries); err != nil || added != 0 {
+		t.Errorf("merging again added %d entries: %v", added, err)
+	}
+	changed := append([]scheduler.Entry(nil), entries...)
+	changed[0].Queue = "critical"
+	if _, err := scheduler.MergeEntries(schedule, changed); err == nil {
+		t.Error("merge replaced an entry with a different one")
+	}
+
+	var out bytes.Buffer
+	if err := scheduler.EntriesFile(schedule).Export(&out); err != nil {
+		t.Fatal(err)
+	}
+	var exported struct {
+		Entries []scheduler.Entry `yaml:"entries"`
+	}
+	if err := yaml.Unmarshal(out.Bytes(), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Entries) != 4 || exported.Entries[0].ID != "digest-1" {
+		t.Fatalf("exported entries %+v", exported.Entries)
+	}
+	if !reflect.DeepEqual(exported.Entries[1:], entries) {
+		t.Errorf("export lost fields of the imported entries:\n%+v\nwant\n%+v", exported.Entries[1:], entries)
+	}
+}
@@ -0,0 +1,164 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+	"gopkg.in/yaml.v3"
+)
+
+// Entry is a periodic task of the sharded schedule, e.g. the digest of one
+// customer. Its ID decides the shard it belongs to, so it must stay stable.
+type Entry struct {
+	ID       string                 `yaml:"id"`
+	Cronspec string                 `yaml:"cron"`
+	Type     string                 `yaml:"type"`
+	Payload  map[string]interface{} `yaml:"payload,omitempty"`
+	Queue    string                 `yaml:"queue,omitempty"`
+	MaxRetry *int                   `yaml:"max_retry,omitempty"`
+	Timeout  time.Duration          `yaml:"timeout,omitempty"`
+	// Group names the entries suspended together, e.g. those of a tenant
+	Group string `yaml:"group,omitempty"`
+	// Suspended skips the entry's ticks until the flag is removed, and
+	// Suspensions skips them within the windows
+	Suspended   bool     `yaml:"suspended,omitempty"`
+	Suspensions []Window `yaml:"suspensions,omitempty"`
+}
+
+// Config returns the entry as a config for asynq's PeriodicTaskManager
+func (e Entry) Config() (*asynq.PeriodicTaskConfig, error) {
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("entry %s: failed to marshal payload: %v", e.ID, err)
+	}
+	opts := common.EnqueueOptions(e.Type)
+	if e.Queue != "" {
+		opts = append(opts, asynq.Queue(e.Queue))
+	}
+	if e.MaxRetry != nil {
+		opts = append(opts, asynq.MaxRetry(*e.MaxRetry))
+	}
+	if e.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(e.Timeout))
+	}
+	return &asynq.PeriodicTaskConfig{Cronspec: e.Cronspec, Task: asynq.NewTask(e.Type, payload), Opts: opts}, nil
+}
+
+// EntrySource lists every entry of the sharded schedule
+type EntrySource interface {
+	Entries() ([]Entry, error)
+}
+
+// EntriesFunc adapts a function to EntrySource
+type EntriesFunc func() ([]Entry, error)
+
+// Entries calls f
+func (f EntriesFunc) Entries() ([]Entry, error) {
+	return f()
+}
+
+// EntriesFile reads the entries of a YAML file with an "entries" list, a
+// "once" list of one-shot entries and a "groups" map of the suspensions of
+// entry groups on every call, so edits apply at the next sync
+type EntriesFile string
+
+// scheduleFile is the layout of an EntriesFile
+type scheduleFile struct {
+	Entries []Entry          `yaml:"entries,omitempty"`
+	Once    []OneShot        `yaml:"once,omitempty"`
+	Groups  map[string]Group `yaml:"groups,omitempty"`
+}
+
+// Entries reads and checks the file
+func (path EntriesFile) Entries() ([]Entry, error) {
+	file, err := path.load()
+	if err != nil {
+		return nil, err
+	}
+	return file.Entries, nil
+}
+
+// Groups reads and checks the file
+func (path EntriesFile) Groups() (map[string]Group, error) {
+	file, err := path.load()
+	if err != nil {
+		return nil, err
+	}
+	return file.Groups, nil
+}
+
+// OneShots reads and checks the file
+func (path EntriesFile) OneShots() ([]OneShot, error) {
+	file, err := path.load()
+	if err != nil {
+		return nil, err
+	}
+	return file.Once, nil
+}
+
+func (path EntriesFile) load() (*scheduleFile, error) {
+	data, err := os.ReadFile(string(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read periodic entries: %v", err)
+	}
+	var file scheduleFile
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse periodic entries %s: %v", path, err)
+	}
+	seen := make(map[string]bool, len(file.Entries))
+	for i, e := range file.Entries {
+		switch {
+		case e.ID == "":
+			return nil, fmt.Errorf("entry %d of %s has no id", i+1, path)
+		case seen[e.ID]:
+			return nil, fmt.Errorf("entry %s of %s is duplicated", e.ID, path)
+		case e.Cronspec == "":
+			return nil, fmt.Errorf("entry %s of %s has no cron", e.ID, path)
+		}
+		seen[e.ID] = true
+		if err := checkPayload(e.Type, e.Payload); err != nil {
+			return nil, fmt.Errorf("entry %s of %s: %v", e.ID, path, err)
+		}
+		if err := checkWindows(e.Suspensions); err != nil {
+			return nil, fmt.Errorf("entry %s of %s: %v", e.ID, path, err)
+		}
+	}
+	for name, g := range file.Groups {
+		if err := checkWindows(g.Suspensions); err != nil {
+			return nil, fmt.Errorf("group %s of %s: %v", name, path, err)
+		}
+	}
+	names := make(map[string]bool, len(file.Once))
+	for i, o := range file.Once {
+		switch {
+		case o.Name == "":
+			return nil, fmt.Errorf("one-shot entry %d of %s has no name", i+1, path)
+		case names[o.Name]:
+			return nil, fmt.Errorf("one-shot entry %s of %s is duplicated", o.Name, path)
+		case o.At.IsZero():
+			return nil, fmt.Errorf("one-shot entry %s of %s has no time", o.Name, path)
+		}
+		names[o.Name] = true
+		if err := checkPayload(o.Type, o.Payload); err != nil {
+			return nil, fmt.Errorf("one-shot entry %s of %s: %v", o.Name, path, err)
+		}
+	}
+	return &file, nil
+}
+
+// checkPayload validates a payload of the schedule file against its type
+func checkPayload(taskType string, payload map[string]interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %v", err)
+	}
+	return common.ValidatePayload(taskType, data)
+}
@@ -0,0 +1,75 @@
+// Package scheduler adds instrumentation around asynq's periodic task scheduler.
+package scheduler
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SchedulerInterface is the part of *asynq.Scheduler that registers entries
+type SchedulerInterface interface {
+	Register(cronspec string, task *asynq.Task, opts ...asynq.Option) (string, error)
+	Unregister(entryID string) error
+}
+
+// Runner is a scheduler that can also be started and stopped
+type Runner interface {
+	SchedulerInterface
+	Start() error
+	Shutdown()
+}
+
+// ObservabilityWrapper records how long registering each entry takes, which is
+// dominated by parsing its cron expression
+type ObservabilityWrapper struct {
+	inner          SchedulerInterface
+	evaluationHist *prometheus.HistogramVec
+	entries        atomic.Int64
+}
+
+// NewObservabilityWrapper wraps inner and registers the histogram with reg
+func NewObservabilityWrapper(inner SchedulerInterface, reg prometheus.Registerer) (*ObservabilityWrapper, error) {
+	hist := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "schedule_evaluation_duration_seconds",
+		Help:    "Time spent evaluating the cron expression of a schedule entry.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 2, 16),
+	}, []string{"entry_id"})
+	if err := reg.Register(hist); err != nil {
+		return nil, fmt.Errorf("failed to register schedule histogram: %v", err)
+	}
+	return &ObservabilityWrapper{inner: inner, evaluationHist: hist}, nil
+}
+
+// Register registers task under cronExpr, checking it is of taskType
+func (w *ObservabilityWrapper) Register(cronExpr, taskType string, task *asynq.Task, opts ...asynq.Option) (string, error) {
+	if task.Type() != taskType {
+		return "", fmt.Errorf("task type %s does not match %s", task.Type(), taskType)
+	}
+	start := time.Now()
+	entryID, err := w.inner.Register(cronExpr, task, opts...)
+	if err != nil {
+		return "", err
+	}
+	w.evaluationHist.WithLabelValues(entryID).Observe(time.Since(start).Seconds())
+	w.entries.Add(1)
+	return entryID, nil
+}
+
+// Unregister removes the entry and its histogram series
+func (w *ObservabilityWrapper) Unregister(entryID string) error {
+	if err := w.inner.Unregister(entryID); err != nil {
+		return err
+	}
+	w.evaluationHist.DeleteLabelValues(entryID)
+	w.entries.Add(-1)
+	return nil
+}
+
+// Entries returns the number of registered entries
+func (w *ObservabilityWrapper) Entries() int {
+	return int(w.entries.Load())
+}
@@ -0,0 +1,83 @@
+package scheduler_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/scheduler"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const evaluationMetric = "schedule_evaluation_duration_seconds"
+
+// TestObservabilityWrapper registers 100 entries on a real scheduler and
+// fails unless each got one observation in the evaluation histogram, the
+// P99 is under 1ms, failed registrations are not observed and removing an
+// entry removes its series
+func TestObservabilityWrapper(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	s := asynq.NewScheduler(srv.ConnOpt(), &asynq.SchedulerOpts{LogLevel: asynq.FatalLevel})
+	reg := prometheus.NewRegistry()
+	w, err := scheduler.NewObservabilityWrapper(s, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scheduler.NewObservabilityWrapper(s, reg); err == nil {
+		t.Error("histogram registered twice")
+	}
+
+	var ids []string
+	for i := 0; i < 100; i++ {
+		id, err := w.Register(fmt.Sprintf("%d */2 * * *", i%60), "report:daily", asynq.NewTask("report:daily", []byte(fmt.Sprint(i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := w.Register("not a cron", "report:daily", asynq.NewTask("report:daily", nil)); err == nil {
+		t.Error("invalid cron expression registered")
+	}
+	if _, err := w.Register("@every 1m", "report:weekly", asynq.NewTask("report:daily", nil)); err == nil {
+		t.Error("task of another type registered")
+	}
+	if n, err := testutil.GatherAndCount(reg, evaluationMetric); err != nil || n != 100 || w.Entries() != 100 {
+		t.Fatalf("%d series (%v), %d entries; want 100", n, err, w.Entries())
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var durations []float64
+	for _, m := range families[0].GetMetric() {
+		h := m.GetHistogram()
+		if h.GetSampleCount() != 1 {
+			t.Errorf("entry %v has %d observations, want 1", m.GetLabel(), h.GetSampleCount())
+		}
+		durations = append(durations, h.GetSampleSum())
+	}
+	sort.Float64s(durations)
+	if p99 := time.Duration(durations[98] * float64(time.Second)); p99 >= time.Millisecond {
+		t.Errorf("P99 evaluation time %v, want under 1ms", p99)
+	}
+
+	if err := w.Unregister(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := testutil.GatherAndCount(reg, evaluationMetric); n != 99 || w.Entries() != 99 {
+		t.Errorf("%d series and %d entries after unregistering one, want 99", n, w.Entries())
+	}
+	if err := w.Unregister(ids[0]); err == nil {
+		t.Error("unregistered entry removed twice")
+	}
+}
@@ -0,0 +1,207 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultOneShotGrace is how late a one-shot entry is still enqueued, e.g.
+// when the schedulers were down at its time
+const DefaultOneShotGrace = time.Hour
+
+// firedKey maps the names of the one-shot entries enqueued to their task
+// IDs, so a one-shot is not enqueued again once its task is gone
+const firedKey = "scheduler:once"
+
+// OneShot is a task enqueued once for At, declared next to the periodic
+// entries so it is version-controlled. Its name decides its task ID; a
+// one-shot enqueued already is not moved by editing its time, rename it.
+type OneShot struct {
+	Name      string                 `yaml:"name"`
+	At        time.Time              `yaml:"at"`
+	Type      string                 `yaml:"type"`
+	Payload   map[string]interface{} `yaml:"payload,omitempty"`
+	Queue     string                 `yaml:"queue,omitempty"`
+	MaxRetry  *int                   `yaml:"max_retry,omitempty"`
+	Timeout   time.Duration          `yaml:"timeout,omitempty"`
+	Retention time.Duration          `yaml:"retention,omitempty"`
+}
+
+// TaskID returns the task ID of the one-shot
+func (o OneShot) TaskID() string {
+	return "once-" + o.Name
+}
+
+// queue returns the queue the one-shot is enqueued into
+func (o OneShot) queue() string {
+	if o.Queue == "" {
+		return "default"
+	}
+	return o.Queue
+}
+
+// Task returns the one-shot's task and options
+func (o OneShot) Task() (*asynq.Task, []asynq.Option, error) {
+	payload, err := json.Marshal(o.Payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("one-shot %s: failed to marshal payload: %v", o.Name, err)
+	}
+	opts := []asynq.Option{asynq.TaskID(o.TaskID()), asynq.ProcessAt(o.At), asynq.Queue(o.queue())}
+	if o.MaxRetry != nil {
+		opts = append(opts, asynq.MaxRetry(*o.MaxRetry))
+	}
+	if o.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(o.Timeout))
+	}
+	if o.Retention > 0 {
+		opts = append(opts, asynq.Retention(o.Retention))
+	}
+	return asynq.NewTask(o.Type, payload), opts, nil
+}
+
+// OneShotSource lists the one-shot entries
+type OneShotSource interface {
+	OneShots() ([]OneShot, error)
+}
+
+// OneShotLoader enqueues the one-shot entries of a source. Every scheduler
+// instance may run one: the task IDs and the fired marks keep each entry
+// from being enqueued twice.
+type OneShotLoader struct {
+	Source   OneShotSource
+	Grace    time.Duration
+	Interval time.Duration
+
+	client *asynq.Client
+	rdb    redis.UniversalClient
+	// warned holds the entries already reported as skipped
+	warned map[string]bool
+}
+
+// NewOneShotLoader creates a loader of source syncing every interval
+func NewOneShotLoader(source OneShotSource, client *asynq.Client, rdb redis.UniversalClient, interval time.Duration) *OneShotLoader {
+	return &OneShotLoader{Source: source, Grace: DefaultOneShotGrace, Interval: interval, client: client, rdb: rdb, warned: make(map[string]bool)}
+}
+
+// Sync enqueues the one-shots not enqueued before whose time is at most
+// Grace ago, and returns their names. Those further in the past are
+// skipped with a warning.
+func (l *OneShotLoader) Sync(ctx context.Context, now time.Time) ([]string, error) {
+	shots, err := l.Source.OneShots()
+	if err != nil {
+		return nil, err
+	}
+	fired, err := l.rdb.HGetAll(ctx, firedKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fired one-shots: %v", err)
+	}
+	var enqueued []string
+	for _, o := range shots {
+		if _, ok := fired[o.Name]; ok {
+			continue
+		}
+		if now.Sub(o.At) > l.Grace {
+			if !l.warned[o.Name] {
+				l.warned[o.Name] = true
+				log.Printf("⚠️  One-shot %s was due at %s, more than %v ago; skipping it", o.Name, o.At.Format(time.RFC3339), l.Grace)
+			}
+			continue
+		}
+		task, opts, err := o.Task()
+		if err != nil {
+			return enqueued, err
+		}
+		_, err = l.client.EnqueueContext(ctx, task, opts...)
+		switch {
+		case err == nil:
+			enqueued = append(enqueued, o.Name)
+			fmt.Printf("📌 One-shot %s enqueued for %s\n", o.Name, o.At.Format(time.RFC3339))
+		case errors.Is(err, asynq.ErrTaskIDConflict):
+			// Another instance enqueued it first
+		default:
+			return enqueued, fmt.Errorf("failed to enqueue one-shot %s: %v", o.Name, err)
+		}
+		if err := l.rdb.HSet(ctx, firedKey, o.Name, o.TaskID()).Err(); err != nil {
+			return enqueued, fmt.Errorf("failed to mark one-shot %s: %v", o.Name, err)
+		}
+	}
+	return enqueued, nil
+}
+
+// Run syncs at once and then every interval until ctx is done
+func (l *OneShotLoader) Run(ctx context.Context) error {
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := l.Sync(ctx, time.Now()); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// One-shot statuses
+const (
+	// OneShotPending is enqueued and waiting for its time
+	OneShotPending = "pending"
+	// OneShotFired is due: its task ran, runs, or waits for a worker
+	OneShotFired = "fired"
+	// OneShotSkipped was found too late to enqueue
+	OneShotSkipped = "skipped"
+	// OneShotUnsynced is not enqueued yet; the next sync will
+	OneShotUnsynced = "unsynced"
+)
+
+// OneShotStatus is the state of a one-shot entry
+type OneShotStatus struct {
+	Name   string    `json:"name"`
+	At     time.Time `json:"at"`
+	Type   string    `json:"type"`
+	Queue  string    `json:"queue"`
+	TaskID string    `json:"task_id"`
+	Status string    `json:"status"`
+	// TaskState is the state of its task while asynq keeps it
+	TaskState string `json:"task_state,omitempty"`
+}
+
+// OneShotStatuses returns the state of every one-shot of shots, by time
+func OneShotStatuses(ctx context.Context, inspector *asynq.Inspector, rdb redis.UniversalClient, shots []OneShot, grace time.Duration, now time.Time) ([]OneShotStatus, error) {
+	fired, err := rdb.HGetAll(ctx, firedKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fired one-shots: %v", err)
+	}
+	statuses := make([]OneShotStatus, 0, len(shots))
+	for _, o := range shots {
+		s := OneShotStatus{Name: o.Name, At: o.At.UTC(), Type: o.Type, Queue: o.queue(), TaskID: o.TaskID()}
+		info, err := inspector.GetTaskInfo(s.Queue, s.TaskID)
+		if err == nil {
+			s.TaskState = info.State.String()
+		}
+		_, marked := fired[o.Name]
+		switch {
+		case err == nil && info.State == asynq.TaskStateScheduled:
+			s.Status = OneShotPending
+		case err == nil || marked:
+			s.Status = OneShotFired
+		case now.Sub(o.At) > grace:
+			s.Status = OneShotSkipped
+		default:
+			s.Status = OneShotUnsynced
+		}
+		statuses = append(statuses, s)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].At.Before(statuses[j].At) })
+	return statuses, nil
+}
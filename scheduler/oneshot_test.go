@@ -0,0 +1,113 @@
+package scheduler_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/scheduler"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestOneShots syncs the one-shot entries of a schedule file against an
+// embedded Redis, and fails unless an entry due in the future is
+// scheduled and one due within the grace period is enqueued at once, one
+// past the grace period is skipped, and neither a restarted loader nor the
+// deletion of a processed task enqueues an entry again.
+func TestOneShots(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	path := filepath.Join(t.TempDir(), "schedule.yaml")
+	write := func(names ...string) {
+		at := map[string]time.Time{"launch": now.Add(time.Hour), "late": now.Add(-30 * time.Minute), "stale": now.Add(-3 * time.Hour), "added": now.Add(2 * time.Hour)}
+		data := "once:\n"
+		for _, name := range names {
+			data += fmt.Sprintf("  - name: %s\n    at: %s\n    type: %s\n    payload: {user_id: 1}\n", name, at[name].Format(time.RFC3339), common.TypeWelcomeMessage)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := scheduler.EntriesFile(path)
+	sync := func(want ...string) {
+		t.Helper()
+		loader := scheduler.NewOneShotLoader(source, client, rdb, time.Minute)
+		got, err := loader.Sync(ctx, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("sync enqueued %v, want %v", got, want)
+		}
+	}
+	statuses := func() map[string]string {
+		t.Helper()
+		shots, err := source.OneShots()
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := scheduler.OneShotStatuses(ctx, inspector, rdb, shots, scheduler.DefaultOneShotGrace, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]string, len(list))
+		for _, s := range list {
+			m[s.Name] = s.Status
+		}
+		return m
+	}
+
+	write("launch", "late", "stale")
+	if got, want := statuses(), map[string]string{"launch": scheduler.OneShotUnsynced, "late": scheduler.OneShotUnsynced, "stale": scheduler.OneShotSkipped}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("statuses before the first sync are %v, want %v", got, want)
+	}
+	sync("launch", "late")
+	launch, err := inspector.GetTaskInfo("default", "once-launch")
+	if err != nil || launch.State != asynq.TaskStateScheduled || !launch.NextProcessAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("launch is %+v (%v), want scheduled for %s", launch, err, now.Add(time.Hour))
+	}
+	if late, err := inspector.GetTaskInfo("default", "once-late"); err != nil || late.State != asynq.TaskStatePending {
+		t.Fatalf("late is %+v (%v), want pending", late, err)
+	}
+	if _, err := inspector.GetTaskInfo("default", "once-stale"); err == nil {
+		t.Fatal("stale was enqueued past its grace period")
+	}
+
+	// A restarted scheduler, also after the late task was processed and
+	// deleted, enqueues nothing again
+	sync()
+	if err := inspector.DeleteTask("default", "once-late"); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	q, err := inspector.GetQueueInfo("default")
+	if err != nil || q.Size != 1 {
+		t.Fatalf("default queue is %+v (%v), want only launch", q, err)
+	}
+
+	write("launch", "late", "stale", "added")
+	if got, want := statuses(), map[string]string{"launch": scheduler.OneShotPending, "late": scheduler.OneShotFired, "stale": scheduler.OneShotSkipped, "added": scheduler.OneShotUnsynced}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("statuses are %v, want %v", got, want)
+	}
+	sync("added")
+}
@@ -0,0 +1,148 @@
+package scheduler_test
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+
+	"github.com/hibiken/asynq"
+)
+
+// recordingClient records when a scheduler enqueued each task type. Its
+// postEnqueue is the PostEnqueueFunc of asynq.SchedulerOpts.
+type recordingClient struct {
+	mu    sync.Mutex
+	fired map[string][]time.Time
+}
+
+func newRecordingClient() *recordingClient {
+	return &recordingClient{fired: make(map[string][]time.Time)}
+}
+
+// postEnqueue records successful enqueues
+func (c *recordingClient) postEnqueue(info *asynq.TaskInfo, err error) {
+	if err != nil || info == nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fired[info.Type] = append(c.fired[info.Type], now)
+}
+
+// firings returns the enqueue times of taskType in order
+func (c *recordingClient) firings(taskType string) []time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := append([]time.Time(nil), c.fired[taskType]...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Before(out[j]) })
+	return out
+}
+
+// accuracy is how precisely one entry fired
+type accuracy struct {
+	firings int
+	// onTime counts firings within the tolerance of their expected time
+	onTime int
+	// maxDrift is the largest distance from an expected time
+	maxDrift time.Duration
+}
+
+func (a accuracy) onTimeRatio() float64 {
+	if a.firings == 0 {
+		return 0
+	}
+	return float64(a.onTime) / float64(a.firings)
+}
+
+// measureAccuracy compares the firings of an "@every interval" entry
+// registered at start with their expected times. Intervals are aligned to
+// whole seconds, so the n-th firing is due n intervals after start truncated
+// to the second.
+func measureAccuracy(firings []time.Time, start time.Time, interval, tolerance time.Duration) accuracy {
+	a := accuracy{firings: len(firings)}
+	base := start.Truncate(time.Second)
+	for i, f := range firings {
+		drift := f.Sub(base.Add(time.Duration(i+1) * interval))
+		if drift < 0 {
+			drift = -drift
+		}
+		if drift <= tolerance {
+			a.onTime++
+		}
+		if drift > a.maxDrift {
+			a.maxDrift = drift
+		}
+	}
+	return a
+}
+
+func TestMeasureAccuracy(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 300e6, time.UTC)
+	base := start.Truncate(time.Second)
+	firings := []time.Time{
+		base.Add(time.Second + 100*time.Millisecond),
+		base.Add(2*time.Second - 400*time.Millisecond),
+		base.Add(3*time.Second + 700*time.Millisecond),
+		base.Add(4 * time.Second),
+	}
+	a := measureAccuracy(firings, start, time.Second, 500*time.Millisecond)
+	if a.firings != 4 || a.onTime != 3 || a.maxDrift != 700*time.Millisecond || a.onTimeRatio() != 0.75 {
+		t.Errorf("got %+v", a)
+	}
+	if r := measureAccuracy(nil, start, time.Second, time.Second).onTimeRatio(); r != 0 {
+		t.Errorf("ratio of no firings %v", r)
+	}
+}
+
+// TestSchedulerAccuracy registers 20 "@every 1s" entries, runs the
+// scheduler for 30s and fails unless every entry fired within 500ms of its
+// expected time at least 90% of the time and 28 to 32 times. It is slow, so
+// it only runs with ASYNQ_SLOW_TESTS=1.
+func TestSchedulerAccuracy(t *testing.T) {
+	if os.Getenv("ASYNQ_SLOW_TESTS") != "1" {
+		t.Skip("set ASYNQ_SLOW_TESTS=1 to run scheduler accuracy tests")
+	}
+	const (
+		entries  = 20
+		interval = time.Second
+		d        = 30 * time.Second
+	)
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	recorder := newRecordingClient()
+	sched := asynq.NewScheduler(srv.ConnOpt(), &asynq.SchedulerOpts{PostEnqueueFunc: recorder.postEnqueue, LogLevel: asynq.ErrorLevel})
+
+	cron := fmt.Sprintf("@every %v", interval)
+	starts := make([]time.Time, entries)
+	for i := range starts {
+		starts[i] = time.Now()
+		if _, err := sched.Register(cron, asynq.NewTask(fmt.Sprintf("accuracy:entry-%d", i), nil), asynq.Queue("scheduler-accuracy")); err != nil {
+			t.Fatalf("failed to register entry %d: %v", i, err)
+		}
+	}
+	if err := sched.Start(); err != nil {
+		t.Fatalf("failed to start scheduler: %v", err)
+	}
+	time.Sleep(d)
+	sched.Shutdown()
+
+	for i, start := range starts {
+		taskType := fmt.Sprintf("accuracy:entry-%d", i)
+		a := measureAccuracy(recorder.firings(taskType), start, interval, 500*time.Millisecond)
+		if a.firings < 28 || a.firings > 32 {
+			t.Errorf("%s fired %d times, want 28 to 32", taskType, a.firings)
+		}
+		if a.onTimeRatio() < 0.9 {
+			t.Errorf("%s fired on time %d of %d times (max drift %v), want at least 90%%", taskType, a.onTime, a.firings, a.maxDrift)
+		}
+	}
+}
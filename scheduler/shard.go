@@ -0,0 +1,442 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Defaults of the sharded schedule
+const (
+	DefaultShardCount   = 16
+	DefaultSyncInterval = 10 * time.Second
+	DefaultShardTTL     = 30 * time.Second
+)
+
+// ringReplicas is the number of points of each shard on the hash ring
+const ringReplicas = 64
+
+// Ring assigns entry IDs to shards by consistent hashing, so changing the
+// number of shards moves only the entries of the shards added or removed
+type Ring struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// hash64 spreads similar IDs, such as numbered customers, evenly
+func hash64(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// NewRing creates a ring of shards numbered from 0
+func NewRing(shards int) *Ring {
+	r := &Ring{points: make([]ringPoint, 0, shards*ringReplicas)}
+	for s := 0; s < shards; s++ {
+		for i := 0; i < ringReplicas; i++ {
+			r.points = append(r.points, ringPoint{hash: hash64(fmt.Sprintf("shard-%d-%d", s, i)), shard: s})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// Shard returns the shard of an entry ID
+func (r *Ring) Shard(id string) int {
+	h := hash64(id)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// ParseShards parses a shard set such as "0-3,8", checking each is below total
+func ParseShards(s string, total int) ([]int, error) {
+	var shards []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard %q", part)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(to); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid shard range %q", part)
+			}
+		}
+		if lo < 0 || hi >= total {
+			return nil, fmt.Errorf("shard %q outside 0-%d", part, total-1)
+		}
+		for s := lo; s <= hi; s++ {
+			shards = append(shards, s)
+		}
+	}
+	return shards, nil
+}
+
+// claimScript takes a free shard or extends the caller's own claim
+var claimScript = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if not owner then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseScript gives up a shard only when the caller still holds it
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func shardKey(shard int) string {
+	return fmt.Sprintf("scheduler:shard:%d", shard)
+}
+
+// ShardClaimer holds per-shard leases in Redis, one owner per shard. An
+// instance claims its preferred shards and, with Failover, any shard left
+// free, e.g. by an instance that died, once its lease expired.
+//
+// A claim counts locally only until TTL minus Grace after it was taken or
+// renewed. With Grace longer than the config sync interval, an instance that
+// stops renewing has dropped the shard's entries before the lease expires
+// and another instance can take it, so no entry is registered twice.
+type ShardClaimer struct {
+	rdb       redis.UniversalClient
+	owner     string
+	total     int
+	preferred map[int]bool
+	started   time.Time
+
+	// Failover also claims free shards that are not preferred, after the
+	// instance ran for TTL so preferred owners start first
+	Failover bool
+	TTL      time.Duration
+	Grace    time.Duration
+
+	mu    sync.Mutex
+	valid map[int]time.Time
+}
+
+// NewShardClaimer creates a claimer for owner of the preferred shards among
+// total
+func NewShardClaimer(rdb redis.UniversalClient, owner string, total int, preferred []int) *ShardClaimer {
+	c := &ShardClaimer{
+		rdb:       rdb,
+		owner:     owner,
+		total:     total,
+		preferred: make(map[int]bool, len(preferred)),
+		started:   time.Now(),
+		Failover:  true,
+		TTL:       DefaultShardTTL,
+		Grace:     DefaultSyncInterval + 2*time.Second,
+		valid:     make(map[int]time.Time),
+	}
+	for _, s := range preferred {
+		c.preferred[s] = true
+	}
+	return c
+}
+
+// Claim takes or renews the shards this instance may hold
+func (c *ShardClaimer) Claim(ctx context.Context) error {
+	failover := c.Failover && time.Since(c.started) >= c.TTL
+	var firstErr error
+	for s := 0; s < c.total; s++ {
+		if !c.preferred[s] && !failover && !c.Owns(s) {
+			continue
+		}
+		start := time.Now()
+		ok, err := claimScript.Run(ctx, c.rdb, []string{shardKey(s)}, c.owner, c.TTL.Milliseconds()).Bool()
+		c.mu.Lock()
+		switch {
+		case err != nil:
+			// Keep the claim until it lapses, Redis may be back by then
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to claim shard %d: %v", s, err)
+			}
+		case ok:
+			if _, held := c.valid[s]; !held {
+				log.Printf("🧩 Scheduler %s claimed shard %d", c.owner, s)
+			}
+			c.valid[s] = start.Add(c.TTL - c.Grace)
+		default:
+			delete(c.valid, s)
+		}
+		c.mu.Unlock()
+	}
+	return firstErr
+}
+
+// Owns reports whether the instance holds a shard
+func (c *ShardClaimer) Owns(shard int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(c.valid[shard])
+}
+
+// Claimed returns the shards the instance holds
+func (c *ShardClaimer) Claimed() []int {
+	var shards []int
+	for s := 0; s < c.total; s++ {
+		if c.Owns(s) {
+			shards = append(shards, s)
+		}
+	}
+	return shards
+}
+
+// Release gives up every shard, so other instances can take them at once
+func (c *ShardClaimer) Release(ctx context.Context) {
+	c.mu.Lock()
+	held := c.valid
+	c.valid = make(map[int]time.Time)
+	c.mu.Unlock()
+	for s := range held {
+		if err := releaseScript.Run(ctx, c.rdb, []string{shardKey(s)}, c.owner).Err(); err != nil {
+			log.Printf("⚠️  Failed to release scheduler shard %d: %v", s, err)
+		}
+	}
+}
+
+// Run claims shards every third of the TTL until ctx is done
+func (c *ShardClaimer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.TTL / 3)
+	defer ticker.Stop()
+	for {
+		if err := c.Claim(ctx); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ShardedProvider is an asynq.PeriodicTaskConfigProvider serving the
+// entries of the shards the claimer holds
+type ShardedProvider struct {
+	Source  EntrySource
+	Ring    *Ring
+	Claimer *ShardClaimer
+	// Suspensions leaves the suspended entries out; nil registers all
+	Suspensions *Suspensions
+
+	mu   sync.Mutex
+	last []Entry
+	// suspended holds the entries left out at the last sync
+	suspended map[string]bool
+}
+
+// GetConfigs returns the configs of the claimed shards' entries. When the
+// source fails it keeps using the entries last read, because the manager
+// would keep every registered entry on an error, even of shards given up.
+func (p *ShardedProvider) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
+	entries, err := p.Source.Entries()
+	p.mu.Lock()
+	if err == nil {
+		p.last = entries
+	} else if p.last != nil {
+		log.Printf("⚠️  %v, keeping the entries last read", err)
+		entries, err = p.last, nil
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[int]bool)
+	for _, s := range p.Claimer.Claimed() {
+		owned[s] = true
+	}
+	var mine []Entry
+	for _, e := range entries {
+		if owned[p.Ring.Shard(e.ID)] {
+			mine = append(mine, e)
+		}
+	}
+	if p.Suspensions != nil {
+		if mine, err = p.suspend(mine); err != nil {
+			return nil, err
+		}
+	}
+	var configs []*asynq.PeriodicTaskConfig
+	for _, e := range mine {
+		c, err := e.Config()
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+// suspend drops the suspended entries, whose ticks are skipped until they
+// are registered again, and logs the entries suspended and resumed
+func (p *ShardedProvider) suspend(entries []Entry) ([]Entry, error) {
+	active, suspended, err := p.Suspensions.Gate(context.Background(), entries, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := make(map[string]bool, len(suspended))
+	for _, st := range suspended {
+		now[st.ID] = true
+		if !p.suspended[st.ID] {
+			log.Printf("⏸️  Entry %s suspended (%s), skipping its ticks", st.ID, strings.Join(st.By, ", "))
+		}
+	}
+	for _, e := range active {
+		if p.suspended[e.ID] {
+			log.Printf("▶️  Entry %s resumed", e.ID)
+		}
+	}
+	p.suspended = now
+	return active, nil
+}
+
+// ShardConfig configures the sharded schedule
+type ShardConfig struct {
+	File         string
+	Shards       int
+	Preferred    []int
+	Failover     bool
+	SyncInterval time.Duration
+	OneShotGrace time.Duration
+	// PostEnqueueFunc is called after each tick's enqueue, as in
+	// asynq.SchedulerOpts
+	PostEnqueueFunc func(info *asynq.TaskInfo, err error)
+}
+
+// ShardConfigFromEnv reads PERIODIC_ENTRIES_FILE, which enables the sharded
+// schedule, SCHEDULER_SHARD_COUNT (default 16), SCHEDULER_SHARDS, the
+// preferred shards such as "0-7" (default all), SCHEDULER_SHARD_FAILOVER
+// ("false" to only ever hold the preferred shards) and
+// SCHEDULER_SYNC_INTERVAL (default 10s), which also paces the one-shot
+// entries, late by at most SCHEDULER_ONE_SHOT_GRACE (default 1h). It
+// returns nil without a file.
+func ShardConfigFromEnv() (*ShardConfig, error) {
+	file := os.Getenv("PERIODIC_ENTRIES_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	c := &ShardConfig{File: file, Shards: DefaultShardCount, Failover: os.Getenv("SCHEDULER_SHARD_FAILOVER") != "false", SyncInterval: DefaultSyncInterval, OneShotGrace: DefaultOneShotGrace}
+	if v := os.Getenv("SCHEDULER_SHARD_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid SCHEDULER_SHARD_COUNT %q", v)
+		}
+		c.Shards = n
+	}
+	if v := os.Getenv("SCHEDULER_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SCHEDULER_SYNC_INTERVAL %q", v)
+		}
+		c.SyncInterval = d
+	}
+	if v := os.Getenv("SCHEDULER_ONE_SHOT_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid SCHEDULER_ONE_SHOT_GRACE %q", v)
+		}
+		c.OneShotGrace = d
+	}
+	if v := os.Getenv("SCHEDULER_SHARDS"); v != "" {
+		shards, err := ParseShards(v, c.Shards)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SCHEDULER_SHARDS: %v", err)
+		}
+		c.Preferred = shards
+	} else {
+		for s := 0; s < c.Shards; s++ {
+			c.Preferred = append(c.Preferred, s)
+		}
+	}
+	return c, nil
+}
+
+// ShardedScheduler runs asynq's PeriodicTaskManager over the entries of the
+// shards this instance claims
+type ShardedScheduler struct {
+	Claimer  *ShardClaimer
+	Provider *ShardedProvider
+	manager  *asynq.PeriodicTaskManager
+}
+
+// NewShardedScheduler creates the claimer, the provider and the manager of
+// c for owner
+func NewShardedScheduler(redisConnOpt asynq.RedisConnOpt, rdb redis.UniversalClient, owner string, c *ShardConfig) (*ShardedScheduler, error) {
+	claimer := NewShardClaimer(rdb, owner, c.Shards, c.Preferred)
+	claimer.Failover = c.Failover
+	claimer.Grace = c.SyncInterval + 2*time.Second
+	if claimer.TTL < 3*claimer.Grace {
+		claimer.TTL = 3 * claimer.Grace
+	}
+	source := EntriesFile(c.File)
+	provider := &ShardedProvider{Source: source, Ring: NewRing(c.Shards), Claimer: claimer, Suspensions: NewSuspensions(rdb, source)}
+	manager, err := asynq.NewPeriodicTaskManager(asynq.PeriodicTaskManagerOpts{
+		PeriodicTaskConfigProvider: provider,
+		RedisConnOpt:               redisConnOpt,
+		SchedulerOpts:              &asynq.SchedulerOpts{PostEnqueueFunc: c.PostEnqueueFunc},
+		SyncInterval:               c.SyncInterval,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sharded scheduler: %v", err)
+	}
+	return &ShardedScheduler{Claimer: claimer, Provider: provider, manager: manager}, nil
+}
+
+// Run claims shards and keeps the manager in sync with them until ctx is
+// done, then gives the shards up
+func (s *ShardedScheduler) Run(ctx context.Context) error {
+	if err := s.Claimer.Claim(ctx); err != nil {
+		log.Printf("⚠️  %v", err)
+	}
+	if err := s.manager.Start(); err != nil {
+		return fmt.Errorf("failed to start sharded scheduler: %v", err)
+	}
+	claimCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Claimer.Run(claimCtx)
+	}()
+	<-ctx.Done()
+	// Stop scheduling before giving the shards to other instances
+	s.manager.Shutdown()
+	cancel()
+	<-done
+	s.Claimer.Release(context.Background())
+	return nil
+}
@@ -0,0 +1,124 @@
+package scheduler_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/scheduler"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TestShardCoverage runs two sharded schedulers preferring half of 8
+// shards each over 1000 synthetic per-customer entries, and fails unless
+// together they serve every entry exactly once, and unless the survivor
+// takes over the shards of the other after it dies without any entry being
+// served by both at any time.
+func TestShardCoverage(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	const (
+		shards  = 8
+		entries = 1000
+	)
+	ctx := context.Background()
+	rdb, ok := r.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		t.Fatalf("unsupported redis connection %T", r)
+	}
+	defer rdb.Close()
+	source := scheduler.EntriesFunc(func() ([]scheduler.Entry, error) {
+		list := make([]scheduler.Entry, entries)
+		for i := range list {
+			list[i] = scheduler.Entry{
+				ID:       fmt.Sprintf("digest-customer-%d", i),
+				Cronspec: "0 8 * * *",
+				Type:     common.TypeEmailTask,
+				Payload:  map[string]interface{}{"user_id": i + 1, "email": fmt.Sprintf("customer%d@example.com", i), "subject": "Digest", "category": common.CategoryDigest},
+			}
+		}
+		return list, nil
+	})
+	ring := scheduler.NewRing(shards)
+	newInstance := func(owner, preferred string) *scheduler.ShardedProvider {
+		set, err := scheduler.ParseShards(preferred, shards)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := scheduler.NewShardClaimer(rdb, owner, shards, set)
+		c.TTL, c.Grace = 1500*time.Millisecond, 500*time.Millisecond
+		return &scheduler.ShardedProvider{Source: source, Ring: ring, Claimer: c}
+	}
+	a, b := newInstance("scheduler-a", "0-3"), newInstance("scheduler-b", "4-7")
+
+	// coverage returns how many entries are served and fails t for any
+	// served by both
+	coverage := func(when string) int {
+		served := make(map[string]string)
+		for name, p := range map[string]*scheduler.ShardedProvider{"a": a, "b": b} {
+			configs, err := p.GetConfigs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range configs {
+				key := string(c.Task.Payload())
+				if other, ok := served[key]; ok {
+					t.Fatalf("%s: entry %s served by both %s and %s", when, key, other, name)
+				}
+				served[key] = name
+			}
+		}
+		return len(served)
+	}
+
+	for _, p := range []*scheduler.ShardedProvider{a, b} {
+		if err := p.Claimer.Claim(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := coverage("both running"); n != entries {
+		t.Fatalf("both running: %d of %d entries served", n, entries)
+	}
+	perShard := make(map[int]int)
+	list, _ := source.Entries()
+	for _, e := range list {
+		perShard[ring.Shard(e.ID)]++
+	}
+	for s := 0; s < shards; s++ {
+		if perShard[s] < entries/shards/3 {
+			t.Errorf("shard %d got %d of %d entries", s, perShard[s], entries)
+		}
+	}
+
+	// a dies without releasing its shards; b renews and fails over
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		time.Sleep(100 * time.Millisecond)
+		if err := b.Claimer.Claim(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if n := coverage("failing over"); n == entries && len(a.Claimer.Claimed()) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("b did not take over a's shards, holding %v", b.Claimer.Claimed())
+		}
+	}
+
+	// a restarted finds its shards taken and serves nothing
+	a = newInstance("scheduler-a", "0-3")
+	if err := a.Claimer.Claim(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := coverage("after restart"); n != entries {
+		t.Errorf("after restart: %d of %d entries served", n, entries)
+	}
+}
@@ -0,0 +1,468 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"asynqdemo/admin"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"github.com/robfig/cron/v3"
+)
+
+// suspendedKey maps the targets suspended through the admin API, entries
+// and groups, to their JSON Suspension
+const suspendedKey = "scheduler:suspended"
+
+// flaggedKey maps the IDs of the entries the schedule file suspends to
+// when the flag was first seen, to count their skipped ticks from
+const flaggedKey = "scheduler:suspended:flagged"
+
+// maxSkipped bounds the ticks counted for one suspension
+const maxSkipped = 100000
+
+// Causes of a suspension
+const (
+	ByEntry       = "entry"
+	ByGroup       = "group"
+	ByConfig      = "config"
+	ByGroupConfig = "group-config"
+	ByWindow      = "window"
+	ByGroupWindow = "group-window"
+)
+
+// Window suspends an entry or a group from Start until End, e.g. over a
+// tenant's off-season. A date without a time is midnight UTC, so End is
+// the first day the entries run again.
+type Window struct {
+	Start time.Time `yaml:"start" json:"start"`
+	End   time.Time `yaml:"end" json:"end"`
+}
+
+func (w Window) active(now time.Time) bool {
+	return !now.Before(w.Start) && now.Before(w.End)
+}
+
+func checkWindows(windows []Window) error {
+	for _, w := range windows {
+		if w.Start.IsZero() || !w.End.After(w.Start) {
+			return fmt.Errorf("suspension window %s - %s does not end after it starts", w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Group is the suspension of the entries of a group in the schedule file
+type Group struct {
+	Suspended   bool     `yaml:"suspended,omitempty"`
+	Suspensions []Window `yaml:"suspensions,omitempty"`
+}
+
+// GroupSource lists the groups of the schedule file
+type GroupSource interface {
+	Groups() (map[string]Group, error)
+}
+
+// EntryTarget names an entry for Suspend and Resume
+func EntryTarget(id string) string {
+	return ByEntry + ":" + id
+}
+
+// GroupTarget names a group of entries for Suspend and Resume
+func GroupTarget(name string) string {
+	return ByGroup + ":" + name
+}
+
+// Suspension is a suspension made through the admin API
+type Suspension struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// EntryState is whether an entry is suspended, why, and how many of its
+// ticks were skipped since
+type EntryState struct {
+	ID        string    `json:"id"`
+	Group     string    `json:"group,omitempty"`
+	Cronspec  string    `json:"cron"`
+	Type      string    `json:"type"`
+	Suspended bool      `json:"suspended"`
+	By        []string  `json:"by,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	// Until is when the windows suspending the entry end, unset when
+	// another cause suspends it too
+	Until   time.Time `json:"until,omitempty"`
+	Skipped int       `json:"skipped"`
+}
+
+// Resumed is an entry a Resume let run again
+type Resumed struct {
+	ID      string `json:"id"`
+	Skipped int    `json:"skipped"`
+	// CatchUpTaskID is the task enqueued for the skipped ticks
+	CatchUpTaskID string `json:"catch_up_task_id,omitempty"`
+	// StillSuspendedBy lists the other causes keeping the entry suspended
+	StillSuspendedBy []string `json:"still_suspended_by,omitempty"`
+}
+
+// ErrUnknownTarget is returned for suspensions of entries and groups the
+// schedule file does not declare
+var ErrUnknownTarget = errors.New("unknown schedule entry or group")
+
+// Suspensions decides which entries of a schedule are suspended: by the
+// flags and windows of the file, or through the admin API, which keeps
+// its suspensions in Redis so every scheduler instance honors them
+type Suspensions struct {
+	rdb    redis.UniversalClient
+	source EntrySource
+}
+
+// NewSuspensions creates the suspensions of the entries of source, and of
+// its groups when it is a GroupSource
+func NewSuspensions(rdb redis.UniversalClient, source EntrySource) *Suspensions {
+	return &Suspensions{rdb: rdb, source: source}
+}
+
+// load reads the entries and groups of the source
+func (s *Suspensions) load() ([]Entry, map[string]Group, error) {
+	entries, err := s.source.Entries()
+	if err != nil {
+		return nil, nil, err
+	}
+	var groups map[string]Group
+	if gs, ok := s.source.(GroupSource); ok {
+		if groups, err = gs.Groups(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return entries, groups, nil
+}
+
+// check returns ErrUnknownTarget unless target names an entry or group
+func (s *Suspensions) check(target string) error {
+	entries, groups, err := s.load()
+	if err != nil {
+		return err
+	}
+	kind, name, _ := strings.Cut(target, ":")
+	if _, ok := groups[name]; ok && kind == ByGroup {
+		return nil
+	}
+	for _, e := range entries {
+		if (kind == ByEntry && e.ID == name) || (kind == ByGroup && e.Group == name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownTarget, target)
+}
+
+// Suspend suspends target from now. Suspending it again keeps the first
+// time, so the skipped ticks are counted from there.
+func (s *Suspensions) Suspend(ctx context.Context, target, reason string, now time.Time) error {
+	if err := s.check(target); err != nil {
+		return err
+	}
+	data, err := json.Marshal(Suspension{Since: now.UTC(), Reason: reason})
+	if err != nil {
+		return fmt.Errorf("failed to marshal suspension: %v", err)
+	}
+	if err := s.rdb.HSetNX(ctx, suspendedKey, target, data).Err(); err != nil {
+		return fmt.Errorf("failed to suspend %s: %v", target, err)
+	}
+	return nil
+}
+
+// Resume lifts the suspension of target made through Suspend and returns
+// the entries it lets run again. With catchUp, each of them that skipped
+// ticks is enqueued once; the task ID is derived from the suspension, so
+// resuming twice does not enqueue it again.
+func (s *Suspensions) Resume(ctx context.Context, client *asynq.Client, target string, catchUp bool, now time.Time) ([]Resumed, error) {
+	if err := s.check(target); err != nil {
+		return nil, err
+	}
+	entries, groups, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	before, err := s.states(ctx, entries, groups, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rdb.HDel(ctx, suspendedKey, target).Err(); err != nil {
+		return nil, fmt.Errorf("failed to resume %s: %v", target, err)
+	}
+	after, err := s.states(ctx, entries, groups, now)
+	if err != nil {
+		return nil, err
+	}
+	resumed := []Resumed{}
+	for i, b := range before {
+		if !b.Suspended || !contains(b.By, strings.SplitN(target, ":", 2)[0]) || !matches(target, b) {
+			continue
+		}
+		r := Resumed{ID: b.ID, Skipped: b.Skipped}
+		if a := after[i]; a.Suspended {
+			r.StillSuspendedBy = a.By
+		} else if catchUp && b.Skipped > 0 {
+			if r.CatchUpTaskID, err = CatchUp(client, entries[i], b.Since); err != nil {
+				return resumed, err
+			}
+		}
+		resumed = append(resumed, r)
+	}
+	return resumed, nil
+}
+
+// matches reports whether target names the entry of state
+func matches(target string, state EntryState) bool {
+	return target == EntryTarget(state.ID) || (state.Group != "" && target == GroupTarget(state.Group))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CatchUp enqueues one task of e for the ticks it skipped while suspended
+// since since, and returns its ID
+func CatchUp(client *asynq.Client, e Entry, since time.Time) (string, error) {
+	c, err := e.Config()
+	if err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("catchup-%s-%d", e.ID, since.Unix())
+	_, err = client.Enqueue(c.Task, append(c.Opts, asynq.TaskID(id))...)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return "", fmt.Errorf("failed to enqueue catch-up of %s: %v", e.ID, err)
+	}
+	return id, nil
+}
+
+// States returns the state of every entry of the source, in file order
+func (s *Suspensions) States(ctx context.Context, now time.Time) ([]EntryState, error) {
+	entries, groups, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return s.states(ctx, entries, groups, now)
+}
+
+func (s *Suspensions) states(ctx context.Context, entries []Entry, groups map[string]Group, now time.Time) ([]EntryState, error) {
+	manual, err := s.rdb.HGetAll(ctx, suspendedKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read suspensions: %v", err)
+	}
+	flagged, err := s.rdb.HGetAll(ctx, flaggedKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read suspensions: %v", err)
+	}
+	states := make([]EntryState, 0, len(entries))
+	for _, e := range entries {
+		st := EntryState{ID: e.ID, Group: e.Group, Cronspec: e.Cronspec, Type: e.Type}
+		cause := func(by string, since time.Time) {
+			st.By = append(st.By, by)
+			if st.Since.IsZero() || since.Before(st.Since) {
+				st.Since = since
+			}
+		}
+		for _, target := range []string{EntryTarget(e.ID), GroupTarget(e.Group)} {
+			data, ok := manual[target]
+			if !ok || (e.Group == "" && target == GroupTarget("")) {
+				continue
+			}
+			var m Suspension
+			if err := json.Unmarshal([]byte(data), &m); err != nil {
+				return nil, fmt.Errorf("invalid suspension of %s: %v", target, err)
+			}
+			cause(strings.SplitN(target, ":", 2)[0], m.Since)
+			if st.Reason == "" {
+				st.Reason = m.Reason
+			}
+		}
+		g := groups[e.Group]
+		if e.Suspended || g.Suspended {
+			// Counted from the first sync that saw the flag
+			since := now
+			if v, ok := flagged[e.ID]; ok {
+				if t, err := time.Parse(time.RFC3339, v); err == nil {
+					since = t
+				}
+			}
+			if e.Suspended {
+				cause(ByConfig, since)
+			}
+			if g.Suspended {
+				cause(ByGroupConfig, since)
+			}
+		}
+		windowsOnly := len(st.By) == 0
+		for _, ws := range []struct {
+			by      string
+			windows []Window
+		}{{ByWindow, e.Suspensions}, {ByGroupWindow, g.Suspensions}} {
+			for _, w := range ws.windows {
+				if !w.active(now) {
+					continue
+				}
+				if !contains(st.By, ws.by) {
+					cause(ws.by, w.Start)
+				} else if w.Start.Before(st.Since) {
+					st.Since = w.Start
+				}
+				if windowsOnly && w.End.After(st.Until) {
+					st.Until = w.End
+				}
+			}
+		}
+		if st.Suspended = len(st.By) > 0; st.Suspended {
+			st.Since = st.Since.UTC()
+			st.Skipped = skippedTicks(e.Cronspec, st.Since, now)
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// skippedTicks counts the ticks of spec after since up to now
+func skippedTicks(spec string, since, now time.Time) int {
+	sched, err := cronParser.Parse(spec)
+	if err != nil {
+		return 0
+	}
+	if every, ok := sched.(cron.ConstantDelaySchedule); ok {
+		n := int(now.Sub(since) / every.Delay)
+		if n > maxSkipped {
+			n = maxSkipped
+		}
+		return n
+	}
+	n := 0
+	for t := sched.Next(since.UTC()); !t.IsZero() && !t.After(now) && n < maxSkipped; t = sched.Next(t) {
+		n++
+	}
+	return n
+}
+
+// Gate returns the entries of entries not suspended at now, for the
+// config provider to register. It records when the file first flags an
+// entry as suspended and forgets it once the flag is gone.
+func (s *Suspensions) Gate(ctx context.Context, entries []Entry, now time.Time) ([]Entry, []EntryState, error) {
+	var groups map[string]Group
+	if gs, ok := s.source.(GroupSource); ok {
+		var err error
+		if groups, err = gs.Groups(); err != nil {
+			return nil, nil, err
+		}
+	}
+	states, err := s.states(ctx, entries, groups, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	flagged, err := s.rdb.HGetAll(ctx, flaggedKey).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read suspensions: %v", err)
+	}
+	var active []Entry
+	var suspended []EntryState
+	for i, e := range entries {
+		_, seen := flagged[e.ID]
+		switch flag := e.Suspended || groups[e.Group].Suspended; {
+		case flag && !seen:
+			err = s.rdb.HSetNX(ctx, flaggedKey, e.ID, now.UTC().Format(time.RFC3339)).Err()
+		case !flag && seen:
+			err = s.rdb.HDel(ctx, flaggedKey, e.ID).Err()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to record the suspension of %s: %v", e.ID, err)
+		}
+		if states[i].Suspended {
+			suspended = append(suspended, states[i])
+			continue
+		}
+		active = append(active, e)
+	}
+	return active, suspended, nil
+}
+
+// Handler serves the entries of the schedule with their suspensions on GET
+// /admin/schedule/entries, and suspends and resumes an entry or a group on
+// POST /admin/schedule/suspend with {"entry" or "group", "reason"} and
+// POST /admin/schedule/resume with {"entry" or "group", "catch_up"}
+func Handler(s *Suspensions, client *asynq.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := strings.TrimPrefix(r.URL.Path, "/admin/schedule/")
+		if action == "entries" {
+			if r.Method != http.MethodGet {
+				admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			states, err := s.States(r.Context(), time.Now())
+			if err != nil {
+				admin.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			sort.SliceStable(states, func(i, j int) bool { return states[i].Suspended && !states[j].Suspended })
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"entries": states})
+			return
+		}
+		if action != "suspend" && action != "resume" {
+			admin.WriteError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodPost {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req struct {
+			Entry   string `json:"entry"`
+			Group   string `json:"group"`
+			Reason  string `json:"reason"`
+			CatchUp bool   `json:"catch_up"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Entry == "") == (req.Group == "") {
+			admin.WriteError(w, http.StatusBadRequest, `expected {"entry": "id"} or {"group": "name"}`)
+			return
+		}
+		target := EntryTarget(req.Entry)
+		if req.Group != "" {
+			target = GroupTarget(req.Group)
+		}
+		var (
+			resp interface{}
+			err  error
+		)
+		if action == "suspend" {
+			if err = s.Suspend(r.Context(), target, req.Reason, time.Now()); err == nil {
+				log.Printf("⏸️  Schedule %s suspended by %s", target, r.RemoteAddr)
+			}
+			resp = map[string]string{"suspended": target}
+		} else {
+			var resumed []Resumed
+			if resumed, err = s.Resume(r.Context(), client, target, req.CatchUp, time.Now()); err == nil {
+				log.Printf("▶️  Schedule %s resumed by %s, %d entries running again", target, r.RemoteAddr, len(resumed))
+			}
+			resp = map[string]interface{}{"resumed": resumed}
+		}
+		switch {
+		case errors.Is(err, ErrUnknownTarget):
+			admin.WriteError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			admin.WriteError(w, http.StatusInternalServerError, err.Error())
+		default:
+			admin.WriteJSON(w, http.StatusOK, resp)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package scheduler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/scheduler"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestScheduleSuspension runs the sharded schedule of a file on an
+// embedded Redis and fails unless suspending a group stops its entry
+// ticking while the others keep going and the skipped ticks are counted,
+// the file's suspended flag and active windows keep their entries from
+// ever running, and resuming with catch-up enqueues exactly one task for
+// the skipped ticks, also when resumed twice, before the entry ticks again.
+func TestScheduleSuspension(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	digest := func(subject string) string {
+		return fmt.Sprintf(`{user_id: 1, email: tenant@example.com, subject: %s, category: %s}`, subject, common.CategoryDigest)
+	}
+	file := filepath.Join(t.TempDir(), "entries.yaml")
+	schedule := fmt.Sprintf(`entries:
+  - {id: digest-a, cron: "@every 1s", type: %[1]s, group: tenant-a, payload: %[2]s}
+  - {id: report-b, cron: "@every 1s", type: %[1]s, payload: %[3]s}
+  - {id: paused, cron: "@every 1s", type: %[1]s, suspended: true, payload: %[4]s}
+  - id: offseason
+    cron: "@every 1s"
+    type: %[1]s
+    group: tenant-c
+    payload: %[5]s
+groups:
+  tenant-c:
+    suspensions:
+      - {start: %[6]s, end: %[7]s}
+`, common.TypeEmailTask, digest("digest-a"), digest("report-b"), digest("paused"), digest("offseason"),
+		now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339))
+	if err := os.WriteFile(file, []byte(schedule), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(file), "bad.yaml"), []byte("entries: []\ngroups:\n  x:\n    suspensions: [{start: 2026-06-01, end: 2026-05-01}]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scheduler.EntriesFile(filepath.Join(filepath.Dir(file), "bad.yaml")).Entries(); err == nil {
+		t.Error("window ending before it starts accepted")
+	}
+
+	const sync = 200 * time.Millisecond
+	sharded, err := scheduler.NewShardedScheduler(srv.ConnOpt(), rdb, "scheduler-test", &scheduler.ShardConfig{File: file, Shards: 1, Preferred: []int{0}, SyncInterval: sync})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sharded.Run(runCtx)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	// counts returns the pending tasks by subject, and the catch-up tasks
+	counts := func() (map[string]int, []string) {
+		tasks, err := inspector.ListPendingTasks("default", asynq.PageSize(1000))
+		if err != nil && !errors.Is(err, asynq.ErrQueueNotFound) {
+			t.Fatal(err)
+		}
+		bySubject := map[string]int{}
+		var catchUps []string
+		for _, task := range tasks {
+			var p struct{ Subject string }
+			json.Unmarshal(task.Payload, &p)
+			bySubject[p.Subject]++
+			if strings.HasPrefix(task.ID, "catchup-") {
+				catchUps = append(catchUps, task.ID)
+			}
+		}
+		return bySubject, catchUps
+	}
+	waitFor := func(what string, ok func(map[string]int) bool) {
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+			if c, _ := counts(); ok(c) {
+				return
+			}
+			if time.Now().After(deadline) {
+				c, _ := counts()
+				t.Fatalf("timed out waiting for %s, pending %v", what, c)
+			}
+		}
+	}
+	waitFor("digest-a to tick", func(c map[string]int) bool { return c["digest-a"] > 0 && c["report-b"] > 0 })
+
+	// Suspending the group stops digest-a from the next sync on
+	suspensions := scheduler.NewSuspensions(rdb, scheduler.EntriesFile(file))
+	if err := suspensions.Suspend(ctx, scheduler.GroupTarget("tenant-a"), "off-season", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := suspensions.Suspend(ctx, scheduler.GroupTarget("tenant-x"), "", time.Now()); !errors.Is(err, scheduler.ErrUnknownTarget) {
+		t.Errorf("suspending an unknown group gave %v", err)
+	}
+	time.Sleep(3 * sync)
+	before, _ := counts()
+	time.Sleep(3 * time.Second)
+	after, catchUps := counts()
+	if after["digest-a"] != before["digest-a"] {
+		t.Errorf("suspended digest-a ticked %d times", after["digest-a"]-before["digest-a"])
+	}
+	if after["report-b"] < before["report-b"]+2 {
+		t.Errorf("report-b ticked %d times in 3s next to a suspended group", after["report-b"]-before["report-b"])
+	}
+	if after["paused"] != 0 || after["offseason"] != 0 || len(catchUps) != 0 {
+		t.Errorf("suspended entries ran: %v, catch-ups %v", after, catchUps)
+	}
+
+	// The listing shows why each entry is suspended and the skipped ticks
+	rec := httptest.NewRecorder()
+	scheduler.Handler(suspensions, client).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/schedule/entries", nil))
+	var listing struct{ Entries []scheduler.EntryState }
+	if err := json.Unmarshal(rec.Body.Bytes(), &listing); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("listing gave %d %s (%v)", rec.Code, rec.Body, err)
+	}
+	states := map[string]scheduler.EntryState{}
+	for _, st := range listing.Entries {
+		states[st.ID] = st
+	}
+	if st := states["digest-a"]; !st.Suspended || strings.Join(st.By, ",") != scheduler.ByGroup || st.Reason != "off-season" || st.Skipped < 3 {
+		t.Errorf("digest-a listed as %+v", st)
+	}
+	if st := states["paused"]; !st.Suspended || strings.Join(st.By, ",") != scheduler.ByConfig || st.Skipped < 3 {
+		t.Errorf("paused listed as %+v", st)
+	}
+	if st := states["offseason"]; !st.Suspended || strings.Join(st.By, ",") != scheduler.ByGroupWindow || st.Skipped < 3600 || !st.Until.Equal(now.Add(time.Hour).Truncate(time.Second)) {
+		t.Errorf("offseason listed as %+v", st)
+	}
+	if st := states["report-b"]; st.Suspended || st.Skipped != 0 {
+		t.Errorf("report-b listed as %+v", st)
+	}
+
+	// Resuming with catch-up enqueues one task, even when resumed twice
+	resumed, err := suspensions.Resume(ctx, client, scheduler.GroupTarget("tenant-a"), true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed) != 1 || resumed[0].ID != "digest-a" || resumed[0].Skipped < 3 || resumed[0].CatchUpTaskID == "" {
+		t.Fatalf("resume gave %+v", resumed)
+	}
+	if again, err := suspensions.Resume(ctx, client, scheduler.GroupTarget("tenant-a"), true, time.Now()); err != nil || len(again) != 0 {
+		t.Errorf("second resume gave %+v (%v)", again, err)
+	}
+	if _, catchUps = counts(); len(catchUps) != 1 || catchUps[0] != resumed[0].CatchUpTaskID {
+		t.Errorf("catch-up tasks %v, want exactly %s", catchUps, resumed[0].CatchUpTaskID)
+	}
+	// +1 for the catch-up, then the entry ticks again
+	waitFor("digest-a to tick again", func(c map[string]int) bool { return c["digest-a"] >= after["digest-a"]+3 })
+	if _, catchUps = counts(); len(catchUps) != 1 {
+		t.Errorf("catch-up tasks %v after resuming, want one", catchUps)
+	}
+	if c, _ := counts(); c["paused"] != 0 || c["offseason"] != 0 {
+		t.Errorf("suspended entries ran after the group resumed: %v", c)
+	}
+}
@@ -0,0 +1,245 @@
+// Package startup describes what a worker process is actually running, for
+// the startup log and /healthz.
+package startup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/common"
+	"asynqdemo/fleet"
+	"asynqdemo/redisconn"
+
+	"github.com/hibiken/asynq"
+)
+
+// TaskType is a registered task type and its defaults
+type TaskType struct {
+	Type           string   `json:"type"`
+	Versions       []int    `json:"versions"`
+	DefaultOptions []string `json:"default_options,omitempty"`
+	RetryPolicy    string   `json:"retry_policy,omitempty"`
+}
+
+// Build identifies the binary
+type Build struct {
+	GitSHA       string            `json:"git_sha"`
+	BuildTime    string            `json:"build_time"`
+	GoVersion    string            `json:"go_version"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// ConfigFile is a config file the process read, identified by content hash
+type ConfigFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Report is the effective configuration of a worker
+type Report struct {
+	StartedAt       time.Time         `json:"started_at"`
+	Mode            string            `json:"mode,omitempty"`
+	Redis           redisconn.Summary `json:"redis"`
+	Queues          map[string]int    `json:"queues"`
+	Concurrency     int               `json:"concurrency"`
+	Features        []string          `json:"features"`
+	Middlewares     []string          `json:"middlewares"`
+	TaskTypes       []TaskType        `json:"task_types"`
+	ScheduleEntries int               `json:"schedule_entries"`
+	Build           Build             `json:"build"`
+	ConfigFiles     []ConfigFile      `json:"config_files,omitempty"`
+}
+
+// NewReport fills in the Redis summary, task types and build info; the
+// caller sets the rest
+func NewReport(redisConnOpt asynq.RedisConnOpt) *Report {
+	r := &Report{
+		StartedAt: time.Now(),
+		Redis:     redisconn.Summarize(redisConnOpt),
+		Build:     buildInfo(),
+	}
+	for _, spec := range common.TaskSpecs() {
+		tt := TaskType{Type: spec.Type, Versions: spec.Versions()}
+		for _, o := range spec.DefaultOptions {
+			tt.DefaultOptions = append(tt.DefaultOptions, o.String())
+		}
+		if spec.RetryPolicy != nil {
+			tt.RetryPolicy = spec.RetryPolicy.String()
+		}
+		r.TaskTypes = append(r.TaskTypes, tt)
+	}
+	return r
+}
+
+// AddConfigFile records a config file by path and content hash
+func (r *Report) AddConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash config file: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	r.ConfigFiles = append(r.ConfigFiles, ConfigFile{Path: path, SHA256: hex.EncodeToString(sum[:])})
+	return nil
+}
+
+func buildInfo() Build {
+	b := Build{GitSHA: fleet.GitSHA, BuildTime: fleet.BuildTime, GoVersion: runtime.Version(), Dependencies: map[string]string{}}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && b.GitSHA == "":
+			b.GitSHA = s.Value
+		case s.Key == "vcs.time" && b.BuildTime == "":
+			b.BuildTime = s.Value
+		}
+	}
+	for _, d := range bi.Deps {
+		b.Dependencies[d.Path] = d.Version
+	}
+	return b
+}
+
+// Text renders the report for humans
+func (r *Report) Text() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🚀 Asynq Demo worker started at %s\n", r.StartedAt.Format(time.RFC3339))
+	if r.Mode != "" {
+		fmt.Fprintf(&sb, "   mode:         %s\n", r.Mode)
+	}
+	fmt.Fprintf(&sb, "   build:        %s (%s, %s)\n", orUnknown(r.Build.GitSHA), orUnknown(r.Build.BuildTime), r.Build.GoVersion)
+	redis := fmt.Sprintf("%s %s", r.Redis.Mode, strings.Join(r.Redis.Addrs, ","))
+	if r.Redis.Master != "" {
+		redis += " master " + r.Redis.Master
+	}
+	if r.Redis.Username != "" {
+		redis += " user " + r.Redis.Username
+	}
+	if r.Redis.Password != "" {
+		redis += " password " + r.Redis.Password
+	}
+	fmt.Fprintf(&sb, "   redis:        %s db %d tls %v\n", redis, r.Redis.DB, r.Redis.TLS)
+	names := make([]string, 0, len(r.Queues))
+	for q := range r.Queues {
+		names = append(names, q)
+	}
+	sort.Strings(names)
+	queues := make([]string, len(names))
+	for i, q := range names {
+		queues[i] = fmt.Sprintf("%s=%d", q, r.Queues[q])
+	}
+	fmt.Fprintf(&sb, "   queues:       %s\n", strings.Join(queues, " "))
+	fmt.Fprintf(&sb, "   concurrency:  %d\n", r.Concurrency)
+	fmt.Fprintf(&sb, "   features:     %s\n", orNone(r.Features))
+	fmt.Fprintf(&sb, "   middlewares:  %s\n", orNone(r.Middlewares))
+	fmt.Fprintf(&sb, "   schedules:    %d entries\n", r.ScheduleEntries)
+	for _, c := range r.ConfigFiles {
+		fmt.Fprintf(&sb, "   config:       %s sha256:%s\n", c.Path, c.SHA256)
+	}
+	fmt.Fprintf(&sb, "   task types:\n")
+	for _, t := range r.TaskTypes {
+		opts := append([]string(nil), t.DefaultOptions...)
+		if t.RetryPolicy != "" {
+			opts = append(opts, "retry: "+t.RetryPolicy)
+		}
+		fmt.Fprintf(&sb, "     %-22s v%v %s\n", t.Type, t.Versions, strings.Join(opts, " "))
+	}
+	deps := make([]string, 0, len(r.Build.Dependencies))
+	for path, v := range r.Build.Dependencies {
+		deps = append(deps, path+"@"+v)
+	}
+	sort.Strings(deps)
+	fmt.Fprintf(&sb, "   dependencies: %s\n", orNone(deps))
+	return sb.String()
+}
+
+// Log writes the report once, as JSON when format is "json"
+func (r *Report) Log(format string) {
+	if format != "json" {
+		fmt.Print(r.Text())
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{"msg": "startup", "report": r})
+	if err != nil {
+		log.Printf("❌ Failed to marshal startup report: %v", err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+func orNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
+
+// Holder keeps the report served by /healthz once startup finished
+type Holder struct {
+	report atomic.Pointer[Report]
+
+	mu     sync.Mutex
+	checks map[string]func() interface{}
+}
+
+// Set publishes the report
+func (h *Holder) Set(r *Report) {
+	h.report.Store(r)
+}
+
+// AddCheck shows the state returned by f under name on /healthz. It is
+// informational: the status stays ok so probes do not restart the worker.
+func (h *Holder) AddCheck(name string, f func() interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checks == nil {
+		h.checks = make(map[string]func() interface{})
+	}
+	h.checks[name] = f
+}
+
+// ServeHTTP serves GET /healthz: 503 while starting, then 200 with the report
+func (h *Holder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	report := h.report.Load()
+	if report == nil {
+		admin.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	body := map[string]interface{}{"status": "ok", "startup": report}
+	h.mu.Lock()
+	if len(h.checks) > 0 {
+		checks := make(map[string]interface{}, len(h.checks))
+		for name, f := range h.checks {
+			checks[name] = f()
+		}
+		body["checks"] = checks
+	}
+	h.mu.Unlock()
+	admin.WriteJSON(w, http.StatusOK, body)
+}
@@ -0,0 +1,161 @@
+package startup_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/startup"
+
+	"github.com/hibiken/asynq"
+)
+
+// knownReport is the report of a worker with a known config
+func knownReport(t *testing.T) (*startup.Report, string) {
+	t.Helper()
+	common.RegisterTaskSpec(common.TaskSpec{Type: "startup:test", PayloadVersions: []int{1, 2}, DefaultOptions: []asynq.Option{asynq.Queue("low"), asynq.MaxRetry(4)}})
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := []byte("concurrency: 7\n")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := startup.NewReport(asynq.RedisFailoverClientOpt{
+		MasterName:       "main",
+		SentinelAddrs:    []string{"s1:26379", "s2:26379"},
+		Username:         "worker",
+		Password:         "hunter2",
+		SentinelPassword: "sentinel-hunter2",
+		DB:               2,
+	})
+	r.Mode = "all"
+	r.Queues = map[string]int{"critical": 6, "default": 3, "low": 1}
+	r.Concurrency = 7
+	r.Features = []string{"audit", "canary"}
+	r.Middlewares = []string{"metadata", "timeout"}
+	r.ScheduleEntries = 4
+	if err := r.AddConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	return r, path + " sha256:" + hex.EncodeToString(sum[:])
+}
+
+// captureStdout returns what f prints
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	f()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+// TestReport fails unless the text and JSON reports of a known config show
+// its Redis, queues, concurrency, features, middlewares, task types,
+// schedules and config file hash, and neither shows a password
+func TestReport(t *testing.T) {
+	r, config := knownReport(t)
+
+	text := captureStdout(t, func() { r.Log("text") })
+	for _, want := range []string{
+		"   mode:         all\n",
+		"   redis:        failover s1:26379,s2:26379 master main user worker password [redacted] db 2 tls false\n",
+		"   queues:       critical=6 default=3 low=1\n",
+		"   concurrency:  7\n",
+		"   features:     audit, canary\n",
+		"   middlewares:  metadata, timeout\n",
+		"   schedules:    4 entries\n",
+		"   config:       " + config + "\n",
+		"     startup:test           v[1 2] Queue(\"low\") MaxRetry(4)\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text report lacks %q:\n%s", want, text)
+		}
+	}
+
+	out := captureStdout(t, func() { r.Log("json") })
+	var logged struct {
+		Msg    string          `json:"msg"`
+		Report json.RawMessage `json:"report"`
+	}
+	if err := json.Unmarshal([]byte(out), &logged); err != nil || logged.Msg != "startup" || strings.Count(out, "\n") != 1 {
+		t.Fatalf("JSON report %q (%v), want one line", out, err)
+	}
+	var got startup.Report
+	if err := json.Unmarshal(logged.Report, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Redis.Password != "[redacted]" || got.Redis.SentinelPassword != "[redacted]" || got.Redis.Username != "worker" ||
+		got.Concurrency != 7 || got.Queues["critical"] != 6 || got.ScheduleEntries != 4 || len(got.ConfigFiles) != 1 {
+		t.Errorf("JSON report %+v", got)
+	}
+	found := false
+	for _, tt := range got.TaskTypes {
+		if tt.Type == "startup:test" {
+			found = len(tt.DefaultOptions) == 2 && len(tt.Versions) == 2
+		}
+	}
+	if !found {
+		t.Errorf("JSON report lacks startup:test with its options: %+v", got.TaskTypes)
+	}
+
+	for name, s := range map[string]string{"text": text, "json": out} {
+		if strings.Contains(s, "hunter2") {
+			t.Errorf("%s report shows a password", name)
+		}
+	}
+}
+
+// TestHealthz fails unless /healthz answers 503 while starting and then
+// the report and the checks, without the password
+func TestHealthz(t *testing.T) {
+	h := &startup.Holder{}
+	api := httptest.NewServer(h)
+	defer api.Close()
+	get := func() (int, string) {
+		resp, err := http.Get(api.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		body.ReadFrom(resp.Body)
+		return resp.StatusCode, body.String()
+	}
+
+	if code, body := get(); code != http.StatusServiceUnavailable || !strings.Contains(body, "starting") {
+		t.Errorf("while starting got %d %s", code, body)
+	}
+	r, _ := knownReport(t)
+	h.Set(r)
+	h.AddCheck("redis", func() interface{} { return map[string]interface{}{"ok": true, "at": time.Unix(0, 0).UTC()} })
+	code, body := get()
+	var got struct {
+		Status  string                     `json:"status"`
+		Startup startup.Report             `json:"startup"`
+		Checks  map[string]json.RawMessage `json:"checks"`
+	}
+	if err := json.Unmarshal([]byte(body), &got); err != nil || code != http.StatusOK || got.Status != "ok" ||
+		got.Startup.Concurrency != 7 || string(got.Checks["redis"]) != `{"at":"1970-01-01T00:00:00Z","ok":true}` {
+		t.Errorf("after startup got %d %s", code, body)
+	}
+	if strings.Contains(body, "hunter2") {
+		t.Error("/healthz shows a password")
+	}
+}
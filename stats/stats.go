@@ -0,0 +1,199 @@
+// Package stats collects the runtime statistics of the process, as reported
+// by server info tasks and the admin stats command, and checks them against
+// thresholds.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Source reads the runtime statistics; Runtime reads those of this process
+type Source interface {
+	ReadMemStats(m *runtime.MemStats)
+	NumCPU() int
+	NumGoroutine() int
+}
+
+// Runtime is the Source of the Go runtime
+type Runtime struct{}
+
+func (Runtime) ReadMemStats(m *runtime.MemStats) { runtime.ReadMemStats(m) }
+func (Runtime) NumCPU() int                      { return runtime.NumCPU() }
+func (Runtime) NumGoroutine() int                { return runtime.NumGoroutine() }
+
+// Snapshot is the statistics at one point in time
+type Snapshot struct {
+	CollectedAt  time.Time `json:"collected_at"`
+	NumCPU       int       `json:"num_cpu"`
+	Goroutines   int       `json:"goroutines"`
+	AllocBytes   uint64    `json:"alloc_bytes"`
+	SysBytes     uint64    `json:"sys_bytes"`
+	HeapAlloc    uint64    `json:"heap_alloc"`
+	HeapSys      uint64    `json:"heap_sys"`
+	HeapObjects  uint64    `json:"heap_objects"`
+	NumGC        uint32    `json:"num_gc"`
+	PauseTotalNs uint64    `json:"pause_total_ns"`
+}
+
+// Collect reads a snapshot from src, taken at now
+func Collect(src Source, now time.Time) Snapshot {
+	var m runtime.MemStats
+	src.ReadMemStats(&m)
+	return Snapshot{
+		CollectedAt:  now,
+		NumCPU:       src.NumCPU(),
+		Goroutines:   src.NumGoroutine(),
+		AllocBytes:   m.Alloc,
+		SysBytes:     m.Sys,
+		HeapAlloc:    m.HeapAlloc,
+		HeapSys:      m.HeapSys,
+		HeapObjects:  m.HeapObjects,
+		NumGC:        m.NumGC,
+		PauseTotalNs: m.PauseTotalNs,
+	}
+}
+
+// AvgGCPause is the mean pause of the garbage collections so far, zero
+// before the first
+func (s Snapshot) AvgGCPause() time.Duration {
+	if s.NumGC == 0 {
+		return 0
+	}
+	return time.Duration(s.PauseTotalNs / uint64(s.NumGC))
+}
+
+func mb(n uint64) float64 {
+	return float64(n) / 1024 / 1024
+}
+
+// WriteText writes the snapshot one statistic per line, as server info
+// tasks print it
+func (s Snapshot) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "   🔢 CPU核心数: %d\n", s.NumCPU)
+	fmt.Fprintf(w, "   🧵 当前Goroutines: %d\n", s.Goroutines)
+	fmt.Fprintf(w, "   💾 分配内存: %.2f MB\n", mb(s.AllocBytes))
+	fmt.Fprintf(w, "   🔄 系统内存: %.2f MB\n", mb(s.SysBytes))
+	fmt.Fprintf(w, "   🗑️  GC次数: %d\n", s.NumGC)
+	if s.NumGC > 0 {
+		fmt.Fprintf(w, "   ⏱️  平均GC暂停时间: %v\n", s.AvgGCPause())
+	} else {
+		fmt.Fprintf(w, "   ⏱️  平均GC暂停时间: N/A\n")
+	}
+	fmt.Fprintf(w, "   📊 堆使用: %.2f MB\n", mb(s.HeapAlloc))
+	fmt.Fprintf(w, "   📈 堆系统: %.2f MB\n", mb(s.HeapSys))
+	fmt.Fprintf(w, "   🏗️  堆对象数: %d\n", s.HeapObjects)
+}
+
+// Exit codes of the admin stats command. A breach of one threshold exits
+// with its code, breaches of several with ExitSeveral.
+const (
+	ExitOK         = 0
+	ExitGoroutines = 3
+	ExitHeap       = 4
+	ExitGCPause    = 5
+	ExitSeveral    = 6
+)
+
+// Thresholds are the limits a snapshot is checked against; zero disables
+// a limit
+type Thresholds struct {
+	MaxGoroutines int
+	MaxHeapBytes  uint64
+	MaxAvgGCPause time.Duration
+}
+
+// ThresholdsFromEnv reads STATS_MAX_GOROUTINES, STATS_MAX_HEAP_MB and
+// STATS_MAX_GC_PAUSE (e.g. "5ms"), shared by server info tasks, which alert
+// on breaches, and the admin stats command, which exits with their code
+func ThresholdsFromEnv() (Thresholds, error) {
+	return thresholdsFrom(os.Getenv)
+}
+
+func thresholdsFrom(getenv func(string) string) (Thresholds, error) {
+	var t Thresholds
+	if v := getenv("STATS_MAX_GOROUTINES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return t, fmt.Errorf("invalid STATS_MAX_GOROUTINES %q", v)
+		}
+		t.MaxGoroutines = n
+	}
+	if v := getenv("STATS_MAX_HEAP_MB"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return t, fmt.Errorf("invalid STATS_MAX_HEAP_MB %q", v)
+		}
+		t.MaxHeapBytes = n * 1024 * 1024
+	}
+	if v := getenv("STATS_MAX_GC_PAUSE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return t, fmt.Errorf("invalid STATS_MAX_GC_PAUSE %q", v)
+		}
+		t.MaxAvgGCPause = d
+	}
+	return t, nil
+}
+
+// Breach is a statistic over its threshold
+type Breach struct {
+	Metric string `json:"metric"`
+	Value  string `json:"value"`
+	Limit  string `json:"limit"`
+	// Code is the exit code of the breach
+	Code int `json:"-"`
+}
+
+func (b Breach) String() string {
+	return fmt.Sprintf("%s %s over %s", b.Metric, b.Value, b.Limit)
+}
+
+// Check returns the thresholds s breaches
+func (t Thresholds) Check(s Snapshot) []Breach {
+	var breaches []Breach
+	if t.MaxGoroutines > 0 && s.Goroutines > t.MaxGoroutines {
+		breaches = append(breaches, Breach{Metric: "goroutines", Value: strconv.Itoa(s.Goroutines), Limit: strconv.Itoa(t.MaxGoroutines), Code: ExitGoroutines})
+	}
+	if t.MaxHeapBytes > 0 && s.HeapAlloc > t.MaxHeapBytes {
+		breaches = append(breaches, Breach{Metric: "heap", Value: fmt.Sprintf("%.2f MB", mb(s.HeapAlloc)), Limit: fmt.Sprintf("%.2f MB", mb(t.MaxHeapBytes)), Code: ExitHeap})
+	}
+	if t.MaxAvgGCPause > 0 && s.AvgGCPause() > t.MaxAvgGCPause {
+		breaches = append(breaches, Breach{Metric: "avg_gc_pause", Value: s.AvgGCPause().String(), Limit: t.MaxAvgGCPause.String(), Code: ExitGCPause})
+	}
+	return breaches
+}
+
+// ExitCode maps breaches to the exit code of the admin stats command
+func ExitCode(breaches []Breach) int {
+	switch len(breaches) {
+	case 0:
+		return ExitOK
+	case 1:
+		return breaches[0].Code
+	}
+	return ExitSeveral
+}
+
+// BreachError reports breaches as an error with their exit code
+type BreachError struct {
+	Breaches []Breach
+}
+
+func (e BreachError) Error() string {
+	parts := make([]string, len(e.Breaches))
+	for i, b := range e.Breaches {
+		parts[i] = b.String()
+	}
+	return "thresholds breached: " + strings.Join(parts, ", ")
+}
+
+// ExitCode is the exit code of the breaches
+func (e BreachError) ExitCode() int {
+	return ExitCode(e.Breaches)
+}
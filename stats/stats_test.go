@@ -0,0 +1,124 @@
+package stats_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/stats"
+)
+
+// fakeStats is a stats.Source with fixed values
+type fakeStats struct {
+	mem        runtime.MemStats
+	cpus       int
+	goroutines int
+}
+
+func (f fakeStats) ReadMemStats(m *runtime.MemStats) { *m = f.mem }
+func (f fakeStats) NumCPU() int                      { return f.cpus }
+func (f fakeStats) NumGoroutine() int                { return f.goroutines }
+
+// TestStatsSnapshot collects snapshots from a fake source and fails
+// unless they carry its values, breaches map to their exit codes, the
+// STATS_MAX_* variables are parsed, and server info tasks alert about
+// breaches only.
+func TestStatsSnapshot(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	src := fakeStats{cpus: 4, goroutines: 120}
+	src.mem.Alloc = 64 << 20
+	src.mem.Sys = 128 << 20
+	src.mem.HeapAlloc = 60 << 20
+	src.mem.HeapSys = 100 << 20
+	src.mem.HeapObjects = 5000
+	src.mem.NumGC = 4
+	src.mem.PauseTotalNs = uint64(8 * time.Millisecond)
+
+	snap := stats.Collect(src, now)
+	want := stats.Snapshot{
+		CollectedAt: now, NumCPU: 4, Goroutines: 120, AllocBytes: 64 << 20, SysBytes: 128 << 20,
+		HeapAlloc: 60 << 20, HeapSys: 100 << 20, HeapObjects: 5000, NumGC: 4, PauseTotalNs: uint64(8 * time.Millisecond),
+	}
+	if snap != want {
+		t.Errorf("snapshot %+v, want %+v", snap, want)
+	}
+	if snap.AvgGCPause() != 2*time.Millisecond {
+		t.Errorf("average GC pause %v, want 2ms", snap.AvgGCPause())
+	}
+	if (stats.Snapshot{}).AvgGCPause() != 0 {
+		t.Error("average GC pause before the first GC is not zero")
+	}
+	var text bytes.Buffer
+	snap.WriteText(&text)
+	for _, line := range []string{"Goroutines: 120", "堆使用: 60.00 MB", "平均GC暂停时间: 2ms"} {
+		if !strings.Contains(text.String(), line) {
+			t.Errorf("text snapshot lacks %q:\n%s", line, text.String())
+		}
+	}
+
+	for _, c := range []struct {
+		name       string
+		thresholds stats.Thresholds
+		code       int
+	}{
+		{"none set", stats.Thresholds{}, stats.ExitOK},
+		{"all within", stats.Thresholds{MaxGoroutines: 120, MaxHeapBytes: 60 << 20, MaxAvgGCPause: 2 * time.Millisecond}, stats.ExitOK},
+		{"goroutines", stats.Thresholds{MaxGoroutines: 100}, stats.ExitGoroutines},
+		{"heap", stats.Thresholds{MaxHeapBytes: 50 << 20}, stats.ExitHeap},
+		{"gc pause", stats.Thresholds{MaxAvgGCPause: time.Millisecond}, stats.ExitGCPause},
+		{"several", stats.Thresholds{MaxGoroutines: 100, MaxAvgGCPause: time.Millisecond}, stats.ExitSeveral},
+	} {
+		breaches := c.thresholds.Check(snap)
+		if code := stats.ExitCode(breaches); code != c.code {
+			t.Errorf("%s: exit code %d for %v, want %d", c.name, code, breaches, c.code)
+		}
+		if len(breaches) == 0 {
+			continue
+		}
+		var coded interface{ ExitCode() int }
+		if err := error(stats.BreachError{Breaches: breaches}); !errors.As(err, &coded) || coded.ExitCode() != c.code {
+			t.Errorf("%s: breach error %v does not carry exit code %d", c.name, err, c.code)
+		}
+	}
+
+	t.Setenv("STATS_MAX_GOROUTINES", "500")
+	t.Setenv("STATS_MAX_HEAP_MB", "256")
+	t.Setenv("STATS_MAX_GC_PAUSE", "5ms")
+	th, err := stats.ThresholdsFromEnv()
+	if want := (stats.Thresholds{MaxGoroutines: 500, MaxHeapBytes: 256 << 20, MaxAvgGCPause: 5 * time.Millisecond}); err != nil || th != want {
+		t.Errorf("thresholds from env %+v (%v), want %+v", th, err, want)
+	}
+	t.Setenv("STATS_MAX_HEAP_MB", "lots")
+	if _, err := stats.ThresholdsFromEnv(); err == nil || !strings.Contains(err.Error(), "STATS_MAX_HEAP_MB") {
+		t.Errorf("invalid STATS_MAX_HEAP_MB gave %v", err)
+	}
+
+	// Server info tasks read the same thresholds and alert on breaches
+	var alerts []string
+	deps := common.DefaultDeps()
+	deps.Stats = src
+	deps.Alert = func(ctx context.Context, text string) error {
+		alerts = append(alerts, text)
+		return nil
+	}
+	run := func(th stats.Thresholds) {
+		t.Helper()
+		deps.StatsThresholds = th
+		if err := common.HandleServerInfoTask(common.WithDeps(context.Background(), deps), &common.ServerInfoPayload{Source: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(stats.Thresholds{MaxGoroutines: 500})
+	if len(alerts) != 0 {
+		t.Errorf("server info within thresholds alerted %v", alerts)
+	}
+	run(stats.Thresholds{MaxGoroutines: 100})
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "goroutines 120 over 100") {
+		t.Errorf("server info over the goroutine threshold alerted %v", alerts)
+	}
+}
@@ -0,0 +1,291 @@
+// Package support builds bundles for escalations: recent failures with their
+// history, the redacted effective config, queue stats, scheduler entries,
+// the worker fleet and the latest events, in a tar.gz encrypted to the
+// support keys and signed by the worker. Payloads, error messages and
+// events are redacted of personal data before they enter the archive.
+package support
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/config"
+	"asynqdemo/dash"
+	"asynqdemo/eventlog"
+	"asynqdemo/fleet"
+	"asynqdemo/redisconn"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Sources are where the contents of a bundle are read from
+type Sources struct {
+	Inspector *asynq.Inspector
+	RDB       redis.UniversalClient
+	// Config is the effective config, whose passwords are redacted
+	Config *config.Config
+	// EventDir is the event log directory; empty leaves the events out
+	EventDir string
+	// Window is how far back events are included, 30 minutes when zero
+	Window time.Duration
+	// Failures bounds the archived and the retried tasks listed per queue,
+	// 50 when zero
+	Failures int
+	// Environ is the environment, os.Environ() when nil; values of secret
+	// variables are redacted
+	Environ []string
+}
+
+// Manifest describes a bundle and the SHA-256 of every other file in it
+type Manifest struct {
+	CreatedAt time.Time         `json:"created_at"`
+	Host      string            `json:"host"`
+	GoVersion string            `json:"go_version"`
+	Window    string            `json:"window"`
+	Files     map[string]string `json:"files"`
+}
+
+// Failure is an archived or retried task
+type Failure struct {
+	ID           string                 `json:"id"`
+	Queue        string                 `json:"queue"`
+	Type         string                 `json:"type"`
+	State        string                 `json:"state"`
+	Retried      int                    `json:"retried"`
+	MaxRetry     int                    `json:"max_retry"`
+	LastErr      string                 `json:"last_err,omitempty"`
+	LastFailedAt time.Time              `json:"last_failed_at,omitempty"`
+	Payload      map[string]interface{} `json:"payload"`
+	PayloadNote  string                 `json:"payload_note,omitempty"`
+	History      []common.HistoryEntry  `json:"history,omitempty"`
+}
+
+// SchedulerEntry is a periodic task, its payload redacted
+type SchedulerEntry struct {
+	ID      string                 `json:"id"`
+	Spec    string                 `json:"spec"`
+	Type    string                 `json:"type"`
+	Payload map[string]interface{} `json:"payload"`
+	Next    time.Time              `json:"next"`
+	Prev    time.Time              `json:"prev,omitempty"`
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// Phone and card numbers: nine digits or more, maybe split by dashes or
+	// spaces after a leading +
+	numberPattern = regexp.MustCompile(`\+\d(?:[ -]?\d){8,}|\d(?:-?\d){8,}`)
+	secretPattern = regexp.MustCompile(`(?i)PASSWORD|SECRET|TOKEN|KEY|CREDENTIAL|AUTH|PRIVATE`)
+)
+
+// RedactText replaces the email addresses and long numbers of s, which may
+// be personal data
+func RedactText(s string) string {
+	s = emailPattern.ReplaceAllString(s, "[email]")
+	return numberPattern.ReplaceAllString(s, "[number]")
+}
+
+// redactEnv keeps the names of secret variables only and hides the
+// passwords of URLs and the personal data of the others
+func redactEnv(environ []string) map[string]string {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		switch {
+		case value == "":
+		case secretPattern.MatchString(name):
+			value = redisconn.Redacted
+		case strings.Contains(value, "://"):
+			if u, err := url.Parse(value); err == nil {
+				value = u.Redacted()
+			}
+		}
+		env[name] = RedactText(value)
+	}
+	return env
+}
+
+// Build gathers the contents of a bundle into a tar.gz
+func Build(ctx context.Context, src Sources, now time.Time) ([]byte, error) {
+	if src.Window <= 0 {
+		src.Window = 30 * time.Minute
+	}
+	if src.Failures <= 0 {
+		src.Failures = 50
+	}
+	if src.Environ == nil {
+		src.Environ = os.Environ()
+	}
+	files := map[string]interface{}{}
+
+	cfg := *src.Config
+	if cfg.Redis.Password != "" {
+		cfg.Redis.Password = redisconn.Redacted
+	}
+	if cfg.Redis.SentinelPassword != "" {
+		cfg.Redis.SentinelPassword = redisconn.Redacted
+	}
+	effective := map[string]interface{}{"file": src.Config.File, "config": cfg, "env": redactEnv(src.Environ)}
+	if opt, err := src.Config.ConnOpt(); err == nil {
+		effective["redis"] = redisconn.Summarize(opt)
+	}
+	files["config.json"] = effective
+
+	queueNames, err := src.Inspector.Queues()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues: %v", err)
+	}
+	sort.Strings(queueNames)
+	history := common.NewHistory(src.RDB)
+	queueInfos := make([]*asynq.QueueInfo, 0, len(queueNames))
+	failures := []Failure{}
+	for _, q := range queueNames {
+		info, err := src.Inspector.GetQueueInfo(q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read queue %s: %v", q, err)
+		}
+		queueInfos = append(queueInfos, info)
+		for _, list := range []func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error){src.Inspector.ListArchivedTasks, src.Inspector.ListRetryTasks} {
+			tasks, err := list(q, asynq.PageSize(src.Failures))
+			if err != nil {
+				return nil, fmt.Errorf("failed to list failed tasks of %s: %v", q, err)
+			}
+			for _, t := range tasks {
+				f := Failure{ID: t.ID, Queue: t.Queue, Type: t.Type, State: t.State.String(), Retried: t.Retried, MaxRetry: t.MaxRetry,
+					LastErr: RedactText(t.LastErr), LastFailedAt: t.LastFailedAt}
+				f.Payload, f.PayloadNote = dash.Summarize(t.Payload)
+				entries, err := history.Entries(ctx, t.Queue, t.ID)
+				if err != nil {
+					return nil, err
+				}
+				for i := range entries {
+					entries[i].Detail = RedactText(entries[i].Detail)
+				}
+				f.History = entries
+				failures = append(failures, f)
+			}
+		}
+	}
+	files["queues.json"] = queueInfos
+	files["failures.json"] = failures
+
+	entries, err := src.Inspector.SchedulerEntries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scheduler entries: %v", err)
+	}
+	schedule := make([]SchedulerEntry, 0, len(entries))
+	for _, e := range entries {
+		payload, _ := dash.Summarize(e.Task.Payload())
+		schedule = append(schedule, SchedulerEntry{ID: e.ID, Spec: e.Spec, Type: e.Task.Type(), Payload: payload, Next: e.Next, Prev: e.Prev})
+	}
+	files["scheduler.json"] = schedule
+
+	workers, err := fleet.List(ctx, src.RDB)
+	if err != nil {
+		return nil, err
+	}
+	files["fleet.json"] = workers
+
+	contents := map[string][]byte{}
+	for name, v := range files {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s: %v", name, err)
+		}
+		contents[name] = data
+	}
+	if src.EventDir != "" {
+		events, err := eventlog.Query(src.EventDir, eventlog.Filter{From: now.Add(-src.Window)})
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, e := range events {
+			e.Message = RedactText(e.Message)
+			if err := enc.Encode(e); err != nil {
+				return nil, fmt.Errorf("failed to marshal event: %v", err)
+			}
+		}
+		contents["events.jsonl"] = buf.Bytes()
+	}
+
+	host, _ := os.Hostname()
+	manifest := Manifest{CreatedAt: now.UTC(), Host: host, GoVersion: runtime.Version(), Window: src.Window.String(), Files: map[string]string{}}
+	for name, data := range contents {
+		sum := sha256.Sum256(data)
+		manifest.Files[name] = hex.EncodeToString(sum[:])
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	contents["manifest.json"] = data
+	return archive(contents, now)
+}
+
+// archive writes contents into a tar.gz, in name order
+func archive(contents map[string][]byte, now time.Time) ([]byte, error) {
+	names := make([]string, 0, len(contents))
+	for name := range contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		data := contents[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: now}); err != nil {
+			return nil, fmt.Errorf("failed to write %s to the bundle: %v", name, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to write %s to the bundle: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write the bundle: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write the bundle: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadArchive returns the files of a decrypted bundle by name
+func ReadArchive(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("bundle is not a tar.gz: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %v", err)
+		}
+		if files[h.Name], err = io.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("failed to read %s from bundle: %v", h.Name, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package support_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/config"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/eventlog"
+	"asynqdemo/support"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestSupportBundle fails a task carrying personal data on an embedded
+// Redis, builds a bundle and fails unless it round-trips through Seal and
+// Open with test keys, holds every section with no email address, phone
+// number or password left in it, and tampered bundles, other signers and
+// other identities are refused.
+func TestSupportBundle(t *testing.T) {
+	const (
+		email    = "jane.doe@example.com"
+		phone    = "+1 555 123 4567"
+		password = "hunter2-redis"
+	)
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	ctx := context.Background()
+
+	// A task whose handler fails with the address in the error is archived
+	payload, _ := json.Marshal(map[string]interface{}{"user_id": 42, "email": email, "phone": phone, "locale": "en"})
+	info, err := client.Enqueue(asynq.NewTask(common.TypeEmailTask, payload), asynq.MaxRetry(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 1, LogLevel: asynq.FatalLevel})
+	if err := worker.Start(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		return fmt.Errorf("SMTP server refused recipient %s (call %s)", email, phone)
+	})); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if q, err := inspector.GetQueueInfo("default"); err == nil && q.Archived == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the task to be archived")
+		}
+	}
+	worker.Shutdown()
+	if err := common.NewHistory(rdb).Record(ctx, info.Queue, info.ID, common.HistoryEntry{At: time.Now(), Event: "payload_updated", Detail: "email changed to " + email}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inspector.SchedulerEntries(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	w, err := eventlog.NewWriter(eventlog.Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := runEventLog(w)
+	w.Write(eventlog.Event{Kind: eventlog.KindTask, TaskID: info.ID, Type: common.TypeEmailTask, Outcome: eventlog.OutcomeArchived, Message: "failed to send email to " + email})
+	stop()
+
+	cfg := config.Default()
+	cfg.Redis = config.Redis{Addr: srv.Addr(), Password: password}
+	archive, err := support.Build(ctx, support.Sources{
+		Inspector: inspector,
+		RDB:       rdb,
+		Config:    cfg,
+		EventDir:  dir,
+		Environ:   []string{"SMTP_PASSWORD=" + password, "REDIS_URL=redis://:" + password + "@redis:6379/0", "ALERT_EMAIL=" + email, "WORKER_CONCURRENCY=8"},
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sealed to two recipients and signed by the worker
+	supportID, supportKey := testKeys(t)
+	_, otherKey := testKeys(t)
+	private, public, err := support.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := support.ParseSigningKey(private)
+	trusted, _ := support.ParseSigner(public)
+	bundle, err := support.Seal(archive, []*ecdh.PublicKey{otherKey, supportKey}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bundle, []byte(email)) || bytes.Contains(bundle, []byte("failures.json")) {
+		t.Error("sealed bundle holds plaintext")
+	}
+	if got, err := support.Verify(bundle, trusted); err != nil || !got.Equal(trusted) {
+		t.Errorf("verify gave %v (%v)", got, err)
+	}
+	opened, err := support.Open(bundle, supportID, trusted)
+	if err != nil || !bytes.Equal(opened, archive) {
+		t.Fatalf("open gave %d bytes (%v), want the archive back", len(opened), err)
+	}
+	files, err := support.ReadArchive(opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"manifest.json", "config.json", "queues.json", "failures.json", "scheduler.json", "fleet.json", "events.jsonl"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("bundle lacks %s", name)
+		}
+	}
+	for name, data := range files {
+		for _, secret := range []string{email, phone, "555 123", password} {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("%s holds %q:\n%s", name, secret, data)
+			}
+		}
+	}
+	var failures []support.Failure
+	if err := json.Unmarshal(files["failures.json"], &failures); err != nil || len(failures) != 1 {
+		t.Fatalf("failures.json: %s (%v)", files["failures.json"], err)
+	}
+	f := failures[0]
+	if f.ID != info.ID || f.State != "archived" || !strings.Contains(f.LastErr, "[email]") || f.Payload["user_id"] != float64(42) ||
+		f.Payload["locale"] != "en" || len(f.History) != 1 || !strings.Contains(f.History[0].Detail, "[email]") {
+		t.Errorf("failure %+v", f)
+	}
+	for name, want := range map[string]string{"config.json": `"WORKER_CONCURRENCY": "8"`, "events.jsonl": "failed to send email to [email]"} {
+		if !bytes.Contains(files[name], []byte(want)) {
+			t.Errorf("%s lacks %s:\n%s", name, want, files[name])
+		}
+	}
+
+	// Tampering, another signer and another identity are refused
+	tampered := append([]byte(nil), bundle...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := support.Verify(tampered, nil); !errors.Is(err, support.ErrBadSignature) {
+		t.Errorf("tampered bundle verified: %v", err)
+	}
+	_, otherPublic, _ := support.GenerateSigningKey()
+	otherSigner, _ := support.ParseSigner(otherPublic)
+	if _, err := support.Open(bundle, supportID, otherSigner); !errors.Is(err, support.ErrBadSignature) {
+		t.Errorf("bundle opened against another signer: %v", err)
+	}
+	strangerID, _ := testKeys(t)
+	if _, err := support.Open(bundle, strangerID, trusted); !errors.Is(err, support.ErrNotRecipient) {
+		t.Errorf("bundle opened by a stranger: %v", err)
+	}
+}
+
+// testKeys generates a support identity and its recipient key
+func testKeys(t *testing.T) (*ecdh.PrivateKey, *ecdh.PublicKey) {
+	t.Helper()
+	identity, recipient, err := support.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := support.ParseIdentity(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := support.ParseRecipient(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, key
+}
+
+// runEventLog runs w until the returned function is called, which waits
+// for the buffered events to be written
+func runEventLog(w *eventlog.Writer) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,323 @@
+package support
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A sealed bundle is a text header followed by the encrypted archive:
+//
+//	asynqdemo-support-bundle/v1
+//	-> X25519 <ephemeral public key> <wrapped file key>   one per recipient
+//	signer <ed25519 public key>
+//	--- <ed25519 signature>
+//	<nonce><AES-256-GCM ciphertext of the archive>
+//
+// Like age, a random file key encrypts the archive and is wrapped for each
+// recipient with a key derived from an ephemeral X25519 exchange. The
+// signature covers the header above it and the encrypted archive, so it can
+// be verified without any private key.
+const (
+	header    = "asynqdemo-support-bundle/v1"
+	stanza    = "-> X25519 "
+	signerTag = "signer "
+	sigTag    = "--- "
+	kdfInfo   = "asynqdemo-support-bundle/v1/X25519"
+)
+
+// ErrBadSignature is returned for bundles whose signature does not verify,
+// or which another key than the trusted one signed
+var ErrBadSignature = errors.New("support bundle signature does not verify")
+
+// ErrNotRecipient is returned when an identity is not among a bundle's
+// recipients
+var ErrNotRecipient = errors.New("support bundle is not encrypted to this identity")
+
+var b64 = base64.StdEncoding
+
+// GenerateIdentity returns a new X25519 identity, kept by support, and its
+// public recipient key, configured on the workers
+func GenerateIdentity() (identity, recipient string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate identity: %v", err)
+	}
+	return b64.EncodeToString(key.Bytes()), b64.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// GenerateSigningKey returns a new ed25519 signing key, kept by the worker,
+// and its public key, which support verifies bundles against
+func GenerateSigningKey() (private, public string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	return b64.EncodeToString(priv.Seed()), b64.EncodeToString(pub), nil
+}
+
+// ParseRecipient parses a public key from GenerateIdentity
+func ParseRecipient(s string) (*ecdh.PublicKey, error) {
+	raw, err := b64.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: not base64", s)
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %v", s, err)
+	}
+	return key, nil
+}
+
+// ParseIdentity parses a private key from GenerateIdentity
+func ParseIdentity(s string) (*ecdh.PrivateKey, error) {
+	raw, err := b64.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("invalid identity: not base64")
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity: %v", err)
+	}
+	return key, nil
+}
+
+// ParseSigningKey parses a private key from GenerateSigningKey
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := b64.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid signing key: want the base64 of a 32-byte ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseSigner parses a public key from GenerateSigningKey
+func ParseSigner(s string) (ed25519.PublicKey, error) {
+	raw, err := b64.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signer %q: want the base64 of a 32-byte ed25519 public key", s)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Hash is the hex SHA-256 of a sealed bundle, to compare over another channel
+func Hash(bundle []byte) string {
+	sum := sha256.Sum256(bundle)
+	return hex.EncodeToString(sum[:])
+}
+
+// Seal encrypts archive to recipients and signs the result with signer
+func Seal(archive []byte, recipients []*ecdh.PublicKey, signer ed25519.PrivateKey) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("support bundle needs at least one recipient")
+	}
+	fileKey := make([]byte, 32)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %v", err)
+	}
+	var head bytes.Buffer
+	head.WriteString(header + "\n")
+	for _, r := range recipients {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key: %v", err)
+		}
+		wrapped, err := wrap(eph, r, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&head, "%s%s %s\n", stanza, b64.EncodeToString(eph.PublicKey().Bytes()), b64.EncodeToString(wrapped))
+	}
+	fmt.Fprintf(&head, "%s%s\n", signerTag, b64.EncodeToString(signer.Public().(ed25519.PublicKey)))
+
+	// The header is authenticated with the archive, so recipients cannot be
+	// swapped without the file key
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	body := aead.Seal(nonce, nonce, archive, head.Bytes())
+
+	sig := ed25519.Sign(signer, append(append([]byte(nil), head.Bytes()...), body...))
+	head.WriteString(sigTag + b64.EncodeToString(sig) + "\n")
+	head.Write(body)
+	return head.Bytes(), nil
+}
+
+// sealed is a parsed bundle
+type sealed struct {
+	// head is the signed header, up to the signature line
+	head    []byte
+	stanzas [][2][]byte
+	signer  ed25519.PublicKey
+	sig     []byte
+	body    []byte
+}
+
+func parse(bundle []byte) (*sealed, error) {
+	r := bufio.NewReader(bytes.NewReader(bundle))
+	s := &sealed{}
+	// read is the length of the header lines read
+	read := 0
+	line := func() (string, error) {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return "", errors.New("truncated support bundle header")
+		}
+		read += len(l)
+		return strings.TrimSuffix(l, "\n"), nil
+	}
+	if l, err := line(); err != nil || l != header {
+		return nil, errors.New("not a support bundle")
+	}
+	for {
+		l, err := line()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(l, stanza):
+			fields := strings.Fields(strings.TrimPrefix(l, stanza))
+			if len(fields) != 2 {
+				return nil, errors.New("malformed recipient stanza")
+			}
+			eph, err1 := b64.DecodeString(fields[0])
+			wrapped, err2 := b64.DecodeString(fields[1])
+			if err1 != nil || err2 != nil {
+				return nil, errors.New("malformed recipient stanza")
+			}
+			s.stanzas = append(s.stanzas, [2][]byte{eph, wrapped})
+		case strings.HasPrefix(l, signerTag):
+			if s.signer, err = ParseSigner(strings.TrimPrefix(l, signerTag)); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(l, sigTag):
+			// The signature line is not part of what it signs
+			s.head = bundle[:read-len(l)-1]
+			if s.sig, err = b64.DecodeString(strings.TrimPrefix(l, sigTag)); err != nil {
+				return nil, errors.New("malformed signature")
+			}
+			if s.signer == nil {
+				return nil, errors.New("support bundle names no signer")
+			}
+			s.body = bundle[read:]
+			return s, nil
+		default:
+			return nil, fmt.Errorf("unexpected support bundle header line %q", l)
+		}
+	}
+}
+
+// Verify checks the signature of bundle and returns the key that signed
+// it. With trusted set, a bundle signed by another key fails too.
+func Verify(bundle []byte, trusted ed25519.PublicKey) (ed25519.PublicKey, error) {
+	s, err := parse(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(s.signer, append(append([]byte(nil), s.head...), s.body...), s.sig) {
+		return nil, ErrBadSignature
+	}
+	if trusted != nil && !s.signer.Equal(trusted) {
+		return nil, fmt.Errorf("%w: signed by %s, not the trusted key", ErrBadSignature, b64.EncodeToString(s.signer))
+	}
+	return s.signer, nil
+}
+
+// Open verifies bundle as Verify does and decrypts the archive with identity
+func Open(bundle []byte, identity *ecdh.PrivateKey, trusted ed25519.PublicKey) ([]byte, error) {
+	if _, err := Verify(bundle, trusted); err != nil {
+		return nil, err
+	}
+	s, err := parse(bundle)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range s.stanzas {
+		eph, err := ecdh.X25519().NewPublicKey(st[0])
+		if err != nil {
+			continue
+		}
+		fileKey, err := unwrap(identity, eph, st[1])
+		if err != nil {
+			continue
+		}
+		aead, err := newGCM(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.body) < aead.NonceSize() {
+			return nil, errors.New("truncated support bundle")
+		}
+		nonce, ciphertext := s.body[:aead.NonceSize()], s.body[aead.NonceSize():]
+		archive, err := aead.Open(nil, nonce, ciphertext, s.head)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt support bundle: %v", err)
+		}
+		return archive, nil
+	}
+	return nil, ErrNotRecipient
+}
+
+// wrap encrypts fileKey for recipient with a key derived from eph
+func wrap(eph *ecdh.PrivateKey, recipient *ecdh.PublicKey, fileKey []byte) ([]byte, error) {
+	shared, err := eph.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to agree on a key with recipient: %v", err)
+	}
+	aead, err := newGCM(wrapKey(shared, eph.PublicKey().Bytes(), recipient.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	// Each wrapping key is used once, so a zero nonce is safe
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+func unwrap(identity *ecdh.PrivateKey, eph *ecdh.PublicKey, wrapped []byte) ([]byte, error) {
+	shared, err := identity.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(wrapKey(shared, eph.Bytes(), identity.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), wrapped, nil)
+}
+
+// wrapKey is HKDF-SHA256 of the shared secret, salted with both public keys
+func wrapKey(shared, ephPub, recipientPub []byte) []byte {
+	extract := hmac.New(sha256.New, append(append([]byte(nil), ephPub...), recipientPub...))
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(kdfInfo))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,55 @@
+// Command consumer is an external service enqueueing tasks through
+// asynqdemo/pkg/taskclient. It must build against that package alone.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"time"
+
+	"asynqdemo/pkg/taskclient"
+
+	"github.com/hibiken/asynq"
+)
+
+func main() {
+	target := flag.String("target", "http://localhost:8080", "HTTP API base URL or redis:// URL")
+	redisAddr := flag.String("redis", "", "Redis address, overrides -target")
+	flag.Parse()
+
+	var c *taskclient.Client
+	var err error
+	if *redisAddr != "" {
+		c, err = taskclient.New(asynq.RedisClientOpt{Addr: *redisAddr})
+	} else {
+		c, err = taskclient.New(*target, taskclient.WithToken("example"))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	info, err := c.EnqueueEmail(ctx, taskclient.EmailPayload{
+		UserID:   42,
+		Email:    "user@example.com",
+		Subject:  "Your receipt",
+		Message:  "Thanks for your order",
+		Category: taskclient.CategoryTransactional,
+	}, taskclient.Queue(taskclient.QueueCritical), taskclient.WithMetadata("source", "consumer"))
+	var apiErr *taskclient.APIError
+	switch {
+	case errors.As(err, &apiErr) && !apiErr.NextAllowed.IsZero():
+		log.Printf("throttled until %s", apiErr.NextAllowed)
+	case err != nil:
+		log.Fatal(err)
+	default:
+		log.Printf("enqueued %s on %s", info.ID, info.Queue)
+	}
+
+	if _, err := c.EnqueueWelcome(ctx, taskclient.WelcomePayload{UserID: 42, Username: "ada"}, taskclient.ProcessIn(time.Minute)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package throttle caps how many emails of a category a user receives in a
+// period, across every campaign and workflow that sends them.
+package throttle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultCaps is used when EMAIL_FREQUENCY_CAPS is unset
+const DefaultCaps = "welcome=1/168h"
+
+// ledgerSize is the most sends kept per user and category
+const ledgerSize = 50
+
+// Cap allows Max emails of a category per user within Per. Emails over the
+// cap are deferred until the cap allows them when Defer is set, and
+// rejected otherwise.
+type Cap struct {
+	Max   int
+	Per   time.Duration
+	Defer bool
+}
+
+func (c Cap) String() string {
+	s := fmt.Sprintf("%d/%v", c.Max, c.Per)
+	if c.Defer {
+		s += ":defer"
+	}
+	return s
+}
+
+// ParseCaps parses "category=max/period[:defer],...", e.g.
+// "welcome=1/168h,marketing=3/24h:defer"
+func ParseCaps(s string) (map[string]Cap, error) {
+	caps := make(map[string]Cap)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		category, spec, ok := strings.Cut(part, "=")
+		if !ok || category == "" {
+			return nil, fmt.Errorf("invalid cap %q, want category=max/period", part)
+		}
+		var c Cap
+		spec, c.Defer = strings.CutSuffix(spec, ":defer")
+		max, per, ok := strings.Cut(spec, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid cap %q, want category=max/period", part)
+		}
+		var err error
+		if c.Max, err = strconv.Atoi(max); err != nil || c.Max < 1 {
+			return nil, fmt.Errorf("invalid cap %q: max must be a positive number", part)
+		}
+		if c.Per, err = time.ParseDuration(per); err != nil || c.Per <= 0 {
+			return nil, fmt.Errorf("invalid cap %q: period must be a positive duration", part)
+		}
+		if c.Max > ledgerSize {
+			return nil, fmt.Errorf("invalid cap %q: at most %d per period", part, ledgerSize)
+		}
+		caps[category] = c
+	}
+	return caps, nil
+}
+
+// CapsFromEnv reads EMAIL_FREQUENCY_CAPS, DefaultCaps when unset and none
+// when "off"
+func CapsFromEnv() (map[string]Cap, error) {
+	v := os.Getenv("EMAIL_FREQUENCY_CAPS")
+	switch v {
+	case "":
+		v = DefaultCaps
+	case "off":
+		return nil, nil
+	}
+	caps, err := ParseCaps(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EMAIL_FREQUENCY_CAPS: %v", err)
+	}
+	return caps, nil
+}
+
+// ErrThrottled is returned for an email that would exceed its category's cap
+type ErrThrottled struct {
+	UserID      int
+	Category    string
+	Cap         Cap
+	NextAllowed time.Time
+}
+
+func (e ErrThrottled) Error() string {
+	return fmt.Sprintf("user %d already got %d %s emails within %v, next allowed at %s", e.UserID, e.Cap.Max, e.Category, e.Cap.Per, e.NextAllowed.Format(time.RFC3339))
+}
+
+// Ledger records the emails sent to each user per capped category in Redis
+// sorted sets scored by send time, trimmed to the cap's period and to
+// ledgerSize entries
+type Ledger struct {
+	rdb  redis.UniversalClient
+	caps map[string]Cap
+}
+
+// NewLedger creates a ledger enforcing caps, nil when there are none
+func NewLedger(rdb redis.UniversalClient, caps map[string]Cap) *Ledger {
+	if len(caps) == 0 {
+		return nil
+	}
+	return &Ledger{rdb: rdb, caps: caps}
+}
+
+func ledgerKey(userID int, category string) string {
+	return fmt.Sprintf("throttle:ledger:%d:%s", userID, category)
+}
+
+// Record adds an email sent at to the user's ledger of its category;
+// uncapped categories are not recorded
+func (l *Ledger) Record(ctx context.Context, userID int, category, id string, at time.Time) error {
+	c, ok := l.caps[category]
+	if !ok || userID == 0 {
+		return nil
+	}
+	key := ledgerKey(userID, category)
+	pipe := l.rdb.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(at.UnixMilli()), Member: id})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(at.Add(-c.Per).UnixMilli(), 10))
+	pipe.ZRemRangeByRank(ctx, key, 0, -ledgerSize-1)
+	pipe.PExpire(ctx, key, c.Per)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record %s email to user %d: %v", category, userID, err)
+	}
+	return nil
+}
+
+// NextAllowed returns the earliest time from at on when the cap allows
+// another email of category to the user
+func (l *Ledger) NextAllowed(ctx context.Context, userID int, category string, at time.Time) (time.Time, error) {
+	c, ok := l.caps[category]
+	if !ok || userID == 0 {
+		return at, nil
+	}
+	sent, err := l.rdb.ZRangeByScoreWithScores(ctx, ledgerKey(userID, category), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(at.Add(-c.Per).UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read %s emails of user %d: %v", category, userID, err)
+	}
+	if len(sent) < c.Max {
+		return at, nil
+	}
+	// Allowed once enough of the sends in the period have aged out of it
+	oldest := time.UnixMilli(int64(sent[len(sent)-c.Max].Score))
+	return oldest.Add(c.Per), nil
+}
+
+// Options returns opts for enqueueing the email p, with a ProcessAt
+// deferring it when its category's cap defers, or ErrThrottled when the
+// cap rejects it. The intended time is the last ProcessAt or ProcessIn of
+// opts, now when there is none. override skips the cap; callers must
+// audit it. A nil Ledger caps nothing.
+func (l *Ledger) Options(ctx context.Context, p *common.EmailPayload, now time.Time, override bool, opts ...asynq.Option) ([]asynq.Option, error) {
+	if l == nil || override {
+		return opts, nil
+	}
+	c, ok := l.caps[p.Category]
+	if !ok || p.UserID == 0 {
+		return opts, nil
+	}
+	at := now
+	for _, o := range opts {
+		switch o.Type() {
+		case asynq.ProcessAtOpt:
+			at = o.Value().(time.Time)
+		case asynq.ProcessInOpt:
+			at = now.Add(o.Value().(time.Duration))
+		}
+	}
+	next, err := l.NextAllowed(ctx, p.UserID, p.Category, at)
+	if err != nil {
+		return nil, err
+	}
+	if !next.After(at) {
+		return opts, nil
+	}
+	if !c.Defer {
+		return nil, ErrThrottled{UserID: p.UserID, Category: p.Category, Cap: c, NextAllowed: next}
+	}
+	return append(opts[:len(opts):len(opts)], asynq.ProcessAt(next)), nil
+}
+
+// Middleware records every email sent successfully in the ledger. Install
+// it after the decrypt middleware so it sees the plain payload.
+func (l *Ledger) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			err := next.ProcessTask(ctx, t)
+			if err != nil || t.Type() != common.TypeEmailTask {
+				return err
+			}
+			var p common.EmailPayload
+			if json.Unmarshal(t.Payload(), &p) != nil {
+				return nil
+			}
+			id, ok := asynq.GetTaskID(ctx)
+			if !ok {
+				id = strconv.FormatInt(time.Now().UnixNano(), 10)
+			}
+			// Use a fresh context so an expired task deadline does not lose the send
+			if rerr := l.Record(context.Background(), p.UserID, p.Category, id, time.Now()); rerr != nil {
+				log.Printf("⚠️  %v", rerr)
+			}
+			return nil
+		})
+	}
+}
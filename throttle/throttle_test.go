@@ -0,0 +1,147 @@
+package throttle_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/api"
+	"asynqdemo/audit"
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/throttle"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestFrequencyCaps fails unless a second welcome email within the cap
+// is refused with ErrThrottled and a 429 naming the next allowed time,
+// email over a deferring cap is scheduled for when the cap allows it,
+// failed sends are not counted, and an admin override enqueues past the
+// cap with an audit record while other tokens cannot override.
+func TestFrequencyCaps(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	ctx := context.Background()
+	rdb, ok := r.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		t.Fatalf("unsupported redis connection %T", r)
+	}
+	defer rdb.Close()
+	const user = 9000001
+
+	caps, err := throttle.ParseCaps("welcome=1/168h,digest=2/24h:defer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger := throttle.NewLedger(rdb, caps)
+	welcome := &common.EmailPayload{UserID: user, Email: "capped@example.com", Subject: "Welcome", Category: common.CategoryWelcome}
+	now := time.Now()
+
+	// Sends are recorded by the completion hook, failed ones are not
+	send := func(p *common.EmailPayload, fail bool) {
+		payload, _ := json.Marshal(p)
+		h := ledger.Middleware()(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			if fail {
+				return errors.New("smtp down")
+			}
+			return nil
+		}))
+		h.ProcessTask(ctx, asynq.NewTask(common.TypeEmailTask, payload))
+	}
+	send(welcome, true)
+	if _, err := ledger.Options(ctx, welcome, now, false); err != nil {
+		t.Errorf("welcome email capped after a failed send: %v", err)
+	}
+	send(welcome, false)
+	_, err = ledger.Options(ctx, welcome, now, false)
+	var throttled throttle.ErrThrottled
+	if !errors.As(err, &throttled) {
+		t.Fatalf("second welcome email within 7 days: %v, want ErrThrottled", err)
+	}
+	if want := now.Add(168 * time.Hour); throttled.NextAllowed.Before(want.Add(-time.Minute)) || throttled.NextAllowed.After(want.Add(time.Minute)) {
+		t.Errorf("next welcome email allowed at %v, want about %v", throttled.NextAllowed, want)
+	}
+	if opts, err := ledger.Options(ctx, welcome, now, true); err != nil || len(opts) != 0 {
+		t.Errorf("override: options %v, error %v", opts, err)
+	}
+	other := *welcome
+	other.UserID++
+	if _, err := ledger.Options(ctx, &other, now, false); err != nil {
+		t.Errorf("cap of one user applied to another: %v", err)
+	}
+
+	// Deferral to when the oldest of the period's sends ages out
+	digest := &common.EmailPayload{UserID: user, Email: "capped@example.com", Subject: "Digest", Category: common.CategoryDigest}
+	first := now.Add(-time.Hour)
+	ledger.Record(ctx, user, common.CategoryDigest, "digest-1", first)
+	ledger.Record(ctx, user, common.CategoryDigest, "digest-2", now.Add(-30*time.Minute))
+	opts, err := ledger.Options(ctx, digest, now, false, asynq.Queue("low"))
+	if err != nil || len(opts) != 2 || opts[1].Type() != asynq.ProcessAtOpt {
+		t.Fatalf("digest over its cap: options %v, error %v, want a ProcessAt", opts, err)
+	}
+	if got, want := opts[1].Value().(time.Time), first.Add(24*time.Hour); got.Sub(want).Abs() > time.Second {
+		t.Errorf("digest deferred to %v, want %v", got, want)
+	}
+
+	// The HTTP API answers 429, and only admins may override with an audit record
+	authz, err := admin.NewAuthorizer([]admin.TokenConfig{
+		{Name: "oncall", Role: "operator", Token: "operator-token-0123456789"},
+		{Name: "sre", Role: "admin", Token: "admin-token-0123456789"},
+	}, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := asynq.NewClient(r)
+	defer client.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	auditStore := audit.NewStore(rdb)
+	handler := api.EnqueueHandler(client, nil, ledger, authz, nil, auditStore, inspector, nil)
+	payload, _ := json.Marshal(welcome)
+	post := func(override bool, token string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api.EnqueueRequest{Type: common.TypeEmailTask, Payload: payload, OverrideFrequencyCap: override})
+		req := httptest.NewRequest(http.MethodPost, "/api/tasks", strings.NewReader(string(body)))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := post(false, "")
+	var resp api.ThrottledResponse
+	if rec.Code != http.StatusTooManyRequests || json.Unmarshal(rec.Body.Bytes(), &resp) != nil || resp.NextAllowed.IsZero() || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("capped email: status %d, body %s, want 429 with next_allowed and Retry-After", rec.Code, rec.Body.String())
+	}
+	if rec := post(true, "operator-token-0123456789"); rec.Code != http.StatusForbidden {
+		t.Errorf("override by an operator: status %d, want 403", rec.Code)
+	}
+	rec = post(true, "admin-token-0123456789")
+	var enqueued api.EnqueueResponse
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &enqueued) != nil {
+		t.Fatalf("override by an admin: status %d, body %s, want 201", rec.Code, rec.Body.String())
+	}
+	defer inspector.DeleteTask(enqueued.Queue, enqueued.ID)
+	events, err := auditStore.Range(ctx, now.Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range events {
+		if e.TaskID == enqueued.ID && e.Kind == audit.KindCapOverridden && strings.Contains(e.Detail, "sre") {
+			return
+		}
+	}
+	t.Errorf("override of task %s not in the audit log", enqueued.ID)
+}
@@ -0,0 +1,54 @@
+// Package timeout derives task deadlines from how long tasks waited in the queue.
+package timeout
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/metadata"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+)
+
+// ErrTaskExpired is returned for tasks whose whole time budget was spent waiting
+// in the queue. It wraps asynq.SkipRetry since retrying cannot help.
+type ErrTaskExpired struct {
+	EnqueuedAt time.Time
+	ExpiredAt  time.Time
+}
+
+func (e ErrTaskExpired) Error() string {
+	return fmt.Sprintf("task expired at %s (enqueued at %s)", e.ExpiredAt.Format(time.RFC3339), e.EnqueuedAt.Format(time.RFC3339))
+}
+
+func (e ErrTaskExpired) Unwrap() error {
+	return asynq.SkipRetry
+}
+
+// ContextualTimeoutMiddleware gives each task totalBudget minus the time it
+// spent in the queue, read from the enqueued_at metadata. Tasks without the
+// attribute get the whole budget. Install it after metadata.Middleware.
+func ContextualTimeoutMiddleware(totalBudget time.Duration) middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			remaining := totalBudget
+			if v, ok := metadata.FromContext(ctx)[metadata.KeyEnqueuedAt]; ok {
+				enqueuedAt, err := time.Parse(time.RFC3339Nano, v)
+				if err != nil {
+					return fmt.Errorf("failed to parse %s %q: %v", metadata.KeyEnqueuedAt, v, err)
+				}
+				now := common.DepsFrom(ctx).Clock.Now()
+				remaining = totalBudget - now.Sub(enqueuedAt)
+				if remaining <= 0 {
+					return ErrTaskExpired{EnqueuedAt: enqueuedAt, ExpiredAt: enqueuedAt.Add(totalBudget)}
+				}
+			}
+			ctx, cancel := context.WithTimeout(ctx, remaining)
+			defer cancel()
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
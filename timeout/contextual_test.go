@@ -0,0 +1,74 @@
+package timeout_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/common/clock"
+	"asynqdemo/leak/leaktest"
+	"asynqdemo/metadata"
+	"asynqdemo/timeout"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestContextualTimeout runs tasks enqueued 9 minutes and 1 minute ago
+// under a 10 minute budget and fails unless the first is skipped as
+// expired without a retry and the second gets a 9 minute deadline
+func TestContextualTimeout(t *testing.T) {
+	leaktest.Check(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := common.WithDeps(context.Background(), common.Deps{Clock: clock.NewFake(now)})
+
+	var ran bool
+	var deadline time.Time
+	h := metadata.Middleware()(timeout.ContextualTimeoutMiddleware(10 * time.Minute)(
+		asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			ran = true
+			deadline, _ = ctx.Deadline()
+			return nil
+		})))
+	run := func(md metadata.Metadata) error {
+		t.Helper()
+		task, err := metadata.NewTask("timeout:test", []byte(`{}`), md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ran, deadline = false, time.Time{}
+		return h.ProcessTask(ctx, task)
+	}
+	at := func(d time.Duration) metadata.Metadata {
+		return metadata.Metadata{metadata.KeyEnqueuedAt: now.Add(-d).Format(time.RFC3339Nano)}
+	}
+
+	err := run(at(11 * time.Minute))
+	var expired timeout.ErrTaskExpired
+	if !errors.As(err, &expired) || !errors.Is(err, asynq.SkipRetry) || ran {
+		t.Fatalf("task 11m old gave %v, ran %v", err, ran)
+	}
+	if !expired.EnqueuedAt.Equal(now.Add(-11*time.Minute)) || !expired.ExpiredAt.Equal(now.Add(-time.Minute)) {
+		t.Errorf("expired %+v", expired)
+	}
+
+	if err := run(at(time.Minute)); err != nil || !ran {
+		t.Fatalf("task 1m old gave %v, ran %v", err, ran)
+	}
+	// The deadline is measured from the wall clock when the handler starts
+	if remaining := time.Until(deadline); remaining > 9*time.Minute || remaining < 9*time.Minute-5*time.Second {
+		t.Errorf("task 1m old has %v left, want 9m", remaining)
+	}
+
+	ran = false
+	if err := h.ProcessTask(ctx, asynq.NewTask("timeout:test", []byte(`{}`))); err != nil || !ran {
+		t.Fatalf("task without metadata gave %v, ran %v", err, ran)
+	}
+	if remaining := time.Until(deadline); remaining > 10*time.Minute || remaining < 10*time.Minute-5*time.Second {
+		t.Errorf("task without metadata has %v left, want the whole 10m", remaining)
+	}
+	if err := run(metadata.Metadata{metadata.KeyEnqueuedAt: "yesterday"}); err == nil || ran {
+		t.Errorf("malformed enqueued_at gave %v, ran %v", err, ran)
+	}
+}
@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"asynqdemo/metadata"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+)
+
+// TraceOpt is the asynq.OptionType of WithTraceContext, past asynq's own
+// types and dedup.KeyOpt. asynq ignores the option; Inject acts on it.
+const TraceOpt asynq.OptionType = 101
+
+// traceOption is the option of WithTraceContext
+type traceOption struct {
+	sc SpanContext
+}
+
+func (o traceOption) String() string         { return "WithTraceContext(" + FormatTraceParent(o.sc) + ")" }
+func (o traceOption) Type() asynq.OptionType { return TraceOpt }
+func (o traceOption) Value() interface{}     { return o.sc }
+
+// WithTraceContext carries the span context of ctx to the handler of the
+// task. asynq has no place for it, so Inject writes it into the task
+// metadata; nothing is carried when ctx has no span context.
+func WithTraceContext(ctx context.Context) asynq.Option {
+	return traceOption{sc: SpanContextFromContext(ctx)}
+}
+
+// Inject writes the span context of the WithTraceContext option in opts
+// into md as W3C Trace Context
+func Inject(md metadata.Metadata, opts ...asynq.Option) {
+	for _, opt := range opts {
+		if o, ok := opt.(traceOption); ok && o.sc.IsValid() {
+			TraceContext{}.Inject(ContextWithRemoteSpanContext(context.Background(), o.sc), MapCarrier(md))
+		}
+	}
+}
+
+// OTelMiddleware extracts the span context the producer put into the task
+// metadata with propagator and runs the handler in a consumer span named
+// after the task type, ended also when the handler panics. It must be
+// installed after metadata.Middleware.
+func OTelMiddleware(propagator TextMapPropagator, tracer Tracer) middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			md := metadata.FromContext(ctx)
+			if md == nil {
+				md = metadata.FromTask(t)
+			}
+			ctx = propagator.Extract(ctx, MapCarrier(md))
+			ctx, span := tracer.Start(ctx, t.Type(), SpanKindConsumer)
+			defer span.End()
+			span.SetAttribute("messaging.system", "asynq")
+			span.SetAttribute("messaging.operation", "process")
+			if id, ok := asynq.GetTaskID(ctx); ok {
+				span.SetAttribute("messaging.message.id", id)
+			}
+			if queue, ok := asynq.GetQueueName(ctx); ok {
+				span.SetAttribute("messaging.destination.name", queue)
+			}
+			if retried, ok := asynq.GetRetryCount(ctx); ok && retried > 0 {
+				span.SetAttribute("asynq.retry_count", strconv.Itoa(retried))
+			}
+			// Deferred after End, so it runs first
+			defer func() {
+				if r := recover(); r != nil {
+					span.RecordError(fmt.Errorf("panic: %v", r))
+					panic(r)
+				}
+			}()
+			err := next.ProcessTask(ctx, t)
+			span.RecordError(err)
+			return err
+		})
+	}
+}
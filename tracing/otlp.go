@@ -0,0 +1,234 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultServiceName is the service.name of the spans unless
+// OTEL_SERVICE_NAME sets it
+const DefaultServiceName = "asynqdemo"
+
+// DefaultFlushInterval is how often an OTLPExporter sends the spans it queued
+const DefaultFlushInterval = 5 * time.Second
+
+// DefaultMaxQueue is how many spans an OTLPExporter queues at most between
+// flushes; it drops the spans past it
+const DefaultMaxQueue = 2048
+
+// OTLP status code of failed spans
+const otlpStatusError = 2
+
+// EndpointFromEnv returns the OTLP/HTTP traces endpoint,
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or else /v1/traces of
+// OTEL_EXPORTER_OTLP_ENDPOINT, empty when neither is set
+func EndpointFromEnv() string {
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); v != "" {
+		return v
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		return strings.TrimSuffix(v, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// ServiceNameFromEnv returns OTEL_SERVICE_NAME, DefaultServiceName when it
+// is unset
+func ServiceNameFromEnv() string {
+	if v := os.Getenv("OTEL_SERVICE_NAME"); v != "" {
+		return v
+	}
+	return DefaultServiceName
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector as OTLP/HTTP JSON,
+// in batches every FlushInterval while Run runs. Export is the export
+// function of NewTracer.
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	Client   *http.Client
+	// FlushInterval is how often Run sends the queued spans
+	FlushInterval time.Duration
+	// MaxQueue is how many spans are queued at most
+	MaxQueue int
+
+	mu      sync.Mutex
+	queue   []SpanData
+	dropped int
+}
+
+// NewOTLPExporter creates an exporter sending the spans of service to
+// endpoint, e.g. http://collector:4318/v1/traces
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:      endpoint,
+		service:       service,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		FlushInterval: DefaultFlushInterval,
+		MaxQueue:      DefaultMaxQueue,
+	}
+}
+
+// Export queues a finished span for the next flush
+func (e *OTLPExporter) Export(s SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= e.MaxQueue {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, s)
+}
+
+// Flush sends the queued spans; they are dropped when the collector
+// cannot take them
+func (e *OTLPExporter) Flush(ctx context.Context) error {
+	e.mu.Lock()
+	spans, dropped := e.queue, e.dropped
+	e.queue, e.dropped = nil, 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("⚠️  Dropped %d spans over the export queue of %d", dropped, e.MaxQueue)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return fmt.Errorf("failed to marshal %d spans: %v", len(spans), err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export %d spans: %v", len(spans), err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export %d spans: collector returned %s", len(spans), resp.Status)
+	}
+	return nil
+}
+
+// Run flushes every FlushInterval, and once more when ctx is done
+func (e *OTLPExporter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := e.Flush(flushCtx); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+			return nil
+		case <-ticker.C:
+			if err := e.Flush(ctx); err != nil {
+				log.Printf("⚠️  %v", err)
+			}
+		}
+	}
+}
+
+// OTLP/JSON encoding of a trace export request; IDs are hex and times
+// decimal strings of Unix nanoseconds
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		TraceState        string          `json:"traceState,omitempty"`
+		Name              string          `json:"name"`
+		Kind              SpanKind        `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (e *OTLPExporter) request(spans []SpanData) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			TraceState:        s.Context.TraceState,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes(s.Attributes),
+		}
+		if s.Parent.IsValid() {
+			span.ParentSpanID = s.Parent.String()
+		}
+		if s.Err != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Err}
+		}
+		out = append(out, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: attributes(map[string]string{"service.name": e.service})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "asynqdemo/tracing"}, Spans: out}},
+	}}}
+}
+
+// attributes returns the OTLP attributes of m, sorted by key
+func attributes(m map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]otlpAttribute, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, otlpAttribute{Key: k, Value: otlpValue{StringValue: m[k]}})
+	}
+	return attrs
+}
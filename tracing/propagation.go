@@ -0,0 +1,168 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// W3C TraceContext fields
+const (
+	KeyTraceParent = "traceparent"
+	KeyTraceState  = "tracestate"
+)
+
+// maxTraceStateMembers is the most list members a tracestate may have
+const maxTraceStateMembers = 32
+
+// TextMapCarrier holds propagated fields, such as task metadata or HTTP
+// headers
+type TextMapCarrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// MapCarrier is a TextMapCarrier of a string map, e.g. metadata.Metadata
+type MapCarrier map[string]string
+
+// Get returns the value of key
+func (c MapCarrier) Get(key string) string { return c[key] }
+
+// Set sets the value of key
+func (c MapCarrier) Set(key, value string) { c[key] = value }
+
+// Keys returns the keys of the map
+func (c MapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// TextMapPropagator moves the span context of a context through a carrier
+type TextMapPropagator interface {
+	// Inject writes the span context of ctx into carrier
+	Inject(ctx context.Context, carrier TextMapCarrier)
+	// Extract returns ctx with the remote span context read from carrier,
+	// ctx itself when carrier has none that is valid
+	Extract(ctx context.Context, carrier TextMapCarrier) context.Context
+	// Fields returns the keys the propagator sets
+	Fields() []string
+}
+
+// TraceContext propagates span contexts in the traceparent and tracestate
+// fields of the W3C Trace Context specification
+type TraceContext struct{}
+
+var _ TextMapPropagator = TraceContext{}
+
+// Inject writes traceparent and tracestate, nothing when ctx has no valid
+// span context
+func (TraceContext) Inject(ctx context.Context, carrier TextMapCarrier) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	carrier.Set(KeyTraceParent, FormatTraceParent(sc))
+	if sc.TraceState != "" {
+		carrier.Set(KeyTraceState, sc.TraceState)
+	}
+}
+
+// Extract reads traceparent and tracestate. A tracestate that is not valid
+// is dropped, keeping the traceparent.
+func (TraceContext) Extract(ctx context.Context, carrier TextMapCarrier) context.Context {
+	sc, err := ParseTraceParent(carrier.Get(KeyTraceParent))
+	if err != nil {
+		return ctx
+	}
+	if state := strings.TrimSpace(carrier.Get(KeyTraceState)); validTraceState(state) {
+		sc.TraceState = state
+	}
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Fields returns traceparent and tracestate
+func (TraceContext) Fields() []string {
+	return []string{KeyTraceParent, KeyTraceState}
+}
+
+// FormatTraceParent returns the version 00 traceparent of sc, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func FormatTraceParent(sc SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags&FlagSampled)
+}
+
+// ParseTraceParent parses a traceparent. Versions after 00 are read as 00,
+// ignoring the fields they add, as the specification asks.
+func ParseTraceParent(v string) (SpanContext, error) {
+	var sc SpanContext
+	v = strings.TrimSpace(v)
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return sc, fmt.Errorf("invalid traceparent %q", v)
+	}
+	version, err := lowerHex(v[:2])
+	switch {
+	case err != nil:
+		return sc, fmt.Errorf("invalid traceparent version %q", v[:2])
+	case version[0] == 0xff:
+		return sc, fmt.Errorf("traceparent version ff is forbidden")
+	case version[0] == 0 && len(v) != 55:
+		return sc, fmt.Errorf("traceparent of version 00 is %d characters long, want 55", len(v))
+	case len(v) > 55 && v[55] != '-':
+		return sc, fmt.Errorf("invalid traceparent %q", v)
+	}
+	traceID, err := lowerHex(v[3:35])
+	if err != nil {
+		return sc, fmt.Errorf("invalid trace ID %q", v[3:35])
+	}
+	spanID, err := lowerHex(v[36:52])
+	if err != nil {
+		return sc, fmt.Errorf("invalid parent ID %q", v[36:52])
+	}
+	flags, err := lowerHex(v[53:55])
+	if err != nil {
+		return sc, fmt.Errorf("invalid trace flags %q", v[53:55])
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("traceparent %q has an all-zero ID", v)
+	}
+	return sc, nil
+}
+
+// lowerHex decodes hex digits, refusing upper case ones
+func lowerHex(s string) ([]byte, error) {
+	if strings.ToLower(s) != s {
+		return nil, fmt.Errorf("%q is not lowercase", s)
+	}
+	return hex.DecodeString(s)
+}
+
+// validTraceState reports whether a tracestate is a list of at most 32
+// key=value members
+func validTraceState(state string) bool {
+	if state == "" {
+		return false
+	}
+	members := strings.Split(state, ",")
+	if len(members) > maxTraceStateMembers {
+		return false
+	}
+	for _, m := range members {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(m, "=")
+		if !ok || key == "" || value == "" {
+			return false
+		}
+	}
+	return true
+}
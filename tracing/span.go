@@ -0,0 +1,182 @@
+// Package tracing carries W3C trace context from the producer of a task to
+// its handler and records spans of the handling. It follows the shape of the
+// OpenTelemetry API, a tracer starting spans and a propagator moving their
+// context through a carrier, without depending on the SDK; spans are
+// exported as OTLP by OTLPExporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// String returns the ID as 32 lowercase hex digits
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeros
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// String returns the ID as 16 lowercase hex digits
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeros
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// FlagSampled is the trace flag of sampled traces
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span that crosses process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// TraceState is the vendor tracestate, passed on as is
+	TraceState string
+	// Remote is set for a context extracted from a carrier
+	Remote bool
+}
+
+// IsValid reports whether both IDs are set
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// IsSampled reports whether the sampled flag is set
+func (sc SpanContext) IsSampled() bool { return sc.Flags&FlagSampled != 0 }
+
+// SpanKind is the role of a span, as in OTLP
+type SpanKind int
+
+// Span kinds
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindProducer SpanKind = 4
+	SpanKindConsumer SpanKind = 5
+)
+
+// Span is an operation of a trace
+type Span interface {
+	SpanContext() SpanContext
+	SetAttribute(key, value string)
+	// RecordError marks the span failed with err
+	RecordError(err error)
+	// End finishes the span; later calls do nothing
+	End()
+}
+
+// Tracer starts spans, children of the span or remote span context of ctx
+type Tracer interface {
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// ContextWithSpan returns a context carrying span
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// ContextWithRemoteSpanContext returns a context carrying sc as the parent
+// of the spans started from it
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanContextFromContext returns the context of the span of ctx, or else
+// its remote span context, the zero SpanContext when it has neither
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span.SpanContext()
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// SpanData is a finished span
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start, End time.Time
+	Attributes map[string]string
+	// Err is the message of the error recorded, empty when it succeeded
+	Err string
+}
+
+// NewTracer creates a tracer handing every finished span of a sampled trace
+// to export. Spans without a parent start sampled traces.
+func NewTracer(export func(SpanData)) Tracer {
+	return &tracer{export: export}
+}
+
+type tracer struct {
+	export func(SpanData)
+}
+
+func (t *tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+	s := &span{tracer: t, data: SpanData{Name: name, Kind: kind, Start: time.Now(), Attributes: map[string]string{}}}
+	if parent.IsValid() {
+		s.data.Context = SpanContext{TraceID: parent.TraceID, Flags: parent.Flags, TraceState: parent.TraceState}
+		s.data.Parent = parent.SpanID
+	} else {
+		rand.Read(s.data.Context.TraceID[:])
+		s.data.Context.Flags = FlagSampled
+	}
+	rand.Read(s.data.Context.SpanID[:])
+	return ContextWithSpan(ctx, s), s
+}
+
+type span struct {
+	tracer *tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+func (s *span) SpanContext() SpanContext {
+	return s.data.Context
+}
+
+func (s *span) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.Attributes[key] = value
+	}
+}
+
+func (s *span) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended && err != nil {
+		s.data.Err = err.Error()
+	}
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if data.Context.IsSampled() && s.tracer.export != nil {
+		s.tracer.export(data)
+	}
+}
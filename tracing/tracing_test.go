@@ -0,0 +1,236 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metadata"
+	"asynqdemo/tracing"
+
+	"github.com/hibiken/asynq"
+)
+
+// spanRecorder keeps the spans a tracer exports
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (r *spanRecorder) export(s tracing.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) named(name string) []tracing.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var spans []tracing.SpanData
+	for _, s := range r.spans {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// TestTracePropagation fails unless traceparent is parsed as the W3C
+// Trace Context specification asks, a task enqueued with WithTraceContext
+// on an embedded Redis is handled in a consumer span named after its type
+// that is a child of the producer span, also after a delay, a task without
+// it starts its own trace, failures and panics end the span as failed, and
+// the OTLP exporter sends the spans as OTLP/HTTP JSON.
+func TestTracePropagation(t *testing.T) {
+	for _, c := range []struct {
+		traceparent string
+		ok          bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-later", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-later", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"", false},
+	} {
+		sc, err := tracing.ParseTraceParent(c.traceparent)
+		if (err == nil) != c.ok {
+			t.Errorf("traceparent %q gave %v, want ok %v", c.traceparent, err, c.ok)
+		}
+		if c.ok && c.traceparent[:2] == "00" && tracing.FormatTraceParent(sc) != c.traceparent {
+			t.Errorf("traceparent %q formats back as %q", c.traceparent, tracing.FormatTraceParent(sc))
+		}
+	}
+
+	// The producer continues a remote trace with a vendor tracestate
+	carrier := tracing.MapCarrier{
+		tracing.KeyTraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		tracing.KeyTraceState:  "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7",
+	}
+	remote := tracing.TraceContext{}.Extract(context.Background(), carrier)
+	if sc := tracing.SpanContextFromContext(remote); !sc.Remote || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.TraceState != carrier[tracing.KeyTraceState] {
+		t.Fatalf("extracted %+v", sc)
+	}
+
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+
+	recorder := &spanRecorder{}
+	tracer := tracing.NewTracer(recorder.export)
+	var (
+		mu      sync.Mutex
+		handled = map[string]tracing.SpanContext{}
+		done    = make(chan string, 10)
+	)
+	mux := asynq.NewServeMux()
+	mux.Use(metadata.Middleware(), tracing.OTelMiddleware(tracing.TraceContext{}, tracer))
+	handle := func(ctx context.Context, task *asynq.Task) error {
+		var p struct{ Name string }
+		json.Unmarshal(task.Payload(), &p)
+		mu.Lock()
+		handled[p.Name] = tracing.SpanContextFromContext(ctx)
+		mu.Unlock()
+		defer func() { done <- p.Name }()
+		switch p.Name {
+		case "fails":
+			return errors.New("smtp down")
+		case "panics":
+			panic("nil map")
+		}
+		return nil
+	}
+	mux.HandleFunc("trace:test", handle)
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 4, LogLevel: asynq.ErrorLevel, DelayedTaskCheckInterval: 100 * time.Millisecond})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	enqueue := func(ctx context.Context, name string, opts ...asynq.Option) tracing.SpanContext {
+		ctx, span := tracer.Start(ctx, "trace:test publish", tracing.SpanKindProducer)
+		defer span.End()
+		opts = append(opts, tracing.WithTraceContext(ctx), asynq.MaxRetry(0))
+		md := metadata.Metadata{}
+		tracing.Inject(md, opts...)
+		task, err := metadata.NewTask("trace:test", []byte(`{"name": "`+name+`"}`), md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Enqueue(task, opts...); err != nil {
+			t.Fatal(err)
+		}
+		return span.SpanContext()
+	}
+	producers := map[string]tracing.SpanContext{
+		"ok":      enqueue(remote, "ok"),
+		"delayed": enqueue(context.Background(), "delayed", asynq.ProcessIn(500*time.Millisecond)),
+		"fails":   enqueue(context.Background(), "fails"),
+		"panics":  enqueue(context.Background(), "panics"),
+	}
+	if err := func() error {
+		md := metadata.Metadata{}
+		tracing.Inject(md, tracing.WithTraceContext(context.Background()))
+		task, err := metadata.NewTask("trace:test", []byte(`{"name": "untraced"}`), md)
+		if err != nil {
+			return err
+		}
+		_, err = client.Enqueue(task)
+		return err
+	}(); err != nil {
+		t.Fatal(err)
+	}
+	for seen := map[string]bool{}; len(seen) < 5; {
+		select {
+		case name := <-done:
+			seen[name] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out with %v handled", seen)
+		}
+	}
+	// The span ends after the handler returns
+	time.Sleep(100 * time.Millisecond)
+
+	consumers := map[string]tracing.SpanData{}
+	for _, s := range recorder.named("trace:test") {
+		if s.Kind != tracing.SpanKindConsumer || s.Attributes["messaging.system"] != "asynq" || s.Attributes["messaging.destination.name"] != "default" || s.Attributes["messaging.message.id"] == "" {
+			t.Errorf("consumer span %+v", s)
+		}
+		consumers[s.Context.SpanID.String()] = s
+	}
+	if len(consumers) != 5 {
+		t.Fatalf("%d consumer spans, want 5", len(consumers))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for name, producer := range producers {
+		got := handled[name]
+		span, ok := consumers[got.SpanID.String()]
+		if !ok || got.TraceID != producer.TraceID || span.Parent != producer.SpanID || span.Context.TraceState != producer.TraceState {
+			t.Errorf("%s task handled in %+v, span %+v, want a child of %+v", name, got, span, producer)
+		}
+	}
+	if producers["ok"].TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || handled["ok"].TraceState != carrier[tracing.KeyTraceState] {
+		t.Errorf("remote trace not continued: %+v", handled["ok"])
+	}
+	untraced := handled["untraced"]
+	if span := consumers[untraced.SpanID.String()]; span.Parent.IsValid() || !untraced.TraceID.IsValid() || untraced.TraceID == producers["ok"].TraceID {
+		t.Errorf("task without trace context handled in %+v", span)
+	}
+	for name, want := range map[string]string{"ok": "", "delayed": "", "fails": "smtp down", "panics": "panic: nil map"} {
+		if got := consumers[handled[name].SpanID.String()].Err; got != want {
+			t.Errorf("%s span failed with %q, want %q", name, got, want)
+		}
+	}
+
+	// The exporter sends OTLP/HTTP JSON
+	var (
+		bodies []map[string]interface{}
+		bodyMu sync.Mutex
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodyMu.Lock()
+		bodies = append(bodies, body)
+		bodyMu.Unlock()
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL+"/")
+	exporter := tracing.NewOTLPExporter(tracing.EndpointFromEnv(), "mailer")
+	failed := consumers[handled["fails"].SpanID.String()]
+	exporter.Export(failed)
+	if err := exporter.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Flush(context.Background()); err != nil || len(bodies) != 1 {
+		t.Fatalf("empty flush gave %v with %d requests", err, len(bodies))
+	}
+	resource := bodies[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	service := resource["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})
+	span := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	if service["key"] != "service.name" || service["value"].(map[string]interface{})["stringValue"] != "mailer" ||
+		span["traceId"] != failed.Context.TraceID.String() || span["parentSpanId"] != failed.Parent.String() ||
+		span["name"] != "trace:test" || span["kind"] != float64(tracing.SpanKindConsumer) ||
+		span["status"].(map[string]interface{})["code"] != float64(2) || span["status"].(map[string]interface{})["message"] != "smtp down" {
+		t.Errorf("collector got %v", bodies[0])
+	}
+}
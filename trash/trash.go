@@ -0,0 +1,223 @@
+// Package trash implements soft deletes: deleted tasks wait in a paused queue
+// for a grace period, during which they can be restored, before they are
+// purged for good.
+package trash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"asynqdemo/common"
+	"asynqdemo/metadata"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Queue holds soft-deleted tasks. It is kept paused so they never run.
+const Queue = "trash"
+
+// Metadata attributes recording where a trashed task came from
+const (
+	KeyFrom      = "trashed_from"
+	KeyState     = "trashed_state"
+	KeyProcessAt = "trashed_process_at"
+	KeyAt        = "trashed_at"
+	// keyBare marks payloads that had no metadata envelope before trashing
+	keyBare = "trashed_bare"
+)
+
+// TypePurge deletes trashed tasks older than the payload's TTL
+const TypePurge = "trash:purge"
+
+// PurgePayload configures one purge run
+type PurgePayload struct {
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+var purgeOptions = []asynq.Option{asynq.Queue("low"), asynq.MaxRetry(1)}
+
+func init() {
+	common.RegisterTaskSpec(common.TaskSpec{Type: TypePurge, NewPayload: func() interface{} { return &PurgePayload{} }, DefaultOptions: purgeOptions})
+}
+
+// SoftDelete moves a task into the trash queue, keeping its ID and options
+func SoftDelete(ctx context.Context, inspector *asynq.Inspector, client *asynq.Client, rdb redis.UniversalClient, t *asynq.TaskInfo) error {
+	if t.Queue == Queue {
+		return fmt.Errorf("task %s is already in the trash", t.ID)
+	}
+	if err := ensurePaused(ctx, rdb); err != nil {
+		return err
+	}
+	raw, md := metadata.Unwrap(t.Payload)
+	trashed := metadata.Metadata{
+		KeyFrom:  t.Queue,
+		KeyState: t.State.String(),
+		KeyAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	for k, v := range md {
+		trashed[k] = v
+	}
+	if md == nil {
+		trashed[keyBare] = "true"
+	}
+	if t.State != asynq.TaskStatePending && !t.NextProcessAt.IsZero() {
+		trashed[KeyProcessAt] = t.NextProcessAt.UTC().Format(time.RFC3339)
+	}
+	payload, err := metadata.Wrap(raw, trashed)
+	if err != nil {
+		return fmt.Errorf("failed to trash task %s: %v", t.ID, err)
+	}
+	if err := copyTask(ctx, client, t, payload, Queue, time.Time{}); err != nil {
+		return err
+	}
+	if err := inspector.DeleteTask(t.Queue, t.ID); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+		return fmt.Errorf("failed to delete task %s from %s: %v", t.ID, t.Queue, err)
+	}
+	return nil
+}
+
+// Restore moves a trashed task back to its queue. Scheduled and retry tasks
+// keep their process time unless it passed while they were in the trash.
+func Restore(ctx context.Context, inspector *asynq.Inspector, client *asynq.Client, id string) (*asynq.TaskInfo, error) {
+	t, err := inspector.GetTaskInfo(Queue, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed task %s: %w", id, err)
+	}
+	raw, md := metadata.Unwrap(t.Payload)
+	from := md[KeyFrom]
+	if from == "" {
+		return nil, fmt.Errorf("trashed task %s does not record its queue", id)
+	}
+	var processAt time.Time
+	if s := md[KeyProcessAt]; s != "" {
+		if processAt, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, fmt.Errorf("invalid %s of task %s: %v", KeyProcessAt, id, err)
+		}
+	}
+	bare := md[keyBare] == "true"
+	for _, k := range []string{KeyFrom, KeyState, KeyProcessAt, KeyAt, keyBare} {
+		delete(md, k)
+	}
+	payload := raw
+	if !bare {
+		if payload, err = metadata.Wrap(raw, md); err != nil {
+			return nil, fmt.Errorf("failed to restore task %s: %v", id, err)
+		}
+	}
+	if err := copyTask(ctx, client, t, payload, from, processAt); err != nil {
+		return nil, err
+	}
+	if err := inspector.DeleteTask(Queue, id); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+		return nil, fmt.Errorf("failed to delete task %s from trash: %v", id, err)
+	}
+	return inspector.GetTaskInfo(from, id)
+}
+
+// List returns the trashed tasks
+func List(inspector *asynq.Inspector) ([]*asynq.TaskInfo, error) {
+	var all []*asynq.TaskInfo
+	for page := 1; ; page++ {
+		tasks, err := inspector.ListPendingTasks(Queue, asynq.PageSize(100), asynq.Page(page))
+		if errors.Is(err, asynq.ErrQueueNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list trash: %v", err)
+		}
+		all = append(all, tasks...)
+		if len(tasks) < 100 {
+			return all, nil
+		}
+	}
+}
+
+// Purge hard-deletes trashed tasks that have been in the trash longer than ttl
+func Purge(inspector *asynq.Inspector, ttl time.Duration, now time.Time) (int, error) {
+	tasks, err := List(inspector)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, t := range tasks {
+		_, md := metadata.Unwrap(t.Payload)
+		at, err := time.Parse(time.RFC3339, md[KeyAt])
+		if err != nil {
+			log.Printf("⚠️  Trashed task %s has no valid %s, purging it: %v", t.ID, KeyAt, err)
+		} else if now.Sub(at) < ttl {
+			continue
+		}
+		if err := inspector.DeleteTask(Queue, t.ID); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+			return purged, fmt.Errorf("failed to purge task %s: %v", t.ID, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// NewPurgeTask creates a purge task for the low priority queue
+func NewPurgeTask(ttl time.Duration) (*asynq.Task, error) {
+	payload, err := json.Marshal(PurgePayload{TTLSeconds: int(ttl.Seconds())})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal purge payload: %v", err)
+	}
+	return asynq.NewTask(TypePurge, payload, purgeOptions...), nil
+}
+
+// PurgeHandler handles TypePurge tasks
+func PurgeHandler(inspector *asynq.Inspector) asynq.HandlerFunc {
+	return func(ctx context.Context, t *asynq.Task) error {
+		var p PurgePayload
+		if err := json.Unmarshal(t.Payload(), &p); err != nil {
+			return fmt.Errorf("failed to unmarshal purge payload: %v", err)
+		}
+		n, err := Purge(inspector, time.Duration(p.TTLSeconds)*time.Second, time.Now())
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			fmt.Printf("🗑️  [Trash] purged %d tasks\n", n)
+		}
+		return nil
+	}
+}
+
+// ensurePaused pauses the trash queue; asynq's PauseQueue fails when it
+// already is, so the flag is set directly
+func ensurePaused(ctx context.Context, rdb redis.UniversalClient) error {
+	key := fmt.Sprintf("asynq:{%s}:paused", Queue)
+	if err := rdb.SetNX(ctx, key, time.Now().Unix(), 0).Err(); err != nil {
+		return fmt.Errorf("failed to pause trash queue: %v", err)
+	}
+	return nil
+}
+
+// copyTask enqueues payload under t's ID and options into queue
+func copyTask(ctx context.Context, client *asynq.Client, t *asynq.TaskInfo, payload []byte, queue string, processAt time.Time) error {
+	opts := []asynq.Option{
+		asynq.TaskID(t.ID),
+		asynq.Queue(queue),
+		asynq.MaxRetry(t.MaxRetry),
+	}
+	if processAt.After(time.Now()) {
+		opts = append(opts, asynq.ProcessAt(processAt))
+	}
+	if t.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(t.Timeout))
+	}
+	if !t.Deadline.IsZero() {
+		opts = append(opts, asynq.Deadline(t.Deadline))
+	}
+	if t.Retention > 0 {
+		opts = append(opts, asynq.Retention(t.Retention))
+	}
+	_, err := client.EnqueueContext(ctx, asynq.NewTask(t.Type, payload), opts...)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to copy task %s to %s: %v", t.ID, queue, err)
+	}
+	return nil
+}
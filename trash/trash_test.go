@@ -0,0 +1,134 @@
+package trash_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/metadata"
+	"asynqdemo/trash"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestSoftDelete trashes a pending task without metadata and a scheduled
+// one with metadata, and fails unless they wait in the paused trash queue,
+// restoring the scheduled one brings it back with its process time, options
+// and metadata, and a purge removes the other only once its TTL has passed
+func TestSoftDelete(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	ctx := context.Background()
+
+	processAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	if _, err := client.Enqueue(asynq.NewTask("report:generate", []byte(`{"id":1}`)), asynq.TaskID("bare"), asynq.Queue("low")); err != nil {
+		t.Fatal(err)
+	}
+	scheduled, err := metadata.NewTask("email:send", []byte(`{"user_id":2}`), metadata.Metadata{"tenant_id": "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Enqueue(scheduled, asynq.TaskID("scheduled"), asynq.Queue("critical"), asynq.ProcessAt(processAt),
+		asynq.MaxRetry(7), asynq.Timeout(3*time.Minute), asynq.Retention(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, loc := range []struct{ queue, id string }{{"low", "bare"}, {"critical", "scheduled"}} {
+		info, err := inspector.GetTaskInfo(loc.queue, loc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := trash.SoftDelete(ctx, inspector, client, rdb, info); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := inspector.GetTaskInfo(loc.queue, loc.id); !errors.Is(err, asynq.ErrTaskNotFound) {
+			t.Errorf("task %s still in %s (%v)", loc.id, loc.queue, err)
+		}
+	}
+	q, err := inspector.GetQueueInfo(trash.Queue)
+	if err != nil || !q.Paused || q.Pending != 2 {
+		t.Fatalf("trash %+v (%v), want 2 tasks paused", q, err)
+	}
+	trashed, _ := inspector.GetTaskInfo(trash.Queue, "bare")
+	if err := trash.SoftDelete(ctx, inspector, client, rdb, trashed); err == nil {
+		t.Error("trashed task trashed again")
+	}
+
+	restored, err := trash.Restore(ctx, inspector, client, "scheduled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, md := metadata.Unwrap(restored.Payload)
+	if restored.Queue != "critical" || restored.State != asynq.TaskStateScheduled || !restored.NextProcessAt.Equal(processAt) ||
+		restored.MaxRetry != 7 || restored.Timeout != 3*time.Minute || restored.Retention != time.Hour {
+		t.Errorf("restored %+v, want it scheduled in critical at %v with its options", restored, processAt)
+	}
+	if string(payload) != `{"user_id":2}` || md["tenant_id"] != "acme" || md[trash.KeyFrom] != "" || md[trash.KeyAt] != "" {
+		t.Errorf("restored payload %s with metadata %v", payload, md)
+	}
+	if _, err := trash.Restore(ctx, inspector, client, "scheduled"); err == nil {
+		t.Error("task restored twice")
+	}
+
+	const ttl = 24 * time.Hour
+	if n, err := trash.Purge(inspector, ttl, time.Now().Add(ttl-time.Minute)); err != nil || n != 0 {
+		t.Errorf("purge within the TTL removed %d (%v)", n, err)
+	}
+	if n, err := trash.Purge(inspector, ttl, time.Now().Add(ttl+time.Minute)); err != nil || n != 1 {
+		t.Errorf("purge after the TTL removed %d (%v), want 1", n, err)
+	}
+	if left, err := trash.List(inspector); err != nil || len(left) != 0 {
+		t.Errorf("trash holds %d tasks after the purge (%v)", len(left), err)
+	}
+	if _, err := inspector.GetTaskInfo("critical", "scheduled"); err != nil {
+		t.Errorf("purge touched the restored task: %v", err)
+	}
+}
+
+// TestRestoreBare fails unless a task without metadata is restored with its
+// payload unchanged and a scheduled time that passed in the trash makes it
+// pending
+func TestRestoreBare(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	ctx := context.Background()
+
+	if _, err := client.Enqueue(asynq.NewTask("report:generate", []byte(`{"id":3}`)), asynq.TaskID("soon"), asynq.ProcessIn(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := inspector.GetTaskInfo("default", "soon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trash.SoftDelete(ctx, inspector, client, rdb, info); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	restored, err := trash.Restore(ctx, inspector, client, "soon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(restored.Payload) != `{"id":3}` || restored.State != asynq.TaskStatePending || restored.Queue != "default" {
+		t.Errorf("restored %s %s in %s", restored.Payload, restored.State, restored.Queue)
+	}
+}
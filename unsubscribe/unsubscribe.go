@@ -0,0 +1,134 @@
+// Package unsubscribe implements signed unsubscribe links for marketing mail.
+package unsubscribe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"asynqdemo/admin"
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+)
+
+// ErrInvalidToken is returned for tokens that were not issued by this signer
+var ErrInvalidToken = errors.New("invalid unsubscribe token")
+
+type claims struct {
+	Email    string `json:"e"`
+	Category string `json:"c"`
+}
+
+// Signer issues and verifies unsubscribe tokens scoped to a recipient and an
+// email category
+type Signer struct {
+	key []byte
+}
+
+// NewSigner creates a signer with the HMAC key
+func NewSigner(key []byte) (*Signer, error) {
+	if len(key) < 16 {
+		return nil, fmt.Errorf("unsubscribe key must be at least 16 bytes")
+	}
+	return &Signer{key: key}, nil
+}
+
+// Token returns the token unsubscribing email from category
+func (s *Signer) Token(email, category string) string {
+	data, _ := json.Marshal(claims{Email: email, Category: category})
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + base64.RawURLEncoding.EncodeToString(s.sign(body))
+}
+
+// Verify returns the recipient and category a token was issued for
+func (s *Signer) Verify(token string) (email, category string, err error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", ErrInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, s.sign(body)) {
+		return "", "", ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return "", "", ErrInvalidToken
+	}
+	var c claims
+	if err := json.Unmarshal(data, &c); err != nil || c.Email == "" || c.Category == "" {
+		return "", "", ErrInvalidToken
+	}
+	return c.Email, c.Category, nil
+}
+
+func (s *Signer) sign(body string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// URLFunc returns the link builder handed to the email handler through Deps
+func (s *Signer) URLFunc(baseURL string) func(email, category string) string {
+	baseURL = strings.TrimRight(baseURL, "/")
+	return func(email, category string) string {
+		return baseURL + "/unsubscribe/" + s.Token(email, category)
+	}
+}
+
+var confirmation = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Unsubscribed</title></head>
+<body><p>{{.Email}} will no longer receive {{.Category}} emails.</p></body></html>
+`))
+
+// RenderConfirmation writes the page shown after unsubscribing through a link
+func RenderConfirmation(w io.Writer, email, category string) error {
+	return confirmation.Execute(w, map[string]string{"Email": email, "Category": category})
+}
+
+// Handler serves /unsubscribe/{token}. GET is the link in the mail body and
+// POST is the RFC 8058 one-click request; both enqueue the preference change.
+func Handler(s *Signer, client *asynq.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		seg := admin.PathSegments(r, "/unsubscribe/")
+		if len(seg) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+		email, category, err := s.Verify(seg[0])
+		if err != nil {
+			http.Error(w, "This unsubscribe link is not valid.", http.StatusBadRequest)
+			return
+		}
+		payload, err := json.Marshal(common.PreferencesUpdatePayload{Email: email, Category: category, OptedOut: true})
+		if err != nil {
+			http.Error(w, "Something went wrong, please try again.", http.StatusInternalServerError)
+			return
+		}
+		if _, err := client.EnqueueContext(r.Context(), asynq.NewTask(common.TypePreferencesUpdate, payload, asynq.Queue("critical"))); err != nil {
+			log.Printf("❌ Failed to enqueue unsubscribe of %s: %v", email, err)
+			http.Error(w, "Something went wrong, please try again.", http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := RenderConfirmation(w, email, category); err != nil {
+			log.Printf("❌ Failed to render unsubscribe page: %v", err)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package unsubscribe_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"asynqdemo/common"
+	"asynqdemo/embeddedredis"
+	"asynqdemo/unsubscribe"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// recordingMailer keeps the messages it is asked to send
+type recordingMailer struct {
+	sent []common.EmailMessage
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg common.EmailMessage) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func newSigner(t *testing.T, key string) *unsubscribe.Signer {
+	t.Helper()
+	s, err := unsubscribe.NewSigner([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestToken fails unless a token verifies to the recipient and category it
+// was issued for and tampered, foreign and malformed tokens are refused
+func TestToken(t *testing.T) {
+	s := newSigner(t, "0123456789abcdef")
+	token := s.Token("ada@example.com", common.CategoryMarketing)
+	email, category, err := s.Verify(token)
+	if err != nil || email != "ada@example.com" || category != common.CategoryMarketing {
+		t.Fatalf("verified %s %s (%v)", email, category, err)
+	}
+
+	body, sig, _ := strings.Cut(token, ".")
+	_, otherSig, _ := strings.Cut(s.Token("ada@example.com", common.CategoryDigest), ".")
+	otherBody, _, _ := strings.Cut(s.Token("ada@example.com", common.CategoryDigest), ".")
+	for name, bad := range map[string]string{
+		"another category's body": otherBody + "." + sig,
+		"another category's sig":  body + "." + otherSig,
+		"foreign key":             newSigner(t, "fedcba9876543210").Token("ada@example.com", common.CategoryMarketing),
+		"no signature":            body,
+		"empty":                   "",
+		"garbage":                 "!!!.???",
+		"empty claims":            s.Token("", ""),
+	} {
+		if _, _, err := s.Verify(bad); !errors.Is(err, unsubscribe.ErrInvalidToken) {
+			t.Errorf("%s verified: %v", name, err)
+		}
+	}
+	if _, err := unsubscribe.NewSigner([]byte("short")); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+// TestUnsubscribe follows the link of a marketing email and fails unless
+// the page confirms it, a preferences update opting the recipient out of
+// marketing only is enqueued, and once applied marketing mail to them is
+// suppressed while transactional mail is sent. Only marketing mail carries
+// the one-click headers.
+func TestUnsubscribe(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+
+	s := newSigner(t, "0123456789abcdef")
+	mailer := &recordingMailer{}
+	deps := common.DefaultDeps()
+	deps.Mailer = mailer
+	deps.Preferences = common.NewRedisPreferences(rdb)
+	deps.UnsubscribeURL = s.URLFunc("https://mail.example.com/")
+	ctx := common.WithDeps(context.Background(), deps)
+	marketing := &common.EmailPayload{UserID: 7, Email: "ada@example.com", Subject: "Sale", Message: "50% off", Category: common.CategoryMarketing}
+	receipt := &common.EmailPayload{UserID: 7, Email: "ada@example.com", Subject: "Receipt", Message: "Thanks", Category: common.CategoryTransactional}
+
+	if err := common.HandleEmailTask(ctx, marketing); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.HandleEmailTask(ctx, receipt); err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.sent) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(mailer.sent))
+	}
+	link := strings.Trim(mailer.sent[0].Headers["List-Unsubscribe"], "<>")
+	if !strings.HasPrefix(link, "https://mail.example.com/unsubscribe/") || !strings.Contains(mailer.sent[0].Body, "Unsubscribe: "+link) ||
+		mailer.sent[0].Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Errorf("marketing mail %+v lacks the unsubscribe link and headers", mailer.sent[0])
+	}
+	if len(mailer.sent[1].Headers) != 0 || strings.Contains(mailer.sent[1].Body, "Unsubscribe") {
+		t.Errorf("transactional mail %+v has unsubscribe headers", mailer.sent[1])
+	}
+
+	api := httptest.NewServer(unsubscribe.Handler(s, client))
+	defer api.Close()
+	path := strings.TrimPrefix(link, "https://mail.example.com")
+	resp, err := http.Get(api.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "ada@example.com will no longer receive marketing emails") {
+		t.Errorf("GET gave %d %s", resp.StatusCode, page)
+	}
+	resp, err = http.Post(api.URL+path, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("one-click POST gave %d", resp.StatusCode)
+	}
+	for method, want := range map[string]int{
+		"GET /unsubscribe/" + s.Token("ada@example.com", "marketing") + "x": http.StatusBadRequest,
+		"DELETE " + path: http.StatusMethodNotAllowed,
+	} {
+		m, p, _ := strings.Cut(method, " ")
+		req, _ := http.NewRequest(m, api.URL+p, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s gave %d, want %d", method, resp.StatusCode, want)
+		}
+	}
+
+	tasks, err := inspector.ListPendingTasks("critical")
+	if err != nil || len(tasks) != 2 {
+		t.Fatalf("%d preference updates enqueued (%v), want one per request", len(tasks), err)
+	}
+	var update common.PreferencesUpdatePayload
+	if err := json.Unmarshal(tasks[0].Payload, &update); err != nil || tasks[0].Type != common.TypePreferencesUpdate {
+		t.Fatalf("enqueued %s %s", tasks[0].Type, tasks[0].Payload)
+	}
+	if update != (common.PreferencesUpdatePayload{Email: "ada@example.com", Category: common.CategoryMarketing, OptedOut: true}) {
+		t.Errorf("update %+v", update)
+	}
+	if err := common.HandlePreferencesUpdateTask(ctx, &update); err != nil {
+		t.Fatal(err)
+	}
+
+	mailer.sent = nil
+	for _, p := range []*common.EmailPayload{marketing, receipt} {
+		if err := common.HandleEmailTask(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].Subject != "Receipt" {
+		t.Errorf("after unsubscribing sent %+v, want only the receipt", mailer.sent)
+	}
+}
@@ -0,0 +1,184 @@
+// Package validation checks task payloads before their handlers run.
+package validation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+
+	"asynqdemo/common"
+	"asynqdemo/middleware"
+	"asynqdemo/quarantine"
+
+	"github.com/hibiken/asynq"
+)
+
+// ErrInvalidPayload describes the first problem found in a payload. It wraps
+// asynq.SkipRetry since the same payload would fail again.
+type ErrInvalidPayload struct {
+	TaskType string
+	Field    string
+	Reason   string
+}
+
+func (e ErrInvalidPayload) Error() string {
+	return fmt.Sprintf("invalid %s payload: %s %s", e.TaskType, e.Field, e.Reason)
+}
+
+func (e ErrInvalidPayload) Unwrap() error {
+	return asynq.SkipRetry
+}
+
+// PayloadValidator checks a raw task payload
+type PayloadValidator interface {
+	Validate(payload []byte) error
+}
+
+// ValidatorFunc adapts a function to PayloadValidator
+type ValidatorFunc func(payload []byte) error
+
+// Validate calls f(payload)
+func (f ValidatorFunc) Validate(payload []byte) error {
+	return f(payload)
+}
+
+// ValidatorRegistry maps task types to their validators
+type ValidatorRegistry struct {
+	validators map[string]PayloadValidator
+}
+
+// NewValidatorRegistry creates an empty registry
+func NewValidatorRegistry() *ValidatorRegistry {
+	return &ValidatorRegistry{validators: make(map[string]PayloadValidator)}
+}
+
+// DefaultRegistry returns a registry with the validators of the built-in task types
+func DefaultRegistry() *ValidatorRegistry {
+	reg := NewValidatorRegistry()
+	reg.Register(common.TypeWelcomeMessage, ValidatorFunc(validateWelcome))
+	reg.Register(common.TypeEmailTask, ValidatorFunc(validateEmail))
+	reg.Register(common.TypeServerInfo, ValidatorFunc(validateServerInfo))
+	reg.Register(common.TypePreferencesUpdate, ValidatorFunc(validatePreferencesUpdate))
+	return reg
+}
+
+// Register sets the validator of a task type
+func (r *ValidatorRegistry) Register(taskType string, v PayloadValidator) {
+	r.validators[taskType] = v
+}
+
+// Validate checks payload with the validator of taskType; types without one pass
+func (r *ValidatorRegistry) Validate(taskType string, payload []byte) error {
+	v, ok := r.validators[taskType]
+	if !ok {
+		return nil
+	}
+	if err := v.Validate(payload); err != nil {
+		if invalid, ok := err.(ErrInvalidPayload); ok && invalid.TaskType == "" {
+			invalid.TaskType = taskType
+			return invalid
+		}
+		if decode, ok := err.(quarantine.ErrDecode); ok && decode.TaskType == "" {
+			decode.TaskType = taskType
+			return decode
+		}
+		return err
+	}
+	return nil
+}
+
+// ValidationMiddleware rejects tasks whose payload fails validation. Install
+// it after metadata.Middleware so validators see the plain payload.
+func ValidationMiddleware(reg *ValidatorRegistry) middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			if err := reg.Validate(t.Type(), t.Payload()); err != nil {
+				return err
+			}
+			return next.ProcessTask(ctx, t)
+		})
+	}
+}
+
+func required(field string) ErrInvalidPayload {
+	return ErrInvalidPayload{Field: field, Reason: "required"}
+}
+
+func decode(payload []byte, v interface{}) error {
+	if err := json.Unmarshal(payload, v); err != nil {
+		return quarantine.ErrDecode{Encoding: quarantine.EncodingJSON, Err: err}
+	}
+	return nil
+}
+
+func validateWelcome(payload []byte) error {
+	var p common.WelcomePayload
+	if err := decode(payload, &p); err != nil {
+		return err
+	}
+	switch {
+	case p.UserID == 0:
+		return required("user_id")
+	case p.Username == "":
+		return required("username")
+	}
+	return nil
+}
+
+func validateEmail(payload []byte) error {
+	var p common.EmailPayload
+	if err := decode(payload, &p); err != nil {
+		return err
+	}
+	switch {
+	case p.UserID == 0:
+		return required("user_id")
+	case p.Email == "":
+		return required("email")
+	case p.Subject == "":
+		return required("subject")
+	}
+	if _, err := mail.ParseAddress(p.Email); err != nil {
+		return ErrInvalidPayload{Field: "email", Reason: "is not a valid address"}
+	}
+	return validateCategory(p.Category, true)
+}
+
+func validateCategory(category string, optional bool) error {
+	switch category {
+	case common.CategoryMarketing, common.CategoryTransactional, common.CategoryDigest, common.CategorySecurity, common.CategoryWelcome:
+		return nil
+	case "":
+		if optional {
+			return nil
+		}
+		return required("category")
+	}
+	return ErrInvalidPayload{Field: "category", Reason: fmt.Sprintf("%q is not a known category", category)}
+}
+
+func validateServerInfo(payload []byte) error {
+	var p common.ServerInfoPayload
+	if err := decode(payload, &p); err != nil {
+		return err
+	}
+	switch {
+	case p.Timestamp == 0:
+		return required("timestamp")
+	case p.Source == "":
+		return required("source")
+	}
+	return nil
+}
+
+func validatePreferencesUpdate(payload []byte) error {
+	var p common.PreferencesUpdatePayload
+	if err := decode(payload, &p); err != nil {
+		return err
+	}
+	if p.Email == "" {
+		return required("email")
+	}
+	return validateCategory(p.Category, false)
+}
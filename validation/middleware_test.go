@@ -0,0 +1,71 @@
+package validation_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"asynqdemo/common"
+	"asynqdemo/quarantine"
+	"asynqdemo/validation"
+
+	"github.com/hibiken/asynq"
+)
+
+// TestValidationMiddleware runs the payload {} of every built-in task type
+// and other invalid payloads through the middleware and fails unless each
+// is refused without a retry, naming the field at fault, before its
+// handler runs, while valid payloads and unregistered types pass
+func TestValidationMiddleware(t *testing.T) {
+	ran := 0
+	h := validation.ValidationMiddleware(validation.DefaultRegistry())(asynq.HandlerFunc(func(context.Context, *asynq.Task) error {
+		ran++
+		return nil
+	}))
+	for _, c := range []struct {
+		taskType, payload, want string
+	}{
+		{common.TypeWelcomeMessage, `{}`, "user_id required"},
+		{common.TypeEmailTask, `{}`, "user_id required"},
+		{common.TypeServerInfo, `{}`, "timestamp required"},
+		{common.TypePreferencesUpdate, `{}`, "email required"},
+		{common.TypeWelcomeMessage, `{"user_id":7}`, "username required"},
+		{common.TypeEmailTask, `{"user_id":7,"email":"ada@example.com"}`, "subject required"},
+		{common.TypeEmailTask, `{"user_id":7,"email":"not an address","subject":"Hi"}`, "email is not a valid address"},
+		{common.TypeEmailTask, `{"user_id":7,"email":"ada@example.com","subject":"Hi","category":"spam"}`, `category "spam" is not a known category`},
+		{common.TypeServerInfo, `{"timestamp":1}`, "source required"},
+		{common.TypePreferencesUpdate, `{"email":"ada@example.com"}`, "category required"},
+	} {
+		err := h.ProcessTask(context.Background(), asynq.NewTask(c.taskType, []byte(c.payload)))
+		var invalid validation.ErrInvalidPayload
+		if !errors.As(err, &invalid) || invalid.TaskType != c.taskType || !strings.HasSuffix(err.Error(), c.want) {
+			t.Errorf("%s %s: %v, want %q", c.taskType, c.payload, err, c.want)
+		}
+		if !errors.Is(err, asynq.SkipRetry) {
+			t.Errorf("%s %s is retried", c.taskType, c.payload)
+		}
+	}
+	if ran != 0 {
+		t.Errorf("handler ran for %d invalid payloads", ran)
+	}
+
+	err := h.ProcessTask(context.Background(), asynq.NewTask(common.TypeEmailTask, []byte(`{"user_id":`)))
+	var decode quarantine.ErrDecode
+	if !errors.As(err, &decode) || decode.TaskType != common.TypeEmailTask {
+		t.Errorf("malformed JSON gave %v, want a decode error", err)
+	}
+
+	for _, task := range []*asynq.Task{
+		asynq.NewTask(common.TypeEmailTask, []byte(`{"user_id":7,"email":"ada@example.com","subject":"Hi","category":"digest"}`)),
+		asynq.NewTask(common.TypeWelcomeMessage, []byte(`{"user_id":7,"username":"ada"}`)),
+		asynq.NewTask("report:daily", []byte(`{}`)),
+	} {
+		if err := h.ProcessTask(context.Background(), task); err != nil {
+			t.Errorf("%s %s refused: %v", task.Type(), task.Payload(), err)
+		}
+	}
+	if ran != 3 {
+		t.Errorf("handler ran %d times for 3 valid tasks", ran)
+	}
+}
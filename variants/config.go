@@ -0,0 +1,111 @@
+package variants
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StableName is the stable variant of a type whose config names none
+const StableName = "stable"
+
+// DefaultRollbackWindow is the window of a Rollback that sets none
+const DefaultRollbackWindow = 10 * time.Minute
+
+// maxRollbackWindow is how long the router keeps task outcomes
+const maxRollbackWindow = time.Hour
+
+// Rollback sets the weight of a variant to zero when its error rate over
+// Window exceeds the stable variant's by more than Margin, e.g. 0.05 for
+// five percentage points. Both variants need MinSamples tasks in the
+// window.
+type Rollback struct {
+	Margin     float64       `yaml:"margin"`
+	Window     time.Duration `yaml:"window"`
+	MinSamples int           `yaml:"min_samples"`
+}
+
+// Config splits the tasks of a type between its variants by weight. Stable
+// is served by the handler the type is registered with on the mux, the
+// other variants by the handlers registered with the router.
+type Config struct {
+	Stable   string         `yaml:"stable"`
+	Weights  map[string]int `yaml:"weights"`
+	Rollback *Rollback      `yaml:"rollback"`
+}
+
+// File is a YAML file mapping task types to their Config, e.g.
+//
+//	email:send:
+//	  weights: {stable: 95, v2: 5}
+//	  rollback: {margin: 0.05, window: 10m}
+type File string
+
+// Load reads and checks the file
+func (path File) Load() (map[string]Config, error) {
+	data, err := os.ReadFile(string(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handler variants: %v", err)
+	}
+	configs := map[string]Config{}
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&configs); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse handler variants %s: %v", path, err)
+	}
+	for taskType, c := range configs {
+		if c.Stable == "" {
+			c.Stable = StableName
+		}
+		if err := c.check(); err != nil {
+			return nil, fmt.Errorf("handler variants of %s in %s: %v", taskType, path, err)
+		}
+		if c.Rollback != nil {
+			r := *c.Rollback
+			if r.Window == 0 {
+				r.Window = DefaultRollbackWindow
+			}
+			if r.MinSamples == 0 {
+				r.MinSamples = 20
+			}
+			c.Rollback = &r
+		}
+		configs[taskType] = c
+	}
+	return configs, nil
+}
+
+func (c Config) check() error {
+	if _, ok := c.Weights[c.Stable]; !ok {
+		return fmt.Errorf("stable variant %s has no weight", c.Stable)
+	}
+	total := 0
+	for name, w := range c.Weights {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid variant name %q", name)
+		}
+		if w < 0 {
+			return fmt.Errorf("variant %s has a negative weight", name)
+		}
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("every variant has weight 0")
+	}
+	if r := c.Rollback; r != nil {
+		switch {
+		case r.Margin <= 0 || r.Margin >= 1:
+			return fmt.Errorf("rollback margin must be between 0 and 1, got %v", r.Margin)
+		case r.Window < 0 || r.Window > maxRollbackWindow:
+			return fmt.Errorf("rollback window must be at most %v", maxRollbackWindow)
+		case r.MinSamples < 0:
+			return fmt.Errorf("rollback min_samples must not be negative")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+// Package variants rolls out new implementations of a task handler
+// progressively: the tasks of a type are split between named variants by
+// the weights of a config file, each task ID always going to the same
+// variant so retries stay with it. A variant failing more often than the
+// stable one by its rollback margin is set to weight zero fleet-wide.
+package variants
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"asynqdemo/metrics"
+	"asynqdemo/middleware"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// rolledBackKey maps "type/variant" to the rollbackRecord of variants
+	// rolled back
+	rolledBackKey = "variants:rolled-back"
+	// buckets is the resolution of the split; a variant's share of tasks
+	// is its share of the buckets
+	buckets = 10000
+)
+
+// rollbackRecord is a rollback shared through Redis. It holds while the
+// configured weight of the variant is still Weight; changing the weight in
+// the file lifts it.
+type rollbackRecord struct {
+	Weight int       `json:"weight"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+type variantKey struct{}
+
+// Variant returns the variant a task is processed by, "" when its type
+// has no variants
+func Variant(ctx context.Context) string {
+	v, _ := ctx.Value(variantKey{}).(string)
+	return v
+}
+
+// Router is the middleware routing tasks to their variant. The configs are
+// read from the file at every Sync, so weight changes apply without a
+// restart.
+type Router struct {
+	rdb   redis.UniversalClient
+	file  File
+	rates *metrics.ErrorRates
+	// isFailure tells failures from errors that only defer the task
+	isFailure func(error) bool
+	// Alert reports rollbacks; nil only logs
+	Alert func(ctx context.Context, text string) error
+	// Interval is how often Run rereads the file and checks the rollbacks
+	Interval time.Duration
+
+	tasks  *prometheus.CounterVec
+	weight *prometheus.GaugeVec
+
+	mu         sync.RWMutex
+	impls      map[string]map[string]asynq.Handler
+	configs    map[string]Config
+	rolledBack map[string]map[string]bool
+}
+
+// NewRouter creates a router of the variants in file. Errors for which
+// isFailure reports false, like asynq's Config.IsFailure, count as
+// neither success nor failure; nil counts every error.
+func NewRouter(rdb redis.UniversalClient, file File, isFailure func(error) bool, reg prometheus.Registerer) (*Router, error) {
+	if isFailure == nil {
+		isFailure = func(error) bool { return true }
+	}
+	r := &Router{
+		rdb:       rdb,
+		file:      file,
+		rates:     metrics.NewErrorRates(10*time.Second, maxRollbackWindow, isFailure),
+		isFailure: isFailure,
+		Interval:  10 * time.Second,
+		tasks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "asynq_handler_variant_tasks_total",
+			Help: "Tasks processed by each handler variant, by outcome.",
+		}, []string{"type", "variant", "status"}),
+		weight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "asynq_handler_variant_weight",
+			Help: "Effective weight of each handler variant, zero once rolled back.",
+		}, []string{"type", "variant"}),
+		impls: make(map[string]map[string]asynq.Handler),
+	}
+	for _, c := range []prometheus.Collector{r.tasks, r.weight} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register handler variant metrics: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// Register adds the implementation of a variant of taskType; register
+// every variant before the first Sync
+func (r *Router) Register(taskType, variant string, h asynq.Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.impls[taskType] == nil {
+		r.impls[taskType] = make(map[string]asynq.Handler)
+	}
+	r.impls[taskType][variant] = h
+}
+
+// Sync rereads the file and the rollbacks in Redis. A config naming a
+// variant without implementation is refused, keeping the previous one.
+func (r *Router) Sync(ctx context.Context) error {
+	configs, err := r.file.Load()
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	for taskType, c := range configs {
+		for name := range c.Weights {
+			if name != c.Stable && r.impls[taskType][name] == nil {
+				r.mu.RUnlock()
+				return fmt.Errorf("handler variant %s of %s in %s has no implementation", name, taskType, r.file)
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	records, err := r.rdb.HGetAll(ctx, rolledBackKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read handler variant rollbacks: %v", err)
+	}
+	rolledBack := make(map[string]map[string]bool)
+	for field, data := range records {
+		taskType, name, _ := strings.Cut(field, "/")
+		var rec rollbackRecord
+		if json.Unmarshal([]byte(data), &rec) == nil && configs[taskType].Weights[name] == rec.Weight {
+			if rolledBack[taskType] == nil {
+				rolledBack[taskType] = make(map[string]bool)
+			}
+			rolledBack[taskType][name] = true
+			continue
+		}
+		if err := r.rdb.HDel(ctx, rolledBackKey, field).Err(); err != nil {
+			return fmt.Errorf("failed to lift rollback of %s: %v", field, err)
+		}
+		log.Printf("✅ Rollback of handler variant %s lifted, its weight changed", field)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for taskType, c := range configs {
+		if !reflect.DeepEqual(r.configs[taskType], c) {
+			fmt.Printf("🧪 Handler variants of %s: %v\n", taskType, c.Weights)
+		}
+	}
+	r.configs, r.rolledBack = configs, rolledBack
+	r.weight.Reset()
+	for taskType, c := range configs {
+		for name, w := range c.Weights {
+			if rolledBack[taskType][name] {
+				w = 0
+			}
+			r.weight.WithLabelValues(taskType, name).Set(float64(w))
+		}
+	}
+	return nil
+}
+
+// Assign returns the variant of the task with the given ID, "" when its
+// type has no variants. The same ID always gets the same variant for the
+// same weights, and raising the weight of a variant other than the stable
+// one only moves tasks to it.
+func (r *Router) Assign(taskType, id string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.configs[taskType]
+	if !ok {
+		return ""
+	}
+	// The other variants take the first buckets and stable the rest
+	names := make([]string, 0, len(c.Weights))
+	for name := range c.Weights {
+		if name != c.Stable {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append(names, c.Stable)
+	weights := make([]int64, len(names))
+	var total int64
+	for i, name := range names {
+		if !r.rolledBack[taskType][name] {
+			weights[i] = int64(c.Weights[name])
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return c.Stable
+	}
+	h := fnv.New32a()
+	h.Write([]byte(taskType + "/" + id))
+	point := int64(h.Sum32()%buckets) * total / buckets
+	for i, name := range names {
+		if point < weights[i] {
+			return name
+		}
+		point -= weights[i]
+	}
+	return c.Stable
+}
+
+// Middleware processes the tasks of types with variants by the variant
+// their ID is assigned, counting the outcome by variant
+func (r *Router) Middleware() middleware.HandlerMiddleware {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			id, ok := asynq.GetTaskID(ctx)
+			if !ok {
+				return next.ProcessTask(ctx, t)
+			}
+			variant := r.Assign(t.Type(), id)
+			if variant == "" {
+				return next.ProcessTask(ctx, t)
+			}
+			h := next
+			r.mu.RLock()
+			if impl := r.impls[t.Type()][variant]; impl != nil && variant != r.configs[t.Type()].Stable {
+				h = impl
+			}
+			r.mu.RUnlock()
+
+			err := h.ProcessTask(context.WithValue(ctx, variantKey{}, variant), t)
+			r.rates.Record(t.Type()+"/"+variant, err, time.Now())
+			status := "success"
+			switch {
+			case err == nil:
+			case r.isFailure(err):
+				status = "failure"
+				log.Printf("⚠️  Task %s of %s failed in handler variant %s: %v", id, t.Type(), variant, err)
+			default:
+				status = "deferred"
+			}
+			r.tasks.WithLabelValues(t.Type(), variant, status).Inc()
+			return err
+		})
+	}
+}
+
+// Check compares the error rate of every variant with its stable
+// variant's at now and rolls back those over the margin
+func (r *Router) Check(ctx context.Context, now time.Time) error {
+	type candidate struct {
+		taskType, name string
+		weight         int
+		reason         string
+	}
+	var over []candidate
+	r.mu.RLock()
+	for taskType, c := range r.configs {
+		rb := c.Rollback
+		if rb == nil {
+			continue
+		}
+		stableRate, stableSamples := r.rates.Rate(taskType+"/"+c.Stable, rb.Window, now)
+		if stableSamples < rb.MinSamples {
+			continue
+		}
+		for name, w := range c.Weights {
+			if name == c.Stable || w == 0 || r.rolledBack[taskType][name] {
+				continue
+			}
+			rate, samples := r.rates.Rate(taskType+"/"+name, rb.Window, now)
+			if samples < rb.MinSamples || rate-stableRate <= rb.Margin {
+				continue
+			}
+			reason := fmt.Sprintf("%.1f%% of %d tasks failed over %v, against %.1f%% of %d in %s", rate*100, samples, rb.Window, stableRate*100, stableSamples, c.Stable)
+			over = append(over, candidate{taskType, name, w, reason})
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, o := range over {
+		if err := r.rollback(ctx, o.taskType, o.name, o.weight, o.reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback sets the variant's weight to zero on every worker; the worker
+// that records it first alerts
+func (r *Router) rollback(ctx context.Context, taskType, name string, weight int, reason string) error {
+	data, err := json.Marshal(rollbackRecord{Weight: weight, Reason: reason, At: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal rollback: %v", err)
+	}
+	first, err := r.rdb.HSetNX(ctx, rolledBackKey, taskType+"/"+name, data).Result()
+	if err != nil {
+		return fmt.Errorf("failed to roll back handler variant %s of %s: %v", name, taskType, err)
+	}
+	r.mu.Lock()
+	if r.rolledBack[taskType] == nil {
+		r.rolledBack[taskType] = make(map[string]bool)
+	}
+	r.rolledBack[taskType][name] = true
+	r.weight.WithLabelValues(taskType, name).Set(0)
+	r.mu.Unlock()
+	if !first {
+		return nil
+	}
+	text := fmt.Sprintf("Handler variant %s of %s rolled back to weight 0: %s. Change its weight in %s to lift the rollback.", name, taskType, reason, r.file)
+	log.Printf("⏪ %s", text)
+	if r.Alert != nil {
+		if err := r.Alert(ctx, text); err != nil {
+			log.Printf("❌ Failed to alert about the rollback: %v", err)
+		}
+	}
+	return nil
+}
+
+// Run rereads the file and checks the rollbacks every Interval until ctx
+// is done
+func (r *Router) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := r.Sync(ctx); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		if err := r.Check(ctx, time.Now()); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package variants_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/variants"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestHandlerVariants routes tasks between a stable handler and a new
+// variant through a worker on an embedded Redis. It fails unless every
+// task ID keeps its variant across calls and routers, the variant gets
+// about its weight's share of tasks and keeps them when its weight is
+// raised, a variant failing more than the stable one by the margin is
+// rolled back on every router with one alert, and changing its weight in
+// the file lifts the rollback.
+func TestHandlerVariants(t *testing.T) {
+	const taskType = "variants:test"
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "variants.yaml")
+	write := func(v2 int) {
+		t.Helper()
+		config := fmt.Sprintf("%s:\n  weights: {stable: %d, v2: %d}\n  rollback: {margin: 0.2, window: 1m, min_samples: 30}\n", taskType, 100-v2, v2)
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(5)
+
+	var stableCalls, v2Calls, mislabeled atomic.Int32
+	var alerts []string
+	newRouter := func() *variants.Router {
+		t.Helper()
+		r, err := variants.NewRouter(rdb, variants.File(path), nil, prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Alert = func(ctx context.Context, text string) error {
+			alerts = append(alerts, text)
+			return nil
+		}
+		if err := r.Sync(ctx); err == nil {
+			t.Fatal("config with a variant without implementation was accepted")
+		}
+		r.Register(taskType, "v2", asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			v2Calls.Add(1)
+			if variants.Variant(ctx) != "v2" {
+				mislabeled.Add(1)
+			}
+			return fmt.Errorf("v2 is broken")
+		}))
+		if err := r.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	router, other := newRouter(), newRouter()
+
+	const ids = 20000
+	assigned := make([]string, ids)
+	share, v2ID := 0, ""
+	for i := range assigned {
+		id := fmt.Sprintf("task-%d", i)
+		assigned[i] = router.Assign(taskType, id)
+		if again, elsewhere := router.Assign(taskType, id), other.Assign(taskType, id); again != assigned[i] || elsewhere != assigned[i] {
+			t.Fatalf("task %s got %s, then %s and %s on another router", id, assigned[i], again, elsewhere)
+		}
+		if assigned[i] == "v2" {
+			share, v2ID = share+1, id
+		}
+	}
+	if share < ids*4/100 || share > ids*6/100 {
+		t.Errorf("v2 got %d of %d tasks at weight 5%%", share, ids)
+	}
+	if router.Assign("other:type", "task-1") != "" {
+		t.Error("type without variants was assigned one")
+	}
+	write(10)
+	if err := router.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, variant := range assigned {
+		if variant == "v2" && router.Assign(taskType, fmt.Sprintf("task-%d", i)) != "v2" {
+			t.Fatalf("task-%d left v2 when its weight was raised", i)
+		}
+	}
+
+	const tasks = 600
+	wantV2 := int32(0)
+	for i := 0; i < tasks; i++ {
+		if router.Assign(taskType, fmt.Sprintf("task-%d", i)) == "v2" {
+			wantV2++
+		}
+	}
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{Concurrency: 10, Queues: map[string]int{"default": 1}})
+	mux := asynq.NewServeMux()
+	mux.Use(router.Middleware())
+	mux.HandleFunc(taskType, func(ctx context.Context, task *asynq.Task) error {
+		stableCalls.Add(1)
+		if variants.Variant(ctx) != "stable" {
+			mislabeled.Add(1)
+		}
+		return nil
+	})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	for i := 0; i < tasks; i++ {
+		if _, err := client.Enqueue(asynq.NewTask(taskType, nil), asynq.TaskID(fmt.Sprintf("task-%d", i)), asynq.MaxRetry(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for stableCalls.Load()+v2Calls.Load() < tasks {
+		if time.Now().After(deadline) {
+			t.Fatalf("processed %d of %d tasks", stableCalls.Load()+v2Calls.Load(), tasks)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if mislabeled.Load() > 0 {
+		t.Errorf("%d tasks saw another variant in their context", mislabeled.Load())
+	}
+	if v2Calls.Load() != wantV2 {
+		t.Errorf("v2 processed %d tasks, want the %d assigned to it", v2Calls.Load(), wantV2)
+	}
+
+	if err := router.Check(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("rollback sent %d alerts, want 1: %v", len(alerts), alerts)
+	}
+	if err := other.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < ids; i++ {
+		id := fmt.Sprintf("task-%d", i)
+		if router.Assign(taskType, id) == "v2" || other.Assign(taskType, id) == "v2" {
+			t.Fatalf("%s still goes to v2 after its rollback", id)
+		}
+	}
+
+	write(20)
+	if err := other.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if router.Assign(taskType, v2ID) != "v2" || other.Assign(taskType, v2ID) != "v2" {
+		t.Error("rollback was not lifted when the weight changed")
+	}
+}
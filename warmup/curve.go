@@ -0,0 +1,86 @@
+// Package warmup ramps worker concurrency up after startup.
+package warmup
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"asynqdemo/concurrency"
+)
+
+// CurveFunc maps the elapsed fraction of the warmup in [0,1] to the fraction
+// of the concurrency increase applied, also in [0,1]
+type CurveFunc func(t float64) float64
+
+// Linear raises concurrency at a constant rate
+func Linear(t float64) float64 {
+	return t
+}
+
+// Exponential starts slowly and speeds up towards the end
+func Exponential(t float64) float64 {
+	const k = 5
+	return (math.Exp(k*t) - 1) / (math.Exp(k) - 1)
+}
+
+// SCurve starts and ends slowly
+func SCurve(t float64) float64 {
+	return t * t * (3 - 2*t)
+}
+
+// WarmupCurve describes a ramp from initial to target concurrency
+type WarmupCurve struct {
+	initial, target int
+	duration        time.Duration
+	fn              CurveFunc
+}
+
+// NewWarmupCurve creates a curve ramping from initial to target over duration
+func NewWarmupCurve(initial, target int, duration time.Duration, fn CurveFunc) (WarmupCurve, error) {
+	if initial < 1 || target < initial {
+		return WarmupCurve{}, fmt.Errorf("invalid warmup from %d to %d", initial, target)
+	}
+	if duration <= 0 {
+		return WarmupCurve{}, fmt.Errorf("warmup duration must be positive")
+	}
+	if fn == nil {
+		fn = Linear
+	}
+	return WarmupCurve{initial: initial, target: target, duration: duration, fn: fn}, nil
+}
+
+// At returns the concurrency the curve gives after elapsed time
+func (c WarmupCurve) At(elapsed time.Duration) int {
+	t := math.Min(1, math.Max(0, float64(elapsed)/float64(c.duration)))
+	f := math.Min(1, math.Max(0, c.fn(t)))
+	return c.initial + int(math.Round(float64(c.target-c.initial)*f))
+}
+
+// ApplyWarmup steps the concurrency of s along curve in 100 steps. It returns
+// once the target is reached, or with ctx's error if ctx ends first.
+func ApplyWarmup(ctx context.Context, s concurrency.Setter, curve WarmupCurve) error {
+	step := curve.duration / 100
+	ticker := time.NewTicker(step)
+	defer ticker.Stop()
+
+	start := time.Now()
+	s.SetConcurrency(curve.initial)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		elapsed := time.Since(start)
+		n := curve.At(elapsed)
+		if n != s.Concurrency() {
+			s.SetConcurrency(n)
+		}
+		if elapsed >= curve.duration {
+			s.SetConcurrency(curve.target)
+			return nil
+		}
+	}
+}
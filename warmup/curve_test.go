@@ -0,0 +1,96 @@
+package warmup_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/warmup"
+)
+
+// recordingSetter keeps the concurrency it is set to, whether it ever went
+// down and when it reached 10
+type recordingSetter struct {
+	mu       sync.Mutex
+	n        int
+	wentDown bool
+	reached  time.Time
+}
+
+func (s *recordingSetter) SetConcurrency(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < s.n {
+		s.wentDown = true
+	}
+	s.n = n
+	if n == 10 && s.reached.IsZero() {
+		s.reached = time.Now()
+	}
+}
+
+func (s *recordingSetter) Concurrency() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// TestApplyWarmup ramps linearly from 1 to 10 workers over a second and
+// fails unless concurrency only rises and reaches 10 within 1.1s
+func TestApplyWarmup(t *testing.T) {
+	curve, err := warmup.NewWarmupCurve(1, 10, time.Second, warmup.Linear)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &recordingSetter{}
+	start := time.Now()
+	if err := warmup.ApplyWarmup(context.Background(), s, curve); err != nil {
+		t.Fatal(err)
+	}
+	if s.reached.IsZero() || s.reached.Sub(start) > 1100*time.Millisecond {
+		t.Errorf("reached 10 after %v, want within 1.1s", s.reached.Sub(start))
+	}
+	if s.wentDown || s.Concurrency() != 10 {
+		t.Errorf("concurrency ended at %d or went down on the way", s.Concurrency())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := warmup.ApplyWarmup(ctx, &recordingSetter{}, curve); err != context.Canceled {
+		t.Errorf("cancelled warmup gave %v", err)
+	}
+}
+
+// TestCurves fails unless every curve starts at the initial concurrency,
+// ends at the target and never goes down, and the exponential curve is
+// behind and the linear one at the middle halfway through
+func TestCurves(t *testing.T) {
+	for name, fn := range map[string]warmup.CurveFunc{"linear": warmup.Linear, "exponential": warmup.Exponential, "s-curve": warmup.SCurve} {
+		curve, err := warmup.NewWarmupCurve(1, 101, 100*time.Second, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev := 0
+		for s := 0; s <= 100; s++ {
+			n := curve.At(time.Duration(s) * time.Second)
+			if n < prev {
+				t.Errorf("%s went down from %d to %d at %ds", name, prev, n, s)
+			}
+			prev = n
+		}
+		if curve.At(0) != 1 || curve.At(100*time.Second) != 101 || curve.At(time.Hour) != 101 {
+			t.Errorf("%s runs from %d to %d", name, curve.At(0), curve.At(time.Hour))
+		}
+	}
+	linear, _ := warmup.NewWarmupCurve(1, 101, 100*time.Second, warmup.Linear)
+	exp, _ := warmup.NewWarmupCurve(1, 101, 100*time.Second, warmup.Exponential)
+	if linear.At(50*time.Second) != 51 || exp.At(50*time.Second) >= 20 {
+		t.Errorf("halfway linear gives %d and exponential %d", linear.At(50*time.Second), exp.At(50*time.Second))
+	}
+	for _, c := range []struct{ initial, target int }{{0, 10}, {10, 5}} {
+		if _, err := warmup.NewWarmupCurve(c.initial, c.target, time.Second, nil); err == nil {
+			t.Errorf("warmup from %d to %d accepted", c.initial, c.target)
+		}
+	}
+}
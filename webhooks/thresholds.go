@@ -0,0 +1,200 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// StateKey is the hash holding the threshold state of every queue, shared
+// by all workers so each crossing is notified once
+const StateKey = "webhooks:thresholds"
+
+// DefaultHold is how long a queue must stay on the other side of its
+// threshold before the crossing is notified
+const DefaultHold = time.Minute
+
+// AllQueues in a threshold config applies to queues not listed by name
+const AllQueues = "*"
+
+// Thresholds maps queues to the pending count at which they are breached
+type Thresholds map[string]int
+
+// ParseThresholds parses "queue=count" pairs, e.g. "critical=50,*=1000"
+func ParseThresholds(s string) (Thresholds, error) {
+	th := make(Thresholds)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		q, count, ok := strings.Cut(part, "=")
+		if !ok || q == "" {
+			return nil, fmt.Errorf("invalid threshold %q, want queue=count", part)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid count in threshold %q", part)
+		}
+		th[q] = n
+	}
+	return th, nil
+}
+
+// For returns the threshold of queue q, zero when it has none
+func (th Thresholds) For(q string) int {
+	if n, ok := th[q]; ok {
+		return n
+	}
+	return th[AllQueues]
+}
+
+// ThresholdsFromEnv returns QUEUE_THRESHOLDS and QUEUE_THRESHOLD_HOLD; the
+// thresholds are empty when QUEUE_THRESHOLDS is unset
+func ThresholdsFromEnv() (Thresholds, time.Duration, error) {
+	th, err := ParseThresholds(os.Getenv("QUEUE_THRESHOLDS"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid QUEUE_THRESHOLDS: %v", err)
+	}
+	hold := DefaultHold
+	if v := os.Getenv("QUEUE_THRESHOLD_HOLD"); v != "" {
+		if hold, err = time.ParseDuration(v); err != nil {
+			return nil, 0, fmt.Errorf("invalid QUEUE_THRESHOLD_HOLD %q: %v", v, err)
+		}
+	}
+	return th, hold, nil
+}
+
+// transitionScript moves a queue to the state in ARGV[2] once it has been
+// seen there for ARGV[4] seconds, returning 1 only to the caller making the
+// move. Seeing the current state again resets the hold.
+var transitionScript = redis.NewScript(`
+local state = redis.call('HGET', KEYS[1], ARGV[1]) or 'ok'
+local since = ARGV[1] .. ':since'
+if state == ARGV[2] then
+	redis.call('HDEL', KEYS[1], since)
+	return 0
+end
+local first = tonumber(redis.call('HGET', KEYS[1], since))
+if not first then
+	first = tonumber(ARGV[3])
+	redis.call('HSET', KEYS[1], since, first)
+end
+if tonumber(ARGV[3]) - first < tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('HDEL', KEYS[1], since)
+return 1
+`)
+
+// Watcher compares the pending count of queues with their thresholds and
+// notifies when a queue is breached and when it recovers
+type Watcher struct {
+	inspector  *asynq.Inspector
+	rdb        redis.UniversalClient
+	thresholds Thresholds
+	notify     func(ctx context.Context, e Event) error
+
+	// Hold debounces flapping: a crossing is notified once the queue stayed
+	// on the new side for Hold
+	Hold time.Duration
+	// MonitorURL is the asynqmon base URL linked from events
+	MonitorURL string
+}
+
+// NewWatcher creates a watcher; notify usually enqueues a TypeDeliver task
+func NewWatcher(inspector *asynq.Inspector, rdb redis.UniversalClient, thresholds Thresholds, notify func(ctx context.Context, e Event) error) *Watcher {
+	return &Watcher{inspector: inspector, rdb: rdb, thresholds: thresholds, notify: notify, Hold: DefaultHold, MonitorURL: os.Getenv("ASYNQMON_URL")}
+}
+
+// Check compares every queue with its threshold and notifies the crossings
+// that held long enough
+func (w *Watcher) Check(ctx context.Context) error {
+	names, err := w.queues()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, q := range names {
+		threshold := w.thresholds.For(q)
+		if threshold == 0 {
+			continue
+		}
+		// A queue that does not exist (any more) has nothing pending
+		pending := 0
+		if info, err := w.inspector.GetQueueInfo(q); err == nil {
+			pending = info.Pending
+		} else if !errors.Is(err, asynq.ErrQueueNotFound) {
+			return fmt.Errorf("failed to get queue %s: %v", q, err)
+		}
+		kind := KindRecovered
+		want := "ok"
+		if pending >= threshold {
+			kind, want = KindBreached, KindBreached
+		}
+		moved, err := transitionScript.Run(ctx, w.rdb, []string{StateKey}, q, want, now.Unix(), int64(w.Hold.Seconds())).Int()
+		if err != nil {
+			return fmt.Errorf("failed to update threshold state of %s: %v", q, err)
+		}
+		if moved == 0 {
+			continue
+		}
+		e := Event{Kind: kind, Queue: q, Count: pending, Threshold: threshold, Link: w.link(q), At: now.UTC()}
+		log.Printf("⚠️  Queue %s %s its threshold: %d pending, threshold %d", q, kind, pending, threshold)
+		if err := w.notify(ctx, e); err != nil {
+			return fmt.Errorf("failed to notify %s of queue %s: %v", kind, q, err)
+		}
+	}
+	return nil
+}
+
+// queues returns the queues to check
+func (w *Watcher) queues() ([]string, error) {
+	if _, ok := w.thresholds[AllQueues]; ok {
+		names, err := w.inspector.Queues()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list queues: %v", err)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	names := make([]string, 0, len(w.thresholds))
+	for q := range w.thresholds {
+		names = append(names, q)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (w *Watcher) link(q string) string {
+	if w.MonitorURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(w.MonitorURL, "/") + "/queues/" + url.PathEscape(q)
+}
+
+// After runs next, then checks the queues, so the thresholds are watched on
+// the schedule of an existing periodic task. Check errors are logged
+// without failing the task.
+func (w *Watcher) After(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if err := next.ProcessTask(ctx, t); err != nil {
+			return err
+		}
+		if err := w.Check(ctx); err != nil {
+			log.Printf("❌ Failed to check queue thresholds: %v", err)
+		}
+		return nil
+	})
+}
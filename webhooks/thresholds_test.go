@@ -0,0 +1,126 @@
+package webhooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/webhooks"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestThresholdWebhooks drives a synthetic backlog across a threshold of 3
+// and back, checking several times on each side, and fails unless the
+// receiver got exactly one signed breached and one recovered notification.
+// A crossing that does not hold is not notified.
+func TestThresholdWebhooks(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	r := srv.ConnOpt()
+	const (
+		queue     = "webhooks-test"
+		threshold = 3
+	)
+	ctx := context.Background()
+	rdb, ok := r.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		t.Fatalf("unsupported redis connection %T", r)
+	}
+	defer rdb.Close()
+	inspector := asynq.NewInspector(r)
+	defer inspector.Close()
+	client := asynq.NewClient(r)
+	defer client.Close()
+
+	secret := []byte("webhooks-test-secret")
+	var (
+		mu       sync.Mutex
+		received []webhooks.Event
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if err := webhooks.Verify(secret, req.Header, body); err != nil {
+			t.Errorf("delivery failed verification: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e webhooks.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("invalid delivery body %s: %v", body, err)
+		}
+		mu.Lock()
+		received = append(received, e)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	deliverer := &webhooks.Deliverer{URL: receiver.URL, Secret: secret}
+	watcher := webhooks.NewWatcher(inspector, rdb, webhooks.Thresholds{queue: threshold}, deliverer.Deliver)
+	watcher.MonitorURL = "http://asynqmon.test"
+
+	fill := func(n int) {
+		t.Helper()
+		inspector.DeleteQueue(queue, true)
+		for i := 0; i < n; i++ {
+			if _, err := client.Enqueue(asynq.NewTask("webhooks:probe", nil), asynq.Queue(queue)); err != nil {
+				t.Fatalf("failed to enqueue: %v", err)
+			}
+		}
+	}
+	check := func(times int) {
+		t.Helper()
+		for i := 0; i < times; i++ {
+			if err := watcher.Check(ctx); err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+		}
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received)
+	}
+
+	// Flapping: a breach lasting less than the hold is not notified
+	watcher.Hold = time.Hour
+	fill(threshold + 2)
+	check(2)
+	fill(1)
+	check(2)
+	if n := count(); n != 0 {
+		t.Fatalf("flapping within the hold sent %d notifications", n)
+	}
+
+	watcher.Hold = 0
+	fill(threshold + 2)
+	check(3)
+	if n := count(); n != 1 {
+		t.Fatalf("backlog above the threshold sent %d notifications, want 1", n)
+	}
+	fill(1)
+	check(3)
+	if n := count(); n != 2 {
+		t.Fatalf("backlog back below the threshold sent %d notifications in total, want 2", n)
+	}
+
+	want := []webhooks.Event{
+		{Kind: webhooks.KindBreached, Queue: queue, Count: threshold + 2, Threshold: threshold, Link: "http://asynqmon.test/queues/" + queue},
+		{Kind: webhooks.KindRecovered, Queue: queue, Count: 1, Threshold: threshold, Link: "http://asynqmon.test/queues/" + queue},
+	}
+	for i, got := range received {
+		got.At = time.Time{}
+		if got != want[i] {
+			t.Errorf("notification %d is %+v, want %+v", i+1, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Package webhooks delivers signed outbound webhooks, such as queue threshold
+// notifications, to the URL on-call tooling listens on.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"asynqdemo/admin"
+	"asynqdemo/circuit"
+	"asynqdemo/common"
+
+	"github.com/hibiken/asynq"
+)
+
+// TypeDeliver posts one event to the configured webhook URL
+const TypeDeliver = "webhook:deliver"
+
+// Event kinds
+const (
+	KindBreached  = "breached"
+	KindRecovered = "recovered"
+	KindTest      = "test"
+)
+
+// Headers set on every delivery. The signature is "sha256=" followed by the
+// hex HMAC-SHA256 of the timestamp, a dot and the body.
+const (
+	HeaderSignature = "X-Webhook-Signature"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+)
+
+// Event is the body of a webhook
+type Event struct {
+	Kind      string `json:"kind"`
+	Queue     string `json:"queue"`
+	Count     int    `json:"count"`
+	Threshold int    `json:"threshold"`
+	// Link opens the queue in asynqmon; empty without ASYNQMON_URL
+	Link string    `json:"link,omitempty"`
+	At   time.Time `json:"at"`
+}
+
+// deliverOptions put deliveries on the critical queue and retry receivers that are down
+var deliverOptions = []asynq.Option{asynq.Queue("critical"), asynq.MaxRetry(10), asynq.Timeout(30 * time.Second)}
+
+func init() {
+	common.RegisterTaskSpec(common.TaskSpec{Type: TypeDeliver, NewPayload: func() interface{} { return &Event{} }, DefaultOptions: deliverOptions})
+}
+
+// NewDeliverTask creates a task delivering e
+func NewDeliverTask(e Event) (*asynq.Task, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook event: %v", err)
+	}
+	return asynq.NewTask(TypeDeliver, payload, deliverOptions...), nil
+}
+
+// Sign returns the signature header value of body sent at timestamp
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrInvalidSignature is returned by Verify for requests not signed with the secret
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Verify checks the signature headers of a delivery the way receivers should
+func Verify(secret []byte, h http.Header, body []byte) error {
+	ts, err := strconv.ParseInt(h.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(h.Get(HeaderSignature)), []byte(Sign(secret, ts, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Deliverer posts events to a URL and handles TypeDeliver tasks
+type Deliverer struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+	// Breaker defers deliveries while the receiver is down; nil always posts
+	Breaker *circuit.Breaker
+}
+
+// DelivererFromEnv returns a deliverer for WEBHOOK_URL signed with
+// WEBHOOK_SECRET, nil when WEBHOOK_URL is unset
+func DelivererFromEnv() (*Deliverer, error) {
+	url := os.Getenv("WEBHOOK_URL")
+	if url == "" {
+		return nil, nil
+	}
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("WEBHOOK_SECRET must be at least 16 bytes")
+	}
+	return &Deliverer{URL: url, Secret: []byte(secret), Client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Deliver posts e and fails unless the receiver answers with a 2xx status.
+// A 429 or 503 with Retry-After fails with circuit.ErrRetryAfter.
+func (d *Deliverer) Deliver(ctx context.Context, e Event) error {
+	if d.Breaker == nil {
+		return d.deliver(ctx, e)
+	}
+	return d.Breaker.Do(ctx, func(ctx context.Context) error {
+		return d.deliver(ctx, e)
+	})
+}
+
+func (d *Deliverer) deliver(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %v", err)
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(d.Secret, ts, body))
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to deliver webhook: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("webhook returned %s", resp.Status)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if after, ok := circuit.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				return circuit.ErrRetryAfter{Err: err, After: after}
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// ProcessTask delivers the event of a TypeDeliver task
+func (d *Deliverer) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	var e Event
+	if err := json.Unmarshal(t.Payload(), &e); err != nil {
+		return fmt.Errorf("failed to unmarshal webhook event: %v", err)
+	}
+	return d.Deliver(ctx, e)
+}
+
+// TestHandler serves POST /admin/test-webhook by delivering a test event
+// right away and reporting whether the receiver accepted it
+func TestHandler(d *Deliverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if d == nil {
+			admin.WriteError(w, http.StatusServiceUnavailable, "WEBHOOK_URL is not set")
+			return
+		}
+		e := Event{Kind: KindTest, Queue: r.URL.Query().Get("queue"), At: time.Now().UTC()}
+		if err := d.Deliver(r.Context(), e); err != nil {
+			admin.WriteError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"delivered": true, "url": d.URL, "event": e})
+	})
+}
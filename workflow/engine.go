@@ -0,0 +1,395 @@
+// Package workflow runs declarative, parameterized workflows defined in
+// JSON. A step runs once every step it depends on completed: executing a
+// template enqueues the steps without dependencies, and the Middleware of
+// the Engine enqueues the others as their last dependency succeeds.
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// StateTTL bounds how long the steps of a run wait for their dependencies
+var StateTTL = 7 * 24 * time.Hour
+
+// taskIDPrefix starts the task IDs of workflow steps
+const taskIDPrefix = "workflow:"
+
+// WorkflowTemplate is a declarative, parameterized workflow definition
+type WorkflowTemplate struct {
+	Name  string         `json:"name"`
+	Steps []TemplateStep `json:"steps"`
+}
+
+// TemplateStep describes a single task of a workflow template
+type TemplateStep struct {
+	// Name identifies the step for DependsOn, defaults to TaskType
+	Name            string   `json:"name,omitempty"`
+	TaskType        string   `json:"task_type"`
+	PayloadTemplate string   `json:"payload_template"`
+	DependsOn       []string `json:"depends_on,omitempty"`
+	Queue           string   `json:"queue,omitempty"`
+}
+
+// TaskDependency records that the task of step Step must run after the task of step DependsOn
+type TaskDependency struct {
+	Step      string
+	DependsOn string
+}
+
+// LoadTemplate decodes a workflow template from JSON
+func LoadTemplate(r io.Reader) (WorkflowTemplate, error) {
+	var t WorkflowTemplate
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return t, fmt.Errorf("failed to decode workflow template: %v", err)
+	}
+	return t, nil
+}
+
+// LoadTemplateFile reads a workflow template from a JSON file
+func LoadTemplateFile(path string) (WorkflowTemplate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return WorkflowTemplate{}, fmt.Errorf("failed to open workflow template: %v", err)
+	}
+	defer f.Close()
+	return LoadTemplate(f)
+}
+
+// Instantiate renders every step payload with params and returns the tasks
+// (in step order) together with the dependency graph
+func Instantiate(t WorkflowTemplate, params map[string]interface{}) ([]*asynq.Task, []TaskDependency, error) {
+	steps, err := normalize(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tasks := make([]*asynq.Task, 0, len(steps))
+	var deps []TaskDependency
+	for _, step := range steps {
+		payload, err := render(t.Name, step, params)
+		if err != nil {
+			return nil, nil, err
+		}
+		var opts []asynq.Option
+		if step.Queue != "" {
+			opts = append(opts, asynq.Queue(step.Queue))
+		}
+		tasks = append(tasks, asynq.NewTask(step.TaskType, payload, opts...))
+		for _, d := range step.DependsOn {
+			deps = append(deps, TaskDependency{Step: step.Name, DependsOn: d})
+		}
+	}
+	return tasks, deps, nil
+}
+
+// Engine runs workflow templates, keeping the steps that wait for their
+// dependencies in Redis
+type Engine struct {
+	client *asynq.Client
+	rdb    redis.UniversalClient
+}
+
+// NewEngine returns an engine enqueueing through client
+func NewEngine(client *asynq.Client, rdb redis.UniversalClient) *Engine {
+	return &Engine{client: client, rdb: rdb}
+}
+
+// TaskID is the task ID of a step of a workflow run
+func TaskID(runID, step string) string {
+	return taskIDPrefix + runID + ":" + step
+}
+
+// parseTaskID returns the run and step of a workflow task ID
+func parseTaskID(id string) (runID, step string, ok bool) {
+	if !strings.HasPrefix(id, taskIDPrefix) {
+		return "", "", false
+	}
+	runID, step, ok = strings.Cut(strings.TrimPrefix(id, taskIDPrefix), ":")
+	return runID, step, ok && runID != "" && step != ""
+}
+
+// stateKey is a key of the state of a run; the hash tag keeps the keys of
+// a run in one cluster slot
+func stateKey(runID, part string) string {
+	return fmt.Sprintf("workflow:{%s}:%s", runID, part)
+}
+
+// stateKeys are the keys of completeScript
+func stateKeys(runID string) []string {
+	return []string{stateKey(runID, "done"), stateKey(runID, "waiting"), stateKey(runID, "dependents"), stateKey(runID, "tasks")}
+}
+
+// pendingStep is a step waiting for its dependencies
+type pendingStep struct {
+	Type    string `json:"type"`
+	Payload []byte `json:"payload"`
+	Queue   string `json:"queue,omitempty"`
+}
+
+// ExecuteTemplate instantiates the template, stores the steps with
+// dependencies and enqueues the others. The returned task IDs are in step
+// order; those of waiting steps are enqueued by the Middleware once their
+// dependencies complete. It is a method rather than a function of a client
+// because the waiting steps are kept in the Engine's Redis.
+func (e *Engine) ExecuteTemplate(ctx context.Context, t WorkflowTemplate, params map[string]interface{}) ([]string, error) {
+	steps, err := normalize(t)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCycles(steps); err != nil {
+		return nil, err
+	}
+	tasks, _, err := Instantiate(t, params)
+	if err != nil {
+		return nil, err
+	}
+
+	runID, err := newRunID()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(steps))
+	dependents := map[string][]string{}
+	pipe := e.rdb.TxPipeline()
+	for i, step := range steps {
+		ids[i] = TaskID(runID, step.Name)
+		if len(step.DependsOn) == 0 {
+			continue
+		}
+		data, err := json.Marshal(pendingStep{Type: step.TaskType, Payload: tasks[i].Payload(), Queue: step.Queue})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal step %q: %v", step.Name, err)
+		}
+		pipe.HSet(ctx, stateKey(runID, "tasks"), step.Name, data)
+		pipe.HSet(ctx, stateKey(runID, "waiting"), step.Name, len(step.DependsOn))
+		for _, d := range step.DependsOn {
+			dependents[d] = append(dependents[d], step.Name)
+		}
+	}
+	if len(dependents) > 0 {
+		for parent, children := range dependents {
+			data, err := json.Marshal(children)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal dependents of step %q: %v", parent, err)
+			}
+			pipe.HSet(ctx, stateKey(runID, "dependents"), parent, data)
+		}
+		for _, key := range stateKeys(runID)[1:] {
+			pipe.Expire(ctx, key, StateTTL)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to store workflow run %s: %v", runID, err)
+		}
+	}
+
+	for i, step := range steps {
+		if len(step.DependsOn) > 0 {
+			continue
+		}
+		if _, err := e.client.EnqueueContext(ctx, tasks[i], asynq.TaskID(ids[i])); err != nil {
+			return ids, fmt.Errorf("failed to enqueue step %q: %v", step.Name, err)
+		}
+	}
+	return ids, nil
+}
+
+// completeScript marks a step of a run done, once, and returns the name and
+// pending task of every dependent whose dependencies all completed and that
+// is not enqueued yet
+//
+// KEYS[1] done set, KEYS[2] waiting counts, KEYS[3] dependents, KEYS[4] pending tasks
+// ARGV[1] step, ARGV[2] TTL in seconds
+var completeScript = redis.NewScript(`
+local children = redis.call("HGET", KEYS[3], ARGV[1])
+if not children then
+  return {}
+end
+children = cjson.decode(children)
+if redis.call("SADD", KEYS[1], ARGV[1]) == 1 then
+  redis.call("EXPIRE", KEYS[1], ARGV[2])
+  for _, c in ipairs(children) do
+    redis.call("HINCRBY", KEYS[2], c, -1)
+  end
+end
+local ready = {}
+for _, c in ipairs(children) do
+  local task = redis.call("HGET", KEYS[4], c)
+  if task and tonumber(redis.call("HGET", KEYS[2], c) or "1") <= 0 then
+    table.insert(ready, c)
+    table.insert(ready, task)
+  end
+end
+return ready
+`)
+
+// Middleware enqueues the dependents of workflow steps whose dependencies
+// all completed once a step's handler succeeds. A step retried because its
+// dependents could not be enqueued does not count twice.
+func (e *Engine) Middleware() asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			if err := next.ProcessTask(ctx, task); err != nil {
+				return err
+			}
+			id, _ := asynq.GetTaskID(ctx)
+			runID, step, ok := parseTaskID(id)
+			if !ok {
+				return nil
+			}
+			return e.complete(ctx, runID, step)
+		})
+	}
+}
+
+// complete records that step succeeded and enqueues the dependents it made ready
+func (e *Engine) complete(ctx context.Context, runID, step string) error {
+	ready, err := completeScript.Run(ctx, e.rdb, stateKeys(runID), step, int(StateTTL.Seconds())).StringSlice()
+	if err != nil {
+		return fmt.Errorf("failed to complete step %q of workflow run %s: %v", step, runID, err)
+	}
+	for i := 0; i+1 < len(ready); i += 2 {
+		name := ready[i]
+		var p pendingStep
+		if err := json.Unmarshal([]byte(ready[i+1]), &p); err != nil {
+			return fmt.Errorf("invalid step %q of workflow run %s: %v", name, runID, err)
+		}
+		opts := []asynq.Option{asynq.TaskID(TaskID(runID, name))}
+		if p.Queue != "" {
+			opts = append(opts, asynq.Queue(p.Queue))
+		}
+		if _, err := e.client.EnqueueContext(ctx, asynq.NewTask(p.Type, p.Payload), opts...); err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+			return fmt.Errorf("failed to enqueue step %q of workflow run %s: %v", name, runID, err)
+		}
+		if err := e.rdb.HDel(ctx, stateKey(runID, "tasks"), name).Err(); err != nil {
+			return fmt.Errorf("failed to clear step %q of workflow run %s: %v", name, runID, err)
+		}
+	}
+	return nil
+}
+
+// normalize fills in default step names and checks the template for obvious mistakes
+func normalize(t WorkflowTemplate) ([]TemplateStep, error) {
+	if len(t.Steps) == 0 {
+		return nil, fmt.Errorf("workflow template %q has no steps", t.Name)
+	}
+	steps := make([]TemplateStep, len(t.Steps))
+	seen := make(map[string]bool, len(t.Steps))
+	for i, s := range t.Steps {
+		if s.TaskType == "" {
+			return nil, fmt.Errorf("step %d of workflow template %q has no task type", i, t.Name)
+		}
+		if s.Name == "" {
+			s.Name = s.TaskType
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("duplicate step %q in workflow template %q", s.Name, t.Name)
+		}
+		seen[s.Name] = true
+		steps[i] = s
+	}
+	for _, s := range steps {
+		deps := make(map[string]bool, len(s.DependsOn))
+		for _, d := range s.DependsOn {
+			if !seen[d] {
+				return nil, fmt.Errorf("step %q depends on unknown step %q", s.Name, d)
+			}
+			if deps[d] {
+				return nil, fmt.Errorf("step %q depends on step %q twice", s.Name, d)
+			}
+			deps[d] = true
+		}
+	}
+	return steps, nil
+}
+
+// checkCycles fails when steps depend on each other in a cycle, which would
+// leave them waiting forever
+func checkCycles(steps []TemplateStep) error {
+	index := make(map[string]int, len(steps))
+	for i, s := range steps {
+		index[s.Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(steps))
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("dependency cycle at step %q", steps[i].Name)
+		case done:
+			return nil
+		}
+		state[i] = visiting
+		for _, d := range steps[i].DependsOn {
+			if err := visit(index[d]); err != nil {
+				return err
+			}
+		}
+		state[i] = done
+		return nil
+	}
+
+	for i := range steps {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render executes a step's payload template and checks that the result is valid JSON
+func render(workflow string, step TemplateStep, params map[string]interface{}) ([]byte, error) {
+	tmpl, err := template.New(step.Name).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"json": toJSON}).
+		Parse(step.PayloadTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse payload template of step %q: %v", step.Name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, params); err != nil {
+		return nil, fmt.Errorf("failed to render payload of step %q: %v", step.Name, err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("rendered payload of step %q in workflow %q is not valid JSON", step.Name, workflow)
+	}
+	return buf.Bytes(), nil
+}
+
+// toJSON lets templates embed parameters as properly quoted JSON values
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func newRunID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate workflow run id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
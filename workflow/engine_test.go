@@ -0,0 +1,187 @@
+package workflow_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"asynqdemo/embeddedredis"
+	"asynqdemo/workflow"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// onboarding is a 3-step template: the welcome and the profile step run
+// after the signup step
+var onboarding = workflow.WorkflowTemplate{
+	Name: "onboarding",
+	Steps: []workflow.TemplateStep{
+		{Name: "signup", TaskType: "user:signup", PayloadTemplate: `{"user_id": {{.user_id}}, "email": {{json .email}}}`},
+		{Name: "welcome", TaskType: "email:welcome", PayloadTemplate: `{"user_id": {{.user_id}}, "subject": {{json .subject}}}`, DependsOn: []string{"signup"}, Queue: "critical"},
+		{Name: "profile", TaskType: "user:profile", PayloadTemplate: `{"user_id": {{.user_id}}}`, DependsOn: []string{"signup"}},
+	},
+}
+
+func TestInstantiate(t *testing.T) {
+	params := map[string]interface{}{"user_id": 42, "email": "ada@example.com", "subject": `Hi "Ada"`}
+	tasks, deps, err := workflow.Instantiate(onboarding, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		taskType string
+		payload  map[string]interface{}
+	}{
+		{"user:signup", map[string]interface{}{"user_id": 42.0, "email": "ada@example.com"}},
+		{"email:welcome", map[string]interface{}{"user_id": 42.0, "subject": `Hi "Ada"`}},
+		{"user:profile", map[string]interface{}{"user_id": 42.0}},
+	}
+	if len(tasks) != len(want) {
+		t.Fatalf("got %d tasks, want %d", len(tasks), len(want))
+	}
+	for i, w := range want {
+		var got map[string]interface{}
+		if err := json.Unmarshal(tasks[i].Payload(), &got); err != nil {
+			t.Fatalf("payload of %s: %v", w.taskType, err)
+		}
+		if tasks[i].Type() != w.taskType || len(got) != len(w.payload) {
+			t.Errorf("task %d: %s %s, want %s %v", i, tasks[i].Type(), tasks[i].Payload(), w.taskType, w.payload)
+			continue
+		}
+		for k, v := range w.payload {
+			if got[k] != v {
+				t.Errorf("%s payload %s = %v, want %v", w.taskType, k, got[k], v)
+			}
+		}
+	}
+	if len(deps) != 2 || deps[0] != (workflow.TaskDependency{Step: "welcome", DependsOn: "signup"}) || deps[1] != (workflow.TaskDependency{Step: "profile", DependsOn: "signup"}) {
+		t.Errorf("got dependencies %+v", deps)
+	}
+
+	if _, _, err := workflow.Instantiate(onboarding, map[string]interface{}{"user_id": 42}); err == nil {
+		t.Error("missing parameter accepted")
+	}
+	for _, steps := range [][]workflow.TemplateStep{
+		{{Name: "a", TaskType: "t", PayloadTemplate: `{}`, DependsOn: []string{"b"}}},
+		{{Name: "a", TaskType: "t", PayloadTemplate: `{}`}, {Name: "a", TaskType: "t", PayloadTemplate: `{}`}},
+		{{Name: "a", TaskType: "t", PayloadTemplate: `{`}},
+	} {
+		if _, _, err := workflow.Instantiate(workflow.WorkflowTemplate{Name: "bad", Steps: steps}, nil); err == nil {
+			t.Errorf("steps %+v accepted", steps)
+		}
+	}
+}
+
+// TestExecuteTemplate runs a diamond workflow on a worker with the engine's
+// middleware and fails unless dependents are enqueued only once all their
+// dependencies succeeded, a failing step holds back its dependents until
+// its retry succeeds, and cycles are refused before anything is enqueued.
+func TestExecuteTemplate(t *testing.T) {
+	srv, err := embeddedredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rdb := srv.ConnOpt().MakeRedisClient().(redis.UniversalClient)
+	defer rdb.Close()
+	client := asynq.NewClient(srv.ConnOpt())
+	defer client.Close()
+	inspector := asynq.NewInspector(srv.ConnOpt())
+	defer inspector.Close()
+	engine := workflow.NewEngine(client, rdb)
+	ctx := context.Background()
+
+	diamond := workflow.WorkflowTemplate{
+		Name: "diamond",
+		Steps: []workflow.TemplateStep{
+			{Name: "a", TaskType: "step", PayloadTemplate: `{"step": "a"}`},
+			{Name: "b", TaskType: "step", PayloadTemplate: `{"step": "b"}`, DependsOn: []string{"a"}},
+			{Name: "c", TaskType: "step", PayloadTemplate: `{"step": "c", "n": {{.n}}}`, DependsOn: []string{"a"}},
+			{Name: "d", TaskType: "step", PayloadTemplate: `{"step": "d"}`, DependsOn: []string{"b", "c"}},
+		},
+	}
+	cyclic := workflow.WorkflowTemplate{Name: "cyclic", Steps: []workflow.TemplateStep{
+		{Name: "x", TaskType: "step", PayloadTemplate: `{}`, DependsOn: []string{"y"}},
+		{Name: "y", TaskType: "step", PayloadTemplate: `{}`, DependsOn: []string{"x"}},
+	}}
+	if _, err := engine.ExecuteTemplate(ctx, cyclic, nil); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("cyclic template gave %v", err)
+	}
+
+	ids, err := engine.ExecuteTemplate(ctx, diamond, map[string]interface{}{"n": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 4 || !strings.HasPrefix(ids[0], "workflow:") || !strings.HasSuffix(ids[3], ":d") {
+		t.Fatalf("got task IDs %v", ids)
+	}
+	// Only the step without dependencies is enqueued
+	if pending, err := inspector.ListPendingTasks("default"); err != nil || len(pending) != 1 || pending[0].ID != ids[0] {
+		t.Fatalf("pending before the worker started: %v (%v)", pending, err)
+	}
+
+	var (
+		mu       sync.Mutex
+		ran      []string
+		failedC  bool
+		payloadC string
+	)
+	mux := asynq.NewServeMux()
+	mux.Use(engine.Middleware())
+	mux.HandleFunc("step", func(ctx context.Context, task *asynq.Task) error {
+		var p struct {
+			Step string `json:"step"`
+		}
+		if err := json.Unmarshal(task.Payload(), &p); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Step == "c" && !failedC {
+			failedC = true
+			return errors.New("first attempt of c fails")
+		}
+		if p.Step == "c" {
+			payloadC = string(task.Payload())
+		}
+		ran = append(ran, p.Step)
+		return nil
+	})
+	worker := asynq.NewServer(srv.ConnOpt(), asynq.Config{
+		Concurrency:    2,
+		LogLevel:       asynq.FatalLevel,
+		RetryDelayFunc: func(int, error, *asynq.Task) time.Duration { return time.Second },
+	})
+	if err := worker.Start(mux); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Shutdown()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		done := len(ran) == 4
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			mu.Lock()
+			t.Fatalf("ran %v, want all 4 steps", ran)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ran[0] != "a" || ran[3] != "d" {
+		t.Errorf("ran %v, want a first and d after b and c", ran)
+	}
+	if payloadC != `{"step": "c", "n": 7}` {
+		t.Errorf("step c ran with %s", payloadC)
+	}
+}